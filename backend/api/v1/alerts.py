@@ -9,7 +9,7 @@ import logging
 import sys
 import os
 sys.path.append(os.path.dirname(os.path.dirname(__file__)))
-from core.alert_engine import alert_engine
+from core.alert_engine import alert_engine, MaintenanceWindow
 
 logger = logging.getLogger(__name__)
 
@@ -83,8 +83,8 @@ async def get_metric_history(metric_name: str, hours: int = 24) -> Dict[str, Any
         history = alert_engine.metrics_history[metric_name]
         
         # Limit to requested timeframe
-        from datetime import datetime, timedelta
-        cutoff_time = datetime.now() - timedelta(hours=hours)
+        from datetime import datetime, timedelta, timezone
+        cutoff_time = datetime.now(timezone.utc) - timedelta(hours=hours)
         filtered_history = [
             {"timestamp": timestamp.isoformat(), "value": value}
             for timestamp, value in history
@@ -127,6 +127,57 @@ async def reset_baselines() -> Dict[str, Any]:
         logger.error(f"Failed to reset baselines: {e}")
         raise HTTPException(status_code=500, detail=f"Failed to reset baselines: {str(e)}")
 
+@router.get("/rules")
+async def get_alert_rules() -> Dict[str, Any]:
+    """Get per-rule dedup keys, cool-downs and maintenance windows"""
+    try:
+        return {
+            "success": True,
+            "data": alert_engine._rule_config()
+        }
+    except Exception as e:
+        logger.error(f"Failed to get alert rules: {e}")
+        raise HTTPException(status_code=500, detail=f"Failed to get alert rules: {str(e)}")
+
+@router.put("/rules/{metric_name}")
+async def update_alert_rule(metric_name: str, rule: Dict[str, Any]) -> Dict[str, Any]:
+    """Update the notification policy (dedup_key, cooldown_seconds, silences) of a rule"""
+    if metric_name not in alert_engine.thresholds:
+        raise HTTPException(status_code=404, detail=f"Unknown alert rule: {metric_name}")
+    try:
+        alert_engine._apply_rule_config({metric_name: rule})
+        alert_engine._save_persistent_data()
+        return {
+            "success": True,
+            "data": alert_engine._rule_config()[metric_name]
+        }
+    except (TypeError, ValueError) as e:
+        raise HTTPException(status_code=400, detail=f"Invalid alert rule: {str(e)}")
+
+@router.post("/rules/{metric_name}/silences")
+async def add_silence(metric_name: str, window: Dict[str, Any]) -> Dict[str, Any]:
+    """Silence notifications for a rule during a maintenance window"""
+    if metric_name not in alert_engine.thresholds:
+        raise HTTPException(status_code=404, detail=f"Unknown alert rule: {metric_name}")
+    try:
+        silence = alert_engine.add_silence(metric_name, MaintenanceWindow.from_dict(window))
+        return {
+            "success": True,
+            "data": silence.to_dict()
+        }
+    except (TypeError, ValueError) as e:
+        raise HTTPException(status_code=400, detail=f"Invalid maintenance window: {str(e)}")
+
+@router.delete("/silences/{window_id}")
+async def remove_silence(window_id: str) -> Dict[str, Any]:
+    """Remove a maintenance window"""
+    if not alert_engine.remove_silence(window_id):
+        raise HTTPException(status_code=404, detail=f"Unknown maintenance window: {window_id}")
+    return {
+        "success": True,
+        "message": f"Maintenance window {window_id} removed"
+    }
+
 @router.get("/status")
 async def get_alert_engine_status() -> Dict[str, Any]:
     """Get status and configuration of the alert engine"""
@@ -142,7 +193,15 @@ async def get_alert_engine_status() -> Dict[str, Any]:
             "total_historical_points": {
                 metric: len(history) for metric, history in alert_engine.metrics_history.items()
             },
-            "max_history_size": alert_engine.max_history_size
+            "max_history_size": alert_engine.max_history_size,
+            "notification_state": {
+                key: {
+                    "occurrences": state.occurrences,
+                    "suppressed": state.suppressed,
+                    "last_notified": state.last_notified.isoformat() if state.last_notified else None
+                }
+                for key, state in alert_engine.notification_state.items()
+            }
         }
         
         return {
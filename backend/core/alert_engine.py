@@ -8,14 +8,102 @@ import time
 import json
 import asyncio
 from typing import Dict, List, Optional, Tuple
-from datetime import datetime, timedelta
-from dataclasses import dataclass, asdict
+from datetime import datetime, timedelta, timezone
+from dataclasses import dataclass, asdict, field
 from pathlib import Path
 import statistics
 import logging
+import re
+import uuid
 
 logger = logging.getLogger(__name__)
 
+# Recurring maintenance windows start and end at zero-padded "HH:MM"
+CLOCK_TIME = re.compile(r'^([01]\d|2[0-3]):[0-5]\d$')
+
+def to_utc(value: datetime) -> datetime:
+    """Normalize a datetime to UTC; naive ones are taken as local time"""
+    if value.tzinfo is None:
+        value = value.astimezone()
+    return value.astimezone(timezone.utc)
+
+def parse_time(value: str) -> datetime:
+    """Parse an ISO 8601 time, with or without an offset, into UTC"""
+    return to_utc(datetime.fromisoformat(value))
+
+@dataclass
+class MaintenanceWindow:
+    """Silence window for a rule, either one-off or recurring weekly"""
+    window_id: str
+    reason: str = ""
+    # One-off window
+    starts_at: Optional[datetime] = None
+    ends_at: Optional[datetime] = None
+    # Recurring window: weekdays (0=Monday) and zero-padded "HH:MM" local
+    # times
+    weekdays: List[int] = field(default_factory=list)
+    start_time: Optional[str] = None
+    end_time: Optional[str] = None
+
+    def is_active(self, now: datetime) -> bool:
+        """Check whether the window silences notifications at the given time"""
+        now = to_utc(now)
+        if self.starts_at or self.ends_at:
+            if self.starts_at and now < self.starts_at:
+                return False
+            if self.ends_at and now >= self.ends_at:
+                return False
+            return True
+
+        if not self.start_time or not self.end_time:
+            return False
+        now = now.astimezone()
+        current = now.strftime("%H:%M")
+        weekday = now.weekday()
+        if self.start_time <= self.end_time:
+            active = self.start_time <= current < self.end_time
+        elif current >= self.start_time:
+            # Window wraps past midnight, e.g. 22:00-02:00
+            active = True
+        else:
+            # After midnight, the window started the day before
+            active = current < self.end_time
+            weekday = (weekday - 1) % 7
+        return active and (not self.weekdays or weekday in self.weekdays)
+
+    def is_expired(self, now: datetime) -> bool:
+        """One-off windows expire once they end; recurring ones never do"""
+        return self.ends_at is not None and to_utc(now) >= self.ends_at
+
+    def to_dict(self) -> Dict:
+        data = asdict(self)
+        data['starts_at'] = self.starts_at.isoformat() if self.starts_at else None
+        data['ends_at'] = self.ends_at.isoformat() if self.ends_at else None
+        return data
+
+    @classmethod
+    def from_dict(cls, data: Dict) -> 'MaintenanceWindow':
+        for key in ('start_time', 'end_time'):
+            value = data.get(key)
+            if value is not None and not (isinstance(value, str) and CLOCK_TIME.match(value)):
+                raise ValueError(f"{key} must be a zero-padded HH:MM time, not {value!r}")
+        if bool(data.get('start_time')) != bool(data.get('end_time')):
+            raise ValueError("start_time and end_time must be given together")
+        weekdays = data.get('weekdays') or []
+        if not isinstance(weekdays, list) or not all(
+            isinstance(day, int) and not isinstance(day, bool) and 0 <= day <= 6 for day in weekdays
+        ):
+            raise ValueError(f"weekdays must be a list of days 0-6 (0=Monday), not {weekdays!r}")
+        return cls(
+            window_id=data.get('window_id') or uuid.uuid4().hex[:12],
+            reason=data.get('reason', ''),
+            starts_at=parse_time(data['starts_at']) if data.get('starts_at') else None,
+            ends_at=parse_time(data['ends_at']) if data.get('ends_at') else None,
+            weekdays=list(weekdays),
+            start_time=data.get('start_time'),
+            end_time=data.get('end_time'),
+        )
+
 @dataclass
 class AlertThreshold:
     """Dynamic alert threshold configuration"""
@@ -26,6 +114,11 @@ class AlertThreshold:
     baseline_std: Optional[float] = None
     adaptive: bool = True
     last_updated: datetime = None
+    # Notification policy: alerts sharing a dedup key notify at most once
+    # per cool-down, and not at all while a maintenance window is active
+    dedup_key: str = "{metric_name}:{severity}"
+    cooldown_seconds: int = 300
+    silences: List[MaintenanceWindow] = field(default_factory=list)
 
 @dataclass
 class SystemAlert:
@@ -39,6 +132,20 @@ class SystemAlert:
     timestamp: datetime
     baseline_deviation: Optional[float] = None
     suggested_actions: List[str] = None
+    dedup_key: Optional[str] = None
+    notify: bool = True
+    occurrences: int = 1
+    silenced_by: Optional[str] = None
+
+@dataclass
+class NotificationState:
+    """Per dedup key bookkeeping for cool-downs and duplicate counts"""
+    metric_name: str
+    first_seen: datetime
+    last_seen: datetime
+    last_notified: Optional[datetime] = None
+    occurrences: int = 0
+    suppressed: int = 0
 
 class AlertEngine:
     """Advanced alerting engine with baseline learning and dynamic thresholds"""
@@ -61,14 +168,18 @@ class AlertEngine:
         self.metrics_history = {}
         self.max_history_size = 1440  # 24 hours at 1 minute intervals
         
-        # Active alerts
+        # Active alerts, keyed by dedup key
         self.active_alerts = {}
         
+        # Notification state per dedup key
+        self.notification_state: Dict[str, NotificationState] = {}
+        
         # Load existing data
         self._load_persistent_data()
         
     def _load_persistent_data(self):
-        """Load historical data and thresholds from disk"""
+        """Load historical data, thresholds and rules from disk; each file
+        loads on its own, so one bad file does not keep the others out"""
         try:
             # Load thresholds
             threshold_file = self.data_dir / "thresholds.json"
@@ -80,10 +191,22 @@ class AlertEngine:
                             # Update threshold with saved data
                             self.thresholds[name].baseline_avg = thresh_data.get('baseline_avg')
                             self.thresholds[name].baseline_std = thresh_data.get('baseline_std')
-                            self.thresholds[name].last_updated = datetime.fromisoformat(
+                            self.thresholds[name].last_updated = parse_time(
                                 thresh_data['last_updated']
                             ) if thresh_data.get('last_updated') else None
-            
+        except Exception as e:
+            logger.warning(f"Failed to load alert thresholds: {e}")
+        
+        try:
+            # Load per-rule notification policy
+            rules_file = self.data_dir / "alert_rules.json"
+            if rules_file.exists():
+                with open(rules_file, 'r') as f:
+                    self._apply_rule_config(json.load(f))
+        except Exception as e:
+            logger.warning(f"Failed to load alert rules: {e}")
+        
+        try:
             # Load metrics history
             history_file = self.data_dir / "metrics_history.json"
             if history_file.exists():
@@ -92,12 +215,113 @@ class AlertEngine:
                     # Convert timestamps back to datetime objects
                     for metric_name, history in history_data.items():
                         self.metrics_history[metric_name] = [
-                            (datetime.fromisoformat(timestamp), value)
+                            (parse_time(timestamp), value)
                             for timestamp, value in history
                         ]
                         
         except Exception as e:
-            logger.warning(f"Failed to load persistent alert data: {e}")
+            logger.warning(f"Failed to load metrics history: {e}")
+    
+    def _apply_rule_config(self, rules: Dict):
+        """Apply dedup keys, cool-downs and silences configured per rule;
+        every rule is validated before any is applied, so an invalid one
+        leaves all of them as they were"""
+        updates = []
+        for name, rule in rules.items():
+            threshold = self.thresholds.get(name)
+            if threshold is None:
+                logger.warning(f"Ignoring alert rule config for unknown metric {name}")
+                continue
+            update = {}
+            if 'dedup_key' in rule:
+                update['dedup_key'] = rule['dedup_key']
+            if 'cooldown_seconds' in rule:
+                update['cooldown_seconds'] = int(rule['cooldown_seconds'])
+            if 'silences' in rule:
+                update['silences'] = [
+                    MaintenanceWindow.from_dict(window) for window in rule['silences']
+                ]
+            updates.append((threshold, update))
+        for threshold, update in updates:
+            for key, value in update.items():
+                setattr(threshold, key, value)
+    
+    def _rule_config(self) -> Dict:
+        """Serialize the per-rule notification policy"""
+        return {
+            name: {
+                'dedup_key': threshold.dedup_key,
+                'cooldown_seconds': threshold.cooldown_seconds,
+                'silences': [window.to_dict() for window in threshold.silences],
+            }
+            for name, threshold in self.thresholds.items()
+        }
+    
+    def add_silence(self, metric_name: str, window: MaintenanceWindow) -> MaintenanceWindow:
+        """Add a maintenance window to a rule and persist it"""
+        if metric_name not in self.thresholds:
+            raise KeyError(metric_name)
+        self.thresholds[metric_name].silences.append(window)
+        self._save_persistent_data()
+        return window
+    
+    def remove_silence(self, window_id: str) -> bool:
+        """Remove a maintenance window from whichever rule holds it"""
+        for threshold in self.thresholds.values():
+            for window in threshold.silences:
+                if window.window_id == window_id:
+                    threshold.silences.remove(window)
+                    self._save_persistent_data()
+                    return True
+        return False
+    
+    def _apply_notification_policy(self, alert: SystemAlert, threshold: AlertThreshold,
+                                   now: datetime) -> SystemAlert:
+        """Deduplicate, cool down and silence an alert before it is notified"""
+        try:
+            alert.dedup_key = threshold.dedup_key.format(
+                metric_name=alert.metric_name, severity=alert.severity
+            )
+        except (KeyError, IndexError, ValueError):
+            alert.dedup_key = f"{alert.metric_name}:{alert.severity}"
+        
+        state = self.notification_state.get(alert.dedup_key)
+        if state is None:
+            state = NotificationState(metric_name=alert.metric_name, first_seen=now, last_seen=now)
+            self.notification_state[alert.dedup_key] = state
+        state.last_seen = now
+        state.occurrences += 1
+        alert.occurrences = state.occurrences
+        
+        # Drop one-off windows that have ended
+        threshold.silences = [w for w in threshold.silences if not w.is_expired(now)]
+        for window in threshold.silences:
+            if window.is_active(now):
+                alert.notify = False
+                alert.silenced_by = window.window_id
+                state.suppressed += 1
+                return alert
+        
+        cooldown = timedelta(seconds=threshold.cooldown_seconds)
+        if state.last_notified is not None and now - state.last_notified < cooldown:
+            alert.notify = False
+            state.suppressed += 1
+            return alert
+        
+        state.last_notified = now
+        return alert
+    
+    def _expire_notification_state(self, firing_keys: set, now: datetime):
+        """Forget keys that stopped firing so the next occurrence notifies"""
+        for key in list(self.notification_state):
+            if key in firing_keys:
+                continue
+            self.active_alerts.pop(key, None)
+            state = self.notification_state[key]
+            rule = self.thresholds.get(state.metric_name)
+            cooldown = timedelta(seconds=rule.cooldown_seconds if rule else 300)
+            if now - state.last_seen >= cooldown:
+                del self.notification_state[key]
     
     def _save_persistent_data(self):
         """Save historical data and thresholds to disk"""
@@ -114,6 +338,9 @@ class AlertEngine:
             with open(self.data_dir / "thresholds.json", 'w') as f:
                 json.dump(threshold_data, f, indent=2)
             
+            with open(self.data_dir / "alert_rules.json", 'w') as f:
+                json.dump(self._rule_config(), f, indent=2)
+            
             # Save metrics history (convert datetime to string)
             history_data = {}
             for metric_name, history in self.metrics_history.items():
@@ -157,7 +384,7 @@ class AlertEngine:
     
     def update_baselines(self, metrics: Dict[str, float]):
         """Update baseline statistics with new metrics"""
-        current_time = datetime.now()
+        current_time = datetime.now(timezone.utc)
         
         for metric_name, value in metrics.items():
             if metric_name not in self.metrics_history:
@@ -210,7 +437,7 @@ class AlertEngine:
     def analyze_metrics_and_generate_alerts(self, metrics: Dict[str, float]) -> List[SystemAlert]:
         """Analyze metrics and generate intelligent alerts"""
         alerts = []
-        current_time = datetime.now()
+        current_time = datetime.now(timezone.utc)
         
         for metric_name, current_value in metrics.items():
             if metric_name not in self.thresholds:
@@ -244,7 +471,6 @@ class AlertEngine:
                     suggested_actions=self._get_suggested_actions(metric_name, 'critical')
                 )
                 alerts.append(alert)
-                self.active_alerts[alert_id] = alert
                 
             elif current_value >= warning_threshold:
                 alert = SystemAlert(
@@ -259,7 +485,6 @@ class AlertEngine:
                     suggested_actions=self._get_suggested_actions(metric_name, 'warning')
                 )
                 alerts.append(alert)
-                self.active_alerts[alert_id] = alert
             
             # Check for significant baseline deviation even if not threshold alert
             elif (baseline_deviation is not None and abs(baseline_deviation) > 2.5):
@@ -276,6 +501,13 @@ class AlertEngine:
                 )
                 alerts.append(alert)
         
+        # Collapse repeats onto their dedup key and decide what to notify
+        for alert in alerts:
+            self._apply_notification_policy(alert, self.thresholds[alert.metric_name], current_time)
+            if alert.severity != 'info':
+                self.active_alerts[alert.dedup_key] = alert
+        self._expire_notification_state({alert.dedup_key for alert in alerts}, current_time)
+        
         return alerts
     
     def _generate_alert_message(self, metric_name: str, value: float, severity: str) -> str:
@@ -362,6 +594,7 @@ class AlertEngine:
         # Store metrics in historical database
         try:
             from .historical_metrics import historical_engine, TimeSeriesPoint
+            # The historical store keeps naive local times throughout
             current_time = datetime.now()
             
             # Store all metrics as time series points
@@ -408,6 +641,7 @@ class AlertEngine:
             'status': status,
             'message': message,
             'alerts': [asdict(alert) for alert in alerts],
+            'notifications': [asdict(alert) for alert in alerts if alert.notify],
             'metrics': metrics,
             'thresholds': {
                 name: {
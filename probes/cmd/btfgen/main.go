@@ -0,0 +1,68 @@
+// Command btfgen writes Go struct definitions for the structs of a compiled
+// eBPF object, read from the object's BTF. Probes run it via go:generate
+// after the object is built:
+//
+//	go run probepilot/cmd/btfgen -obj tcp_flow.o -out tcp_flow_types.go \
+//	    -types tcp_event,flow_key,flow_data -names tcp_event=TCPEvent \
+//	    -checks layoutChecks
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cilium/ebpf/btf"
+
+	"probepilot/pkg/btfgen"
+)
+
+func main() {
+	obj := flag.String("obj", "", "compiled eBPF object to read BTF from")
+	out := flag.String("out", "", "Go file to write (default stdout)")
+	pkg := flag.String("pkg", "main", "package name of the generated file")
+	types := flag.String("types", "", "comma-separated C struct names to generate")
+	names := flag.String("names", "", "comma-separated c_name=GoName overrides for types and fields")
+	checks := flag.String("checks", "", "name of a generated []layout.Check of every struct, for layout.ValidateAll (none if empty)")
+	flag.Parse()
+
+	if err := run(*obj, *out, *pkg, *types, *names, *checks); err != nil {
+		fmt.Fprintf(os.Stderr, "btfgen: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(obj, out, pkg, types, names, checks string) error {
+	if obj == "" || types == "" {
+		return fmt.Errorf("-obj and -types are required")
+	}
+
+	spec, err := btf.LoadSpec(obj)
+	if err != nil {
+		return fmt.Errorf("load BTF from %s: %w", obj, err)
+	}
+
+	overrides, err := btfgen.ParseNames(names)
+	if err != nil {
+		return err
+	}
+
+	src, err := btfgen.Generate(spec, btfgen.Options{
+		Package: pkg,
+		Source:  filepath.Base(obj),
+		Types:   strings.Split(types, ","),
+		Names:   overrides,
+		Checks:  checks,
+	})
+	if err != nil {
+		return err
+	}
+
+	if out == "" {
+		_, err = os.Stdout.Write(src)
+		return err
+	}
+	return os.WriteFile(out, src, 0o644)
+}
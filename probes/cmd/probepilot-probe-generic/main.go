@@ -0,0 +1,31 @@
+// Command probepilot-probe-generic is the generic probe plugin: it
+// attaches the kprobes, kretprobes and tracepoints a spec lists and counts
+// what the spec extracts there, without C:
+//
+//	probepilot generic -spec /etc/probepilot/generic.yaml -listen 127.0.0.1:9470
+//
+// See package generic for the spec.
+package main
+
+import (
+	"errors"
+	"flag"
+
+	"probepilot/pkg/generic"
+	"probepilot/pkg/plugin"
+)
+
+func main() {
+	spec := flag.String("spec", "", "YAML file of the hooks to attach and the fields to extract there")
+	plugin.Main(plugin.Info{Name: "generic", Description: "counts and latencies of kprobes and tracepoints listed in a YAML spec"},
+		func(env *plugin.Env) (plugin.Probe, error) {
+			if *spec == "" {
+				return nil, errors.New("no -spec given")
+			}
+			s, err := generic.ReadSpec(*spec)
+			if err != nil {
+				return nil, err
+			}
+			return generic.NewProbe(s, env)
+		})
+}
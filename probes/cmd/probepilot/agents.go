@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// agent is a probe agent probepilot runs as a subcommand.
+type agent struct {
+	// Name is the subcommand, e.g. memory.
+	Name string
+	// Binaries are the names the agent is built as, by its Makefile first.
+	Binaries    []string
+	Description string
+	// After names the agents probepilot run starts this one after, once
+	// they are ready, if they run too.
+	After []string
+
+	// path is where a plugin was found
+	path string
+}
+
+// agents are the built-in probes probepilot manages, in the order run
+// -all starts them.
+var agents = []agent{
+	{Name: "memory", Binaries: []string{"memory_tracker", "memory-tracker"}, Description: "memory allocations, page faults and leaks"},
+	{Name: "cpu", Binaries: []string{"cpu_profiler", "cpu-profiler"}, Description: "scheduling, run queues and CPU time"},
+	{Name: "tcpflow", Binaries: []string{"tcp_flow_monitor", "tcp-flow"}, Description: "TCP flows, RTTs and retransmits"},
+}
+
+// AgentDirEnv names a directory to look for agent binaries in before the
+// one probepilot is installed in and $PATH.
+const AgentDirEnv = "PROBEPILOT_AGENT_DIR"
+
+// DefaultSocketDir is where agents started by probepilot put their control
+// sockets, <name>.sock, for status and attach.
+const DefaultSocketDir = "/run/probepilot"
+
+func findAgent(name string) (agent, bool) {
+	for _, a := range allAgents() {
+		if a.Name == name {
+			return a, true
+		}
+	}
+	return agent{}, false
+}
+
+// Path finds the agent's binary.
+func (a agent) Path() (string, error) {
+	if a.path != "" {
+		return a.path, nil
+	}
+	var dirs []string
+	if dir := os.Getenv(AgentDirEnv); dir != "" {
+		dirs = append(dirs, dir)
+	}
+	if exe, err := os.Executable(); err == nil {
+		dirs = append(dirs, filepath.Dir(exe))
+	}
+	for _, dir := range dirs {
+		for _, bin := range a.Binaries {
+			path := filepath.Join(dir, bin)
+			if info, err := os.Stat(path); err == nil && !info.IsDir() && info.Mode()&0o111 != 0 {
+				return path, nil
+			}
+		}
+	}
+	for _, bin := range a.Binaries {
+		if path, err := exec.LookPath(bin); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("%s agent not found: no %s next to probepilot, in $%s or in $PATH",
+		a.Name, strings.Join(a.Binaries, " or "), AgentDirEnv)
+}
+
+// Socket is the agent's control socket under dir.
+func (a agent) Socket(dir string) string {
+	return filepath.Join(dir, a.Name+".sock")
+}
+
+// Command returns the agent invoked with args, in its own process group,
+// given a control socket under socketDir unless args choose one.
+func (a agent) Command(args []string, socketDir string) (*exec.Cmd, error) {
+	path, err := a.Path()
+	if err != nil {
+		return nil, err
+	}
+	if socketDir != "" && !hasFlag(args, "control") {
+		args = append([]string{"-control", a.Socket(socketDir)}, args...)
+	}
+	cmd := exec.Command(path, args...)
+	ownProcessGroup(cmd)
+	return cmd, nil
+}
+
+// hasFlag reports whether args mention the flag name.
+func hasFlag(args []string, name string) bool {
+	for _, arg := range args {
+		if arg == "--" {
+			return false
+		}
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		arg = strings.TrimLeft(arg, "-")
+		if arg == name || strings.HasPrefix(arg, name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// flagValue returns the value args give the flag name, as -name=value or
+// -name value.
+func flagValue(args []string, name string) (string, bool) {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		arg = strings.TrimLeft(arg, "-")
+		if value, ok := strings.CutPrefix(arg, name+"="); ok {
+			return value, true
+		}
+		if arg == name && i+1 < len(args) {
+			return args[i+1], true
+		}
+	}
+	return "", false
+}
+
+// relaySignals passes SIGINT and SIGTERM on to the started cmds until
+// the returned function is called. Agents shut down cleanly on either.
+func relaySignals(cmds ...*exec.Cmd) (stop func()) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-sigs:
+				for _, cmd := range cmds {
+					cmd.Process.Signal(sig)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
+
+// agentCmd runs one agent in the foreground with args, its own flags,
+// exiting with its status.
+func agentCmd(a agent, args []string) error {
+	// Help and dry runs leave the control socket alone
+	socketDir := DefaultSocketDir
+	if hasFlag(args, "h") || hasFlag(args, "help") || hasFlag(args, "dry-run") {
+		socketDir = ""
+	}
+	cmd, err := a.Command(args, socketDir)
+	if err != nil {
+		return err
+	}
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// Wait for the agent to shut down rather than dying first
+	stop := relaySignals(cmd)
+	defer stop()
+	err = cmd.Wait()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) && exit.ExitCode() > 0 {
+		os.Exit(exit.ExitCode())
+	}
+	return err
+}
+
+// prefixWriter writes whole lines to w, each behind a prefix. Writers
+// sharing mu do not interleave within a line.
+type prefixWriter struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	prefix string
+	buf    []byte
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			return len(b), nil
+		}
+		p.mu.Lock()
+		_, err := fmt.Fprintf(p.w, "%s%s\n", p.prefix, p.buf[:i])
+		p.mu.Unlock()
+		p.buf = p.buf[i+1:]
+		if err != nil {
+			return len(b), err
+		}
+	}
+}
+
+// Flush writes what is left of an unterminated last line.
+func (p *prefixWriter) Flush() {
+	if len(p.buf) > 0 {
+		p.Write([]byte{'\n'})
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"probepilot/pkg/control"
+)
+
+type reply struct {
+	resp control.Response
+	err  error
+}
+
+// attachCmd runs a REPL against the control socket of a running agent.
+func attachCmd(args []string) error {
+	fs := flag.NewFlagSet("attach", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: probepilot attach <socket>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	client, err := control.Dial(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if err := client.Negotiate(); err != nil {
+		return fmt.Errorf("%s: %w", fs.Arg(0), err)
+	}
+
+	// Read stdin and the socket concurrently so a tail can be stopped by
+	// pressing enter while events stream in
+	input := make(chan string)
+	go func() {
+		defer close(input)
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			input <- scanner.Text()
+		}
+	}()
+	replies := make(chan reply)
+	go func() {
+		for {
+			resp, err := client.Receive()
+			replies <- reply{resp, err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	fmt.Printf("Connected to %s. Type help for commands, quit to exit.\n", fs.Arg(0))
+	for {
+		fmt.Print("probepilot> ")
+		line, ok := <-input
+		if !ok {
+			fmt.Println()
+			return nil
+		}
+		line = strings.TrimSpace(line)
+		switch line {
+		case "":
+			continue
+		case "quit", "exit":
+			return nil
+		}
+		if err := client.Send(line); err != nil {
+			return err
+		}
+
+		if line == "tail" {
+			fmt.Println("Tailing events, press enter to stop.")
+			if err := tail(client, input, replies); err != nil {
+				return err
+			}
+			continue
+		}
+		r := <-replies
+		if r.err != nil {
+			return r.err
+		}
+		printResponse(r.resp)
+	}
+}
+
+// tail prints streamed events until the user sends a line, then waits for
+// the agent to confirm the tail ended.
+func tail(client *control.Client, input <-chan string, replies <-chan reply) error {
+	stopping := false
+	for {
+		select {
+		case _, ok := <-input:
+			if !ok {
+				input = nil
+			}
+			if stopping {
+				continue
+			}
+			if err := client.Send("stop"); err != nil {
+				return err
+			}
+			stopping = true
+		case r := <-replies:
+			if r.err != nil {
+				return r.err
+			}
+			if r.resp.Event != "" {
+				fmt.Println(r.resp.Event)
+				continue
+			}
+			printResponse(r.resp)
+			return nil
+		}
+	}
+}
+
+func printResponse(resp control.Response) {
+	if resp.Error != "" {
+		fmt.Printf("error: %s\n", resp.Error)
+		return
+	}
+	if resp.Output != "" {
+		fmt.Println(resp.Output)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"probepilot/pkg/baseline"
+)
+
+const baselineUsage = `usage: probepilot baseline record [flags] -o <file> <agent>
+       probepilot baseline compare [flags] <baseline> <agent|recording>
+
+<agent> is an agent's -listen address: host:port, unix:/path or a URL.
+`
+
+// errRegressed makes compare exit 1, so canary pipelines can gate on it.
+var errRegressed = errors.New("regressions against the baseline")
+
+// baselineCmd records an agent's metrics over a window, or compares a new
+// window against a recording, for canary analysis.
+func baselineCmd(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, baselineUsage)
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "record":
+		return baselineRecord(args[1:])
+	case "compare":
+		return baselineCompare(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "probepilot baseline: unknown command %q\n\n%s", args[0], baselineUsage)
+		os.Exit(2)
+		return nil
+	}
+}
+
+func recordFlags(fs *flag.FlagSet) (duration, interval *time.Duration) {
+	duration = fs.Duration("duration", 5*time.Minute, "How long to record")
+	interval = fs.Duration("interval", 10*time.Second, "Scrape interval; series get one value per interval")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), baselineUsage)
+		fs.PrintDefaults()
+	}
+	return duration, interval
+}
+
+// record scrapes addr, stopping early with what it has on Ctrl-C.
+func record(addr string, duration, interval time.Duration) (*baseline.Baseline, error) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	fmt.Fprintf(os.Stderr, "Recording %s for %s every %s (Ctrl-C to stop early)\n", addr, duration, interval)
+	return baseline.Record(ctx, addr, duration, interval)
+}
+
+func baselineRecord(args []string) error {
+	fs := flag.NewFlagSet("baseline record", flag.ExitOnError)
+	duration, interval := recordFlags(fs)
+	out := fs.String("o", "", "File to write the baseline to")
+	fs.Parse(args)
+	if fs.NArg() != 1 || *out == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	b, err := record(fs.Arg(0), *duration, *interval)
+	if err != nil {
+		return err
+	}
+	if err := b.Save(*out); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %s: %d histograms, %d series over %s\n",
+		*out, len(b.Histograms), len(b.Series), time.Duration(b.Duration).Round(time.Second))
+	return nil
+}
+
+func baselineCompare(args []string) error {
+	fs := flag.NewFlagSet("baseline compare", flag.ExitOnError)
+	duration, interval := recordFlags(fs)
+	alpha := fs.Float64("alpha", baseline.DefaultOptions.Alpha, "Significance level of each test")
+	minChange := fs.Float64("min-change", baseline.DefaultOptions.MinChange, "Smallest relative change to report, e.g. 0.05 for 5%")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	base, err := baseline.Load(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	var cur *baseline.Baseline
+	if st, err := os.Stat(fs.Arg(1)); err == nil && st.Mode().IsRegular() {
+		cur, err = baseline.Load(fs.Arg(1))
+		if err != nil {
+			return err
+		}
+	} else {
+		// A live comparison defaults to the baseline's own window.
+		set := make(map[string]bool)
+		fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		if !set["duration"] {
+			*duration = time.Duration(base.Duration)
+		}
+		if !set["interval"] {
+			*interval = time.Duration(base.Interval)
+		}
+		if cur, err = record(fs.Arg(1), *duration, *interval); err != nil {
+			return err
+		}
+	}
+
+	report := baseline.Compare(base, cur, baseline.Options{Alpha: *alpha, MinChange: *minChange})
+	regressions := len(report.Regressions())
+	fmt.Printf("Compared %d metrics: %d significant changes, %d regressions\n",
+		report.Compared, len(report.Findings), regressions)
+	if len(report.Findings) > 0 {
+		fmt.Println()
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERDICT\tCATEGORY\tMETRIC\tSTATISTIC\tBASELINE\tCURRENT\tCHANGE\tP")
+		for _, f := range report.Findings {
+			verdict := "changed"
+			switch {
+			case f.Regression:
+				verdict = "REGRESSION"
+			case f.Category != "":
+				verdict = "improved"
+			}
+			category := f.Category
+			if category == "" {
+				category = "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s%s\t%s\t%.4g\t%.4g\t%s\t%.2g\n", verdict, category,
+				f.Name, labelSuffix(f), f.Statistic, f.Baseline, f.Current, baseline.FormatChange(f.Change), f.P)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	if regressions > 0 {
+		return errRegressed
+	}
+	return nil
+}
+
+func labelSuffix(f baseline.Finding) string {
+	if len(f.Labels) == 0 {
+		return ""
+	}
+	return strings.ReplaceAll(f.Labels.String(), `"`, "")
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"probepilot/pkg/doctor"
+	"probepilot/pkg/plan"
+)
+
+const doctorUsage = `usage: probepilot doctor [flags] [probe ...]
+
+Diagnoses whether the probes, all or those named, can run on this host:
+kernel features, configuration and BTF, tracefs, cgroups, minimal attach
+tests, conflicting tracers, and every hook of each probe's -dry-run
+attach plan. Run it as root, as the agents run.
+`
+
+// errDoctorFailed makes doctor exit 1 when a probe cannot run.
+var errDoctorFailed = errors.New("a probe cannot run on this host")
+
+// doctorCmd prints the host's diagnostics and the probes' compatibility
+// matrix, with hints for everything that is not fine.
+func doctorCmd(args []string) error {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	noAttach := fs.Bool("no-attach", false, "Skip the attach tests")
+	timeout := fs.Duration("timeout", time.Minute, "How long each probe's dry run may take")
+	verbose := fs.Bool("v", false, "List every hook, not only those that are not fine")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), doctorUsage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	probes := allAgents()
+	if fs.NArg() > 0 {
+		probes = nil
+		for _, name := range fs.Args() {
+			a, ok := findAgent(name)
+			if !ok {
+				return fmt.Errorf("unknown probe %q", name)
+			}
+			probes = append(probes, a)
+		}
+	}
+
+	var hints []doctor.Check
+	section := func(title string, checks []doctor.Check) {
+		fmt.Printf("%s:\n", title)
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, c := range checks {
+			fmt.Fprintf(w, "  %s\t%s\t%s\n", c.Status, c.Name, c.Detail)
+			if c.Hint != "" && c.Status != doctor.OK {
+				hints = append(hints, c)
+			}
+		}
+		w.Flush()
+		fmt.Println()
+	}
+	section("Host", doctor.Host())
+	section("Kernel config", doctor.KernelConfig())
+	if !*noAttach {
+		section("Attach tests", doctor.AttachTests())
+	}
+	section("Tracers", doctor.Conflicts())
+
+	failed := false
+	matrix := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(matrix, "PROBE\tSTATUS\tHOOKS\tVERIFIER")
+	var details []string
+	for _, a := range probes {
+		p, err := dryRun(a, *timeout)
+		if err != nil {
+			status := doctor.Fail
+			if _, missing := a.Path(); missing != nil {
+				status = doctor.Skip
+			} else {
+				failed = true
+			}
+			fmt.Fprintf(matrix, "%s\t%s\t-\t%v\n", a.Name, status, err)
+			continue
+		}
+		checks := doctor.Hooks(p)
+		status, available := doctor.Worst(checks), 0
+		for _, c := range checks {
+			if c.Status == doctor.OK {
+				available++
+			}
+		}
+		if p.Err() != nil {
+			status = doctor.Fail
+		}
+		if status == doctor.Fail {
+			failed = true
+		}
+		fmt.Fprintf(matrix, "%s\t%s\t%d/%d available\t%s\n", a.Name, status, available, len(checks), p.Verdict())
+
+		var b strings.Builder
+		w := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+		for _, c := range checks {
+			if c.Status == doctor.OK && !*verbose {
+				continue
+			}
+			fmt.Fprintf(w, "  %s\t%s\t%s\n", c.Status, c.Name, c.Detail)
+			if c.Hint != "" && c.Status != doctor.OK && c.Status != doctor.Skip {
+				c.Name = a.Name + ": " + c.Name
+				hints = append(hints, c)
+			}
+		}
+		w.Flush()
+		if b.Len() > 0 {
+			details = append(details, fmt.Sprintf("%s hooks:\n%s", a.Name, b.String()))
+		}
+	}
+	fmt.Println("Probes:")
+	matrix.Flush()
+	for _, d := range details {
+		fmt.Printf("\n%s", d)
+	}
+
+	if len(hints) > 0 {
+		fmt.Println("\nHints:")
+		for _, c := range hints {
+			fmt.Printf("  %s: %s\n", c.Name, c.Hint)
+		}
+	}
+	if failed {
+		return errDoctorFailed
+	}
+	return nil
+}
+
+// dryRun runs the agent's -dry-run and reads back its plan.
+func dryRun(a agent, timeout time.Duration) (*plan.Plan, error) {
+	path, err := a.Path()
+	if err != nil {
+		return nil, errors.New("not installed")
+	}
+	cmd, err := a.Command([]string{"-dry-run"}, "")
+	if err != nil {
+		return nil, err
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	timer := time.AfterFunc(timeout, func() { cmd.Process.Kill() })
+	defer timer.Stop()
+	runErr := cmd.Wait()
+
+	p, err := plan.Read(&stdout)
+	if err != nil {
+		// The last line of a failed run says why
+		if msg := lastLine(stderr.String()); msg != "" {
+			return nil, errors.New(msg)
+		}
+		if runErr != nil {
+			return nil, fmt.Errorf("%s -dry-run: %v", path, runErr)
+		}
+		return nil, fmt.Errorf("%s -dry-run printed no plan", path)
+	}
+	return p, nil
+}
+
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"probepilot/pkg/flowlog"
+	"probepilot/pkg/output"
+)
+
+const eventsUsage = `usage: probepilot events [flags] <file>...
+
+Replays the records of binary event logs, written with -output binary
+-output-file, as the JSON lines -output json would have written,
+seeking to -since through the logs' indexes rather than reading them
+from the start:
+
+  probepilot events -since 2h -until 1h -kind event /var/log/probepilot/memory.log
+`
+
+// eventsCmd replays a time range of binary event logs.
+func eventsCmd(args []string) error {
+	fs := flag.NewFlagSet("events", flag.ExitOnError)
+	since := fs.String("since", "", "Records since, a duration ago (e.g. 2h) or an RFC 3339 time")
+	until := fs.String("until", "", "Records until, a duration ago or an RFC 3339 time")
+	kind := fs.String("kind", "", "Records of this kind only: event or stats (default both)")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), eventsUsage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	switch *kind {
+	case "", output.KindEvent, output.KindStats:
+	default:
+		return fmt.Errorf("invalid -kind %q (want event or stats)", *kind)
+	}
+	now := time.Now()
+	from, err := flowlog.ParseTime(*since, now)
+	if err != nil {
+		return fmt.Errorf("invalid -since: %v", err)
+	}
+	to, err := flowlog.ParseTime(*until, now)
+	if err != nil {
+		return fmt.Errorf("invalid -until: %v", err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	for _, path := range fs.Args() {
+		r, err := output.OpenLog(path)
+		if err != nil {
+			return err
+		}
+		err = replay(r, enc, from, to, *kind)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// replay prints the records of r between from and to, either of which
+// may be zero.
+func replay(r *output.LogReader, enc *json.Encoder, from, to time.Time, kind string) error {
+	if !from.IsZero() {
+		if err := r.Seek(from); err != nil {
+			return err
+		}
+	}
+	for {
+		rec, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if (!from.IsZero() && rec.Time.Before(from)) || (!to.IsZero() && rec.Time.After(to)) {
+			continue
+		}
+		if kind != "" && rec.Kind != kind {
+			continue
+		}
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+}
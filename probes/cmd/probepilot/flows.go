@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"probepilot/pkg/flowlog"
+	"probepilot/pkg/units"
+)
+
+const flowsUsage = `usage: probepilot flows search [flags] [file ...]
+
+Searches the connections the TCP flow monitor recorded as JSON lines,
+with -output json -output-file, in the files given (gzipped if they end
+in .gz) or ` + flowlog.DefaultPath + `. Binary event logs, recorded
+with -output binary, are read from -since on instead of in full:
+
+  probepilot flows search -dst 10.0.0.5 -since 2h
+`
+
+// flowsCmd answers questions about recorded flow history without an
+// external database.
+func flowsCmd(args []string) error {
+	if len(args) == 0 || args[0] != "search" {
+		fmt.Fprint(os.Stderr, flowsUsage)
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("flows search", flag.ExitOnError)
+	src := fs.String("src", "", "Address or CIDR of the connecting end")
+	dst := fs.String("dst", "", "Address or CIDR of the accepting end")
+	port := fs.Uint("port", 0, "Port of the accepting end")
+	pid := fs.Uint("pid", 0, "PID of the process at either end")
+	comm := fs.String("comm", "", "Command name of the process at either end")
+	since := fs.String("since", "", "Flows seen since, a duration ago (e.g. 2h) or an RFC 3339 time")
+	until := fs.String("until", "", "Flows seen until, a duration ago or an RFC 3339 time")
+	asJSON := fs.Bool("json", false, "Print one JSON object per flow")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), flowsUsage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args[1:])
+
+	var q flowlog.Query
+	var err error
+	if q.Src, err = flowlog.ParsePrefix(*src); err != nil {
+		return fmt.Errorf("invalid -src: %v", err)
+	}
+	if q.Dst, err = flowlog.ParsePrefix(*dst); err != nil {
+		return fmt.Errorf("invalid -dst: %v", err)
+	}
+	if *port > 0xffff {
+		return fmt.Errorf("invalid -port %d", *port)
+	}
+	q.Port, q.PID, q.Comm = uint16(*port), uint32(*pid), *comm
+	now := time.Now()
+	if q.Since, err = flowlog.ParseTime(*since, now); err != nil {
+		return fmt.Errorf("invalid -since: %v", err)
+	}
+	if q.Until, err = flowlog.ParseTime(*until, now); err != nil {
+		return fmt.Errorf("invalid -until: %v", err)
+	}
+
+	files := fs.Args()
+	if len(files) == 0 {
+		files = []string{flowlog.DefaultPath}
+	}
+	l := flowlog.New()
+	l.Since = q.Since
+	for _, path := range files {
+		if err := l.ReadFile(path); err != nil {
+			return err
+		}
+	}
+	flows := l.Search(q)
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		for _, f := range flows {
+			if err := enc.Encode(f); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "FIRST SEEN\tLAST SEEN\tSOURCE\tDESTINATION\tCLIENT\tSERVER\tTX\tRX\tRTT\tSTATE")
+	for _, f := range flows {
+		rtt := "-"
+		if f.RTT > 0 {
+			rtt = units.Duration(f.RTT)
+		}
+		state := f.State
+		if f.Retransmits > 0 {
+			state += fmt.Sprintf(" (%.0f retransmits)", f.Retransmits)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			f.First.Local().Format(time.DateTime), f.Last.Local().Format(time.DateTime),
+			f.Src, f.Dst, processName(f.Client), processName(f.Server),
+			units.Bytes(uint64(f.BytesTX)), units.Bytes(uint64(f.BytesRX)), rtt, state)
+	}
+	w.Flush()
+	fmt.Fprintf(os.Stderr, "%d flows in %s\n", len(flows), strings.Join(files, ", "))
+	return nil
+}
+
+func processName(p *flowlog.Process) string {
+	if p == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%s[%d]", p.Comm, p.PID)
+}
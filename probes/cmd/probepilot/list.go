@@ -0,0 +1,33 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+// listCmd prints the probes probepilot can run and where their agents are.
+func listCmd(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: probepilot list")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PROBE\tAGENT\tOBSERVES")
+	for _, a := range allAgents() {
+		path, err := a.Path()
+		if err != nil {
+			path = "not installed"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", a.Name, path, a.Description)
+	}
+	return w.Flush()
+}
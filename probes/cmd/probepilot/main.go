@@ -0,0 +1,91 @@
+// Command probepilot is the operator CLI for running probe agents:
+//
+//	probepilot run -all -- -targets /etc/probepilot/targets.json
+//	probepilot memory -profile minimal -listen 127.0.0.1:9464
+//	probepilot status
+//	probepilot attach /run/probepilot/memory.sock
+//	probepilot usdt /usr/lib/postgresql/16/bin/postgres
+//	probepilot baseline record -o before.json localhost:9464
+//	probepilot baseline compare before.json localhost:9464
+//	probepilot selftest -memory localhost:9464 -cpu localhost:9465
+//	probepilot doctor
+//	probepilot flows search -dst 10.0.0.5 -since 2h
+//	probepilot events -since 2h /var/log/probepilot/memory.log
+//	probepilot unseal -key file:/etc/probepilot/seal.key oom-*.txt.sealed
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+const usage = `usage: probepilot <command> [arguments]
+
+commands:
+  memory [flags]    run the memory tracker (-h for its flags)
+  cpu [flags]       run the CPU profiler (-h for its flags)
+  tcpflow [flags]   run the TCP flow monitor (-h for its flags)
+  <plugin> [flags]  run a probe plugin listed by probepilot list
+  run -all          run every probe, or those named, side by side
+  list              list the probes and where their agents are
+  status            show which probes are running
+  attach <socket>   open an interactive session with a running agent
+  usdt <binary>     list the USDT probes of a binary or library
+  baseline record   record an agent's metric distributions over a window
+  baseline compare  compare an agent or recording against a baseline
+  selftest          check that agents report known workloads
+  doctor            diagnose whether the probes can run on this host
+  flows search      search the flow history the TCP flow monitor recorded
+  events <file>     replay a time range of binary event logs as JSON lines
+  unseal <file>     decrypt OOM reports, leak files or spooled batches
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "memory", "cpu", "tcpflow":
+		a, _ := findAgent(cmd)
+		err = agentCmd(a, args)
+	case "run":
+		err = runCmd(args)
+	case "list":
+		err = listCmd(args)
+	case "status":
+		err = statusCmd(args)
+	case "attach":
+		err = attachCmd(args)
+	case "usdt":
+		err = usdtCmd(args)
+	case "baseline":
+		err = baselineCmd(args)
+	case "selftest":
+		err = selftestCmd(args)
+	case "doctor":
+		err = doctorCmd(args)
+	case "flows":
+		err = flowsCmd(args)
+	case "events":
+		err = eventsCmd(args)
+	case "unseal":
+		err = unsealCmd(args)
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+		return
+	default:
+		if a, ok := findAgent(cmd); ok {
+			err = agentCmd(a, args)
+			break
+		}
+		fmt.Fprintf(os.Stderr, "probepilot: unknown command %q\n\n%s", cmd, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "probepilot: %v\n", err)
+		os.Exit(1)
+	}
+}
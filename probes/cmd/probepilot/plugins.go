@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"probepilot/pkg/plugin"
+)
+
+// handshakeTimeout bounds how long a plugin may take to describe itself.
+const handshakeTimeout = 5 * time.Second
+
+// allAgents are the built-in agents followed by the probe plugins found
+// installed, in the order run -all starts them.
+var allAgents = sync.OnceValue(func() []agent {
+	return append(append([]agent(nil), agents...), plugins()...)
+})
+
+// plugins finds the probe plugins: executables named plugin.Prefix plus
+// their name in $PROBEPILOT_PLUGIN_DIR, plugin.DefaultDir and $PATH that
+// answer the handshake. The first plugin of a name wins; broken ones are
+// reported and skipped.
+func plugins() []agent {
+	dirs := []string{plugin.DefaultDir}
+	if dir := os.Getenv(plugin.DirEnv); dir != "" {
+		dirs = append([]string{dir}, dirs...)
+	}
+	dirs = append(dirs, filepath.SplitList(os.Getenv("PATH"))...)
+
+	var found []agent
+	seen := make(map[string]bool)
+	for _, dir := range dirs {
+		matches, _ := filepath.Glob(filepath.Join(dir, plugin.Prefix+"*"))
+		for _, path := range matches {
+			bin := filepath.Base(path)
+			if info, err := os.Stat(path); err != nil || info.IsDir() || info.Mode()&0o111 == 0 || seen[bin] {
+				continue
+			}
+			seen[bin] = true
+			a, err := handshake(path)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "probepilot: skipping plugin %s: %v\n", path, err)
+				continue
+			}
+			found = append(found, a)
+		}
+	}
+	return found
+}
+
+// handshake runs the plugin at path with -plugin-info and returns the
+// agent it describes.
+func handshake(path string) (agent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, path, "-"+plugin.InfoFlag).Output()
+	if err != nil {
+		return agent{}, fmt.Errorf("handshake failed: %v", err)
+	}
+	var info plugin.Info
+	if err := json.Unmarshal(out, &info); err != nil {
+		return agent{}, fmt.Errorf("handshake failed: %v", err)
+	}
+	if err := info.Validate(); err != nil {
+		return agent{}, err
+	}
+	if want := strings.TrimPrefix(filepath.Base(path), plugin.Prefix); info.Name != want {
+		return agent{}, fmt.Errorf("plugin calls itself %q, not %q", info.Name, want)
+	}
+	return agent{Name: info.Name, Binaries: []string{filepath.Base(path)}, Description: info.Description, After: info.After, path: path}, nil
+}
@@ -0,0 +1,15 @@
+//go:build unix
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// ownProcessGroup keeps Ctrl-C at the terminal from reaching cmd directly;
+// probepilot relays it once, where a second SIGINT would kill an agent
+// that is still shutting down.
+func ownProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
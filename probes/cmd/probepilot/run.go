@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"probepilot/pkg/config"
+)
+
+const runUsage = `usage: probepilot run [flags] -all | <probe>... [-- agent flags]
+
+Runs probes side by side until interrupted, prefixing their output with
+the probe name; JSON lines of -output json are passed through as is.
+Flags after -- go to every agent, e.g. -targets or -profile;
+-<probe>-args adds flags for one. If an agent exits, the others are
+stopped too. With -config, or $PROBEPILOT_CONFIG, and no probes named,
+the probes the configuration file enables run.
+
+Probes start in stages: one ordered after another, by -after or by its
+plugin, starts once the other answers on its control socket, that is has
+attached. If a probe fails to start or get ready, those already started
+are stopped again. Once all are ready, a report lists them.
+`
+
+// runCmd supervises several agents.
+func runCmd(args []string) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	all := fs.Bool("all", false, "Run every probe")
+	configFile := fs.String("config", os.Getenv(config.Env), "YAML file of per-probe settings, passed to every agent")
+	socketDir := fs.String("socket-dir", DefaultSocketDir, "Directory of the agents' control sockets")
+	after := make(afterFlag)
+	fs.Var(after, "after", "Start a probe once others are ready, as probe=probe[,probe], e.g. memory=exectracer (repeatable)")
+	readyTimeout := fs.Duration("ready-timeout", 2*time.Minute, "How long a probe may take to attach and open its control socket")
+	perAgent := make(map[string]*string)
+	for _, a := range allAgents() {
+		perAgent[a.Name] = fs.String(a.Name+"-args", "", "Flags for the "+a.Name+" agent only, e.g. \"-listen 127.0.0.1:9464\"")
+	}
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), runUsage)
+		fs.PrintDefaults()
+	}
+
+	// Agent flags follow --; the flag package would stop there anyway
+	var shared []string
+	for i, arg := range args {
+		if arg == "--" {
+			args, shared = args[:i], args[i+1:]
+			break
+		}
+	}
+	fs.Parse(args)
+
+	var file *config.File
+	if *configFile != "" {
+		var err error
+		if file, err = config.ReadFile(*configFile); err != nil {
+			return err
+		}
+		shared = append([]string{"-config", *configFile}, shared...)
+	}
+
+	var selected []agent
+	if *all {
+		if fs.NArg() != 0 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		selected = allAgents()
+	}
+	if file != nil && !*all && fs.NArg() == 0 {
+		for _, a := range allAgents() {
+			if file.Enabled(a.Name) {
+				selected = append(selected, a)
+			}
+		}
+		if len(selected) == 0 {
+			return fmt.Errorf("%s enables no probes", *configFile)
+		}
+	}
+	for _, name := range fs.Args() {
+		a, ok := findAgent(name)
+		if !ok {
+			return fmt.Errorf("unknown probe %q (see probepilot list)", name)
+		}
+		selected = append(selected, a)
+	}
+	if len(selected) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	stages, err := startStages(selected, after)
+	if err != nil {
+		return err
+	}
+
+	var mu sync.Mutex
+	var cmds []*exec.Cmd
+	var sockets []string
+	var outputs []*prefixWriter
+	for _, a := range selected {
+		agentArgs := append(strings.Fields(*perAgent[a.Name]), shared...)
+		cmd, err := a.Command(agentArgs, *socketDir)
+		if err != nil {
+			return err
+		}
+		stdout := &prefixWriter{mu: &mu, w: os.Stdout, prefix: a.Name + ": "}
+		// JSON lines name their probe and must stay parseable
+		format, ok := flagValue(agentArgs, "output")
+		if !ok {
+			settings := &config.Settings{File: file, Probe: a.Name}
+			format, _ = settings.Lookup("output")
+		}
+		if format == "json" {
+			stdout.prefix = ""
+		}
+		stderr := &prefixWriter{mu: &mu, w: os.Stderr, prefix: a.Name + ": "}
+		cmd.Stdout, cmd.Stderr = stdout, stderr
+		cmds = append(cmds, cmd)
+		outputs = append(outputs, stdout, stderr)
+		socket, ok := flagValue(cmd.Args[1:], "control")
+		if !ok && *socketDir != "" {
+			socket = a.Socket(*socketDir)
+		}
+		sockets = append(sockets, socket)
+	}
+	defer func() {
+		for _, o := range outputs {
+			o.Flush()
+		}
+	}()
+
+	s := newStartup(selected, cmds, sockets, *readyTimeout)
+	if err := s.Run(stages); err != nil {
+		return err
+	}
+	stop := relaySignals(cmds...)
+	defer stop()
+	report := s.Report()
+	mu.Lock()
+	os.Stderr.Write(report)
+	fmt.Fprintf(os.Stderr, "probepilot: running %s (Ctrl-C to stop)\n", names(selected))
+	mu.Unlock()
+
+	// The first agent to exit, for whatever reason, takes the others down
+	var errs []error
+	for i := range cmds {
+		e := <-s.exits
+		if i == 0 {
+			for _, cmd := range cmds {
+				cmd.Process.Signal(os.Interrupt)
+			}
+		}
+		if e.err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", e.name, e.err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func names(agents []agent) string {
+	s := make([]string, len(agents))
+	for i, a := range agents {
+		s[i] = a.Name
+	}
+	return strings.Join(s, ", ")
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+
+	"probepilot/pkg/selftest"
+)
+
+const selftestUsage = `usage: probepilot selftest [flags]
+
+Runs known workloads and checks that the given agents report them. Give
+each agent's -listen address: host:port, unix:/path or a URL.
+`
+
+// errSelftestFailed makes selftest exit 1 when a probe missed its workload.
+var errSelftestFailed = errors.New("self-test failed")
+
+// selftestCmd validates the probes end to end on this host.
+func selftestCmd(args []string) error {
+	// Run starts this command again to perform each workload
+	if name := os.Getenv(selftest.WorkloadEnv); name != "" {
+		return selftest.RunWorkload(name, os.Stdin, os.Stdout)
+	}
+
+	opts := selftest.DefaultOptions
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	fs.StringVar(&opts.Memory, "memory", "", "Query API of the memory tracker (skipped if empty)")
+	fs.StringVar(&opts.CPU, "cpu", "", "Query API of the CPU profiler (skipped if empty)")
+	fs.StringVar(&opts.TCP, "tcp", "", "Query API of the TCP flow monitor (skipped if empty)")
+	fs.Uint64Var(&opts.LeakBytes, "leak", opts.LeakBytes, "Bytes the leaky allocator leaks")
+	fs.DurationVar(&opts.Burn, "burn", opts.Burn, "How long the CPU burner spins")
+	fs.IntVar(&opts.Connections, "connections", opts.Connections, "Connections forced into SYN retransmits, and opened over the veth pair")
+	fs.BoolVar(&opts.Veth, "veth", false, "Also check the TCP flow monitor's flows, bytes, RTT and retransmits over a veth pair into a network namespace (needs iproute2)")
+	fs.Uint64Var(&opts.VethBytes, "veth-bytes", opts.VethBytes, "Bytes each connection sends over the veth pair")
+	fs.DurationVar(&opts.VethDelay, "veth-delay", opts.VethDelay, "Delay netem adds to the veth pair, checked against the flows' RTT")
+	fs.Float64Var(&opts.VethLoss, "veth-loss", opts.VethLoss, "Percentage of packets netem drops on the veth pair for the retransmit check")
+	fs.Float64Var(&opts.Tolerance, "tolerance", opts.Tolerance, "Relative error allowed between a workload and its probe")
+	fs.DurationVar(&opts.Timeout, "timeout", opts.Timeout, "How long to wait for a probe to catch up")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), selftestUsage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 || (opts.Memory == "" && opts.CPU == "" && opts.TCP == "") {
+		fs.Usage()
+		os.Exit(2)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	opts.Command = []string{exe, "selftest"}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	results, err := selftest.Run(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "RESULT\tWORKLOAD\tAGENT\tMETRIC\tEXPECTED\tMEASURED")
+	for _, r := range results {
+		result, expected := "PASS", fmt.Sprintf("%.6g ±%.0f%%", r.Expected, opts.Tolerance*100)
+		if r.AtLeast {
+			expected = fmt.Sprintf(">= %.6g", r.Expected)
+		}
+		measured := fmt.Sprintf("%.6g", r.Measured)
+		if !r.Pass {
+			result = "FAIL"
+			failed++
+		}
+		if r.Err != nil {
+			measured = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", result, r.Workload, r.Agent, r.Metric, expected, measured)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	for _, r := range results {
+		switch {
+		case r.Err != nil:
+			fmt.Fprintf(os.Stderr, "%s: %v\n", r.Workload, r.Err)
+		case !r.Pass:
+			fmt.Fprintf(os.Stderr, "%s: %s\n", r.Workload, r.Hint)
+		}
+	}
+	if failed > 0 {
+		return errSelftestFailed
+	}
+	return nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"probepilot/pkg/control"
+)
+
+// readyPoll is how often startup checks whether agents are ready.
+const readyPoll = 100 * time.Millisecond
+
+// afterFlag collects -after probe=dep,dep orderings.
+type afterFlag map[string][]string
+
+func (f afterFlag) String() string {
+	var s []string
+	for name, deps := range f {
+		s = append(s, name+"="+strings.Join(deps, ","))
+	}
+	return strings.Join(s, " ")
+}
+
+func (f afterFlag) Set(value string) error {
+	name, deps, ok := strings.Cut(value, "=")
+	if !ok || name == "" || deps == "" {
+		return fmt.Errorf("want probe=probe[,probe], got %q", value)
+	}
+	for _, n := range append([]string{name}, strings.Split(deps, ",")...) {
+		if _, ok := findAgent(n); !ok {
+			return fmt.Errorf("unknown probe %q (see probepilot list)", n)
+		}
+	}
+	f[name] = append(f[name], strings.Split(deps, ",")...)
+	return nil
+}
+
+// startStages orders the selected agents into stages, indices into
+// selected: every agent starts in a stage after those of the agents it
+// must follow, by its own After or -after. Agents follow only agents that
+// are selected; a cycle is an error.
+func startStages(selected []agent, after afterFlag) ([][]int, error) {
+	index := make(map[string]int, len(selected))
+	for i, a := range selected {
+		index[a.Name] = i
+	}
+	deps := make([][]int, len(selected))
+	for i, a := range selected {
+		for _, name := range append(append([]string(nil), a.After...), after[a.Name]...) {
+			j, ok := index[name]
+			if !ok {
+				fmt.Fprintf(os.Stderr, "probepilot: %s starts after %s, which is not running\n", a.Name, name)
+				continue
+			}
+			deps[i] = append(deps[i], j)
+		}
+	}
+
+	// An agent's stage is one past the latest of its dependencies'
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make([]int, len(selected))
+	stage := make([]int, len(selected))
+	var visit func(i int, path []string) error
+	visit = func(i int, path []string) error {
+		switch state[i] {
+		case done:
+			return nil
+		case visiting:
+			return fmt.Errorf("startup order has a cycle: %s -> %s", strings.Join(path, " -> "), selected[i].Name)
+		}
+		state[i] = visiting
+		for _, j := range deps[i] {
+			if err := visit(j, append(path, selected[i].Name)); err != nil {
+				return err
+			}
+			stage[i] = max(stage[i], stage[j]+1)
+		}
+		state[i] = done
+		return nil
+	}
+	var stages [][]int
+	for i := range selected {
+		if err := visit(i, nil); err != nil {
+			return nil, err
+		}
+	}
+	for i := range selected {
+		for len(stages) <= stage[i] {
+			stages = append(stages, nil)
+		}
+		stages[stage[i]] = append(stages[stage[i]], i)
+	}
+	return stages, nil
+}
+
+// exit is an agent's process ending.
+type exit struct {
+	name string
+	err  error
+}
+
+// startup starts agents stage by stage, each stage once the agents of the
+// one before are ready, and stops whatever it started if any fails.
+type startup struct {
+	selected []agent
+	cmds     []*exec.Cmd
+	// sockets are the agents' control sockets, "" if they have none and
+	// are ready once started.
+	sockets []string
+	timeout time.Duration
+
+	// started are indices of the agents started, in order, and ready how
+	// long each took to get ready.
+	started []int
+	ready   map[int]time.Duration
+	stage   map[int]int
+	exits   chan exit
+}
+
+func newStartup(selected []agent, cmds []*exec.Cmd, sockets []string, timeout time.Duration) *startup {
+	return &startup{
+		selected: selected,
+		cmds:     cmds,
+		sockets:  sockets,
+		timeout:  timeout,
+		ready:    make(map[int]time.Duration),
+		stage:    make(map[int]int),
+		exits:    make(chan exit, len(cmds)),
+	}
+}
+
+// Run starts the stages in order. An agent failing to start, exiting or
+// not getting ready within the timeout, or an interrupt, stops the agents
+// already started, in reverse order, and returns why.
+func (s *startup) Run(stages [][]int) error {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	for n, stage := range stages {
+		if err := s.runStage(n, stage, sigs); err != nil {
+			return s.rollback(err)
+		}
+	}
+	return nil
+}
+
+func (s *startup) runStage(n int, stage []int, sigs <-chan os.Signal) error {
+	begin := time.Now()
+	pending := make(map[int]bool)
+	for _, i := range stage {
+		if err := s.cmds[i].Start(); err != nil {
+			return fmt.Errorf("%s: %w", s.selected[i].Name, err)
+		}
+		s.started = append(s.started, i)
+		s.stage[i] = n + 1
+		go func(name string, cmd *exec.Cmd) {
+			s.exits <- exit{name, cmd.Wait()}
+		}(s.selected[i].Name, s.cmds[i])
+		pending[i] = true
+	}
+
+	deadline := time.After(s.timeout)
+	tick := time.NewTicker(readyPoll)
+	defer tick.Stop()
+	for {
+		for i := range pending {
+			if s.sockets[i] == "" || agentReady(s.sockets[i]) {
+				s.ready[i] = time.Since(begin)
+				delete(pending, i)
+			}
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+		select {
+		case e := <-s.exits:
+			// Put it back for rollback to count
+			s.exits <- e
+			if e.err == nil {
+				e.err = errors.New("exited")
+			}
+			return fmt.Errorf("%s exited during startup: %w", e.name, e.err)
+		case sig := <-sigs:
+			return fmt.Errorf("startup interrupted by %v", sig)
+		case <-deadline:
+			var late []string
+			for _, i := range stage {
+				if pending[i] {
+					late = append(late, s.selected[i].Name)
+				}
+			}
+			return fmt.Errorf("%s not ready after %v", strings.Join(late, ", "), s.timeout)
+		case <-tick.C:
+		}
+	}
+}
+
+// rollback interrupts the agents started, latest first, waits for them
+// and returns cause with their errors.
+func (s *startup) rollback(cause error) error {
+	if len(s.started) == 0 {
+		return cause
+	}
+	var stopping []string
+	for k := len(s.started) - 1; k >= 0; k-- {
+		i := s.started[k]
+		s.cmds[i].Process.Signal(os.Interrupt)
+		stopping = append(stopping, s.selected[i].Name)
+	}
+	fmt.Fprintf(os.Stderr, "probepilot: startup failed, stopping %s\n", strings.Join(stopping, ", "))
+	errs := []error{cause}
+	for range s.started {
+		if e := <-s.exits; e.err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", e.name, e.err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Report writes what is running: each agent's stage, how long it took to
+// get ready after its stage began, its hooks and control socket.
+func (s *startup) Report() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "probepilot: started %d probes in %d stages\n", len(s.started), s.stage[s.started[len(s.started)-1]])
+	w := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PROBE\tSTAGE\tREADY\tHOOKS\tSOCKET")
+	for _, i := range s.started {
+		hooks, socket := "-", "-"
+		if s.sockets[i] != "" {
+			_, hooks = agentStatus(s.sockets[i])
+			socket = s.sockets[i]
+		}
+		fmt.Fprintf(w, "%s\t%d\t%v\t%s\t%s\n", s.selected[i].Name, s.stage[i], s.ready[i].Round(time.Millisecond), hooks, socket)
+	}
+	w.Flush()
+	return buf.Bytes()
+}
+
+// agentReady reports whether the agent at socket answers. Agents listen on
+// their control socket once their probes are attached.
+func agentReady(socket string) bool {
+	client, err := control.Dial(socket)
+	if err != nil {
+		return false
+	}
+	defer client.Close()
+	return client.Negotiate() == nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"probepilot/pkg/control"
+)
+
+// statusCmd reports which probes are running, through their control
+// sockets.
+func statusCmd(args []string) error {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	socketDir := flags.String("socket-dir", DefaultSocketDir, "Directory of the agents' control sockets")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: probepilot status [flags]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PROBE\tSTATE\tHOOKS\tSOCKET")
+	for _, a := range allAgents() {
+		socket := a.Socket(*socketDir)
+		state, hooks := agentStatus(socket)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", a.Name, state, hooks, socket)
+	}
+	return w.Flush()
+}
+
+// agentStatus asks the agent at socket for its hooks. An agent is stopped
+// if its socket is gone or left behind, else unresponsive if it does not
+// answer.
+func agentStatus(socket string) (state, hooks string) {
+	client, err := control.Dial(socket)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ECONNREFUSED) {
+			return "stopped", "-"
+		}
+		return "unresponsive: " + err.Error(), "-"
+	}
+	defer client.Close()
+	if err := client.Negotiate(); err != nil {
+		return "unresponsive: " + err.Error(), "-"
+	}
+	resp, err := client.Do("hooks")
+	if err != nil || resp.Error != "" {
+		return "running", "-"
+	}
+	on, total := 0, 0
+	for _, line := range strings.Split(resp.Output, "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			total++
+			if fields[1] == "on" {
+				on++
+			}
+		}
+	}
+	return "running", fmt.Sprintf("%d/%d on", on, total)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"probepilot/pkg/seal"
+)
+
+// unsealCmd decrypts files the agents sealed, OOM reports, leak reports
+// and spills or spooled batches, to stdout.
+func unsealCmd(args []string) error {
+	fs := flag.NewFlagSet("unseal", flag.ExitOnError)
+	keySpec := fs.String("key", "", "Key the files were sealed under: env:VAR, file:PATH or exec:COMMAND")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: probepilot unseal -key <spec> <file>...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *keySpec == "" || fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	key, err := seal.Load(*keySpec)
+	if err != nil {
+		return err
+	}
+	for _, path := range fs.Args() {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		plain, err := key.OpenFile(data)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if _, err := os.Stdout.Write(plain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"probepilot/pkg/attach"
+)
+
+// usdtCmd lists the USDT probes of a binary or library, to pick targets
+// for attach.USDT.
+func usdtCmd(args []string) error {
+	fs := flag.NewFlagSet("usdt", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: probepilot usdt <binary>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	probes, err := attach.ReadUSDT(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PROBE\tOFFSET\tSEMAPHORE\tARGS")
+	for _, p := range probes {
+		sem := "-"
+		if p.SemaphoreOffset != 0 {
+			sem = fmt.Sprintf("0x%x", p.SemaphoreOffset)
+		}
+		args := make([]string, len(p.Args))
+		for i, a := range p.Args {
+			args[i] = a.String()
+		}
+		fmt.Fprintf(w, "%s:%s\t0x%x\t%s\t%s\n", p.Provider, p.Name, p.Offset, sem, strings.Join(args, " "))
+	}
+	return w.Flush()
+}
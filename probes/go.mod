@@ -0,0 +1,10 @@
+module probepilot
+
+go 1.21
+
+require (
+	github.com/cilium/ebpf v0.12.3
+	golang.org/x/sys v0.15.0
+)
+
+require golang.org/x/exp v0.0.0-20230224173230-c95f2b4c22f2 // indirect
@@ -0,0 +1,192 @@
+// Allocator detection: processes linked against jemalloc, tcmalloc or
+// mimalloc never call glibc's malloc, so the tracker looks for their
+// libraries in the maps of every process it sees and traces them too
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/cilium/ebpf/link"
+
+	"probepilot/pkg/attach"
+	"probepilot/pkg/procfs"
+	"probepilot/pkg/profile"
+)
+
+// allocator is a malloc implementation, found by the file names of its
+// shared libraries. Builds that do not replace malloc export only the
+// allocator's own API, e.g. je_malloc, under its prefix.
+type allocator struct {
+	name   string
+	libs   []string
+	prefix string
+	funcs  []allocFunc
+}
+
+var (
+	glibc      = allocator{name: "glibc", libs: []string{"libc.so", "libc-"}, funcs: libcAllocFuncs}
+	cxxRuntime = allocator{name: "libstdc++", libs: []string{"libstdc++.so"}, funcs: cxxAllocFuncs}
+)
+
+// allocators are detected in order: a process mapping one of the others
+// has it replace glibc's malloc
+var allocators = []*allocator{
+	{name: "jemalloc", libs: []string{"libjemalloc.so"}, prefix: "je_", funcs: libcAllocFuncs},
+	{name: "tcmalloc", libs: []string{"libtcmalloc.so", "libtcmalloc_minimal.so"}, prefix: "tc_", funcs: libcAllocFuncs},
+	{name: "mimalloc", libs: []string{"libmimalloc.so"}, prefix: "mi_", funcs: libcAllocFuncs},
+	&glibc,
+}
+
+func (a *allocator) provides(path string) bool {
+	base := path[strings.LastIndexByte(path, '/')+1:]
+	for _, lib := range a.libs {
+		if strings.HasPrefix(base, lib) {
+			return true
+		}
+	}
+	return false
+}
+
+// symbol names fn in lib: its plain name, or the prefixed one if lib
+// does not export that
+func (a *allocator) symbol(lib string, fn allocFunc) string {
+	if a.prefix == "" {
+		return fn.symbol
+	}
+	if _, err := attach.ResolveSymbol(lib, fn.symbol); errors.Is(err, attach.ErrSymbolNotFound) {
+		return a.prefix + fn.symbol
+	}
+	return fn.symbol
+}
+
+// allocLib is an allocator library the uprobes trace
+type allocLib struct {
+	alloc *allocator
+	path  string
+}
+
+// processAllocator finds the allocator pid uses, and the path of its
+// library through the process's root
+func processAllocator(pid uint32) (*allocator, string, error) {
+	dir := strconv.FormatUint(uint64(pid), 10)
+	f, err := os.Open(procfs.Path(dir, "maps"))
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+
+	found := make([]string, len(allocators))
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 {
+			continue
+		}
+		for i, a := range allocators {
+			if found[i] == "" && a.provides(fields[5]) {
+				found[i] = fields[5]
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, "", err
+	}
+	for i, path := range found {
+		if path != "" {
+			return allocators[i], procfs.Path(dir, "root", path), nil
+		}
+	}
+	return nil, "", fmt.Errorf("PID %d maps no known allocator", pid)
+}
+
+// tracing reports whether the uprobes trace lib; mt.allocMu must be held
+func (mt *MemoryTracker) tracing(lib string) bool {
+	for _, l := range mt.allocLibs {
+		if sameFile(l.path, lib) {
+			return true
+		}
+	}
+	return false
+}
+
+// detectAllocator labels the process of id with its allocator and, the
+// first time a library of one shows up, traces it in every process
+func (mt *MemoryTracker) detectAllocator(id ProcKey) {
+	a, lib, err := processAllocator(id.PID)
+	if err != nil {
+		return
+	}
+	mt.allocs[id] = a.name
+	// Target processes are traced on their own
+	if len(mt.targetPIDs) > 0 {
+		return
+	}
+	mt.allocMu.Lock()
+	known := mt.tracing(lib)
+	mt.allocMu.Unlock()
+	if known {
+		return
+	}
+
+	// Resolving symbols can take a while; events keep flowing meanwhile
+	go func() {
+		err := mt.hooks.Grow(profile.HookUprobes, func(on bool) ([]link.Link, error) {
+			mt.allocMu.Lock()
+			defer mt.allocMu.Unlock()
+			if mt.tracing(lib) {
+				return nil, nil
+			}
+			log.Printf("Detected %s in PID %d: %s", a.name, id.PID, lib)
+			mt.allocLibs = append(mt.allocLibs, allocLib{alloc: a, path: lib})
+			if !on {
+				return nil, nil
+			}
+			return mt.attachAllocator(a, lib), nil
+		})
+		if err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}()
+}
+
+// attachAllocator attaches the probes of a's functions in lib, warning
+// about those that fail
+func (mt *MemoryTracker) attachAllocator(a *allocator, lib string) []link.Link {
+	var links []link.Link
+	for _, fn := range a.funcs {
+		symbol := a.symbol(lib, fn)
+		// Returns first: an entry without its return would leave calls
+		// pending
+		var ret link.Link
+		if fn.ret != "" {
+			var err error
+			ret, _, err = attach.Uprobe(mt.coll, fn.ret, lib, symbol, attach.UprobeOptions{Return: true})
+			if err != nil {
+				log.Printf("Warning: failed to attach uretprobe %s:%s: %v", lib, symbol, err)
+				continue
+			}
+		}
+		// Symbols resolve through .dynsym on stripped distro libraries
+		l, sym, err := attach.Uprobe(mt.coll, fn.entry, lib, symbol, attach.UprobeOptions{})
+		if err != nil {
+			log.Printf("Warning: failed to attach uprobe %s:%s: %v", lib, symbol, err)
+			if ret != nil {
+				ret.Close()
+			}
+			continue
+		}
+		log.Printf("Uprobe %s:%s at offset 0x%x (%s)", lib, symbol, sym.Offset, sym.Source)
+		links = append(links, l)
+		if ret != nil {
+			links = append(links, ret)
+		}
+	}
+	return links
+}
@@ -0,0 +1,235 @@
+// Deep allocation capture, escalated from memory growth alerts
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cilium/ebpf/link"
+
+	"probepilot/pkg/attach"
+	"probepilot/pkg/reaction"
+	"probepilot/pkg/topk"
+	"probepilot/pkg/units"
+)
+
+// Must match MAX_STACK_DEPTH in memory_tracker.c
+const maxStackDepth = 20
+
+// allocCapture accumulates allocation stacks of one PID during a capture
+type allocCapture struct {
+	mu     sync.Mutex
+	events uint64
+	bytes  uint64
+	stacks *topk.Sketch[uint64, stackTotals] // by bytes allocated
+}
+
+type stackTotals struct {
+	count uint64
+	bytes uint64
+}
+
+// EnableGrowthCapture fires a memory_growth alert when a process grows by
+// more than threshold between two checks, escalating to PID-scoped
+// allocation uprobes for the given duration, as large allocations past a
+// capture threshold also do
+func (mt *MemoryTracker) EnableGrowthCapture(threshold uint64, duration time.Duration) {
+	mt.growthThreshold = threshold
+	mt.reactor = reaction.NewReactor(reaction.Escalation{
+		Name:     "allocation-stacks",
+		Alerts:   []string{"memory_growth", "heap_growth", "large_allocation"},
+		Duration: duration,
+		Cooldown: 10 * time.Minute,
+		Action:   mt.captureAllocations,
+	})
+	mt.reactor.OnReport = func(r reaction.Report) {
+		if r.Err != nil {
+			log.Printf("Escalation %s for %s failed: %v", r.Escalation, r.Alert, r.Err)
+			return
+		}
+		log.Printf("Escalation %s for %s finished:\n%s", r.Escalation, r.Alert, r.Body)
+	}
+}
+
+// CheckGrowth compares per-process usage with the previous check and
+// fires alerts for processes that grew past the threshold
+func (mt *MemoryTracker) CheckGrowth(ctx context.Context) {
+	if mt.reactor == nil || mt.growthThreshold == 0 {
+		return
+	}
+
+	now := time.Now()
+	mt.processStats.Each(func(id ProcKey, stats *ProcessMemory) bool {
+		pid := id.PID
+		prev, seen := mt.lastUsage[id]
+		mt.lastUsage[id] = stats.CurrentUsage
+		if !seen || stats.CurrentUsage <= prev || stats.CurrentUsage-prev < mt.growthThreshold {
+			return true
+		}
+		mt.alert(ctx, reaction.Alert{
+			Name:     "memory_growth",
+			Severity: "warning",
+			PID:      pid,
+			Message: fmt.Sprintf("%s grew by %s to %s", mt.procs.Name(pid),
+				units.Bytes(stats.CurrentUsage-prev), units.Bytes(stats.CurrentUsage)),
+			FiredAt: now,
+		})
+		return true
+	})
+	for id := range mt.lastUsage {
+		if _, ok := mt.processStats.Get(id); !ok {
+			delete(mt.lastUsage, id)
+		}
+	}
+}
+
+// captureAllocations attaches allocator uprobes scoped to the alerting
+// PID until ctx expires, then reports its hottest allocation stacks
+func (mt *MemoryTracker) captureAllocations(ctx context.Context, alert reaction.Alert) (string, error) {
+	pid := alert.PID
+	alloc, lib, err := processAllocator(pid)
+	if err != nil {
+		return "", err
+	}
+
+	// The global uprobes, or those of a target process, already see this
+	// library; attaching again would count every call twice
+	var links []link.Link
+	mt.allocMu.Lock()
+	_, target := mt.targetLinks[pid]
+	traced := target || (len(mt.targetPIDs) == 0 && mt.tracing(lib))
+	mt.allocMu.Unlock()
+	if !traced {
+		links, err = mt.attachPIDUprobes(alloc, lib, pid)
+		if err != nil {
+			return "", err
+		}
+	}
+	defer func() {
+		for _, l := range links {
+			l.Close()
+		}
+	}()
+
+	// A PID filter would drop the process's events before they reach the
+	// capture; let it through while the capture runs
+	if mt.pidFilter != nil && !mt.pidFilter.Contains(pid) {
+		if err := mt.pidFilter.Add(pid); err != nil {
+			return "", err
+		}
+		defer mt.pidFilter.Remove(pid)
+	}
+
+	capture := &allocCapture{stacks: topk.New[uint64, stackTotals](mt.limits.TopKEntries())}
+	mt.captureMu.Lock()
+	mt.captures[pid] = capture
+	mt.captureMu.Unlock()
+
+	<-ctx.Done()
+
+	// Name the stacks while the capture still keeps them from pruning
+	body := mt.formatCapture(pid, capture)
+	mt.captureMu.Lock()
+	delete(mt.captures, pid)
+	mt.captureMu.Unlock()
+
+	return body, nil
+}
+
+func (mt *MemoryTracker) attachPIDUprobes(alloc *allocator, lib string, pid uint32) ([]link.Link, error) {
+	var links []link.Link
+	closeAll := func() {
+		for _, l := range links {
+			l.Close()
+		}
+	}
+	for _, fn := range alloc.funcs {
+		symbol := alloc.symbol(lib, fn)
+		// Returns first: an entry without its return would leave calls
+		// pending
+		progs := []string{fn.entry}
+		if fn.ret != "" {
+			progs = []string{fn.ret, fn.entry}
+		}
+		attached := len(links)
+		for _, prog := range progs {
+			l, _, err := attach.Uprobe(mt.coll, prog, lib, symbol, attach.UprobeOptions{PID: int(pid), Return: prog == fn.ret})
+			if err != nil && fn.optional {
+				for _, l := range links[attached:] {
+					l.Close()
+				}
+				links = links[:attached]
+				break
+			}
+			if err != nil {
+				closeAll()
+				return nil, fmt.Errorf("attach %s to %s for PID %d: %v", prog, lib, pid, err)
+			}
+			links = append(links, l)
+		}
+	}
+	return links, nil
+}
+
+// recordCapture adds an allocation event to the capture of its PID, if any
+func (mt *MemoryTracker) recordCapture(event *MemoryEvent) {
+	if !heapAllocation(event.Type) {
+		return
+	}
+	mt.captureMu.Lock()
+	capture := mt.captures[event.PID]
+	mt.captureMu.Unlock()
+	if capture == nil {
+		return
+	}
+
+	capture.mu.Lock()
+	defer capture.mu.Unlock()
+	capture.events++
+	capture.bytes += event.Size
+	// bpf_get_stackid failures come through as negative ids
+	if int64(event.StackID) < 0 {
+		return
+	}
+	totals := capture.stacks.Add(event.StackID, event.Size)
+	totals.count++
+	totals.bytes += event.Size
+}
+
+func (mt *MemoryTracker) formatCapture(pid uint32, capture *allocCapture) string {
+	capture.mu.Lock()
+	defer capture.mu.Unlock()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "  PID %d (%s): %d allocations, %s\n",
+		pid, mt.procs.Name(pid), capture.events, units.Bytes(capture.bytes))
+	for _, s := range capture.stacks.Top(10) {
+		fmt.Fprintf(&b, "  Stack %d: %d allocations, %s\n", s.Key, s.Value.count, units.Bytes(s.Value.bytes))
+		for _, frame := range mt.stacks.frames(stackRef{pid: pid, user: int64(s.Key), kernel: -1}) {
+			fmt.Fprintf(&b, "    %s\n", frame)
+		}
+	}
+	return b.String()
+}
+
+// sameFile reports whether a and b name the same file, however reached
+func sameFile(a, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	ia, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	ib, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(ia, ib)
+}
@@ -0,0 +1,218 @@
+// Cgroups: the traced allocations of each process summed by the cgroup v2
+// it last allocated or freed in, as BPF records it in process_memory_map,
+// set against the cgroup's memory.current and memory.max, with a warning
+// when a cgroup nears its limit
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"probepilot/pkg/control"
+	"probepilot/pkg/query"
+	"probepilot/pkg/reaction"
+	"probepilot/pkg/target"
+	"probepilot/pkg/units"
+)
+
+const (
+	// cgroupExported bounds the cgroups in Samples
+	cgroupExported = 20
+	// cgroupContributors bounds the processes a limit warning names
+	cgroupContributors = 3
+)
+
+// cgroupUsage is what the processes of a cgroup allocated, and the
+// cgroup's memory as the kernel accounts it
+type cgroupUsage struct {
+	id   uint64
+	path string
+	// Traced allocations of its processes: outstanding, in total, and
+	// how many
+	current     uint64
+	allocated   uint64
+	allocations uint64
+	processes   []cgroupProcess
+	// memory is valid if limited, the memory controller's files read
+	memory  target.CgroupMemory
+	limited bool
+}
+
+// cgroupProcess is a process of a cgroup and its outstanding allocations
+type cgroupProcess struct {
+	id      ProcKey
+	current uint64
+}
+
+// name is the cgroup's path, or its ID if it could not be resolved
+func (c *cgroupUsage) name() string {
+	if c.path != "" {
+		return c.path
+	}
+	return "cgroup-" + strconv.FormatUint(c.id, 10)
+}
+
+// usage is the share of memory.max the cgroup uses, 0 without a limit
+func (c *cgroupUsage) usage() float64 {
+	if !c.limited || c.memory.Max == 0 {
+		return 0
+	}
+	return float64(c.memory.Current) / float64(c.memory.Max)
+}
+
+// sampleCgroups sums process_memory_map by cgroup, reads the limits of
+// each cgroup, and warns of those past -cgroup-warn of memory.max
+func (mt *MemoryTracker) sampleCgroups(ctx context.Context) error {
+	m := mt.coll.Maps["process_memory_map"]
+	if m == nil {
+		return errors.New("no process_memory_map map")
+	}
+	byID := make(map[uint64]*cgroupUsage)
+	var id ProcKey
+	var stats ProcessMemory
+	iter := m.Iterate()
+	for iter.Next(&id, &stats) {
+		if stats.CgroupID == 0 {
+			continue
+		}
+		c, ok := byID[stats.CgroupID]
+		if !ok {
+			c = &cgroupUsage{id: stats.CgroupID}
+			byID[stats.CgroupID] = c
+		}
+		c.current += stats.CurrentUsage
+		c.allocated += stats.TotalAllocated
+		c.allocations += stats.AllocationCount
+		c.processes = append(c.processes, cgroupProcess{id: id, current: stats.CurrentUsage})
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	cgroups := make([]*cgroupUsage, 0, len(byID))
+	for _, c := range byID {
+		c.path, _ = mt.cgroupPaths.Path(c.id)
+		if c.path != "" {
+			if mem, err := target.ReadCgroupMemory(c.path); err == nil {
+				c.memory, c.limited = mem, true
+			}
+		}
+		cgroups = append(cgroups, c)
+	}
+	sort.Slice(cgroups, func(i, j int) bool {
+		if cgroups[i].memory.Current != cgroups[j].memory.Current {
+			return cgroups[i].memory.Current > cgroups[j].memory.Current
+		}
+		return cgroups[i].current > cgroups[j].current
+	})
+	mt.cgroups = cgroups
+
+	for cid := range mt.cgroupAlerted {
+		if c, ok := byID[cid]; !ok || c.usage() < mt.cgroupWarn {
+			delete(mt.cgroupAlerted, cid)
+		}
+	}
+	if mt.cgroupWarn > 0 {
+		for _, c := range cgroups {
+			if c.usage() >= mt.cgroupWarn && !mt.cgroupAlerted[c.id] {
+				mt.cgroupAlerted[c.id] = true
+				mt.warnCgroup(ctx, c)
+			}
+		}
+	}
+	return nil
+}
+
+// warnCgroup routes and outputs a warning of a cgroup near its limit,
+// naming the processes in it with the most outstanding, and tells the
+// notifier
+func (mt *MemoryTracker) warnCgroup(ctx context.Context, c *cgroupUsage) {
+	mt.cgroupWarnings++
+	procs := append([]cgroupProcess(nil), c.processes...)
+	sort.Slice(procs, func(i, j int) bool { return procs[i].current > procs[j].current })
+	if len(procs) > cgroupContributors {
+		procs = procs[:cgroupContributors]
+	}
+	labels := query.Labels{
+		"type":        "cgroup_memory_limit",
+		"cgroup":      c.name(),
+		"usage_ratio": strconv.FormatFloat(c.usage(), 'f', 2, 64),
+	}
+	if id := target.ContainerID(c.path); id != "" {
+		labels["container_id"] = id
+	}
+	text := fmt.Sprintf("cgroup %s at %.0f%% of memory.max: %s of %s, traced allocations %s outstanding in %d processes",
+		c.name(), c.usage()*100, units.Bytes(c.memory.Current), units.Bytes(c.memory.Max), units.Bytes(c.current), len(c.processes))
+	for i, p := range procs {
+		if i == 0 {
+			labels["pid"] = strconv.FormatUint(uint64(p.id.PID), 10)
+			labels["comm"] = mt.procs.Name(p.id.PID)
+			mt.procs.AddPIDLabels(labels, p.id.PID)
+		}
+		text += fmt.Sprintf("; pid=%d comm=%s outstanding=%s", p.id.PID, mt.procs.Name(p.id.PID), units.Bytes(p.current))
+	}
+	alert := reaction.Alert{Name: "cgroup_memory_limit", Severity: "warning", Message: text, FiredAt: time.Now()}
+	mt.control.Publish(control.Event{Labels: labels, Text: alert.String()})
+	mt.router.Route(labels, alert.String())
+	mt.output.Event(labels, alert.String())
+	if !mt.output.JSON() {
+		fmt.Printf("Cgroup Memory Warning: %s\n", text)
+	}
+	reaction.Notify(ctx, mt.notifier, alert)
+}
+
+// printCgroups prints the cgroups using the most memory
+func (mt *MemoryTracker) printCgroups() {
+	if len(mt.cgroups) == 0 {
+		return
+	}
+	fmt.Printf("\nTop 10 cgroups:\n")
+	for i, c := range mt.cgroups {
+		if i == 10 {
+			break
+		}
+		line := fmt.Sprintf("  %s: Traced=%s, Allocs=%d, Processes=%d", c.name(), units.Bytes(c.current), c.allocations, len(c.processes))
+		if c.limited {
+			line += fmt.Sprintf(", Current=%s", units.Bytes(c.memory.Current))
+			if c.memory.High > 0 {
+				line += fmt.Sprintf(", High=%s", units.Bytes(c.memory.High))
+			}
+			if c.memory.Max > 0 {
+				line += fmt.Sprintf(", Max=%s (%.0f%%)", units.Bytes(c.memory.Max), c.usage()*100)
+			}
+		}
+		fmt.Println(line)
+	}
+}
+
+// cgroupSamples exports the cgroups using the most memory
+func (mt *MemoryTracker) cgroupSamples() []query.Sample {
+	samples := []query.Sample{{Name: "cgroup_memory_limit_warnings_total", Value: float64(mt.cgroupWarnings)}}
+	for i, c := range mt.cgroups {
+		if i == cgroupExported {
+			break
+		}
+		labels := query.Labels{"cgroup": c.name()}
+		samples = append(samples,
+			query.Sample{Name: "cgroup_memory_traced_bytes", Labels: labels, Value: float64(c.current)},
+			query.Sample{Name: "cgroup_memory_allocated_bytes_total", Labels: labels, Value: float64(c.allocated)},
+			query.Sample{Name: "cgroup_memory_processes", Labels: labels, Value: float64(len(c.processes))},
+		)
+		if !c.limited {
+			continue
+		}
+		samples = append(samples, query.Sample{Name: "cgroup_memory_current_bytes", Labels: labels, Value: float64(c.memory.Current)})
+		if c.memory.Max > 0 {
+			samples = append(samples,
+				query.Sample{Name: "cgroup_memory_max_bytes", Labels: labels, Value: float64(c.memory.Max)},
+				query.Sample{Name: "cgroup_memory_usage_ratio", Labels: labels, Value: c.usage()},
+			)
+		}
+	}
+	return samples
+}
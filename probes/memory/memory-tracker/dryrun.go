@@ -0,0 +1,233 @@
+// Dry run: the tracker's attach plan, printed instead of running
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/cilium/ebpf"
+
+	"probepilot/pkg/attach"
+	"probepilot/pkg/core"
+	"probepilot/pkg/expr"
+	"probepilot/pkg/layout"
+	"probepilot/pkg/otlp"
+	"probepilot/pkg/output"
+	"probepilot/pkg/plan"
+	"probepilot/pkg/probe"
+	"probepilot/pkg/profile"
+	"probepilot/pkg/route"
+	"probepilot/pkg/sampling"
+	"probepilot/pkg/summary"
+	"probepilot/pkg/tsdb"
+)
+
+// tracepointCost rates the core tracepoints; the mmap family fires with
+// every mapping change, the rest on memory pressure or process exit only
+var tracepointCost = map[string]plan.Overhead{
+	"vmscan": plan.Low,
+	"oom":    plan.Low,
+	"sched":  plan.Low,
+}
+
+// dryRunPlan verifies the programs and prints what the tracker would
+// attach and export under config, then exits without attaching anything
+func dryRunPlan(run *summary.Run, config Config, growthAlert uint64, routes, listen, controlSocket string, out output.Options, otlpMetrics string, otlpLogs *route.Tap, hook route.HookConfig, filter *expr.Program, coalesce route.CoalesceConfig) {
+	p := plan.New("memory-tracker", config.Profile)
+	if err := p.Routes(routes); err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+
+	spec, err := ebpf.LoadCollectionSpec(probe.Object("memory_tracker.o"))
+	if err != nil {
+		run.Fatal(summary.StageLoad, "Failed to load eBPF spec: %v", err)
+	}
+	if err := layout.ValidateAll(spec.Types, layoutChecks...); err != nil && !errors.Is(err, layout.ErrNoBTF) {
+		run.Fatal(summary.StageLoad, "memory_tracker.o does not match agent structs (rebuild both): %v", err)
+	}
+	if err := config.Limits.ApplySpec(spec); err != nil {
+		run.Fatal(summary.StageConfig, "Invalid map limits: %v", err)
+	}
+	attach.Prepare(spec, config.AttachMode, kernelFuncs)
+	attach.Prepare(spec, config.AttachMode, faultFuncs)
+	kernel, err := core.Detect(config.KernelBTF)
+	if err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	if err := kernel.Err(); err != nil {
+		run.Fatal(summary.StageLoad, "Cannot run memory tracker: %v", err)
+	}
+	dropped, err := kernel.Prepare(spec, requiredPrograms...)
+	if err != nil {
+		run.Fatal(summary.StageLoad, "Failed to load eBPF programs: %v", fmt.Errorf("memory_tracker.o cannot run on %s: %w", kernel, err))
+	}
+	p.Core(kernel, dropped)
+	p.Verify("memory_tracker.o", spec, kernel.Options())
+
+	for _, tp := range tracepoints {
+		cost, ok := tracepointCost[tp.group]
+		if !ok {
+			cost = plan.Medium
+		}
+		p.Hooks = append(p.Hooks, plan.Hook{Kind: "tracepoint", Target: tp.group + "/" + tp.name,
+			Program: tp.prog, Enabled: true, Cost: cost})
+	}
+	p.Hooks = append(p.Hooks, plan.KernelHooks(profile.HookPageFaults, config.AttachMode, faultFuncs,
+		config.Profile.Enabled(profile.HookPageFaults), plan.High)...)
+	swap := config.Profile.Enabled(profile.HookSwap)
+	p.Hooks = append(p.Hooks, plan.KernelHooks(profile.HookSwap, attach.ModeKprobe, swapFuncs, swap, plan.Low)...)
+	for _, tp := range reclaimTracepoints {
+		p.Hooks = append(p.Hooks, plan.Hook{Set: profile.HookSwap, Kind: "tracepoint", Target: tp.group + "/" + tp.name,
+			Program: tp.prog, Enabled: swap, Cost: plan.Low})
+	}
+	kmem := config.Profile.Enabled(profile.HookKmem)
+	for _, tp := range kmemTracepoints {
+		p.Hooks = append(p.Hooks, plan.Hook{Set: profile.HookKmem, Kind: "tracepoint", Target: tp.group + "/" + tp.name,
+			Program: tp.prog, Enabled: kmem, Cost: plan.High})
+	}
+	p.Hooks = append(p.Hooks, plan.KernelHooks(profile.HookPageAlloc, config.AttachMode, kernelFuncs,
+		config.Profile.Enabled(profile.HookPageAlloc), plan.High)...)
+
+	// The BPF-side PID filter saves the event, not the uprobe trap itself
+	uprobes := config.Profile.Enabled(profile.HookUprobes)
+	if len(config.TargetPIDs) > 0 {
+		// Target processes replace the system-wide uprobes
+		for _, pid := range config.TargetPIDs {
+			libs, err := processLibs(pid)
+			if err != nil {
+				run.Fatal(summary.StageConfig, "Invalid configuration: %v", fmt.Errorf("target PID %d: %v", pid, err))
+			}
+			for _, lib := range libs {
+				p.Hooks = append(p.Hooks, allocHooks(fmt.Sprintf("PID %d %s", pid, lib.path), lib.alloc.funcs, true)...)
+			}
+		}
+	} else {
+		libc := firstPath(libcPaths)
+		if libc == "" {
+			libc = "libc (not found)"
+		}
+		p.Hooks = append(p.Hooks, allocHooks(libc, libcAllocFuncs, uprobes)...)
+		// C++ programs only, so not worth a warning when missing
+		if libstdcxx := firstPath(libstdcxxPaths); libstdcxx != "" {
+			p.Hooks = append(p.Hooks, allocHooks(libstdcxx, cxxAllocFuncs, uprobes)...)
+		}
+	}
+	capture := config.Profile.Enabled(profile.HookDeepCapture) && (growthAlert > 0 || config.LargeAllocs.has(actionCapture))
+	p.Hooks = append(p.Hooks, plan.Hook{Set: profile.HookDeepCapture, Kind: "uprobe",
+		Target: "libc allocator functions of PIDs alerting on growth or large allocations", Program: "trace_malloc,trace_malloc_ret,trace_free,...",
+		Enabled: capture, Cost: plan.Medium})
+
+	if len(config.PIDs) > 0 {
+		pids := make([]string, len(config.PIDs))
+		for i, pid := range config.PIDs {
+			pids[i] = fmt.Sprint(pid)
+		}
+		p.Filter("pids", strings.Join(pids, ",")+" (malloc/free, inside BPF)")
+	}
+	p.Filter("large allocations", config.LargeAllocs.String())
+	p.Filter("sampling", config.Sampling.String()+" (inside BPF)")
+	if config.AdaptiveSampling > 0 {
+		p.Filter("adaptive sampling", fmt.Sprintf("allocation sampling doubled from 1 in %d, up to 1 in %d, while the ring buffer drops over %v records/s", max(config.Sampling.Rate, 1), sampling.MaxAdaptiveRate, config.AdaptiveSampling))
+	}
+	leaks := fmt.Sprintf("at most %d, evicting %s first", config.MaxLeaks, config.LeakEviction)
+	if config.MaxLeaks == 0 {
+		leaks = "unbounded"
+	}
+	if config.LeakSpill != "" {
+		leaks += ", spilled to " + config.LeakSpill
+	}
+	if config.LeakReport != "" {
+		leaks += ", grouped by comm and stack into " + config.LeakReport
+	}
+	p.Filter("potential leaks", leaks)
+	if config.PerThread {
+		p.Filter("threads", fmt.Sprintf("the %d heaviest allocating threads, from allocation events, with the growth of their live bytes every report", config.Limits.TopKEntries()))
+	}
+	if config.Fragmentation {
+		p.Filter("heap fragmentation", fmt.Sprintf("the heaps of the %d heaviest allocating processes, from allocation events and smaps", config.Limits.TopKEntries()))
+	}
+	cgroups := "traced allocations by cgroup v2, against memory.current and memory.max"
+	if config.CgroupWarn > 0 {
+		cgroups += fmt.Sprintf(", warning at %v%% of memory.max", config.CgroupWarn)
+	}
+	p.Filter("cgroups", cgroups)
+	if config.PressureThreshold > 0 {
+		p.Filter("pressure incidents", fmt.Sprintf("seconds stalled on memory for %v%%, from /proc/pressure/memory", config.PressureThreshold))
+	}
+	if config.ExitRetention > 0 {
+		p.Filter("exited processes", fmt.Sprintf("summaries kept for %v, at most %d", config.ExitRetention, exitedRetained))
+	}
+	if config.NUMA {
+		p.Filter("numa", "page allocations by node, from process_memory_map")
+	}
+	if config.Queue != nil {
+		p.Filter("event queue", fmt.Sprintf("%d records, allocations and frees shed first, process exits, OOM kills and W+X mappings never", config.Queue.Stats().Capacity))
+	}
+	if config.Targets != nil {
+		p.Filter("targets", config.Targets.String()+" (every probe, inside BPF)")
+	}
+	if listen != "" {
+		p.Export("query API", listen)
+		p.Export("Grafana datasource", tsdb.GrafanaPath+" on "+listen)
+	}
+	if controlSocket != "" {
+		p.Export("control socket", controlSocket)
+	}
+	switch out.Format {
+	case output.JSON:
+		p.Export("JSON lines", out.Destination())
+	case output.Binary:
+		p.Export("binary event log", out.Destination())
+	}
+	if otlpMetrics != "" {
+		url, err := otlp.SignalURL(otlpMetrics, otlp.MetricsPath)
+		if err != nil {
+			run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+		}
+		p.Export("OTLP metrics", url)
+	}
+	if otlpLogs != nil {
+		p.Export("OTLP logs", otlpLogs.String())
+	}
+	if config.OOMReportDir != "" {
+		p.Export("OOM reports", config.OOMReportDir)
+	}
+	if config.Seal != nil {
+		p.Filter("sealing", "OOM reports, leak report and leak spill under "+config.Seal.String())
+	}
+	if hook.Module != "" {
+		p.Filter("event hook", hook.String()+" (before routing)")
+	}
+	if filter != nil {
+		p.Filter("event filter", filter.String()+" (before routing)")
+	}
+	if coalesce.Window > 0 {
+		p.Filter("event coalescing", coalesce.String()+" (before routing)")
+	}
+
+	if err := p.Write(os.Stdout); err != nil {
+		run.Fatal(summary.StageRun, "Failed to print the plan: %v", err)
+	}
+	if err := p.Err(); err != nil {
+		run.Fatal(summary.StageLoad, "eBPF programs failed verification: %v", err)
+	}
+	run.Finish()
+	os.Exit(0)
+}
+
+// allocHooks are the uprobes and uretprobes of funcs in lib
+func allocHooks(lib string, funcs []allocFunc, enabled bool) []plan.Hook {
+	var hooks []plan.Hook
+	for _, fn := range funcs {
+		hooks = append(hooks, plan.Hook{Set: profile.HookUprobes, Kind: "uprobe", Target: lib + ":" + fn.symbol,
+			Program: fn.entry, Enabled: enabled, Cost: plan.High})
+		if fn.ret != "" {
+			hooks = append(hooks, plan.Hook{Set: profile.HookUprobes, Kind: "uretprobe", Target: lib + ":" + fn.symbol,
+				Program: fn.ret, Enabled: enabled, Cost: plan.High})
+		}
+	}
+	return hooks
+}
@@ -0,0 +1,181 @@
+// Page faults: the user faults of each process, minor and major, by the
+// kind of mapping they hit, and how long major faults took, timed around
+// handle_mm_fault under the page-faults hook set
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+	"unsafe"
+
+	"github.com/cilium/ebpf/link"
+
+	"probepilot/pkg/attach"
+	"probepilot/pkg/decode"
+	"probepilot/pkg/histogram"
+	"probepilot/pkg/profile"
+	"probepilot/pkg/query"
+)
+
+// faultFuncs time user page faults; the entry program classifies the
+// faulting mapping, the return program counts the fault
+var faultFuncs = []attach.KernelFunc{
+	{Symbol: "handle_mm_fault", Kprobe: "handle_mm_fault", Fentry: "handle_mm_fault_fentry"},
+	{Symbol: "handle_mm_fault", Kprobe: "handle_mm_fault_ret", Fentry: "handle_mm_fault_fexit", Return: true},
+}
+
+// faultRegions name enum fault_region
+var faultRegions = []string{"anon", "heap", "stack", "file"}
+
+// faultEventSize tells major faults apart from events in the ring buffer
+var faultEventSize = int(unsafe.Sizeof(FaultEvent{}))
+
+// faultLatencyBuckets are the default classic major fault latency
+// boundaries, 10us to ~1s
+var faultLatencyBuckets = histogram.ExponentialBuckets(0.00001, 2, 17)
+
+// faultExported bounds the processes whose faults are in Samples
+const faultExported = 20
+
+func regionName(region uint32) string {
+	if int(region) < len(faultRegions) {
+		return faultRegions[region]
+	}
+	return fmt.Sprintf("unknown(%d)", region)
+}
+
+func (mt *MemoryTracker) attachPageFaults() ([]link.Link, error) {
+	links, _, err := attach.Kernel(mt.coll, mt.attachMode, faultFuncs)
+	if err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+// handleFault observes the latency of a major fault in the histogram of
+// its region
+func (mt *MemoryTracker) handleFault(record []byte) error {
+	var event FaultEvent
+	if err := decode.Record(record, &event); err != nil {
+		return fmt.Errorf("failed to parse page fault: %v", err)
+	}
+	mt.pageEvents++
+	h, ok := mt.faultLatency[event.Region]
+	if !ok {
+		h = mt.histograms.New("memory_major_fault_latency_seconds", faultLatencyBuckets)
+		mt.faultLatency[event.Region] = h
+	}
+	h.ObserveWithExemplar(time.Duration(event.LatencyNs).Seconds(), query.Labels{
+		"pid":  strconv.Itoa(int(event.PID)),
+		"comm": string(bytes.TrimRight(event.Comm[:], "\x00")),
+		"addr": fmt.Sprintf("0x%x", event.Address),
+	})
+	return nil
+}
+
+// processFaults are the page faults of a process
+type processFaults struct {
+	id ProcKey
+	FaultStats
+}
+
+// topFaults returns the n processes with the most major, then minor,
+// faults
+func (mt *MemoryTracker) topFaults(n int) ([]processFaults, error) {
+	m := mt.coll.Maps["fault_stats_map"]
+	if m == nil {
+		return nil, errors.New("no fault_stats_map map")
+	}
+	var procs []processFaults
+	var id ProcKey
+	var stats FaultStats
+	iter := m.Iterate()
+	for iter.Next(&id, &stats) {
+		procs = append(procs, processFaults{id: id, FaultStats: stats})
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(procs, func(i, j int) bool {
+		if procs[i].Major != procs[j].Major {
+			return procs[i].Major > procs[j].Major
+		}
+		return procs[i].Minor > procs[j].Minor
+	})
+	if len(procs) > n {
+		procs = procs[:n]
+	}
+	return procs, nil
+}
+
+// averageMajor is how long a major fault of the process took on average
+func (p *processFaults) averageMajor() time.Duration {
+	if p.Major == 0 {
+		return 0
+	}
+	return time.Duration(p.MajorNs / p.Major)
+}
+
+// printFaults prints the processes faulting the most, under the
+// page-faults hook set
+func (mt *MemoryTracker) printFaults() {
+	if !mt.hooks.States()[profile.HookPageFaults] {
+		return
+	}
+	procs, err := mt.topFaults(10)
+	if err != nil {
+		log.Printf("Warning: failed to read page faults: %v", err)
+		return
+	}
+	fmt.Printf("\nTop 10 page-faulting processes:\n")
+	for _, p := range procs {
+		fmt.Printf("  PID %d (%s): Minor=%d, Major=%d (avg %v), Heap=%d, Stack=%d, File=%d, Anon=%d\n",
+			p.id.PID, mt.procs.Name(p.id.PID), p.Minor, p.Major, p.averageMajor().Round(time.Microsecond),
+			p.Regions[1], p.Regions[2], p.Regions[3], p.Regions[0])
+	}
+}
+
+// faultSamples exports the faults of the processes faulting the most
+func (mt *MemoryTracker) faultSamples() []query.Sample {
+	if !mt.hooks.States()[profile.HookPageFaults] {
+		return nil
+	}
+	procs, err := mt.topFaults(faultExported)
+	if err != nil {
+		return nil
+	}
+	var samples []query.Sample
+	for _, p := range procs {
+		labels := query.Labels{
+			"pid":  strconv.FormatUint(uint64(p.id.PID), 10),
+			"comm": mt.procs.Name(p.id.PID),
+		}
+		mt.procs.AddPIDLabels(labels, p.id.PID)
+		samples = append(samples,
+			query.Sample{Name: "process_page_faults_total", Labels: withLabel(labels, "type", "minor"), Value: float64(p.Minor)},
+			query.Sample{Name: "process_page_faults_total", Labels: withLabel(labels, "type", "major"), Value: float64(p.Major)},
+			query.Sample{Name: "process_major_fault_seconds_total", Labels: labels, Value: time.Duration(p.MajorNs).Seconds()},
+		)
+		for region, n := range p.Regions {
+			samples = append(samples, query.Sample{Name: "process_page_faults_by_region_total",
+				Labels: withLabel(labels, "region", regionName(uint32(region))), Value: float64(n)})
+		}
+	}
+	return samples
+}
+
+// withLabel returns a copy of labels with name set to value
+func withLabel(labels query.Labels, name, value string) query.Labels {
+	l := make(query.Labels, len(labels)+1)
+	for k, v := range labels {
+		l[k] = v
+	}
+	l[name] = value
+	return l
+}
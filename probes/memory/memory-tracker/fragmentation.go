@@ -0,0 +1,280 @@
+// Fragmentation: under -fragmentation the live heap bytes of each process,
+// counted from its allocations and frees by size class, every one sent,
+// are set against the heap footprint the kernel holds for it, the [heap]
+// and private anonymous mappings of /proc/<pid>/smaps. A footprint far
+// above what is live, and growing while live bytes do not, is
+// fragmentation rather than a leak. Anonymous mappings the allocator did
+// not make, e.g. thread stacks or JIT code, count as fragmentation too
+// (hence estimate)
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"probepilot/pkg/limits"
+	"probepilot/pkg/procfs"
+	"probepilot/pkg/query"
+	"probepilot/pkg/units"
+)
+
+// fragmentation bounds: the processes in Samples, and the reports the
+// trend of each is taken over
+const (
+	fragExported    = 20
+	fragTrendPoints = 10
+)
+
+// heapState is the heap of a process: what its allocations hold live by
+// size class, the program breaks and mappings it asked for, and what
+// smaps says backs it
+type heapState struct {
+	// live is the heap bytes allocated and not freed, and classes the
+	// allocations by the size class of allocSizeBuckets, the last
+	// larger than any
+	live    uint64
+	classes []uint64
+	// brkStart and brkEnd are the first and last program breaks set,
+	// mapped the bytes mmap added less those munmap took
+	brkStart, brkEnd uint64
+	mapped           int64
+	// heap is smaps at the last report, read if read is set
+	heap  procfs.Heap
+	read  bool
+	trend []fragPoint
+}
+
+// fragPoint is the fragmentation of a process at a report
+type fragPoint struct {
+	at    time.Time
+	ratio float64
+}
+
+// sizeClass is the index in heapState.classes of an allocation of size
+func sizeClass(size uint64) int {
+	return sort.SearchFloat64s(allocSizeBuckets, float64(size))
+}
+
+// sizeClassName names a size class by its upper bound, e.g. "<=4K"
+func sizeClassName(i int) string {
+	if i == len(allocSizeBuckets) {
+		return ">" + limits.FormatSize(uint64(allocSizeBuckets[i-1]))
+	}
+	return "<=" + limits.FormatSize(uint64(allocSizeBuckets[i]))
+}
+
+// observeHeap counts a heap allocation, program break or mapping of a
+// process
+func (mt *MemoryTracker) observeHeap(id ProcKey, event *MemoryEvent) {
+	if mt.heaps == nil || event.StartTime == 0 {
+		return
+	}
+	switch {
+	case heapAllocation(event.Type):
+		h := mt.heaps.Add(id, event.Size)
+		if h.classes == nil {
+			h.classes = make([]uint64, len(allocSizeBuckets)+1)
+		}
+		h.live += event.Size
+		h.classes[sizeClass(event.Size)]++
+	case event.Type == AllocBrk:
+		// brk(0) asks where the break is
+		if h, ok := mt.heaps.Get(id); ok && event.Addr != 0 {
+			if h.brkStart == 0 {
+				h.brkStart = event.Addr
+			}
+			h.brkEnd = event.Addr
+		}
+	case event.Type == AllocMmap:
+		if h, ok := mt.heaps.Get(id); ok {
+			h.mapped += int64(event.Size)
+		}
+	}
+}
+
+// observeHeapFree takes a freed allocation, or unmapping, of size off its
+// process's heap
+func (mt *MemoryTracker) observeHeapFree(id ProcKey, typ uint32, size uint64) {
+	if mt.heaps == nil || size == 0 {
+		return
+	}
+	h, ok := mt.heaps.Get(id)
+	if !ok {
+		return
+	}
+	if typ == AllocMunmap {
+		h.mapped -= int64(size)
+		return
+	}
+	if h.live >= size {
+		h.live -= size
+	}
+	if c := &h.classes[sizeClass(size)]; *c > 0 {
+		*c--
+	}
+}
+
+// fragmentation is the share of the heap footprint of h that holds no
+// live allocation, 0 if smaps was not read
+func (mt *MemoryTracker) fragmentation(h *heapState) float64 {
+	footprint := h.heap.Footprint()
+	if !h.read || footprint == 0 || h.live >= footprint {
+		return 0
+	}
+	return 1 - float64(h.live)/float64(footprint)
+}
+
+// trendOver is how much the fragmentation of h moved over the reports
+// kept, and over how long
+func (h *heapState) trendOver() (float64, time.Duration) {
+	if len(h.trend) < 2 {
+		return 0, 0
+	}
+	first, last := h.trend[0], h.trend[len(h.trend)-1]
+	return last.ratio - first.ratio, last.at.Sub(first.at)
+}
+
+// sampleHeaps reads the heap footprint of every process tracked from
+// smaps, and notes its fragmentation for the trend. Processes gone are
+// left to sampleUsage to evict
+func (mt *MemoryTracker) sampleHeaps() {
+	if mt.heaps == nil {
+		return
+	}
+	now := time.Now()
+	mt.heaps.Each(func(id ProcKey, h *heapState) bool {
+		if mt.starts[id.PID] != id.StartTime {
+			h.read = false
+			return true
+		}
+		heap, err := procfs.ReadHeap(id.PID)
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				log.Printf("Warning: failed to read the heap of PID %d: %v", id.PID, err)
+			}
+			h.read = false
+			return true
+		}
+		h.heap, h.read = heap, true
+		h.trend = append(h.trend, fragPoint{at: now, ratio: mt.fragmentation(h)})
+		if len(h.trend) > fragTrendPoints {
+			h.trend = h.trend[len(h.trend)-fragTrendPoints:]
+		}
+		return true
+	})
+}
+
+// evictHeap drops the heap of a process that is gone
+func (mt *MemoryTracker) evictHeap(id ProcKey) {
+	if mt.heaps != nil {
+		mt.heaps.Remove(id)
+	}
+}
+
+// heapEntry is a process's heap, for sorting
+type heapEntry struct {
+	id ProcKey
+	*heapState
+}
+
+// topHeaps returns the n heaps read from smaps wasting the most bytes
+func (mt *MemoryTracker) topHeaps(n int) []heapEntry {
+	var top []heapEntry
+	mt.heaps.Each(func(id ProcKey, h *heapState) bool {
+		if h.read {
+			top = append(top, heapEntry{id: id, heapState: h})
+		}
+		return true
+	})
+	wasted := func(h heapEntry) float64 {
+		return mt.fragmentation(h.heapState) * float64(h.heap.Footprint())
+	}
+	sort.Slice(top, func(i, j int) bool { return wasted(top[i]) > wasted(top[j]) })
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// heapTotals sums the live heap bytes and footprints of the heaps read
+func (mt *MemoryTracker) heapTotals() (live, footprint uint64) {
+	mt.heaps.Each(func(_ ProcKey, h *heapState) bool {
+		if h.read {
+			live += h.live
+			footprint += h.heap.Footprint()
+		}
+		return true
+	})
+	return live, footprint
+}
+
+// printHeaps prints the processes whose heaps waste the most, with their
+// live allocations by size class
+func (mt *MemoryTracker) printHeaps() {
+	if mt.heaps == nil {
+		return
+	}
+	fmt.Printf("\nHeap fragmentation (live heap bytes vs. heap footprint in smaps):\n")
+	for _, h := range mt.topHeaps(10) {
+		line := fmt.Sprintf("  PID %d (%s): Live=%s, Footprint=%s (brk %s, anon %s in %d mappings), Fragmentation=%.0f%%",
+			h.id.PID, mt.procs.Name(h.id.PID), units.Bytes(h.live), units.Bytes(h.heap.Footprint()),
+			units.Bytes(h.heap.Brk), units.Bytes(h.heap.Anon), h.heap.Mappings, mt.fragmentation(h.heapState)*100)
+		if delta, span := h.trendOver(); span > 0 {
+			line += fmt.Sprintf(", Trend=%+.1f points over %s", delta*100, units.Duration(span))
+		}
+		if h.brkEnd > h.brkStart {
+			line += ", Brk growth=" + units.Bytes(h.brkEnd-h.brkStart)
+		}
+		if h.mapped > 0 {
+			line += ", Mapped=" + units.Bytes(uint64(h.mapped))
+		}
+		fmt.Println(line)
+		var classes []string
+		for i, n := range h.classes {
+			if n > 0 {
+				classes = append(classes, fmt.Sprintf("%s:%d", sizeClassName(i), n))
+			}
+		}
+		if len(classes) > 0 {
+			fmt.Printf("    Live allocations by size: %s\n", strings.Join(classes, " "))
+		}
+	}
+}
+
+// heapSamples exports the fragmentation of the processes whose heaps
+// waste the most, with their live allocations by size class
+func (mt *MemoryTracker) heapSamples() []query.Sample {
+	if mt.heaps == nil {
+		return nil
+	}
+	var samples []query.Sample
+	for _, h := range mt.topHeaps(fragExported) {
+		labels := query.Labels{
+			"pid":  strconv.FormatUint(uint64(h.id.PID), 10),
+			"comm": mt.procs.Name(h.id.PID),
+		}
+		mt.procs.AddPIDLabels(labels, h.id.PID)
+		samples = append(samples,
+			query.Sample{Name: "process_heap_live_bytes", Labels: labels, Value: float64(h.live)},
+			query.Sample{Name: "process_heap_footprint_bytes", Labels: labels, Value: float64(h.heap.Footprint())},
+			query.Sample{Name: "process_heap_fragmentation_ratio", Labels: labels, Value: mt.fragmentation(h.heapState)},
+		)
+		if h.brkEnd > h.brkStart {
+			samples = append(samples, query.Sample{Name: "process_heap_brk_growth_bytes", Labels: labels, Value: float64(h.brkEnd - h.brkStart)})
+		}
+		for i, n := range h.classes {
+			if n > 0 {
+				samples = append(samples, query.Sample{Name: "process_heap_live_allocations",
+					Labels: withLabel(labels, "size_class", sizeClassName(i)), Value: float64(n)})
+			}
+		}
+	}
+	return samples
+}
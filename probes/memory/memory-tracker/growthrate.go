@@ -0,0 +1,157 @@
+// Heap growth anomalies: the allocation rate and net growth of each
+// process over a sliding window of reports, alerting on heaps that only
+// grow, and faster than a slope, long before the OOM killer steps in
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"probepilot/pkg/query"
+	"probepilot/pkg/reaction"
+	"probepilot/pkg/units"
+)
+
+// growthPoint is a process's heap at one report
+type growthPoint struct {
+	at        time.Time
+	current   uint64
+	allocated uint64
+}
+
+// growthRates are what the window of a process says about its heap
+type growthRates struct {
+	// slope is the net growth, fitted by least squares, and alloc the
+	// allocation rate, both in bytes per second
+	slope, alloc float64
+	growth       uint64
+	span         time.Duration
+	// monotonic is set when the heap never shrank within the window
+	monotonic bool
+}
+
+// EnableGrowthRate alerts on processes whose heap grows monotonically
+// by more than slope bytes a minute over window, telling notifier
+func (mt *MemoryTracker) EnableGrowthRate(slope uint64, window time.Duration, notifier reaction.Notifier) {
+	mt.growthSlope = slope
+	mt.growthWindow = window
+	mt.growthWindows = make(map[ProcKey][]growthPoint)
+	mt.notifier = notifier
+}
+
+// checkGrowthRate adds this report to the window of every tracked process
+// and alerts on those growing steadily past the slope. A process alerted
+// on starts a new window
+func (mt *MemoryTracker) checkGrowthRate(ctx context.Context) {
+	if mt.growthWindow == 0 {
+		return
+	}
+	now := time.Now()
+	mt.processStats.Each(func(id ProcKey, stats *ProcessMemory) bool {
+		points := append(mt.growthWindows[id], growthPoint{at: now, current: stats.CurrentUsage, allocated: stats.TotalAllocated})
+		// Keep the newest point at or before the window's start, so a
+		// full window spans it entirely
+		for len(points) > 2 && now.Sub(points[1].at) >= mt.growthWindow {
+			points = points[1:]
+		}
+		mt.growthWindows[id] = points
+
+		r, ok := rates(points)
+		if !ok || mt.growthSlope == 0 || r.span < mt.growthWindow || !r.monotonic || r.slope*60 < float64(mt.growthSlope) {
+			return true
+		}
+		pid := id.PID
+		mt.alert(ctx, reaction.Alert{
+			Name:     "heap_growth",
+			Severity: "warning",
+			PID:      pid,
+			Message: fmt.Sprintf("%s grew monotonically by %s over %s, %s/min, allocating %s, to %s%s",
+				mt.procs.Name(pid), units.Bytes(r.growth), units.Duration(r.span), units.Bytes(uint64(r.slope*60)),
+				units.ByteRate(r.alloc), units.Bytes(stats.CurrentUsage), mt.growthAttribution(id)),
+			FiredAt: now,
+		})
+		mt.growthWindows[id] = points[len(points)-1:]
+		return true
+	})
+	for id := range mt.growthWindows {
+		if _, ok := mt.processStats.Get(id); !ok {
+			delete(mt.growthWindows, id)
+		}
+	}
+}
+
+// rates fits the window's points, at least two
+func rates(points []growthPoint) (growthRates, bool) {
+	if len(points) < 2 {
+		return growthRates{}, false
+	}
+	first, last := points[0], points[len(points)-1]
+	r := growthRates{span: last.at.Sub(first.at), monotonic: true}
+	if r.span <= 0 {
+		return growthRates{}, false
+	}
+	if last.current > first.current {
+		r.growth = last.current - first.current
+	}
+	r.alloc = float64(last.allocated-first.allocated) / r.span.Seconds()
+
+	var sx, sy, sxx, sxy float64
+	for i, p := range points {
+		x, y := p.at.Sub(first.at).Seconds(), float64(p.current)
+		sx, sy, sxx, sxy = sx+x, sy+y, sxx+x*x, sxy+x*y
+		if i > 0 && p.current < points[i-1].current {
+			r.monotonic = false
+		}
+	}
+	n := float64(len(points))
+	if d := n*sxx - sx*sx; d > 0 {
+		r.slope = (n*sxy - sx*sy) / d
+	}
+	return r, true
+}
+
+// growthRateSamples exports the growth and allocation rates of the
+// processes with a window
+func (mt *MemoryTracker) growthRateSamples() []query.Sample {
+	var samples []query.Sample
+	for id, points := range mt.growthWindows {
+		r, ok := rates(points)
+		if !ok {
+			continue
+		}
+		labels := query.Labels{
+			"pid":  strconv.FormatUint(uint64(id.PID), 10),
+			"comm": mt.procs.Name(id.PID),
+		}
+		mt.procs.AddPIDLabels(labels, id.PID)
+		samples = append(samples,
+			query.Sample{Name: "process_memory_growth_bytes_per_second", Labels: labels, Value: r.slope},
+			query.Sample{Name: "process_memory_allocation_rate_bytes_per_second", Labels: labels, Value: r.alloc},
+		)
+	}
+	return samples
+}
+
+// alert announces a fired alert and escalates it
+func (mt *MemoryTracker) alert(ctx context.Context, alert reaction.Alert) {
+	mt.announce(ctx, alert)
+	if mt.reactor != nil {
+		mt.reactor.Fire(ctx, alert)
+	}
+}
+
+// announce routes and outputs an alert and tells the notifier
+func (mt *MemoryTracker) announce(ctx context.Context, alert reaction.Alert) {
+	labels := query.Labels{
+		"type": alert.Name,
+		"pid":  strconv.FormatUint(uint64(alert.PID), 10),
+		"comm": mt.procs.Name(alert.PID),
+	}
+	mt.procs.AddPIDLabels(labels, alert.PID)
+	mt.router.Route(labels, alert.String())
+	mt.output.Event(labels, alert.String())
+	reaction.Notify(ctx, mt.notifier, alert)
+}
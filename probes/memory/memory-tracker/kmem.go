@@ -0,0 +1,168 @@
+// Kernel memory: kmalloc and slab cache allocations by call site, counted
+// in BPF from the kmem tracepoints, and the slab caches' usage from
+// /proc/slabinfo
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/cilium/ebpf/link"
+
+	"probepilot/pkg/procfs"
+	"probepilot/pkg/profile"
+	"probepilot/pkg/query"
+	"probepilot/pkg/units"
+)
+
+// kmemTracepoints feed kmem_sites under the kmem hook set
+var kmemTracepoints = []struct {
+	group string
+	name  string
+	prog  string
+}{
+	{"kmem", "kmalloc", "trace_kmalloc"},
+	{"kmem", "kmem_cache_alloc", "trace_kmem_cache_alloc"},
+	{"kmem", "kfree", "trace_kfree"},
+	{"kmem", "kmem_cache_free", "trace_kmem_cache_free"},
+}
+
+// kmemExported bounds the slab caches and call sites in Samples
+const kmemExported = 20
+
+// attachKmem attaches every kmem tracepoint or, so that frees are not
+// missed, none
+func (mt *MemoryTracker) attachKmem() ([]link.Link, error) {
+	var links []link.Link
+	for _, tp := range kmemTracepoints {
+		l, err := link.Tracepoint(link.TracepointOptions{Group: tp.group, Name: tp.name, Program: mt.coll.Programs[tp.prog]})
+		if err != nil {
+			for _, l := range links {
+				l.Close()
+			}
+			return nil, fmt.Errorf("failed to attach tracepoint %s:%s: %v", tp.group, tp.name, err)
+		}
+		links = append(links, l)
+	}
+	return links, nil
+}
+
+// kmemSite is a kernel allocation call site and what it allocated
+type kmemSite struct {
+	addr uint64
+	name string
+	KmemSite
+}
+
+// topKmemSites returns the n call sites holding the most kernel memory
+func (mt *MemoryTracker) topKmemSites(n int) ([]kmemSite, error) {
+	m := mt.coll.Maps["kmem_sites"]
+	if m == nil {
+		return nil, errors.New("no kmem_sites map")
+	}
+	var sites []kmemSite
+	var addr uint64
+	var site KmemSite
+	iter := m.Iterate()
+	for iter.Next(&addr, &site) {
+		sites = append(sites, kmemSite{addr: addr, KmemSite: site})
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(sites, func(i, j int) bool {
+		if sites[i].Outstanding != sites[j].Outstanding {
+			return sites[i].Outstanding > sites[j].Outstanding
+		}
+		return sites[i].BytesAlloc > sites[j].BytesAlloc
+	})
+	if len(sites) > n {
+		sites = sites[:n]
+	}
+	for i := range sites {
+		f := mt.symbols.ResolveKernelStack([]uint64{sites[i].addr})[0]
+		sites[i].name = fmt.Sprintf("0x%x", f.Addr)
+		if f.Function != "" {
+			sites[i].name = fmt.Sprintf("%s+0x%x", f.Function, f.Offset)
+		}
+	}
+	return sites, nil
+}
+
+// topSlabCaches returns the n slab caches with the most memory in use
+func topSlabCaches(n int) ([]procfs.SlabCache, error) {
+	caches, err := procfs.ReadSlabinfo()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(caches, func(i, j int) bool {
+		return caches[i].ActiveBytes() > caches[j].ActiveBytes()
+	})
+	if len(caches) > n {
+		caches = caches[:n]
+	}
+	return caches, nil
+}
+
+// printKernelMemory prints the top slab caches and, under the kmem hook
+// set, the top kernel allocation call sites
+func (mt *MemoryTracker) printKernelMemory() {
+	caches, err := topSlabCaches(10)
+	if err == nil && len(caches) > 0 {
+		fmt.Printf("\nTop 10 slab caches:\n")
+		for _, c := range caches {
+			fmt.Printf("  %-24s %s in %d/%d objects of %s\n",
+				c.Name, units.Bytes(c.ActiveBytes()), c.ActiveObjects, c.Objects, units.Bytes(c.ObjectSize))
+		}
+	}
+	if !mt.hooks.States()[profile.HookKmem] {
+		return
+	}
+	sites, err := mt.topKmemSites(10)
+	if err != nil {
+		log.Printf("Warning: failed to read kernel allocation sites: %v", err)
+		return
+	}
+	fmt.Printf("\nTop 10 kernel allocation sites:\n")
+	for _, s := range sites {
+		// The slab rounds requests up to its object sizes
+		waste := s.BytesAlloc - s.BytesReq
+		fmt.Printf("  %s: Outstanding=%s, Allocs=%d, Frees=%d, Allocated=%s, Rounding=%s\n",
+			s.name, units.Bytes(s.Outstanding), s.Allocs, s.Frees, units.Bytes(s.BytesAlloc), units.Bytes(waste))
+	}
+}
+
+// kmemSamples exports the top slab caches and kernel allocation sites
+func (mt *MemoryTracker) kmemSamples() []query.Sample {
+	var samples []query.Sample
+	if caches, err := topSlabCaches(kmemExported); err == nil {
+		for _, c := range caches {
+			labels := query.Labels{"cache": c.Name}
+			samples = append(samples,
+				query.Sample{Name: "kernel_slab_cache_bytes", Labels: labels, Value: float64(c.ActiveBytes())},
+				query.Sample{Name: "kernel_slab_cache_objects", Labels: labels, Value: float64(c.ActiveObjects)},
+			)
+		}
+	}
+	if !mt.hooks.States()[profile.HookKmem] {
+		return samples
+	}
+	sites, err := mt.topKmemSites(kmemExported)
+	if err != nil {
+		return samples
+	}
+	for _, s := range sites {
+		labels := query.Labels{"site": s.name}
+		samples = append(samples,
+			query.Sample{Name: "kernel_alloc_site_outstanding_bytes", Labels: labels, Value: float64(s.Outstanding)},
+			query.Sample{Name: "kernel_alloc_site_allocations_total", Labels: labels, Value: float64(s.Allocs)},
+			query.Sample{Name: "kernel_alloc_site_frees_total", Labels: labels, Value: float64(s.Frees)},
+			query.Sample{Name: "kernel_alloc_site_requested_bytes_total", Labels: labels, Value: float64(s.BytesReq)},
+			query.Sample{Name: "kernel_alloc_site_allocated_bytes_total", Labels: labels, Value: float64(s.BytesAlloc)},
+		)
+	}
+	return samples
+}
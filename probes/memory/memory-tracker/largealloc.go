@@ -0,0 +1,173 @@
+// Large allocations: what an allocation past each size threshold of
+// -large-allocs does, from printing it with its stack to alerting on it
+// and tracing its process deeply for a while
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"probepilot/pkg/limits"
+	"probepilot/pkg/reaction"
+	"probepilot/pkg/units"
+)
+
+// DefaultLargeAllocs prints allocations over 1MiB with their stack
+const DefaultLargeAllocs = "1M:event+stack"
+
+// largeAlertCooldown suppresses repeated large_allocation alerts of a
+// process
+const largeAlertCooldown = time.Minute
+
+// largeAction is what an allocation past a threshold does
+type largeAction uint8
+
+const (
+	// actionEvent prints the allocation and keeps it for OOM reports
+	actionEvent largeAction = 1 << iota
+	// actionStack names its stack in the event
+	actionStack
+	// actionAlert fires a large_allocation alert, routed, output and
+	// told to -alert-notify
+	actionAlert
+	// actionCapture escalates to capturing the process's allocation
+	// stacks for -capture-duration
+	actionCapture
+)
+
+var largeActionNames = []struct {
+	name   string
+	action largeAction
+}{
+	{"event", actionEvent},
+	{"stack", actionStack},
+	{"alert", actionAlert},
+	{"capture", actionCapture},
+}
+
+func (a largeAction) String() string {
+	var names []string
+	for _, n := range largeActionNames {
+		if a&n.action != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, "+")
+}
+
+// largeRule is a threshold and what allocations larger than it do
+type largeRule struct {
+	size    uint64
+	actions largeAction
+}
+
+// largeRules are the thresholds of -large-allocs, smallest first
+type largeRules []largeRule
+
+// parseLargeAllocs parses a comma-separated list of
+// <size>:<action>[+<action>...], e.g. 1M:event+stack,64M:alert,1G:capture.
+// An allocation takes the actions of every threshold it is larger than.
+func parseLargeAllocs(spec string) (largeRules, error) {
+	var rules largeRules
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		size, actions, ok := strings.Cut(field, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid -large-allocs rule %q (want <size>:<action>[+<action>...])", field)
+		}
+		var rule largeRule
+		var err error
+		if rule.size, err = limits.ParseSize(size); err != nil {
+			return nil, fmt.Errorf("invalid -large-allocs rule %q: %v", field, err)
+		}
+		for _, name := range strings.Split(actions, "+") {
+			action, err := parseLargeAction(strings.TrimSpace(name))
+			if err != nil {
+				return nil, fmt.Errorf("invalid -large-allocs rule %q: %v", field, err)
+			}
+			rule.actions |= action
+		}
+		rules = append(rules, rule)
+	}
+	sort.SliceStable(rules, func(i, j int) bool { return rules[i].size < rules[j].size })
+	return rules, nil
+}
+
+func parseLargeAction(name string) (largeAction, error) {
+	for _, n := range largeActionNames {
+		if n.name == name {
+			return n.action, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown action %q (want event, stack, alert or capture)", name)
+}
+
+// match returns the actions of an allocation of size bytes and the
+// largest threshold it passed
+func (r largeRules) match(size uint64) (largeAction, uint64) {
+	var actions largeAction
+	var threshold uint64
+	for _, rule := range r {
+		if size <= rule.size {
+			break
+		}
+		actions |= rule.actions
+		threshold = rule.size
+	}
+	return actions, threshold
+}
+
+// has reports whether any threshold takes action
+func (r largeRules) has(action largeAction) bool {
+	for _, rule := range r {
+		if rule.actions&action != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (r largeRules) String() string {
+	if len(r) == 0 {
+		return "none"
+	}
+	rules := make([]string, len(r))
+	for i, rule := range r {
+		rules[i] = fmt.Sprintf("over %s: %s", limits.FormatSize(rule.size), rule.actions)
+	}
+	return strings.Join(rules, ", ")
+}
+
+// reactLargeAlloc alerts on an allocation past an alert threshold and
+// escalates one past a capture threshold, at most once a
+// largeAlertCooldown for each process
+func (mt *MemoryTracker) reactLargeAlloc(event *MemoryEvent, comm, kind string, actions largeAction, threshold uint64) {
+	if actions&(actionAlert|actionCapture) == 0 {
+		return
+	}
+	now := time.Now()
+	if last, ok := mt.largeAlerted[event.PID]; ok && now.Sub(last) < largeAlertCooldown {
+		return
+	}
+	mt.largeAlerted[event.PID] = now
+	alert := reaction.Alert{
+		Name:     "large_allocation",
+		Severity: "warning",
+		PID:      event.PID,
+		Message: fmt.Sprintf("%s allocated %s at once with %s, over the %s threshold",
+			comm, units.Bytes(event.Size), kind, limits.FormatSize(threshold)),
+		FiredAt: now,
+	}
+	if actions&actionAlert != 0 {
+		mt.announce(mt.ctx, alert)
+	}
+	if actions&actionCapture != 0 && mt.reactor != nil {
+		mt.reactor.Fire(mt.ctx, alert)
+	}
+}
@@ -0,0 +1,254 @@
+// Leak groups: the leak candidates grouped by the command that allocated
+// them and the symbolized stack they were allocated from, each under an ID
+// derived from those alone, so that a suspected leak keeps its ID across
+// agent restarts and on every host running the same binaries.
+// -leak-report rewrites the groups every report as a JSON document keyed
+// by ID, carrying forward when each was first seen and its peak, for
+// tooling to follow a leak's growth over days
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"probepilot/pkg/query"
+	"probepilot/pkg/schema"
+	"probepilot/pkg/seal"
+	"probepilot/pkg/units"
+)
+
+// leakGroupsExported bounds the leak groups in Samples
+const leakGroupsExported = 20
+
+// leakGroup is the leak candidates of one command and stack
+type leakGroup struct {
+	Comm string `json:"comm"`
+	// Stack is leaf first, kernel frames suffixed _[k]
+	Stack []string `json:"stack,omitempty"`
+	// Count and Bytes are the candidates outstanding, PIDs the processes
+	// holding them
+	Count uint64   `json:"count"`
+	Bytes uint64   `json:"bytes"`
+	PIDs  []uint32 `json:"pids"`
+	// Oldest is when the oldest candidate was allocated
+	Oldest time.Time `json:"oldest"`
+	// FirstSeen is the first report the group was in and PeakBytes the
+	// most it held in any, both kept over restarts
+	FirstSeen time.Time `json:"first_seen"`
+	PeakBytes uint64    `json:"peak_bytes"`
+
+	id string
+}
+
+// leakReport is the document -leak-report writes
+type leakReport struct {
+	Schema    string    `json:"schema"`
+	Generated time.Time `json:"generated"`
+	// Started is when the agent writing the report started
+	Started time.Time             `json:"started"`
+	Groups  map[string]*leakGroup `json:"groups"`
+}
+
+// leakGroupKey tells groups apart before they are named
+type leakGroupKey struct {
+	comm  string
+	stack stackRef
+}
+
+// frameAddr matches what differs between runs of the same binary in a
+// frame's name: its offset into the function, or the address of a frame
+// without one
+var frameAddr = regexp.MustCompile(`^0x[0-9a-f]+|\+0x[0-9a-f]+`)
+
+// leakGroupID derives the ID of the group of comm and frames from the
+// function and module names alone, so rebuilds moving code within a
+// function and address space randomization leave it as it is
+func leakGroupID(comm string, frames []string) string {
+	h := sha256.New()
+	h.Write([]byte(comm))
+	for _, frame := range frames {
+		h.Write([]byte{0})
+		h.Write([]byte(frameAddr.ReplaceAllStringFunc(frame, func(s string) string {
+			if strings.HasPrefix(s, "+") {
+				return ""
+			}
+			return "?"
+		})))
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// sampleLeakGroups groups the leak candidates, ranks the groups by bytes
+// and writes -leak-report
+func (mt *MemoryTracker) sampleLeakGroups(now time.Time) {
+	byKey := make(map[leakGroupKey]*leakGroup)
+	pids := make(map[leakGroupKey]map[uint32]bool)
+	mt.leaks.Each(func(_ uint64, info *AllocationInfo) bool {
+		key := leakGroupKey{
+			comm:  mt.procs.Name(info.PID),
+			stack: stackRef{pid: info.PID, user: int64(info.StackID), kernel: int64(info.KernelStackID)},
+		}
+		g, ok := byKey[key]
+		if !ok {
+			g = &leakGroup{Comm: key.comm}
+			byKey[key] = g
+			pids[key] = make(map[uint32]bool)
+		}
+		g.Count++
+		g.Bytes += info.Size
+		pids[key][info.PID] = true
+		if at := time.Unix(0, int64(info.Timestamp)); g.Oldest.IsZero() || at.Before(g.Oldest) {
+			g.Oldest = at
+		}
+		return true
+	})
+
+	// Stacks are per process, so groups of the same stack in several
+	// processes merge once named
+	byID := make(map[string]*leakGroup)
+	for key, g := range byKey {
+		if mt.stacks != nil {
+			g.Stack = mt.stacks.frames(key.stack)
+		}
+		g.id = leakGroupID(g.Comm, g.Stack)
+		merged, ok := byID[g.id]
+		if !ok {
+			byID[g.id] = g
+			merged = g
+		} else {
+			merged.Count += g.Count
+			merged.Bytes += g.Bytes
+			if g.Oldest.Before(merged.Oldest) {
+				merged.Oldest = g.Oldest
+			}
+		}
+		for pid := range pids[key] {
+			merged.PIDs = append(merged.PIDs, pid)
+		}
+	}
+
+	groups := make([]*leakGroup, 0, len(byID))
+	for id, g := range byID {
+		sort.Slice(g.PIDs, func(i, j int) bool { return g.PIDs[i] < g.PIDs[j] })
+		g.FirstSeen, g.PeakBytes = now, g.Bytes
+		prev, ok := mt.leakHistory[id]
+		if !ok {
+			prev, ok = mt.leakPrior[id]
+		}
+		if ok {
+			g.FirstSeen, g.PeakBytes = prev.FirstSeen, max(prev.PeakBytes, g.Bytes)
+		}
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Bytes != groups[j].Bytes {
+			return groups[i].Bytes > groups[j].Bytes
+		}
+		return groups[i].id < groups[j].id
+	})
+	mt.leakGroups = groups
+	mt.leakHistory = byID
+
+	if mt.leakReportPath != "" {
+		if err := mt.writeLeakReport(now); err != nil {
+			log.Printf("Warning: failed to write leak report: %v", err)
+		}
+	}
+}
+
+// writeLeakReport replaces -leak-report with the current groups
+func (mt *MemoryTracker) writeLeakReport(now time.Time) error {
+	report := leakReport{
+		Schema:    schema.Tag(schema.Leaks),
+		Generated: now,
+		Started:   mt.startTime,
+		Groups:    mt.leakHistory,
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if mt.sealKey != nil {
+		data = mt.sealKey.Seal(data)
+	}
+	tmp := mt.leakReportPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, mt.leakReportPath)
+}
+
+// readLeakReport reads the groups of the report at path a previous run
+// wrote, none if there is none yet, opening it with key if sealed. They
+// stay in mt.leakPrior for the groups of this run to take their first
+// sighting and peak from
+func readLeakReport(path string, key *seal.Key) (map[string]*leakGroup, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if seal.IsSealed(data) {
+		if key == nil {
+			return nil, fmt.Errorf("%s is sealed, and no -seal-key given", path)
+		}
+		if data, err = key.Open(data); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	var report leakReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := schema.Check(schema.Leaks, report.Schema); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return report.Groups, nil
+}
+
+// printLeakGroups prints the groups holding the most
+func (mt *MemoryTracker) printLeakGroups() {
+	if len(mt.leakGroups) == 0 {
+		return
+	}
+	fmt.Printf("\nLeak groups (top 5 of %d):\n", len(mt.leakGroups))
+	for i, g := range mt.leakGroups {
+		if i == 5 {
+			break
+		}
+		fmt.Printf("  %s %s: %s in %d allocations, Peak=%s, Oldest=%v, Since=%s\n",
+			g.id, g.Comm, units.Bytes(g.Bytes), g.Count, units.Bytes(g.PeakBytes),
+			time.Since(g.Oldest).Truncate(time.Second), g.FirstSeen.Format(time.RFC3339))
+		printFrames(g.Stack, 4)
+	}
+}
+
+// leakGroupSamples exports the groups holding the most
+func (mt *MemoryTracker) leakGroupSamples() []query.Sample {
+	samples := []query.Sample{{Name: "memory_leak_groups", Value: float64(len(mt.leakGroups))}}
+	for i, g := range mt.leakGroups {
+		if i == leakGroupsExported {
+			break
+		}
+		labels := query.Labels{"leak_id": g.id, "comm": g.Comm}
+		samples = append(samples,
+			query.Sample{Name: "memory_leak_group_bytes", Labels: labels, Value: float64(g.Bytes)},
+			query.Sample{Name: "memory_leak_group_allocations", Labels: labels, Value: float64(g.Count)},
+			query.Sample{Name: "memory_leak_group_peak_bytes", Labels: labels, Value: float64(g.PeakBytes)},
+		)
+	}
+	return samples
+}
@@ -0,0 +1,282 @@
+// Leak candidates: the tracked allocations not freed yet, bounded by
+// -max-leaks so that a busy host cannot grow them without end. Past the
+// bound the allocation tracked longest ago, or the smallest, makes way,
+// and may be spilled to -leak-spill for later analysis
+
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"probepilot/pkg/seal"
+)
+
+// DefaultMaxLeaks bounds the leak candidates unless -max-leaks says
+// otherwise
+const DefaultMaxLeaks = 100000
+
+// leakEviction picks the leak candidate making way for a new one
+type leakEviction string
+
+const (
+	// evictLRU evicts the allocation tracked longest ago
+	evictLRU leakEviction = "lru"
+	// evictSmallest evicts the smallest allocation, keeping the large
+	// ones that matter most however old
+	evictSmallest leakEviction = "smallest"
+)
+
+func parseLeakEviction(s string) (leakEviction, error) {
+	switch e := leakEviction(s); e {
+	case evictLRU, evictSmallest:
+		return e, nil
+	}
+	return "", fmt.Errorf("invalid -leak-eviction %q (want lru or smallest)", s)
+}
+
+type leakEntry struct {
+	key  AllocKey
+	info *AllocationInfo
+	elem *list.Element // in the LRU order
+	slot int           // in the size heap
+}
+
+// leakTable is the leak candidates by process and address, as forked
+// workers allocate at the same addresses, bounded to max entries
+type leakTable struct {
+	max      int
+	eviction leakEviction
+	entries  map[AllocKey]*leakEntry
+	order    *list.List // lru: most recently tracked at the front
+	sizes    leakHeap   // smallest: smallest at the root
+	// bytes sums the candidates of each process, and total all of them
+	bytes map[ProcKey]uint64
+	total uint64
+	// onEvict is told of every entry evicted
+	onEvict func(addr uint64, info *AllocationInfo)
+
+	evicted      uint64
+	evictedBytes uint64
+}
+
+func newLeakTable(max int, eviction leakEviction, onEvict func(uint64, *AllocationInfo)) *leakTable {
+	return &leakTable{
+		max:      max,
+		eviction: eviction,
+		entries:  make(map[AllocKey]*leakEntry),
+		order:    list.New(),
+		bytes:    make(map[ProcKey]uint64),
+		onEvict:  onEvict,
+	}
+}
+
+func (t *leakTable) Len() int {
+	return len(t.entries)
+}
+
+func (t *leakTable) Get(id ProcKey, addr uint64) (*AllocationInfo, bool) {
+	e, ok := t.entries[AllocKey{Proc: id, Addr: addr}]
+	if !ok {
+		return nil, false
+	}
+	return e.info, true
+}
+
+// Add tracks the allocation of info's process at addr, replacing any
+// tracked there, and evicts a candidate if the table is over its bound
+func (t *leakTable) Add(addr uint64, info *AllocationInfo) {
+	key := AllocKey{Proc: info.proc(), Addr: addr}
+	t.Remove(key.Proc, addr)
+	e := &leakEntry{key: key, info: info}
+	t.entries[key] = e
+	t.bytes[info.proc()] += info.Size
+	t.total += info.Size
+	switch t.eviction {
+	case evictSmallest:
+		heap.Push(&t.sizes, e)
+	default:
+		e.elem = t.order.PushFront(e)
+	}
+	if t.max > 0 && len(t.entries) > t.max {
+		t.evict()
+	}
+}
+
+// Remove stops tracking the allocation of process id at addr
+func (t *leakTable) Remove(id ProcKey, addr uint64) {
+	key := AllocKey{Proc: id, Addr: addr}
+	e, ok := t.entries[key]
+	if !ok {
+		return
+	}
+	delete(t.entries, key)
+	if t.bytes[id] -= e.info.Size; t.bytes[id] == 0 {
+		delete(t.bytes, id)
+	}
+	t.total -= e.info.Size
+	switch t.eviction {
+	case evictSmallest:
+		heap.Remove(&t.sizes, e.slot)
+	default:
+		t.order.Remove(e.elem)
+	}
+}
+
+func (t *leakTable) evict() {
+	var e *leakEntry
+	switch t.eviction {
+	case evictSmallest:
+		e = t.sizes[0]
+	default:
+		e = t.order.Back().Value.(*leakEntry)
+	}
+	t.Remove(e.key.Proc, e.key.Addr)
+	t.evicted++
+	t.evictedBytes += e.info.Size
+	if t.onEvict != nil {
+		t.onEvict(e.key.Addr, e.info)
+	}
+}
+
+// Each calls fn for every candidate, in no particular order, until fn
+// returns false
+func (t *leakTable) Each(fn func(addr uint64, info *AllocationInfo) bool) {
+	for key, e := range t.entries {
+		if !fn(key.Addr, e.info) {
+			return
+		}
+	}
+}
+
+// Bytes returns the bytes of the candidates of the process id
+func (t *leakTable) Bytes(id ProcKey) uint64 {
+	return t.bytes[id]
+}
+
+// Total returns the bytes of every candidate
+func (t *leakTable) Total() uint64 {
+	return t.total
+}
+
+func (t *leakTable) Evicted() uint64 {
+	return t.evicted
+}
+
+func (t *leakTable) EvictedBytes() uint64 {
+	return t.evictedBytes
+}
+
+// leakHeap orders candidates by size, smallest first
+type leakHeap []*leakEntry
+
+func (h leakHeap) Len() int           { return len(h) }
+func (h leakHeap) Less(i, j int) bool { return h[i].info.Size < h[j].info.Size }
+
+func (h leakHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].slot = i
+	h[j].slot = j
+}
+
+func (h *leakHeap) Push(x any) {
+	e := x.(*leakEntry)
+	e.slot = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *leakHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
+
+// spilledLeak is an evicted candidate as -leak-spill records it, one JSON
+// object a line
+type spilledLeak struct {
+	Addr      string    `json:"addr"`
+	Size      uint64    `json:"size"`
+	PID       uint32    `json:"pid"`
+	Comm      string    `json:"comm,omitempty"`
+	Allocated time.Time `json:"allocated"`
+	Evicted   time.Time `json:"evicted"`
+	// Stack is folded, root first; stacks of evicted candidates are
+	// freed at the next report, so it is named on eviction
+	Stack string `json:"stack,omitempty"`
+}
+
+// leakSpill appends evicted candidates to a file, each line sealed on
+// its own under key unless nil
+type leakSpill struct {
+	f   *os.File
+	w   *bufio.Writer
+	key *seal.Key
+	err error
+}
+
+func openLeakSpill(path string, key *seal.Key) (*leakSpill, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &leakSpill{f: f, w: bufio.NewWriter(f), key: key}, nil
+}
+
+// write records a candidate; the first error stops the spill and is
+// returned by Flush
+func (s *leakSpill) write(leak *spilledLeak) {
+	if s.err != nil {
+		return
+	}
+	line, err := json.Marshal(leak)
+	if err != nil {
+		s.err = err
+		return
+	}
+	line = append(line, '\n')
+	if s.key != nil {
+		line = s.key.SealLine(line)
+	}
+	_, s.err = s.w.Write(line)
+}
+
+func (s *leakSpill) Flush() error {
+	if s.err == nil {
+		s.err = s.w.Flush()
+	}
+	return s.err
+}
+
+func (s *leakSpill) Close() error {
+	err := s.Flush()
+	if cerr := s.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// spillLeak records an evicted candidate to -leak-spill
+func (mt *MemoryTracker) spillLeak(addr uint64, info *AllocationInfo) {
+	if mt.leakSpill == nil {
+		return
+	}
+	leak := &spilledLeak{
+		Addr:      fmt.Sprintf("0x%x", addr),
+		Size:      info.Size,
+		PID:       info.PID,
+		Comm:      mt.procs.Name(info.PID),
+		Allocated: time.Unix(0, int64(info.Timestamp)),
+		Evicted:   time.Now(),
+	}
+	if mt.stacks != nil {
+		leak.Stack = folded(mt.stacks.frames(stackRef{pid: info.PID, user: int64(info.StackID), kernel: int64(info.KernelStackID)}))
+	}
+	mt.leakSpill.write(leak)
+}
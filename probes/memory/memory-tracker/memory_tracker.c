@@ -15,9 +15,13 @@
 #include <bpf/bpf_tracing.h>
 #include <bpf/bpf_core_read.h>
 
+#include "pidfilter.bpf.h"
+#include "target.bpf.h"
+
 #define MAX_ENTRIES 10240
 #define MAX_STACK_DEPTH 20
 #define TASK_COMM_LEN 16
+#define MAX_NUMA_NODES 8
 
 /* Memory allocation event types */
 enum alloc_type {
@@ -29,9 +33,21 @@ enum alloc_type {
     ALLOC_MUNMAP,
     ALLOC_BRK,
     ALLOC_PAGE,
+    ALLOC_MEMALIGN,  // posix_memalign, aligned_alloc
+    ALLOC_NEW,       // C++ operator new
+    ALLOC_DELETE,    // C++ operator delete
+    ALLOC_MPROTECT,  // only in region events
 };
 
 /* Data structures */
+
+/* Identity of a process: its PID, and the start time of its thread
+ * group leader in ns since boot, which tells a recycled PID apart */
+struct proc_key {
+    __u32 pid;
+    __u64 start_time;
+};
+
 struct memory_event {
     __u64 timestamp;
     __u32 pid;
@@ -41,7 +57,19 @@ struct memory_event {
     __u64 old_addr;  // for realloc
     __u32 type;      // enum alloc_type
     __u32 flags;
-    __u64 stack_id;
+    __u64 stack_id;         // user stack in stack_traces, negative if none
+    __u64 kernel_stack_id;  // kernel stack, negative if none
+    char comm[TASK_COMM_LEN];
+    __u64 start_time;       // of pid, 0 for OOM victims
+    __u64 old_size;         // of old_addr if it was tracked
+};
+
+/* Sent when a process exits, after its last event */
+struct process_exit {
+    __u64 timestamp;
+    __u64 start_time;
+    __u32 pid;
+    __s32 exit_code;
     char comm[TASK_COMM_LEN];
 };
 
@@ -56,6 +84,9 @@ struct process_memory {
     __u64 major_faults;
     __u64 rss_pages;
     __u64 vmem_pages;
+    __u64 node_bytes[MAX_NUMA_NODES];  // pages allocated on each node
+    __u64 remote_bytes;                // of them, off the allocating CPU's node
+    __u64 cgroup_id;                   // cgroup v2 of the last allocation or free
 };
 
 struct system_memory {
@@ -72,25 +103,137 @@ struct system_memory {
 struct allocation_info {
     __u64 size;
     __u64 timestamp;
-    __u64 stack_id;
+    __u64 start_time;  // of pid, so userspace can drop a dead process's entries
     __u32 pid;
+    __u32 reported;    // whether its allocation was sent to userspace
+};
+
+/* An allocation, by the process that made it and its address: forked
+ * workers share heap layouts, so an address alone names many */
+struct alloc_key {
+    struct proc_key proc;
+    __u64 addr;
 };
 
 /* BPF Maps */
 struct {
     __uint(type, BPF_MAP_TYPE_HASH);
     __uint(max_entries, MAX_ENTRIES);
-    __type(key, __u32); // PID
+    __type(key, struct proc_key);
     __type(value, struct process_memory);
 } process_memory_map SEC(".maps");
 
 struct {
     __uint(type, BPF_MAP_TYPE_HASH);
     __uint(max_entries, MAX_ENTRIES * 4);
-    __type(key, __u64); // Address
+    __type(key, struct alloc_key);
     __type(value, struct allocation_info);
 } allocation_map SEC(".maps");
 
+/* An allocator call between its entry and return */
+struct pending_alloc {
+    __u64 size;
+    __u64 old_addr;  // realloc's allocation to retire
+    __u64 out;       // posix_memalign's pointer to the address
+    __u32 type;
+};
+
+/* Allocator calls between entry and return, by thread; LRU so entries of
+ * returns never seen, e.g. longjmp out of a signal handler, make way */
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(max_entries, MAX_ENTRIES);
+    __type(key, __u64); // pid_tgid
+    __type(value, struct pending_alloc);
+} pending_mallocs SEC(".maps");
+
+/* The address operator delete is freeing, by thread, so the free() it
+ * calls is not reported again */
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(max_entries, MAX_ENTRIES);
+    __type(key, __u64); // pid_tgid
+    __type(value, __u64); // address
+} pending_deletes SEC(".maps");
+
+/* An mmap call between its entry and return */
+struct pending_mmap {
+    __u64 len;
+    __u32 prot;
+    __u32 flags;
+    __s64 fd;
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(max_entries, MAX_ENTRIES);
+    __type(key, __u64); // pid_tgid
+    __type(value, struct pending_mmap);
+} pending_mmaps SEC(".maps");
+
+/* mmap and mprotect arguments */
+#define PROT_WRITE    0x2
+#define PROT_EXEC     0x4
+#define MAP_ANONYMOUS 0x20
+#define REGION_PAGE   4096ULL
+#define REGION_FILE_LEN 64
+
+/* A mapping of a process, by where it starts */
+struct region_key {
+    struct proc_key proc;
+    __u64 start;
+};
+
+/* A live mapping: how it was asked for and what backs it */
+struct mmap_region {
+    __u64 len;      // in whole pages
+    __u64 created;  // when mmap returned, in ns since boot
+    __u64 ino;      // of the backing file, 0 if anonymous
+    __u32 prot;     // PROT_*, as mmap or the last mprotect set it
+    __u32 flags;    // MAP_*, as mmap was given them
+    char file[REGION_FILE_LEN];  // name of the backing file
+};
+
+/* Sent when a mapping becomes writable and executable */
+struct region_event {
+    __u64 timestamp;
+    __u64 start_time;
+    __u64 addr;
+    __u64 len;
+    __u64 stack_id;  // user stack in stack_traces, negative if none
+    __u32 pid;
+    __u32 prot;
+    __u32 flags;
+    __u32 op;        // ALLOC_MMAP or ALLOC_MPROTECT
+    char comm[TASK_COMM_LEN];
+    char file[REGION_FILE_LEN];
+};
+
+/* Mappings made since the tracker started, trimmed and split by munmap
+ * and mprotect calls starting where one does; LRU so the oldest of a
+ * process that maps without end make way */
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(max_entries, MAX_ENTRIES * 4);
+    __type(key, struct region_key);
+    __type(value, struct mmap_region);
+} region_map SEC(".maps");
+
+/* An mprotect call between its entry and return */
+struct pending_mprotect {
+    __u64 start;
+    __u64 len;
+    __u32 prot;
+    __u32 pad;
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(max_entries, MAX_ENTRIES);
+    __type(key, __u64); // pid_tgid
+    __type(value, struct pending_mprotect);
+} pending_mprotects SEC(".maps");
+
 struct {
     __uint(type, BPF_MAP_TYPE_ARRAY);
     __uint(max_entries, 1);
@@ -98,9 +241,11 @@ struct {
     __type(value, struct system_memory);
 } system_memory_map SEC(".maps");
 
+/* User and kernel stacks of events; userspace deletes the stacks no
+ * tracked allocation references at every report */
 struct {
     __uint(type, BPF_MAP_TYPE_STACK_TRACE);
-    __uint(max_entries, 1024);
+    __uint(max_entries, 16384);
     __uint(key_size, sizeof(__u32));
     __uint(value_size, MAX_STACK_DEPTH * sizeof(__u64));
 } stack_traces SEC(".maps");
@@ -110,7 +255,27 @@ struct {
     __uint(max_entries, 256 * 1024);
 } events SEC(".maps");
 
-/* Configuration */
+/* Records the ring buffer had no room for, per CPU; userspace sums them */
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __uint(max_entries, 1);
+    __type(key, __u32);
+    __type(value, __u64);
+} ringbuf_drops SEC(".maps");
+
+static __always_inline void count_drop(void) {
+    __u32 key = 0;
+    __u64 *drops = bpf_map_lookup_elem(&ringbuf_drops, &key);
+    if (drops)
+        (*drops)++;
+}
+
+/* Configuration: which allocations are sent to userspace */
+#define CONFIG_SAMPLE_RATE    0  // 1 in N allocations
+#define CONFIG_MIN_SIZE       1  // none smaller than this
+#define CONFIG_AGGREGATE_ONLY 2  // none, only the maps count them
+#define CONFIG_ALWAYS_SIZE    3  // every one at least this large, unsampled
+
 struct {
     __uint(type, BPF_MAP_TYPE_ARRAY);
     __uint(max_entries, 4);
@@ -118,15 +283,69 @@ struct {
     __type(value, __u32);
 } config_map SEC(".maps");
 
-/* Helper function to send memory event to userspace */
-static __always_inline void send_memory_event(__u32 pid, __u64 addr, 
+static __always_inline void proc_key_of(struct task_struct *task, struct proc_key *key) {
+    key->pid = BPF_CORE_READ(task, tgid);
+    key->start_time = BPF_CORE_READ(task, group_leader, start_time);
+}
+
+static __always_inline void current_proc_key(struct proc_key *key) {
+    proc_key_of((struct task_struct *)bpf_get_current_task(), key);
+}
+
+/* Returns the memory statistics of a process, creating them if needed */
+static __always_inline struct process_memory *touch_process(struct proc_key *key) {
+    struct process_memory *mem = bpf_map_lookup_elem(&process_memory_map, key);
+    if (mem)
+        return mem;
+    struct process_memory new_mem = {};
+    bpf_map_update_elem(&process_memory_map, key, &new_mem, BPF_NOEXIST);
+    return bpf_map_lookup_elem(&process_memory_map, key);
+}
+
+/* Whether events of type come from the allocator uprobes */
+static __always_inline bool allocator_call(__u32 type) {
+    return type <= ALLOC_FREE || (type >= ALLOC_MEMALIGN && type <= ALLOC_DELETE);
+}
+
+static __always_inline __u32 config_value(__u32 key) {
+    __u32 *value = bpf_map_lookup_elem(&config_map, &key);
+    return value ? *value : 0;
+}
+
+/* Whether an allocation of size is sent to userspace. The maps count
+ * every allocation; one not sent has its free not sent either */
+static __always_inline bool report_allocation(__u64 size) {
+    if (config_value(CONFIG_AGGREGATE_ONLY) || size < config_value(CONFIG_MIN_SIZE))
+        return false;
+    __u32 always = config_value(CONFIG_ALWAYS_SIZE);
+    if (always && size >= always)
+        return true;
+    __u32 rate = config_value(CONFIG_SAMPLE_RATE);
+    return rate <= 1 || bpf_get_prandom_u32() % rate == 0;
+}
+
+/* Whether every allocation is sent, and so frees of addresses the maps
+ * did not track, whose allocations may have been */
+static __always_inline bool reporting_all(void) {
+    return config_value(CONFIG_SAMPLE_RATE) <= 1 && config_value(CONFIG_MIN_SIZE) == 0 &&
+           !config_value(CONFIG_AGGREGATE_ONLY);
+}
+
+/* Helper function to send memory event to userspace; ctx is the
+ * program's, which the stacks are walked from */
+static __always_inline void send_memory_event(void *ctx, __u32 pid, __u64 addr, 
                                              __u64 size, __u32 type,
-                                             __u64 old_addr) {
+                                             __u64 old_addr, __u64 old_size) {
     struct memory_event *event;
     
+    if (!target_allowed())
+        return;
+    
     event = bpf_ringbuf_reserve(&events, sizeof(*event), 0);
-    if (!event)
+    if (!event) {
+        count_drop();
         return;
+    }
     
     event->timestamp = bpf_ktime_get_ns();
     event->pid = pid;
@@ -134,12 +353,23 @@ static __always_inline void send_memory_event(__u32 pid, __u64 addr,
     event->addr = addr;
     event->size = size;
     event->old_addr = old_addr;
+    event->old_size = old_size;
     event->type = type;
     event->flags = 0;
+    event->start_time = 0;
+    if (pid == bpf_get_current_pid_tgid() >> 32) {
+        struct proc_key key = {};
+        current_proc_key(&key);
+        event->start_time = key.start_time;
+    }
     
-    // Capture stack trace
-    event->stack_id = bpf_get_stackid(bpf_get_current_task(), &stack_traces, 
-                                     BPF_F_USER_STACK);
+    // Capture stack traces; the kernel stack of a uprobe is only the
+    // trap into it
+    event->stack_id = bpf_get_stackid(ctx, &stack_traces, BPF_F_USER_STACK);
+    if (allocator_call(type))
+        event->kernel_stack_id = -1;
+    else
+        event->kernel_stack_id = bpf_get_stackid(ctx, &stack_traces, 0);
     
     // Get process name
     bpf_get_current_comm(&event->comm, sizeof(event->comm));
@@ -147,17 +377,16 @@ static __always_inline void send_memory_event(__u32 pid, __u64 addr,
     bpf_ringbuf_submit(event, 0);
 }
 
-/* Helper function to update process memory statistics */
-static __always_inline void update_process_memory(__u32 pid, __s64 size_delta,
+/* Helper function to update the memory statistics of the current process */
+static __always_inline void update_process_memory(__s64 size_delta,
                                                  __u32 is_allocation) {
-    struct process_memory *mem = bpf_map_lookup_elem(&process_memory_map, &pid);
-    if (!mem) {
-        struct process_memory new_mem = {};
-        bpf_map_update_elem(&process_memory_map, &pid, &new_mem, BPF_ANY);
-        mem = bpf_map_lookup_elem(&process_memory_map, &pid);
-        if (!mem) return;
-    }
+    struct proc_key key = {};
+    current_proc_key(&key);
+    struct process_memory *mem = touch_process(&key);
+    if (!mem)
+        return;
     
+    mem->cgroup_id = bpf_get_current_cgroup_id();
     if (is_allocation) {
         mem->total_allocated += size_delta;
         mem->allocation_count++;
@@ -174,82 +403,311 @@ static __always_inline void update_process_memory(__u32 pid, __s64 size_delta,
     }
 }
 
-/* Trace malloc calls */
-SEC("uprobe/malloc")
-int trace_malloc(struct pt_regs *ctx) {
-    __u64 size = PT_REGS_PARM1(ctx);
-    __u32 pid = bpf_get_current_pid_tgid() >> 32;
+/* Start of an allocator call: the size requested, and for realloc the
+ * allocation it replaces, are known on entry, the address on return */
+static __always_inline int alloc_enter(__u64 size, __u32 type, __u64 old_addr, __u64 out) {
+    __u64 pid_tgid = bpf_get_current_pid_tgid();
+    __u32 pid = pid_tgid >> 32;
     
-    if (pid == 0 || size == 0)
+    if (pid == 0 || (size == 0 && old_addr == 0) || !pid_filter_allowed(pid))
         return 0;
     
-    send_memory_event(pid, 0, size, ALLOC_MALLOC, 0);
+    // The outermost call wins: operator new and realloc(NULL, n) call
+    // malloc, whose return then completes the outer call
+    struct pending_alloc pending = {
+        .size = size,
+        .old_addr = old_addr,
+        .out = out,
+        .type = type,
+    };
+    bpf_map_update_elem(&pending_mallocs, &pid_tgid, &pending, BPF_NOEXIST);
     return 0;
 }
 
+SEC("uprobe/malloc")
+int trace_malloc(struct pt_regs *ctx) {
+    return alloc_enter(PT_REGS_PARM1(ctx), ALLOC_MALLOC, 0, 0);
+}
+
+SEC("uprobe/calloc")
+int trace_calloc(struct pt_regs *ctx) {
+    return alloc_enter(PT_REGS_PARM1(ctx) * PT_REGS_PARM2(ctx), ALLOC_CALLOC, 0, 0);
+}
+
+SEC("uprobe/realloc")
+int trace_realloc(struct pt_regs *ctx) {
+    return alloc_enter(PT_REGS_PARM2(ctx), ALLOC_REALLOC, PT_REGS_PARM1(ctx), 0);
+}
+
+/* posix_memalign(&ptr, alignment, size) returns 0 and stores the address */
+SEC("uprobe/posix_memalign")
+int trace_posix_memalign(struct pt_regs *ctx) {
+    __u64 out = PT_REGS_PARM1(ctx);
+    if (out == 0)
+        return 0;
+    return alloc_enter(PT_REGS_PARM3(ctx), ALLOC_MEMALIGN, 0, out);
+}
+
+SEC("uprobe/aligned_alloc")
+int trace_aligned_alloc(struct pt_regs *ctx) {
+    return alloc_enter(PT_REGS_PARM2(ctx), ALLOC_MEMALIGN, 0, 0);
+}
+
+/* operator new and new[] */
+SEC("uprobe/_Znwm")
+int trace_new(struct pt_regs *ctx) {
+    return alloc_enter(PT_REGS_PARM1(ctx), ALLOC_NEW, 0, 0);
+}
+
+/* Return of every allocator call above */
 SEC("uretprobe/malloc")
 int trace_malloc_ret(struct pt_regs *ctx) {
-    __u64 addr = PT_REGS_RC(ctx);
-    __u32 pid = bpf_get_current_pid_tgid() >> 32;
+    __u64 rc = PT_REGS_RC(ctx);
+    __u64 pid_tgid = bpf_get_current_pid_tgid();
+    __u32 pid = pid_tgid >> 32;
+    __u64 addr = rc;
     
-    if (pid == 0 || addr == 0)
+    // Only calls the entry probe let through have a size waiting
+    struct pending_alloc *pending = bpf_map_lookup_elem(&pending_mallocs, &pid_tgid);
+    if (!pending)
+        return 0;
+    struct pending_alloc call = *pending;
+    bpf_map_delete_elem(&pending_mallocs, &pid_tgid);
+    if (call.out) {
+        // posix_memalign returns an error number
+        if (rc != 0 || bpf_probe_read_user(&addr, sizeof(addr), (void *)call.out))
+            return 0;
+    }
+    // A failed realloc leaves the old allocation alone; realloc(p, 0)
+    // that returns NULL freed p through free(), which retired it
+    if (addr == 0)
         return 0;
     
-    // We need to correlate this with the size from the entry probe
-    // For now, we'll store the allocation in a temporary map
+    // realloc retires the allocation it replaces, which may be the same
+    // address; if that was sent, so is its replacement, for userspace to
+    // retire it
+    struct alloc_key key = {.addr = call.old_addr};
+    current_proc_key(&key.proc);
+    __u64 old_size = 0;
+    bool old_reported = false;
+    if (call.old_addr) {
+        struct allocation_info *old = bpf_map_lookup_elem(&allocation_map, &key);
+        if (old) {
+            old_size = old->size;
+            old_reported = old->reported;
+            bpf_map_delete_elem(&allocation_map, &key);
+            update_process_memory(old_size, 0);
+        }
+    }
+    
+    // Remember the size for free(), which is only passed the address
+    struct allocation_info info = {};
+    key.addr = addr;
+    info.size = call.size;
+    info.timestamp = bpf_ktime_get_ns();
+    info.start_time = key.proc.start_time;
+    info.pid = pid;
+    info.reported = old_reported || report_allocation(call.size);
+    bpf_map_update_elem(&allocation_map, &key, &info, BPF_ANY);
+    update_process_memory(call.size, 1);
+    
+    if (info.reported)
+        send_memory_event(ctx, pid, addr, call.size, call.type, call.old_addr, old_size);
     return 0;
 }
 
+/* Retires the current process's allocation at addr, returning its size
+ * if it was tracked and whether its free is to be sent */
+static __always_inline __u64 retire(__u64 addr, bool *reported) {
+    struct alloc_key key = {.addr = addr};
+    current_proc_key(&key.proc);
+    struct allocation_info *info = bpf_map_lookup_elem(&allocation_map, &key);
+    __u64 size = 0;
+    *reported = reporting_all();
+    if (info) {
+        size = info->size;
+        *reported = info->reported;
+        bpf_map_delete_elem(&allocation_map, &key);
+        update_process_memory(size, 0);
+    }
+    return size;
+}
+
 /* Trace free calls */
 SEC("uprobe/free")
 int trace_free(struct pt_regs *ctx) {
     __u64 addr = PT_REGS_PARM1(ctx);
-    __u32 pid = bpf_get_current_pid_tgid() >> 32;
+    __u64 pid_tgid = bpf_get_current_pid_tgid();
+    __u32 pid = pid_tgid >> 32;
     
-    if (pid == 0 || addr == 0)
+    if (pid == 0 || addr == 0 || !pid_filter_allowed(pid))
         return 0;
     
-    // Look up allocation info
-    struct allocation_info *info = bpf_map_lookup_elem(&allocation_map, &addr);
-    __u64 size = 0;
-    if (info) {
-        size = info->size;
-        bpf_map_delete_elem(&allocation_map, &addr);
-        update_process_memory(pid, size, 0);
+    // operator delete frees through free(); it reported the address
+    __u64 *deleting = bpf_map_lookup_elem(&pending_deletes, &pid_tgid);
+    if (deleting && *deleting == addr) {
+        bpf_map_delete_elem(&pending_deletes, &pid_tgid);
+        return 0;
     }
     
-    send_memory_event(pid, addr, size, ALLOC_FREE, 0);
+    bool reported;
+    __u64 size = retire(addr, &reported);
+    if (reported)
+        send_memory_event(ctx, pid, addr, size, ALLOC_FREE, 0, 0);
+    return 0;
+}
+
+/* operator delete and delete[], sized or not */
+SEC("uprobe/_ZdlPv")
+int trace_delete(struct pt_regs *ctx) {
+    __u64 addr = PT_REGS_PARM1(ctx);
+    __u64 pid_tgid = bpf_get_current_pid_tgid();
+    __u32 pid = pid_tgid >> 32;
+    
+    if (pid == 0 || addr == 0 || !pid_filter_allowed(pid))
+        return 0;
+    
+    bpf_map_update_elem(&pending_deletes, &pid_tgid, &addr, BPF_ANY);
+    bool reported;
+    __u64 size = retire(addr, &reported);
+    if (reported)
+        send_memory_event(ctx, pid, addr, size, ALLOC_DELETE, 0, 0);
     return 0;
 }
 
-/* Trace mmap calls */
+static __always_inline bool writable_exec(__u32 prot) {
+    return (prot & (PROT_WRITE | PROT_EXEC)) == (PROT_WRITE | PROT_EXEC);
+}
+
+/* Lengths as the kernel rounds them, to whole pages */
+static __always_inline __u64 region_len(__u64 len) {
+    return (len + REGION_PAGE - 1) & ~(REGION_PAGE - 1);
+}
+
+/* The file the current process has open as fd, or NULL */
+static __always_inline struct file *fd_file(__s64 fd) {
+    struct task_struct *task = (struct task_struct *)bpf_get_current_task();
+    struct file **fds = BPF_CORE_READ(task, files, fdt, fd);
+    struct file *file = NULL;
+
+    if (fd < 0 || fd >= BPF_CORE_READ(task, files, fdt, max_fds))
+        return NULL;
+    bpf_core_read(&file, sizeof(file), &fds[fd]);
+    return file;
+}
+
+static __always_inline void send_region_event(void *ctx, struct region_key *key,
+                                              struct mmap_region *region, __u32 op) {
+    struct region_event *event = bpf_ringbuf_reserve(&events, sizeof(*event), 0);
+    if (!event) {
+        count_drop();
+        return;
+    }
+    event->timestamp = bpf_ktime_get_ns();
+    event->start_time = key->proc.start_time;
+    event->addr = key->start;
+    event->len = region->len;
+    event->stack_id = bpf_get_stackid(ctx, &stack_traces, BPF_F_USER_STACK);
+    event->pid = key->proc.pid;
+    event->prot = region->prot;
+    event->flags = region->flags;
+    event->op = op;
+    bpf_get_current_comm(&event->comm, sizeof(event->comm));
+    __builtin_memcpy(event->file, region->file, sizeof(event->file));
+    bpf_ringbuf_submit(event, 0);
+}
+
+/* Records the mapping mmap made at addr, reporting it if it is writable
+ * and executable */
+static __always_inline void track_region(void *ctx, __u64 addr, struct pending_mmap *call) {
+    if (!target_allowed())
+        return;
+    struct region_key key = {.start = addr};
+    current_proc_key(&key.proc);
+    struct mmap_region region = {
+        .len = region_len(call->len),
+        .created = bpf_ktime_get_ns(),
+        .prot = call->prot,
+        .flags = call->flags,
+    };
+    if (!(call->flags & MAP_ANONYMOUS)) {
+        struct file *file = fd_file(call->fd);
+        if (file) {
+            region.ino = BPF_CORE_READ(file, f_inode, i_ino);
+            bpf_probe_read_kernel_str(region.file, sizeof(region.file),
+                                      BPF_CORE_READ(file, f_path.dentry, d_name.name));
+        }
+    }
+    bpf_map_update_elem(&region_map, &key, &region, BPF_ANY);
+    if (writable_exec(region.prot))
+        send_region_event(ctx, &key, &region, ALLOC_MMAP);
+}
+
+/* Cuts the first len bytes off the mapping at key, which the rest of it,
+ * if any, outlives as a mapping of its own; returns the mapping */
+static __always_inline struct mmap_region *split_region(struct region_key *key, __u64 len) {
+    struct mmap_region *region = bpf_map_lookup_elem(&region_map, key);
+    if (!region || len >= region->len)
+        return region;
+    struct mmap_region rest = *region;
+    struct region_key rest_key = *key;
+    rest.len -= len;
+    rest_key.start += len;
+    bpf_map_update_elem(&region_map, &rest_key, &rest, BPF_ANY);
+    region->len = len;
+    return region;
+}
+
+/* Trace mmap calls: the length is known on entry, the address on exit */
 SEC("tp/syscalls/sys_enter_mmap")
 int trace_mmap_enter(struct trace_event_raw_sys_enter *ctx) {
     __u64 size = ((__u64)ctx->args[1]);
-    __u32 pid = bpf_get_current_pid_tgid() >> 32;
+    __u64 pid_tgid = bpf_get_current_pid_tgid();
+    __u32 pid = pid_tgid >> 32;
     
     if (pid == 0 || size == 0)
         return 0;
     
-    send_memory_event(pid, 0, size, ALLOC_MMAP, 0);
+    struct pending_mmap call = {
+        .len = size,
+        .prot = ctx->args[2],
+        .flags = ctx->args[3],
+        .fd = (int)ctx->args[4],
+    };
+    bpf_map_update_elem(&pending_mmaps, &pid_tgid, &call, BPF_ANY);
     return 0;
 }
 
 SEC("tp/syscalls/sys_exit_mmap")
 int trace_mmap_exit(struct trace_event_raw_sys_exit *ctx) {
     __u64 addr = ctx->ret;
-    __u32 pid = bpf_get_current_pid_tgid() >> 32;
+    __u64 pid_tgid = bpf_get_current_pid_tgid();
+    __u32 pid = pid_tgid >> 32;
     
-    if (pid == 0 || (__s64)addr < 0)
+    struct pending_mmap *pending = bpf_map_lookup_elem(&pending_mmaps, &pid_tgid);
+    if (!pending)
         return 0;
+    struct pending_mmap call = *pending;
+    __u64 size = call.len;
+    bpf_map_delete_elem(&pending_mmaps, &pid_tgid);
+    if ((__s64)addr < 0)
+        return 0;
+    track_region(ctx, addr, &call);
     
     // Store allocation info for future munmap
     struct allocation_info info = {};
+    struct alloc_key key = {.addr = addr};
+    current_proc_key(&key.proc);
+    info.size = size;
     info.timestamp = bpf_ktime_get_ns();
+    info.start_time = key.proc.start_time;
     info.pid = pid;
-    // info.size would need to be retrieved from entry
+    info.reported = report_allocation(size);
+    bpf_map_update_elem(&allocation_map, &key, &info, BPF_ANY);
+    update_process_memory(size, 1);
     
-    bpf_map_update_elem(&allocation_map, &addr, &info, BPF_ANY);
+    if (info.reported)
+        send_memory_event(ctx, pid, addr, size, ALLOC_MMAP, 0, 0);
     return 0;
 }
 
@@ -263,13 +721,72 @@ int trace_munmap(struct trace_event_raw_sys_enter *ctx) {
     if (pid == 0 || addr == 0)
         return 0;
     
-    struct allocation_info *info = bpf_map_lookup_elem(&allocation_map, &addr);
+    bool reported = reporting_all();
+    struct alloc_key alloc = {.addr = addr};
+    current_proc_key(&alloc.proc);
+    struct allocation_info *info = bpf_map_lookup_elem(&allocation_map, &alloc);
     if (info) {
-        bpf_map_delete_elem(&allocation_map, &addr);
-        update_process_memory(pid, size, 0);
+        reported = info->reported;
+        bpf_map_delete_elem(&allocation_map, &alloc);
+        update_process_memory(size, 0);
     }
     
-    send_memory_event(pid, addr, size, ALLOC_MUNMAP, 0);
+    // Unmapping the start of a mapping leaves the rest mapped
+    struct region_key key = {.start = addr};
+    current_proc_key(&key.proc);
+    if (split_region(&key, region_len(size)))
+        bpf_map_delete_elem(&region_map, &key);
+    
+    if (reported)
+        send_memory_event(ctx, pid, addr, size, ALLOC_MUNMAP, 0, 0);
+    return 0;
+}
+
+/* Trace mprotect calls, applied to the mapping starting where they do on
+ * success; the start of a mapping whose protection changes is split off
+ * as the kernel splits it */
+SEC("tp/syscalls/sys_enter_mprotect")
+int trace_mprotect_enter(struct trace_event_raw_sys_enter *ctx) {
+    __u64 pid_tgid = bpf_get_current_pid_tgid();
+
+    if ((pid_tgid >> 32) == 0)
+        return 0;
+    struct pending_mprotect call = {
+        .start = ctx->args[0],
+        .len = region_len(ctx->args[1]),
+        .prot = ctx->args[2],
+    };
+    bpf_map_update_elem(&pending_mprotects, &pid_tgid, &call, BPF_ANY);
+    return 0;
+}
+
+SEC("tp/syscalls/sys_exit_mprotect")
+int trace_mprotect_exit(struct trace_event_raw_sys_exit *ctx) {
+    __u64 pid_tgid = bpf_get_current_pid_tgid();
+    struct pending_mprotect *pending = bpf_map_lookup_elem(&pending_mprotects, &pid_tgid);
+
+    if (!pending)
+        return 0;
+    struct pending_mprotect call = *pending;
+    bpf_map_delete_elem(&pending_mprotects, &pid_tgid);
+    if (ctx->ret != 0 || call.len == 0 || !target_allowed())
+        return 0;
+
+    struct region_key key = {.start = call.start};
+    current_proc_key(&key.proc);
+    struct mmap_region *region = split_region(&key, call.len);
+    if (!region) {
+        // Inside a mapping, or one made before the tracker started:
+        // nothing is known of its backing, but W+X is still reported
+        struct mmap_region unknown = {.len = call.len, .prot = call.prot};
+        if (writable_exec(call.prot))
+            send_region_event(ctx, &key, &unknown, ALLOC_MPROTECT);
+        return 0;
+    }
+    __u32 old = region->prot;
+    region->prot = call.prot;
+    if (writable_exec(call.prot) && !writable_exec(old))
+        send_region_event(ctx, &key, region, ALLOC_MPROTECT);
     return 0;
 }
 
@@ -282,39 +799,184 @@ int trace_brk(struct trace_event_raw_sys_enter *ctx) {
     if (pid == 0)
         return 0;
     
-    send_memory_event(pid, addr, 0, ALLOC_BRK, 0);
+    if (report_allocation(0))
+        send_memory_event(ctx, pid, addr, 0, ALLOC_BRK, 0, 0);
     return 0;
 }
 
-/* Trace page faults */
-SEC("tp/exceptions/page_fault_user")
-int trace_page_fault(struct trace_event_raw_page_fault_user *ctx) {
-    __u32 pid = bpf_get_current_pid_tgid() >> 32;
-    __u64 address = ctx->address;
-    __u32 error_code = ctx->error_code;
-    
-    if (pid == 0)
+/* Where a faulting address lies, as /proc/<pid>/maps names its mapping */
+enum fault_region {
+    REGION_ANON = 0,
+    REGION_HEAP,
+    REGION_STACK,
+    REGION_FILE,
+    NR_REGIONS,
+};
+
+/* vm_fault_t bits of handle_mm_fault's result, and FAULT_FLAG_USER */
+#define VM_FAULT_MAJOR 0x4
+#define VM_FAULT_RETRY 0x400
+#define VM_FAULT_ERROR 0x873  // OOM, SIGBUS, SIGSEGV, HWPOISON*, FALLBACK
+#define FAULT_FLAG_USER 0x40
+
+/* The user page faults of a process, by how they were served and where */
+struct fault_stats {
+    __u64 minor;
+    __u64 major;
+    __u64 regions[NR_REGIONS];
+    __u64 major_ns;  // time spent in major faults
+};
+
+/* Sent for every major fault, whose latency userspace observes */
+struct fault_event {
+    __u64 timestamp;
+    __u64 start_time;
+    __u64 address;
+    __u64 latency_ns;
+    __u32 pid;
+    __u32 region;   // enum fault_region
+    char comm[TASK_COMM_LEN];
+};
+
+/* A user page fault between handle_mm_fault entry and return */
+struct pending_fault {
+    __u64 start;
+    __u64 address;
+    __u32 region;
+    __u32 retried;  // the fault was retried, so it waited on I/O
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, MAX_ENTRIES);
+    __type(key, struct proc_key);
+    __type(value, struct fault_stats);
+} fault_stats_map SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(max_entries, MAX_ENTRIES);
+    __type(key, __u64); // pid_tgid
+    __type(value, struct pending_fault);
+} pending_faults SEC(".maps");
+
+/* The mapping address faulted in, tested as /proc/<pid>/maps names
+ * [heap] and [stack] */
+static __always_inline __u32 fault_region(struct vm_area_struct *vma) {
+    struct mm_struct *mm = BPF_CORE_READ(vma, vm_mm);
+    __u64 start = BPF_CORE_READ(vma, vm_start);
+    __u64 end = BPF_CORE_READ(vma, vm_end);
+    __u64 stack;
+
+    if (BPF_CORE_READ(vma, vm_file))
+        return REGION_FILE;
+    if (!mm)
+        return REGION_ANON;
+    if (start <= BPF_CORE_READ(mm, brk) && end >= BPF_CORE_READ(mm, start_brk))
+        return REGION_HEAP;
+    stack = BPF_CORE_READ(mm, start_stack);
+    if (start <= stack && end >= stack)
+        return REGION_STACK;
+    return REGION_ANON;
+}
+
+/* Start of a user page fault. A retried fault keeps the start of its
+ * first attempt */
+static __always_inline int fault_start(struct vm_area_struct *vma, unsigned long address, unsigned int flags) {
+    __u64 id = bpf_get_current_pid_tgid();
+    struct pending_fault *pending;
+
+    if (!(flags & FAULT_FLAG_USER) || (id >> 32) == 0 || !target_allowed())
+        return 0;
+    pending = bpf_map_lookup_elem(&pending_faults, &id);
+    if (pending && pending->retried)
+        return 0;
+
+    struct pending_fault fault = {
+        .start = bpf_ktime_get_ns(),
+        .address = address,
+        .region = fault_region(vma),
+    };
+    bpf_map_update_elem(&pending_faults, &id, &fault, BPF_ANY);
+    return 0;
+}
+
+/* End of a user page fault: counted as the kernel accounts faults, once
+ * done and major if it did I/O or had to be retried */
+static __always_inline int fault_end(unsigned int ret) {
+    __u64 id = bpf_get_current_pid_tgid();
+    struct pending_fault *pending = bpf_map_lookup_elem(&pending_faults, &id);
+
+    if (!pending)
+        return 0;
+    if (ret & VM_FAULT_RETRY) {
+        pending->retried = 1;
         return 0;
-    
-    struct process_memory *mem = bpf_map_lookup_elem(&process_memory_map, &pid);
-    if (!mem) {
-        struct process_memory new_mem = {};
-        bpf_map_update_elem(&process_memory_map, &pid, &new_mem, BPF_ANY);
-        mem = bpf_map_lookup_elem(&process_memory_map, &pid);
-        if (!mem) return 0;
     }
-    
-    mem->page_faults++;
-    
-    // Check if this is a major fault (page not in memory)
-    if (error_code & 0x4) { // Major fault flag
-        mem->major_faults++;
+    struct pending_fault fault = *pending;
+    bpf_map_delete_elem(&pending_faults, &id);
+    if (ret & VM_FAULT_ERROR)
+        return 0;
+
+    struct proc_key key = {};
+    current_proc_key(&key);
+    struct fault_stats *stats = bpf_map_lookup_elem(&fault_stats_map, &key);
+    if (!stats) {
+        struct fault_stats new_stats = {};
+        bpf_map_update_elem(&fault_stats_map, &key, &new_stats, BPF_NOEXIST);
+        stats = bpf_map_lookup_elem(&fault_stats_map, &key);
+        if (!stats)
+            return 0;
     }
-    
-    send_memory_event(pid, address, 4096, ALLOC_PAGE, 0);
+    if (fault.region < NR_REGIONS)
+        __sync_fetch_and_add(&stats->regions[fault.region], 1);
+    if (!(ret & VM_FAULT_MAJOR) && !fault.retried) {
+        __sync_fetch_and_add(&stats->minor, 1);
+        return 0;
+    }
+
+    __u64 latency = bpf_ktime_get_ns() - fault.start;
+    __sync_fetch_and_add(&stats->major, 1);
+    __sync_fetch_and_add(&stats->major_ns, latency);
+
+    struct fault_event *event = bpf_ringbuf_reserve(&events, sizeof(*event), 0);
+    if (!event) {
+        count_drop();
+        return 0;
+    }
+    event->timestamp = bpf_ktime_get_ns();
+    event->start_time = key.start_time;
+    event->address = fault.address;
+    event->latency_ns = latency;
+    event->pid = key.pid;
+    event->region = fault.region;
+    bpf_get_current_comm(&event->comm, sizeof(event->comm));
+    bpf_ringbuf_submit(event, 0);
     return 0;
 }
 
+SEC("kprobe/handle_mm_fault")
+int BPF_KPROBE(handle_mm_fault, struct vm_area_struct *vma, unsigned long address, unsigned int flags) {
+    return fault_start(vma, address, flags);
+}
+
+SEC("kretprobe/handle_mm_fault")
+int BPF_KRETPROBE(handle_mm_fault_ret, unsigned int ret) {
+    return fault_end(ret);
+}
+
+/* Trampoline variants, used instead of the kprobes where supported */
+SEC("fentry/handle_mm_fault")
+int BPF_PROG(handle_mm_fault_fentry, struct vm_area_struct *vma, unsigned long address, unsigned int flags) {
+    return fault_start(vma, address, flags);
+}
+
+SEC("fexit/handle_mm_fault")
+int BPF_PROG(handle_mm_fault_fexit, struct vm_area_struct *vma, unsigned long address, unsigned int flags,
+             struct pt_regs *regs, vm_fault_t ret) {
+    return fault_end(ret);
+}
+
 /* Monitor memory pressure events */
 SEC("tp/vmscan/mm_vmscan_wakeup_kswapd")
 int trace_memory_pressure(void *ctx) {
@@ -326,16 +988,138 @@ int trace_memory_pressure(void *ctx) {
     return 0;
 }
 
+/* Swap activity of a process under the swap hook set: pages it faulted
+ * back in from swap, pages its reclaim wrote out to swap, and its direct
+ * reclaims, where it freed memory itself instead of waiting for kswapd */
+struct swap_stats {
+    __u64 swap_ins;
+    __u64 swap_outs;
+    __u64 reclaims;
+    __u64 reclaim_ns;
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, MAX_ENTRIES);
+    __type(key, struct proc_key);
+    __type(value, struct swap_stats);
+} swap_stats_map SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(max_entries, MAX_ENTRIES);
+    __type(key, __u64); // pid_tgid
+    __type(value, __u64); // direct reclaim start
+} pending_reclaims SEC(".maps");
+
+static __always_inline struct swap_stats *current_swap_stats(void) {
+    struct proc_key key = {};
+    struct swap_stats *stats;
+
+    current_proc_key(&key);
+    stats = bpf_map_lookup_elem(&swap_stats_map, &key);
+    if (stats)
+        return stats;
+    struct swap_stats new_stats = {};
+    bpf_map_update_elem(&swap_stats_map, &key, &new_stats, BPF_NOEXIST);
+    return bpf_map_lookup_elem(&swap_stats_map, &key);
+}
+
+/* A folio read in from swap, swap_readpage before 6.10; readahead is
+ * counted to the faulting process too */
+SEC("kprobe/swap_read_folio")
+int trace_swap_in(struct pt_regs *ctx) {
+    struct swap_stats *stats;
+
+    if ((bpf_get_current_pid_tgid() >> 32) == 0 || !target_allowed())
+        return 0;
+    stats = current_swap_stats();
+    if (stats)
+        __sync_fetch_and_add(&stats->swap_ins, 1);
+    return 0;
+}
+
+/* A page written out to swap, counted to the process reclaiming: kswapd,
+ * or an allocating process in direct reclaim */
+SEC("kprobe/swap_writepage")
+int trace_swap_out(struct pt_regs *ctx) {
+    struct swap_stats *stats;
+
+    if ((bpf_get_current_pid_tgid() >> 32) == 0 || !target_allowed())
+        return 0;
+    stats = current_swap_stats();
+    if (stats)
+        __sync_fetch_and_add(&stats->swap_outs, 1);
+    return 0;
+}
+
+SEC("tp/vmscan/mm_vmscan_direct_reclaim_begin")
+int trace_reclaim_begin(void *ctx) {
+    __u64 id = bpf_get_current_pid_tgid();
+    __u64 start = bpf_ktime_get_ns();
+
+    if ((id >> 32) == 0 || !target_allowed())
+        return 0;
+    bpf_map_update_elem(&pending_reclaims, &id, &start, BPF_ANY);
+    return 0;
+}
+
+SEC("tp/vmscan/mm_vmscan_direct_reclaim_end")
+int trace_reclaim_end(void *ctx) {
+    __u64 id = bpf_get_current_pid_tgid();
+    __u64 *start = bpf_map_lookup_elem(&pending_reclaims, &id);
+    struct swap_stats *stats;
+
+    if (!start)
+        return 0;
+    __u64 latency = bpf_ktime_get_ns() - *start;
+    bpf_map_delete_elem(&pending_reclaims, &id);
+    stats = current_swap_stats();
+    if (!stats)
+        return 0;
+    __sync_fetch_and_add(&stats->reclaims, 1);
+    __sync_fetch_and_add(&stats->reclaim_ns, latency);
+    return 0;
+}
+
 /* Trace OOM killer events */
 SEC("tp/oom/mark_victim")
 int trace_oom_victim(struct trace_event_raw_mark_victim *ctx) {
     __u32 pid = ctx->pid;
     
     // Send OOM event
-    send_memory_event(pid, 0, 0, 0xFF, 0); // Special type for OOM
+    send_memory_event(ctx, pid, 0, 0, 0xFF, 0, 0); // Special type for OOM
     return 0;
 }
 
+/*
+ * mm->rss_stat changed layout in 6.2, from a struct of atomic counters to
+ * an array of percpu counters; these flavors read whichever the running
+ * kernel has
+ */
+struct mm_rss_stat___old {
+    atomic_long_t count[4];
+} __attribute__((preserve_access_index));
+
+struct mm_struct___old {
+    struct mm_rss_stat___old rss_stat;
+} __attribute__((preserve_access_index));
+
+struct mm_struct___new {
+    struct percpu_counter rss_stat[4];
+} __attribute__((preserve_access_index));
+
+/* Resident file-backed pages of mm (MM_FILEPAGES) */
+static __always_inline __u64 mm_rss_pages(struct mm_struct *mm) {
+    __u64 pages = 0;
+
+    if (bpf_core_type_exists(struct mm_rss_stat___old))
+        BPF_CORE_READ_INTO(&pages, (struct mm_struct___old *)mm, rss_stat.count[0].counter);
+    else
+        BPF_CORE_READ_INTO(&pages, (struct mm_struct___new *)mm, rss_stat[0].count);
+    return pages;
+}
+
 /* Sample memory statistics periodically */
 SEC("perf_event")
 int sample_memory_stats(struct bpf_perf_event_data *ctx) {
@@ -352,17 +1136,15 @@ int sample_memory_stats(struct bpf_perf_event_data *ctx) {
     if (!mm)
         return 0;
     
-    struct process_memory *mem = bpf_map_lookup_elem(&process_memory_map, &pid);
-    if (!mem) {
-        struct process_memory new_mem = {};
-        bpf_map_update_elem(&process_memory_map, &pid, &new_mem, BPF_ANY);
-        mem = bpf_map_lookup_elem(&process_memory_map, &pid);
-        if (!mem) return 0;
-    }
+    struct proc_key key = {};
+    proc_key_of(task, &key);
+    struct process_memory *mem = touch_process(&key);
+    if (!mem)
+        return 0;
     
     // Update RSS and virtual memory statistics
     __u64 rss_pages, vmem_pages;
-    BPF_CORE_READ_INTO(&rss_pages, mm, rss_stat.count[0].counter);
+    rss_pages = mm_rss_pages(mm);
     BPF_CORE_READ_INTO(&vmem_pages, mm, total_vm);
     
     mem->rss_pages = rss_pages;
@@ -371,29 +1153,220 @@ int sample_memory_stats(struct bpf_perf_event_data *ctx) {
     return 0;
 }
 
-/* Kprobe for detailed allocation tracking */
-SEC("kprobe/__alloc_pages")
-int BPF_KPROBE(__alloc_pages, gfp_t gfp_mask, unsigned int order) {
+/* Counts pages allocated by the current process against the NUMA node
+ * they were asked from: the preferred node, which the allocator only
+ * falls back from when it runs short, or the allocating CPU's node when
+ * none was preferred */
+static __always_inline void update_process_numa(__u64 size, int preferred_nid) {
+    struct proc_key key = {};
+    current_proc_key(&key);
+    struct process_memory *mem = touch_process(&key);
+    if (!mem)
+        return;
+    
+    __u32 local = bpf_get_numa_node_id();
+    __u32 node = preferred_nid < 0 ? local : preferred_nid;  // NUMA_NO_NODE
+    if (node < MAX_NUMA_NODES)
+        mem->node_bytes[node] += size;
+    if (node != local)
+        mem->remote_bytes += size;
+}
+
+/* Shared body of the page allocation kprobe and fentry programs */
+static __always_inline int handle_alloc_pages(void *ctx, unsigned int order, int preferred_nid) {
     __u32 pid = bpf_get_current_pid_tgid() >> 32;
     __u64 size = (1ULL << order) * 4096; // Pages to bytes
     
     if (pid == 0)
         return 0;
     
-    update_process_memory(pid, size, 1);
-    send_memory_event(pid, 0, size, ALLOC_PAGE, 0);
+    update_process_memory(size, 1);
+    update_process_numa(size, preferred_nid);
+    if (report_allocation(size))
+        send_memory_event(ctx, pid, 0, size, ALLOC_PAGE, 0, 0);
     return 0;
 }
 
-SEC("kprobe/__free_pages")
-int BPF_KPROBE(__free_pages, struct page *page, unsigned int order) {
+/* Shared body of the page free kprobe and fentry programs */
+static __always_inline int handle_free_pages(unsigned int order) {
     __u32 pid = bpf_get_current_pid_tgid() >> 32;
     __u64 size = (1ULL << order) * 4096; // Pages to bytes
     
     if (pid == 0)
         return 0;
     
-    update_process_memory(pid, size, 0);
+    update_process_memory(size, 0);
+    return 0;
+}
+
+/* Kprobe for detailed allocation tracking */
+SEC("kprobe/__alloc_pages")
+int BPF_KPROBE(__alloc_pages, gfp_t gfp_mask, unsigned int order, int preferred_nid) {
+    return handle_alloc_pages(ctx, order, preferred_nid);
+}
+
+SEC("kprobe/__free_pages")
+int BPF_KPROBE(__free_pages, struct page *page, unsigned int order) {
+    return handle_free_pages(order);
+}
+
+/* Trampoline variants, used instead of the kprobes where supported */
+SEC("fentry/__alloc_pages")
+int BPF_PROG(alloc_pages_fentry, gfp_t gfp_mask, unsigned int order, int preferred_nid) {
+    return handle_alloc_pages(ctx, order, preferred_nid);
+}
+
+SEC("fentry/__free_pages")
+int BPF_PROG(free_pages_fentry, struct page *page, unsigned int order) {
+    return handle_free_pages(order);
+}
+
+/* Kernel allocations by call site, from the kmem tracepoints. They are
+ * the kernel's, not a process's, so neither the PID filter nor the
+ * targets scope them */
+struct kmem_site {
+    __u64 allocs;
+    __u64 frees;
+    __u64 bytes_req;
+    __u64 bytes_alloc;
+    __u64 outstanding;  // bytes_alloc not freed yet
+};
+
+/* A live kernel allocation */
+struct kmem_object {
+    __u64 call_site;
+    __u64 bytes_alloc;
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 4096);
+    __type(key, __u64); // call site
+    __type(value, struct kmem_site);
+} kmem_sites SEC(".maps");
+
+/* Live kernel allocations by address; LRU, so objects that live as long
+ * as the kernel make way */
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(max_entries, MAX_ENTRIES * 4);
+    __type(key, __u64); // address
+    __type(value, struct kmem_object);
+} kmem_objects SEC(".maps");
+
+/* The leading fields of the kmem tracepoints, the same on every kernel
+ * although 6.1 split their event classes */
+struct kmem_alloc_args {
+    __u64 common;  // struct trace_entry
+    unsigned long call_site;
+    const void *ptr;
+    size_t bytes_req;
+    size_t bytes_alloc;
+};
+
+struct kmem_free_args {
+    __u64 common;
+    unsigned long call_site;
+    const void *ptr;
+};
+
+static __always_inline int kmem_alloc(struct kmem_alloc_args *args) {
+    __u64 ptr = (__u64)args->ptr;
+    __u64 call_site = args->call_site;
+    struct kmem_object object = {
+        .call_site = call_site,
+        .bytes_alloc = args->bytes_alloc,
+    };
+    struct kmem_site *site;
+
+    if (!ptr)
+        return 0;
+    site = bpf_map_lookup_elem(&kmem_sites, &call_site);
+    if (!site) {
+        struct kmem_site new_site = {};
+        bpf_map_update_elem(&kmem_sites, &call_site, &new_site, BPF_NOEXIST);
+        site = bpf_map_lookup_elem(&kmem_sites, &call_site);
+        if (!site)
+            return 0;
+    }
+    __sync_fetch_and_add(&site->allocs, 1);
+    __sync_fetch_and_add(&site->bytes_req, args->bytes_req);
+    __sync_fetch_and_add(&site->bytes_alloc, args->bytes_alloc);
+    __sync_fetch_and_add(&site->outstanding, args->bytes_alloc);
+    bpf_map_update_elem(&kmem_objects, &ptr, &object, BPF_ANY);
+    return 0;
+}
+
+/* A free is credited to the site that allocated the object, if it was
+ * seen */
+static __always_inline int kmem_free(struct kmem_free_args *args) {
+    __u64 ptr = (__u64)args->ptr;
+    struct kmem_object *object;
+    struct kmem_site *site;
+
+    object = bpf_map_lookup_elem(&kmem_objects, &ptr);
+    if (!object)
+        return 0;
+    site = bpf_map_lookup_elem(&kmem_sites, &object->call_site);
+    if (site) {
+        __sync_fetch_and_add(&site->frees, 1);
+        __sync_fetch_and_sub(&site->outstanding, object->bytes_alloc);
+    }
+    bpf_map_delete_elem(&kmem_objects, &ptr);
+    return 0;
+}
+
+SEC("tp/kmem/kmalloc")
+int trace_kmalloc(struct kmem_alloc_args *args) {
+    return kmem_alloc(args);
+}
+
+SEC("tp/kmem/kmem_cache_alloc")
+int trace_kmem_cache_alloc(struct kmem_alloc_args *args) {
+    return kmem_alloc(args);
+}
+
+SEC("tp/kmem/kfree")
+int trace_kfree(struct kmem_free_args *args) {
+    return kmem_free(args);
+}
+
+SEC("tp/kmem/kmem_cache_free")
+int trace_kmem_cache_free(struct kmem_free_args *args) {
+    return kmem_free(args);
+}
+
+/* Process exit: drop the statistics and report the exit, whose record
+ * userspace tells from events by its size. Only the thread group
+ * leader's exit ends the process. */
+SEC("tp/sched/sched_process_exit")
+int trace_sched_process_exit(void *ctx) {
+    struct task_struct *task = (struct task_struct *)bpf_get_current_task();
+    __u64 pid_tgid = bpf_get_current_pid_tgid();
+    struct proc_key key = {};
+    struct process_exit *record;
+
+    if ((__u32)pid_tgid != (__u32)(pid_tgid >> 32))
+        return 0;
+
+    proc_key_of(task, &key);
+    bpf_map_delete_elem(&process_memory_map, &key);
+    bpf_map_delete_elem(&fault_stats_map, &key);
+    bpf_map_delete_elem(&swap_stats_map, &key);
+
+    if (!target_allowed())
+        return 0;
+    record = bpf_ringbuf_reserve(&events, sizeof(*record), 0);
+    if (!record) {
+        count_drop();
+        return 0;
+    }
+    record->timestamp = bpf_ktime_get_ns();
+    record->start_time = key.start_time;
+    record->pid = key.pid;
+    record->exit_code = BPF_CORE_READ(task, exit_code);
+    bpf_get_current_comm(&record->comm, sizeof(record->comm));
+    bpf_ringbuf_submit(record, 0);
     return 0;
 }
 
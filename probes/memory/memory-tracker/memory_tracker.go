@@ -3,23 +3,54 @@
 
 package main
 
+// Event and map value types are generated from the object's BTF:
+//go:generate go run probepilot/cmd/btfgen -obj build/memory_tracker.o -out memory_tracker_types.go -types proc_key,memory_event,process_exit,process_memory,system_memory,allocation_info,alloc_key,kmem_site,kmem_object,fault_stats,fault_event,swap_stats,region_key,mmap_region,region_event -names vmem_pages=VMemPages,allocation_info=AllocationEntry -checks layoutChecks
+
 import (
-    "bytes"
     "context"
-    "encoding/binary"
+    "errors"
+    "flag"
     "fmt"
+    "io"
     "log"
+    "net/http"
     "os"
-    "os/signal"
     "sort"
-    "syscall"
+    "strconv"
+    "sync"
     "time"
     "unsafe"
 
     "github.com/cilium/ebpf"
     "github.com/cilium/ebpf/link"
-    "github.com/cilium/ebpf/ringbuf"
-    "github.com/cilium/ebpf/rlimit"
+
+    "probepilot/pkg/attach"
+    "probepilot/pkg/config"
+    "probepilot/pkg/control"
+    "probepilot/pkg/core"
+    "probepilot/pkg/decode"
+    "probepilot/pkg/export"
+    "probepilot/pkg/histogram"
+    "probepilot/pkg/layout"
+    "probepilot/pkg/limits"
+    "probepilot/pkg/maps"
+    "probepilot/pkg/otlp"
+    "probepilot/pkg/output"
+    "probepilot/pkg/platform"
+    "probepilot/pkg/probe"
+    "probepilot/pkg/procfs"
+    "probepilot/pkg/profile"
+    "probepilot/pkg/query"
+    "probepilot/pkg/route"
+    "probepilot/pkg/sampling"
+    "probepilot/pkg/seal"
+    "probepilot/pkg/summary"
+    "probepilot/pkg/symbolize"
+    "probepilot/pkg/target"
+    "probepilot/pkg/topk"
+    "probepilot/pkg/reaction"
+    "probepilot/pkg/tsdb"
+    "probepilot/pkg/units"
 )
 
 // Memory allocation types
@@ -32,6 +63,10 @@ const (
     AllocMunmap = 6
     AllocBrk = 7
     AllocPage = 8
+    AllocMemalign = 9
+    AllocNew = 10
+    AllocDelete = 11
+    AllocMprotect = 12
     AllocOOM = 0xFF
 )
 
@@ -44,124 +79,522 @@ var allocTypeNames = map[uint32]string{
     AllocMunmap:  "munmap",
     AllocBrk:     "brk",
     AllocPage:    "page",
+    AllocMemalign: "memalign",
+    AllocNew:     "new",
+    AllocDelete:  "delete",
+    AllocMprotect: "mprotect",
     AllocOOM:     "oom",
 }
 
-// Data structures matching eBPF program
-type MemoryEvent struct {
-    Timestamp uint64
-    PID       uint32
-    TID       uint32
-    Addr      uint64
-    Size      uint64
-    OldAddr   uint64
-    Type      uint32
-    Flags     uint32
-    StackID   uint64
-    Comm      [16]int8
-}
-
-type ProcessMemory struct {
-    TotalAllocated  uint64
-    TotalFreed      uint64
-    CurrentUsage    uint64
-    PeakUsage       uint64
-    AllocationCount uint64
-    FreeCount       uint64
-    PageFaults      uint64
-    MajorFaults     uint64
-    RSSPages        uint64
-    VMemPages       uint64
-}
-
-type SystemMemory struct {
-    TotalMemory     uint64
-    FreeMemory      uint64
-    AvailableMemory uint64
-    CachedMemory    uint64
-    BufferMemory    uint64
-    SlabMemory      uint64
-    PageCacheSize   uint64
-    MemoryPressure  uint32
+// heapAllocation reports whether events of type t are allocations traced
+// by the allocator uprobes
+func heapAllocation(t uint32) bool {
+    switch t {
+    case AllocMalloc, AllocCalloc, AllocRealloc, AllocMemalign, AllocNew:
+        return true
+    }
+    return false
+}
+
+// Core tracepoints, always attached
+var tracepoints = []struct {
+    group string
+    name  string
+    prog  string
+}{
+    {"syscalls", "sys_enter_mmap", "trace_mmap_enter"},
+    {"syscalls", "sys_exit_mmap", "trace_mmap_exit"},
+    {"syscalls", "sys_enter_munmap", "trace_munmap"},
+    {"syscalls", "sys_enter_mprotect", "trace_mprotect_enter"},
+    {"syscalls", "sys_exit_mprotect", "trace_mprotect_exit"},
+    {"syscalls", "sys_enter_brk", "trace_brk"},
+    {"vmscan", "mm_vmscan_wakeup_kswapd", "trace_memory_pressure"},
+    {"oom", "mark_victim", "trace_oom_victim"},
+    {"sched", "sched_process_exit", "trace_sched_process_exit"},
+}
+
+// Common libc paths to try for the allocator uprobes
+var libcPaths = []string{
+    "/lib/x86_64-linux-gnu/libc.so.6",
+    "/usr/lib/x86_64-linux-gnu/libc.so.6",
+    "/lib64/libc.so.6",
+    "/usr/lib64/libc.so.6",
+}
+
+// Common libstdc++ paths to try for the operator new/delete uprobes
+var libstdcxxPaths = []string{
+    "/lib/x86_64-linux-gnu/libstdc++.so.6",
+    "/usr/lib/x86_64-linux-gnu/libstdc++.so.6",
+    "/lib64/libstdc++.so.6",
+    "/usr/lib64/libstdc++.so.6",
+}
+
+// allocFunc is an allocator function traced by a uprobe at entry and,
+// for allocations, a uretprobe at return. Optional ones may be missing
+// from older libraries.
+type allocFunc struct {
+    symbol   string
+    entry    string
+    ret      string
+    optional bool
 }
 
+// libcAllocFuncs are traced in libc; every allocation returns through
+// trace_malloc_ret, which retires the allocation realloc replaces
+var libcAllocFuncs = []allocFunc{
+    {symbol: "malloc", entry: "trace_malloc", ret: "trace_malloc_ret"},
+    {symbol: "calloc", entry: "trace_calloc", ret: "trace_malloc_ret", optional: true},
+    {symbol: "realloc", entry: "trace_realloc", ret: "trace_malloc_ret", optional: true},
+    {symbol: "posix_memalign", entry: "trace_posix_memalign", ret: "trace_malloc_ret", optional: true},
+    {symbol: "aligned_alloc", entry: "trace_aligned_alloc", ret: "trace_malloc_ret", optional: true},
+    {symbol: "free", entry: "trace_free"},
+}
+
+// cxxAllocFuncs are traced in libstdc++: operator new and delete, which
+// new[] and the sized and array deletes call
+var cxxAllocFuncs = []allocFunc{
+    {symbol: "_Znwm", entry: "trace_new", ret: "trace_malloc_ret", optional: true},
+    {symbol: "_ZdlPv", entry: "trace_delete", optional: true},
+}
+
+// Page allocator hooks, with kprobe and fentry program variants
+var kernelFuncs = []attach.KernelFunc{
+    {Symbol: "__alloc_pages", Kprobe: "__alloc_pages", Fentry: "alloc_pages_fentry", Optional: true},
+    {Symbol: "__free_pages", Kprobe: "__free_pages", Fentry: "free_pages_fentry", Optional: true},
+}
+
+// requiredPrograms are the programs the tracker cannot run without; any
+// other program this kernel cannot load is dropped with its hook
+var requiredPrograms = []string{"trace_malloc", "trace_malloc_ret", "trace_free"}
+
 type AllocationInfo struct {
-    Size      uint64
-    Timestamp uint64
-    StackID   uint64
-    PID       uint32
+    Size          uint64
+    Timestamp     uint64
+    StackID       uint64
+    KernelStackID uint64
+    PID           uint32
+    TID           uint32
+    StartTime     uint64
+}
+
+func (info *AllocationInfo) proc() ProcKey {
+    return ProcKey{PID: info.PID, StartTime: info.StartTime}
+}
+
+// Config holds tracker configuration
+type Config struct {
+    Profile    profile.Profile
+    AttachMode attach.Mode
+    Retention  []tsdb.Resolution
+    Limits     limits.Limits
+    RawSymbols bool
+    Router     *route.Router
+    Output     *output.Writer
+    Histograms histogram.Options
+    // PIDs restricts the malloc/free uprobes to these processes, filtered
+    // inside BPF; empty traces every process
+    PIDs []uint32
+    // TargetPIDs are running processes whose own allocator libraries and
+    // executable are traced, by uprobes scoped to them, instead of
+    // system-wide libc
+    TargetPIDs []uint32
+    // OOMReportDir is where a report is written for every OOM kill, ""
+    // for none
+    OOMReportDir string
+    KernelBTF    string
+    // Targets scopes every probe to the processes of a targeting file;
+    // nil traces every process
+    Targets *target.Config
+    // LargeAllocs are what allocations past each size threshold do
+    LargeAllocs largeRules
+    // NUMA reports page allocations by NUMA node, under the page-alloc
+    // hook set
+    NUMA bool
+    // Sampling selects the allocations sent to userspace
+    Sampling Sampling
+    // MaxLeaks bounds the potential leaks tracked, 0 for no bound; past
+    // it LeakEviction picks the one making way, spilled to LeakSpill
+    // unless ""
+    MaxLeaks     int
+    LeakEviction leakEviction
+    LeakSpill    string
+    // LeakReport is the file the leak groups are written to as JSON
+    // every report, empty for none
+    LeakReport string
+    // Seal encrypts OOM reports, the leak report and the leak spill at
+    // rest; nil writes them in the clear
+    Seal *seal.Key
+    // ExitRetention is how long the summaries of exited processes are
+    // kept for queries, 0 for not at all
+    ExitRetention time.Duration
+    // PerThread counts allocations per thread too
+    PerThread bool
+    // Fragmentation sets the live heap bytes of each process against
+    // its heap footprint in smaps
+    Fragmentation bool
+    // PressureThreshold is the percentage of a second some task stalls
+    // on memory for that opens a pressure incident, 0 for none
+    PressureThreshold float64
+    // CgroupWarn is the percentage of memory.max a cgroup uses that
+    // warns, 0 for no warnings
+    CgroupWarn float64
+    // Queue holds records the tracker has yet to handle; nil handles
+    // them as they are read
+    Queue *probe.Queue
+    // AdaptiveSampling is the ring buffer drops per second past which
+    // the sampling rate is raised; 0 keeps Sampling.Rate
+    AdaptiveSampling float64
 }
 
 type MemoryTracker struct {
-    spec        *ebpf.CollectionSpec
-    coll        *ebpf.Collection
-    eventReader *ringbuf.Reader
-    links       []link.Link
+    // mu serializes Handle with Stats, which run on different goroutines,
+    // and with the query API, control socket and exporters reading the
+    // tracker's state
+    mu sync.Mutex
+
+    spec  *ebpf.CollectionSpec
+    coll  *ebpf.Collection
+    links []link.Link
+
+    profile      profile.Profile
+    attachMode   attach.Mode
+    limits       limits.Limits
+    kernelBTF    string
+    attachReport attach.Report
+    bpfStats     io.Closer
+
+    // Optional hooks operators can toggle at runtime, and the control
+    // socket server they are toggled through
+    hooks   *attach.Toggles
+    control *control.Server
+
+    // Severity classification and routing of events to external sinks
+    router *route.Router
+
+    // JSON lines of events and stats snapshots, nil for text output
+    output *output.Writer
     
     // Statistics
     totalEvents       uint64
     allocationEvents  uint64
     freeEvents        uint64
     pageEvents        uint64
+    wxEvents          uint64
     oomEvents         uint64
-    processStats      map[uint32]*ProcessMemory
-    leaks             map[uint64]*AllocationInfo
+    processStats      *topk.Sketch[ProcKey, ProcessMemory] // heaviest allocators, bounded by -top-k
+    currentUsage      uint64 // CurrentUsage summed over processStats
+    leaks             *leakTable // potential leaks, bounded by -max-leaks
+    leakSpill         *leakSpill // evicted leaks, nil unless -leak-spill
+
+    // Leak candidates grouped by comm and stack under stable IDs, largest
+    // first, and by ID this report and in the report of the last run
+    leakGroups     []*leakGroup
+    leakHistory    map[string]*leakGroup
+    leakPrior      map[string]*leakGroup
+    leakReportPath string
+
+    // Key OOM reports, the leak report and the leak spill are sealed
+    // under, nil for none
+    sealKey *seal.Key
     startTime         time.Time
+
+    // Processes by PID and start time, so a recycled PID is not merged
+    // with the process that had it before: the start time of the process
+    // holding each PID, and the processes that exited since the last
+    // report, whose allocations are dropped then
+    starts map[uint32]uint64
+    exited map[ProcKey]bool
+    exits  uint64
+
+    // Kernel-reported memory of the tracked processes, sampled from /proc
+    // at each report to check the allocations traced against
+    usage map[ProcKey]procfs.Usage
+
+    // OOM reports, written to oomReportDir, with the recent large
+    // allocations and the usage of each process at the last reports
+    oomReportDir string
+    largeAllocs  []largeAlloc
+    usageTrend   map[ProcKey][]usagePoint
+
+    // Thresholds of large allocations, and when each process was last
+    // alerted on for one
+    large        largeRules
+    largeAlerted map[uint32]time.Time
+
+    // Whether to report page allocations by NUMA node
+    numa bool
+
+    // Lifetime summaries of exited processes, oldest first, kept for
+    // exitRetention
+    exitRetention time.Duration
+    exitSummaries []exitSummary
+
+    // The heaviest allocating threads under -per-thread, else nil
+    threads *topk.Sketch[threadKey, threadStats]
+
+    // The heaps of the heaviest allocating processes under
+    // -fragmentation, else nil
+    heaps *topk.Sketch[ProcKey, heapState]
+
+    // Memory stalls from /proc/pressure/memory and the pressure
+    // incidents they open, nil under -pressure-threshold 0
+    pressure *pressureState
+
+    // Traced allocations by cgroup v2 at the last report, the cgroups
+    // warned of nearing memory.max, and the share of it that warns
+    cgroupPaths    *target.CgroupPaths
+    cgroups        []*cgroupUsage
+    cgroupWarn     float64
+    cgroupAlerted  map[uint64]bool
+    cgroupWarnings uint64
+
+    // Records read from the ring buffer and not yet handled
+    queue *probe.Queue
+
+    // Which allocations BPF sends; unless every one, process totals are
+    // read from process_memory_map
+    sampling Sampling
+
+    // Records the ring buffer had no room for, and the sampling rate they
+    // call for under -adaptive-sampling
+    drops *sampling.Adaptive
+
+    // Bounds the alerts and escalations raised while handling events,
+    // which have no context of their own, to the tracker's life
+    ctx    context.Context
+    cancel context.CancelFunc
+
+    // Caps new processStats and leaks entries under -memory-limit
+    budget *limits.Budget
+
+    // Process metadata, backfilled from /proc at startup
+    procs *procfs.Cache
+
+    // Local metric history with downsampled rollups
+    history *tsdb.Store
+
+    // Allocator of each process, detected from its maps, and the
+    // allocator libraries the uprobes trace
+    allocs    map[ProcKey]string
+    allocMu   sync.Mutex
+    allocLibs []allocLib
+
+    // Target processes, traced instead of system-wide libc, and the
+    // uprobes of those still running
+    targetPIDs  []uint32
+    targetLinks map[uint32][]link.Link
+
+    // Growth alerts and the deep captures they escalate to
+    growthThreshold uint64
+    lastUsage       map[ProcKey]uint64
+    reactor         *reaction.Reactor
+    captureMu       sync.Mutex
+    captures        map[uint32]*allocCapture
+    symbols         *symbolize.Symbolizer
+
+    // Heap growth anomalies: the window of reports each process's growth
+    // rate is fitted over, the slope in bytes a minute that alerts, and
+    // who is told of alerts
+    growthSlope   uint64
+    growthWindow  time.Duration
+    growthWindows map[ProcKey][]growthPoint
+    notifier      reaction.Notifier
+
+    // Names of the stacks large allocations and leaks are reported with
+    stacks *stackNames
+
+    // Allocation size distributions by event type
+    histograms histogram.Options
+    allocSizes map[uint32]*histogram.Histogram
+
+    // Major fault latency distributions by region
+    faultLatency map[uint32]*histogram.Histogram
+
+    // Processes the libc uprobes fire for, checked in BPF before any work
+    pids      []uint32
+    pidFilter *attach.PIDFilter
+
+    // Processes every probe reports, shared with the other agents
+    targetConfig *target.Config
+    targets      *target.Filter
 }
 
-func NewMemoryTracker() (*MemoryTracker, error) {
-    if err := rlimit.RemoveMemlock(); err != nil {
-        return nil, fmt.Errorf("failed to remove memlock: %v", err)
+// allocSizeBuckets are the default classic allocation size boundaries,
+// 16 bytes to 64M
+var allocSizeBuckets = histogram.ExponentialBuckets(16, 4, 12)
+
+func NewMemoryTracker(config Config) (*MemoryTracker, error) {
+    history, err := tsdb.New(config.Retention...)
+    if err != nil {
+        return nil, fmt.Errorf("invalid history retention: %v", err)
     }
 
     tracker := &MemoryTracker{
-        processStats: make(map[uint32]*ProcessMemory),
-        leaks:        make(map[uint64]*AllocationInfo),
+        processStats: topk.New[ProcKey, ProcessMemory](config.Limits.TopKEntries()),
+        starts:       make(map[uint32]uint64),
+        exited:       make(map[ProcKey]bool),
+        allocs:       make(map[ProcKey]string),
+        usage:        make(map[ProcKey]procfs.Usage),
+        oomReportDir: config.OOMReportDir,
+        sealKey:      config.Seal,
+        usageTrend:   make(map[ProcKey][]usagePoint),
+        large:        config.LargeAllocs,
+        largeAlerted: make(map[uint32]time.Time),
+        numa:         config.NUMA,
+        exitRetention: config.ExitRetention,
+        cgroupPaths:   target.NewCgroupPaths(),
+        cgroupWarn:    config.CgroupWarn / 100,
+        cgroupAlerted: make(map[uint64]bool),
+        queue:         config.Queue,
+        sampling:     config.Sampling,
         startTime:    time.Now(),
+        profile:      config.Profile,
+        attachMode:   config.AttachMode,
+        limits:       config.Limits,
+        kernelBTF:    config.KernelBTF,
+        budget:       limits.NewBudget(config.Limits.MemoryLimit / 4 * 3),
+        procs:        procfs.NewCache(),
+        history:      history,
+        lastUsage:    make(map[ProcKey]uint64),
+        captures:     make(map[uint32]*allocCapture),
+        symbols:      symbolize.New(symbolize.Options{Raw: config.RawSymbols}),
+        hooks:        attach.NewToggles(),
+        router:       config.Router,
+        output:       config.Output,
+        histograms:   config.Histograms,
+        allocSizes:   make(map[uint32]*histogram.Histogram),
+        faultLatency: make(map[uint32]*histogram.Histogram),
+        pids:         config.PIDs,
+        targetPIDs:   config.TargetPIDs,
+        targetLinks:  make(map[uint32][]link.Link),
+        targetConfig: config.Targets,
+    }
+    tracker.processStats.OnEvict = tracker.dropUsage
+    tracker.leaks = newLeakTable(config.MaxLeaks, config.LeakEviction, tracker.spillLeak)
+    if tracker.drops, err = sampling.NewAdaptive(config.Sampling.Rate, config.AdaptiveSampling); err != nil {
+        return nil, err
+    }
+    if config.LeakSpill != "" {
+        if tracker.leakSpill, err = openLeakSpill(config.LeakSpill, config.Seal); err != nil {
+            return nil, fmt.Errorf("failed to open leak spill: %v", err)
+        }
+    }
+    if config.LeakReport != "" {
+        tracker.leakReportPath = config.LeakReport
+        if tracker.leakPrior, err = readLeakReport(config.LeakReport, config.Seal); err != nil {
+            log.Printf("Warning: failed to read the last leak report, leak groups are seen anew: %v", err)
+        }
+    }
+    tracker.ctx, tracker.cancel = context.WithCancel(context.Background())
+    if config.PerThread {
+        tracker.threads = topk.New[threadKey, threadStats](config.Limits.TopKEntries())
+    }
+    if config.Fragmentation {
+        tracker.heaps = topk.New[ProcKey, heapState](config.Limits.TopKEntries())
+    }
+    if config.PressureThreshold > 0 {
+        tracker.pressure = &pressureState{threshold: config.PressureThreshold / 100}
+    }
+    tracker.control = control.NewServer(tracker)
+    tracker.control.HandleHooks(tracker.hooks)
+
+    // Attribute processes that were already running before the agent
+    if n, err := tracker.procs.Backfill(); err != nil {
+        log.Printf("Warning: failed to backfill process metadata: %v", err)
+    } else {
+        log.Printf("Backfilled metadata for %d running processes", n)
+    }
+    if err := procfs.CheckHostPIDs(); err != nil {
+        log.Printf("Warning: %v", err)
     }
 
     return tracker, nil
 }
 
 func (mt *MemoryTracker) Load() error {
-    spec, err := ebpf.LoadCollectionSpec("memory_tracker.o")
+    spec, err := ebpf.LoadCollectionSpec(probe.Object("memory_tracker.o"))
     if err != nil {
-        return fmt.Errorf("failed to load eBPF spec: %v", err)
+        return fmt.Errorf("failed to load eBPF spec: %w", err)
+    }
+
+    // Refuse to decode records with structs that no longer match the object
+    if err := layout.ValidateAll(spec.Types, layoutChecks...); err != nil {
+        if !errors.Is(err, layout.ErrNoBTF) {
+            return fmt.Errorf("memory_tracker.o does not match agent structs (rebuild both): %w", err)
+        }
+        log.Printf("Warning: cannot validate struct layouts: %v", err)
     }
     mt.spec = spec
 
-    coll, err := ebpf.NewCollection(spec)
+    // Size maps and ring buffers before they are created
+    if err := mt.limits.ApplySpec(spec); err != nil {
+        return fmt.Errorf("invalid map limits: %w", err)
+    }
+
+    // Drop fentry variants on kernels without BPF trampolines
+    attach.Prepare(spec, mt.attachMode, kernelFuncs)
+    attach.Prepare(spec, mt.attachMode, faultFuncs)
+
+    // Relocate against this kernel's BTF, dropping hooks it cannot run
+    kernel, err := core.Detect(mt.kernelBTF)
     if err != nil {
-        return fmt.Errorf("failed to create eBPF collection: %v", err)
+        return err
+    }
+    if err := kernel.Err(); err != nil {
+        return err
+    }
+    dropped, err := kernel.Prepare(spec, requiredPrograms...)
+    for _, d := range dropped {
+        log.Printf("Warning: dropped program %s", d)
+    }
+    if err != nil {
+        return fmt.Errorf("memory_tracker.o cannot run on %s: %w", kernel, err)
+    }
+    log.Printf("Kernel: %s", kernel)
+
+    coll, err := ebpf.NewCollectionWithOptions(spec, kernel.Options())
+    if err != nil {
+        return fmt.Errorf("failed to create eBPF collection: %w", err)
     }
     mt.coll = coll
+    mt.stacks = newStackNames(coll.Maps["stack_traces"], mt.symbols)
+
+    // Scope the shared libc uprobes before they attach
+    mt.pidFilter, err = attach.NewPIDFilter(coll)
+    if err != nil {
+        return fmt.Errorf("failed to set up PID filter: %w", err)
+    }
+    if len(mt.pids) > 0 {
+        if err := mt.pidFilter.Add(mt.pids...); err != nil {
+            return err
+        }
+        log.Printf("Tracing allocations of PIDs %v", mt.pids)
+    }
 
-    // Create event reader
-    reader, err := ringbuf.NewReader(coll.Maps["events"])
+    // Scope every probe to the processes of the targeting file
+    mt.targets, err = target.NewFilter(coll, mt.targetConfig)
     if err != nil {
-        return fmt.Errorf("failed to create ring buffer reader: %v", err)
+        return fmt.Errorf("failed to set up targeting: %w", err)
+    }
+    if mt.targets != nil {
+        // Processes the agent reads from /proc are scoped at once
+        mt.procs.OnAdd = mt.targets.Add
+        log.Printf("Targets: %s", mt.targets)
+    }
+
+    // Spare the ring buffer allocations userspace does not need
+    if err := mt.configureSampling(); err != nil {
+        return fmt.Errorf("failed to configure sampling: %w", err)
+    }
+    if !mt.sampling.all() {
+        log.Printf("Sending %s to userspace", mt.sampling)
     }
-    mt.eventReader = reader
 
     return nil
 }
 
 func (mt *MemoryTracker) Attach() error {
     // Attach tracepoints
-    tracepoints := []struct {
-        group string
-        name  string
-        prog  string
-    }{
-        {"syscalls", "sys_enter_mmap", "trace_mmap_enter"},
-        {"syscalls", "sys_exit_mmap", "trace_mmap_exit"},
-        {"syscalls", "sys_enter_munmap", "trace_munmap"},
-        {"syscalls", "sys_enter_brk", "trace_brk"},
-        {"exceptions", "page_fault_user", "trace_page_fault"},
-        {"vmscan", "mm_vmscan_wakeup_kswapd", "trace_memory_pressure"},
-        {"oom", "mark_victim", "trace_oom_victim"},
-    }
-    
     for _, tp := range tracepoints {
         l, err := link.Tracepoint(link.TracepointOptions{
             Group:   tp.group,
@@ -175,95 +608,168 @@ func (mt *MemoryTracker) Attach() error {
         mt.links = append(mt.links, l)
     }
 
-    // Attach kprobes for kernel allocation tracking
-    kprobes := []struct {
-        symbol string
-        prog   string
-    }{
-        {"__alloc_pages", "__alloc_pages"},
-        {"__free_pages", "__free_pages"},
+    // Account BPF run time so the attach mode overhead can be reported
+    if closer, err := attach.EnableRuntimeStats(); err != nil {
+        log.Printf("Warning: BPF runtime stats unavailable: %v", err)
+    } else {
+        mt.bpfStats = closer
     }
-    
-    for _, kp := range kprobes {
-        l, err := link.Kprobe(link.KprobeOptions{
-            Symbol:  kp.symbol,
-            Program: mt.coll.Programs[kp.prog],
-        })
-        if err != nil {
-            log.Printf("Warning: failed to attach kprobe %s: %v", kp.symbol, err)
-            continue
+
+    // The profile decides which optional hooks start attached; the rest
+    // can be switched on through the control socket
+    if err := mt.hooks.Add(profile.HookPageFaults, mt.attachPageFaults,
+        mt.profile.Enabled(profile.HookPageFaults)); err != nil {
+        log.Printf("Warning: %v", err)
+    }
+
+    if err := mt.hooks.Add(profile.HookSwap, mt.attachSwap,
+        mt.profile.Enabled(profile.HookSwap)); err != nil {
+        log.Printf("Warning: %v", err)
+    }
+
+    if err := mt.hooks.Add(profile.HookKmem, mt.attachKmem,
+        mt.profile.Enabled(profile.HookKmem)); err != nil {
+        log.Printf("Warning: %v", err)
+    }
+
+    // Attach page allocator hooks via fentry where possible, kprobes otherwise
+    if err := mt.hooks.Add(profile.HookPageAlloc, mt.attachPageAlloc,
+        mt.profile.Enabled(profile.HookPageAlloc)); err != nil {
+        return fmt.Errorf("failed to attach kernel functions: %w", err)
+    }
+
+    // Trace only the target processes, if any, in whatever they allocate
+    // with
+    if len(mt.targetPIDs) > 0 {
+        for _, pid := range mt.targetPIDs {
+            if err := mt.attachTarget(pid); err != nil {
+                log.Printf("Warning: %v", err)
+            }
         }
-        mt.links = append(mt.links, l)
+        if len(mt.targetLinks) == 0 {
+            return fmt.Errorf("no target process could be traced")
+        }
+        log.Printf("Attached %d eBPF programs", len(mt.links)+mt.hooks.Links())
+        return nil
     }
 
-    // Try to attach uprobes for malloc/free tracking
-    // Note: This requires the binary path and may fail in some environments
-    mt.attachUprobes()
+    // Try to attach uprobes for allocator tracking: the first available
+    // libc, libstdc++ for C++ programs, and allocators detected later
+    if libc := firstPath(libcPaths); libc != "" {
+        mt.allocLibs = append(mt.allocLibs, allocLib{alloc: &glibc, path: libc})
+    }
+    if libstdcxx := firstPath(libstdcxxPaths); libstdcxx != "" {
+        mt.allocLibs = append(mt.allocLibs, allocLib{alloc: &cxxRuntime, path: libstdcxx})
+    }
+    if err := mt.hooks.Add(profile.HookUprobes, mt.attachUprobes,
+        mt.profile.Enabled(profile.HookUprobes)); err != nil {
+        log.Printf("Warning: %v", err)
+    }
 
-    log.Printf("Attached %d eBPF programs", len(mt.links))
+    log.Printf("Attached %d eBPF programs", len(mt.links)+mt.hooks.Links())
     return nil
 }
 
-func (mt *MemoryTracker) attachUprobes() {
-    // Common libc paths to try
-    libcPaths := []string{
-        "/lib/x86_64-linux-gnu/libc.so.6",
-        "/usr/lib/x86_64-linux-gnu/libc.so.6",
-        "/lib64/libc.so.6",
-        "/usr/lib64/libc.so.6",
+func (mt *MemoryTracker) attachPageAlloc() ([]link.Link, error) {
+    kernelLinks, report, err := attach.Kernel(mt.coll, mt.attachMode, kernelFuncs)
+    if err != nil {
+        return nil, err
     }
-    
-    functions := []string{"malloc", "free"}
-    
-    for _, libcPath := range libcPaths {
-        if _, err := os.Stat(libcPath); err != nil {
-            continue
-        }
-        
-        for _, funcName := range functions {
-            // Attach uprobe
-            l, err := link.Uprobe(link.UprobeOptions{
-                Path:    libcPath,
-                Symbol:  funcName,
-                Program: mt.coll.Programs["trace_"+funcName],
-            })
-            if err != nil {
-                log.Printf("Warning: failed to attach uprobe %s:%s: %v", libcPath, funcName, err)
-                continue
-            }
-            mt.links = append(mt.links, l)
-            
-            // Attach uretprobe for malloc
-            if funcName == "malloc" {
-                l, err := link.Uprobe(link.UprobeOptions{
-                    Path:       libcPath,
-                    Symbol:     funcName,
-                    Program:    mt.coll.Programs["trace_malloc_ret"],
-                    ReturnProbe: true,
-                })
-                if err != nil {
-                    log.Printf("Warning: failed to attach uretprobe %s:%s: %v", libcPath, funcName, err)
-                    continue
-                }
-                mt.links = append(mt.links, l)
-            }
+    for sym, ferr := range report.Failed {
+        log.Printf("Warning: failed to attach %s: %v", sym, ferr)
+    }
+    mt.attachReport = report
+    log.Printf("Kernel hooks: %s", report)
+    return kernelLinks, nil
+}
+
+func (mt *MemoryTracker) attachUprobes() ([]link.Link, error) {
+    mt.allocMu.Lock()
+    libs := append([]allocLib(nil), mt.allocLibs...)
+    mt.allocMu.Unlock()
+    var links []link.Link
+    for _, lib := range libs {
+        links = append(links, mt.attachAllocator(lib.alloc, lib.path)...)
+    }
+    return links, nil
+}
+
+// firstPath returns the first of paths that exists, or ""
+func firstPath(paths []string) string {
+    for _, path := range paths {
+        if _, err := os.Stat(path); err == nil {
+            return path
         }
-        break // Use first available libc
     }
+    return ""
 }
 
-func (mt *MemoryTracker) processEvent(record ringbuf.Record) error {
-    if len(record.RawSample) < int(unsafe.Sizeof(MemoryEvent{})) {
-        return fmt.Errorf("invalid sample size")
+// Events returns the ring buffer the allocation events and process exits
+// arrive on
+func (mt *MemoryTracker) Events() *ebpf.Map {
+    if mt.coll == nil {
+        return nil
+    }
+    return mt.coll.Maps["events"]
+}
+
+// processExitSize tells process exits apart from events in the ring buffer
+var processExitSize = int(unsafe.Sizeof(ProcessExit{}))
+
+// eventTypeOffset locates the type in memory_event records, for Priority
+var eventTypeOffset = int(unsafe.Offsetof(MemoryEvent{}.Type))
+
+// Priority ranks records for the event queue: process exits, OOM kills
+// and W+X mappings are never shed, single allocations and frees first
+func (mt *MemoryTracker) Priority(record []byte) probe.Priority {
+    switch len(record) {
+    case processExitSize, regionEventSize:
+        return probe.PriorityCritical
+    case faultEventSize:
+        return probe.PriorityNormal
+    }
+    if len(record) >= eventTypeOffset+4 && decode.ByteOrder.Uint32(record[eventTypeOffset:]) == AllocOOM {
+        return probe.PriorityCritical
+    }
+    return probe.PriorityBulk
+}
+
+// Lock locks the tracker's state; the Runner holds it over Handle, Stats
+// and RecordHistory, and query.Snapshot while it reads the samples
+func (mt *MemoryTracker) Lock() { mt.mu.Lock() }
+
+// Unlock unlocks the tracker's state
+func (mt *MemoryTracker) Unlock() { mt.mu.Unlock() }
+
+// Handle processes one event or process exit from the ring buffer
+func (mt *MemoryTracker) Handle(record []byte) error {
+    if len(record) == processExitSize {
+        var exit ProcessExit
+        if err := decode.Record(record, &exit); err != nil {
+            return fmt.Errorf("failed to parse process exit: %v", err)
+        }
+        mt.handleExit(&exit)
+        return nil
+    }
+    if len(record) == faultEventSize {
+        return mt.handleFault(record)
+    }
+    if len(record) == regionEventSize {
+        return mt.handleRegion(record)
     }
 
     var event MemoryEvent
-    err := binary.Read(bytes.NewReader(record.RawSample), binary.LittleEndian, &event)
-    if err != nil {
+    if err := decode.Record(record, &event); err != nil {
         return fmt.Errorf("failed to parse event: %v", err)
     }
 
     mt.totalEvents++
+    mt.recordCapture(&event)
+    // OOM victims come without a start time
+    id := ProcKey{PID: event.PID, StartTime: event.StartTime}
+    if event.StartTime != 0 {
+        mt.observe(id)
+    }
     
     // Convert C string to Go string
     comm := make([]byte, 0, 16)
@@ -276,284 +782,932 @@ func (mt *MemoryTracker) processEvent(record ringbuf.Record) error {
     
     // Update statistics based on event type
     switch event.Type {
-    case AllocMalloc, AllocMmap, AllocBrk, AllocPage:
+    case AllocMalloc, AllocCalloc, AllocRealloc, AllocMemalign, AllocNew, AllocMmap, AllocBrk, AllocPage:
         mt.allocationEvents++
-        mt.trackAllocation(event.PID, event.Addr, event.Size)
-    case AllocFree, AllocMunmap:
+        mt.observeAllocSize(&event, string(comm))
+        // realloc retires the allocation it replaces, maybe at the same
+        // address, before its new size is tracked
+        if event.OldAddr != 0 {
+            mt.observeHeapFree(id, event.Type, mt.trackDeallocation(id, event.OldAddr, event.OldSize))
+        }
+        mt.trackAllocation(&event)
+        mt.observeThread(&event, string(comm))
+        mt.observeHeap(id, &event)
+    case AllocFree, AllocDelete, AllocMunmap:
         mt.freeEvents++
-        mt.trackDeallocation(event.PID, event.Addr, event.Size)
+        mt.observeHeapFree(id, event.Type, mt.trackDeallocation(id, event.Addr, event.Size))
+        mt.observeThread(&event, string(comm))
     case AllocOOM:
         mt.oomEvents++
         log.Printf("OOM event detected for PID %d (%s)", event.PID, string(comm))
     }
     
-    // Print interesting events
-    if event.Size > 1024*1024 || event.Type == AllocOOM { // Large allocations or OOM
-        typeName, ok := allocTypeNames[event.Type]
-        if !ok {
-            typeName = fmt.Sprintf("unknown(%d)", event.Type)
+    typeName, ok := allocTypeNames[event.Type]
+    if !ok {
+        typeName = fmt.Sprintf("unknown(%d)", event.Type)
+    }
+    labels := query.Labels{
+        "pid":  strconv.Itoa(int(event.PID)),
+        "comm": string(comm),
+        "type": typeName,
+        "size": strconv.FormatUint(event.Size, 10),
+    }
+    mt.procs.AddPIDLabels(labels, event.PID)
+    if heapAllocation(event.Type) || event.Type == AllocFree || event.Type == AllocDelete {
+        if name, ok := mt.allocs[id]; ok {
+            labels["allocator"] = name
+        }
+    }
+    text := fmt.Sprintf("%s pid=%d comm=%s addr=0x%x size=%d",
+        typeName, event.PID, string(comm), event.Addr, event.Size)
+
+    // Large allocations take the actions of the thresholds they pass;
+    // OOMs carry their stack, root first
+    actions, threshold := mt.large.match(event.Size)
+    interesting := actions&actionEvent != 0 || event.Type == AllocOOM
+    allocation := event.Type != AllocOOM && event.Type != AllocFree && event.Type != AllocDelete && event.Type != AllocMunmap
+    var frames []string
+    if actions&actionStack != 0 || event.Type == AllocOOM {
+        frames = mt.stacks.frames(eventStack(&event))
+        if len(frames) > 0 {
+            labels["stack"] = folded(frames)
         }
-        
+    }
+    switch {
+    case event.Type == AllocOOM && mt.oomReportDir != "":
+        if path, err := mt.writeOOMReport(event.PID, string(comm), frames); err != nil {
+            log.Printf("Warning: failed to write OOM report: %v", err)
+        } else {
+            log.Printf("OOM report for PID %d written to %s", event.PID, path)
+            labels["report"] = path
+        }
+    case interesting && allocation:
+        mt.noteLargeAlloc(largeAlloc{at: time.Now(), pid: event.PID, comm: string(comm), kind: typeName, size: event.Size, frames: frames})
+    }
+    mt.control.Publish(control.Event{Labels: labels, Text: text})
+    mt.router.RouteAt(event.Timestamp, labels, text)
+    mt.output.EventAt(event.Timestamp, labels, text)
+    if allocation {
+        mt.reactLargeAlloc(&event, string(comm), typeName, actions, threshold)
+    }
+    
+    // Print interesting events
+    if mt.output.JSON() {
+        return nil
+    }
+    if interesting {
         fmt.Printf("Memory Event: PID=%d, Type=%s, Addr=0x%x, Size=%d, Comm=%s\n",
             event.PID, typeName, event.Addr, event.Size, string(comm))
+        printFrames(frames, 8)
     }
 
     return nil
 }
 
-func (mt *MemoryTracker) trackAllocation(pid uint32, addr, size uint64) {
+// observeAllocSize records an allocation in the size histogram of its
+// type, with the allocating process and address as exemplar
+func (mt *MemoryTracker) observeAllocSize(event *MemoryEvent, comm string) {
+    h, ok := mt.allocSizes[event.Type]
+    if !ok {
+        h = mt.histograms.New("memory_allocation_size_bytes", allocSizeBuckets)
+        mt.allocSizes[event.Type] = h
+    }
+    h.ObserveWithExemplar(float64(event.Size), query.Labels{
+        "pid":  strconv.Itoa(int(event.PID)),
+        "comm": comm,
+        "addr": fmt.Sprintf("0x%x", event.Addr),
+    })
+}
+
+func (mt *MemoryTracker) trackAllocation(event *MemoryEvent) {
+    id := ProcKey{PID: event.PID, StartTime: event.StartTime}
+    addr, size := event.Addr, event.Size
     if addr == 0 {
         return
     }
     
-    // Track potential leaks
-    mt.leaks[addr] = &AllocationInfo{
-        Size:      size,
-        Timestamp: time.Now().UnixNano(),
-        PID:       pid,
+    // Track potential leaks, with the stacks they are reported with
+    if mt.budget.Allow() {
+        mt.leaks.Add(addr, &AllocationInfo{
+            Size:          size,
+            Timestamp:     time.Now().UnixNano(),
+            StackID:       event.StackID,
+            KernelStackID: event.KernelStackID,
+            PID:           id.PID,
+            TID:           event.TID,
+            StartTime:     id.StartTime,
+        })
     }
     
-    // Update process statistics
-    if _, exists := mt.processStats[pid]; !exists {
-        mt.processStats[pid] = &ProcessMemory{}
+    // Update process statistics, weighting processes by bytes allocated
+    // so short-lived ones make way for the heaviest allocators; when not
+    // every allocation is sent they are read from BPF instead
+    if !mt.sampling.all() {
+        return
+    }
+    if _, exists := mt.processStats.Get(id); !exists {
+        if !mt.budget.Allow() {
+            return
+        }
     }
     
-    stats := mt.processStats[pid]
+    stats := mt.processStats.Add(id, size)
     stats.TotalAllocated += size
     stats.AllocationCount++
     stats.CurrentUsage += size
+    mt.currentUsage += size
     
     if stats.CurrentUsage > stats.PeakUsage {
         stats.PeakUsage = stats.CurrentUsage
     }
 }
 
-func (mt *MemoryTracker) trackDeallocation(pid uint32, addr, size uint64) {
+// trackDeallocation retires the allocation at addr, returning its size
+func (mt *MemoryTracker) trackDeallocation(id ProcKey, addr, size uint64) uint64 {
     if addr == 0 {
-        return
+        return 0
     }
     
-    // Remove from leak tracking
-    if _, exists := mt.leaks[addr]; exists {
-        delete(mt.leaks, addr)
+    // free() is only passed the address: BPF sends the size it recorded
+    // at malloc time, and where it had none, e.g. with allocation_map
+    // full, the size recorded here stands in
+    if info, exists := mt.leaks.Get(id, addr); exists {
+        if size == 0 {
+            size = info.Size
+        }
+        mt.releaseThread(info)
+        mt.leaks.Remove(id, addr)
     }
     
     // Update process statistics
-    if stats, exists := mt.processStats[pid]; exists {
+    if !mt.sampling.all() {
+        return size
+    }
+    if stats, exists := mt.processStats.Get(id); exists {
         stats.TotalFreed += size
         stats.FreeCount++
         if stats.CurrentUsage >= size {
             stats.CurrentUsage -= size
+            mt.currentUsage -= size
         }
     }
+    return size
 }
 
-func (mt *MemoryTracker) Run(ctx context.Context) error {
-    fmt.Println("Starting memory tracker...")
+// RecordHistory samples the tracker's counters into the local history;
+// the Runner calls it every second under the tracker's lock, so it reads
+// running totals rather than walking the processes and leaks
+func (mt *MemoryTracker) RecordHistory(now time.Time) {
 
-    for {
-        select {
-        case <-ctx.Done():
-            return ctx.Err()
-        default:
-            record, err := mt.eventReader.Read()
-            if err != nil {
-                if err == ringbuf.ErrClosed {
-                    return nil
-                }
-                log.Printf("Error reading from ring buffer: %v", err)
-                continue
-            }
+    mt.history.Add("memory.events", now, float64(mt.totalEvents))
+    mt.history.Add("memory.allocations", now, float64(mt.allocationEvents))
+    mt.history.Add("memory.frees", now, float64(mt.freeEvents))
+    mt.history.Add("memory.oom_events", now, float64(mt.oomEvents))
+    mt.history.Add("memory.current_bytes", now, float64(mt.currentUsage))
+    mt.history.Add("memory.leaked_bytes", now, float64(mt.leaks.Total()))
+    mt.history.Add("memory.tracked_processes", now, float64(mt.processStats.Len()))
+    if mt.heaps != nil {
+        if live, footprint := mt.heapTotals(); footprint > 0 {
+            mt.history.Add("memory.heap_live_bytes", now, float64(live))
+            mt.history.Add("memory.heap_footprint_bytes", now, float64(footprint))
+        }
+    }
+    mt.samplePressure(now)
+}
 
-            if err := mt.processEvent(record); err != nil {
-                log.Printf("Error processing event: %v", err)
-            }
+// Mount serves the tracker's local history to Grafana beside the query API
+func (mt *MemoryTracker) Mount(mux *http.ServeMux) {
+    mt.history.Mount(mux)
+}
+
+// Samples exposes the tracker's current state to the local query API
+func (mt *MemoryTracker) Samples() []query.Sample {
+    samples := []query.Sample{
+        {Name: "memory_events_total", Value: float64(mt.totalEvents)},
+        {Name: "memory_oom_events_total", Value: float64(mt.oomEvents)},
+        {Name: "memory_process_exits_total", Value: float64(mt.exits)},
+    }
+    // Leaks are of the allocations sent
+    leaks := sampling.CountEstimate(sampling.Counter{Count: uint64(mt.leaks.Len())}, mt.sampling.Rate)
+    samples = append(samples, sampling.Samples("memory_potential_leaks", nil, leaks)...)
+    samples = append(samples,
+        query.Sample{Name: "memory_leaks_evicted_total", Value: float64(mt.leaks.Evicted())},
+        query.Sample{Name: "memory_leaks_evicted_bytes_total", Value: float64(mt.leaks.EvictedBytes())},
+    )
+    samples = append(samples, mt.leakGroupSamples()...)
+    samples = append(samples, mapSamples(mt.coll)...)
+    samples = append(samples, mt.router.Samples()...)
+    samples = append(samples, mt.queue.Samples()...)
+    samples = append(samples, mt.drops.Samples()...)
+    samples = append(samples, mt.growthRateSamples()...)
+    samples = append(samples, mt.kmemSamples()...)
+    samples = append(samples, mt.faultSamples()...)
+    samples = append(samples, mt.pressureSamples()...)
+    samples = append(samples, mt.cgroupSamples()...)
+    samples = append(samples, mt.regionSamples()...)
+    samples = append(samples, mt.exitSamples()...)
+    samples = append(samples, mt.threadSamples()...)
+    samples = append(samples, mt.heapSamples()...)
+    samples = append(samples, mt.numaSamples()...)
+    for _, h := range mt.Histograms() {
+        samples = append(samples, h.Samples()...)
+    }
+    samples = append(samples, query.Sample{Name: "memory_tracked_processes_evicted_total", Value: float64(mt.processStats.Evicted())})
+    mt.processStats.Each(func(id ProcKey, stats *ProcessMemory) bool {
+        labels := query.Labels{
+            "pid":  strconv.FormatUint(uint64(id.PID), 10),
+            "comm": mt.procs.Name(id.PID),
+        }
+        mt.procs.AddPIDLabels(labels, id.PID)
+        samples = append(samples,
+            query.Sample{Name: "process_memory_current", Labels: labels, Value: float64(stats.CurrentUsage)},
+            query.Sample{Name: "process_memory_peak", Labels: labels, Value: float64(stats.PeakUsage)},
+            query.Sample{Name: "process_memory_allocated_total", Labels: labels, Value: float64(stats.TotalAllocated)},
+            query.Sample{Name: "process_memory_freed_total", Labels: labels, Value: float64(stats.TotalFreed)},
+            query.Sample{Name: "process_memory_allocations_total", Labels: labels, Value: float64(stats.AllocationCount)},
+        )
+        if u, ok := mt.usage[id]; ok {
+            samples = append(samples,
+                query.Sample{Name: "process_memory_rss_bytes", Labels: labels, Value: float64(u.RSS)},
+                query.Sample{Name: "process_memory_pss_bytes", Labels: labels, Value: float64(u.PSS)},
+                query.Sample{Name: "process_memory_swap_bytes", Labels: labels, Value: float64(u.Swap)},
+                query.Sample{Name: "process_memory_vsz_bytes", Labels: labels, Value: float64(u.VSZ)},
+            )
+        }
+        return true
+    })
+    return samples
+}
+
+// Histograms exposes the tracker's distributions to /metrics
+func (mt *MemoryTracker) Histograms() []query.HistogramSample {
+    types := make([]uint32, 0, len(mt.allocSizes))
+    for t := range mt.allocSizes {
+        types = append(types, t)
+    }
+    sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+    hists := make([]query.HistogramSample, 0, len(types))
+    for _, t := range types {
+        hists = append(hists, mt.allocSizes[t].Snapshot(query.Labels{"type": allocTypeNames[t]}))
+    }
+    regions := make([]uint32, 0, len(mt.faultLatency))
+    for r := range mt.faultLatency {
+        regions = append(regions, r)
+    }
+    sort.Slice(regions, func(i, j int) bool { return regions[i] < regions[j] })
+    for _, r := range regions {
+        hists = append(hists, mt.faultLatency[r].Snapshot(query.Labels{"region": regionName(r)}))
+    }
+    return hists
+}
+
+// mapSamples exposes map fill levels to the local query API
+func mapSamples(coll *ebpf.Collection) []query.Sample {
+    var samples []query.Sample
+    for _, u := range maps.Measure(coll) {
+        labels := query.Labels{"map": u.Name}
+        samples = append(samples,
+            query.Sample{Name: "bpf_map_entries", Labels: labels, Value: float64(u.Entries)},
+            query.Sample{Name: "bpf_map_max_entries", Labels: labels, Value: float64(u.MaxEntries)},
+        )
+    }
+    return samples
+}
+
+// Stats prints the statistics, or writes them as a JSON snapshot, and
+// fires growth alerts
+func (mt *MemoryTracker) Stats(ctx context.Context) {
+    if !mt.sampling.all() {
+        if err := mt.syncProcessStats(); err != nil {
+            log.Printf("Warning: failed to read process totals: %v", err)
+        }
+    }
+    mt.sampleUsage()
+    mt.sampleHeaps()
+    mt.sampleThreads()
+    if err := mt.sampleCgroups(ctx); err != nil {
+        log.Printf("Warning: failed to read cgroup usage: %v", err)
+    }
+    mt.pruneExited(time.Now())
+    mt.sampleLeakGroups(time.Now())
+    mt.checkDrops(time.Now())
+    if mt.output.JSON() {
+        mt.output.Stats(mt.Samples())
+    } else {
+        mt.PrintStats()
+    }
+    mt.CheckGrowth(ctx)
+    mt.checkGrowthRate(ctx)
+    mt.sweepExited()
+    mt.pruneStacks()
+    if mt.leakSpill != nil {
+        if err := mt.leakSpill.Flush(); err != nil {
+            log.Printf("Warning: failed to spill evicted leaks: %v", err)
         }
     }
 }
 
+// Stalled raises the watchdog's stalls as probe_stall alerts
+func (mt *MemoryTracker) Stalled(s probe.Stall) {
+    labels, text := s.Labels(), s.String()
+    mt.control.Publish(control.Event{Labels: labels, Text: text})
+    mt.router.Route(labels, text)
+    mt.output.Event(labels, text)
+    reaction.Notify(mt.ctx, mt.notifier, reaction.Alert{Name: "probe_stall", Severity: "critical", Message: text, FiredAt: time.Now()})
+}
+
 func (mt *MemoryTracker) PrintStats() {
     fmt.Printf("\n=== Memory Tracker Statistics ===\n")
     fmt.Printf("Runtime: %v\n", time.Since(mt.startTime))
     fmt.Printf("Total events: %d\n", mt.totalEvents)
     fmt.Printf("Allocation events: %d\n", mt.allocationEvents)
     fmt.Printf("Free events: %d\n", mt.freeEvents)
-    fmt.Printf("Page fault events: %d\n", mt.pageEvents)
+    fmt.Printf("Major page fault events: %d\n", mt.pageEvents)
+    fmt.Printf("W+X mapping events: %d\n", mt.wxEvents)
     fmt.Printf("OOM events: %d\n", mt.oomEvents)
-    fmt.Printf("Tracked processes: %d\n", len(mt.processStats))
-    fmt.Printf("Potential leaks: %d\n", len(mt.leaks))
+    if mt.queue != nil {
+        fmt.Printf("Event queue: %s\n", mt.queue)
+    }
+    fmt.Printf("Ring buffer: %s\n", mt.drops)
+    fmt.Printf("Tracked processes: %d (top %d)\n", mt.processStats.Len(), mt.processStats.Capacity())
+    if evicted := mt.processStats.Evicted(); evicted > 0 {
+        fmt.Printf("Processes evicted for heavier allocators: %d\n", evicted)
+    }
+    fmt.Printf("Potential leaks: %d (max %d)\n", mt.leaks.Len(), mt.leaks.max)
+    if evicted := mt.leaks.Evicted(); evicted > 0 {
+        fmt.Printf("Leak candidates evicted (%s first): %d, %s\n", mt.leaks.eviction, evicted, units.Bytes(mt.leaks.EvictedBytes()))
+    }
+    if !mt.sampling.all() {
+        fmt.Printf("Allocations sent: %s\n", mt.sampling)
+    }
+    fmt.Printf("Processes exited: %d\n", mt.exits)
+    if dropped := mt.budget.Dropped(); dropped > 0 {
+        fmt.Printf("Entries dropped over memory budget: %d\n", dropped)
+    }
+    fmt.Printf("History: %d points in %d series\n", mt.history.Len(), len(mt.history.Series()))
+    if mt.reactor != nil {
+        fmt.Printf("Escalation reports: %d\n", len(mt.reactor.Reports()))
+    }
+    fmt.Printf("Attach mode: %s\n", mt.attachReport.Resolved)
+    for name, o := range attach.MeasureOverhead(mt.coll, mt.attachReport.ProgramNames(kernelFuncs)...) {
+        fmt.Printf("  %s: %d runs, %v/run\n", name, o.Runs, o.PerRun())
+    }
 
     // Top memory consumers
     fmt.Printf("\nTop 10 memory consumers:\n")
-    type processInfo struct {
-        pid     uint32
-        current uint64
-        peak    uint64
-        allocs  uint64
+    for _, p := range mt.topConsumers(10) {
+        fmt.Printf("  PID %d (%s): Current=%s, Peak=%s, Allocs=%d, RSS=%s, PSS=%s, Swap=%s, VSZ=%s\n", 
+            p.pid, mt.procs.Name(p.pid), units.Bytes(p.current), units.Bytes(p.peak), p.allocs,
+            units.Bytes(p.usage.RSS), units.Bytes(p.usage.PSS), units.Bytes(p.usage.Swap), units.Bytes(p.usage.VSZ))
+    }
+    
+    // Memory leaks
+    if mt.leaks.Len() > 0 {
+        fmt.Printf("\nPotential memory leaks (top 10):\n")
+        for _, l := range mt.topLeaks(10, 0) {
+            fmt.Printf("  Addr=0x%x, Size=%s, Age=%v, PID=%d\n",
+                l.addr, units.Bytes(l.size), l.age.Truncate(time.Second), l.pid)
+            printFrames(mt.stacks.frames(l.stack), 8)
+        }
     }
+    mt.printLeakGroups()
     
+    mt.printCgroups()
+    mt.printFaults()
+    mt.printPressure()
+    mt.printRegions()
+    mt.printThreads()
+    mt.printHeaps()
+    mt.printExited()
+    mt.printNUMA()
+    mt.printKernelMemory()
+
+    // Read current memory statistics from maps
+    mt.readMemoryMaps()
+    mt.printMapUtilization()
+}
+
+type processInfo struct {
+    pid     uint32
+    current uint64
+    peak    uint64
+    allocs  uint64
+    usage   procfs.Usage
+}
+
+// topConsumers returns the n processes using the most memory
+func (mt *MemoryTracker) topConsumers(n int) []processInfo {
     var processes []processInfo
-    for pid, stats := range mt.processStats {
+    mt.processStats.Each(func(id ProcKey, stats *ProcessMemory) bool {
         processes = append(processes, processInfo{
-            pid:     pid,
+            pid:     id.PID,
             current: stats.CurrentUsage,
             peak:    stats.PeakUsage,
             allocs:  stats.AllocationCount,
+            usage:   mt.usage[id],
         })
-    }
+        return true
+    })
     
     sort.Slice(processes, func(i, j int) bool {
         return processes[i].current > processes[j].current
     })
-    
-    count := len(processes)
-    if count > 10 {
-        count = 10
+    if len(processes) > n {
+        processes = processes[:n]
     }
-    
-    for i := 0; i < count; i++ {
-        p := processes[i]
-        fmt.Printf("  PID %d: Current=%s, Peak=%s, Allocs=%d\n", 
-            p.pid, formatBytes(p.current), formatBytes(p.peak), p.allocs)
-    }
-    
-    // Memory leaks
-    if len(mt.leaks) > 0 {
-        fmt.Printf("\nPotential memory leaks (top 10):\n")
-        type leakInfo struct {
-            addr uint64
-            size uint64
-            age  time.Duration
-            pid  uint32
-        }
-        
-        var leaks []leakInfo
-        now := time.Now().UnixNano()
-        for addr, info := range mt.leaks {
-            leaks = append(leaks, leakInfo{
-                addr: addr,
-                size: info.Size,
-                age:  time.Duration(now - info.Timestamp),
-                pid:  info.PID,
-            })
+    return processes
+}
+
+type leakInfo struct {
+    addr  uint64
+    size  uint64
+    age   time.Duration
+    pid   uint32
+    stack stackRef
+}
+
+// topLeaks returns the n largest potential leaks, of pid or, if 0, of
+// every process
+func (mt *MemoryTracker) topLeaks(n int, pid uint32) []leakInfo {
+    var leaks []leakInfo
+    now := time.Now().UnixNano()
+    mt.leaks.Each(func(addr uint64, info *AllocationInfo) bool {
+        if pid != 0 && info.PID != pid {
+            return true
         }
-        
-        sort.Slice(leaks, func(i, j int) bool {
-            return leaks[i].size > leaks[j].size
+        leaks = append(leaks, leakInfo{
+            addr: addr,
+            size: info.Size,
+            age:  time.Duration(now - info.Timestamp),
+            pid:  info.PID,
+            stack: stackRef{
+                pid:    info.PID,
+                user:   int64(info.StackID),
+                kernel: int64(info.KernelStackID),
+            },
         })
-        
-        leakCount := len(leaks)
-        if leakCount > 10 {
-            leakCount = 10
-        }
-        
-        for i := 0; i < leakCount; i++ {
-            l := leaks[i]
-            fmt.Printf("  Addr=0x%x, Size=%s, Age=%v, PID=%d\n",
-                l.addr, formatBytes(l.size), l.age.Truncate(time.Second), l.pid)
+        return true
+    })
+    
+    sort.Slice(leaks, func(i, j int) bool {
+        return leaks[i].size > leaks[j].size
+    })
+    if len(leaks) > n {
+        leaks = leaks[:n]
+    }
+    return leaks
+}
+
+// printMapUtilization reports map fill levels and warns before maps fill up
+func (mt *MemoryTracker) printMapUtilization() {
+    fmt.Printf("\nMap utilization:\n")
+    for _, u := range maps.Measure(mt.coll) {
+        fmt.Printf("  %s\n", u)
+        if rec := u.Recommendation(maps.DefaultWarnPercent); rec != "" {
+            log.Printf("Warning: %s", rec)
         }
     }
-    
-    // Read current memory statistics from maps
-    mt.readMemoryMaps()
 }
 
 func (mt *MemoryTracker) readMemoryMaps() {
     processMap := mt.coll.Maps["process_memory_map"]
     
     fmt.Printf("\nProcess Memory Map (from eBPF):\n")
-    var key uint32
+    var key ProcKey
     var stats ProcessMemory
     iter := processMap.Iterate()
     
     count := 0
     for iter.Next(&key, &stats) && count < 5 {
         fmt.Printf("  PID %d: Alloc=%s, Free=%s, Current=%s, Peak=%s\n",
-            key, 
-            formatBytes(stats.TotalAllocated),
-            formatBytes(stats.TotalFreed),
-            formatBytes(stats.CurrentUsage),
-            formatBytes(stats.PeakUsage))
+            key.PID, 
+            units.Bytes(stats.TotalAllocated),
+            units.Bytes(stats.TotalFreed),
+            units.Bytes(stats.CurrentUsage),
+            units.Bytes(stats.PeakUsage))
         count++
     }
 }
 
-func formatBytes(bytes uint64) string {
-    const unit = 1024
-    if bytes < unit {
-        return fmt.Sprintf("%dB", bytes)
-    }
-    div, exp := int64(unit), 0
-    for n := bytes / unit; n >= unit; n /= unit {
-        div *= unit
-        exp++
+// printFrames prints the first depth frames of a stack, leaf first
+func printFrames(frames []string, depth int) {
+    for i, frame := range frames {
+        if i == depth {
+            fmt.Printf("      ... %d more frames\n", len(frames)-depth)
+            break
+        }
+        fmt.Printf("      %s\n", frame)
     }
-    return fmt.Sprintf("%.1f%cB", float64(bytes)/float64(div), "KMGTPE"[exp])
 }
 
 func (mt *MemoryTracker) Close() error {
-    if mt.eventReader != nil {
-        mt.eventReader.Close()
-    }
-
     for _, l := range mt.links {
         l.Close()
     }
+    mt.hooks.Close()
+    for pid := range mt.targetLinks {
+        for _, l := range mt.targetLinks[pid] {
+            l.Close()
+        }
+    }
 
     if mt.coll != nil {
         mt.coll.Close()
     }
 
+    if mt.bpfStats != nil {
+        mt.bpfStats.Close()
+    }
+
+    mt.cancel()
+    if mt.reactor != nil {
+        mt.reactor.Wait()
+    }
+
+    // Deliver events still queued for routing
+    mt.router.Close()
+    mt.output.Close()
+    if mt.leakSpill != nil {
+        mt.leakSpill.Close()
+    }
+
     return nil
 }
 
 func main() {
-    tracker, err := NewMemoryTracker()
+    run := summary.Start("memory-tracker", flag.CommandLine)
+
+    // The configuration file and environment may select the profile, which
+    // supplies the defaults of every other flag
+    settings, err := config.Load(os.Args[1:], "memory")
     if err != nil {
-        log.Fatalf("Failed to create memory tracker: %v", err)
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
     }
-    defer tracker.Close()
+    // Deferred first, so it runs after every other deferred cleanup
+    defer settings.Restart()
+    prof, err := profile.Selected(settings.Args(os.Args[1:]))
+    if err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    flag.String("config", settings.Path(),
+        "YAML file of per-probe settings, overridden by $PROBEPILOT_* and flags (default $PROBEPILOT_CONFIG)")
+    settings.RegisterFleetFlags(flag.CommandLine)
+    flag.String("profile", prof.Name, profile.Usage())
+    attachMode := flag.String("attach-mode", string(prof.AttachMode),
+        "kernel hook mode for page allocator and page fault hooks: auto, fentry or kprobe")
+    retention := flag.String("retention", prof.Retention,
+        "local history resolutions as step:retention pairs")
+    reportInterval := flag.Duration("report-interval", prof.ReportInterval,
+        "how often to print statistics")
+    watchdog := probe.RegisterWatchdogFlag(flag.CommandLine)
+    eventQueue := probe.RegisterQueueFlag(flag.CommandLine)
+    adaptiveSampling := sampling.RegisterAdaptiveFlag(flag.CommandLine)
+    listen := flag.String("listen", "",
+        "address for the local query API: host:port, e.g. 127.0.0.1:9464, or unix:/path (disabled if empty)")
+    controlSocket := flag.String("control", "",
+        "UNIX socket for probepilot attach, e.g. /run/probepilot/memory.sock (disabled if empty)")
+    growthAlert := flag.Uint64("growth-alert", prof.GrowthAlert,
+        "bytes a process may grow between reports before alerting (0 disables)")
+    captureDuration := flag.Duration("capture-duration", prof.CaptureDuration,
+        "how long a growth alert captures allocation stacks of the process")
+    growthSlope := flag.Uint64("growth-slope", 1<<20,
+        "bytes a minute a process's heap may grow monotonically over -growth-window before alerting (0 disables)")
+    growthWindow := flag.Duration("growth-window", 15*time.Minute,
+        "sliding window heap growth and allocation rates are fitted over")
+    alertNotify := flag.String("alert-notify", "",
+        "who to tell of growth alerts: exec:<command>, given the alert as JSON on stdin, or an http(s) URL to POST it to (disabled if empty)")
+    rawSymbols := flag.Bool("raw-symbols", false,
+        "print mangled C++ and Rust symbol names in stacks as is")
+    routes := flag.String("routes", "",
+        "JSON file of per-probe event severity and routing rules (disabled if empty)")
+    otlpMetrics := flag.String("otlp-metrics", "",
+        "OpenTelemetry collector to push metrics to every report interval over OTLP/HTTP, e.g. http://otel-collector:4318 (disabled if empty)")
+    otlpLogs := flag.String("otlp-logs", "",
+        "OpenTelemetry collector to export the -otlp-log-events classes of events to as OTLP log records, e.g. http://otel-collector:4318 (disabled if empty)")
+    otlpLogEvents := flag.String("otlp-log-events", route.DefaultLogClasses,
+        "comma-separated classes of events for -otlp-logs: oom, security, connection_failure, self_health, process_exit, memory_pressure or all")
+    pidList := flag.String("pids", "",
+        "comma-separated PIDs to trace malloc/free for, filtered inside BPF (all processes if empty)")
+    targetPIDList := flag.String("target-pid", "",
+        "comma-separated running PIDs to attach allocation uprobes to, in their own libraries and executable, instead of system-wide libc")
+    targetCmd := flag.String("target-cmd", "",
+        "command name of running processes to attach allocation uprobes to, as -target-pid")
+    oomReports := flag.String("oom-reports", DefaultOOMReportDir,
+        "directory to write a report of the victim, top consumers, large allocations and leaks to on every OOM kill (disabled if empty)")
+    kernelBTF := flag.String("kernel-btf", "",
+        "BTF file of the running kernel, e.g. from BTFHub, for kernels without /sys/kernel/btf/vmlinux")
+    largeAllocs := flag.String("large-allocs", DefaultLargeAllocs,
+        "comma-separated <size>:<action>[+<action>...] thresholds, allocations larger than which take the actions: event (print it), stack (with its stack), alert (fire a large_allocation alert) or capture (capture the process's allocation stacks for -capture-duration, under deep-capture)")
+    samplingRate := flag.Uint("sampling-rate", 1,
+        "send 1 in N allocations, and their frees, to userspace; process totals stay exact and allocations past the smallest -large-allocs threshold are always sent")
+    flag.UintVar(samplingRate, "sample-rate", 1, "alias for -sampling-rate")
+    minSize := flag.String("min-size", "0",
+        "send no allocation smaller than this to userspace, e.g. 4K; process totals stay exact")
+    aggregateOnly := flag.Bool("aggregate-only", false,
+        "send no allocations to userspace, only count them per process in BPF; disables allocation events, leaks and large allocation actions")
+    maxLeaks := flag.Int("max-leaks", DefaultMaxLeaks,
+        "potential leaks to track at most, 0 for no bound")
+    leakEviction := flag.String("leak-eviction", string(evictSmallest),
+        "potential leak evicted past -max-leaks: smallest (the smallest allocation) or lru (the one tracked longest ago)")
+    leakSpill := flag.String("leak-spill", "",
+        "file to append evicted potential leaks to as JSON lines, with their stacks (disabled if empty)")
+    leakReport := flag.String("leak-report", "",
+        "JSON file rewritten every report with the potential leaks grouped by comm and stack, keyed by an ID stable across restarts (disabled if empty)")
+    sealSpec := flag.String("seal-key", "",
+        "encrypt OOM reports, -leak-report and -leak-spill at rest with AES-256-GCM under this key: env:VAR, file:PATH or exec:COMMAND printing it, e.g. from a KMS; read them with probepilot unseal (disabled if empty)")
+    numa := flag.Bool("numa", false,
+        "report the pages allocated on each NUMA node and the processes allocating off their CPU's node, under page-alloc")
+    exitRetention := flag.Duration("exit-retention", 0,
+        "how long to keep the lifetime summaries of exited processes for queries and reports, e.g. 30m (0 keeps none)")
+    perThread := flag.Bool("per-thread", false,
+        "count allocations per thread too, reporting the threads and thread pools (threads named alike) allocating the most; counted from the allocations sent to userspace")
+    fragmentation := flag.Bool("fragmentation", false,
+        "estimate the heap fragmentation of each process, its live heap bytes by size class against its heap footprint in /proc/<pid>/smaps, and its trend")
+    pressureThreshold := flag.Float64("pressure-threshold", 10,
+        "percentage of a second some task stalls on memory for, per /proc/pressure/memory, that opens a pressure incident naming the processes allocating and swapping meanwhile (0 for none)")
+    cgroupWarn := flag.Float64("cgroup-warn", 90,
+        "percentage of its memory.max a cgroup v2 uses that raises a cgroup_memory_limit warning naming the processes in it allocating the most (0 for none)")
+    dryRun := flag.Bool("dry-run", false,
+        "verify the eBPF programs and print the attach plan, filters and exports, then exit")
+    parseLimits := limits.RegisterFlags(flag.CommandLine)
+    parseSocket := control.RegisterFlags(flag.CommandLine)
+    parseHistograms := histogram.RegisterFlags(flag.CommandLine)
+    parseOutput := output.RegisterFlags(flag.CommandLine)
+    parseHook := route.RegisterHookFlags(flag.CommandLine)
+    parseFilter := route.RegisterFilterFlag(flag.CommandLine)
+    parseCoalesce := route.RegisterCoalesceFlags(flag.CommandLine)
+    parseTargets := target.RegisterFlags(flag.CommandLine)
+    procfs.RegisterFlags(flag.CommandLine)
+    if err := settings.Apply(flag.CommandLine); err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    flag.Parse()
 
-    if err := tracker.Load(); err != nil {
-        log.Fatalf("Failed to load eBPF program: %v", err)
+    mode, err := attach.ParseMode(*attachMode)
+    if err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
     }
+    resolutions, err := tsdb.ParseResolutions(*retention)
+    if err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    lim, err := parseLimits()
+    if err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    sockOpts, err := parseSocket()
+    if err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    histOpts, err := parseHistograms()
+    if err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    outOpts, err := parseOutput()
+    if err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    pids, err := attach.ParsePIDs(*pidList)
+    if err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    targetPIDs, err := attach.ParsePIDs(*targetPIDList)
+    if err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    if targetPIDs, err = findTargets(targetPIDs, *targetCmd); err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    sealKey, err := seal.Load(*sealSpec)
+    if err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    targetConfig, err := parseTargets()
+    if err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    logTap, err := route.OTLPLogs(*otlpLogs, *otlpLogEvents)
+    if err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    notifier, err := reaction.ParseNotifier(*alertNotify)
+    if err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    largeRules, err := parseLargeAllocs(*largeAllocs)
+    if err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    if largeRules.has(actionCapture) && !prof.Enabled(profile.HookDeepCapture) {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", fmt.Errorf("-large-allocs capture needs the %s hook set, e.g. -profile deep", profile.HookDeepCapture))
+    }
+    samplingConfig := Sampling{Rate: uint32(*samplingRate), AggregateOnly: *aggregateOnly}
+    if samplingConfig.MinSize, err = limits.ParseSize(*minSize); err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", fmt.Errorf("invalid -min-size: %v", err))
+    }
+    if err := samplingConfig.validate(); err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    eviction, err := parseLeakEviction(*leakEviction)
+    if err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    if *maxLeaks < 0 {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", fmt.Errorf("invalid -max-leaks %d (want >= 0)", *maxLeaks))
+    }
+    if *perThread && *aggregateOnly {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", errors.New("-per-thread needs allocations sent to userspace, not -aggregate-only"))
+    }
+    if *fragmentation && !samplingConfig.all() {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", errors.New("-fragmentation needs every allocation sent to userspace, not -sampling-rate, -min-size or -aggregate-only"))
+    }
+    if *adaptiveSampling < 0 {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", fmt.Errorf("invalid -adaptive-sampling %v (want >= 0)", *adaptiveSampling))
+    }
+    if *fragmentation && *adaptiveSampling > 0 {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", errors.New("-fragmentation needs every allocation sent to userspace, not -adaptive-sampling"))
+    }
+    if *pressureThreshold < 0 || *pressureThreshold > 100 {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", fmt.Errorf("invalid -pressure-threshold %v (want 0 to 100)", *pressureThreshold))
+    }
+    if *cgroupWarn < 0 || *cgroupWarn > 100 {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", fmt.Errorf("invalid -cgroup-warn %v (want 0 to 100)", *cgroupWarn))
+    }
+    if *numa && !prof.Enabled(profile.HookPageAlloc) {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", fmt.Errorf("-numa needs the %s hook set, e.g. -profile balanced", profile.HookPageAlloc))
+    }
+    if *growthWindow <= 0 {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", fmt.Errorf("invalid -growth-window %v (want > 0)", *growthWindow))
+    }
+    hookConfig, err := parseHook()
+    if err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    eventFilter, err := parseFilter()
+    if err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    coalesceConfig, err := parseCoalesce()
+    if err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    queue, err := probe.NewQueue(*eventQueue)
+    if err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+
+    // Review a configuration without loading or attaching anything
+    if *dryRun {
+        dryRunPlan(run, Config{Profile: prof, AttachMode: mode, Limits: lim, PIDs: pids, TargetPIDs: targetPIDs, OOMReportDir: *oomReports, KernelBTF: *kernelBTF, Targets: targetConfig, LargeAllocs: largeRules, NUMA: *numa, Sampling: samplingConfig, MaxLeaks: *maxLeaks, LeakEviction: eviction, LeakSpill: *leakSpill, LeakReport: *leakReport, Seal: sealKey, ExitRetention: *exitRetention, PerThread: *perThread, Fragmentation: *fragmentation, PressureThreshold: *pressureThreshold, CgroupWarn: *cgroupWarn, Queue: queue, AdaptiveSampling: *adaptiveSampling},
+            *growthAlert, *routes, *listen, *controlSocket, outOpts, *otlpMetrics, logTap, hookConfig, eventFilter, coalesceConfig)
+    }
+    router, err := route.Load(*routes, "memory-tracker", logTap)
+    if err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    hook, err := route.StartHook(hookConfig, "memory-tracker")
+    if err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    if err := router.Use(hook); err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    if err := router.Filter(eventFilter); err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    if err := router.Coalesce(coalesceConfig); err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    out, err := output.Open(outOpts, "memory-tracker")
+    if err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    metrics, err := otlp.NewMetricPusher(*otlpMetrics, nil, "memory-tracker", export.Options{})
+    if err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+
+    // Refuse to start where there is no eBPF backend
+    report, err := platform.Check()
+    if err != nil {
+        run.Fatal(summary.StageConfig, "Cannot run memory tracker: %v", err)
+    }
+    log.Printf("Platform: %s", report)
+    log.Printf("Profile: %s", prof)
+    log.Printf("Configuration: %s", settings)
 
-    if err := tracker.Attach(); err != nil {
-        log.Fatalf("Failed to attach eBPF programs: %v", err)
+    // Keep the tracker from competing with the workloads it observes
+    if err := lim.ApplyProcess(); err != nil {
+        log.Printf("Warning: failed to apply resource limits: %v", err)
+    }
+    log.Printf("Resource limits: %s", lim)
+
+    tracker, err := NewMemoryTracker(Config{
+        Profile:      prof,
+        AttachMode:   mode,
+        Retention:    resolutions,
+        Limits:       lim,
+        RawSymbols:   *rawSymbols,
+        Router:       router,
+        Output:       out,
+        Histograms:   histOpts,
+        PIDs:         pids,
+        TargetPIDs:   targetPIDs,
+        OOMReportDir: *oomReports,
+        KernelBTF:    *kernelBTF,
+        Targets:      targetConfig,
+        LargeAllocs:  largeRules,
+        NUMA:         *numa,
+        Sampling:     samplingConfig,
+        MaxLeaks:     *maxLeaks,
+        LeakEviction: eviction,
+        LeakSpill:    *leakSpill,
+        LeakReport:   *leakReport,
+        Seal:         sealKey,
+        ExitRetention: *exitRetention,
+        PerThread:    *perThread,
+        Fragmentation: *fragmentation,
+        PressureThreshold: *pressureThreshold,
+        CgroupWarn:   *cgroupWarn,
+        Queue:        queue,
+        AdaptiveSampling: *adaptiveSampling,
+    })
+    if err != nil {
+        run.Fatal(summary.StageLoad, "Failed to create memory tracker: %v", err)
+    }
+    defer tracker.Close()
+    run.SetSource(tracker)
+    if prof.Enabled(profile.HookDeepCapture) {
+        tracker.EnableGrowthCapture(*growthAlert, *captureDuration)
+    }
+    tracker.EnableGrowthRate(*growthSlope, *growthWindow, notifier)
+
+    runner := probe.Runner{ReportInterval: *reportInterval, Watchdog: *watchdog, Queue: queue}
+    if err := runner.Start(tracker); err != nil {
+        run.Fatal(probe.Stage(err), "Failed to start memory tracker: %v", err)
     }
 
     // Handle interrupts gracefully
-    ctx, cancel := context.WithCancel(context.Background())
-    sigChan := make(chan os.Signal, 1)
-    signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+    ctx, cancel := probe.SignalContext()
+    defer cancel()
 
-    go func() {
-        <-sigChan
-        log.Println("Received interrupt signal, shutting down...")
-        cancel()
-    }()
+    // Restart when the fleet configuration changes the agent's settings
+    go settings.Watch(ctx, cancel)
 
-    // Start stats printer goroutine
-    go func() {
-        ticker := time.NewTicker(15 * time.Second)
-        defer ticker.Stop()
-        
-        for {
-            select {
-            case <-ctx.Done():
-                return
-            case <-ticker.C:
-                tracker.PrintStats()
+    // Follow new cgroups and processes of the targeting file
+    go tracker.targets.Run(ctx)
+
+    // Serve /api/v1/query and /metrics over the tracker's live state
+    if *listen != "" {
+        l, err := control.Listen(*listen, sockOpts)
+        if err != nil {
+            run.Fatal(summary.StageConfig, "Failed to listen for the query API: %v", err)
+        }
+        go func() {
+            if err := query.Serve(ctx, l, tracker); err != nil {
+                log.Printf("Query API error: %v", err)
             }
+        }()
+        log.Printf("Query API listening on %s", *listen)
+    }
+
+    // Let probepilot attach steer the running tracker
+    if *controlSocket != "" {
+        l, err := control.Listen("unix:"+*controlSocket, sockOpts)
+        if err != nil {
+            run.Fatal(summary.StageConfig, "Failed to listen on the control socket: %v", err)
         }
-    }()
+        go func() {
+            if err := tracker.control.Serve(ctx, l); err != nil {
+                log.Printf("Control socket error: %v", err)
+            }
+        }()
+        log.Printf("Control socket listening on %s", *controlSocket)
+    }
 
-    // Run the tracker
-    if err := tracker.Run(ctx); err != nil && err != context.Canceled {
-        log.Fatalf("Memory tracker error: %v", err)
+    // Push metrics to the OpenTelemetry collector
+    if metrics != nil {
+        log.Printf("OTLP metrics: pushing to %s every %v", metrics.URL(), *reportInterval)
     }
+    go metrics.Run(ctx, tracker, *reportInterval)
+
+    // Keep kernel symbols current as modules load and unload
+    go func() {
+        if err := tracker.symbols.WatchKernelModules(ctx); err != nil {
+            log.Printf("Warning: kernel symbols will not follow module loads: %v", err)
+        }
+    }()
 
-    // Print final statistics
-    tracker.PrintStats()
+    // Run the tracker, reporting every interval until interrupted
+    if !out.JSON() {
+        fmt.Println("Starting memory tracker...")
+    }
+    if err := runner.Run(ctx, tracker); err != nil {
+        run.Fatal(summary.StageRun, "Memory tracker error: %v", err)
+    }
+    // Send the final counts
+    metrics.Push(tracker)
+    metrics.Close()
+    run.Finish()
     log.Println("Memory tracker stopped")
 }
\ No newline at end of file
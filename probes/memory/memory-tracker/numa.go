@@ -0,0 +1,174 @@
+// NUMA: the pages each process allocated on each node, counted in BPF
+// by the page allocator hooks, and how much of it landed off the node of
+// the CPU allocating it, reported under -numa
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"probepilot/pkg/profile"
+	"probepilot/pkg/query"
+	"probepilot/pkg/units"
+)
+
+// maxNUMANodes is MAX_NUMA_NODES, the nodes counted apart; pages of
+// higher nodes only count as remote
+const maxNUMANodes = 8
+
+// numaExported bounds the processes whose nodes are in Samples
+const numaExported = 20
+
+// processNUMA is where the pages of a process were allocated
+type processNUMA struct {
+	id     ProcKey
+	nodes  [maxNUMANodes]uint64
+	remote uint64
+}
+
+func (p *processNUMA) total() uint64 {
+	var total uint64
+	for _, n := range p.nodes {
+		total += n
+	}
+	return total
+}
+
+// remoteShare is the percentage of the process's pages allocated off
+// the node of the CPU allocating them
+func (p *processNUMA) remoteShare() float64 {
+	total := p.total()
+	if total == 0 {
+		return 0
+	}
+	return float64(p.remote) / float64(total) * 100
+}
+
+// readNUMA returns the processes that allocated pages, the most remote
+// bytes first, and the bytes allocated on each node by all of them
+func (mt *MemoryTracker) readNUMA() ([]processNUMA, []uint64, error) {
+	m := mt.coll.Maps["process_memory_map"]
+	if m == nil {
+		return nil, nil, errors.New("no process_memory_map map")
+	}
+	var procs []processNUMA
+	var nodes []uint64
+	var id ProcKey
+	var stats ProcessMemory
+	iter := m.Iterate()
+	for iter.Next(&id, &stats) {
+		p := processNUMA{id: id, nodes: stats.NodeBytes, remote: stats.RemoteBytes}
+		if p.total() == 0 {
+			continue
+		}
+		for node, n := range p.nodes {
+			if n == 0 {
+				continue
+			}
+			for len(nodes) <= node {
+				nodes = append(nodes, 0)
+			}
+			nodes[node] += n
+		}
+		procs = append(procs, p)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, nil, err
+	}
+	sort.Slice(procs, func(i, j int) bool {
+		if procs[i].remote != procs[j].remote {
+			return procs[i].remote > procs[j].remote
+		}
+		return procs[i].total() > procs[j].total()
+	})
+	return procs, nodes, nil
+}
+
+// numaReady reports whether -numa has page allocations to report
+func (mt *MemoryTracker) numaReady() bool {
+	return mt.numa && mt.hooks.States()[profile.HookPageAlloc]
+}
+
+// printNUMA prints the pages allocated on each node and the processes
+// allocating the most off their CPU's node
+func (mt *MemoryTracker) printNUMA() {
+	if !mt.numaReady() {
+		return
+	}
+	procs, nodes, err := mt.readNUMA()
+	if err != nil {
+		log.Printf("Warning: failed to read NUMA allocations: %v", err)
+		return
+	}
+	var total uint64
+	for _, n := range nodes {
+		total += n
+	}
+	if total == 0 {
+		return
+	}
+	fmt.Printf("\nPage allocations by NUMA node:\n")
+	for node, n := range nodes {
+		fmt.Printf("  node%d: %s (%.1f%%)\n", node, units.Bytes(n), float64(n)/float64(total)*100)
+	}
+	if len(procs) > 10 {
+		procs = procs[:10]
+	}
+	fmt.Printf("\nTop 10 processes allocating on remote nodes:\n")
+	for _, p := range procs {
+		fmt.Printf("  PID %d (%s): Remote=%s (%.1f%%), %s\n", p.id.PID, mt.procs.Name(p.id.PID),
+			units.Bytes(p.remote), p.remoteShare(), p.nodeList())
+	}
+}
+
+// nodeList lists the nodes the process allocated on, e.g.
+// node0=1.2GB node1=64.0MB
+func (p *processNUMA) nodeList() string {
+	var nodes []string
+	for node, n := range p.nodes {
+		if n > 0 {
+			nodes = append(nodes, fmt.Sprintf("node%d=%s", node, units.Bytes(n)))
+		}
+	}
+	return strings.Join(nodes, " ")
+}
+
+// numaSamples exports the pages allocated on each node, in all and by
+// the processes allocating the most off their CPU's node
+func (mt *MemoryTracker) numaSamples() []query.Sample {
+	if !mt.numaReady() {
+		return nil
+	}
+	procs, nodes, err := mt.readNUMA()
+	if err != nil {
+		return nil
+	}
+	var samples []query.Sample
+	for node, n := range nodes {
+		samples = append(samples, query.Sample{Name: "memory_node_allocated_bytes_total",
+			Labels: query.Labels{"node": strconv.Itoa(node)}, Value: float64(n)})
+	}
+	if len(procs) > numaExported {
+		procs = procs[:numaExported]
+	}
+	for _, p := range procs {
+		labels := query.Labels{
+			"pid":  strconv.FormatUint(uint64(p.id.PID), 10),
+			"comm": mt.procs.Name(p.id.PID),
+		}
+		mt.procs.AddPIDLabels(labels, p.id.PID)
+		samples = append(samples, query.Sample{Name: "process_remote_node_allocated_bytes_total", Labels: labels, Value: float64(p.remote)})
+		for node, n := range p.nodes {
+			if n > 0 {
+				samples = append(samples, query.Sample{Name: "process_node_allocated_bytes_total",
+					Labels: withLabel(labels, "node", strconv.Itoa(node)), Value: float64(n)})
+			}
+		}
+	}
+	return samples
+}
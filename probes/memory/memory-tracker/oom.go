@@ -0,0 +1,164 @@
+// OOM forensics: when the kernel kills a process for want of memory, what
+// the tracker knows about the victim and the system is written to a
+// report file, for after the fact
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"probepilot/pkg/procfs"
+	"probepilot/pkg/units"
+)
+
+// DefaultOOMReportDir holds OOM reports unless -oom-reports says otherwise
+const DefaultOOMReportDir = "/var/lib/probepilot/oom"
+
+// recentLargeAllocs bounds the large allocations kept for OOM reports
+const recentLargeAllocs = 32
+
+// usageTrendPoints bounds the usage samples kept per process, one a report
+const usageTrendPoints = 12
+
+// largeAlloc is a large allocation, as OOM reports list it
+type largeAlloc struct {
+	at     time.Time
+	pid    uint32
+	comm   string
+	kind   string
+	size   uint64
+	frames []string
+}
+
+// usagePoint is a process's memory at one report
+type usagePoint struct {
+	at      time.Time
+	current uint64
+	rss     uint64
+}
+
+// noteLargeAlloc keeps a large allocation for OOM reports, dropping the
+// oldest beyond recentLargeAllocs
+func (mt *MemoryTracker) noteLargeAlloc(a largeAlloc) {
+	if mt.oomReportDir == "" {
+		return
+	}
+	if len(mt.largeAllocs) == recentLargeAllocs {
+		mt.largeAllocs = append(mt.largeAllocs[:0], mt.largeAllocs[1:]...)
+	}
+	mt.largeAllocs = append(mt.largeAllocs, a)
+}
+
+// noteUsage keeps a process's memory at this report for OOM reports
+func (mt *MemoryTracker) noteUsage(id ProcKey, stats *ProcessMemory, now time.Time) {
+	if mt.oomReportDir == "" {
+		return
+	}
+	trend := mt.usageTrend[id]
+	if len(trend) == usageTrendPoints {
+		trend = append(trend[:0], trend[1:]...)
+	}
+	mt.usageTrend[id] = append(trend, usagePoint{at: now, current: stats.CurrentUsage, rss: mt.usage[id].RSS})
+}
+
+// writeOOMReport writes a snapshot for the OOM kill of pid: the system's
+// memory and pressure, the victim's allocations, usage over the last
+// reports and outstanding allocations, the top consumers, the recent
+// large allocations and the leak candidates. It returns the report's path
+func (mt *MemoryTracker) writeOOMReport(pid uint32, comm string, frames []string) (string, error) {
+	now := time.Now()
+	var b strings.Builder
+	fmt.Fprintf(&b, "OOM kill of PID %d (%s) at %s\n", pid, comm, now.Format(time.RFC3339Nano))
+	if len(frames) > 0 {
+		fmt.Fprintf(&b, "Stack:\n")
+		for _, frame := range frames {
+			fmt.Fprintf(&b, "  %s\n", frame)
+		}
+	}
+
+	fmt.Fprintf(&b, "\nSystem memory:\n")
+	if m, err := procfs.ReadMeminfo(); err != nil {
+		fmt.Fprintf(&b, "  unavailable: %v\n", err)
+	} else {
+		fmt.Fprintf(&b, "  Total=%s, Free=%s, Available=%s, Buffers=%s, Cached=%s, Slab=%s\n",
+			units.Bytes(m.Total), units.Bytes(m.Free), units.Bytes(m.Available),
+			units.Bytes(m.Buffers), units.Bytes(m.Cached), units.Bytes(m.Slab))
+		fmt.Fprintf(&b, "  Swap: Total=%s, Free=%s\n", units.Bytes(m.SwapTotal), units.Bytes(m.SwapFree))
+	}
+	if lines, err := procfs.ReadPressure("memory"); err == nil {
+		for _, line := range lines {
+			fmt.Fprintf(&b, "  Pressure: %s\n", line)
+		}
+	}
+
+	id := ProcKey{PID: pid, StartTime: mt.starts[pid]}
+	fmt.Fprintf(&b, "\nVictim:\n")
+	if stats, ok := mt.processStats.Get(id); ok {
+		fmt.Fprintf(&b, "  Allocated=%s, Freed=%s, Unfreed=%s, Peak=%s, Allocations=%d, Frees=%d\n",
+			units.Bytes(stats.TotalAllocated), units.Bytes(stats.TotalFreed), units.Bytes(stats.CurrentUsage),
+			units.Bytes(stats.PeakUsage), stats.AllocationCount, stats.FreeCount)
+	} else {
+		fmt.Fprintf(&b, "  No allocations traced\n")
+	}
+	if u, ok := mt.usage[id]; ok {
+		fmt.Fprintf(&b, "  At the last report: RSS=%s, PSS=%s, Swap=%s, VSZ=%s\n",
+			units.Bytes(u.RSS), units.Bytes(u.PSS), units.Bytes(u.Swap), units.Bytes(u.VSZ))
+	}
+	if trend := mt.usageTrend[id]; len(trend) > 0 {
+		fmt.Fprintf(&b, "  Usage at the last %d reports:\n", len(trend))
+		for _, p := range trend {
+			fmt.Fprintf(&b, "    %s: Unfreed=%s, RSS=%s\n", p.at.Format(time.TimeOnly), units.Bytes(p.current), units.Bytes(p.rss))
+		}
+	}
+	if leaks := mt.topLeaks(10, pid); len(leaks) > 0 {
+		fmt.Fprintf(&b, "  Largest outstanding allocations:\n")
+		mt.writeLeaks(&b, leaks, "    ")
+	}
+
+	fmt.Fprintf(&b, "\nTop memory consumers:\n")
+	for _, p := range mt.topConsumers(10) {
+		fmt.Fprintf(&b, "  PID %d (%s): Current=%s, Peak=%s, Allocs=%d, RSS=%s\n",
+			p.pid, mt.procs.Name(p.pid), units.Bytes(p.current), units.Bytes(p.peak), p.allocs, units.Bytes(p.usage.RSS))
+	}
+
+	fmt.Fprintf(&b, "\nRecent large allocations:\n")
+	for i := len(mt.largeAllocs) - 1; i >= 0; i-- {
+		a := mt.largeAllocs[i]
+		fmt.Fprintf(&b, "  %s PID %d (%s): %s of %s\n", a.at.Format(time.TimeOnly+".000"), a.pid, a.comm, a.kind, units.Bytes(a.size))
+		for _, frame := range a.frames {
+			fmt.Fprintf(&b, "    %s\n", frame)
+		}
+	}
+
+	fmt.Fprintf(&b, "\nPotential memory leaks (%d):\n", mt.leaks.Len())
+	mt.writeLeaks(&b, mt.topLeaks(10, 0), "  ")
+
+	if err := os.MkdirAll(mt.oomReportDir, 0o750); err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("oom-%s-%d.txt", now.Format("20060102T150405.000"), pid)
+	data := []byte(b.String())
+	if mt.sealKey != nil {
+		name += ".sealed"
+		data = mt.sealKey.Seal(data)
+	}
+	path := filepath.Join(mt.oomReportDir, name)
+	if err := os.WriteFile(path, data, 0o640); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func (mt *MemoryTracker) writeLeaks(b *strings.Builder, leaks []leakInfo, indent string) {
+	for _, l := range leaks {
+		fmt.Fprintf(b, "%sAddr=0x%x, Size=%s, Age=%v, PID=%d\n",
+			indent, l.addr, units.Bytes(l.size), l.age.Truncate(time.Second), l.pid)
+		for _, frame := range mt.stacks.frames(l.stack) {
+			fmt.Fprintf(b, "%s  %s\n", indent, frame)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// Target processes: instead of system-wide libc, -target-pid and
+// -target-cmd trace the allocator libraries and executable of chosen
+// running processes with uprobes scoped to them, detached when they exit
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/cilium/ebpf/link"
+
+	"probepilot/pkg/attach"
+	"probepilot/pkg/procfs"
+)
+
+// findTargets resolves -target-pid and -target-cmd to running processes:
+// the PIDs given and those whose command name, executable or argv[0] is
+// cmd
+func findTargets(pids []uint32, cmd string) ([]uint32, error) {
+	targets := append([]uint32(nil), pids...)
+	for _, pid := range pids {
+		if _, err := os.Stat(procfs.Path(strconv.FormatUint(uint64(pid), 10))); err != nil {
+			return nil, fmt.Errorf("target PID %d is not running", pid)
+		}
+	}
+	if cmd == "" {
+		return targets, nil
+	}
+	procs, err := procfs.Scan()
+	if err != nil {
+		return nil, err
+	}
+	self := uint32(os.Getpid())
+	found := 0
+	for _, p := range procs {
+		if p.PID == self || !runs(p, cmd) {
+			continue
+		}
+		found++
+		if !containsPID(targets, p.PID) {
+			targets = append(targets, p.PID)
+		}
+	}
+	if found == 0 {
+		return nil, fmt.Errorf("no running process matches -target-cmd %q", cmd)
+	}
+	return targets, nil
+}
+
+func runs(p *procfs.Process, cmd string) bool {
+	if p.Comm == cmd || (p.Exe != "" && filepath.Base(p.Exe) == cmd) {
+		return true
+	}
+	return len(p.Cmdline) > 0 && filepath.Base(p.Cmdline[0]) == cmd
+}
+
+func containsPID(pids []uint32, pid uint32) bool {
+	for _, p := range pids {
+		if p == pid {
+			return true
+		}
+	}
+	return false
+}
+
+// processLibs lists what the uprobes of pid attach to: every allocator
+// library it maps, through the process's root, and its executable if it
+// defines malloc or operator new itself, as statically linked binaries do
+func processLibs(pid uint32) ([]allocLib, error) {
+	dir := strconv.FormatUint(uint64(pid), 10)
+	f, err := os.Open(procfs.Path(dir, "maps"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var libs []allocLib
+	seen := make(map[string]bool)
+	candidates := append(allocators[:len(allocators):len(allocators)], &cxxRuntime)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || seen[fields[5]] {
+			continue
+		}
+		for _, a := range candidates {
+			if a.provides(fields[5]) {
+				seen[fields[5]] = true
+				libs = append(libs, allocLib{alloc: a, path: procfs.Path(dir, "root", fields[5])})
+				break
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	exe := procfs.Path(dir, "exe")
+	for _, a := range []*allocator{&glibc, &cxxRuntime} {
+		if _, err := attach.ResolveSymbol(exe, a.funcs[0].symbol); err == nil {
+			libs = append(libs, allocLib{alloc: a, path: exe})
+		}
+	}
+	return libs, nil
+}
+
+// attachTarget attaches the allocation uprobes of pid, scoped to it
+func (mt *MemoryTracker) attachTarget(pid uint32) error {
+	libs, err := processLibs(pid)
+	if err != nil {
+		return fmt.Errorf("target PID %d: %v", pid, err)
+	}
+	var links []link.Link
+	for _, lib := range libs {
+		l, err := mt.attachPIDUprobes(lib.alloc, lib.path, pid)
+		if err != nil {
+			log.Printf("Warning: %v", err)
+			continue
+		}
+		log.Printf("Target PID %d (%s): traced %s in %s", pid, mt.procs.Name(pid), lib.alloc.name, lib.path)
+		links = append(links, l...)
+	}
+	if len(links) == 0 {
+		return fmt.Errorf("target PID %d: no allocator functions to attach to", pid)
+	}
+	mt.allocMu.Lock()
+	mt.targetLinks[pid] = links
+	mt.allocMu.Unlock()
+	return nil
+}
+
+// detachTarget closes the uprobes of an exited target process
+func (mt *MemoryTracker) detachTarget(pid uint32) {
+	mt.allocMu.Lock()
+	links, ok := mt.targetLinks[pid]
+	delete(mt.targetLinks, pid)
+	left := len(mt.targetLinks)
+	mt.allocMu.Unlock()
+	if !ok {
+		return
+	}
+	for _, l := range links {
+		l.Close()
+	}
+	log.Printf("Target PID %d exited, detached its %d uprobes", pid, len(links))
+	if left == 0 {
+		log.Printf("All target processes exited; no allocations are traced")
+	}
+}
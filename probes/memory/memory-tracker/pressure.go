@@ -0,0 +1,417 @@
+// Memory pressure: the swap-ins, swap-outs and direct reclaims of each
+// process, counted in BPF under the swap hook set, and the pressure stall
+// information of /proc/pressure/memory, read every second. A second in
+// which some task stalled on memory for -pressure-threshold of it opens a
+// pressure incident, closed once the stalls fall back below; the incident
+// is reported as one record naming the processes that allocated, swapped
+// and reclaimed the most while it lasted, its suspected contributors
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cilium/ebpf/link"
+
+	"probepilot/pkg/attach"
+	"probepilot/pkg/control"
+	"probepilot/pkg/procfs"
+	"probepilot/pkg/profile"
+	"probepilot/pkg/query"
+	"probepilot/pkg/units"
+)
+
+// swapFuncs count swap I/O; each kernel has one function of each pair
+var swapFuncs = []attach.KernelFunc{
+	{Symbol: "swap_read_folio", Kprobe: "trace_swap_in", Optional: true},
+	{Symbol: "swap_readpage", Kprobe: "trace_swap_in", Optional: true},
+	{Symbol: "swap_writepage", Kprobe: "trace_swap_out", Optional: true},
+	{Symbol: "swap_writeout", Kprobe: "trace_swap_out", Optional: true},
+}
+
+// reclaimTracepoints time direct reclaim under the swap hook set
+var reclaimTracepoints = []struct {
+	group string
+	name  string
+	prog  string
+}{
+	{"vmscan", "mm_vmscan_direct_reclaim_begin", "trace_reclaim_begin"},
+	{"vmscan", "mm_vmscan_direct_reclaim_end", "trace_reclaim_end"},
+}
+
+const (
+	// swapExported bounds the processes whose swap activity is in Samples
+	swapExported = 20
+	// pressureRetained bounds the closed incidents kept for Stats
+	pressureRetained = 10
+	// pressureSuspects bounds the contributors an incident names
+	pressureSuspects = 5
+)
+
+// attachSwap attaches the swap functions the kernel has and both direct
+// reclaim tracepoints or, so that no reclaim is left open, neither
+func (mt *MemoryTracker) attachSwap() ([]link.Link, error) {
+	links, report, err := attach.Kernel(mt.coll, attach.ModeKprobe, swapFuncs)
+	if err != nil {
+		return nil, err
+	}
+	if len(report.Attached) == 0 {
+		log.Printf("Warning: no swap functions to trace, counting direct reclaim only")
+	}
+	for _, tp := range reclaimTracepoints {
+		l, err := link.Tracepoint(link.TracepointOptions{Group: tp.group, Name: tp.name, Program: mt.coll.Programs[tp.prog]})
+		if err != nil {
+			for _, l := range links {
+				l.Close()
+			}
+			return nil, fmt.Errorf("failed to attach tracepoint %s:%s: %v", tp.group, tp.name, err)
+		}
+		links = append(links, l)
+	}
+	return links, nil
+}
+
+// processSwap is a process and its swap activity
+type processSwap struct {
+	id ProcKey
+	SwapStats
+}
+
+// topSwap returns the n processes swapping the most
+func (mt *MemoryTracker) topSwap(n int) ([]processSwap, error) {
+	swap, err := mt.readSwapStats()
+	if err != nil {
+		return nil, err
+	}
+	procs := make([]processSwap, 0, len(swap))
+	for id, stats := range swap {
+		procs = append(procs, processSwap{id: id, SwapStats: stats})
+	}
+	sort.Slice(procs, func(i, j int) bool {
+		a, b := procs[i].SwapIns+procs[i].SwapOuts, procs[j].SwapIns+procs[j].SwapOuts
+		if a != b {
+			return a > b
+		}
+		return procs[i].ReclaimNs > procs[j].ReclaimNs
+	})
+	if len(procs) > n {
+		procs = procs[:n]
+	}
+	return procs, nil
+}
+
+// readSwapStats reads swap_stats_map
+func (mt *MemoryTracker) readSwapStats() (map[ProcKey]SwapStats, error) {
+	m := mt.coll.Maps["swap_stats_map"]
+	if m == nil {
+		return nil, errors.New("no swap_stats_map map")
+	}
+	swap := make(map[ProcKey]SwapStats)
+	var id ProcKey
+	var stats SwapStats
+	iter := m.Iterate()
+	for iter.Next(&id, &stats) {
+		swap[id] = stats
+	}
+	return swap, iter.Err()
+}
+
+// kswapdWakeups counts the times kswapd was woken since the tracker
+// started
+func (mt *MemoryTracker) kswapdWakeups() uint32 {
+	var sys SystemMemory
+	if m := mt.coll.Maps["system_memory_map"]; m != nil {
+		m.Lookup(uint32(0), &sys)
+	}
+	return sys.MemoryPressure
+}
+
+// pressureActivity is what a process had allocated and swapped by a
+// sample, set against a later one over an incident
+type pressureActivity struct {
+	allocated uint64
+	SwapStats
+}
+
+// pressureSuspect is a process and what it did over an incident
+type pressureSuspect struct {
+	id   ProcKey
+	comm string
+	pressureActivity
+}
+
+// churn weighs a suspect by the memory it allocated and swapped
+func (s *pressureSuspect) churn() uint64 {
+	return s.allocated + (s.SwapIns+s.SwapOuts)*uint64(os.Getpagesize())
+}
+
+// pressureIncident is a run of seconds some task stalled on memory for
+// past the threshold
+type pressureIncident struct {
+	start time.Time
+	end   time.Time
+	// peak is the largest share of a second some task stalled for
+	peak float64
+	// the stall totals and kswapd wakeups at the start, and over the
+	// incident once closed
+	someStart   time.Duration
+	fullStart   time.Duration
+	kswapdStart uint32
+	some        time.Duration
+	full        time.Duration
+	kswapd      uint32
+	// the activity of every process at the start
+	baseline map[ProcKey]pressureActivity
+	suspects []pressureSuspect
+}
+
+// pressureState follows /proc/pressure/memory from one second to the
+// next
+type pressureState struct {
+	// threshold is the share of a second some task stalls for that opens
+	// an incident
+	threshold   float64
+	unavailable bool
+	last        procfs.Pressure
+	lastAt      time.Time
+	// ratio is the share of the last second some task stalled for
+	ratio  float64
+	kswapd uint32
+	// activity is of every process at the last second, read only while
+	// tasks stall so it is the baseline of an incident opening next
+	activity map[ProcKey]pressureActivity
+	open     *pressureIncident
+	// closed are the last incidents, oldest first, of total
+	closed []*pressureIncident
+	total  uint64
+}
+
+// readActivity reads what every process has allocated and, under the
+// swap hook set, swapped
+func (mt *MemoryTracker) readActivity() map[ProcKey]pressureActivity {
+	activity := make(map[ProcKey]pressureActivity)
+	if m := mt.coll.Maps["process_memory_map"]; m != nil {
+		var id ProcKey
+		var stats ProcessMemory
+		iter := m.Iterate()
+		for iter.Next(&id, &stats) {
+			activity[id] = pressureActivity{allocated: stats.TotalAllocated}
+		}
+	}
+	if !mt.hooks.States()[profile.HookSwap] {
+		return activity
+	}
+	swap, err := mt.readSwapStats()
+	if err != nil {
+		return activity
+	}
+	for id, stats := range swap {
+		a := activity[id]
+		a.SwapStats = stats
+		activity[id] = a
+	}
+	return activity
+}
+
+// samplePressure reads the memory stalls of the last second, opening or
+// closing an incident
+func (mt *MemoryTracker) samplePressure(now time.Time) {
+	ps := mt.pressure
+	if ps == nil || ps.unavailable {
+		return
+	}
+	p, err := procfs.ReadPressureStall("memory")
+	if err != nil {
+		log.Printf("Warning: no pressure incidents, memory pressure unavailable: %v", err)
+		ps.unavailable = true
+		return
+	}
+	last, lastAt, kswapd := ps.last, ps.lastAt, ps.kswapd
+	ps.last, ps.lastAt, ps.kswapd = p, now, mt.kswapdWakeups()
+	if lastAt.IsZero() || !now.After(lastAt) {
+		return
+	}
+	ps.ratio = float64(p.Some.Total-last.Some.Total) / float64(now.Sub(lastAt))
+	mt.history.Add("memory.pressure_stall_ratio", now, ps.ratio)
+
+	var activity map[ProcKey]pressureActivity
+	if ps.ratio > 0 || p.Some.Avg10 > 0 || ps.open != nil {
+		activity = mt.readActivity()
+	}
+	switch {
+	case ps.open == nil && ps.ratio >= ps.threshold:
+		baseline := ps.activity
+		if baseline == nil {
+			baseline = activity
+		}
+		ps.open = &pressureIncident{start: lastAt, peak: ps.ratio, someStart: last.Some.Total,
+			fullStart: last.Full.Total, kswapdStart: kswapd, baseline: baseline}
+	case ps.open != nil && ps.ratio >= ps.threshold:
+		ps.open.peak = max(ps.open.peak, ps.ratio)
+	case ps.open != nil:
+		mt.closeIncident(now, p, activity)
+	}
+	ps.activity = activity
+}
+
+// closeIncident ends the open incident, names its suspects and reports it
+func (mt *MemoryTracker) closeIncident(now time.Time, p procfs.Pressure, activity map[ProcKey]pressureActivity) {
+	ps := mt.pressure
+	in := ps.open
+	ps.open = nil
+	in.end = now
+	in.some = p.Some.Total - in.someStart
+	in.full = p.Full.Total - in.fullStart
+	in.kswapd = ps.kswapd - in.kswapdStart
+	for id, a := range activity {
+		// A PID seen first during the incident did it all then
+		b := in.baseline[id]
+		s := pressureSuspect{id: id}
+		s.allocated = a.allocated - min(b.allocated, a.allocated)
+		s.SwapIns = a.SwapIns - min(b.SwapIns, a.SwapIns)
+		s.SwapOuts = a.SwapOuts - min(b.SwapOuts, a.SwapOuts)
+		s.Reclaims = a.Reclaims - min(b.Reclaims, a.Reclaims)
+		s.ReclaimNs = a.ReclaimNs - min(b.ReclaimNs, a.ReclaimNs)
+		if s.churn() > 0 || s.Reclaims > 0 {
+			in.suspects = append(in.suspects, s)
+		}
+	}
+	in.baseline = nil
+	sort.Slice(in.suspects, func(i, j int) bool {
+		a, b := &in.suspects[i], &in.suspects[j]
+		if a.churn() != b.churn() {
+			return a.churn() > b.churn()
+		}
+		return a.ReclaimNs > b.ReclaimNs
+	})
+	if len(in.suspects) > pressureSuspects {
+		in.suspects = in.suspects[:pressureSuspects]
+	}
+	for i := range in.suspects {
+		in.suspects[i].comm = mt.procs.Name(in.suspects[i].id.PID)
+	}
+	ps.total++
+	if len(ps.closed) == pressureRetained {
+		ps.closed = append(ps.closed[:0], ps.closed[1:]...)
+	}
+	ps.closed = append(ps.closed, in)
+	mt.reportIncident(in)
+}
+
+// reportIncident publishes, routes and outputs an incident, labelled with
+// its top suspect
+func (mt *MemoryTracker) reportIncident(in *pressureIncident) {
+	duration := in.end.Sub(in.start)
+	labels := query.Labels{
+		"type":        "pressure_incident",
+		"duration_ms": strconv.FormatInt(duration.Milliseconds(), 10),
+		"peak_stall":  strconv.FormatFloat(in.peak, 'f', 2, 64),
+	}
+	pids := make([]string, len(in.suspects))
+	suspects := make([]string, len(in.suspects))
+	for i, s := range in.suspects {
+		pids[i] = strconv.FormatUint(uint64(s.id.PID), 10)
+		suspects[i] = fmt.Sprintf("pid=%d comm=%s allocated=%d swap_ins=%d swap_outs=%d reclaims=%d reclaim_ns=%d",
+			s.id.PID, s.comm, s.allocated, s.SwapIns, s.SwapOuts, s.Reclaims, s.ReclaimNs)
+	}
+	if len(in.suspects) > 0 {
+		top := in.suspects[0]
+		labels["pid"] = pids[0]
+		labels["comm"] = top.comm
+		labels["suspects"] = strings.Join(pids, ",")
+		mt.procs.AddPIDLabels(labels, top.id.PID)
+	}
+	text := fmt.Sprintf("pressure_incident duration_ms=%d peak_stall=%.2f some_ns=%d full_ns=%d kswapd_wakeups=%d suspects=[%s]",
+		duration.Milliseconds(), in.peak, in.some.Nanoseconds(), in.full.Nanoseconds(), in.kswapd, strings.Join(suspects, "; "))
+	mt.control.Publish(control.Event{Labels: labels, Text: text})
+	mt.router.Route(labels, text)
+	mt.output.Event(labels, text)
+	if !mt.output.JSON() {
+		fmt.Printf("Memory Pressure Incident:\n")
+		mt.printIncident(in)
+	}
+}
+
+// printIncident prints an incident and its suspects
+func (mt *MemoryTracker) printIncident(in *pressureIncident) {
+	fmt.Printf("  %s for %v: peak %.0f%% stalled, Some=%v, Full=%v, kswapd woken %d times\n",
+		in.start.Format(time.TimeOnly), in.end.Sub(in.start).Round(time.Second), in.peak*100,
+		in.some.Round(time.Millisecond), in.full.Round(time.Millisecond), in.kswapd)
+	for _, s := range in.suspects {
+		fmt.Printf("    PID %d (%s): Allocated=%s, SwapIns=%d, SwapOuts=%d, Reclaims=%d (%v)\n",
+			s.id.PID, s.comm, units.Bytes(s.allocated), s.SwapIns, s.SwapOuts, s.Reclaims,
+			time.Duration(s.ReclaimNs).Round(time.Microsecond))
+	}
+}
+
+// printPressure prints the memory stalls and recent incidents and, under
+// the swap hook set, the processes swapping the most
+func (mt *MemoryTracker) printPressure() {
+	if ps := mt.pressure; ps != nil && !ps.unavailable {
+		fmt.Printf("\nMemory pressure: Some avg10=%.2f%% avg60=%.2f%%, Full avg10=%.2f%% avg60=%.2f%%, kswapd woken %d times, %d incidents\n",
+			ps.last.Some.Avg10, ps.last.Some.Avg60, ps.last.Full.Avg10, ps.last.Full.Avg60, ps.kswapd, ps.total)
+		if ps.open != nil {
+			fmt.Printf("  Incident open since %s, peak %.0f%% stalled\n", ps.open.start.Format(time.TimeOnly), ps.open.peak*100)
+		}
+		for _, in := range ps.closed {
+			mt.printIncident(in)
+		}
+	}
+	if !mt.hooks.States()[profile.HookSwap] {
+		return
+	}
+	procs, err := mt.topSwap(10)
+	if err != nil {
+		log.Printf("Warning: failed to read swap activity: %v", err)
+		return
+	}
+	fmt.Printf("\nTop 10 swapping processes:\n")
+	for _, p := range procs {
+		fmt.Printf("  PID %d (%s): SwapIns=%d, SwapOuts=%d, DirectReclaims=%d (%v)\n",
+			p.id.PID, mt.procs.Name(p.id.PID), p.SwapIns, p.SwapOuts, p.Reclaims,
+			time.Duration(p.ReclaimNs).Round(time.Microsecond))
+	}
+}
+
+// pressureSamples exports the memory stalls, incidents and kswapd
+// wakeups and, under the swap hook set, the swap activity of the
+// processes swapping the most
+func (mt *MemoryTracker) pressureSamples() []query.Sample {
+	samples := []query.Sample{{Name: "memory_kswapd_wakeups_total", Value: float64(mt.kswapdWakeups())}}
+	if ps := mt.pressure; ps != nil && !ps.unavailable {
+		samples = append(samples,
+			query.Sample{Name: "memory_pressure_stall_seconds_total", Labels: query.Labels{"kind": "some"}, Value: ps.last.Some.Total.Seconds()},
+			query.Sample{Name: "memory_pressure_stall_seconds_total", Labels: query.Labels{"kind": "full"}, Value: ps.last.Full.Total.Seconds()},
+			query.Sample{Name: "memory_pressure_stall_ratio", Value: ps.ratio},
+			query.Sample{Name: "memory_pressure_incidents_total", Value: float64(ps.total)},
+		)
+	}
+	if !mt.hooks.States()[profile.HookSwap] {
+		return samples
+	}
+	procs, err := mt.topSwap(swapExported)
+	if err != nil {
+		return samples
+	}
+	for _, p := range procs {
+		labels := query.Labels{
+			"pid":  strconv.FormatUint(uint64(p.id.PID), 10),
+			"comm": mt.procs.Name(p.id.PID),
+		}
+		mt.procs.AddPIDLabels(labels, p.id.PID)
+		samples = append(samples,
+			query.Sample{Name: "process_swap_ins_total", Labels: labels, Value: float64(p.SwapIns)},
+			query.Sample{Name: "process_swap_outs_total", Labels: labels, Value: float64(p.SwapOuts)},
+			query.Sample{Name: "process_direct_reclaims_total", Labels: labels, Value: float64(p.Reclaims)},
+			query.Sample{Name: "process_direct_reclaim_seconds_total", Labels: labels, Value: time.Duration(p.ReclaimNs).Seconds()},
+		)
+	}
+	return samples
+}
@@ -0,0 +1,253 @@
+// Process identity and exit: state is kept per PID and start time, and
+// finalized when the process exits
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/cilium/ebpf"
+
+	"probepilot/pkg/control"
+	"probepilot/pkg/procfs"
+	"probepilot/pkg/query"
+	"probepilot/pkg/units"
+)
+
+// observe notes the process holding id's PID and detects its allocator.
+// Another process that had the PID must be gone, even if its exit was
+// missed, so it is finalized silently rather than merged into the new one
+func (mt *MemoryTracker) observe(id ProcKey) {
+	start, ok := mt.starts[id.PID]
+	if ok && start == id.StartTime {
+		return
+	}
+	if ok {
+		mt.evict(ProcKey{PID: id.PID, StartTime: start})
+	}
+	mt.starts[id.PID] = id.StartTime
+	mt.detectAllocator(id)
+}
+
+// evict drops the state kept for a process that is gone. Its allocations
+// are dropped at the next report, by sweepExited.
+func (mt *MemoryTracker) evict(id ProcKey) {
+	if stats, ok := mt.processStats.Get(id); ok {
+		mt.dropUsage(id, stats)
+	}
+	mt.processStats.Remove(id)
+	delete(mt.lastUsage, id)
+	delete(mt.usage, id)
+	delete(mt.usageTrend, id)
+	delete(mt.growthWindows, id)
+	delete(mt.allocs, id)
+	mt.evictThreads(id)
+	mt.evictHeap(id)
+	mt.procs.Remove(id.PID)
+	if mt.starts[id.PID] == id.StartTime {
+		delete(mt.starts, id.PID)
+	}
+	mt.exited[id] = true
+}
+
+// exitedRetained bounds the exit summaries kept, however many processes
+// exit within -exit-retention
+const exitedRetained = 1000
+
+// exitSummary is the lifetime of an exited process, kept for
+// -exit-retention for post-mortem queries
+type exitSummary struct {
+	id     ProcKey
+	comm   string
+	status string
+	at     time.Time
+	stats  ProcessMemory
+	// leaked is the bytes of its potential leaks when it exited
+	leaked uint64
+}
+
+// handleExit reports a summary of an exited process, keeps it for
+// -exit-retention, and evicts the process
+func (mt *MemoryTracker) handleExit(exit *ProcessExit) {
+	id := ProcKey{PID: exit.PID, StartTime: exit.StartTime}
+	mt.exits++
+	var stats ProcessMemory
+	if s, ok := mt.processStats.Get(id); ok {
+		stats = *s
+	}
+	leaked := mt.leaks.Bytes(id)
+
+	comm := string(bytes.TrimRight(exit.Comm[:], "\x00"))
+	// exit_code holds the exit status as wait(2) reports it
+	status := fmt.Sprintf("code=%d", exit.ExitCode>>8&0xff)
+	if sig := exit.ExitCode & 0x7f; sig != 0 {
+		status = fmt.Sprintf("signal=%d", sig)
+	}
+	labels := query.Labels{
+		"type": "exit",
+		"pid":  strconv.Itoa(int(exit.PID)),
+		"comm": comm,
+	}
+	mt.procs.AddPIDLabels(labels, exit.PID)
+	text := fmt.Sprintf("exit pid=%d comm=%s %s allocated=%d freed=%d unfreed=%d peak=%d allocations=%d leaked=%d",
+		exit.PID, comm, status, stats.TotalAllocated, stats.TotalFreed, stats.CurrentUsage,
+		stats.PeakUsage, stats.AllocationCount, leaked)
+	mt.control.Publish(control.Event{Labels: labels, Text: text})
+	mt.router.RouteAt(exit.Timestamp, labels, text)
+	mt.output.EventAt(exit.Timestamp, labels, text)
+	if !mt.output.JSON() && stats.AllocationCount > 0 {
+		fmt.Printf("Process exit: PID=%d, Comm=%s, %s, Allocated=%s, Unfreed=%s, Peak=%s, Leaked=%s\n",
+			exit.PID, comm, status, units.Bytes(stats.TotalAllocated),
+			units.Bytes(stats.CurrentUsage), units.Bytes(stats.PeakUsage), units.Bytes(leaked))
+	}
+	if mt.exitRetention > 0 {
+		if len(mt.exitSummaries) == exitedRetained {
+			mt.exitSummaries = append(mt.exitSummaries[:0], mt.exitSummaries[1:]...)
+		}
+		mt.exitSummaries = append(mt.exitSummaries, exitSummary{
+			id: id, comm: comm, status: status, at: time.Now(), stats: stats, leaked: leaked,
+		})
+	}
+
+	mt.evict(id)
+	mt.detachTarget(exit.PID)
+	delete(mt.largeAlerted, exit.PID)
+}
+
+// dropUsage takes the usage of a process processStats stops tracking, on
+// exit or displaced by a heavier allocator, out of the running total
+func (mt *MemoryTracker) dropUsage(_ ProcKey, stats *ProcessMemory) {
+	mt.currentUsage -= stats.CurrentUsage
+}
+
+// sweepExited drops the allocations of the processes that exited since
+// the last sweep, here and in allocation_map: their memory went with
+// them, without frees.
+func (mt *MemoryTracker) sweepExited() {
+	if len(mt.exited) == 0 {
+		return
+	}
+	var gone []AllocKey
+	mt.leaks.Each(func(addr uint64, info *AllocationInfo) bool {
+		if id := info.proc(); mt.exited[id] {
+			gone = append(gone, AllocKey{Proc: id, Addr: addr})
+		}
+		return true
+	})
+	for _, key := range gone {
+		mt.leaks.Remove(key.Proc, key.Addr)
+	}
+
+	allocations := mt.coll.Maps["allocation_map"]
+	var stale []AllocKey
+	var key AllocKey
+	var entry AllocationEntry
+	iter := allocations.Iterate()
+	for iter.Next(&key, &entry) {
+		if mt.exited[key.Proc] {
+			stale = append(stale, key)
+		}
+	}
+	err := iter.Err()
+	for _, key := range stale {
+		if e := allocations.Delete(key); e != nil && !errors.Is(e, ebpf.ErrKeyNotExist) {
+			err = e
+		}
+	}
+	if err != nil {
+		log.Printf("Warning: failed to drop allocations of exited processes: %v", err)
+	}
+	mt.sweepRegions()
+	mt.exited = make(map[ProcKey]bool)
+}
+
+// pruneExited forgets the exit summaries older than -exit-retention; like
+// sampleUsage, it runs in Stats under the tracker's lock
+func (mt *MemoryTracker) pruneExited(now time.Time) {
+	n := 0
+	for n < len(mt.exitSummaries) && now.Sub(mt.exitSummaries[n].at) > mt.exitRetention {
+		n++
+	}
+	mt.exitSummaries = append(mt.exitSummaries[:0], mt.exitSummaries[n:]...)
+}
+
+// printExited prints the processes that exited within -exit-retention,
+// latest first
+func (mt *MemoryTracker) printExited() {
+	if len(mt.exitSummaries) == 0 {
+		return
+	}
+	fmt.Printf("\nExited in the last %v (latest 10 of %d):\n", mt.exitRetention, len(mt.exitSummaries))
+	for i := len(mt.exitSummaries) - 1; i >= 0 && i >= len(mt.exitSummaries)-10; i-- {
+		e := &mt.exitSummaries[i]
+		fmt.Printf("  PID %d (%s): %s %v ago, Allocated=%s, Freed=%s, Peak=%s, Unfreed=%s, Leaked=%s\n",
+			e.id.PID, e.comm, e.status, time.Since(e.at).Truncate(time.Second), units.Bytes(e.stats.TotalAllocated),
+			units.Bytes(e.stats.TotalFreed), units.Bytes(e.stats.PeakUsage), units.Bytes(e.stats.CurrentUsage), units.Bytes(e.leaked))
+	}
+}
+
+// exitSamples exports the summaries of the processes that exited within
+// -exit-retention, for post-mortem queries
+func (mt *MemoryTracker) exitSamples() []query.Sample {
+	var samples []query.Sample
+	for i := range mt.exitSummaries {
+		e := &mt.exitSummaries[i]
+		labels := query.Labels{
+			"pid":    strconv.FormatUint(uint64(e.id.PID), 10),
+			"comm":   e.comm,
+			"status": e.status,
+		}
+		samples = append(samples,
+			query.Sample{Name: "process_exit_allocated_bytes", Labels: labels, Value: float64(e.stats.TotalAllocated)},
+			query.Sample{Name: "process_exit_freed_bytes", Labels: labels, Value: float64(e.stats.TotalFreed)},
+			query.Sample{Name: "process_exit_peak_bytes", Labels: labels, Value: float64(e.stats.PeakUsage)},
+			query.Sample{Name: "process_exit_unfreed_bytes", Labels: labels, Value: float64(e.stats.CurrentUsage)},
+			query.Sample{Name: "process_exit_leaked_bytes", Labels: labels, Value: float64(e.leaked)},
+			query.Sample{Name: "process_exit_time_seconds", Labels: labels, Value: float64(e.at.UnixNano()) / 1e9},
+		)
+	}
+	return samples
+}
+
+// sampleUsage reads the kernel's view of the memory of every tracked
+// process from /proc: RSS, PSS, swap and VSZ, the first and last also
+// kept in pages in its stats, and notes them for OOM reports. A process
+// whose PID another has taken is skipped, and one gone from /proc, whose
+// exit was lost with a full ring buffer, is evicted. It runs in Stats,
+// under the tracker's lock like Handle, whose state it evicts
+func (mt *MemoryTracker) sampleUsage() {
+	page := uint64(os.Getpagesize())
+	now := time.Now()
+	_, err := os.Stat(procfs.Path())
+	procMounted := err == nil
+	var gone []ProcKey
+	mt.processStats.Each(func(id ProcKey, stats *ProcessMemory) bool {
+		if mt.starts[id.PID] != id.StartTime {
+			delete(mt.usage, id)
+			return true
+		}
+		u, err := procfs.ReadUsage(id.PID)
+		if err != nil {
+			delete(mt.usage, id)
+			if procMounted && errors.Is(err, fs.ErrNotExist) {
+				gone = append(gone, id)
+			}
+			return true
+		}
+		mt.usage[id] = u
+		stats.RSSPages = u.RSS / page
+		stats.VMemPages = u.VSZ / page
+		mt.noteUsage(id, stats, now)
+		return true
+	})
+	for _, id := range gone {
+		mt.evict(id)
+	}
+}
@@ -0,0 +1,257 @@
+// Mapped regions: every mmap since start is kept in region_map with its
+// protection and backing, trimmed by munmap and split by mprotect, and
+// mappings made writable and executable at once, by either call, are
+// raised as wx_mapping events
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+
+	"probepilot/pkg/control"
+	"probepilot/pkg/decode"
+	"probepilot/pkg/query"
+	"probepilot/pkg/units"
+)
+
+// mmap protection and flag bits
+const (
+	protRead     = 0x1
+	protWrite    = 0x2
+	protExec     = 0x4
+	mapShared    = 0x01
+	mapAnonymous = 0x20
+)
+
+// regionEventSize tells W+X mappings apart from events in the ring buffer
+var regionEventSize = int(unsafe.Sizeof(RegionEvent{}))
+
+// regionExported bounds the processes whose mappings are in Samples
+const regionExported = 20
+
+// protString renders PROT_* bits as /proc/<pid>/maps does, e.g. "rw-"
+func protString(prot uint32) string {
+	b := []byte("---")
+	if prot&protRead != 0 {
+		b[0] = 'r'
+	}
+	if prot&protWrite != 0 {
+		b[1] = 'w'
+	}
+	if prot&protExec != 0 {
+		b[2] = 'x'
+	}
+	return string(b)
+}
+
+func writableExec(prot uint32) bool {
+	return prot&(protWrite|protExec) == protWrite|protExec
+}
+
+// regionKind is what backs a mapping: a file, or anonymous memory,
+// private or shared
+func regionKind(flags uint32) string {
+	switch {
+	case flags&mapAnonymous == 0:
+		return "file"
+	case flags&mapShared != 0:
+		return "shared"
+	}
+	return "anon"
+}
+
+// handleRegion raises a wx_mapping event for a mapping mmap or mprotect
+// made writable and executable
+func (mt *MemoryTracker) handleRegion(record []byte) error {
+	var event RegionEvent
+	if err := decode.Record(record, &event); err != nil {
+		return fmt.Errorf("failed to parse W+X mapping: %v", err)
+	}
+	mt.wxEvents++
+	op := allocTypeNames[event.Op]
+	comm := string(bytes.TrimRight(event.Comm[:], "\x00"))
+	file := string(bytes.TrimRight(event.File[:], "\x00"))
+	labels := query.Labels{
+		"type": "wx_mapping",
+		"op":   op,
+		"pid":  strconv.Itoa(int(event.PID)),
+		"comm": comm,
+		"prot": protString(event.Prot),
+		"addr": fmt.Sprintf("0x%x", event.Addr),
+		"size": strconv.FormatUint(event.Len, 10),
+	}
+	if file != "" {
+		labels["file"] = file
+	}
+	mt.procs.AddPIDLabels(labels, event.PID)
+	frames := mt.stacks.frames(stackRef{pid: event.PID, user: int64(event.StackID), kernel: -1})
+	if len(frames) > 0 {
+		labels["stack"] = folded(frames)
+	}
+	text := fmt.Sprintf("wx_mapping op=%s pid=%d comm=%s addr=0x%x size=%d prot=%s",
+		op, event.PID, comm, event.Addr, event.Len, protString(event.Prot))
+	if file != "" {
+		text += " file=" + file
+	}
+	mt.control.Publish(control.Event{Labels: labels, Text: text})
+	mt.router.RouteAt(event.Timestamp, labels, text)
+	mt.output.EventAt(event.Timestamp, labels, text)
+	if !mt.output.JSON() {
+		fmt.Printf("W+X Mapping: PID=%d, Op=%s, Addr=0x%x, Size=%d, Prot=%s, File=%s, Comm=%s\n",
+			event.PID, op, event.Addr, event.Len, protString(event.Prot), file, comm)
+		printFrames(frames, 8)
+	}
+	return nil
+}
+
+// wxRegion is a mapping writable and executable
+type wxRegion struct {
+	start uint64
+	MmapRegion
+}
+
+// processRegions are the mappings a process made since start
+type processRegions struct {
+	id      ProcKey
+	regions int
+	bytes   uint64
+	// byKind is the bytes mapped by regionKind, exec those executable
+	byKind map[string]uint64
+	exec   uint64
+	wx     []wxRegion
+}
+
+// readRegions returns the mappings of every process, largest first
+func (mt *MemoryTracker) readRegions() ([]*processRegions, error) {
+	m := mt.coll.Maps["region_map"]
+	if m == nil {
+		return nil, errors.New("no region_map map")
+	}
+	byProc := make(map[ProcKey]*processRegions)
+	var key RegionKey
+	var region MmapRegion
+	iter := m.Iterate()
+	for iter.Next(&key, &region) {
+		p, ok := byProc[key.Proc]
+		if !ok {
+			p = &processRegions{id: key.Proc, byKind: make(map[string]uint64)}
+			byProc[key.Proc] = p
+		}
+		p.regions++
+		p.bytes += region.Len
+		p.byKind[regionKind(region.Flags)] += region.Len
+		if region.Prot&protExec != 0 {
+			p.exec += region.Len
+		}
+		if writableExec(region.Prot) {
+			p.wx = append(p.wx, wxRegion{start: key.Start, MmapRegion: region})
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	procs := make([]*processRegions, 0, len(byProc))
+	for _, p := range byProc {
+		procs = append(procs, p)
+	}
+	sort.Slice(procs, func(i, j int) bool { return procs[i].bytes > procs[j].bytes })
+	return procs, nil
+}
+
+// printRegions prints the processes mapping the most, and every mapping
+// writable and executable
+func (mt *MemoryTracker) printRegions() {
+	procs, err := mt.readRegions()
+	if err != nil {
+		log.Printf("Warning: failed to read mapped regions: %v", err)
+		return
+	}
+	fmt.Printf("\nTop 10 processes by mapped bytes (mappings since start):\n")
+	for i, p := range procs {
+		if i == 10 {
+			break
+		}
+		fmt.Printf("  PID %d (%s): Regions=%d, Mapped=%s, Anon=%s, Shared=%s, File=%s, Exec=%s, W+X=%d\n",
+			p.id.PID, mt.procs.Name(p.id.PID), p.regions, units.Bytes(p.bytes), units.Bytes(p.byKind["anon"]),
+			units.Bytes(p.byKind["shared"]), units.Bytes(p.byKind["file"]), units.Bytes(p.exec), len(p.wx))
+	}
+	printed := false
+	for _, p := range procs {
+		for _, r := range p.wx {
+			if !printed {
+				fmt.Printf("\nWritable and executable mappings:\n")
+				printed = true
+			}
+			file := string(bytes.TrimRight(r.File[:], "\x00"))
+			if file == "" {
+				file = "[" + regionKind(r.Flags) + "]"
+			}
+			fmt.Printf("  PID %d (%s): Addr=0x%x, Size=%s, Prot=%s, %s\n",
+				p.id.PID, mt.procs.Name(p.id.PID), r.start, units.Bytes(r.Len), protString(r.Prot), file)
+		}
+	}
+}
+
+// regionSamples exports the mappings of the processes mapping the most
+func (mt *MemoryTracker) regionSamples() []query.Sample {
+	samples := []query.Sample{{Name: "memory_wx_mappings_total", Value: float64(mt.wxEvents)}}
+	procs, err := mt.readRegions()
+	if err != nil {
+		return samples
+	}
+	if len(procs) > regionExported {
+		procs = procs[:regionExported]
+	}
+	for _, p := range procs {
+		labels := query.Labels{
+			"pid":  strconv.FormatUint(uint64(p.id.PID), 10),
+			"comm": mt.procs.Name(p.id.PID),
+		}
+		mt.procs.AddPIDLabels(labels, p.id.PID)
+		samples = append(samples,
+			query.Sample{Name: "process_mapped_regions", Labels: labels, Value: float64(p.regions)},
+			query.Sample{Name: "process_mapped_executable_bytes", Labels: labels, Value: float64(p.exec)},
+			query.Sample{Name: "process_wx_mappings", Labels: labels, Value: float64(len(p.wx))},
+		)
+		for _, kind := range []string{"anon", "shared", "file"} {
+			samples = append(samples, query.Sample{Name: "process_mapped_bytes",
+				Labels: withLabel(labels, "kind", kind), Value: float64(p.byKind[kind])})
+		}
+	}
+	return samples
+}
+
+// sweepRegions drops the mappings of the processes that exited, which
+// went with them, from region_map
+func (mt *MemoryTracker) sweepRegions() {
+	m := mt.coll.Maps["region_map"]
+	if m == nil {
+		return
+	}
+	var stale []RegionKey
+	var key RegionKey
+	var region MmapRegion
+	iter := m.Iterate()
+	for iter.Next(&key, &region) {
+		if mt.exited[key.Proc] {
+			stale = append(stale, key)
+		}
+	}
+	err := iter.Err()
+	for _, k := range stale {
+		if e := m.Delete(k); e != nil && !errors.Is(e, ebpf.ErrKeyNotExist) {
+			err = e
+		}
+	}
+	if err != nil {
+		log.Printf("Warning: failed to drop mappings of exited processes: %v", err)
+	}
+}
@@ -0,0 +1,158 @@
+// Event sampling: which allocations BPF sends to userspace, so that
+// allocation-heavy workloads do not flood the ring buffer. The maps count
+// every allocation whatever is sent, and per-process totals are then read
+// from them instead of summed from events
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"probepilot/pkg/control"
+	"probepilot/pkg/limits"
+	"probepilot/pkg/maps"
+)
+
+// config_map indices
+const (
+	configSampleRate uint32 = iota
+	configMinSize
+	configAggregateOnly
+	configAlwaysSize
+)
+
+// Sampling selects the allocations sent to userspace
+type Sampling struct {
+	// Rate sends 1 in Rate allocations, and the frees of those
+	Rate uint32
+	// MinSize sends no allocation smaller
+	MinSize uint64
+	// AggregateOnly sends no allocation at all, only OOM kills
+	AggregateOnly bool
+}
+
+// validate rejects sizes config_map cannot hold
+func (s Sampling) validate() error {
+	if s.MinSize > math.MaxUint32 {
+		return fmt.Errorf("invalid -min-size %s (want at most %s)", limits.FormatSize(s.MinSize), limits.FormatSize(math.MaxUint32))
+	}
+	return nil
+}
+
+// all reports whether every allocation is sent
+func (s Sampling) all() bool {
+	return s.Rate <= 1 && s.MinSize == 0 && !s.AggregateOnly
+}
+
+func (s Sampling) String() string {
+	switch {
+	case s.AggregateOnly:
+		return "no allocations, only their totals"
+	case s.all():
+		return "every allocation"
+	}
+	desc := "allocations"
+	if s.MinSize > 0 {
+		desc += " of at least " + limits.FormatSize(s.MinSize)
+	}
+	if s.Rate > 1 {
+		desc = fmt.Sprintf("1 in %d %s", s.Rate, desc)
+	}
+	return desc
+}
+
+// configureSampling tells BPF which allocations to send. Those past the
+// smallest -large-allocs threshold are not sampled, so none is missed
+func (mt *MemoryTracker) configureSampling() error {
+	m := mt.coll.Maps["config_map"]
+	if m == nil {
+		return errors.New("no config_map map")
+	}
+	always := uint64(0)
+	if len(mt.large) > 0 {
+		always = mt.large[0].size + 1
+		if always > math.MaxUint32 {
+			always = math.MaxUint32
+		}
+	}
+	aggregateOnly := uint32(0)
+	if mt.sampling.AggregateOnly {
+		aggregateOnly = 1
+	}
+	for key, value := range map[uint32]uint32{
+		configSampleRate:    mt.sampling.Rate,
+		configMinSize:       uint32(mt.sampling.MinSize),
+		configAggregateOnly: aggregateOnly,
+		configAlwaysSize:    uint32(always),
+	} {
+		if err := m.Put(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkDrops reads the records the ring buffer dropped and, under
+// -adaptive-sampling, moves the allocation sampling rate as they call for.
+// Process totals are read from process_memory_map once allocations are
+// sampled, so only the leak candidates thin out
+func (mt *MemoryTracker) checkDrops(now time.Time) {
+	dropped, err := maps.RingbufDrops(mt.coll)
+	if err != nil {
+		log.Printf("Warning: failed to read ring buffer drops: %v", err)
+		return
+	}
+	prev := mt.sampling.Rate
+	rate, changed := mt.drops.Observe(dropped, now)
+	if !changed {
+		return
+	}
+	if err := mt.coll.Maps["config_map"].Put(configSampleRate, rate); err != nil {
+		log.Printf("Warning: failed to set sampling rate: %v", err)
+		return
+	}
+	mt.sampling.Rate = rate
+
+	labels := mt.drops.Labels(prev)
+	text := fmt.Sprintf("allocation sampling changed from 1 in %d to 1 in %d at %s ring buffer drops/s",
+		max(prev, 1), rate, labels["drops_per_sec"])
+	mt.control.Publish(control.Event{Labels: labels, Text: text})
+	mt.router.Route(labels, text)
+	mt.output.Event(labels, text)
+	if !mt.output.JSON() {
+		fmt.Printf("Sampling: %s\n", text)
+	}
+}
+
+// syncProcessStats reads the totals of every process from
+// process_memory_map, when events do not tell of every allocation
+func (mt *MemoryTracker) syncProcessStats() error {
+	m := mt.coll.Maps["process_memory_map"]
+	if m == nil {
+		return errors.New("no process_memory_map map")
+	}
+	var id ProcKey
+	var stats ProcessMemory
+	iter := m.Iterate()
+	for iter.Next(&id, &stats) {
+		// Weigh processes by bytes allocated, as events do
+		var seen uint64
+		if prev, ok := mt.processStats.Get(id); ok {
+			seen = prev.TotalAllocated
+		} else if !mt.budget.Allow() {
+			continue
+		}
+		weight := uint64(0)
+		if stats.TotalAllocated > seen {
+			weight = stats.TotalAllocated - seen
+		}
+		p := mt.processStats.Add(id, weight)
+		mt.currentUsage += stats.CurrentUsage - p.CurrentUsage
+		*p = stats
+	}
+	return iter.Err()
+}
@@ -0,0 +1,153 @@
+// Allocation stacks, read from stack_traces and symbolized on demand
+
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/cilium/ebpf"
+
+	"probepilot/pkg/symbolize"
+)
+
+// stackRef is the user and kernel stack of an event in stack_traces;
+// bpf_get_stackid failures come through as negative ids.
+type stackRef struct {
+	pid          uint32
+	user, kernel int64
+}
+
+func eventStack(event *MemoryEvent) stackRef {
+	return stackRef{pid: event.PID, user: int64(event.StackID), kernel: int64(event.KernelStackID)}
+}
+
+func (r stackRef) empty() bool {
+	return r.user < 0 && r.kernel < 0
+}
+
+// stackNames names the stacks of large allocations, leak reports and
+// captures. A stack is symbolized on first use and its name kept until
+// prune frees it, so only events worth reporting pay for symbols. It is
+// safe for concurrent use.
+type stackNames struct {
+	traces  *ebpf.Map
+	symbols *symbolize.Symbolizer
+
+	mu    sync.Mutex
+	names map[stackRef][]string
+}
+
+func newStackNames(traces *ebpf.Map, symbols *symbolize.Symbolizer) *stackNames {
+	return &stackNames{traces: traces, symbols: symbols, names: make(map[stackRef][]string)}
+}
+
+// frames names the frames of ref, leaf first, kernel frames suffixed
+// _[k]. It returns nil for events without a stack or once the stacks are
+// gone from stack_traces.
+func (s *stackNames) frames(ref stackRef) []string {
+	if ref.empty() {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if names, ok := s.names[ref]; ok {
+		return names
+	}
+	var names []string
+	for _, f := range s.symbols.ResolveKernelStack(s.read(ref.kernel)) {
+		names = append(names, f.String()+"_[k]")
+	}
+	for _, f := range s.symbols.ResolveStack(ref.pid, s.read(ref.user)) {
+		names = append(names, f.String())
+	}
+	if names != nil {
+		s.names[ref] = names
+	}
+	return names
+}
+
+func (s *stackNames) read(id int64) []uint64 {
+	if id < 0 {
+		return nil
+	}
+	var frames [maxStackDepth]uint64
+	if err := s.traces.Lookup(uint32(id), &frames); err != nil {
+		return nil
+	}
+	depth := 0
+	for depth < len(frames) && frames[depth] != 0 {
+		depth++
+	}
+	return frames[:depth]
+}
+
+// folded joins frames root first, as flame graphs take them.
+func folded(frames []string) string {
+	var b []byte
+	for i := len(frames) - 1; i >= 0; i-- {
+		b = append(b, frames[i]...)
+		if i > 0 {
+			b = append(b, ';')
+		}
+	}
+	return string(b)
+}
+
+// prune deletes the stacks in stack_traces that no id in keep refers to,
+// and their names, so the map does not fill with stacks of freed
+// allocations. Stacks of events still queued in the ring buffer may go
+// too; those events are reported without one.
+func (s *stackNames) prune(keep map[int64]bool) error {
+	var stale []uint32
+	var id uint32
+	iter := s.traces.Iterate()
+	var frames [maxStackDepth]uint64
+	for iter.Next(&id, &frames) {
+		if !keep[int64(id)] {
+			stale = append(stale, id)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	for _, id := range stale {
+		if err := s.traces.Delete(id); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ref := range s.names {
+		if (ref.user >= 0 && !keep[ref.user]) || (ref.kernel >= 0 && !keep[ref.kernel]) {
+			delete(s.names, ref)
+		}
+	}
+	return nil
+}
+
+// pruneStacks frees the stacks no tracked allocation or running capture
+// refers to.
+func (mt *MemoryTracker) pruneStacks() {
+	keep := make(map[int64]bool)
+	mt.leaks.Each(func(_ uint64, info *AllocationInfo) bool {
+		keep[int64(info.StackID)] = true
+		keep[int64(info.KernelStackID)] = true
+		return true
+	})
+	mt.captureMu.Lock()
+	for _, capture := range mt.captures {
+		capture.mu.Lock()
+		capture.stacks.Each(func(id uint64, _ *stackTotals) bool {
+			keep[int64(id)] = true
+			return true
+		})
+		capture.mu.Unlock()
+	}
+	mt.captureMu.Unlock()
+	if err := mt.stacks.prune(keep); err != nil {
+		log.Printf("Warning: failed to free stack traces: %v", err)
+	}
+}
@@ -0,0 +1,303 @@
+// Threads: under -per-thread the allocations and frees of each thread
+// are counted from the events sent to userspace, and the threads of a
+// process grouped into pools by name, e.g. worker-1 and worker-2, to find
+// the thread pool that allocates the most inside a process, and the one
+// its heap grows by
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"probepilot/pkg/query"
+	"probepilot/pkg/units"
+)
+
+// threadExported bounds the threads, and the pools, in Samples
+const threadExported = 50
+
+// threadAttributed bounds the pools a heap growth alert names
+const threadAttributed = 3
+
+// threadKey is a thread of a process
+type threadKey struct {
+	proc ProcKey
+	tid  uint32
+}
+
+// threadStats are the allocations of a thread. Frees are those the thread
+// made, whoever allocated; live is what the thread allocated that was not
+// freed yet, by any thread, and growth how much live changed over the
+// last report interval, from reported at the report before
+type threadStats struct {
+	name       string
+	allocs     uint64
+	allocBytes uint64
+	frees      uint64
+	freedBytes uint64
+	live       uint64
+	growth     int64
+	reported   uint64
+}
+
+// threadPool names the pool of a thread: its name without the number
+// telling it apart from its siblings, e.g. "pool-3-thread" for
+// "pool-3-thread-7" and "worker" for "worker:12"
+func threadPool(name string) string {
+	pool := strings.TrimRight(name, "0123456789")
+	if pool == name {
+		return name
+	}
+	pool = strings.TrimRight(pool, "-_:#./ ")
+	if pool == "" {
+		return name
+	}
+	return pool
+}
+
+// observeThread counts an allocation or free against the thread that
+// made it; frees of threads not tracked are not counted, so that they do
+// not push out the threads allocating
+func (mt *MemoryTracker) observeThread(event *MemoryEvent, name string) {
+	if mt.threads == nil || event.StartTime == 0 {
+		return
+	}
+	key := threadKey{proc: ProcKey{PID: event.PID, StartTime: event.StartTime}, tid: event.TID}
+	switch event.Type {
+	case AllocFree, AllocDelete, AllocMunmap:
+		if t, ok := mt.threads.Get(key); ok {
+			t.frees++
+			t.freedBytes += event.Size
+		}
+	default:
+		t := mt.threads.Add(key, event.Size)
+		t.name = name
+		t.allocs++
+		t.allocBytes += event.Size
+		t.live += event.Size
+	}
+}
+
+// releaseThread takes a freed allocation off the live bytes of the thread
+// that made it
+func (mt *MemoryTracker) releaseThread(info *AllocationInfo) {
+	if mt.threads == nil {
+		return
+	}
+	if t, ok := mt.threads.Get(threadKey{proc: info.proc(), tid: info.TID}); ok && t.live >= info.Size {
+		t.live -= info.Size
+	}
+}
+
+// evictThreads drops the threads of a process that is gone
+func (mt *MemoryTracker) evictThreads(id ProcKey) {
+	if mt.threads == nil {
+		return
+	}
+	var gone []threadKey
+	mt.threads.Each(func(key threadKey, _ *threadStats) bool {
+		if key.proc == id {
+			gone = append(gone, key)
+		}
+		return true
+	})
+	for _, key := range gone {
+		mt.threads.Remove(key)
+	}
+}
+
+// sampleThreads measures the growth of every thread's live bytes since
+// the last report; a thread new since grew by all it holds
+func (mt *MemoryTracker) sampleThreads() {
+	if mt.threads == nil {
+		return
+	}
+	mt.threads.Each(func(_ threadKey, t *threadStats) bool {
+		t.growth = int64(t.live) - int64(t.reported)
+		t.reported = t.live
+		return true
+	})
+}
+
+// threadPoolStats are the allocations of the threads of a pool in a
+// process
+type threadPoolStats struct {
+	proc    ProcKey
+	name    string
+	threads int
+	threadStats
+}
+
+// topThreadPools returns the n pools allocating the most bytes
+func (mt *MemoryTracker) topThreadPools(n int) []*threadPoolStats {
+	top := mt.threadPools(nil)
+	sort.Slice(top, func(i, j int) bool { return top[i].allocBytes > top[j].allocBytes })
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// threadPools sums the threads of each pool, of the processes keep
+// selects, or of all if nil
+func (mt *MemoryTracker) threadPools(keep func(ProcKey) bool) []*threadPoolStats {
+	type poolKey struct {
+		proc ProcKey
+		name string
+	}
+	pools := make(map[poolKey]*threadPoolStats)
+	mt.threads.Each(func(key threadKey, t *threadStats) bool {
+		if keep != nil && !keep(key.proc) {
+			return true
+		}
+		k := poolKey{proc: key.proc, name: threadPool(t.name)}
+		p, ok := pools[k]
+		if !ok {
+			p = &threadPoolStats{proc: key.proc, name: k.name}
+			pools[k] = p
+		}
+		p.threads++
+		p.allocs += t.allocs
+		p.allocBytes += t.allocBytes
+		p.frees += t.frees
+		p.freedBytes += t.freedBytes
+		p.live += t.live
+		p.growth += t.growth
+		return true
+	})
+	all := make([]*threadPoolStats, 0, len(pools))
+	for _, p := range pools {
+		all = append(all, p)
+	}
+	return all
+}
+
+// growingThreads returns the n threads whose live bytes grew the most over
+// the last report interval
+func (mt *MemoryTracker) growingThreads(n int) []threadKey {
+	var keys []threadKey
+	mt.threads.Each(func(key threadKey, t *threadStats) bool {
+		if t.growth > 0 {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	sort.Slice(keys, func(i, j int) bool {
+		a, _ := mt.threads.Get(keys[i])
+		b, _ := mt.threads.Get(keys[j])
+		return a.growth > b.growth
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
+
+// growthAttribution names the pools of threads in process id holding the
+// most live bytes, those its heap grew by, or "" without -per-thread
+func (mt *MemoryTracker) growthAttribution(id ProcKey) string {
+	if mt.threads == nil {
+		return ""
+	}
+	pools := mt.threadPools(func(proc ProcKey) bool { return proc == id })
+	sort.Slice(pools, func(i, j int) bool { return pools[i].live > pools[j].live })
+	var parts []string
+	for _, p := range pools {
+		if len(parts) == threadAttributed || p.live == 0 {
+			break
+		}
+		parts = append(parts, fmt.Sprintf("%s (%d threads) %s live, %s over the last report", p.name, p.threads, units.Bytes(p.live), signedBytes(p.growth)))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "; held by threads " + strings.Join(parts, ", ")
+}
+
+// signedBytes renders a change of n bytes, e.g. "+1.5MB" or "-512B"
+func signedBytes(n int64) string {
+	if n < 0 {
+		return "-" + units.Bytes(uint64(-n))
+	}
+	return "+" + units.Bytes(uint64(n))
+}
+
+// printThreads prints the threads and thread pools allocating the most
+func (mt *MemoryTracker) printThreads() {
+	if mt.threads == nil {
+		return
+	}
+	fmt.Printf("\nHottest allocating threads (of %d tracked):\n", mt.threads.Len())
+	for _, it := range mt.threads.Top(10) {
+		t := it.Value
+		fmt.Printf("  PID %d (%s) TID %d (%s): Allocs=%d, Allocated=%s, Live=%s, Frees=%d, Freed=%s%s\n",
+			it.Key.proc.PID, mt.procs.Name(it.Key.proc.PID), it.Key.tid, t.name, t.allocs,
+			units.Bytes(t.allocBytes), units.Bytes(t.live), t.frees, units.Bytes(t.freedBytes), mt.processShare(it.Key.proc, t.allocBytes))
+	}
+	if keys := mt.growingThreads(10); len(keys) > 0 {
+		fmt.Printf("\nThreads growing the most over the last report:\n")
+		for _, key := range keys {
+			t, _ := mt.threads.Get(key)
+			fmt.Printf("  PID %d (%s) TID %d (%s): Growth=%s, Live=%s, Allocated=%s\n",
+				key.proc.PID, mt.procs.Name(key.proc.PID), key.tid, t.name, signedBytes(t.growth),
+				units.Bytes(t.live), units.Bytes(t.allocBytes))
+		}
+	}
+	fmt.Printf("\nHottest allocating thread pools:\n")
+	for _, p := range mt.topThreadPools(10) {
+		fmt.Printf("  PID %d (%s) %s (%d threads): Allocs=%d, Allocated=%s, Live=%s (%s), Frees=%d, Freed=%s%s\n",
+			p.proc.PID, mt.procs.Name(p.proc.PID), p.name, p.threads, p.allocs,
+			units.Bytes(p.allocBytes), units.Bytes(p.live), signedBytes(p.growth), p.frees, units.Bytes(p.freedBytes), mt.processShare(p.proc, p.allocBytes))
+	}
+}
+
+// processShare describes bytes as a share of what the process allocated,
+// or "" if its totals are not known
+func (mt *MemoryTracker) processShare(id ProcKey, bytes uint64) string {
+	stats, ok := mt.processStats.Get(id)
+	if !ok || stats.TotalAllocated == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (%.0f%% of the process)", float64(bytes)*100/float64(stats.TotalAllocated))
+}
+
+// threadSamples exports the threads and thread pools allocating the most
+func (mt *MemoryTracker) threadSamples() []query.Sample {
+	if mt.threads == nil {
+		return nil
+	}
+	var samples []query.Sample
+	for _, it := range mt.threads.Top(threadExported) {
+		t := it.Value
+		labels := query.Labels{
+			"pid":    strconv.FormatUint(uint64(it.Key.proc.PID), 10),
+			"comm":   mt.procs.Name(it.Key.proc.PID),
+			"tid":    strconv.FormatUint(uint64(it.Key.tid), 10),
+			"thread": t.name,
+		}
+		samples = append(samples,
+			query.Sample{Name: "thread_allocations_total", Labels: labels, Value: float64(t.allocs)},
+			query.Sample{Name: "thread_allocated_bytes_total", Labels: labels, Value: float64(t.allocBytes)},
+			query.Sample{Name: "thread_freed_bytes_total", Labels: labels, Value: float64(t.freedBytes)},
+			query.Sample{Name: "thread_live_bytes", Labels: labels, Value: float64(t.live)},
+			query.Sample{Name: "thread_live_growth_bytes", Labels: labels, Value: float64(t.growth)},
+		)
+	}
+	for _, p := range mt.topThreadPools(threadExported) {
+		labels := query.Labels{
+			"pid":  strconv.FormatUint(uint64(p.proc.PID), 10),
+			"comm": mt.procs.Name(p.proc.PID),
+			"pool": p.name,
+		}
+		samples = append(samples,
+			query.Sample{Name: "thread_pool_threads", Labels: labels, Value: float64(p.threads)},
+			query.Sample{Name: "thread_pool_allocated_bytes_total", Labels: labels, Value: float64(p.allocBytes)},
+			query.Sample{Name: "thread_pool_live_bytes", Labels: labels, Value: float64(p.live)},
+			query.Sample{Name: "thread_pool_live_growth_bytes", Labels: labels, Value: float64(p.growth)},
+		)
+	}
+	return samples
+}
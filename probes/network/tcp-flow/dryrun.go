@@ -0,0 +1,158 @@
+// Dry run: the monitor's attach plan, printed instead of running
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/cilium/ebpf"
+
+	"probepilot/pkg/attach"
+	"probepilot/pkg/core"
+	"probepilot/pkg/expr"
+	"probepilot/pkg/layout"
+	"probepilot/pkg/otlp"
+	"probepilot/pkg/output"
+	"probepilot/pkg/plan"
+	"probepilot/pkg/probe"
+	"probepilot/pkg/profile"
+	"probepilot/pkg/route"
+	"probepilot/pkg/sampling"
+	"probepilot/pkg/summary"
+	"probepilot/pkg/tsdb"
+)
+
+// dryRunPlan verifies the programs and prints what the monitor would
+// attach and export under config, then exits without attaching anything
+func dryRunPlan(run *summary.Run, config Config, routes, listen, controlSocket string, out output.Options, otlpMetrics string, otlpLogs *route.Tap, hook route.HookConfig, filter *expr.Program, coalesce route.CoalesceConfig) {
+	p := plan.New("tcp-flow", config.Profile)
+	if err := p.Routes(routes); err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+
+	spec, err := ebpf.LoadCollectionSpec(probe.Object("tcp_flow.o"))
+	if err != nil {
+		run.Fatal(summary.StageLoad, "Failed to load eBPF spec: %v", err)
+	}
+	if err := layout.ValidateAll(spec.Types, layoutChecks...); err != nil && !errors.Is(err, layout.ErrNoBTF) {
+		run.Fatal(summary.StageLoad, "tcp_flow.o does not match agent structs (rebuild both): %v", err)
+	}
+	if err := config.Limits.ApplySpec(spec); err != nil {
+		run.Fatal(summary.StageConfig, "Invalid map limits: %v", err)
+	}
+	attach.Prepare(spec, config.AttachMode, kernelFuncs)
+	kernel, err := core.Detect(config.KernelBTF)
+	if err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	if err := kernel.Err(); err != nil {
+		run.Fatal(summary.StageLoad, "Cannot run TCP flow monitor: %v", err)
+	}
+	dropped, err := kernel.Prepare(spec, requiredPrograms...)
+	if err != nil {
+		run.Fatal(summary.StageLoad, "Failed to load eBPF programs: %v", fmt.Errorf("tcp_flow.o cannot run on %s: %w", kernel, err))
+	}
+	p.Core(kernel, dropped)
+	p.Verify("tcp_flow.o", spec, kernel.Options())
+
+	p.Hooks = append(p.Hooks,
+		plan.Hook{Kind: "tracepoint", Target: "sock/inet_sock_set_state", Program: "trace_tcp_state_change", Enabled: true, Cost: plan.Medium},
+		plan.Hook{Kind: "tracepoint", Target: "tcp/tcp_probe", Program: "trace_tcp_probe", Enabled: true, Cost: plan.Medium},
+		plan.Hook{Kind: "tracepoint", Target: "tcp/tcp_retransmit_skb", Program: "trace_tcp_retransmit", Enabled: true, Cost: plan.Low},
+		plan.Hook{Kind: "tracepoint", Target: "sched/sched_process_exit", Program: "trace_sched_process_exit", Enabled: true, Cost: plan.Low},
+	)
+
+	// Sampling drops events in the kernel, after the hook ran but before
+	// the ring buffer; the receive hooks stay idle without trace context
+	if config.SamplingRate == 0 {
+		config.SamplingRate = 1
+	}
+	var dataFuncs, recvFuncs []attach.KernelFunc
+	for _, fn := range kernelFuncs {
+		if fn.Symbol == "tcp_recvmsg" {
+			recvFuncs = append(recvFuncs, fn)
+		} else {
+			dataFuncs = append(dataFuncs, fn)
+		}
+	}
+	dataCost, recvCost := plan.High, plan.Low
+	if config.SamplingRate > 1 {
+		dataCost = plan.Medium
+	}
+	if config.TraceContext {
+		recvCost = plan.Medium
+	}
+	enabled := config.Profile.Enabled(profile.HookTCPData)
+	p.Hooks = append(p.Hooks, plan.KernelHooks(profile.HookTCPData, config.AttachMode, dataFuncs, enabled, dataCost)...)
+	p.Hooks = append(p.Hooks, plan.KernelHooks(profile.HookTCPData, config.AttachMode, recvFuncs, enabled, recvCost)...)
+
+	p.Filter("sampling", fmt.Sprintf("1 in %d send/receive events", config.SamplingRate))
+	if config.TraceContext {
+		p.Filter("trace context", "first bytes of received HTTP requests")
+	}
+	if config.Services != nil {
+		p.Filter("services", config.Services.String()+", traffic summed per pair of services (userspace)")
+	}
+	if config.Policy != nil {
+		p.Filter("policy", fmt.Sprintf("%d allow rules, other connections raise policy_violation", len(config.Policy.Allow)))
+	}
+	if len(config.FilterPorts) > 0 {
+		p.Filter("ports", fmt.Sprintf("%v, local or remote (userspace)", config.FilterPorts))
+	}
+	if config.Targets != nil {
+		p.Filter("targets", config.Targets.String()+" (every probe, inside BPF)")
+	}
+	if config.SocketRescan > 0 {
+		p.Filter("socket owners", fmt.Sprintf("events without process context credited to their socket's process, /proc rescanned at most every %v", config.SocketRescan))
+	}
+	if config.Queue != nil {
+		p.Filter("event queue", fmt.Sprintf("%d records, sends, receives and payloads shed first, connection state changes never", config.Queue.Stats().Capacity))
+	}
+	if config.AdaptiveSampling > 0 {
+		p.Filter("adaptive sampling", fmt.Sprintf("send/receive sampling doubled from 1 in %d, up to 1 in %d, while the ring buffer drops over %v records/s", max(config.SamplingRate, 1), sampling.MaxAdaptiveRate, config.AdaptiveSampling))
+	}
+	p.Filter("interfaces", fmt.Sprintf("traffic by interface and overlay, at most %d interfaces, names from rtnetlink and /proc/<pid>/net/igmp", maxInterfaces))
+	if listen != "" {
+		p.Export("query API", listen)
+		p.Export("Grafana datasource", tsdb.GrafanaPath+" on "+listen)
+	}
+	if controlSocket != "" {
+		p.Export("control socket", controlSocket)
+	}
+	switch out.Format {
+	case output.JSON:
+		p.Export("JSON lines", out.Destination())
+	case output.Binary:
+		p.Export("binary event log", out.Destination())
+	}
+	if otlpMetrics != "" {
+		url, err := otlp.SignalURL(otlpMetrics, otlp.MetricsPath)
+		if err != nil {
+			run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+		}
+		p.Export("OTLP metrics", url)
+	}
+	if otlpLogs != nil {
+		p.Export("OTLP logs", otlpLogs.String())
+	}
+	if hook.Module != "" {
+		p.Filter("event hook", hook.String()+" (before routing)")
+	}
+	if filter != nil {
+		p.Filter("event filter", filter.String()+" (before routing)")
+	}
+	if coalesce.Window > 0 {
+		p.Filter("event coalescing", coalesce.String()+" (before routing)")
+	}
+
+	if err := p.Write(os.Stdout); err != nil {
+		run.Fatal(summary.StageRun, "Failed to print the plan: %v", err)
+	}
+	if err := p.Err(); err != nil {
+		run.Fatal(summary.StageLoad, "eBPF programs failed verification: %v", err)
+	}
+	run.Finish()
+	os.Exit(0)
+}
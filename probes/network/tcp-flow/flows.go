@@ -0,0 +1,177 @@
+// Connections: the flows of both directions merged into one record
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"probepilot/pkg/decode"
+	"probepilot/pkg/query"
+	"probepilot/pkg/sampling"
+	"probepilot/pkg/tracecontext"
+	"probepilot/pkg/units"
+)
+
+// Directions of a connection relative to its canonical key
+const (
+	forward = 0 // from the key's source to its destination
+	reverse = 1 // back
+)
+
+var directionNames = [2]string{"forward", "reverse"}
+
+// canonicalKey returns the key of the connection between two endpoints,
+// the same whichever of them an event was seen from: the lower address
+// and port is the source. dir is the direction from (saddr, sport) to
+// (daddr, dport) under that key.
+func canonicalKey(saddr, daddr uint32, sport, dport uint16) (key FlowKey, dir int) {
+	if saddr > daddr || (saddr == daddr && sport > dport) {
+		return FlowKey{SAddr: daddr, DAddr: saddr, SPort: dport, DPort: sport, Protocol: 6}, reverse
+	}
+	return FlowKey{SAddr: saddr, DAddr: daddr, SPort: sport, DPort: dport, Protocol: 6}, forward
+}
+
+// flowState is the tracked state of one connection: a breakdown by
+// direction and the trace context of its latest request
+type flowState struct {
+	FirstSeen uint64
+	LastSeen  uint64
+	dirs      [2]flowDirection
+	trace     *tracecontext.TraceContext
+}
+
+// flowDirection is what is known of the data going one way. The sender's
+// socket sees it sent and measures its RTT and retransmits; the
+// receiver's socket sees it received. Both are seen when the two ends
+// are on this host, so the direction's volume is the larger of the two
+// rather than their sum
+type flowDirection struct {
+	sent, received sampling.Counter
+	retransmits    uint64
+	rttSamples     uint32
+	rttTotal       uint64
+}
+
+// bytes and packets estimate the data of the direction at rate
+func (d *flowDirection) bytes(rate uint32) sampling.Estimate {
+	return larger(sampling.SumEstimate(d.sent, rate), sampling.SumEstimate(d.received, rate))
+}
+
+func (d *flowDirection) packets(rate uint32) sampling.Estimate {
+	return larger(sampling.CountEstimate(d.sent, rate), sampling.CountEstimate(d.received, rate))
+}
+
+func larger(a, b sampling.Estimate) sampling.Estimate {
+	if b.Value > a.Value {
+		return b
+	}
+	return a
+}
+
+// rttAvg is the average smoothed RTT of the direction
+func (d *flowDirection) rttAvg() time.Duration {
+	return srtt(float64(d.rttTotal) / float64(d.rttSamples))
+}
+
+// srtt converts a smoothed RTT as the kernel keeps it, microseconds
+// shifted left by 3, to a duration
+func srtt(v float64) time.Duration {
+	return time.Duration(v / 8 * float64(time.Microsecond))
+}
+
+func (f *flowState) retransmits() uint64 {
+	return f.dirs[forward].retransmits + f.dirs[reverse].retransmits
+}
+
+// update accounts a send, receive, retransmit or RTT sample seen from
+// the socket of (saddr, sport), going dir under the connection's key
+func (f *flowState) update(event *TCPEvent, dir int) {
+	f.LastSeen = event.Timestamp
+	// The socket's sends and RTT are of data leaving it; its receives
+	// are of data coming back
+	out := &f.dirs[dir]
+	switch event.EventType {
+	case 3: // Send
+		out.sent.Add(float64(event.Bytes))
+	case 4: // Receive
+		f.dirs[1-dir].received.Add(float64(event.Bytes))
+	case 6: // Retransmit
+		out.retransmits++
+	}
+	if event.RTT > 0 {
+		out.rttSamples++
+		out.rttTotal += uint64(event.RTT)
+	}
+}
+
+// flowLabels are the labels of a connection's samples
+func flowLabels(key FlowKey) query.Labels {
+	return query.Labels{
+		"saddr": decode.IPv4(key.SAddr).String(),
+		"daddr": decode.IPv4(key.DAddr).String(),
+		"sport": strconv.Itoa(int(key.SPort)),
+		"dport": strconv.Itoa(int(key.DPort)),
+	}
+}
+
+// flowSamples exports a connection: tx is its forward data, saddr to
+// daddr, and rx its reverse data; the RTT and retransmits of each
+// direction are broken out by a direction label
+func flowSamples(key FlowKey, flow *flowState, rate uint32) []query.Sample {
+	labels := flowLabels(key)
+	fwd, rev := &flow.dirs[forward], &flow.dirs[reverse]
+	// Byte and packet counts come from sampled events
+	samples := sampling.Samples("tcp_flow_bytes_tx", labels, fwd.bytes(rate))
+	samples = append(samples, sampling.Samples("tcp_flow_bytes_rx", labels, rev.bytes(rate))...)
+	samples = append(samples, sampling.Samples("tcp_flow_packets_tx", labels, fwd.packets(rate))...)
+	samples = append(samples, sampling.Samples("tcp_flow_packets_rx", labels, rev.packets(rate))...)
+	if n := flow.retransmits(); n > 0 {
+		samples = append(samples, query.Sample{Name: "tcp_flow_retransmits_total", Labels: labels, Value: float64(n)})
+	}
+	var rttSamples uint32
+	var rttTotal uint64
+	for dir := range flow.dirs {
+		d := &flow.dirs[dir]
+		rttSamples += d.rttSamples
+		rttTotal += d.rttTotal
+		dirLabels := flowLabels(key)
+		dirLabels["direction"] = directionNames[dir]
+		if d.retransmits > 0 {
+			samples = append(samples, query.Sample{Name: "tcp_flow_direction_retransmits_total", Labels: dirLabels, Value: float64(d.retransmits)})
+		}
+		if d.rttSamples > 0 {
+			samples = append(samples, query.Sample{Name: "tcp_flow_direction_rtt_avg_seconds", Labels: dirLabels, Value: d.rttAvg().Seconds()})
+		}
+	}
+	if rttSamples > 0 {
+		samples = append(samples, query.Sample{
+			Name:   "tcp_flow_rtt_avg_seconds",
+			Labels: labels,
+			Value:  srtt(float64(rttTotal) / float64(rttSamples)).Seconds(),
+		})
+	}
+	return samples
+}
+
+// printFlows logs the n busiest connections with their directions
+func (m *TCPFlowMonitor) printFlows(n int) {
+	rate := m.config.SamplingRate
+	for _, item := range m.flows.Top(n) {
+		key, flow := item.Key, item.Value
+		log.Printf("  %s:%d <-> %s:%d", decode.IPv4(key.SAddr), key.SPort, decode.IPv4(key.DAddr), key.DPort)
+		for dir, arrow := range [2]string{"->", "<-"} {
+			d := &flow.dirs[dir]
+			line := fmt.Sprintf("    %s %s in %.0f packets", arrow, units.Bytes(uint64(d.bytes(rate).Value)), d.packets(rate).Value)
+			if d.rttSamples > 0 {
+				line += ", RTT " + units.Duration(d.rttAvg())
+			}
+			if d.retransmits > 0 {
+				line += fmt.Sprintf(", %d retransmits", d.retransmits)
+			}
+			log.Print(line)
+		}
+	}
+}
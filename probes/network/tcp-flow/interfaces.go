@@ -0,0 +1,155 @@
+// Interfaces: every event carries the interface its socket's traffic goes
+// through, and the socket's network namespace. Traffic is broken down by
+// interface, named by netif, and by the overlay the interface is part of,
+// a VLAN or a VXLAN or Geneve tunnel, so traffic through the tunnels of a
+// Kubernetes node is told apart from the rest
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+
+	"probepilot/pkg/netif"
+	"probepilot/pkg/query"
+	"probepilot/pkg/sampling"
+	"probepilot/pkg/units"
+)
+
+// maxInterfaces bounds the interfaces traffic is broken down by, each pod
+// of a node having its own
+const maxInterfaces = 1024
+
+// ifaceStats is the traffic through an interface
+type ifaceStats struct {
+	iface netif.Interface
+	// named is set once the interface was resolved
+	named                    bool
+	sent, received           sampling.Counter
+	connections, retransmits uint64
+}
+
+// name is the interface's name, or "if<index>" until it is resolved
+func (s *ifaceStats) name() string {
+	if s.named {
+		return s.iface.Name
+	}
+	return "if" + strconv.FormatUint(uint64(s.iface.Index), 10)
+}
+
+// observeInterface accounts an event to its interface, returning its
+// stats, or nil if the interface is not known or not tracked
+func (m *TCPFlowMonitor) observeInterface(event *TCPEvent) *ifaceStats {
+	if event.IfIndex == 0 {
+		return nil
+	}
+	key := netif.Key{NetNS: event.NetNS, Index: event.IfIndex}
+	s, ok := m.ifaces[key]
+	if !ok {
+		if len(m.ifaces) >= maxInterfaces {
+			m.stats.InterfacesDropped++
+			return nil
+		}
+		s = &ifaceStats{iface: netif.Interface{Index: event.IfIndex}}
+		m.ifaces[key] = s
+	}
+	if !s.named {
+		if iface, ok := m.netifs.Lookup(key, event.PID); ok {
+			s.iface, s.named = iface, true
+		}
+	}
+	switch event.EventType {
+	case 1, 2: // Connect, accept
+		s.connections++
+	case 3: // Send
+		s.sent.Add(float64(event.Bytes))
+	case 4: // Receive
+		s.received.Add(float64(event.Bytes))
+	case 6: // Retransmit
+		s.retransmits++
+	}
+	return s
+}
+
+// addInterfaceLabels labels an event with its interface and overlay
+func (m *TCPFlowMonitor) addInterfaceLabels(labels query.Labels, key netif.Key, s *ifaceStats) {
+	labels["interface"] = s.name()
+	if key.NetNS != m.netifs.Own() {
+		labels["netns"] = strconv.FormatUint(uint64(key.NetNS), 10)
+	}
+	if kind, id := s.iface.Overlay(); kind != "" {
+		labels["overlay"] = kind
+		labels["overlay_id"] = strconv.FormatUint(uint64(id), 10)
+	}
+}
+
+// interfaceSamples exports the traffic of every interface, and of every
+// overlay
+func (m *TCPFlowMonitor) interfaceSamples(rate uint32) []query.Sample {
+	type overlayKey struct {
+		kind string
+		id   uint32
+	}
+	overlays := make(map[overlayKey]*ifaceStats)
+	var samples []query.Sample
+	for key, s := range m.ifaces {
+		labels := query.Labels{"ifindex": strconv.FormatUint(uint64(key.Index), 10)}
+		m.addInterfaceLabels(labels, key, s)
+		samples = append(samples, sampling.Samples("tcp_interface_bytes_tx", labels, sampling.SumEstimate(s.sent, rate))...)
+		samples = append(samples, sampling.Samples("tcp_interface_bytes_rx", labels, sampling.SumEstimate(s.received, rate))...)
+		samples = append(samples,
+			query.Sample{Name: "tcp_interface_connections_total", Labels: labels, Value: float64(s.connections)},
+			query.Sample{Name: "tcp_interface_retransmits_total", Labels: labels, Value: float64(s.retransmits)},
+		)
+		if kind, id := s.iface.Overlay(); kind != "" {
+			o, ok := overlays[overlayKey{kind, id}]
+			if !ok {
+				o = &ifaceStats{}
+				overlays[overlayKey{kind, id}] = o
+			}
+			o.sent.Merge(s.sent)
+			o.received.Merge(s.received)
+			o.connections += s.connections
+		}
+	}
+	for key, o := range overlays {
+		labels := query.Labels{"overlay": key.kind, "overlay_id": strconv.FormatUint(uint64(key.id), 10)}
+		samples = append(samples, sampling.Samples("tcp_overlay_bytes_tx", labels, sampling.SumEstimate(o.sent, rate))...)
+		samples = append(samples, sampling.Samples("tcp_overlay_bytes_rx", labels, sampling.SumEstimate(o.received, rate))...)
+		samples = append(samples, query.Sample{Name: "tcp_overlay_connections_total", Labels: labels, Value: float64(o.connections)})
+	}
+	return samples
+}
+
+// printInterfaces logs the traffic of the n busiest interfaces
+func (m *TCPFlowMonitor) printInterfaces(n int) {
+	type entry struct {
+		key netif.Key
+		*ifaceStats
+	}
+	busiest := make([]entry, 0, len(m.ifaces))
+	for key, s := range m.ifaces {
+		busiest = append(busiest, entry{key, s})
+	}
+	sort.Slice(busiest, func(i, j int) bool {
+		return busiest[i].sent.Sum+busiest[i].received.Sum > busiest[j].sent.Sum+busiest[j].received.Sum
+	})
+	if len(busiest) > n {
+		busiest = busiest[:n]
+	}
+	rate := m.config.SamplingRate
+	for _, e := range busiest {
+		name := e.name()
+		if kind, id := e.iface.Overlay(); kind != "" {
+			name += fmt.Sprintf(" (%s %d)", kind, id)
+		}
+		if e.key.NetNS != m.netifs.Own() {
+			name += fmt.Sprintf(" in netns %d", e.key.NetNS)
+		}
+		log.Printf("  %s: tx %s, rx %s, %d connections, %d retransmits", name,
+			units.Bytes(uint64(sampling.SumEstimate(e.sent, rate).Value)),
+			units.Bytes(uint64(sampling.SumEstimate(e.received, rate).Value)), e.connections, e.retransmits)
+	}
+}
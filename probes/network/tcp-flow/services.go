@@ -0,0 +1,131 @@
+// Services: with -services, both ends of every event are named after the
+// service they belong to, by port, address or the container labels of
+// the local process, and traffic is summed per pair of services in the
+// direction it flows, a service-level traffic matrix in place of the
+// list of connections
+
+package main
+
+import (
+	"log"
+	"sort"
+
+	"probepilot/pkg/decode"
+	"probepilot/pkg/query"
+	"probepilot/pkg/sampling"
+	"probepilot/pkg/service"
+	"probepilot/pkg/target"
+	"probepilot/pkg/units"
+)
+
+// maxServiceLabels bounds the processes whose container labels are
+// cached; the cache starts over once full, so recycled PIDs do not keep
+// the labels of the process they were before for long
+const maxServiceLabels = 4096
+
+// servicePair is an edge of the traffic matrix: data, connections and
+// retransmits going from src to dst
+type servicePair struct {
+	src, dst string
+}
+
+// serviceStats is the traffic of a pair of services
+type serviceStats struct {
+	bytes                    sampling.Counter
+	connections, retransmits uint64
+}
+
+// observeServices accounts an event to the pair of services it goes
+// between, returning the services of its local and remote ends
+func (m *TCPFlowMonitor) observeServices(event *TCPEvent) (local, remote string) {
+	local = m.config.Services.Name(service.Endpoint{
+		Addr:   decode.Addr4(event.SAddr),
+		Port:   event.SPort,
+		Labels: m.containerLabels(event.PID),
+	})
+	remote = m.config.Services.Name(service.Endpoint{
+		Addr: decode.Addr4(event.DAddr),
+		Port: event.DPort,
+	})
+
+	// Connections and sends go from the local end, receives and accepted
+	// connections come to it
+	pair := servicePair{local, remote}
+	if event.EventType == 2 || event.EventType == 4 {
+		pair = servicePair{remote, local}
+	}
+	s, ok := m.services[pair]
+	if !ok {
+		s = &serviceStats{}
+		m.services[pair] = s
+	}
+	switch event.EventType {
+	case 1, 2: // Connect, accept
+		s.connections++
+	case 3, 4: // Send, receive
+		s.bytes.Add(float64(event.Bytes))
+	case 6: // Retransmit
+		s.retransmits++
+	}
+	return local, remote
+}
+
+// containerLabels returns the labels of pid's container, or nil if no
+// service is named by labels
+func (m *TCPFlowMonitor) containerLabels(pid uint32) map[string]string {
+	if !m.config.Services.NeedsLabels() || pid == 0 {
+		return nil
+	}
+	if labels, ok := m.serviceLabels[pid]; ok {
+		return labels
+	}
+	if len(m.serviceLabels) >= maxServiceLabels {
+		clear(m.serviceLabels)
+	}
+	var labels map[string]string
+	if p := m.procs.Get(pid); p != nil {
+		if id := target.ContainerID(p.Cgroup); id != "" {
+			labels = m.containers.Get(id)
+		}
+	}
+	m.serviceLabels[pid] = labels
+	return labels
+}
+
+// serviceSamples exports the traffic matrix
+func (m *TCPFlowMonitor) serviceSamples(rate uint32) []query.Sample {
+	var samples []query.Sample
+	for pair, s := range m.services {
+		labels := query.Labels{"src_service": pair.src, "dst_service": pair.dst}
+		samples = append(samples, sampling.Samples("tcp_service_bytes", labels, sampling.SumEstimate(s.bytes, rate))...)
+		samples = append(samples,
+			query.Sample{Name: "tcp_service_connections_total", Labels: labels, Value: float64(s.connections)},
+			query.Sample{Name: "tcp_service_retransmits_total", Labels: labels, Value: float64(s.retransmits)},
+		)
+	}
+	return samples
+}
+
+// printServices logs the n busiest pairs of services
+func (m *TCPFlowMonitor) printServices(n int) {
+	pairs := make([]servicePair, 0, len(m.services))
+	for pair := range m.services {
+		pairs = append(pairs, pair)
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		a, b := m.services[pairs[i]], m.services[pairs[j]]
+		if a.bytes.Sum != b.bytes.Sum {
+			return a.bytes.Sum > b.bytes.Sum
+		}
+		return a.connections > b.connections
+	})
+	if len(pairs) > n {
+		pairs = pairs[:n]
+	}
+	rate := m.config.SamplingRate
+	for _, pair := range pairs {
+		s := m.services[pair]
+		log.Printf("  %s -> %s: %s, %d connections, %d retransmits", pair.src, pair.dst,
+			units.Bytes(uint64(sampling.SumEstimate(s.bytes, rate).Value)), s.connections, s.retransmits)
+	}
+}
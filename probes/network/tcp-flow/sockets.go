@@ -0,0 +1,43 @@
+// Socket owners: state changes, retransmits and ACK-clocked probes run in
+// softirq and timers, on behalf of whichever task they interrupted, so
+// their events are credited to the process owning the socket instead
+
+package main
+
+import (
+	"net/netip"
+
+	"probepilot/pkg/decode"
+	"probepilot/pkg/sockmap"
+)
+
+// socketOf is the socket an event was raised on, from our side
+func socketOf(event *TCPEvent) sockmap.Tuple {
+	return sockmap.Tuple{
+		Proto:  sockmap.TCP,
+		Local:  netip.AddrPortFrom(decode.Addr4(event.SAddr), event.SPort),
+		Remote: netip.AddrPortFrom(decode.Addr4(event.DAddr), event.DPort),
+	}
+}
+
+// contextless reports whether the event may have been raised outside
+// the owner's context: every event but the sends and receives of
+// tcp_sendmsg and tcp_cleanup_rbuf, and any event of the idle task
+func contextless(event *TCPEvent) bool {
+	return event.PID == 0 || (event.EventType != 3 && event.EventType != 4)
+}
+
+// attribute replaces the PID and comm of an event without process
+// context with those of its socket's owner, when one is found
+func (m *TCPFlowMonitor) attribute(event *TCPEvent) {
+	if m.sockets == nil || !contextless(event) {
+		return
+	}
+	owner, ok := m.sockets.Lookup(socketOf(event))
+	if !ok {
+		return
+	}
+	event.PID = owner.PID
+	event.Comm = [16]byte{}
+	copy(event.Comm[:], owner.Comm)
+}
@@ -7,6 +7,7 @@
  * - Data transfer rates
  * - Connection teardown
  * - Latency measurements
+ * - Optionally, the start of HTTP requests, for trace context headers
  */
 
 #include <vmlinux.h>
@@ -14,9 +15,12 @@
 #include <bpf/bpf_tracing.h>
 #include <bpf/bpf_core_read.h>
 
+#include "target.bpf.h"
+
 #define AF_INET 2
 #define AF_INET6 10
 #define MAX_ENTRIES 10240
+#define PAYLOAD_LEN 512
 
 /* Data structures for storing flow information */
 struct flow_key {
@@ -48,8 +52,29 @@ struct tcp_event {
     __u16 dport;
     __u32 bytes;
     __u32 rtt;
-    __u8 event_type; // 1=connect, 2=accept, 3=send, 4=recv, 5=close
+    __u8 event_type; // 1=connect, 2=accept, 3=send, 4=recv, 5=close, 6=retransmit, 7=connect failed
     char comm[16];
+    __u32 ifindex;   // interface of the socket's traffic, 0 if not known yet
+    __u32 netns;     // inode of the socket's network namespace
+};
+
+/* Start of an HTTP request sent or received on a socket */
+struct tcp_payload {
+    __u64 timestamp;
+    __u32 pid;
+    __u32 saddr;
+    __u32 daddr;
+    __u16 sport;
+    __u16 dport;
+    __u32 len;       // bytes of data captured
+    __u8 data[PAYLOAD_LEN];
+};
+
+/* A process exit, for userspace to forget the process's metadata */
+struct process_exit {
+    __u64 timestamp;
+    __u32 pid;
+    __u32 pad;
 };
 
 /* BPF Maps for storing flow data */
@@ -66,11 +91,27 @@ struct {
     __uint(max_entries, 256 * 1024);
 } events SEC(".maps");
 
-/* Configuration map */
+/* Records the ring buffer had no room for, per CPU; userspace sums them */
 struct {
-    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
     __uint(max_entries, 1);
     __type(key, __u32);
+    __type(value, __u64);
+} ringbuf_drops SEC(".maps");
+
+static __always_inline void count_drop(void) {
+    __u32 key = 0;
+    __u64 *drops = bpf_map_lookup_elem(&ringbuf_drops, &key);
+    if (drops)
+        (*drops)++;
+}
+
+/* Configuration map: index 0 holds the data event sampling rate, index 1
+ * enables payload capture for trace context */
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, 2);
+    __type(key, __u32);
     __type(value, __u32);
 } config_map SEC(".maps");
 
@@ -85,15 +126,157 @@ static __always_inline void make_flow_key(struct flow_key *key,
     key->protocol = IPPROTO_TCP;
 }
 
+/* Keep 1 in config_map[0] send/receive events; flow_map totals stay exact */
+static __always_inline bool sample_event(void) {
+    __u32 key = 0;
+    __u32 *rate = bpf_map_lookup_elem(&config_map, &key);
+    
+    if (!rate || *rate <= 1)
+        return true;
+    return bpf_get_prandom_u32() % *rate == 0;
+}
+
+/* Receive buffers between tcp_recvmsg entry and return, by thread */
+struct recv_args {
+    struct sock *sk;
+    void *buf;
+    __u64 count;  // bytes msg had room for
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, MAX_ENTRIES);
+    __type(key, __u64);
+    __type(value, struct recv_args);
+} recv_args_map SEC(".maps");
+
+/* iov_iter layouts across kernels: 6.0 added ITER_UBUF for single-buffer
+ * send()/recv(), 6.4 renamed the iovec pointer to __iov */
+struct iov_iter___ubuf {
+    __u8 iter_type;
+    void *ubuf;
+} __attribute__((preserve_access_index));
+
+struct iov_iter___iov_new {
+    const struct iovec *__iov;
+} __attribute__((preserve_access_index));
+
+struct iov_iter___iov_old {
+    const struct iovec *iov;
+} __attribute__((preserve_access_index));
+
+enum iter_type___ubuf {
+    ITER_UBUF___ubuf = 0,
+};
+
+static __always_inline bool capture_enabled(void) {
+    __u32 key = 1;
+    __u32 *enabled = bpf_map_lookup_elem(&config_map, &key);
+
+    return enabled && *enabled;
+}
+
+/* User buffer of the first segment of msg */
+static __always_inline void *msg_buffer(struct msghdr *msg) {
+    void *iter = &msg->msg_iter;
+    const struct iovec *iov;
+
+    if (bpf_core_enum_value_exists(enum iter_type___ubuf, ITER_UBUF___ubuf) &&
+        BPF_CORE_READ((struct iov_iter___ubuf *)iter, iter_type) ==
+            bpf_core_enum_value(enum iter_type___ubuf, ITER_UBUF___ubuf))
+        return BPF_CORE_READ((struct iov_iter___ubuf *)iter, ubuf);
+
+    if (bpf_core_field_exists(((struct iov_iter___iov_new *)iter)->__iov))
+        iov = BPF_CORE_READ((struct iov_iter___iov_new *)iter, __iov);
+    else
+        iov = BPF_CORE_READ((struct iov_iter___iov_old *)iter, iov);
+    return BPF_CORE_READ(iov, iov_base);
+}
+
+/* Send the start of buf if it looks like an HTTP request line */
+static __always_inline void send_payload(struct sock *sk, const void *buf, __u32 size) {
+    struct tcp_payload *p;
+    struct inet_sock *inet;
+    char method[4];
+
+    if (!buf || size < sizeof(method) || !target_allowed())
+        return;
+    if (bpf_probe_read_user(method, sizeof(method), buf))
+        return;
+    // GET, POST, PUT, DELETE, HEAD, PATCH, OPTIONS; userspace checks fully
+    if (method[0] != 'G' && method[0] != 'P' && method[0] != 'D' &&
+        method[0] != 'H' && method[0] != 'O')
+        return;
+
+    p = bpf_ringbuf_reserve(&events, sizeof(*p), 0);
+    if (!p) {
+        count_drop();
+        return;
+    }
+
+    p->timestamp = bpf_ktime_get_ns();
+    p->pid = bpf_get_current_pid_tgid() >> 32;
+    inet = (struct inet_sock *)sk;
+    BPF_CORE_READ_INTO(&p->saddr, inet, inet_saddr);
+    BPF_CORE_READ_INTO(&p->daddr, inet, inet_daddr);
+    BPF_CORE_READ_INTO(&p->sport, inet, inet_sport);
+    BPF_CORE_READ_INTO(&p->dport, inet, inet_dport);
+    p->sport = bpf_ntohs(p->sport);
+    p->dport = bpf_ntohs(p->dport);
+
+    if (size > PAYLOAD_LEN)
+        size = PAYLOAD_LEN;
+    p->len = size;
+    if (bpf_probe_read_user(p->data, size, buf)) {
+        bpf_ringbuf_discard(p, 0);
+        return;
+    }
+    bpf_ringbuf_submit(p, 0);
+}
+
+/* Before 5.18 the interface of the last packet in was kept in inet_sock */
+struct inet_sock___rx_dst {
+    int rx_dst_ifindex;
+} __attribute__((preserve_access_index));
+
+struct sock___rx_dst {
+    int sk_rx_dst_ifindex;
+} __attribute__((preserve_access_index));
+
+/* Interface the socket's traffic goes through: the device of its cached
+ * route out, else the one its packets last came in on, else the one it
+ * is bound to. On a VLAN or tunnel this is the VLAN or tunnel device */
+static __always_inline __u32 sock_ifindex(struct sock *sk) {
+    struct dst_entry *dst = BPF_CORE_READ(sk, sk_dst_cache);
+    __u32 ifindex = 0;
+
+    if (dst)
+        ifindex = BPF_CORE_READ(dst, dev, ifindex);
+    if (!ifindex) {
+        if (bpf_core_field_exists(((struct sock___rx_dst *)sk)->sk_rx_dst_ifindex))
+            ifindex = BPF_CORE_READ((struct sock___rx_dst *)sk, sk_rx_dst_ifindex);
+        else
+            ifindex = BPF_CORE_READ((struct inet_sock___rx_dst *)sk, rx_dst_ifindex);
+    }
+    if (!ifindex)
+        ifindex = BPF_CORE_READ(sk, __sk_common.skc_bound_dev_if);
+    return ifindex;
+}
+
 /* Helper function to send event to userspace */
 static __always_inline void send_event(__u8 event_type, struct sock *sk,
                                       __u32 bytes, __u32 rtt) {
     struct tcp_event *event;
     struct inet_sock *inet;
     
+    if (!target_allowed())
+        return;
+    
     event = bpf_ringbuf_reserve(&events, sizeof(*event), 0);
-    if (!event)
+    if (!event) {
+        count_drop();
         return;
+    }
     
     event->timestamp = bpf_ktime_get_ns();
     event->pid = bpf_get_current_pid_tgid() >> 32;
@@ -113,6 +296,10 @@ static __always_inline void send_event(__u8 event_type, struct sock *sk,
     // Convert to host byte order
     event->sport = bpf_ntohs(event->sport);
     event->dport = bpf_ntohs(event->dport);
+
+    // Interface indexes are per network namespace
+    event->ifindex = sock_ifindex(sk);
+    event->netns = BPF_CORE_READ(sk, __sk_common.skc_net.net, ns.inum);
     
     bpf_ringbuf_submit(event, 0);
 }
@@ -143,6 +330,13 @@ int trace_tcp_state_change(struct trace_event_raw_inet_sock_set_state *ctx) {
         send_event(2, sk, 0, 0); // Accept event
     }
     
+    // A connect that closes before it is established was refused, reset
+    // or timed out
+    if (oldstate == TCP_SYN_SENT && newstate == TCP_CLOSE) {
+        send_event(7, sk, 0, 0); // Connect failed event
+        return 0;
+    }
+
     // Track connection close
     if (newstate == TCP_CLOSE) {
         send_event(5, sk, 0, 0); // Close event
@@ -182,9 +376,28 @@ int trace_tcp_retransmit(struct trace_event_raw_tcp_retransmit_skb *ctx) {
     return 0;
 }
 
-/* Kprobe for tcp_sendmsg to track outbound data */
-SEC("kprobe/tcp_sendmsg")
-int BPF_KPROBE(tcp_sendmsg, struct sock *sk, struct msghdr *msg, size_t size) {
+/* Trace process exits, of thread group leaders only */
+SEC("tp/sched/sched_process_exit")
+int trace_sched_process_exit(void *ctx) {
+    __u64 pid_tgid = bpf_get_current_pid_tgid();
+    struct process_exit *record;
+
+    if ((__u32)pid_tgid != (__u32)(pid_tgid >> 32) || !target_allowed())
+        return 0;
+    record = bpf_ringbuf_reserve(&events, sizeof(*record), 0);
+    if (!record) {
+        count_drop();
+        return 0;
+    }
+    record->timestamp = bpf_ktime_get_ns();
+    record->pid = pid_tgid >> 32;
+    record->pad = 0;
+    bpf_ringbuf_submit(record, 0);
+    return 0;
+}
+
+/* Shared body of the tcp_sendmsg kprobe and fentry programs */
+static __always_inline int handle_tcp_sendmsg(struct sock *sk, struct msghdr *msg, size_t size) {
     struct flow_key key = {};
     struct flow_data *flow;
     struct inet_sock *inet;
@@ -217,15 +430,87 @@ int BPF_KPROBE(tcp_sendmsg, struct sock *sk, struct msghdr *msg, size_t size) {
         flow->last_seen = ts;
     }
     
-    // Send transmission event
-    send_event(3, sk, size, 0);
+    // Requests go out ahead of their transmission event, so userspace
+    // labels it with their trace context
+    if (capture_enabled())
+        send_payload(sk, msg_buffer(msg), size);
+
+    // Send transmission event, sampled
+    if (sample_event())
+        send_event(3, sk, size, 0);
     
     return 0;
 }
 
-/* Kprobe for tcp_cleanup_rbuf to track inbound data */
-SEC("kprobe/tcp_cleanup_rbuf")
-int BPF_KPROBE(tcp_cleanup_rbuf, struct sock *sk, int copied) {
+/* Kprobe for tcp_sendmsg to track outbound data */
+SEC("kprobe/tcp_sendmsg")
+int BPF_KPROBE(tcp_sendmsg, struct sock *sk, struct msghdr *msg, size_t size) {
+    return handle_tcp_sendmsg(sk, msg, size);
+}
+
+/* Trampoline variant of tcp_sendmsg, cheaper than a kprobe on this hot path */
+SEC("fentry/tcp_sendmsg")
+int BPF_PROG(tcp_sendmsg_fentry, struct sock *sk, struct msghdr *msg, size_t size) {
+    return handle_tcp_sendmsg(sk, msg, size);
+}
+
+/* Remember the buffer tcp_recvmsg copies into; its data is only there on
+ * return */
+static __always_inline int handle_tcp_recvmsg(struct sock *sk, struct msghdr *msg) {
+    __u64 id = bpf_get_current_pid_tgid();
+    struct recv_args args = {};
+
+    if (!capture_enabled())
+        return 0;
+    args.sk = sk;
+    args.buf = msg_buffer(msg);
+    args.count = BPF_CORE_READ(msg, msg_iter.count);
+    bpf_map_update_elem(&recv_args_map, &id, &args, BPF_ANY);
+    return 0;
+}
+
+/* Shared body of the tcp_recvmsg kretprobe and fexit programs */
+static __always_inline int handle_tcp_recvmsg_ret(long copied) {
+    __u64 id = bpf_get_current_pid_tgid();
+    struct recv_args *args = bpf_map_lookup_elem(&recv_args_map, &id);
+
+    if (!args)
+        return 0;
+    if (copied > 0)
+        send_payload(args->sk, args->buf, copied);
+    bpf_map_delete_elem(&recv_args_map, &id);
+    return 0;
+}
+
+SEC("kprobe/tcp_recvmsg")
+int BPF_KPROBE(tcp_recvmsg, struct sock *sk, struct msghdr *msg) {
+    return handle_tcp_recvmsg(sk, msg);
+}
+
+SEC("kretprobe/tcp_recvmsg")
+int BPF_KRETPROBE(tcp_recvmsg_ret, int copied) {
+    return handle_tcp_recvmsg_ret(copied);
+}
+
+SEC("fentry/tcp_recvmsg")
+int BPF_PROG(tcp_recvmsg_fentry, struct sock *sk, struct msghdr *msg) {
+    return handle_tcp_recvmsg(sk, msg);
+}
+
+/* The return value follows the arguments, whose number 5.19 changed, so
+ * what was copied is read off how far msg's iterator advanced instead */
+SEC("fexit/tcp_recvmsg")
+int BPF_PROG(tcp_recvmsg_fexit, struct sock *sk, struct msghdr *msg) {
+    __u64 id = bpf_get_current_pid_tgid();
+    struct recv_args *args = bpf_map_lookup_elem(&recv_args_map, &id);
+
+    if (!args)
+        return 0;
+    return handle_tcp_recvmsg_ret(args->count - BPF_CORE_READ(msg, msg_iter.count));
+}
+
+/* Shared body of the tcp_cleanup_rbuf kprobe and fentry programs */
+static __always_inline int handle_tcp_cleanup_rbuf(struct sock *sk, int copied) {
     struct flow_key key = {};
     struct flow_data *flow;
     struct inet_sock *inet;
@@ -261,10 +546,23 @@ int BPF_KPROBE(tcp_cleanup_rbuf, struct sock *sk, int copied) {
         flow->last_seen = ts;
     }
     
-    // Send receive event
-    send_event(4, sk, copied, 0);
+    // Send receive event, sampled
+    if (sample_event())
+        send_event(4, sk, copied, 0);
     
     return 0;
 }
 
+/* Kprobe for tcp_cleanup_rbuf to track inbound data */
+SEC("kprobe/tcp_cleanup_rbuf")
+int BPF_KPROBE(tcp_cleanup_rbuf, struct sock *sk, int copied) {
+    return handle_tcp_cleanup_rbuf(sk, copied);
+}
+
+/* Trampoline variant of tcp_cleanup_rbuf */
+SEC("fentry/tcp_cleanup_rbuf")
+int BPF_PROG(tcp_cleanup_rbuf_fentry, struct sock *sk, int copied) {
+    return handle_tcp_cleanup_rbuf(sk, copied);
+}
+
 char LICENSE[] SEC("license") = "GPL";
\ No newline at end of file
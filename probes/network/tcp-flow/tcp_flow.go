@@ -1,69 +1,170 @@
 package main
 
+// Event and map value types are generated from the object's BTF:
+//go:generate go run probepilot/cmd/btfgen -obj tcp_flow.o -out tcp_flow_types.go -types tcp_event,tcp_payload,process_exit,flow_key,flow_data -names tcp_event=TCPEvent,tcp_payload=TCPPayload,saddr=SAddr,daddr=DAddr,sport=SPort,dport=DPort,bytes_tx=BytesTX,bytes_rx=BytesRX,packets_tx=PacketsTX,packets_rx=PacketsRX,rtt_samples=RTTSamples,rtt_total=RTTTotal,ifindex=IfIndex,netns=NetNS -checks layoutChecks
+
 import (
 	"bytes"
 	"context"
-	"encoding/binary"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
-	"net"
+	"net/http"
 	"os"
-	"os/signal"
-	"syscall"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 	"unsafe"
 
 	"github.com/cilium/ebpf"
 	"github.com/cilium/ebpf/link"
-	"github.com/cilium/ebpf/ringbuf"
-	"github.com/cilium/ebpf/rlimit"
-)
 
-// TCPEvent represents a TCP event from the eBPF program
-type TCPEvent struct {
-	Timestamp uint64
-	PID       uint32
-	SAddr     uint32
-	DAddr     uint32
-	SPort     uint16
-	DPort     uint16
-	Bytes     uint32
-	RTT       uint32
-	EventType uint8
-	Comm      [16]byte
-}
+	"probepilot/pkg/attach"
+	"probepilot/pkg/clock"
+	"probepilot/pkg/config"
+	"probepilot/pkg/control"
+	"probepilot/pkg/core"
+	"probepilot/pkg/decode"
+	"probepilot/pkg/export"
+	"probepilot/pkg/histogram"
+	"probepilot/pkg/layout"
+	"probepilot/pkg/limits"
+	"probepilot/pkg/maps"
+	"probepilot/pkg/netif"
+	"probepilot/pkg/otlp"
+	"probepilot/pkg/output"
+	"probepilot/pkg/platform"
+	"probepilot/pkg/policy"
+	"probepilot/pkg/probe"
+	"probepilot/pkg/procfs"
+	"probepilot/pkg/profile"
+	"probepilot/pkg/query"
+	"probepilot/pkg/route"
+	"probepilot/pkg/sampling"
+	"probepilot/pkg/service"
+	"probepilot/pkg/slo"
+	"probepilot/pkg/sockmap"
+	"probepilot/pkg/summary"
+	"probepilot/pkg/target"
+	"probepilot/pkg/topk"
+	"probepilot/pkg/tracecontext"
+	"probepilot/pkg/tsdb"
+	"probepilot/pkg/units"
+)
 
-// FlowKey represents a network flow identifier
-type FlowKey struct {
-	SAddr    uint32
-	DAddr    uint32
-	SPort    uint16
-	DPort    uint16
-	Protocol uint8
+// kernelFuncs lists the hot-path kernel functions hooked by the probe,
+// with the kprobe and fentry program variants compiled for each
+var kernelFuncs = []attach.KernelFunc{
+	{Symbol: "tcp_sendmsg", Kprobe: "tcp_sendmsg", Fentry: "tcp_sendmsg_fentry", Optional: true},
+	{Symbol: "tcp_cleanup_rbuf", Kprobe: "tcp_cleanup_rbuf", Fentry: "tcp_cleanup_rbuf_fentry", Optional: true},
+	// Received requests are read on return; both programs stay idle
+	// unless -trace-context is set
+	{Symbol: "tcp_recvmsg", Kprobe: "tcp_recvmsg", Fentry: "tcp_recvmsg_fentry", Optional: true},
+	{Symbol: "tcp_recvmsg", Kprobe: "tcp_recvmsg_ret", Fentry: "tcp_recvmsg_fexit", Return: true, Optional: true},
 }
 
-// FlowData represents flow statistics
-type FlowData struct {
-	BytesTX    uint64
-	BytesRX    uint64
-	PacketsTX  uint64
-	PacketsRX  uint64
-	FirstSeen  uint64
-	LastSeen   uint64
-	RTTSamples uint32
-	RTTTotal   uint32
-	State      uint8
-}
+// requiredPrograms are the programs the monitor cannot run without; any
+// other program this kernel cannot load is dropped with its hook
+var requiredPrograms = []string{"trace_tcp_state_change"}
 
 // TCPFlowMonitor represents the TCP flow monitoring probe
 type TCPFlowMonitor struct {
+	// mu serializes Handle with Stats, which run on different goroutines,
+	// and with the query API, control socket and exporters reading the
+	// monitor's state
+	mu sync.Mutex
+
 	spec     *ebpf.CollectionSpec
 	coll     *ebpf.Collection
 	links    []link.Link
-	reader   *ringbuf.Reader
 	config   Config
-	flows    map[FlowKey]*FlowData
+	flows    *topk.Sketch[FlowKey, flowState] // busiest connections by bytes, bounded by -top-k
 	stats    ProbeStats
+
+	// Sampled send/receive events behind stats.TotalBytes, for
+	// extrapolating it at the configured sampling rate
+	sampledBytes sampling.Counter
+
+	attachReport attach.Report
+	bpfStats     io.Closer
+
+	// Caps new flow entries under -memory-limit
+	budget *limits.Budget
+
+	// Process metadata, backfilled from /proc at startup
+	procs *procfs.Cache
+
+	// Owners of the sockets of events raised without process context,
+	// nil with -socket-rescan 0
+	sockets *sockmap.Mapper
+
+	// Traffic by the interface and network namespace of its sockets,
+	// and the interfaces' names and overlays
+	ifaces map[netif.Key]*ifaceStats
+	netifs *netif.Table
+
+	// Traffic by the pair of services it goes between under -services,
+	// and the container labels of the processes naming them
+	services      map[servicePair]*serviceStats
+	serviceLabels map[uint32]map[string]string
+	containers    *target.Labels
+
+	// Local metric history with downsampled rollups
+	history *tsdb.Store
+
+	// Optional hooks operators can toggle at runtime, and the control
+	// socket server they are toggled through
+	hooks   *attach.Toggles
+	control *control.Server
+
+	// Severity classification and routing of events to external sinks
+	router *route.Router
+
+	// JSON lines of events and stats snapshots, nil for text output
+	output *output.Writer
+
+	// Distribution of smoothed RTTs across all flows
+	rtt *histogram.Histogram
+
+	// Connections the -policy file does not allow, by flow; each flow
+	// raises one event while it is tracked
+	violations *topk.Sketch[policy.Flow, uint64]
+
+	// Processes every probe reports, shared with the other agents
+	targets *target.Filter
+
+	// Wall clock time of the kernel's monotonic event timestamps
+	clock *clock.Clock
+
+	// Records the ring buffer had no room for, and the sampling rate they
+	// call for under -adaptive-sampling
+	drops *sampling.Adaptive
+}
+
+// rttBuckets are the default classic RTT boundaries, 100us to ~3s
+var rttBuckets = histogram.ExponentialBuckets(0.0001, 2, 16)
+
+// payloadSize tells payload captures apart from events in the ring buffer
+var payloadSize = int(unsafe.Sizeof(TCPPayload{}))
+
+// processExitSize tells process exits apart from events in the ring buffer
+var processExitSize = int(unsafe.Sizeof(ProcessExit{}))
+
+// eventTypeOffset locates the event type in tcp_event records, for Priority
+var eventTypeOffset = int(unsafe.Offsetof(TCPEvent{}.EventType))
+
+// eventTypeNames names the event types of tcp_event for live tails
+var eventTypeNames = map[uint8]string{
+	1: "connect",
+	2: "accept",
+	3: "send",
+	4: "recv",
+	5: "close",
+	6: "retransmit",
+	7: "connect_failed",
 }
 
 // Config holds probe configuration
@@ -73,6 +174,33 @@ type Config struct {
 	ReportInterval time.Duration
 	FilterPorts  []uint16
 	FilterIPs    []string
+	AttachMode   attach.Mode
+	Retention    []tsdb.Resolution
+	Profile      profile.Profile
+	Limits       limits.Limits
+	Router       *route.Router
+	Output       *output.Writer
+	Histograms   histogram.Options
+	TraceContext bool
+	Policy       *policy.Policy
+	SLOs         *slo.Tracker
+	KernelBTF    string
+	// SocketRescan bounds how often /proc is rescanned to attribute
+	// events without process context to their socket's owner; 0 leaves
+	// them with whichever process the kernel interrupted
+	SocketRescan time.Duration
+	// Targets scopes every probe to the processes of a targeting file;
+	// nil monitors every process
+	Targets *target.Config
+	// Queue holds records the monitor has yet to handle; nil handles
+	// them as they are read
+	Queue *probe.Queue
+	// AdaptiveSampling is the ring buffer drops per second past which
+	// the sampling rate is raised; 0 keeps SamplingRate
+	AdaptiveSampling float64
+	// Services names the ends of connections to sum traffic per pair of
+	// services; nil for no traffic matrix
+	Services *service.Map
 }
 
 // ProbeStats holds probe statistics
@@ -80,61 +208,159 @@ type ProbeStats struct {
 	EventsProcessed uint64
 	ActiveFlows     uint64
 	TotalConnections uint64
+	FailedConnections uint64
 	TotalBytes      uint64
+	TraceContexts   uint64
+	Retransmits     uint64
+	// InterfacesDropped counts events of interfaces past maxInterfaces
+	InterfacesDropped uint64
 	StartTime       time.Time
 }
 
 // NewTCPFlowMonitor creates a new TCP flow monitor instance
 func NewTCPFlowMonitor(config Config) (*TCPFlowMonitor, error) {
-	// Remove memory limit for eBPF
-	if err := rlimit.RemoveMemlock(); err != nil {
-		return nil, fmt.Errorf("failed to remove memlock: %w", err)
-	}
-
-	// Load pre-compiled eBPF program
-	spec, err := ebpf.LoadCollectionSpec("tcp_flow.o")
+	history, err := tsdb.New(config.Retention...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load eBPF spec: %w", err)
+		return nil, fmt.Errorf("invalid history retention: %w", err)
 	}
 
-	// Load eBPF program into kernel
-	coll, err := ebpf.NewCollection(spec)
+	// Sample send/receive events in the kernel at the configured rate
+	if config.SamplingRate == 0 {
+		config.SamplingRate = 1
+	}
+	drops, err := sampling.NewAdaptive(config.SamplingRate, config.AdaptiveSampling)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create eBPF collection: %w", err)
+		return nil, err
 	}
 
 	monitor := &TCPFlowMonitor{
-		spec:   spec,
-		coll:   coll,
 		config: config,
-		flows:  make(map[FlowKey]*FlowData),
+		flows:  topk.New[FlowKey, flowState](config.Limits.TopKEntries()),
 		stats: ProbeStats{
 			StartTime: time.Now(),
 		},
+		budget:  limits.NewBudget(config.Limits.MemoryLimit / 4 * 3),
+		procs:   procfs.NewCache(),
+		history: history,
+		hooks:   attach.NewToggles(),
+		router:  config.Router,
+		output:  config.Output,
+		rtt:     config.Histograms.New("tcp_rtt_seconds", rttBuckets),
+
+		violations: topk.New[policy.Flow, uint64](config.Limits.TopKEntries()),
+		clock:      clock.New(),
+		ifaces:     make(map[netif.Key]*ifaceStats),
+		netifs:     netif.New(netif.DefaultRescan),
+		drops:      drops,
+
+		services:      make(map[servicePair]*serviceStats),
+		serviceLabels: make(map[uint32]map[string]string),
+		containers:    target.NewLabels(),
+	}
+	monitor.control = control.NewServer(monitor)
+	monitor.control.HandleHooks(monitor.hooks)
+	if config.SocketRescan > 0 {
+		monitor.sockets = sockmap.New(config.SocketRescan)
+	}
+
+	// Attribute connections owned by processes started before the agent
+	if n, err := monitor.procs.Backfill(); err != nil {
+		log.Printf("Warning: failed to backfill process metadata: %v", err)
+	} else {
+		log.Printf("Backfilled metadata for %d running processes", n)
+	}
+	if err := procfs.CheckHostPIDs(); err != nil {
+		log.Printf("Warning: %v", err)
 	}
 
 	return monitor, nil
 }
 
-// Start begins monitoring TCP flows
-func (m *TCPFlowMonitor) Start(ctx context.Context) error {
-	// Attach to tracepoints and kprobes
-	if err := m.attachProbes(); err != nil {
-		return fmt.Errorf("failed to attach probes: %w", err)
+// Load loads the eBPF programs into the kernel and configures them
+func (m *TCPFlowMonitor) Load() error {
+	// Load pre-compiled eBPF program
+	spec, err := ebpf.LoadCollectionSpec(probe.Object("tcp_flow.o"))
+	if err != nil {
+		return fmt.Errorf("failed to load eBPF spec: %w", err)
+	}
+
+	// Refuse to decode records with structs that no longer match the object
+	if err := layout.ValidateAll(spec.Types, layoutChecks...); err != nil {
+		if !errors.Is(err, layout.ErrNoBTF) {
+			return fmt.Errorf("tcp_flow.o does not match agent structs (rebuild both): %w", err)
+		}
+		log.Printf("Warning: cannot validate struct layouts: %v", err)
+	}
+
+	// Size maps and ring buffers before they are created
+	if err := m.config.Limits.ApplySpec(spec); err != nil {
+		return fmt.Errorf("invalid map limits: %w", err)
+	}
+
+	// Drop fentry variants on kernels without BPF trampolines
+	attach.Prepare(spec, m.config.AttachMode, kernelFuncs)
+
+	// Relocate against this kernel's BTF, dropping hooks it cannot run
+	kernel, err := core.Detect(m.config.KernelBTF)
+	if err != nil {
+		return err
+	}
+	if err := kernel.Err(); err != nil {
+		return err
 	}
+	dropped, err := kernel.Prepare(spec, requiredPrograms...)
+	for _, d := range dropped {
+		log.Printf("Warning: dropped program %s", d)
+	}
+	if err != nil {
+		return fmt.Errorf("tcp_flow.o cannot run on %s: %w", kernel, err)
+	}
+	log.Printf("Kernel: %s", kernel)
 
-	// Set up ring buffer reader
-	reader, err := ringbuf.NewReader(m.coll.Maps["events"])
+	// Load eBPF program into kernel
+	coll, err := ebpf.NewCollectionWithOptions(spec, kernel.Options())
 	if err != nil {
-		return fmt.Errorf("failed to create ring buffer reader: %w", err)
+		return fmt.Errorf("failed to create eBPF collection: %w", err)
+	}
+	m.spec, m.coll = spec, coll
+
+	if err := coll.Maps["config_map"].Put(uint32(0), m.config.SamplingRate); err != nil {
+		log.Printf("Warning: failed to set sampling rate, sending every event: %v", err)
+		m.config.SamplingRate = 1
 	}
-	m.reader = reader
+	if m.config.TraceContext {
+		if err := coll.Maps["config_map"].Put(uint32(1), uint32(1)); err != nil {
+			return fmt.Errorf("failed to enable trace context capture: %w", err)
+		}
+	}
+
+	// Scope every probe to the processes of the targeting file
+	m.targets, err = target.NewFilter(coll, m.config.Targets)
+	if err != nil {
+		return fmt.Errorf("failed to set up targeting: %w", err)
+	}
+	if m.targets != nil {
+		// Processes the agent reads from /proc are scoped at once
+		m.procs.OnAdd = m.targets.Add
+		log.Printf("Targets: %s", m.targets)
+	}
+
+	return nil
+}
 
-	// Start event processing goroutine
-	go m.processEvents(ctx)
+// Attach hooks the loaded programs
+func (m *TCPFlowMonitor) Attach() error {
+	// Account BPF run time so the attach mode overhead can be reported
+	if closer, err := attach.EnableRuntimeStats(); err != nil {
+		log.Printf("Warning: BPF runtime stats unavailable: %v", err)
+	} else {
+		m.bpfStats = closer
+	}
 
-	// Start periodic reporting
-	go m.periodicReport(ctx)
+	// Attach to tracepoints and kprobes
+	if err := m.attachProbes(); err != nil {
+		return fmt.Errorf("failed to attach probes: %w", err)
+	}
 
 	log.Printf("TCP Flow Monitor started successfully")
 	log.Printf("Monitoring configuration: sampling_rate=%d, max_flows=%d",
@@ -143,23 +369,27 @@ func (m *TCPFlowMonitor) Start(ctx context.Context) error {
 	return nil
 }
 
-// Stop stops the TCP flow monitor
-func (m *TCPFlowMonitor) Stop() error {
-	// Close ring buffer reader
-	if m.reader != nil {
-		m.reader.Close()
-	}
-
+// Close stops the TCP flow monitor
+func (m *TCPFlowMonitor) Close() error {
 	// Detach all probes
 	for _, l := range m.links {
 		l.Close()
 	}
+	m.hooks.Close()
+
+	// Deliver events still queued for routing
+	m.router.Close()
+	m.output.Close()
 
 	// Close eBPF collection
 	if m.coll != nil {
 		m.coll.Close()
 	}
 
+	if m.bpfStats != nil {
+		m.bpfStats.Close()
+	}
+
 	log.Printf("TCP Flow Monitor stopped")
 	return nil
 }
@@ -203,91 +433,259 @@ func (m *TCPFlowMonitor) attachProbes() error {
 		links = append(links, l3)
 	}
 
-	// Attach kprobes
-	l4, err := link.Kprobe(link.KprobeOptions{
-		Symbol:  "tcp_sendmsg",
-		Program: m.coll.Programs["tcp_sendmsg"],
+	// Attach to sched_process_exit, to forget the metadata of processes
+	// that exit
+	l4, err := link.Tracepoint(link.TracepointOptions{
+		Group:   "sched",
+		Name:    "sched_process_exit",
+		Program: m.coll.Programs["trace_sched_process_exit"],
 	})
 	if err != nil {
-		log.Printf("Warning: failed to attach tcp_sendmsg kprobe: %v", err)
+		log.Printf("Warning: failed to attach sched_process_exit: %v", err)
 	} else {
 		links = append(links, l4)
 	}
 
-	l5, err := link.Kprobe(link.KprobeOptions{
-		Symbol:  "tcp_cleanup_rbuf",
-		Program: m.coll.Programs["tcp_cleanup_rbuf"],
-	})
-	if err != nil {
-		log.Printf("Warning: failed to attach tcp_cleanup_rbuf kprobe: %v", err)
-	} else {
-		links = append(links, l5)
+	// Attach hot-path hooks via fentry where possible, kprobes otherwise.
+	// The profile decides whether they start attached; the control socket
+	// can switch them later.
+	m.links = links
+	if err := m.hooks.Add(profile.HookTCPData, m.attachDataPath,
+		m.config.Profile.Enabled(profile.HookTCPData)); err != nil {
+		return fmt.Errorf("failed to attach kernel functions: %w", err)
 	}
 
-	m.links = links
-	log.Printf("Attached %d eBPF probes successfully", len(links))
+	log.Printf("Attached %d eBPF probes successfully", len(links)+m.hooks.Links())
 	return nil
 }
 
-// processEvents processes events from the eBPF ring buffer
-func (m *TCPFlowMonitor) processEvents(ctx context.Context) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-			record, err := m.reader.Read()
-			if err != nil {
-				if err == ringbuf.ErrClosed {
-					return
-				}
-				log.Printf("Error reading from ring buffer: %v", err)
-				continue
-			}
+// attachDataPath hooks the send and receive paths for byte counts. The
+// control socket toggles it under the monitor's lock, as Stats reads the
+// attach report it leaves
+func (m *TCPFlowMonitor) attachDataPath() ([]link.Link, error) {
+	kernelLinks, report, err := attach.Kernel(m.coll, m.config.AttachMode, kernelFuncs)
+	if err != nil {
+		return nil, err
+	}
+	for sym, ferr := range report.Failed {
+		log.Printf("Warning: failed to attach %s: %v", sym, ferr)
+	}
+	m.attachReport = report
+	log.Printf("Kernel hooks: %s", report)
+	return kernelLinks, nil
+}
 
-			if len(record.RawSample) < int(unsafe.Sizeof(TCPEvent{})) {
-				continue
-			}
+// Events returns the ring buffer events and payloads arrive on
+func (m *TCPFlowMonitor) Events() *ebpf.Map {
+	if m.coll == nil {
+		return nil
+	}
+	return m.coll.Maps["events"]
+}
 
-			var event TCPEvent
-			err = binary.Read(bytes.NewReader(record.RawSample), binary.LittleEndian, &event)
-			if err != nil {
-				log.Printf("Error parsing event: %v", err)
-				continue
-			}
+// Lock locks the monitor's state; the Runner holds it over Handle, Stats
+// and RecordHistory, and query.Snapshot while it reads the samples
+func (m *TCPFlowMonitor) Lock() { m.mu.Lock() }
+
+// Unlock unlocks the monitor's state
+func (m *TCPFlowMonitor) Unlock() { m.mu.Unlock() }
 
-			m.handleEvent(&event)
-			m.stats.EventsProcessed++
+// Handle processes one event, payload capture or process exit from the
+// ring buffer
+func (m *TCPFlowMonitor) Handle(record []byte) error {
+	if len(record) == processExitSize {
+		var exit ProcessExit
+		if err := decode.Record(record, &exit); err != nil {
+			return fmt.Errorf("failed to parse process exit: %w", err)
 		}
+		m.procs.Remove(exit.PID)
+		return nil
 	}
+	if len(record) == payloadSize {
+		var payload TCPPayload
+		if err := decode.Record(record, &payload); err != nil {
+			return fmt.Errorf("failed to parse payload: %w", err)
+		}
+		if m.portAllowed(payload.SPort, payload.DPort) {
+			m.handlePayload(&payload)
+		}
+		return nil
+	}
+
+	var event TCPEvent
+	if err := decode.Record(record, &event); err != nil {
+		if errors.Is(err, decode.ErrShortRecord) {
+			return nil
+		}
+		return fmt.Errorf("failed to parse event: %w", err)
+	}
+	if !m.portAllowed(event.SPort, event.DPort) {
+		return nil
+	}
+
+	m.handleEvent(&event)
+	m.stats.EventsProcessed++
+	return nil
+}
+
+// Priority ranks records for the event queue: connection state changes,
+// the policy violations they raise, and process exits are never shed;
+// sends, receives and payload captures are shed first
+func (m *TCPFlowMonitor) Priority(record []byte) probe.Priority {
+	if len(record) == processExitSize {
+		return probe.PriorityCritical
+	}
+	if len(record) == payloadSize || len(record) <= eventTypeOffset {
+		return probe.PriorityBulk
+	}
+	switch record[eventTypeOffset] {
+	case 3, 4: // Send, Receive
+		return probe.PriorityBulk
+	case 6: // Retransmit
+		return probe.PriorityNormal
+	}
+	return probe.PriorityCritical
+}
+
+// portAllowed reports whether flows between the ports are reported: one
+// of them is in FilterPorts, or there is no port filter
+func (m *TCPFlowMonitor) portAllowed(sport, dport uint16) bool {
+	if len(m.config.FilterPorts) == 0 {
+		return true
+	}
+	for _, p := range m.config.FilterPorts {
+		if p == sport || p == dport {
+			return true
+		}
+	}
+	return false
+}
+
+// handlePayload attaches the trace context of a captured HTTP request to
+// its flow, so the flow's events carry the trace they serve
+func (m *TCPFlowMonitor) handlePayload(p *TCPPayload) {
+	n := int(p.Len)
+	if n > len(p.Data) {
+		n = len(p.Data)
+	}
+	tc, ok := tracecontext.FromHTTP(p.Data[:n])
+	if !ok {
+		return
+	}
+	m.stats.TraceContexts++
+
+	key, _ := canonicalKey(p.SAddr, p.DAddr, p.SPort, p.DPort)
+	if _, exists := m.flows.Get(key); !exists && !m.budget.Allow() {
+		return
+	}
+	flow := m.flows.Add(key, 0)
+	flow.trace = &tc
+
+	labels := query.Labels{
+		"type":     "trace",
+		"pid":      strconv.Itoa(int(p.PID)),
+		"comm":     m.procs.Name(p.PID),
+		"saddr":    decode.IPv4(p.SAddr).String(),
+		"daddr":    decode.IPv4(p.DAddr).String(),
+		"sport":    strconv.Itoa(int(p.SPort)),
+		"dport":    strconv.Itoa(int(p.DPort)),
+		"trace_id": tc.TraceIDString(),
+		"span_id":  tc.SpanIDString(),
+	}
+	m.procs.AddPIDLabels(labels, p.PID)
+	text := fmt.Sprintf("trace %s:%d -> %s:%d traceparent=%s pid=%d",
+		decode.IPv4(p.SAddr), p.SPort, decode.IPv4(p.DAddr), p.DPort, tc, p.PID)
+	m.control.Publish(control.Event{Labels: labels, Text: text})
+	m.router.RouteAt(p.Timestamp, labels, text)
+	m.output.EventAt(p.Timestamp, labels, text)
+}
+
+// flowTrace returns the trace context last seen on the event's
+// connection, in either direction
+func (m *TCPFlowMonitor) flowTrace(event *TCPEvent) *tracecontext.TraceContext {
+	key, _ := canonicalKey(event.SAddr, event.DAddr, event.SPort, event.DPort)
+	if flow, ok := m.flows.Get(key); ok {
+		return flow.trace
+	}
+	return nil
 }
 
 // handleEvent processes a single TCP event
 func (m *TCPFlowMonitor) handleEvent(event *TCPEvent) {
 	// Convert to human-readable format
-	srcIP := intToIP(event.SAddr)
-	dstIP := intToIP(event.DAddr)
-	comm := string(bytes.TrimRight(event.Comm[:], "\x00"))
+	srcIP := decode.IPv4(event.SAddr)
+	dstIP := decode.IPv4(event.DAddr)
 	
-	timestamp := time.Unix(0, int64(event.Timestamp))
+	timestamp := m.clock.Wall(event.Timestamp)
+
+	m.attribute(event)
+	comm := string(bytes.TrimRight(event.Comm[:], "\x00"))
+	iface := m.observeInterface(event)
+	var localService, remoteService string
+	if m.config.Services != nil {
+		localService, remoteService = m.observeServices(event)
+	}
+
+	if name, ok := eventTypeNames[event.EventType]; ok {
+		labels := query.Labels{
+			"type":  name,
+			"pid":   strconv.Itoa(int(event.PID)),
+			"comm":  comm,
+			"saddr": srcIP.String(),
+			"daddr": dstIP.String(),
+			"sport": strconv.Itoa(int(event.SPort)),
+			"dport": strconv.Itoa(int(event.DPort)),
+		}
+		m.procs.AddPIDLabels(labels, event.PID)
+		text := fmt.Sprintf("%s %s:%d -> %s:%d bytes=%d pid=%d comm=%s",
+			name, srcIP, event.SPort, dstIP, event.DPort, event.Bytes, event.PID, comm)
+		if iface != nil {
+			m.addInterfaceLabels(labels, netif.Key{NetNS: event.NetNS, Index: event.IfIndex}, iface)
+			text += " dev=" + iface.name()
+		}
+		if m.config.Services != nil {
+			labels["service"], labels["peer_service"] = localService, remoteService
+			text += " service=" + localService + " peer_service=" + remoteService
+		}
+		if tc := m.flowTrace(event); tc != nil {
+			labels["trace_id"] = tc.TraceIDString()
+			labels["span_id"] = tc.SpanIDString()
+			text += " trace_id=" + tc.TraceIDString()
+		}
+		m.control.Publish(control.Event{Labels: labels, Text: text})
+		m.router.RouteAt(event.Timestamp, labels, text)
+		m.output.EventAt(event.Timestamp, labels, text)
+	}
 	
 	switch event.EventType {
 	case 1: // Connect
-		log.Printf("[CONNECT] %s %s:%d -> %s:%d (PID: %d)",
-			timestamp.Format("15:04:05.000"), srcIP, event.SPort, dstIP, event.DPort, event.PID)
+		log.Printf("[CONNECT] %s %s:%d -> %s:%d (PID: %d, %s)",
+			timestamp.Format("15:04:05.000"), srcIP, event.SPort, dstIP, event.DPort, event.PID, m.procs.Name(event.PID))
 		m.stats.TotalConnections++
+		m.checkPolicy(event, comm, policy.Flow{
+			Src:  decode.Addr4(event.SAddr),
+			Dst:  decode.Addr4(event.DAddr),
+			Port: event.DPort,
+		})
 		
 	case 2: // Accept
-		log.Printf("[ACCEPT] %s %s:%d <- %s:%d (PID: %d)",
-			timestamp.Format("15:04:05.000"), srcIP, event.SPort, dstIP, event.DPort, event.PID)
+		log.Printf("[ACCEPT] %s %s:%d <- %s:%d (PID: %d, %s)",
+			timestamp.Format("15:04:05.000"), srcIP, event.SPort, dstIP, event.DPort, event.PID, m.procs.Name(event.PID))
 		m.stats.TotalConnections++
+		// The peer connected to us: it is the flow's source
+		m.checkPolicy(event, comm, policy.Flow{
+			Src:  decode.Addr4(event.DAddr),
+			Dst:  decode.Addr4(event.SAddr),
+			Port: event.SPort,
+		})
 		
 	case 3: // Send
 		if event.Bytes > 0 {
-			log.Printf("[SEND] %s %s:%d -> %s:%d %d bytes (RTT: %dms, %s)",
+			log.Printf("[SEND] %s %s:%d -> %s:%d %d bytes (RTT: %s, %s)",
 				timestamp.Format("15:04:05.000"), srcIP, event.SPort, dstIP, event.DPort,
-				event.Bytes, event.RTT/8000, comm) // Convert srtt to milliseconds
+				event.Bytes, units.Duration(srtt(float64(event.RTT))), comm)
 			m.stats.TotalBytes += uint64(event.Bytes)
+			m.sampledBytes.Add(float64(event.Bytes))
 		}
 		
 	case 4: // Receive
@@ -296,133 +694,624 @@ func (m *TCPFlowMonitor) handleEvent(event *TCPEvent) {
 				timestamp.Format("15:04:05.000"), srcIP, event.SPort, dstIP, event.DPort,
 				event.Bytes, comm)
 			m.stats.TotalBytes += uint64(event.Bytes)
+			m.sampledBytes.Add(float64(event.Bytes))
 		}
 		
 	case 5: // Close
-		log.Printf("[CLOSE] %s %s:%d <-> %s:%d (PID: %d)",
-			timestamp.Format("15:04:05.000"), srcIP, event.SPort, dstIP, event.DPort, event.PID)
+		log.Printf("[CLOSE] %s %s:%d <-> %s:%d (PID: %d, %s)",
+			timestamp.Format("15:04:05.000"), srcIP, event.SPort, dstIP, event.DPort, event.PID, m.procs.Name(event.PID))
+		m.sockets.Forget(socketOf(event))
 		
 	case 6: // Retransmit
 		log.Printf("[RETX] %s %s:%d -> %s:%d (%s)",
 			timestamp.Format("15:04:05.000"), srcIP, event.SPort, dstIP, event.DPort, comm)
+		m.stats.Retransmits++
+
+	case 7: // Connect failed
+		log.Printf("[CONNFAIL] %s %s:%d -> %s:%d (PID: %d, %s)",
+			timestamp.Format("15:04:05.000"), srcIP, event.SPort, dstIP, event.DPort, event.PID, m.procs.Name(event.PID))
+		m.stats.FailedConnections++
+		m.sockets.Forget(socketOf(event))
 	}
 
 	// Update flow statistics
 	m.updateFlowStats(event)
 }
 
-// updateFlowStats updates flow statistics
-func (m *TCPFlowMonitor) updateFlowStats(event *TCPEvent) {
-	key := FlowKey{
-		SAddr:    event.SAddr,
-		DAddr:    event.DAddr,
-		SPort:    event.SPort,
-		DPort:    event.DPort,
-		Protocol: 6, // TCP
+// checkPolicy raises a policy_violation event for a connection the
+// -policy file does not allow, once per tracked flow
+func (m *TCPFlowMonitor) checkPolicy(event *TCPEvent, comm string, flow policy.Flow) {
+	if _, ok := m.config.Policy.Allowed(flow); ok {
+		return
+	}
+	_, seen := m.violations.Get(flow)
+	*m.violations.Add(flow, 1)++
+	if seen {
+		return
 	}
 
-	flow, exists := m.flows[key]
-	if !exists {
-		flow = &FlowData{
-			FirstSeen: event.Timestamp,
-		}
-		m.flows[key] = flow
+	labels := query.Labels{
+		"type":  "policy_violation",
+		"pid":   strconv.Itoa(int(event.PID)),
+		"comm":  comm,
+		"src":   flow.Src.String(),
+		"dst":   flow.Dst.String(),
+		"dport": strconv.Itoa(int(flow.Port)),
 	}
+	m.procs.AddPIDLabels(labels, event.PID)
+	text := fmt.Sprintf("policy violation %s pid=%d comm=%s", flow, event.PID, comm)
+	log.Printf("[POLICY] %s", text)
+	m.control.Publish(control.Event{Labels: labels, Text: text})
+	m.router.RouteAt(event.Timestamp, labels, text)
+	m.output.EventAt(event.Timestamp, labels, text)
+}
 
-	flow.LastSeen = event.Timestamp
+// updateFlowStats updates the statistics of the event's connection,
+// merging both directions into one record
+func (m *TCPFlowMonitor) updateFlowStats(event *TCPEvent) {
+	key, dir := canonicalKey(event.SAddr, event.DAddr, event.SPort, event.DPort)
 
-	switch event.EventType {
-	case 3: // Send
-		flow.BytesTX += uint64(event.Bytes)
-		flow.PacketsTX++
-	case 4: // Receive
-		flow.BytesRX += uint64(event.Bytes)
-		flow.PacketsRX++
+	// Connections are weighted by bytes, so short-lived ones make way for
+	// the busiest once -top-k connections are tracked
+	_, exists := m.flows.Get(key)
+	if !exists && !m.budget.Allow() {
+		return
+	}
+	flow := m.flows.Add(key, uint64(event.Bytes))
+	if !exists {
+		flow.FirstSeen = event.Timestamp
 	}
+	flow.update(event, dir)
 
 	if event.RTT > 0 {
-		flow.RTTSamples++
-		flow.RTTTotal += event.RTT
+		// The exemplar leads from an RTT outlier to its flow, and its
+		// trace if known
+		exemplar := flowLabels(key)
+		exemplar["pid"] = strconv.Itoa(int(event.PID))
+		if flow.trace != nil {
+			exemplar["trace_id"] = flow.trace.TraceIDString()
+		}
+		rtt := srtt(float64(event.RTT)).Seconds()
+		m.rtt.ObserveWithExemplar(rtt, exemplar)
+		m.config.SLOs.Observe("tcp_rtt_seconds", exemplar, rtt)
 	}
 }
 
-// periodicReport prints periodic statistics
-func (m *TCPFlowMonitor) periodicReport(ctx context.Context) {
-	ticker := time.NewTicker(m.config.ReportInterval)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-ticker.C:
-			m.printStats()
+// Stats prints current statistics, or writes them as a JSON snapshot, and
+// routes SLO burn alerts and changes of sampling rate
+func (m *TCPFlowMonitor) Stats(ctx context.Context) {
+	m.checkDrops(time.Now())
+	if m.output.JSON() {
+		m.output.Stats(m.Samples())
+	} else {
+		m.printStats()
+	}
+	m.checkSLOs()
+}
+
+// checkDrops reads the records the ring buffer dropped and, under
+// -adaptive-sampling, moves the in-kernel sampling rate as they call for
+func (m *TCPFlowMonitor) checkDrops(now time.Time) {
+	dropped, err := maps.RingbufDrops(m.coll)
+	if err != nil {
+		log.Printf("Warning: failed to read ring buffer drops: %v", err)
+		return
+	}
+	prev := m.config.SamplingRate
+	rate, changed := m.drops.Observe(dropped, now)
+	if !changed {
+		return
+	}
+	if err := m.coll.Maps["config_map"].Put(uint32(0), rate); err != nil {
+		log.Printf("Warning: failed to set sampling rate: %v", err)
+		return
+	}
+	m.rescale(prev, rate)
+	m.config.SamplingRate = rate
+
+	labels := m.drops.Labels(prev)
+	text := fmt.Sprintf("sampling rate changed from 1 in %d to 1 in %d at %s ring buffer drops/s",
+		prev, rate, labels["drops_per_sec"])
+	log.Printf("[SAMPLING] %s", text)
+	m.control.Publish(control.Event{Labels: labels, Text: text})
+	m.router.Route(labels, text)
+	m.output.Event(labels, text)
+}
+
+// rescale carries the sampled bytes over a change of sampling rate, so
+// estimates keep covering the traffic seen before it
+func (m *TCPFlowMonitor) rescale(from, to uint32) {
+	m.sampledBytes.Rescale(from, to)
+	m.flows.Each(func(_ FlowKey, flow *flowState) bool {
+		for i := range flow.dirs {
+			flow.dirs[i].sent.Rescale(from, to)
+			flow.dirs[i].received.Rescale(from, to)
 		}
+		return true
+	})
+	for _, s := range m.ifaces {
+		s.sent.Rescale(from, to)
+		s.received.Rescale(from, to)
+	}
+	for _, s := range m.services {
+		s.bytes.Rescale(from, to)
 	}
 }
 
+// checkSLOs routes SLO burn alerts that started or stopped firing
+func (m *TCPFlowMonitor) checkSLOs() {
+	for _, burn := range m.config.SLOs.Check() {
+		labels, text := burn.Labels(), burn.String()
+		log.Printf("[SLO] %s", text)
+		m.control.Publish(control.Event{Labels: labels, Text: text})
+		m.router.Route(labels, text)
+		m.output.Event(labels, text)
+	}
+}
+
+// Stalled routes the watchdog's stalls as probe_stall alerts
+func (m *TCPFlowMonitor) Stalled(s probe.Stall) {
+	labels, text := s.Labels(), s.String()
+	m.control.Publish(control.Event{Labels: labels, Text: text})
+	m.router.Route(labels, text)
+	m.output.Event(labels, text)
+}
+
+// RecordHistory samples the monitor's counters into the local history;
+// the Runner calls it every second under the monitor's lock
+func (m *TCPFlowMonitor) RecordHistory(now time.Time) {
+	m.history.Add("tcp.events", now, float64(m.stats.EventsProcessed))
+	m.history.Add("tcp.active_flows", now, float64(m.flows.Len()))
+	m.history.Add("tcp.connections", now, float64(m.stats.TotalConnections))
+	m.history.Add("tcp.bytes", now, float64(m.stats.TotalBytes))
+}
+
+// Samples exposes the monitor's current state to the local query API
+func (m *TCPFlowMonitor) Samples() []query.Sample {
+	samples := []query.Sample{
+		{Name: "tcp_events_total", Value: float64(m.stats.EventsProcessed)},
+		{Name: "tcp_connections_total", Value: float64(m.stats.TotalConnections)},
+		{Name: "tcp_connect_failures_total", Value: float64(m.stats.FailedConnections)},
+		{Name: "tcp_active_flows", Value: float64(m.flows.Len())},
+		{Name: "tcp_flows_evicted_total", Value: float64(m.flows.Evicted())},
+		{Name: "tcp_trace_contexts_total", Value: float64(m.stats.TraceContexts)},
+		{Name: "tcp_retransmits_total", Value: float64(m.stats.Retransmits)},
+	}
+	rate := m.config.SamplingRate
+	samples = append(samples, sampling.Samples("tcp_bytes_total", nil,
+		sampling.SumEstimate(m.sampledBytes, rate))...)
+	samples = append(samples, m.router.Samples()...)
+	samples = append(samples, m.config.Queue.Samples()...)
+	samples = append(samples, m.drops.Samples()...)
+	samples = append(samples, m.config.SLOs.Samples()...)
+	samples = append(samples, m.sockets.Samples()...)
+	samples = append(samples, m.interfaceSamples(rate)...)
+	samples = append(samples, m.serviceSamples(rate)...)
+	if m.stats.InterfacesDropped > 0 {
+		samples = append(samples, query.Sample{Name: "tcp_interface_events_dropped_total", Value: float64(m.stats.InterfacesDropped)})
+	}
+	if m.config.Policy != nil {
+		samples = append(samples, query.Sample{Name: "tcp_policy_violations_total", Value: float64(m.violations.Total())})
+		m.violations.Each(func(flow policy.Flow, count *uint64) bool {
+			samples = append(samples, query.Sample{
+				Name: "tcp_policy_violation_connections_total",
+				Labels: query.Labels{
+					"src":   flow.Src.String(),
+					"dst":   flow.Dst.String(),
+					"dport": strconv.Itoa(int(flow.Port)),
+				},
+				Value: float64(*count),
+			})
+			return true
+		})
+	}
+	for _, h := range m.Histograms() {
+		samples = append(samples, h.Samples()...)
+	}
+	for _, u := range maps.Measure(m.coll) {
+		labels := query.Labels{"map": u.Name}
+		samples = append(samples,
+			query.Sample{Name: "bpf_map_entries", Labels: labels, Value: float64(u.Entries)},
+			query.Sample{Name: "bpf_map_max_entries", Labels: labels, Value: float64(u.MaxEntries)},
+		)
+	}
+	m.flows.Each(func(key FlowKey, flow *flowState) bool {
+		samples = append(samples, flowSamples(key, flow, rate)...)
+		return true
+	})
+	return samples
+}
+
+// Mount serves the monitor's local history to Grafana beside the query API
+func (m *TCPFlowMonitor) Mount(mux *http.ServeMux) {
+	m.history.Mount(mux)
+}
+
+// Histograms exposes the monitor's distributions to /metrics
+func (m *TCPFlowMonitor) Histograms() []query.HistogramSample {
+	return []query.HistogramSample{m.rtt.Snapshot(nil)}
+}
+
 // printStats prints current statistics
 func (m *TCPFlowMonitor) printStats() {
 	uptime := time.Since(m.stats.StartTime)
-	activeFlows := len(m.flows)
+	activeFlows := m.flows.Len()
 	
 	log.Printf("=== TCP Flow Monitor Stats ===")
 	log.Printf("Uptime: %v", uptime.Truncate(time.Second))
 	log.Printf("Events processed: %d", m.stats.EventsProcessed)
-	log.Printf("Active flows: %d", activeFlows)
+	log.Printf("Retransmits: %d", m.stats.Retransmits)
+	log.Printf("Active connections: %d (top %d), both directions merged", activeFlows, m.flows.Capacity())
+	if evicted := m.flows.Evicted(); evicted > 0 {
+		log.Printf("Flows evicted for busier ones: %d", evicted)
+	}
+	if dropped := m.budget.Dropped(); dropped > 0 {
+		log.Printf("Flows dropped over memory budget: %d", dropped)
+	}
 	log.Printf("Total connections: %d", m.stats.TotalConnections)
-	log.Printf("Total bytes: %.2f MB", float64(m.stats.TotalBytes)/(1024*1024))
+	if m.stats.FailedConnections > 0 {
+		log.Printf("Failed connections: %d", m.stats.FailedConnections)
+	}
+	if m.stats.TraceContexts > 0 {
+		log.Printf("Trace contexts captured: %d", m.stats.TraceContexts)
+	}
+	if m.config.Policy != nil {
+		log.Printf("Policy violations: %d connections in %d flows", m.violations.Total(), m.violations.Len())
+	}
+	log.Printf("Total bytes: %s", units.Bytes(m.stats.TotalBytes))
+	if est := sampling.SumEstimate(m.sampledBytes, m.config.SamplingRate); est.Sampled() {
+		log.Printf("Estimated total bytes: %s ±%s (sampled 1:%d, %s confidence)",
+			units.Bytes(uint64(est.Value)), units.Bytes(uint64(est.Error)), est.Rate, est.Confidence())
+	}
+	log.Printf("History: %d points in %d series", m.history.Len(), len(m.history.Series()))
+	if activeFlows > 0 {
+		log.Printf("Busiest connections:")
+		m.printFlows(5)
+	}
+	if len(m.ifaces) > 0 {
+		log.Printf("Busiest interfaces:")
+		m.printInterfaces(5)
+	}
+	if len(m.services) > 0 {
+		log.Printf("Busiest service pairs:")
+		m.printServices(10)
+	}
 	
 	if m.stats.EventsProcessed > 0 {
 		rate := float64(m.stats.EventsProcessed) / uptime.Seconds()
-		log.Printf("Event rate: %.2f events/sec", rate)
+		log.Printf("Event rate: %s", units.Rate(rate, "events"))
+	}
+	if m.config.Queue != nil {
+		log.Printf("Event queue: %s", m.config.Queue)
+	}
+	log.Printf("Ring buffer: %s", m.drops)
+
+	for _, u := range maps.Measure(m.coll) {
+		log.Printf("Map %s", u)
+		if rec := u.Recommendation(maps.DefaultWarnPercent); rec != "" {
+			log.Printf("Warning: %s", rec)
+		}
+	}
+
+	log.Printf("Attach mode: %s", m.attachReport.Resolved)
+	overhead := attach.MeasureOverhead(m.coll, m.attachReport.ProgramNames(kernelFuncs)...)
+	for name, o := range overhead {
+		log.Printf("  %s: %d runs, %v/run", name, o.Runs, o.PerRun())
 	}
 	
 	log.Printf("==============================")
 }
 
-// intToIP converts a uint32 IP address to net.IP
-func intToIP(ip uint32) net.IP {
-	return net.IPv4(byte(ip), byte(ip>>8), byte(ip>>16), byte(ip>>24))
+// parsePorts parses a comma-separated list of ports
+func parsePorts(s string) ([]uint16, error) {
+	var ports []uint16
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		port, err := strconv.ParseUint(part, 10, 16)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("invalid port %q", part)
+		}
+		ports = append(ports, uint16(port))
+	}
+	return ports, nil
 }
 
 func main() {
+	run := summary.Start("tcp-flow", flag.CommandLine)
+
+	// The configuration file and environment may select the profile, which
+	// supplies the defaults of every other flag
+	settings, err := config.Load(os.Args[1:], "tcpflow")
+	if err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	// Deferred first, so it runs after every other deferred cleanup
+	defer settings.Restart()
+	prof, err := profile.Selected(settings.Args(os.Args[1:]))
+	if err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	flag.String("config", settings.Path(),
+		"YAML file of per-probe settings, overridden by $PROBEPILOT_* and flags (default $PROBEPILOT_CONFIG)")
+	settings.RegisterFleetFlags(flag.CommandLine)
+	flag.String("profile", prof.Name, profile.Usage())
+	attachMode := flag.String("attach-mode", string(prof.AttachMode),
+		"kernel hook mode for hot paths: auto, fentry or kprobe")
+	retention := flag.String("retention", prof.Retention,
+		"local history resolutions as step:retention pairs")
+	samplingRate := flag.Uint("sampling-rate", uint(prof.SamplingRate),
+		"keep 1 in N send/receive events; counts derived from them are extrapolated")
+	reportInterval := flag.Duration("report-interval", prof.ReportInterval,
+		"how often to print statistics")
+	watchdog := probe.RegisterWatchdogFlag(flag.CommandLine)
+	eventQueue := probe.RegisterQueueFlag(flag.CommandLine)
+	adaptiveSampling := sampling.RegisterAdaptiveFlag(flag.CommandLine)
+	parseLimits := limits.RegisterFlags(flag.CommandLine)
+	parseSocket := control.RegisterFlags(flag.CommandLine)
+	parseHistograms := histogram.RegisterFlags(flag.CommandLine)
+	parseOutput := output.RegisterFlags(flag.CommandLine)
+	parseHook := route.RegisterHookFlags(flag.CommandLine)
+	parseFilter := route.RegisterFilterFlag(flag.CommandLine)
+	parseCoalesce := route.RegisterCoalesceFlags(flag.CommandLine)
+	parseTargets := target.RegisterFlags(flag.CommandLine)
+	procfs.RegisterFlags(flag.CommandLine)
+	listen := flag.String("listen", "",
+		"address for the local query API: host:port, e.g. 127.0.0.1:9466, or unix:/path (disabled if empty)")
+	controlSocket := flag.String("control", "",
+		"UNIX socket for probepilot attach, e.g. /run/probepilot/tcp-flow.sock (disabled if empty)")
+	routes := flag.String("routes", "",
+		"JSON file of per-probe event severity and routing rules (disabled if empty)")
+	otlpMetrics := flag.String("otlp-metrics", "",
+		"OpenTelemetry collector to push metrics to every report interval over OTLP/HTTP, e.g. http://otel-collector:4318 (disabled if empty)")
+	otlpLogs := flag.String("otlp-logs", "",
+		"OpenTelemetry collector to export the -otlp-log-events classes of events to as OTLP log records, e.g. http://otel-collector:4318 (disabled if empty)")
+	otlpLogEvents := flag.String("otlp-log-events", route.DefaultLogClasses,
+		"comma-separated classes of events for -otlp-logs: oom, security, connection_failure, self_health, process_exit, memory_pressure or all")
+	traceContext := flag.Bool("trace-context", false,
+		"capture the start of HTTP requests to label flows with their W3C traceparent")
+	policyFile := flag.String("policy", "",
+		"JSON file of allowed src->dst:port flows; other connections raise policy_violation events (disabled if empty)")
+	sloFile := flag.String("slos", "",
+		"JSON file of latency SLOs to track compliance and burn rates of (disabled if empty)")
+	servicesFile := flag.String("services", "",
+		"JSON file naming services by port, address or container label, to sum traffic per pair of services (disabled if empty)")
+	portList := flag.String("ports", "",
+		"comma-separated ports to report flows of, local or remote (all ports if empty)")
+	kernelBTF := flag.String("kernel-btf", "",
+		"BTF file of the running kernel, e.g. from BTFHub, for kernels without /sys/kernel/btf/vmlinux")
+	socketRescan := flag.Duration("socket-rescan", sockmap.DefaultRescan,
+		"how often at most /proc is rescanned to attribute connections to the process owning their socket, for events the kernel raises without process context (0 disables)")
+	dryRun := flag.Bool("dry-run", false,
+		"verify the eBPF programs and print the attach plan, filters and exports, then exit")
+	if err := settings.Apply(flag.CommandLine); err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	flag.Parse()
+
+	mode, err := attach.ParseMode(*attachMode)
+	if err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	resolutions, err := tsdb.ParseResolutions(*retention)
+	if err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	lim, err := parseLimits()
+	if err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	sockOpts, err := parseSocket()
+	if err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	histOpts, err := parseHistograms()
+	if err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	outOpts, err := parseOutput()
+	if err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	pol, err := policy.Load(*policyFile)
+	if err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	services, err := service.Load(*servicesFile)
+	if err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	slos, err := slo.Load(*sloFile, "tcp_rtt_seconds")
+	if err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	targetConfig, err := parseTargets()
+	if err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	logTap, err := route.OTLPLogs(*otlpLogs, *otlpLogEvents)
+	if err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	hookConfig, err := parseHook()
+	if err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	eventFilter, err := parseFilter()
+	if err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	coalesceConfig, err := parseCoalesce()
+	if err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	ports, err := parsePorts(*portList)
+	if err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	queue, err := probe.NewQueue(*eventQueue)
+	if err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	if *adaptiveSampling < 0 {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", fmt.Errorf("invalid -adaptive-sampling %v (want >= 0)", *adaptiveSampling))
+	}
+
+	// Review a configuration without loading or attaching anything
+	if *dryRun {
+		dryRunPlan(run, Config{
+			SamplingRate: uint32(*samplingRate),
+			FilterPorts:  ports,
+			AttachMode:   mode,
+			Profile:      prof,
+			Limits:       lim,
+			TraceContext: *traceContext,
+			Policy:       pol,
+			KernelBTF:    *kernelBTF,
+			SocketRescan: *socketRescan,
+			Targets:      targetConfig,
+			Queue:        queue,
+
+			AdaptiveSampling: *adaptiveSampling,
+			Services:         services,
+		}, *routes, *listen, *controlSocket, outOpts, *otlpMetrics, logTap, hookConfig, eventFilter, coalesceConfig)
+	}
+	router, err := route.Load(*routes, "tcp-flow", logTap)
+	if err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	hook, err := route.StartHook(hookConfig, "tcp-flow")
+	if err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	if err := router.Use(hook); err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	if err := router.Filter(eventFilter); err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	if err := router.Coalesce(coalesceConfig); err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	out, err := output.Open(outOpts, "tcp-flow")
+	if err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	metrics, err := otlp.NewMetricPusher(*otlpMetrics, nil, "tcp-flow", export.Options{})
+	if err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+
+	// Refuse to start where there is no eBPF backend
+	report, err := platform.Check()
+	if err != nil {
+		run.Fatal(summary.StageConfig, "Cannot run TCP flow monitor: %v", err)
+	}
+	log.Printf("Platform: %s", report)
+	log.Printf("Profile: %s", prof)
+	log.Printf("Configuration: %s", settings)
+
+	// Keep the monitor from competing with the workloads it observes
+	if err := lim.ApplyProcess(); err != nil {
+		log.Printf("Warning: failed to apply resource limits: %v", err)
+	}
+	log.Printf("Resource limits: %s", lim)
+
 	// Configuration
 	config := Config{
-		SamplingRate:   1000,
+		SamplingRate:   uint32(*samplingRate),
 		MaxFlows:      10000,
-		ReportInterval: 30 * time.Second,
+		ReportInterval: *reportInterval,
+		FilterPorts:    ports,
+		AttachMode:     mode,
+		Retention:      resolutions,
+		Profile:        prof,
+		Limits:         lim,
+		Router:         router,
+		Output:         out,
+		Histograms:     histOpts,
+		TraceContext:   *traceContext,
+		Policy:         pol,
+		SLOs:           slos,
+		KernelBTF:      *kernelBTF,
+		SocketRescan:   *socketRescan,
+		Targets:        targetConfig,
+		Queue:          queue,
+
+		AdaptiveSampling: *adaptiveSampling,
+		Services:         services,
 	}
 
 	// Create monitor
 	monitor, err := NewTCPFlowMonitor(config)
 	if err != nil {
-		log.Fatalf("Failed to create TCP flow monitor: %v", err)
+		run.Fatal(summary.StageLoad, "Failed to create TCP flow monitor: %v", err)
+	}
+	run.SetSource(monitor)
+
+	// Start monitoring
+	runner := probe.Runner{ReportInterval: config.ReportInterval, Watchdog: *watchdog, Queue: config.Queue}
+	if err := runner.Start(monitor); err != nil {
+		run.Fatal(probe.Stage(err), "Failed to start TCP flow monitor: %v", err)
 	}
 
 	// Set up signal handling
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := probe.SignalContext()
 	defer cancel()
 
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	// Restart when the fleet configuration changes the agent's settings
+	go settings.Watch(ctx, cancel)
 
-	go func() {
-		<-sigCh
-		log.Printf("Received signal, shutting down...")
-		cancel()
-	}()
+	// Follow new cgroups and processes of the targeting file
+	go monitor.targets.Run(ctx)
 
-	// Start monitoring
-	if err := monitor.Start(ctx); err != nil {
-		log.Fatalf("Failed to start TCP flow monitor: %v", err)
+	// Serve /api/v1/query and /metrics over the monitor's live state
+	if *listen != "" {
+		l, err := control.Listen(*listen, sockOpts)
+		if err != nil {
+			run.Fatal(summary.StageConfig, "Failed to listen for the query API: %v", err)
+		}
+		go func() {
+			if err := query.Serve(ctx, l, monitor); err != nil {
+				log.Printf("Query API error: %v", err)
+			}
+		}()
+		log.Printf("Query API listening on %s", *listen)
+	}
+
+	// Let probepilot attach steer the running monitor
+	if *controlSocket != "" {
+		l, err := control.Listen("unix:"+*controlSocket, sockOpts)
+		if err != nil {
+			run.Fatal(summary.StageConfig, "Failed to listen on the control socket: %v", err)
+		}
+		go func() {
+			if err := monitor.control.Serve(ctx, l); err != nil {
+				log.Printf("Control socket error: %v", err)
+			}
+		}()
+		log.Printf("Control socket listening on %s", *controlSocket)
+	}
+
+	// Push metrics to the OpenTelemetry collector
+	if metrics != nil {
+		log.Printf("OTLP metrics: pushing to %s every %v", metrics.URL(), *reportInterval)
 	}
+	go metrics.Run(ctx, monitor, *reportInterval)
 
-	// Wait for shutdown
-	<-ctx.Done()
+	// Process events until shutdown
+	if err := runner.Run(ctx, monitor); err != nil {
+		run.Fatal(summary.StageRun, "TCP flow monitor error: %v", err)
+	}
+	// Send the final counts
+	metrics.Push(monitor)
+	metrics.Close()
+	run.Finish()
 
 	// Clean up
-	if err := monitor.Stop(); err != nil {
+	if err := monitor.Close(); err != nil {
 		log.Printf("Error stopping monitor: %v", err)
 	}
 
@@ -0,0 +1,243 @@
+// Cgroups: CPU usage summed by the cgroup v2 each process last ran in, as
+// BPF records it in process_map, with containers named after their pod
+// or runtime name, set against each cgroup's cpu.stat and cpu.max so
+// containers throttled by their quota are warned of
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"probepilot/pkg/control"
+	"probepilot/pkg/query"
+	"probepilot/pkg/target"
+	"probepilot/pkg/units"
+)
+
+const (
+	// cgroupExported bounds the cgroups in Samples
+	cgroupExported = 20
+	// cgroupContributors bounds the processes a throttling warning names
+	cgroupContributors = 3
+)
+
+// cgroupUsage is the CPU usage of the processes of a cgroup over the last
+// report interval, and the cgroup's CPU time and throttling as the kernel
+// accounts it
+type cgroupUsage struct {
+	id   uint64
+	path string
+	// container is the ID of the container the cgroup belongs to, and
+	// containerName its name, "" for other cgroups
+	container     string
+	containerName string
+	percent       float64
+	processes     []cgroupProcess
+	// stat is valid if read, the cpu controller's files read, and
+	// interval its growth since the last report
+	stat     target.CgroupCPU
+	interval target.CgroupCPU
+	read     bool
+}
+
+// cgroupProcess is a process of a cgroup and its CPU usage
+type cgroupProcess struct {
+	id      ProcKey
+	percent float64
+}
+
+// name is the cgroup's container name, or its path, or its ID if neither
+// could be resolved
+func (c *cgroupUsage) name() string {
+	switch {
+	case c.containerName != "":
+		return c.containerName
+	case c.container != "":
+		return shortContainerID(c.container)
+	case c.path != "":
+		return c.path
+	}
+	return "cgroup-" + strconv.FormatUint(c.id, 10)
+}
+
+// throttled is the share of the last interval's enforcement periods in
+// which the cgroup ran out of quota, 0 without a quota
+func (c *cgroupUsage) throttled() float64 {
+	if c.interval.NrPeriods == 0 {
+		return 0
+	}
+	return float64(c.interval.NrThrottled) / float64(c.interval.NrPeriods)
+}
+
+// labels identify the cgroup, and its container if it is one
+func (c *cgroupUsage) labels() query.Labels {
+	labels := query.Labels{"cgroup": c.name()}
+	if c.path != "" {
+		labels["cgroup_path"] = c.path
+	}
+	if c.container != "" {
+		labels["container_id"] = shortContainerID(c.container)
+	}
+	return labels
+}
+
+// addCgroup counts a process using pct percent in cgroup id
+func addCgroup(cgroups map[uint64]*cgroupUsage, id uint64, pid ProcKey, pct float64) {
+	c, ok := cgroups[id]
+	if !ok {
+		c = &cgroupUsage{id: id}
+		cgroups[id] = c
+	}
+	c.percent += pct
+	c.processes = append(c.processes, cgroupProcess{id: pid, percent: pct})
+}
+
+// sampleCgroups resolves the cgroups of the last interval's usage, reads
+// their CPU time and throttling, ranks them by usage, and warns of those
+// throttled in -throttle-warn of their periods
+func (cp *CPUProfiler) sampleCgroups() {
+	prev := cp.cgroupStats
+	cp.cgroupStats = make(map[uint64]target.CgroupCPU, len(cp.usage.cgroups))
+	cgroups := make([]*cgroupUsage, 0, len(cp.usage.cgroups))
+	for _, c := range cp.usage.cgroups {
+		c.path, _ = cp.cgroupPaths.Path(c.id)
+		if c.container = target.ContainerID(c.path); c.container != "" {
+			c.containerName = cp.containers.Name(c.container)
+		}
+		if c.path != "" {
+			if stat, err := target.ReadCgroupCPU(c.path); err == nil {
+				c.stat, c.read = stat, true
+				cp.cgroupStats[c.id] = stat
+				// A cgroup new to the agent had all its throttling before
+				// it was first seen; count from here
+				if last, ok := prev[c.id]; ok {
+					c.interval = cpuStatSince(stat, last)
+				}
+			}
+		}
+		cgroups = append(cgroups, c)
+	}
+	sort.Slice(cgroups, func(i, j int) bool {
+		if cgroups[i].percent != cgroups[j].percent {
+			return cgroups[i].percent > cgroups[j].percent
+		}
+		return cgroups[i].id < cgroups[j].id
+	})
+	cp.cgroups = cgroups
+
+	byID := make(map[uint64]*cgroupUsage, len(cgroups))
+	for _, c := range cgroups {
+		byID[c.id] = c
+	}
+	for id := range cp.throttleAlerted {
+		if c, ok := byID[id]; !ok || c.throttled() < cp.throttleWarn {
+			delete(cp.throttleAlerted, id)
+		}
+	}
+	if cp.throttleWarn > 0 {
+		for _, c := range cgroups {
+			if c.throttled() >= cp.throttleWarn && !cp.throttleAlerted[c.id] {
+				cp.throttleAlerted[c.id] = true
+				cp.warnThrottled(c)
+			}
+		}
+	}
+}
+
+// cpuStatSince is the growth of the counters of stat since prev, an
+// earlier read of the same cgroup
+func cpuStatSince(stat, prev target.CgroupCPU) target.CgroupCPU {
+	d := stat
+	d.UsageUsec -= min(prev.UsageUsec, stat.UsageUsec)
+	d.NrPeriods -= min(prev.NrPeriods, stat.NrPeriods)
+	d.NrThrottled -= min(prev.NrThrottled, stat.NrThrottled)
+	d.ThrottledUsec -= min(prev.ThrottledUsec, stat.ThrottledUsec)
+	return d
+}
+
+// warnThrottled routes and outputs a warning of a cgroup throttled by
+// its CPU quota, naming the processes in it using the most CPU
+func (cp *CPUProfiler) warnThrottled(c *cgroupUsage) {
+	cp.throttleWarnings++
+	procs := append([]cgroupProcess(nil), c.processes...)
+	sort.Slice(procs, func(i, j int) bool { return procs[i].percent > procs[j].percent })
+	if len(procs) > cgroupContributors {
+		procs = procs[:cgroupContributors]
+	}
+	labels := c.labels()
+	labels["type"] = "cgroup_cpu_throttled"
+	labels["throttled_ratio"] = strconv.FormatFloat(c.throttled(), 'f', 2, 64)
+	text := fmt.Sprintf("cgroup %s throttled in %.0f%% of periods: %d of %d, %s throttled under a limit of %.2f CPUs, using %.1f%% of the host's CPU in %d processes",
+		c.name(), c.throttled()*100, c.interval.NrThrottled, c.interval.NrPeriods,
+		units.Duration(time.Duration(c.interval.ThrottledUsec)*time.Microsecond), c.stat.Limit(), c.percent, len(c.processes))
+	for i, p := range procs {
+		if i == 0 {
+			labels["pid"] = strconv.FormatUint(uint64(p.id.PID), 10)
+			labels["comm"] = cp.procs.Name(p.id.PID)
+			cp.procs.AddPIDLabels(labels, p.id.PID)
+		}
+		text += fmt.Sprintf("; pid=%d comm=%s cpu=%.1f%%", p.id.PID, cp.procs.Name(p.id.PID), p.percent)
+	}
+	cp.control.Publish(control.Event{Labels: labels, Text: text})
+	cp.router.Route(labels, text)
+	cp.output.Event(labels, text)
+	if !cp.output.JSON() {
+		fmt.Printf("CPU Throttling Warning: %s\n", text)
+	}
+}
+
+// printCgroups prints the cgroups using the most CPU
+func (cp *CPUProfiler) printCgroups() {
+	if len(cp.cgroups) == 0 {
+		return
+	}
+	fmt.Printf("\nTop 10 cgroups by CPU (%d CPUs):\n", cp.usage.cpus)
+	for i, c := range cp.cgroups {
+		if i == 10 {
+			break
+		}
+		line := fmt.Sprintf("  %s: CPU=%.1f%%, Processes=%d", c.name(), c.percent, len(c.processes))
+		if c.containerName != "" {
+			line += fmt.Sprintf(", Container=%s", shortContainerID(c.container))
+		}
+		if c.read && c.stat.Limit() > 0 {
+			line += fmt.Sprintf(", Limit=%.2f CPUs, Throttled=%.0f%% of periods (%s)", c.stat.Limit(),
+				c.throttled()*100, units.Duration(time.Duration(c.interval.ThrottledUsec)*time.Microsecond))
+		}
+		fmt.Println(line)
+	}
+}
+
+// cgroupSamples exports the cgroups using the most CPU
+func (cp *CPUProfiler) cgroupSamples() []query.Sample {
+	samples := []query.Sample{{Name: "cgroup_cpu_throttle_warnings_total", Value: float64(cp.throttleWarnings)}}
+	for i, c := range cp.cgroups {
+		if i == cgroupExported {
+			break
+		}
+		labels := c.labels()
+		samples = append(samples,
+			query.Sample{Name: "cgroup_cpu_usage_percent", Labels: labels, Value: c.percent},
+			query.Sample{Name: "cgroup_cpu_processes", Labels: labels, Value: float64(len(c.processes))},
+		)
+		if !c.read {
+			continue
+		}
+		samples = append(samples, query.Sample{Name: "cgroup_cpu_usage_seconds_total", Labels: labels,
+			Value: (time.Duration(c.stat.UsageUsec) * time.Microsecond).Seconds()})
+		if c.stat.Limit() > 0 {
+			samples = append(samples,
+				query.Sample{Name: "cgroup_cpu_limit_cores", Labels: labels, Value: c.stat.Limit()},
+				query.Sample{Name: "cgroup_cpu_periods_total", Labels: labels, Value: float64(c.stat.NrPeriods)},
+				query.Sample{Name: "cgroup_cpu_throttled_periods_total", Labels: labels, Value: float64(c.stat.NrThrottled)},
+				query.Sample{Name: "cgroup_cpu_throttled_seconds_total", Labels: labels,
+					Value: (time.Duration(c.stat.ThrottledUsec) * time.Microsecond).Seconds()},
+				query.Sample{Name: "cgroup_cpu_throttled_ratio", Labels: labels, Value: c.throttled()},
+			)
+		}
+	}
+	return samples
+}
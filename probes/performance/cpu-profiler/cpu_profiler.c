@@ -8,6 +8,18 @@
  * - Context switches and preemptions
  * - CPU frequency scaling events
  * - Load balancing across cores
+ *
+ * The 99Hz perf samples are counted in the kernel, per process and
+ * user/kernel stack pair, instead of being sent one by one; userspace
+ * drains the counts every report interval.
+ *
+ * Run queue latency, from a task being woken or preempted to it running
+ * again, is kept as log2 histograms per process and per CPU, which
+ * userspace drains every report interval.
+ *
+ * A process is identified by its PID and start time, as PIDs are
+ * recycled on busy hosts; its exit evicts it from process_map and is
+ * reported so userspace can finalize and drop its state too.
  */
 
 #include <vmlinux.h>
@@ -15,11 +27,24 @@
 #include <bpf/bpf_tracing.h>
 #include <bpf/bpf_core_read.h>
 
+#include "target.bpf.h"
+
 #define MAX_ENTRIES 10240
 #define MAX_CPUS 256
 #define TASK_COMM_LEN 16
+#define MAX_STACKS 16384
+#define MAX_STACK_DEPTH 127
+#define RUNQ_SLOTS 40
 
 /* Data structures */
+
+/* Identity of a process: its PID, and the start time of its thread
+ * group leader in ns since boot, which tells a recycled PID apart */
+struct proc_key {
+    __u32 pid;
+    __u64 start_time;
+};
+
 struct cpu_sample {
     __u64 timestamp;
     __u32 pid;
@@ -29,6 +54,16 @@ struct cpu_sample {
     __u32 prio;
     __u32 weight;
     char comm[TASK_COMM_LEN];
+    __u64 start_time;
+};
+
+/* Sent when a process exits, after its last sample */
+struct process_exit {
+    __u64 timestamp;
+    __u64 start_time;
+    __u32 pid;
+    __s32 exit_code;
+    char comm[TASK_COMM_LEN];
 };
 
 struct process_stats {
@@ -39,6 +74,43 @@ struct process_stats {
     __u64 last_seen;
     __u32 min_cpu;
     __u32 max_cpu;
+    __u64 cgroup_id;                   // cgroup v2 the process last ran in
+    __u64 freq_samples;                // perf samples at a known frequency
+    __u64 freq_khz_sum;                // and the CPU frequencies they ran at
+};
+
+/* Key of the in-kernel sample counts; stack ids are negative when
+ * bpf_get_stackid failed, e.g. for a kernel thread's user stack */
+struct stack_key {
+    __u64 start_time;
+    __u32 pid;
+    __s32 user_stack_id;
+    __s32 kernel_stack_id;
+    char comm[TASK_COMM_LEN];
+};
+
+/* Run queue latencies: slot s counts those under 2^s ns, from 2^(s-1),
+ * and the last slot everything longer */
+struct runq_hist {
+    __u64 slots[RUNQ_SLOTS];
+    __u64 count;
+    __u64 total_ns;
+};
+
+/* The frequency and idle state a CPU is in, and since when; idle_since
+ * is 0 while the CPU runs and freq 0 until its first change */
+struct cpu_power {
+    __u64 freq_since;
+    __u64 idle_since;
+    __u32 freq;                        // kHz
+    __u32 idle_state;                  // cpuidle state index
+};
+
+/* Key of the residency maps: a CPU and the frequency, in kHz, or the idle
+ * state it was in */
+struct power_key {
+    __u32 cpu;
+    __u32 state;
 };
 
 struct cpu_stats {
@@ -56,7 +128,7 @@ struct cpu_stats {
 struct {
     __uint(type, BPF_MAP_TYPE_HASH);
     __uint(max_entries, MAX_ENTRIES);
-    __type(key, __u32); // PID
+    __type(key, struct proc_key);
     __type(value, struct process_stats);
 } process_map SEC(".maps");
 
@@ -67,12 +139,88 @@ struct {
     __type(value, struct cpu_stats);
 } cpu_map SEC(".maps");
 
+struct {
+    __uint(type, BPF_MAP_TYPE_STACK_TRACE);
+    __uint(max_entries, MAX_STACKS);
+    __uint(key_size, sizeof(__u32));
+    __uint(value_size, MAX_STACK_DEPTH * sizeof(__u64));
+} stack_traces SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, MAX_STACKS);
+    __type(key, struct stack_key);
+    __type(value, __u64); // samples
+} stack_counts SEC(".maps");
+
 struct {
     __uint(type, BPF_MAP_TYPE_RINGBUF);
     __uint(max_entries, 256 * 1024);
 } events SEC(".maps");
 
-/* Configuration */
+/* When each task, by TID, was woken or preempted and so queued to run */
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(max_entries, MAX_ENTRIES);
+    __type(key, __u32);
+    __type(value, __u64);
+} runq_enqueued SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, MAX_ENTRIES);
+    __type(key, struct proc_key);
+    __type(value, struct runq_hist);
+} runq_latency SEC(".maps");
+
+/* Only ever updated by the CPU of its index */
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, MAX_CPUS);
+    __type(key, __u32); // CPU ID
+    __type(value, struct runq_hist);
+} runq_cpu_latency SEC(".maps");
+
+/* Indexed by CPU; cpu_frequency may update another CPU's */
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, MAX_CPUS);
+    __type(key, __u32); // CPU ID
+    __type(value, struct cpu_power);
+} cpu_power SEC(".maps");
+
+/* Nanoseconds each CPU spent at each frequency and in each idle state,
+ * up to its last change; userspace adds the time in the current one */
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, MAX_CPUS * 32);
+    __type(key, struct power_key);
+    __type(value, __u64);
+} freq_residency SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, MAX_CPUS * 16);
+    __type(key, struct power_key);
+    __type(value, __u64);
+} idle_residency SEC(".maps");
+
+/* Records the ring buffer had no room for, per CPU; userspace sums them */
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __uint(max_entries, 1);
+    __type(key, __u32);
+    __type(value, __u64);
+} ringbuf_drops SEC(".maps");
+
+static __always_inline void count_drop(void) {
+    __u32 key = 0;
+    __u64 *drops = bpf_map_lookup_elem(&ringbuf_drops, &key);
+    if (drops)
+        (*drops)++;
+}
+
+/* Configuration: index 0 holds the scheduler sample rate */
 struct {
     __uint(type, BPF_MAP_TYPE_ARRAY);
     __uint(max_entries, 4);
@@ -80,20 +228,140 @@ struct {
     __type(value, __u32);
 } config_map SEC(".maps");
 
+/* Keep 1 in config_map[0] scheduler samples; process_map totals stay exact */
+static __always_inline bool sample_event(void) {
+    __u32 key = 0;
+    __u32 *rate = bpf_map_lookup_elem(&config_map, &key);
+
+    if (!rate || *rate <= 1)
+        return true;
+    return bpf_get_prandom_u32() % *rate == 0;
+}
+
+/* Fill in the identity of task's process */
+static __always_inline void proc_key_of(struct task_struct *task, struct proc_key *key) {
+    key->pid = BPF_CORE_READ(task, tgid);
+    key->start_time = BPF_CORE_READ(task, group_leader, start_time);
+}
+
+/* Update the stats of the process of key as scheduled on cpu */
+static __always_inline struct process_stats *touch_process(struct proc_key *key,
+                                                           __u32 cpu, __u64 ts) {
+    struct process_stats *stats = bpf_map_lookup_elem(&process_map, key);
+    if (!stats) {
+        struct process_stats new_stats = {};
+        new_stats.last_seen = ts;
+        new_stats.min_cpu = cpu;
+        new_stats.max_cpu = cpu;
+        bpf_map_update_elem(&process_map, key, &new_stats, BPF_ANY);
+        return bpf_map_lookup_elem(&process_map, key);
+    }
+    stats->last_seen = ts;
+    if (cpu < stats->min_cpu) stats->min_cpu = cpu;
+    if (cpu > stats->max_cpu) stats->max_cpu = cpu;
+    return stats;
+}
+
+/* Add ns to the residency of cpu in state */
+static __always_inline void add_residency(void *map, __u32 cpu, __u32 state, __u64 ns) {
+    struct power_key key = {.cpu = cpu, .state = state};
+    __u64 *total = bpf_map_lookup_elem(map, &key);
+
+    if (total) {
+        __sync_fetch_and_add(total, ns);
+        return;
+    }
+    // Another CPU may have added the key since the lookup
+    if (bpf_map_update_elem(map, &key, &ns, BPF_NOEXIST)) {
+        total = bpf_map_lookup_elem(map, &key);
+        if (total)
+            __sync_fetch_and_add(total, ns);
+    }
+}
+
+/* Note that the task tid is queued to run as of ts */
+static __always_inline void runq_enqueue(__u32 tid, __u64 ts) {
+    if (tid)
+        bpf_map_update_elem(&runq_enqueued, &tid, &ts, BPF_ANY);
+}
+
+/* The histogram slot of a latency: 1 + floor(log2(ns)), 0 for 0 */
+static __always_inline __u32 runq_slot(__u64 ns) {
+    __u32 slot = 1;
+
+    if (!ns)
+        return 0;
+    if (ns >> 32) { ns >>= 32; slot += 32; }
+    if (ns >> 16) { ns >>= 16; slot += 16; }
+    if (ns >> 8) { ns >>= 8; slot += 8; }
+    if (ns >> 4) { ns >>= 4; slot += 4; }
+    if (ns >> 2) { ns >>= 2; slot += 2; }
+    if (ns >> 1) slot += 1;
+    return slot < RUNQ_SLOTS ? slot : RUNQ_SLOTS - 1;
+}
+
+static __always_inline void runq_observe(struct runq_hist *hist, __u32 slot, __u64 ns) {
+    if (slot >= RUNQ_SLOTS)
+        return;
+    __sync_fetch_and_add(&hist->slots[slot], 1);
+    __sync_fetch_and_add(&hist->count, 1);
+    __sync_fetch_and_add(&hist->total_ns, ns);
+}
+
+/* Account how long the task tid, now running on cpu, waited to run, to
+ * the CPU and, if targeted, its process */
+static __always_inline void runq_dequeue(__u32 tid, struct proc_key *key,
+                                         __u32 cpu, __u64 ts) {
+    __u64 *enqueued = bpf_map_lookup_elem(&runq_enqueued, &tid);
+    struct runq_hist *hist;
+    __u64 ns;
+    __u32 slot;
+
+    if (!enqueued)
+        return;
+    ns = ts > *enqueued ? ts - *enqueued : 0;
+    bpf_map_delete_elem(&runq_enqueued, &tid);
+    slot = runq_slot(ns);
+
+    hist = bpf_map_lookup_elem(&runq_cpu_latency, &cpu);
+    if (hist)
+        runq_observe(hist, slot, ns);
+
+    if (!target_allowed())
+        return;
+    hist = bpf_map_lookup_elem(&runq_latency, key);
+    if (!hist) {
+        struct runq_hist zero = {};
+        bpf_map_update_elem(&runq_latency, key, &zero, BPF_NOEXIST);
+        hist = bpf_map_lookup_elem(&runq_latency, key);
+        if (!hist)
+            return;
+    }
+    runq_observe(hist, slot, ns);
+}
+
 /* Helper function to send CPU sample to userspace */
 static __always_inline void send_cpu_sample(struct task_struct *task, 
                                            __u32 cpu, __u64 runtime) {
     struct cpu_sample *sample;
+    struct proc_key key = {};
+    
+    if (!target_allowed() || !sample_event())
+        return;
     
     sample = bpf_ringbuf_reserve(&events, sizeof(*sample), 0);
-    if (!sample)
+    if (!sample) {
+        count_drop();
         return;
+    }
     
     sample->timestamp = bpf_ktime_get_ns();
     sample->cpu = cpu;
     sample->runtime = runtime;
     
-    BPF_CORE_READ_INTO(&sample->pid, task, pid);
+    proc_key_of(task, &key);
+    sample->pid = key.pid;
+    sample->start_time = key.start_time;
     BPF_CORE_READ_INTO(&sample->prio, task, prio);
     BPF_CORE_READ_INTO(&sample->comm, task, comm);
     
@@ -107,30 +375,24 @@ static __always_inline void send_cpu_sample(struct task_struct *task,
     bpf_ringbuf_submit(sample, 0);
 }
 
-/* Trace process scheduling events */
+/* Trace process scheduling events. The tracepoint runs on the outgoing
+ * task; the incoming one is counted by finish_task_switch once it runs */
 SEC("tp/sched/sched_switch")
 int trace_sched_switch(struct trace_event_raw_sched_switch *ctx) {
-    struct task_struct *prev = (struct task_struct *)ctx->prev_pid;
-    struct task_struct *next = (struct task_struct *)ctx->next_pid;
-    __u32 prev_pid = ctx->prev_pid;
-    __u32 next_pid = ctx->next_pid;
+    struct task_struct *prev = (struct task_struct *)bpf_get_current_task();
     __u32 cpu = bpf_get_smp_processor_id();
     __u64 ts = bpf_ktime_get_ns();
     
+    // A preempted task stays runnable, queued to run again
+    if (ctx->prev_state == TASK_RUNNING)
+        runq_enqueue(ctx->prev_pid, ts);
+
     // Update process statistics for outgoing task
-    if (prev_pid > 0) {
-        struct process_stats *stats = bpf_map_lookup_elem(&process_map, &prev_pid);
-        if (!stats) {
-            struct process_stats new_stats = {};
-            new_stats.last_seen = ts;
-            new_stats.min_cpu = cpu;
-            new_stats.max_cpu = cpu;
-            bpf_map_update_elem(&process_map, &prev_pid, &new_stats, BPF_ANY);
-        } else {
-            stats->last_seen = ts;
-            if (cpu < stats->min_cpu) stats->min_cpu = cpu;
-            if (cpu > stats->max_cpu) stats->max_cpu = cpu;
-            
+    if (ctx->prev_pid > 0) {
+        struct proc_key key = {};
+        proc_key_of(prev, &key);
+        struct process_stats *stats = touch_process(&key, cpu, ts);
+        if (stats) {
             // Determine if switch was voluntary or involuntary
             if (ctx->prev_state == TASK_RUNNING) {
                 stats->involuntary_switches++;
@@ -140,24 +402,6 @@ int trace_sched_switch(struct trace_event_raw_sched_switch *ctx) {
         }
     }
     
-    // Update process statistics for incoming task
-    if (next_pid > 0) {
-        struct process_stats *stats = bpf_map_lookup_elem(&process_map, &next_pid);
-        if (!stats) {
-            struct process_stats new_stats = {};
-            new_stats.schedule_count = 1;
-            new_stats.last_seen = ts;
-            new_stats.min_cpu = cpu;
-            new_stats.max_cpu = cpu;
-            bpf_map_update_elem(&process_map, &next_pid, &new_stats, BPF_ANY);
-        } else {
-            stats->schedule_count++;
-            stats->last_seen = ts;
-            if (cpu < stats->min_cpu) stats->min_cpu = cpu;
-            if (cpu > stats->max_cpu) stats->max_cpu = cpu;
-        }
-    }
-    
     // Update CPU statistics
     struct cpu_stats *cpu_stats = bpf_map_lookup_elem(&cpu_map, &cpu);
     if (cpu_stats) {
@@ -173,6 +417,8 @@ int trace_sched_wakeup(struct trace_event_raw_sched_wakeup *ctx) {
     __u32 pid = ctx->pid;
     __u32 cpu = ctx->target_cpu;
     
+    runq_enqueue(pid, bpf_ktime_get_ns());
+
     // Send wakeup sample
     struct task_struct *task = (struct task_struct *)bpf_get_current_task();
     send_cpu_sample(task, cpu, 0);
@@ -180,10 +426,43 @@ int trace_sched_wakeup(struct trace_event_raw_sched_wakeup *ctx) {
     return 0;
 }
 
+/* A new task is queued to run for the first time */
+SEC("tp/sched/sched_wakeup_new")
+int trace_sched_wakeup_new(struct trace_event_raw_sched_wakeup *ctx) {
+    runq_enqueue(ctx->pid, bpf_ktime_get_ns());
+    return 0;
+}
+
+/* Count a perf sample under its process and stacks */
+static __always_inline void count_stack(struct bpf_perf_event_data *ctx, struct proc_key *proc) {
+    struct stack_key key = {};
+    __u64 one = 1, *count;
+
+    if (!target_allowed())
+        return;
+
+    key.pid = proc->pid;
+    key.start_time = proc->start_time;
+    key.user_stack_id = bpf_get_stackid(ctx, &stack_traces, BPF_F_USER_STACK);
+    key.kernel_stack_id = bpf_get_stackid(ctx, &stack_traces, 0);
+    bpf_get_current_comm(&key.comm, sizeof(key.comm));
+
+    count = bpf_map_lookup_elem(&stack_counts, &key);
+    if (count) {
+        __sync_fetch_and_add(count, 1);
+        return;
+    }
+    // Another CPU may have added the key since the lookup
+    if (bpf_map_update_elem(&stack_counts, &key, &one, BPF_NOEXIST)) {
+        count = bpf_map_lookup_elem(&stack_counts, &key);
+        if (count)
+            __sync_fetch_and_add(count, 1);
+    }
+}
+
 /* Sample CPU performance periodically */
 SEC("perf_event")
 int sample_cpu_perf(struct bpf_perf_event_data *ctx) {
-    struct task_struct *task = (struct task_struct *)bpf_get_current_task();
     __u32 pid = bpf_get_current_pid_tgid() >> 32;
     __u32 cpu = bpf_get_smp_processor_id();
     __u64 ts = bpf_ktime_get_ns();
@@ -193,23 +472,20 @@ int sample_cpu_perf(struct bpf_perf_event_data *ctx) {
         return 0;
     
     // Update process runtime statistics
-    struct process_stats *stats = bpf_map_lookup_elem(&process_map, &pid);
-    if (!stats) {
-        struct process_stats new_stats = {};
-        new_stats.total_runtime = 1;
-        new_stats.last_seen = ts;
-        new_stats.min_cpu = cpu;
-        new_stats.max_cpu = cpu;
-        bpf_map_update_elem(&process_map, &pid, &new_stats, BPF_ANY);
-    } else {
+    struct proc_key key = {};
+    proc_key_of((struct task_struct *)bpf_get_current_task(), &key);
+    struct process_stats *stats = touch_process(&key, cpu, ts);
+    if (stats) {
         stats->total_runtime++;
-        stats->last_seen = ts;
-        if (cpu < stats->min_cpu) stats->min_cpu = cpu;
-        if (cpu > stats->max_cpu) stats->max_cpu = cpu;
+        stats->cgroup_id = bpf_get_current_cgroup_id();
+        struct cpu_power *power = bpf_map_lookup_elem(&cpu_power, &cpu);
+        if (power && power->freq) {
+            stats->freq_samples++;
+            stats->freq_khz_sum += power->freq;
+        }
     }
     
-    // Send CPU sample
-    send_cpu_sample(task, cpu, stats ? stats->total_runtime : 1);
+    count_stack(ctx, &key);
     
     return 0;
 }
@@ -219,12 +495,22 @@ SEC("tp/power/cpu_frequency")
 int trace_cpu_frequency(struct trace_event_raw_cpu_frequency *ctx) {
     __u32 cpu = ctx->cpu_id;
     __u32 frequency = ctx->state;
+    __u64 ts = bpf_ktime_get_ns();
     
     // Update CPU frequency in stats
     struct cpu_stats *stats = bpf_map_lookup_elem(&cpu_map, &cpu);
     if (stats) {
         stats->frequency = frequency;
     }
+
+    // Close the residency of the frequency the CPU ran at until now
+    struct cpu_power *power = bpf_map_lookup_elem(&cpu_power, &cpu);
+    if (power) {
+        if (power->freq && ts > power->freq_since)
+            add_residency(&freq_residency, cpu, power->freq, ts - power->freq_since);
+        power->freq = frequency;
+        power->freq_since = ts;
+    }
     
     return 0;
 }
@@ -234,7 +520,20 @@ SEC("tp/power/cpu_idle")
 int trace_cpu_idle(struct trace_event_raw_cpu_idle *ctx) {
     __u32 cpu = bpf_get_smp_processor_id();
     __u32 state = ctx->state;
+    __u64 ts = bpf_ktime_get_ns();
     
+    // Time the idle state entered, adding it to its residency on exit
+    struct cpu_power *power = bpf_map_lookup_elem(&cpu_power, &cpu);
+    if (power) {
+        if (power->idle_since && ts > power->idle_since)
+            add_residency(&idle_residency, cpu, power->idle_state, ts - power->idle_since);
+        power->idle_since = 0;
+        if (state != (__u32)-1) {
+            power->idle_state = state;
+            power->idle_since = ts;
+        }
+    }
+
     struct cpu_stats *stats = bpf_map_lookup_elem(&cpu_map, &cpu);
     if (!stats)
         return 0;
@@ -277,6 +576,7 @@ int trace_softirq_entry(struct trace_event_raw_softirq_entry *ctx) {
 SEC("kprobe/finish_task_switch")
 int BPF_KPROBE(finish_task_switch, struct task_struct *prev) {
     struct task_struct *current = (struct task_struct *)bpf_get_current_task();
+    struct proc_key key = {};
     __u32 prev_pid, curr_pid;
     __u32 cpu = bpf_get_smp_processor_id();
     __u64 ts = bpf_ktime_get_ns();
@@ -286,7 +586,8 @@ int BPF_KPROBE(finish_task_switch, struct task_struct *prev) {
     
     // Calculate runtime for the previous task
     if (prev_pid > 0) {
-        struct process_stats *stats = bpf_map_lookup_elem(&process_map, &prev_pid);
+        proc_key_of(prev, &key);
+        struct process_stats *stats = bpf_map_lookup_elem(&process_map, &key);
         if (stats) {
             __u64 runtime = ts - stats->last_seen;
             stats->total_runtime += runtime;
@@ -296,6 +597,49 @@ int BPF_KPROBE(finish_task_switch, struct task_struct *prev) {
         }
     }
     
+    // Count the schedule of the task now running
+    if (curr_pid > 0) {
+        proc_key_of(current, &key);
+        struct process_stats *stats = touch_process(&key, cpu, ts);
+        if (stats) {
+            stats->schedule_count++;
+            stats->cgroup_id = bpf_get_current_cgroup_id();
+        }
+        runq_dequeue(curr_pid, &key, cpu, ts);
+    }
+    
+    return 0;
+}
+
+/* Evict an exiting process and report its exit, once its thread group
+ * leader exits; its threads exit before it unless the leader called
+ * pthread_exit early */
+SEC("tp/sched/sched_process_exit")
+int trace_sched_process_exit(void *ctx) {
+    struct task_struct *task = (struct task_struct *)bpf_get_current_task();
+    __u64 pid_tgid = bpf_get_current_pid_tgid();
+    struct proc_key key = {};
+    struct process_exit *record;
+
+    if ((__u32)pid_tgid != (__u32)(pid_tgid >> 32))
+        return 0;
+
+    proc_key_of(task, &key);
+    bpf_map_delete_elem(&process_map, &key);
+
+    if (!target_allowed())
+        return 0;
+    record = bpf_ringbuf_reserve(&events, sizeof(*record), 0);
+    if (!record) {
+        count_drop();
+        return 0;
+    }
+    record->timestamp = bpf_ktime_get_ns();
+    record->start_time = key.start_time;
+    record->pid = key.pid;
+    record->exit_code = BPF_CORE_READ(task, exit_code);
+    bpf_get_current_comm(&record->comm, sizeof(record->comm));
+    bpf_ringbuf_submit(record, 0);
     return 0;
 }
 
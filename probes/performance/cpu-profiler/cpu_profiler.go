@@ -3,104 +3,312 @@
 
 package main
 
+// Event and map value types are generated from the object's BTF:
+//go:generate go run probepilot/cmd/btfgen -obj build/cpu_profiler.o -out cpu_profiler_types.go -types proc_key,cpu_sample,process_exit,process_stats,runq_hist,cpu_power,power_key,cpu_stats,stack_key -names prio=Priority,vruntime=VRuntime,softirq_time=SoftIRQTime -checks layoutChecks
+
 import (
     "bytes"
     "context"
-    "encoding/binary"
+    "errors"
+    "flag"
     "fmt"
     "log"
     "os"
-    "os/signal"
-    "syscall"
+    "strconv"
+    "sync"
+    "sync/atomic"
     "time"
     "unsafe"
 
     "github.com/cilium/ebpf"
     "github.com/cilium/ebpf/link"
     "github.com/cilium/ebpf/perf"
-    "github.com/cilium/ebpf/ringbuf"
-    "github.com/cilium/ebpf/rlimit"
+
+    "probepilot/pkg/attach"
+    "probepilot/pkg/config"
+    "probepilot/pkg/control"
+    "probepilot/pkg/core"
+    "probepilot/pkg/decode"
+    "probepilot/pkg/export"
+    "probepilot/pkg/histogram"
+    "probepilot/pkg/layout"
+    "probepilot/pkg/limits"
+    "probepilot/pkg/maps"
+    "probepilot/pkg/otlp"
+    "probepilot/pkg/output"
+    "probepilot/pkg/platform"
+    "probepilot/pkg/probe"
+    "probepilot/pkg/procfs"
+    "probepilot/pkg/profile"
+    "probepilot/pkg/query"
+    "probepilot/pkg/route"
+    "probepilot/pkg/sampling"
+    "probepilot/pkg/slo"
+    "probepilot/pkg/summary"
+    "probepilot/pkg/symbolize"
+    "probepilot/pkg/target"
+    "probepilot/pkg/topk"
+    "probepilot/pkg/tsdb"
+    "probepilot/pkg/units"
 )
 
-// Data structures matching eBPF program
-type CPUSample struct {
-    Timestamp uint64
-    PID       uint32
-    CPU       uint32
-    Runtime   uint64
-    VRuntime  uint64
-    Priority  uint32
-    Weight    uint32
-    Comm      [16]int8
-}
+// requiredPrograms are the programs the profiler cannot run without; any
+// other program this kernel cannot load is dropped with its hook
+var requiredPrograms = []string{"trace_sched_switch"}
 
-type ProcessStats struct {
-    TotalRuntime        uint64
-    ScheduleCount       uint64
-    VoluntarySwitches   uint64
-    InvoluntarySwitches uint64
-    LastSeen            uint64
-    MinCPU              uint32
-    MaxCPU              uint32
-}
-
-type CPUStats struct {
-    IdleTime       uint64
-    UserTime       uint64
-    SystemTime     uint64
-    IRQTime        uint64
-    SoftIRQTime    uint64
-    ContextSwitches uint64
-    Frequency      uint32
-    LoadAvg        uint32
+// Config holds profiler configuration
+type Config struct {
+    Profile    profile.Profile
+    Retention  []tsdb.Resolution
+    Limits     limits.Limits
+    Router     *route.Router
+    Output     *output.Writer
+    Histograms histogram.Options
+    SLOs       *slo.Tracker
+    KernelBTF  string
+    RawSymbols bool
+    // Targets scopes every probe to the processes of a targeting file;
+    // nil profiles every process
+    Targets *target.Config
+    // Queue holds records the profiler has yet to handle; nil handles
+    // them as they are read
+    Queue *probe.Queue
+    // AdaptiveSampling is the ring buffer drops per second past which
+    // scheduler samples are sampled in BPF; 0 sends every one
+    AdaptiveSampling float64
+    // Folded and FlameGraph are rewritten every report with the perf
+    // samples' stacks, as folded stacks and an SVG flame graph; empty
+    // for none
+    Folded     string
+    FlameGraph string
+    // Pprof is rewritten every report with the perf samples as a pprof
+    // CPU profile; empty for none
+    Pprof string
+    // ThrottleWarn is the percentage of its quota's periods a cgroup is
+    // throttled in over a report interval that warns of it; 0 for none
+    ThrottleWarn float64
+    // LowFreq is the percentage of its maximum frequency under which a
+    // CPU counts as running slow
+    LowFreq float64
 }
 
 type CPUProfiler struct {
-    spec        *ebpf.CollectionSpec
-    coll        *ebpf.Collection
-    eventReader *ringbuf.Reader
-    links       []link.Link
+    // mu serializes Handle with Stats, which run on different goroutines,
+    // and with the query API, control socket and exporters reading the
+    // profiler's state
+    mu sync.Mutex
+
+    spec  *ebpf.CollectionSpec
+    coll  *ebpf.Collection
+    links []link.Link
     
-    // Statistics
+    profile   profile.Profile
+    limits    limits.Limits
+    kernelBTF string
+
+    // Optional hooks operators can toggle at runtime, and the control
+    // socket server they are toggled through
+    hooks   *attach.Toggles
+    control *control.Server
+
+    // Severity classification and routing of events to external sinks
+    router *route.Router
+
+    // JSON lines of events and stats snapshots, nil for text output
+    output *output.Writer
+
+    // Caps new processStats entries under -memory-limit
+    budget *limits.Budget
+
+    // Statistics, per process by PID and start time so a recycled PID is
+    // not merged with the process that had it before
     totalSamples uint64
-    processStats map[uint32]*ProcessStats
+    processStats *topk.Sketch[ProcKey, ProcessStats] // busiest by runtime, bounded by -top-k
+    exits        uint64
+
+    // Start time of the process holding each PID; a sample of another
+    // start time means the PID was recycled
+    starts map[uint32]uint64
     cpuStats     map[uint32]*CPUStats
     startTime    time.Time
+
+    // CPU usage of processes and containers over the last report interval
+    usage *usage
+
+    // CPU usage by cgroup, busiest first, and each cgroup's cpu.stat as
+    // last read; throttleWarn is the share of periods throttled that
+    // warns, once until it falls back below it
+    cgroupPaths      *target.CgroupPaths
+    cgroups          []*cgroupUsage
+    cgroupStats      map[uint64]target.CgroupCPU
+    throttleWarn     float64
+    throttleAlerted  map[uint64]bool
+    throttleWarnings uint64
+
+    // Process metadata, backfilled from /proc at startup
+    procs *procfs.Cache
+
+    // Local metric history with downsampled rollups
+    history *tsdb.Store
+
+    // Distribution of how long tasks ran before being switched out
+    runSlices *histogram.Histogram
+
+    // How long tasks waited to run, per process and per CPU
+    runq *runqLatency
+
+    // Time each CPU spent at each frequency and in each idle state
+    power *powerStates
+
+    // Latency SLOs over run slices
+    slos *slo.Tracker
+
+    // Perf samples counted per stack in BPF, and the symbolizer naming
+    // their frames
+    stacks  *stackSamples
+    symbols *symbolize.Symbolizer
+
+    // Files the stacks are written to every report, empty for none
+    foldedPath     string
+    flameGraphPath string
+    pprofPath      string
+
+    // Processes every probe reports, shared with the other agents
+    targetConfig *target.Config
+    targets      *target.Filter
+
+    // Images of the containers processes run in
+    containers *target.Labels
+
+    // Records read from the ring buffer and not yet handled
+    queue *probe.Queue
+
+    // Records the ring buffer had no room for, and the sampling rate they
+    // call for under -adaptive-sampling; each sample handled stands for
+    // sampleRate scheduler switches
+    drops      *sampling.Adaptive
+    sampleRate atomic.Uint32
 }
 
-func NewCPUProfiler() (*CPUProfiler, error) {
-    if err := rlimit.RemoveMemlock(); err != nil {
-        return nil, fmt.Errorf("failed to remove memlock: %v", err)
+// runSliceBuckets are the default classic run slice boundaries, 10us to ~1s
+var runSliceBuckets = histogram.ExponentialBuckets(0.00001, 2, 17)
+
+func NewCPUProfiler(config Config) (*CPUProfiler, error) {
+    history, err := tsdb.New(config.Retention...)
+    if err != nil {
+        return nil, fmt.Errorf("invalid history retention: %v", err)
     }
 
     profiler := &CPUProfiler{
-        processStats: make(map[uint32]*ProcessStats),
+        profile:      config.Profile,
+        limits:       config.Limits,
+        kernelBTF:    config.KernelBTF,
+        targetConfig: config.Targets,
+        budget:       limits.NewBudget(config.Limits.MemoryLimit / 4 * 3),
+        processStats: topk.New[ProcKey, ProcessStats](config.Limits.TopKEntries()),
+        starts:       make(map[uint32]uint64),
         cpuStats:     make(map[uint32]*CPUStats),
         startTime:    time.Now(),
+        procs:        procfs.NewCache(),
+        history:      history,
+        hooks:        attach.NewToggles(),
+        router:       config.Router,
+        output:       config.Output,
+        runSlices:    config.Histograms.New("cpu_run_slice_seconds", runSliceBuckets),
+        slos:         config.SLOs,
+        stacks:       newStackSamples(config.Limits.TopKEntries()),
+        runq:         newRunqLatency(config.Limits.TopKEntries()),
+        power:        newPowerStates(config.LowFreq / 100),
+        symbols:      symbolize.New(symbolize.Options{Raw: config.RawSymbols}),
+        queue:        config.Queue,
+        containers:   target.NewLabels(),
+        cgroupPaths:  target.NewCgroupPaths(),
+        cgroupStats:  make(map[uint64]target.CgroupCPU),
+        throttleWarn: config.ThrottleWarn / 100,
+        throttleAlerted: make(map[uint64]bool),
+
+        foldedPath:     config.Folded,
+        flameGraphPath: config.FlameGraph,
+        pprofPath:      config.Pprof,
+    }
+    if profiler.drops, err = sampling.NewAdaptive(1, config.AdaptiveSampling); err != nil {
+        return nil, err
+    }
+    profiler.sampleRate.Store(1)
+    profiler.usage = newUsage(profiler.startTime)
+    profiler.control = control.NewServer(profiler)
+    profiler.control.HandleHooks(profiler.hooks)
+
+    // Attribute processes that were already running before the agent
+    if n, err := profiler.procs.Backfill(); err != nil {
+        log.Printf("Warning: failed to backfill process metadata: %v", err)
+    } else {
+        log.Printf("Backfilled metadata for %d running processes", n)
+    }
+    if err := procfs.CheckHostPIDs(); err != nil {
+        log.Printf("Warning: %v", err)
     }
 
     return profiler, nil
 }
 
 func (cp *CPUProfiler) Load() error {
-    spec, err := ebpf.LoadCollectionSpec("cpu_profiler.o")
+    spec, err := ebpf.LoadCollectionSpec(probe.Object("cpu_profiler.o"))
     if err != nil {
-        return fmt.Errorf("failed to load eBPF spec: %v", err)
+        return fmt.Errorf("failed to load eBPF spec: %w", err)
+    }
+
+    // Refuse to decode records with structs that no longer match the object
+    if err := layout.ValidateAll(spec.Types, layoutChecks...); err != nil {
+        if !errors.Is(err, layout.ErrNoBTF) {
+            return fmt.Errorf("cpu_profiler.o does not match agent structs (rebuild both): %w", err)
+        }
+        log.Printf("Warning: cannot validate struct layouts: %v", err)
     }
     cp.spec = spec
 
-    coll, err := ebpf.NewCollection(spec)
+    // Size maps and ring buffers before they are created
+    if err := cp.limits.ApplySpec(spec); err != nil {
+        return fmt.Errorf("invalid map limits: %w", err)
+    }
+
+    // Relocate against this kernel's BTF, dropping hooks it cannot run
+    kernel, err := core.Detect(cp.kernelBTF)
     if err != nil {
-        return fmt.Errorf("failed to create eBPF collection: %v", err)
+        return err
+    }
+    if err := kernel.Err(); err != nil {
+        return err
+    }
+    dropped, err := kernel.Prepare(spec, requiredPrograms...)
+    for _, d := range dropped {
+        log.Printf("Warning: dropped program %s", d)
+    }
+    if err != nil {
+        return fmt.Errorf("cpu_profiler.o cannot run on %s: %w", kernel, err)
+    }
+    log.Printf("Kernel: %s", kernel)
+
+    coll, err := ebpf.NewCollectionWithOptions(spec, kernel.Options())
+    if err != nil {
+        return fmt.Errorf("failed to create eBPF collection: %w", err)
     }
     cp.coll = coll
 
-    // Create event reader
-    reader, err := ringbuf.NewReader(coll.Maps["events"])
+    // Scope every probe to the processes of the targeting file
+    cp.targets, err = target.NewFilter(coll, cp.targetConfig)
     if err != nil {
-        return fmt.Errorf("failed to create ring buffer reader: %v", err)
+        return fmt.Errorf("failed to set up targeting: %w", err)
+    }
+    if cp.targets != nil {
+        // Processes the agent reads from /proc are scoped at once
+        cp.procs.OnAdd = cp.targets.Add
+        log.Printf("Targets: %s", cp.targets)
+    }
+
+    if err := cp.power.seed(coll); err != nil {
+        log.Printf("Warning: failed to read CPU frequencies: %v", err)
     }
-    cp.eventReader = reader
 
     return nil
 }
@@ -112,21 +320,19 @@ func (cp *CPUProfiler) Attach() error {
     tracepoints := []string{
         "sched_switch",
         "sched_wakeup", 
+        "sched_wakeup_new",
+        "sched_process_exit",
         "cpu_frequency",
         "cpu_idle",
-        "irq_handler_entry",
-        "softirq_entry",
     }
     
     for _, tp := range tracepoints {
         var group, name string
         switch tp {
-        case "sched_switch", "sched_wakeup":
+        case "sched_switch", "sched_wakeup", "sched_wakeup_new", "sched_process_exit":
             group, name = "sched", tp
         case "cpu_frequency", "cpu_idle":
             group, name = "power", tp
-        case "irq_handler_entry", "softirq_entry":
-            group, name = "irq", tp
         }
         
         l, err := link.Tracepoint(link.TracepointOptions{
@@ -157,7 +363,7 @@ func (cp *CPUProfiler) Attach() error {
         Type:    perf.TypeSoftware,
         Config:  perf.ConfigSoftwareCPUClock,
         Program: cp.coll.Programs["sample_cpu_perf"],
-        SampleFreq: 99, // 99Hz sampling
+        SampleFreq: perfFreq,
     })
     if err != nil {
         log.Printf("Warning: failed to attach perf event: %v", err)
@@ -165,18 +371,76 @@ func (cp *CPUProfiler) Attach() error {
         cp.links = append(cp.links, perfLink)
     }
 
-    log.Printf("Attached %d eBPF programs", len(cp.links))
+    // IRQ hooks are costly on busy hosts; the profile decides whether they
+    // start attached and the control socket can switch them later
+    if err := cp.hooks.Add(profile.HookIRQ, cp.attachIRQ, cp.profile.Enabled(profile.HookIRQ)); err != nil {
+        log.Printf("Warning: %v", err)
+    }
+
+    log.Printf("Attached %d eBPF programs", len(cp.links)+cp.hooks.Links())
     return nil
 }
 
-func (cp *CPUProfiler) processEvent(record ringbuf.Record) error {
-    if len(record.RawSample) < int(unsafe.Sizeof(CPUSample{})) {
-        return fmt.Errorf("invalid sample size")
+func (cp *CPUProfiler) attachIRQ() ([]link.Link, error) {
+    var links []link.Link
+    for _, tp := range []string{"irq_handler_entry", "softirq_entry"} {
+        l, err := link.Tracepoint(link.TracepointOptions{
+            Group:   "irq",
+            Name:    tp,
+            Program: cp.coll.Programs["trace_"+tp],
+        })
+        if err != nil {
+            for _, l := range links {
+                l.Close()
+            }
+            return nil, fmt.Errorf("failed to attach tracepoint %s: %w", tp, err)
+        }
+        links = append(links, l)
+    }
+    return links, nil
+}
+
+// Events returns the ring buffer the wakeup and task switch samples and
+// process exits arrive on; perf samples are counted in BPF instead
+func (cp *CPUProfiler) Events() *ebpf.Map {
+    if cp.coll == nil {
+        return nil
+    }
+    return cp.coll.Maps["events"]
+}
+
+// processExitSize tells process exits apart from samples in the ring buffer
+var processExitSize = int(unsafe.Sizeof(ProcessExit{}))
+
+// Priority ranks records for the event queue: process exits are never
+// shed, scheduler samples first
+func (cp *CPUProfiler) Priority(record []byte) probe.Priority {
+    if len(record) == processExitSize {
+        return probe.PriorityCritical
+    }
+    return probe.PriorityBulk
+}
+
+// Lock locks the profiler's state; the Runner holds it over Handle, Stats
+// and RecordHistory, and query.Snapshot while it reads the samples
+func (cp *CPUProfiler) Lock() { cp.mu.Lock() }
+
+// Unlock unlocks the profiler's state
+func (cp *CPUProfiler) Unlock() { cp.mu.Unlock() }
+
+// Handle processes one sample or process exit from the ring buffer
+func (cp *CPUProfiler) Handle(record []byte) error {
+    if len(record) == processExitSize {
+        var exit ProcessExit
+        if err := decode.Record(record, &exit); err != nil {
+            return fmt.Errorf("failed to parse process exit: %v", err)
+        }
+        cp.handleExit(&exit)
+        return nil
     }
 
     var sample CPUSample
-    err := binary.Read(bytes.NewReader(record.RawSample), binary.LittleEndian, &sample)
-    if err != nil {
+    if err := decode.Record(record, &sample); err != nil {
         return fmt.Errorf("failed to parse sample: %v", err)
     }
 
@@ -190,15 +454,36 @@ func (cp *CPUProfiler) processEvent(record ringbuf.Record) error {
         }
         comm = append(comm, byte(c))
     }
+    labels := query.Labels{
+        "pid":  strconv.Itoa(int(sample.PID)),
+        "comm": string(comm),
+        "cpu":  strconv.Itoa(int(sample.CPU)),
+    }
+    cp.procs.AddPIDLabels(labels, sample.PID)
+    text := fmt.Sprintf("pid=%d cpu=%d comm=%s runtime=%s prio=%d",
+        sample.PID, sample.CPU, string(comm), units.Duration(time.Duration(sample.Runtime)), sample.Priority)
+    cp.control.Publish(control.Event{Labels: labels, Text: text})
+    cp.router.RouteAt(sample.Timestamp, labels, text)
+    cp.output.EventAt(sample.Timestamp, labels, text)
     
-    // Update process statistics
-    if _, exists := cp.processStats[sample.PID]; !exists {
-        cp.processStats[sample.PID] = &ProcessStats{}
+    // Update process statistics, weighting processes by runtime so
+    // short-lived ones make way for the busiest; under adaptive sampling
+    // each sample counts for the switches it stands for
+    id := ProcKey{PID: sample.PID, StartTime: sample.StartTime}
+    cp.observe(id)
+    if _, exists := cp.processStats.Get(id); !exists {
+        if !cp.budget.Allow() {
+            return nil
+        }
     }
     
-    stats := cp.processStats[sample.PID]
-    stats.TotalRuntime += sample.Runtime
-    stats.ScheduleCount++
+    slice := time.Duration(sample.Runtime).Seconds()
+    cp.runSlices.ObserveWithExemplar(slice, labels)
+    cp.slos.Observe("cpu_run_slice_seconds", labels, slice)
+    weight := uint64(cp.sampleRate.Load())
+    stats := cp.processStats.Add(id, sample.Runtime*weight)
+    stats.TotalRuntime += sample.Runtime * weight
+    stats.ScheduleCount += weight
     stats.LastSeen = sample.Timestamp
     
     if stats.MinCPU == 0 || sample.CPU < stats.MinCPU {
@@ -209,81 +494,268 @@ func (cp *CPUProfiler) processEvent(record ringbuf.Record) error {
     }
 
     // Print sample information
-    fmt.Printf("CPU Sample: PID=%d, CPU=%d, Comm=%s, Runtime=%d, VRuntime=%d, Prio=%d\n",
-        sample.PID, sample.CPU, string(comm), sample.Runtime, sample.VRuntime, sample.Priority)
+    if !cp.output.JSON() {
+        fmt.Printf("CPU Sample: PID=%d, CPU=%d, Comm=%s, Runtime=%s, VRuntime=%s, Prio=%d\n",
+            sample.PID, sample.CPU, string(comm), units.Duration(time.Duration(sample.Runtime)),
+            units.Duration(time.Duration(sample.VRuntime)), sample.Priority)
+    }
 
     return nil
 }
 
-func (cp *CPUProfiler) Run(ctx context.Context) error {
-    fmt.Println("Starting CPU profiler...")
-
-    for {
-        select {
-        case <-ctx.Done():
-            return ctx.Err()
-        default:
-            record, err := cp.eventReader.Read()
-            if err != nil {
-                if err == ringbuf.ErrClosed {
-                    return nil
-                }
-                log.Printf("Error reading from ring buffer: %v", err)
-                continue
-            }
+// observe notes the process holding id's PID. Another process that
+// had the PID must be gone, even if its exit was missed, so its state is
+// evicted rather than merged into the new one's
+func (cp *CPUProfiler) observe(id ProcKey) {
+    start, ok := cp.starts[id.PID]
+    if ok && start == id.StartTime {
+        return
+    }
+    if ok {
+        cp.evict(ProcKey{PID: id.PID, StartTime: start})
+    }
+    cp.starts[id.PID] = id.StartTime
+}
 
-            if err := cp.processEvent(record); err != nil {
-                log.Printf("Error processing event: %v", err)
-            }
+// evict drops the state kept for a process that is gone
+func (cp *CPUProfiler) evict(id ProcKey) {
+    cp.processStats.Remove(id)
+    cp.stacks.forget(id)
+    cp.runq.forget(id)
+    cp.procs.Remove(id.PID)
+    if cp.starts[id.PID] == id.StartTime {
+        delete(cp.starts, id.PID)
+    }
+}
+
+// handleExit reports the final statistics of an exited process and
+// evicts it
+func (cp *CPUProfiler) handleExit(exit *ProcessExit) {
+    id := ProcKey{PID: exit.PID, StartTime: exit.StartTime}
+    cp.exits++
+    var stats ProcessStats
+    if s, ok := cp.processStats.Get(id); ok {
+        stats = *s
+    }
+
+    comm := string(bytes.TrimRight(exit.Comm[:], "\x00"))
+    // exit_code holds the exit status as wait(2) reports it
+    status := fmt.Sprintf("code=%d", exit.ExitCode>>8&0xff)
+    if sig := exit.ExitCode & 0x7f; sig != 0 {
+        status = fmt.Sprintf("signal=%d", sig)
+    }
+    labels := query.Labels{
+        "type": "exit",
+        "pid":  strconv.Itoa(int(exit.PID)),
+        "comm": comm,
+    }
+    cp.procs.AddPIDLabels(labels, exit.PID)
+    text := fmt.Sprintf("exit pid=%d comm=%s %s runtime=%s schedules=%d",
+        exit.PID, comm, status, units.Duration(time.Duration(stats.TotalRuntime)), stats.ScheduleCount)
+    cp.control.Publish(control.Event{Labels: labels, Text: text})
+    cp.router.RouteAt(exit.Timestamp, labels, text)
+    cp.output.EventAt(exit.Timestamp, labels, text)
+    if !cp.output.JSON() {
+        fmt.Printf("Process exit: PID=%d, Comm=%s, %s, Runtime=%s, Schedules=%d\n",
+            exit.PID, comm, status, units.Duration(time.Duration(stats.TotalRuntime)), stats.ScheduleCount)
+    }
+
+    cp.evict(id)
+}
+
+// RecordHistory samples the profiler's counters into the local history;
+// the Runner calls it every second under the profiler's lock
+func (cp *CPUProfiler) RecordHistory(now time.Time) {
+    var runtime, schedules uint64
+    cp.processStats.Each(func(_ ProcKey, stats *ProcessStats) bool {
+        runtime += stats.TotalRuntime
+        schedules += stats.ScheduleCount
+        return true
+    })
+
+    cp.history.Add("cpu.samples", now, float64(cp.totalSamples))
+    cp.history.Add("cpu.runtime_seconds", now, time.Duration(runtime).Seconds())
+    cp.history.Add("cpu.schedules", now, float64(schedules))
+    cp.history.Add("cpu.tracked_processes", now, float64(cp.processStats.Len()))
+    cp.history.Add("cpu.runq_latency_p99_seconds", now, cp.runq.hostQuantile(0.99).Seconds())
+    cp.history.Add("cpu.frequency_low_ratio", now, cp.power.hostLow())
+}
+
+// Samples exposes the profiler's current state to the local query API
+func (cp *CPUProfiler) Samples() []query.Sample {
+    samples := []query.Sample{
+        {Name: "cpu_samples_total", Value: float64(cp.totalSamples)},
+        {Name: "cpu_process_exits_total", Value: float64(cp.exits)},
+    }
+    samples = append(samples, cp.stacks.samples(cp.procs.Name)...)
+    samples = append(samples, cp.runq.samples(cp.procs.Name)...)
+    samples = append(samples, cp.power.samples(cp.procs.Name)...)
+    samples = append(samples, mapSamples(cp.coll)...)
+    samples = append(samples, cp.router.Samples()...)
+    samples = append(samples, cp.queue.Samples()...)
+    samples = append(samples, cp.drops.Samples()...)
+    samples = append(samples, cp.slos.Samples()...)
+    samples = append(samples, cp.usageSamples()...)
+    samples = append(samples, cp.cgroupSamples()...)
+    for _, h := range cp.Histograms() {
+        samples = append(samples, h.Samples()...)
+    }
+    samples = append(samples, query.Sample{Name: "cpu_tracked_processes_evicted_total", Value: float64(cp.processStats.Evicted())})
+    cp.processStats.Each(func(id ProcKey, stats *ProcessStats) bool {
+        labels := query.Labels{
+            "pid":  strconv.FormatUint(uint64(id.PID), 10),
+            "comm": cp.procs.Name(id.PID),
         }
+        cp.procs.AddPIDLabels(labels, id.PID)
+        samples = append(samples,
+            query.Sample{Name: "process_cpu_runtime_seconds_total", Labels: labels, Value: time.Duration(stats.TotalRuntime).Seconds()},
+            query.Sample{Name: "process_cpu_schedules_total", Labels: labels, Value: float64(stats.ScheduleCount)},
+            query.Sample{Name: "process_cpu_usage_percent", Labels: labels, Value: cp.usage.processes[id]},
+        )
+        return true
+    })
+    return samples
+}
+
+// Histograms exposes the profiler's distributions to /metrics
+func (cp *CPUProfiler) Histograms() []query.HistogramSample {
+    return append([]query.HistogramSample{cp.runSlices.Snapshot(nil)}, cp.runq.histograms()...)
+}
+
+// mapSamples exposes map fill levels to the local query API
+func mapSamples(coll *ebpf.Collection) []query.Sample {
+    var samples []query.Sample
+    for _, u := range maps.Measure(coll) {
+        labels := query.Labels{"map": u.Name}
+        samples = append(samples,
+            query.Sample{Name: "bpf_map_entries", Labels: labels, Value: float64(u.Entries)},
+            query.Sample{Name: "bpf_map_max_entries", Labels: labels, Value: float64(u.MaxEntries)},
+        )
     }
+    return samples
 }
 
 func (cp *CPUProfiler) PrintStats() {
     fmt.Printf("\n=== CPU Profiler Statistics ===\n")
-    fmt.Printf("Runtime: %v\n", time.Since(cp.startTime))
+    fmt.Printf("Runtime: %s\n", units.Duration(time.Since(cp.startTime)))
     fmt.Printf("Total samples: %d\n", cp.totalSamples)
-    fmt.Printf("Tracked processes: %d\n", len(cp.processStats))
-
-    fmt.Printf("\nTop 10 processes by runtime:\n")
-    type processInfo struct {
-        pid     uint32
-        runtime uint64
-        count   uint64
-    }
-    
-    var processes []processInfo
-    for pid, stats := range cp.processStats {
-        processes = append(processes, processInfo{
-            pid:     pid,
-            runtime: stats.TotalRuntime,
-            count:   stats.ScheduleCount,
-        })
+    fmt.Printf("Tracked processes: %d (top %d)\n", cp.processStats.Len(), cp.processStats.Capacity())
+    if evicted := cp.processStats.Evicted(); evicted > 0 {
+        fmt.Printf("Processes evicted for busier ones: %d\n", evicted)
     }
-    
-    // Simple bubble sort for top 10
-    for i := 0; i < len(processes)-1; i++ {
-        for j := 0; j < len(processes)-i-1; j++ {
-            if processes[j].runtime < processes[j+1].runtime {
-                processes[j], processes[j+1] = processes[j+1], processes[j]
-            }
-        }
+    if dropped := cp.budget.Dropped(); dropped > 0 {
+        fmt.Printf("Processes dropped over memory budget: %d\n", dropped)
     }
-    
-    count := len(processes)
-    if count > 10 {
-        count = 10
+    fmt.Printf("Processes exited: %d\n", cp.exits)
+    if cp.queue != nil {
+        fmt.Printf("Event queue: %s\n", cp.queue)
     }
-    
-    for i := 0; i < count; i++ {
-        p := processes[i]
-        fmt.Printf("  PID %d: Runtime=%d, Schedules=%d\n", 
-            p.pid, p.runtime, p.count)
+    fmt.Printf("Ring buffer: %s\n", cp.drops)
+    fmt.Printf("History: %d points in %d series\n", cp.history.Len(), len(cp.history.Series()))
+
+    fmt.Printf("\nTop 10 processes by runtime:\n")
+    for _, p := range cp.processStats.Top(10) {
+        fmt.Printf("  PID %d (%s): CPU=%.1f%%, Runtime=%s, Schedules=%d\n", 
+            p.Key.PID, cp.procs.Name(p.Key.PID), cp.usage.processes[p.Key], units.Duration(time.Duration(p.Value.TotalRuntime)), p.Value.ScheduleCount)
     }
+    cp.printContainerUsage()
+    cp.printCgroups()
     
+    fmt.Printf("\nHottest stacks:\n")
+    cp.stacks.print(5, 8)
+
+    cp.runq.print(10, cp.procs.Name)
+    cp.power.print(10, cp.runq.slowest(10), cp.procs.Name)
+
     // Read current CPU statistics from maps
     fmt.Printf("\nCPU Statistics:\n")
     cp.readCPUStats()
+    cp.printMapUtilization()
+}
+
+// Stats drains the stack counts, run queue latencies and power state residency, computes CPU usage over the interval,
+// reads the throttling of cgroups, prints the statistics, or writes them
+// as a JSON snapshot, and routes SLO burn alerts, throttling warnings and
+// changes of sampling rate
+func (cp *CPUProfiler) Stats(ctx context.Context) {
+    cp.checkDrops(time.Now())
+    if err := cp.stacks.drain(cp.coll, cp.symbols); err != nil {
+        log.Printf("Warning: %v", err)
+    }
+    if err := cp.runq.drain(cp.coll); err != nil {
+        log.Printf("Warning: %v", err)
+    }
+    if err := cp.power.drain(cp.coll, cp.processStats); err != nil {
+        log.Printf("Warning: %v", err)
+    }
+    cp.power.correlate(cp.runq.cpuQuantiles(0.99))
+    cp.updateUsage(time.Now())
+    cp.sampleCgroups()
+    cp.writeProfiles()
+    if cp.output.JSON() {
+        cp.output.Stats(cp.Samples())
+    } else {
+        cp.PrintStats()
+    }
+    cp.CheckSLOs()
+}
+
+// checkDrops reads the records the ring buffer dropped and, under
+// -adaptive-sampling, moves the scheduler sampling rate as they call for
+func (cp *CPUProfiler) checkDrops(now time.Time) {
+    dropped, err := maps.RingbufDrops(cp.coll)
+    if err != nil {
+        log.Printf("Warning: failed to read ring buffer drops: %v", err)
+        return
+    }
+    prev := cp.sampleRate.Load()
+    rate, changed := cp.drops.Observe(dropped, now)
+    if !changed {
+        return
+    }
+    if err := cp.coll.Maps["config_map"].Put(uint32(0), rate); err != nil {
+        log.Printf("Warning: failed to set sampling rate: %v", err)
+        return
+    }
+    cp.sampleRate.Store(rate)
+
+    labels := cp.drops.Labels(prev)
+    text := fmt.Sprintf("scheduler sampling changed from 1 in %d to 1 in %d at %s ring buffer drops/s",
+        prev, rate, labels["drops_per_sec"])
+    log.Printf("[SAMPLING] %s", text)
+    cp.control.Publish(control.Event{Labels: labels, Text: text})
+    cp.router.Route(labels, text)
+    cp.output.Event(labels, text)
+}
+
+// CheckSLOs routes SLO burn alerts that started or stopped firing
+func (cp *CPUProfiler) CheckSLOs() {
+    for _, burn := range cp.slos.Check() {
+        labels, text := burn.Labels(), burn.String()
+        log.Printf("[SLO] %s", text)
+        cp.control.Publish(control.Event{Labels: labels, Text: text})
+        cp.router.Route(labels, text)
+        cp.output.Event(labels, text)
+    }
+}
+
+// Stalled routes the watchdog's stalls as probe_stall alerts
+func (cp *CPUProfiler) Stalled(s probe.Stall) {
+    labels, text := s.Labels(), s.String()
+    cp.control.Publish(control.Event{Labels: labels, Text: text})
+    cp.router.Route(labels, text)
+    cp.output.Event(labels, text)
+}
+
+// printMapUtilization reports map fill levels and warns before maps fill up
+func (cp *CPUProfiler) printMapUtilization() {
+    fmt.Printf("\nMap utilization:\n")
+    for _, u := range maps.Measure(cp.coll) {
+        fmt.Printf("  %s\n", u)
+        if rec := u.Recommendation(maps.DefaultWarnPercent); rec != "" {
+            log.Printf("Warning: %s", rec)
+        }
+    }
 }
 
 func (cp *CPUProfiler) readCPUStats() {
@@ -291,24 +763,24 @@ func (cp *CPUProfiler) readCPUStats() {
     cpuMap := cp.coll.Maps["cpu_map"]
     
     // Iterate through process map
-    var key uint32
+    var key ProcKey
     var stats ProcessStats
     iter := processMap.Iterate()
     
     fmt.Printf("Process Map Contents:\n")
     count := 0
     for iter.Next(&key, &stats) && count < 5 {
-        fmt.Printf("  PID %d: Runtime=%d, Schedules=%d, Vol/Invol=%d/%d\n",
-            key, stats.TotalRuntime, stats.ScheduleCount,
+        fmt.Printf("  PID %d: Runtime=%s, Schedules=%d, Vol/Invol=%d/%d\n",
+            key.PID, units.Duration(time.Duration(stats.TotalRuntime)), stats.ScheduleCount,
             stats.VoluntarySwitches, stats.InvoluntarySwitches)
         count++
     }
     
-    // Read CPU map for a few CPUs
+    // Read CPU map for a few CPUs; cpu_map is per-CPU, so fold every
+    // CPU's copy of each slot instead of reading only the first one
     fmt.Printf("CPU Map Contents:\n")
     for i := uint32(0); i < 4; i++ { // Check first 4 CPUs
-        var cpuStats CPUStats
-        err := cpuMap.Lookup(i, &cpuStats)
+        cpuStats, err := maps.LookupAggregated[uint32, CPUStats](cpuMap, i, mergeCPUStats)
         if err == nil && cpuStats.ContextSwitches > 0 {
             fmt.Printf("  CPU %d: CtxSwitches=%d, IRQ=%d, SoftIRQ=%d, Freq=%dMHz\n",
                 i, cpuStats.ContextSwitches, cpuStats.IRQTime, 
@@ -317,69 +789,305 @@ func (cp *CPUProfiler) readCPUStats() {
     }
 }
 
-func (cp *CPUProfiler) Close() error {
-    if cp.eventReader != nil {
-        cp.eventReader.Close()
+// mergeCPUStats sums the per-CPU counters of a cpu_map slot; frequency
+// and load are gauges, so the highest reported value wins
+func mergeCPUStats(acc *CPUStats, v CPUStats) {
+    acc.IdleTime += v.IdleTime
+    acc.UserTime += v.UserTime
+    acc.SystemTime += v.SystemTime
+    acc.IRQTime += v.IRQTime
+    acc.SoftIRQTime += v.SoftIRQTime
+    acc.ContextSwitches += v.ContextSwitches
+    if v.Frequency > acc.Frequency {
+        acc.Frequency = v.Frequency
+    }
+    if v.LoadAvg > acc.LoadAvg {
+        acc.LoadAvg = v.LoadAvg
     }
+}
+
+func (cp *CPUProfiler) Close() error {
 
     for _, l := range cp.links {
         l.Close()
     }
+    cp.hooks.Close()
 
     if cp.coll != nil {
         cp.coll.Close()
     }
 
+    // Deliver events still queued for routing
+    cp.router.Close()
+    cp.output.Close()
+
     return nil
 }
 
 func main() {
-    profiler, err := NewCPUProfiler()
+    run := summary.Start("cpu-profiler", flag.CommandLine)
+
+    // The configuration file and environment may select the profile, which
+    // supplies the defaults of every other flag
+    settings, err := config.Load(os.Args[1:], "cpu")
     if err != nil {
-        log.Fatalf("Failed to create CPU profiler: %v", err)
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
     }
-    defer profiler.Close()
+    // Deferred first, so it runs after every other deferred cleanup
+    defer settings.Restart()
+    prof, err := profile.Selected(settings.Args(os.Args[1:]))
+    if err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    flag.String("config", settings.Path(),
+        "YAML file of per-probe settings, overridden by $PROBEPILOT_* and flags (default $PROBEPILOT_CONFIG)")
+    settings.RegisterFleetFlags(flag.CommandLine)
+    flag.String("profile", prof.Name, profile.Usage())
+    retention := flag.String("retention", prof.Retention,
+        "local history resolutions as step:retention pairs")
+    reportInterval := flag.Duration("report-interval", prof.ReportInterval,
+        "how often to print statistics")
+    watchdog := probe.RegisterWatchdogFlag(flag.CommandLine)
+    eventQueue := probe.RegisterQueueFlag(flag.CommandLine)
+    adaptiveSampling := sampling.RegisterAdaptiveFlag(flag.CommandLine)
+    parseLimits := limits.RegisterFlags(flag.CommandLine)
+    parseSocket := control.RegisterFlags(flag.CommandLine)
+    parseHistograms := histogram.RegisterFlags(flag.CommandLine)
+    parseOutput := output.RegisterFlags(flag.CommandLine)
+    parseHook := route.RegisterHookFlags(flag.CommandLine)
+    parseFilter := route.RegisterFilterFlag(flag.CommandLine)
+    parseCoalesce := route.RegisterCoalesceFlags(flag.CommandLine)
+    listen := flag.String("listen", "",
+        "address for the local query API: host:port, e.g. 127.0.0.1:9465, or unix:/path (disabled if empty)")
+    controlSocket := flag.String("control", "",
+        "UNIX socket for probepilot attach, e.g. /run/probepilot/cpu.sock (disabled if empty)")
+    routes := flag.String("routes", "",
+        "JSON file of per-probe event severity and routing rules (disabled if empty)")
+    otlpMetrics := flag.String("otlp-metrics", "",
+        "OpenTelemetry collector to push metrics to every report interval over OTLP/HTTP, e.g. http://otel-collector:4318 (disabled if empty)")
+    otlpLogs := flag.String("otlp-logs", "",
+        "OpenTelemetry collector to export the -otlp-log-events classes of events to as OTLP log records, e.g. http://otel-collector:4318 (disabled if empty)")
+    otlpLogEvents := flag.String("otlp-log-events", route.DefaultLogClasses,
+        "comma-separated classes of events for -otlp-logs: oom, security, connection_failure, self_health, process_exit, memory_pressure or all")
+    sloFile := flag.String("slos", "",
+        "JSON file of latency SLOs to track compliance and burn rates of (disabled if empty)")
+    rawSymbols := flag.Bool("raw-symbols", false,
+        "print mangled C++ and Rust symbol names in stacks as is")
+    folded := flag.String("folded", "",
+        "file to rewrite every report with the sampled stacks as folded stacks, for flamegraph.pl, speedscope or inferno (disabled if empty)")
+    flameGraph := flag.String("flamegraph", "",
+        "SVG file to rewrite every report with a flame graph of the sampled stacks (disabled if empty)")
+    pprofFile := flag.String("pprof", "",
+        "file to rewrite every report with the sampled stacks as a gzipped pprof CPU profile, for go tool pprof or Speedscope; -listen also serves /debug/pprof/profile (disabled if empty)")
+    kernelBTF := flag.String("kernel-btf", "",
+        "BTF file of the running kernel, e.g. from BTFHub, for kernels without /sys/kernel/btf/vmlinux")
+    throttleWarn := flag.Float64("throttle-warn", 25,
+        "percentage of its CPU quota's periods a cgroup is throttled in over a report interval that warns of it (0 disables)")
+    lowFreq := flag.Float64("low-freq", 70,
+        "percentage of its maximum frequency under which a CPU counts as running slow in the frequency report")
+    dryRun := flag.Bool("dry-run", false,
+        "verify the eBPF programs and print the attach plan, filters and exports, then exit")
+    parseTargets := target.RegisterFlags(flag.CommandLine)
+    procfs.RegisterFlags(flag.CommandLine)
+    if err := settings.Apply(flag.CommandLine); err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    flag.Parse()
 
-    if err := profiler.Load(); err != nil {
-        log.Fatalf("Failed to load eBPF program: %v", err)
+    resolutions, err := tsdb.ParseResolutions(*retention)
+    if err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
     }
+    lim, err := parseLimits()
+    if err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    sockOpts, err := parseSocket()
+    if err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    histOpts, err := parseHistograms()
+    if err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    outOpts, err := parseOutput()
+    if err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    slos, err := slo.Load(*sloFile, "cpu_run_slice_seconds")
+    if err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    targetConfig, err := parseTargets()
+    if err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    logTap, err := route.OTLPLogs(*otlpLogs, *otlpLogEvents)
+    if err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    hookConfig, err := parseHook()
+    if err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    eventFilter, err := parseFilter()
+    if err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    coalesceConfig, err := parseCoalesce()
+    if err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    queue, err := probe.NewQueue(*eventQueue)
+    if err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    if *adaptiveSampling < 0 {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", fmt.Errorf("invalid -adaptive-sampling %v (want >= 0)", *adaptiveSampling))
+    }
+    if *throttleWarn < 0 || *throttleWarn > 100 {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", fmt.Errorf("invalid -throttle-warn %v (want 0 to 100)", *throttleWarn))
+    }
+    if *lowFreq <= 0 || *lowFreq > 100 {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", fmt.Errorf("invalid -low-freq %v (want over 0, up to 100)", *lowFreq))
+    }
+
+    // Review a configuration without loading or attaching anything
+    if *dryRun {
+        dryRunPlan(run, Config{Profile: prof, Limits: lim, KernelBTF: *kernelBTF, Targets: targetConfig, Queue: queue, AdaptiveSampling: *adaptiveSampling, Folded: *folded, FlameGraph: *flameGraph, Pprof: *pprofFile, ThrottleWarn: *throttleWarn, LowFreq: *lowFreq}, *routes, *listen, *controlSocket, outOpts, *otlpMetrics, logTap, hookConfig, eventFilter, coalesceConfig)
+    }
+    router, err := route.Load(*routes, "cpu-profiler", logTap)
+    if err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    hook, err := route.StartHook(hookConfig, "cpu-profiler")
+    if err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    if err := router.Use(hook); err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    if err := router.Filter(eventFilter); err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    if err := router.Coalesce(coalesceConfig); err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    out, err := output.Open(outOpts, "cpu-profiler")
+    if err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+    metrics, err := otlp.NewMetricPusher(*otlpMetrics, nil, "cpu-profiler", export.Options{})
+    if err != nil {
+        run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+    }
+
+    // Refuse to start where there is no eBPF backend
+    report, err := platform.Check()
+    if err != nil {
+        run.Fatal(summary.StageConfig, "Cannot run CPU profiler: %v", err)
+    }
+    log.Printf("Platform: %s", report)
+    log.Printf("Profile: %s", prof)
+    log.Printf("Configuration: %s", settings)
+
+    // Keep the profiler from competing with the workloads it observes
+    if err := lim.ApplyProcess(); err != nil {
+        log.Printf("Warning: failed to apply resource limits: %v", err)
+    }
+    log.Printf("Resource limits: %s", lim)
+
+    profiler, err := NewCPUProfiler(Config{
+        Profile:    prof,
+        Retention:  resolutions,
+        Limits:     lim,
+        Router:     router,
+        Output:     out,
+        Histograms: histOpts,
+        SLOs:       slos,
+        KernelBTF:  *kernelBTF,
+        RawSymbols: *rawSymbols,
+        Targets:    targetConfig,
+        Queue:      queue,
+        AdaptiveSampling: *adaptiveSampling,
+        Folded:     *folded,
+        FlameGraph: *flameGraph,
+        Pprof:      *pprofFile,
+        ThrottleWarn: *throttleWarn,
+        LowFreq:    *lowFreq,
+    })
+    if err != nil {
+        run.Fatal(summary.StageLoad, "Failed to create CPU profiler: %v", err)
+    }
+    defer profiler.Close()
+    run.SetSource(profiler)
 
-    if err := profiler.Attach(); err != nil {
-        log.Fatalf("Failed to attach eBPF programs: %v", err)
+    runner := probe.Runner{ReportInterval: *reportInterval, Watchdog: *watchdog, Queue: queue}
+    if err := runner.Start(profiler); err != nil {
+        run.Fatal(probe.Stage(err), "Failed to start CPU profiler: %v", err)
     }
 
     // Handle interrupts gracefully
-    ctx, cancel := context.WithCancel(context.Background())
-    sigChan := make(chan os.Signal, 1)
-    signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+    ctx, cancel := probe.SignalContext()
+    defer cancel()
 
-    go func() {
-        <-sigChan
-        log.Println("Received interrupt signal, shutting down...")
-        cancel()
-    }()
+    // Restart when the fleet configuration changes the agent's settings
+    go settings.Watch(ctx, cancel)
 
-    // Start stats printer goroutine
-    go func() {
-        ticker := time.NewTicker(10 * time.Second)
-        defer ticker.Stop()
-        
-        for {
-            select {
-            case <-ctx.Done():
-                return
-            case <-ticker.C:
-                profiler.PrintStats()
+    // Follow new cgroups and processes of the targeting file
+    go profiler.targets.Run(ctx)
+
+    // Serve /api/v1/query and /metrics over the profiler's live state
+    if *listen != "" {
+        l, err := control.Listen(*listen, sockOpts)
+        if err != nil {
+            run.Fatal(summary.StageConfig, "Failed to listen for the query API: %v", err)
+        }
+        go func() {
+            if err := query.Serve(ctx, l, profiler); err != nil {
+                log.Printf("Query API error: %v", err)
             }
+        }()
+        log.Printf("Query API listening on %s", *listen)
+    }
+
+    // Let probepilot attach steer the running profiler
+    if *controlSocket != "" {
+        l, err := control.Listen("unix:"+*controlSocket, sockOpts)
+        if err != nil {
+            run.Fatal(summary.StageConfig, "Failed to listen on the control socket: %v", err)
         }
-    }()
+        go func() {
+            if err := profiler.control.Serve(ctx, l); err != nil {
+                log.Printf("Control socket error: %v", err)
+            }
+        }()
+        log.Printf("Control socket listening on %s", *controlSocket)
+    }
 
-    // Run the profiler
-    if err := profiler.Run(ctx); err != nil && err != context.Canceled {
-        log.Fatalf("CPU profiler error: %v", err)
+    // Push metrics to the OpenTelemetry collector
+    if metrics != nil {
+        log.Printf("OTLP metrics: pushing to %s every %v", metrics.URL(), *reportInterval)
     }
+    go metrics.Run(ctx, profiler, *reportInterval)
 
-    // Print final statistics
-    profiler.PrintStats()
+    // Keep kernel symbols current as modules load and unload
+    go func() {
+        if err := profiler.symbols.WatchKernelModules(ctx); err != nil {
+            log.Printf("Warning: kernel symbols will not follow module loads: %v", err)
+        }
+    }()
+
+    // Run the profiler, reporting every interval until interrupted
+    if !out.JSON() {
+        fmt.Println("Starting CPU profiler...")
+    }
+    if err := runner.Run(ctx, profiler); err != nil {
+        run.Fatal(summary.StageRun, "CPU profiler error: %v", err)
+    }
+    // Send the final counts
+    metrics.Push(profiler)
+    metrics.Close()
+    run.Finish()
     log.Println("CPU profiler stopped")
 }
\ No newline at end of file
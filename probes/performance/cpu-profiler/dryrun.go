@@ -0,0 +1,140 @@
+// Dry run: the profiler's attach plan, printed instead of running
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/cilium/ebpf"
+
+	"probepilot/pkg/core"
+	"probepilot/pkg/expr"
+	"probepilot/pkg/layout"
+	"probepilot/pkg/otlp"
+	"probepilot/pkg/output"
+	"probepilot/pkg/plan"
+	"probepilot/pkg/probe"
+	"probepilot/pkg/profile"
+	"probepilot/pkg/route"
+	"probepilot/pkg/sampling"
+	"probepilot/pkg/summary"
+	"probepilot/pkg/tsdb"
+)
+
+// dryRunPlan verifies the programs and prints what the profiler would
+// attach and export under config, then exits without attaching anything
+func dryRunPlan(run *summary.Run, config Config, routes, listen, controlSocket string, out output.Options, otlpMetrics string, otlpLogs *route.Tap, hook route.HookConfig, filter *expr.Program, coalesce route.CoalesceConfig) {
+	p := plan.New("cpu-profiler", config.Profile)
+	if err := p.Routes(routes); err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+
+	spec, err := ebpf.LoadCollectionSpec(probe.Object("cpu_profiler.o"))
+	if err != nil {
+		run.Fatal(summary.StageLoad, "Failed to load eBPF spec: %v", err)
+	}
+	if err := layout.ValidateAll(spec.Types, layoutChecks...); err != nil && !errors.Is(err, layout.ErrNoBTF) {
+		run.Fatal(summary.StageLoad, "cpu_profiler.o does not match agent structs (rebuild both): %v", err)
+	}
+	if err := config.Limits.ApplySpec(spec); err != nil {
+		run.Fatal(summary.StageConfig, "Invalid map limits: %v", err)
+	}
+	kernel, err := core.Detect(config.KernelBTF)
+	if err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	if err := kernel.Err(); err != nil {
+		run.Fatal(summary.StageLoad, "Cannot run CPU profiler: %v", err)
+	}
+	dropped, err := kernel.Prepare(spec, requiredPrograms...)
+	if err != nil {
+		run.Fatal(summary.StageLoad, "Failed to load eBPF programs: %v", fmt.Errorf("cpu_profiler.o cannot run on %s: %w", kernel, err))
+	}
+	p.Core(kernel, dropped)
+	p.Verify("cpu_profiler.o", spec, kernel.Options())
+
+	irq := config.Profile.Enabled(profile.HookIRQ)
+	p.Hooks = append(p.Hooks,
+		plan.Hook{Kind: "tracepoint", Target: "sched/sched_switch", Program: "trace_sched_switch", Enabled: true, Cost: plan.Medium},
+		plan.Hook{Kind: "tracepoint", Target: "sched/sched_wakeup", Program: "trace_sched_wakeup", Enabled: true, Cost: plan.Medium},
+		plan.Hook{Kind: "tracepoint", Target: "sched/sched_wakeup_new", Program: "trace_sched_wakeup_new", Enabled: true, Cost: plan.Low},
+		plan.Hook{Kind: "tracepoint", Target: "sched/sched_process_exit", Program: "trace_sched_process_exit", Enabled: true, Cost: plan.Low},
+		plan.Hook{Kind: "tracepoint", Target: "power/cpu_frequency", Program: "trace_cpu_frequency", Enabled: true, Cost: plan.Low},
+		plan.Hook{Kind: "tracepoint", Target: "power/cpu_idle", Program: "trace_cpu_idle", Enabled: true, Cost: plan.Medium},
+		plan.Hook{Kind: "kprobe", Target: "finish_task_switch", Program: "finish_task_switch", Enabled: true, Cost: plan.Medium},
+		plan.Hook{Kind: "perf_event", Target: "cpu-clock at 99Hz, counted per stack in BPF", Program: "sample_cpu_perf", Enabled: true, Cost: plan.Low},
+		plan.Hook{Set: profile.HookIRQ, Kind: "tracepoint", Target: "irq/irq_handler_entry", Program: "trace_irq_handler_entry", Enabled: irq, Cost: plan.High},
+		plan.Hook{Set: profile.HookIRQ, Kind: "tracepoint", Target: "irq/softirq_entry", Program: "trace_softirq_entry", Enabled: irq, Cost: plan.High},
+	)
+
+	if config.Queue != nil {
+		p.Filter("event queue", fmt.Sprintf("%d records, scheduler samples shed first, process exits never", config.Queue.Stats().Capacity))
+	}
+	if config.AdaptiveSampling > 0 {
+		p.Filter("adaptive sampling", fmt.Sprintf("scheduler samples thinned to as few as 1 in %d while the ring buffer drops over %v records/s, process totals weighted to match", sampling.MaxAdaptiveRate, config.AdaptiveSampling))
+	}
+	cgroups := "CPU usage by cgroup v2, containers named after their pod or runtime name, against cpu.stat and cpu.max"
+	if config.ThrottleWarn > 0 {
+		cgroups += fmt.Sprintf(", warning when throttled in %v%% of periods", config.ThrottleWarn)
+	}
+	p.Filter("cgroups", cgroups)
+	p.Filter("power states", fmt.Sprintf("time per CPU at each frequency and in each idle state, under %v%% of max frequency counting as low, set against run queue p99 per CPU and process", config.LowFreq))
+	if config.Targets != nil {
+		p.Filter("targets", config.Targets.String()+" (every probe, inside BPF)")
+	}
+	if listen != "" {
+		p.Export("query API", listen)
+		p.Export("Grafana datasource", tsdb.GrafanaPath+" on "+listen)
+	}
+	if controlSocket != "" {
+		p.Export("control socket", controlSocket)
+	}
+	switch out.Format {
+	case output.JSON:
+		p.Export("JSON lines", out.Destination())
+	case output.Binary:
+		p.Export("binary event log", out.Destination())
+	}
+	if otlpMetrics != "" {
+		url, err := otlp.SignalURL(otlpMetrics, otlp.MetricsPath)
+		if err != nil {
+			run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+		}
+		p.Export("OTLP metrics", url)
+	}
+	if otlpLogs != nil {
+		p.Export("OTLP logs", otlpLogs.String())
+	}
+	if config.Folded != "" {
+		p.Export("folded stacks", config.Folded)
+	}
+	if config.FlameGraph != "" {
+		p.Export("flame graph", config.FlameGraph)
+	}
+	if config.Pprof != "" {
+		p.Export("pprof profile", config.Pprof)
+	}
+	if listen != "" {
+		p.Export("pprof endpoint", "/debug/pprof/profile on "+listen)
+	}
+	if hook.Module != "" {
+		p.Filter("event hook", hook.String()+" (before routing)")
+	}
+	if filter != nil {
+		p.Filter("event filter", filter.String()+" (before routing)")
+	}
+	if coalesce.Window > 0 {
+		p.Filter("event coalescing", coalesce.String()+" (before routing)")
+	}
+
+	if err := p.Write(os.Stdout); err != nil {
+		run.Fatal(summary.StageRun, "Failed to print the plan: %v", err)
+	}
+	if err := p.Err(); err != nil {
+		run.Fatal(summary.StageLoad, "eBPF programs failed verification: %v", err)
+	}
+	run.Finish()
+	os.Exit(0)
+}
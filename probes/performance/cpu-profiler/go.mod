@@ -4,9 +4,12 @@ go 1.21
 
 require (
 	github.com/cilium/ebpf v0.12.3
+	probepilot v0.0.0
 )
 
 require (
 	golang.org/x/exp v0.0.0-20230224173230-c95f2b4c22f2 // indirect
 	golang.org/x/sys v0.15.0 // indirect
-)
\ No newline at end of file
+)
+
+replace probepilot => ../..
@@ -0,0 +1,497 @@
+// CPU power states: how long each CPU ran at each frequency and sat in
+// each idle state over the last report interval, timed by BPF from the
+// power/cpu_frequency and power/cpu_idle tracepoints, and set against
+// the run queue latency of each CPU and the frequency each process ran
+// at, so governor or thermal throttling that slows workloads shows as such
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cilium/ebpf"
+
+	"probepilot/pkg/clock"
+	"probepilot/pkg/procfs"
+	"probepilot/pkg/query"
+	"probepilot/pkg/topk"
+	"probepilot/pkg/units"
+)
+
+// freqBands split frequency residency by share of the maximum frequency,
+// each band up to its bound; the last also holds boost frequencies past
+// the maximum
+var freqBands = []struct {
+	name  string
+	bound float64
+}{
+	{"0-30%", 0.3},
+	{"30-50%", 0.5},
+	{"50-70%", 0.7},
+	{"70-90%", 0.9},
+	{"90-100%", math.Inf(1)},
+}
+
+// minCorrelated is how many CPUs with waits a correlation takes
+const minCorrelated = 3
+
+// cpuPower is a CPU's residency over the last interval, in ns at each
+// frequency in kHz and in each idle state, and its frequency scaling
+type cpuPower struct {
+	freq map[uint32]uint64
+	idle map[uint32]uint64
+	info procfs.CPUFreq
+	// throttles is how many times it was throttled for heat
+	throttles uint64
+}
+
+// maxKHz is the CPU's maximum frequency, or the highest it ran at if
+// cpufreq does not say
+func (c *cpuPower) maxKHz() uint64 {
+	if c.info.MaxKHz > 0 {
+		return c.info.MaxKHz
+	}
+	var top uint64
+	for khz := range c.freq {
+		top = max(top, uint64(khz))
+	}
+	return top
+}
+
+// timed is the ns of the interval the CPU's frequency is known for
+func (c *cpuPower) timed() uint64 {
+	var ns uint64
+	for _, t := range c.freq {
+		ns += t
+	}
+	return ns
+}
+
+// meanKHz is the CPU's frequency averaged over the time it is known for
+func (c *cpuPower) meanKHz() float64 {
+	timed := c.timed()
+	if timed == 0 {
+		return 0
+	}
+	var sum float64
+	for khz, ns := range c.freq {
+		sum += float64(khz) * float64(ns)
+	}
+	return sum / float64(timed)
+}
+
+// share is the part of the time the frequency is known for that it was
+// from lo up to hi of the maximum
+func (c *cpuPower) share(lo, hi float64) float64 {
+	timed, top := c.timed(), float64(c.maxKHz())
+	if timed == 0 || top == 0 {
+		return 0
+	}
+	var ns uint64
+	for khz, t := range c.freq {
+		if f := float64(khz) / top; f >= lo && f < hi {
+			ns += t
+		}
+	}
+	return float64(ns) / float64(timed)
+}
+
+// topFreqs returns the n frequencies the CPU spent the most time at
+func (c *cpuPower) topFreqs(n int) []uint32 {
+	freqs := make([]uint32, 0, len(c.freq))
+	for khz := range c.freq {
+		freqs = append(freqs, khz)
+	}
+	sort.Slice(freqs, func(i, j int) bool { return c.freq[freqs[i]] > c.freq[freqs[j]] })
+	return freqs[:min(n, len(freqs))]
+}
+
+// idleStates returns the idle states the CPU entered, shallowest first
+func (c *cpuPower) idleStates() []uint32 {
+	states := make([]uint32, 0, len(c.idle))
+	for state := range c.idle {
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i] < states[j] })
+	return states
+}
+
+// idleNs is the time the CPU spent idle
+func (c *cpuPower) idleNs() uint64 {
+	var ns uint64
+	for _, t := range c.idle {
+		ns += t
+	}
+	return ns
+}
+
+// powerStates holds the residency of the last interval. It is safe for
+// concurrent use, but drains must not overlap.
+type powerStates struct {
+	mu sync.Mutex
+	// low is the share of its maximum frequency under which a CPU is slow
+	low      float64
+	cpus     map[uint32]*cpuPower
+	interval time.Duration
+	at       uint64
+	// freqRead, idleRead and throttleRead are the totals as last read;
+	// they only grow
+	freqRead     map[PowerKey]uint64
+	idleRead     map[PowerKey]uint64
+	throttleRead map[uint32]uint64
+	// procRead is each tracked process's perf samples at a known frequency
+	// and their frequencies' sum as last read, and procFreq the mean kHz
+	// its samples of the last interval ran at
+	procRead map[ProcKey][2]uint64
+	procFreq map[ProcKey]float64
+	// runqP99 is each CPU's run queue p99 over the last interval, and
+	// correlation that of its share of time at low frequency with it
+	// across the correlated CPUs, if any
+	runqP99     map[uint32]time.Duration
+	correlation float64
+	correlated  int
+}
+
+func newPowerStates(low float64) *powerStates {
+	return &powerStates{
+		low:          low,
+		cpus:         make(map[uint32]*cpuPower),
+		at:           clock.Now(),
+		freqRead:     make(map[PowerKey]uint64),
+		idleRead:     make(map[PowerKey]uint64),
+		throttleRead: make(map[uint32]uint64),
+		procRead:     make(map[ProcKey][2]uint64),
+		procFreq:     make(map[ProcKey]float64),
+	}
+}
+
+// seed starts every CPU at the frequency it runs at, which a CPU whose
+// frequency never changes would otherwise never report.
+func (s *powerStates) seed(coll *ebpf.Collection) error {
+	m := coll.Maps["cpu_power"]
+	if m == nil {
+		return errors.New("no cpu_power map in cpu_profiler.o")
+	}
+	cpus, err := procfs.OnlineCPUs()
+	if err != nil {
+		return err
+	}
+	now := clock.Now()
+	for cpu := 0; cpu < cpus && cpu < int(m.MaxEntries()); cpu++ {
+		info, err := procfs.ReadCPUFreq(cpu)
+		if err != nil || info.CurKHz == 0 {
+			continue
+		}
+		power := CPUPower{FreqSince: now, Freq: uint32(info.CurKHz)}
+		if err := m.Put(uint32(cpu), power); err != nil {
+			return fmt.Errorf("seeding cpu_power: %v", err)
+		}
+	}
+	return nil
+}
+
+// drain reads the residency of every CPU since the last drain, with the
+// time in the states they are in now, and the frequency each tracked
+// process ran at.
+func (s *powerStates) drain(coll *ebpf.Collection, processes *topk.Sketch[ProcKey, ProcessStats]) error {
+	powerMap, freqMap, idleMap := coll.Maps["cpu_power"], coll.Maps["freq_residency"], coll.Maps["idle_residency"]
+	if powerMap == nil || freqMap == nil || idleMap == nil {
+		return errors.New("no power residency maps in cpu_profiler.o")
+	}
+	now := clock.Now()
+
+	// The residency maps are read before the current states: a state that
+	// ends in between is missed until the next drain rather than counted
+	// twice
+	freq, idle := make(map[PowerKey]uint64), make(map[PowerKey]uint64)
+	for _, r := range []struct {
+		name   string
+		m      *ebpf.Map
+		totals map[PowerKey]uint64
+	}{{"freq_residency", freqMap, freq}, {"idle_residency", idleMap, idle}} {
+		var key PowerKey
+		var ns uint64
+		iter := r.m.Iterate()
+		for iter.Next(&key, &ns) {
+			r.totals[key] = ns
+		}
+		if err := iter.Err(); err != nil {
+			return fmt.Errorf("reading %s: %v", r.name, err)
+		}
+	}
+	var cpu uint32
+	var power CPUPower
+	iter := powerMap.Iterate()
+	for iter.Next(&cpu, &power) {
+		if power.Freq != 0 && now > power.FreqSince {
+			freq[PowerKey{CPU: cpu, State: power.Freq}] += now - power.FreqSince
+		}
+		if power.IdleSince != 0 && now > power.IdleSince {
+			idle[PowerKey{CPU: cpu, State: power.IdleState}] += now - power.IdleSince
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("reading cpu_power: %v", err)
+	}
+
+	cpus := make(map[uint32]*cpuPower)
+	get := func(cpu uint32) *cpuPower {
+		c, ok := cpus[cpu]
+		if !ok {
+			c = &cpuPower{freq: make(map[uint32]uint64), idle: make(map[uint32]uint64)}
+			cpus[cpu] = c
+		}
+		return c
+	}
+	for key, ns := range freq {
+		if d := ns - min(s.freqRead[key], ns); d > 0 {
+			get(key.CPU).freq[key.State] = d
+		}
+	}
+	for key, ns := range idle {
+		if d := ns - min(s.idleRead[key], ns); d > 0 {
+			get(key.CPU).idle[key.State] = d
+		}
+	}
+	throttles := make(map[uint32]uint64, len(cpus))
+	for cpu, c := range cpus {
+		if info, err := procfs.ReadCPUFreq(int(cpu)); err == nil {
+			c.info = info
+			if prev, ok := s.throttleRead[cpu]; ok {
+				c.throttles = info.ThermalThrottles - min(prev, info.ThermalThrottles)
+			}
+			throttles[cpu] = info.ThermalThrottles
+		}
+	}
+
+	procRead := make(map[ProcKey][2]uint64)
+	procFreq := make(map[ProcKey]float64)
+	processes.Each(func(id ProcKey, stats *ProcessStats) bool {
+		read := [2]uint64{stats.FreqSamples, stats.FreqKhzSum}
+		procRead[id] = read
+		prev := s.procRead[id]
+		if read[0] > prev[0] && read[1] >= prev[1] {
+			procFreq[id] = float64(read[1]-prev[1]) / float64(read[0]-prev[0])
+		}
+		return true
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cpus = cpus
+	s.interval = time.Duration(now - min(s.at, now))
+	s.at = now
+	s.freqRead, s.idleRead, s.throttleRead = freq, idle, throttles
+	s.procRead, s.procFreq = procRead, procFreq
+	return nil
+}
+
+// correlate sets the share of time each CPU spent at low frequency
+// against its run queue p99.
+func (s *powerStates) correlate(runqP99 map[uint32]time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.runqP99 = runqP99
+	var xs, ys []float64
+	for cpu, p99 := range runqP99 {
+		c, ok := s.cpus[cpu]
+		if !ok || c.timed() == 0 {
+			continue
+		}
+		xs = append(xs, c.share(0, s.low))
+		ys = append(ys, p99.Seconds())
+	}
+	var ok bool
+	if s.correlation, ok = pearson(xs, ys); ok {
+		s.correlated = len(xs)
+	} else {
+		s.correlated = 0
+	}
+}
+
+// pearson is the correlation coefficient of xs and ys, if there are
+// enough of them and both vary
+func pearson(xs, ys []float64) (float64, bool) {
+	n := float64(len(xs))
+	if len(xs) < minCorrelated {
+		return 0, false
+	}
+	var sx, sy float64
+	for i := range xs {
+		sx += xs[i]
+		sy += ys[i]
+	}
+	mx, my := sx/n, sy/n
+	var cov, vx, vy float64
+	for i := range xs {
+		dx, dy := xs[i]-mx, ys[i]-my
+		cov += dx * dy
+		vx += dx * dx
+		vy += dy * dy
+	}
+	if vx == 0 || vy == 0 {
+		return 0, false
+	}
+	return cov / math.Sqrt(vx*vy), true
+}
+
+// hostMaxKHz is the highest maximum frequency of any CPU
+func (s *powerStates) hostMaxKHz() uint64 {
+	var top uint64
+	for _, c := range s.cpus {
+		top = max(top, c.maxKHz())
+	}
+	return top
+}
+
+// hostLow is the share of the known time of every CPU spent at low
+// frequency.
+func (s *powerStates) hostLow() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var low, timed float64
+	for _, c := range s.cpus {
+		t := float64(c.timed())
+		low += c.share(0, s.low) * t
+		timed += t
+	}
+	if timed == 0 {
+		return 0
+	}
+	return low / timed
+}
+
+// samples exports the last interval's residency per CPU, host-wide by
+// band of the maximum frequency, its correlation with run queue latency,
+// and the frequency each process ran at.
+func (s *powerStates) samples(name func(pid uint32) string) []query.Sample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var samples []query.Sample
+	bands := make([]float64, len(freqBands))
+	var timed float64
+	for cpu, c := range s.cpus {
+		labels := query.Labels{"cpu": strconv.FormatUint(uint64(cpu), 10)}
+		if t := c.timed(); t > 0 {
+			samples = append(samples,
+				query.Sample{Name: "cpu_frequency_mean_hertz", Labels: labels, Value: c.meanKHz() * 1000},
+				query.Sample{Name: "cpu_frequency_max_hertz", Labels: labels, Value: float64(c.maxKHz()) * 1000},
+				query.Sample{Name: "cpu_frequency_low_ratio", Labels: labels, Value: c.share(0, s.low)},
+			)
+			lo := 0.0
+			for i, b := range freqBands {
+				bands[i] += c.share(lo, b.bound) * float64(t)
+				lo = b.bound
+			}
+			timed += float64(t)
+		}
+		if s.interval > 0 {
+			samples = append(samples, query.Sample{Name: "cpu_idle_ratio", Labels: labels, Value: float64(c.idleNs()) / float64(s.interval)})
+			for state, ns := range c.idle {
+				samples = append(samples, query.Sample{Name: "cpu_idle_state_ratio",
+					Labels: query.Labels{"cpu": labels["cpu"], "state": c.info.IdleState(state)}, Value: float64(ns) / float64(s.interval)})
+			}
+		}
+		if c.info.ThermalThrottles > 0 {
+			samples = append(samples, query.Sample{Name: "cpu_thermal_throttles_total", Labels: labels, Value: float64(c.info.ThermalThrottles)})
+		}
+	}
+	if timed > 0 {
+		for i, b := range freqBands {
+			samples = append(samples, query.Sample{Name: "cpu_frequency_residency_ratio",
+				Labels: query.Labels{"band": b.name}, Value: bands[i] / timed})
+		}
+	}
+	if s.correlated > 0 {
+		samples = append(samples, query.Sample{Name: "cpu_frequency_runq_correlation", Value: s.correlation})
+	}
+	for id, khz := range s.procFreq {
+		samples = append(samples, query.Sample{Name: "process_cpu_frequency_hertz",
+			Labels: query.Labels{"pid": strconv.FormatUint(uint64(id.PID), 10), "comm": name(id.PID)}, Value: khz * 1000})
+	}
+	return samples
+}
+
+// print logs the residency of the n CPUs that spent the most time at low
+// frequency, the correlation with run queue latency, and the frequency
+// the n processes with the highest run queue p99 ran at
+func (s *powerStates) print(n int, slowest []runqProc, name func(pid uint32) string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.cpus) == 0 {
+		return
+	}
+	fmt.Printf("\nCPU frequency and idle states (low under %.0f%% of max):\n", s.low*100)
+	cpus := make([]uint32, 0, len(s.cpus))
+	for cpu := range s.cpus {
+		cpus = append(cpus, cpu)
+	}
+	sort.Slice(cpus, func(i, j int) bool {
+		a, b := s.cpus[cpus[i]].share(0, s.low), s.cpus[cpus[j]].share(0, s.low)
+		if a != b {
+			return a > b
+		}
+		return cpus[i] < cpus[j]
+	})
+	for _, cpu := range cpus[:min(n, len(cpus))] {
+		c := s.cpus[cpu]
+		var parts []string
+		if c.timed() > 0 {
+			part := fmt.Sprintf("mean %s of %s", units.Hertz(c.meanKHz()*1000), units.Hertz(float64(c.maxKHz())*1000))
+			if c.info.Governor != "" {
+				part += " [" + c.info.Governor + "]"
+			}
+			part += fmt.Sprintf(", low %.0f%%, at", c.share(0, s.low)*100)
+			for _, khz := range c.topFreqs(3) {
+				part += fmt.Sprintf(" %s %.0f%%", units.Hertz(float64(khz)*1000), float64(c.freq[khz])/float64(c.timed())*100)
+			}
+			parts = append(parts, part)
+		}
+		if s.interval > 0 && len(c.idle) > 0 {
+			part := fmt.Sprintf("idle %.0f%%:", float64(c.idleNs())/float64(s.interval)*100)
+			for _, state := range c.idleStates() {
+				part += fmt.Sprintf(" %s %.0f%%", c.info.IdleState(state), float64(c.idle[state])/float64(s.interval)*100)
+			}
+			parts = append(parts, part)
+		}
+		if p99, ok := s.runqP99[cpu]; ok {
+			parts = append(parts, "run queue p99 "+units.Duration(p99))
+		}
+		if c.throttles > 0 {
+			parts = append(parts, fmt.Sprintf("thermal throttles %d", c.throttles))
+		}
+		fmt.Printf("  CPU %d: %s\n", cpu, strings.Join(parts, "; "))
+	}
+	if s.correlated > 0 {
+		line := fmt.Sprintf("Low frequency vs run queue p99 across %d CPUs: r=%.2f", s.correlated, s.correlation)
+		if s.correlation >= 0.5 {
+			line += ", slower CPUs keep tasks waiting longer"
+		}
+		fmt.Println(line)
+	}
+
+	top := float64(s.hostMaxKHz())
+	if top == 0 || len(slowest) == 0 {
+		return
+	}
+	fmt.Printf("Frequency of the top %d processes by run queue p99:\n", n)
+	for _, p := range slowest {
+		khz, ok := s.procFreq[p.id]
+		if !ok {
+			continue
+		}
+		line := fmt.Sprintf("  PID %d (%s): p99=%s, ran at %s (%.0f%% of max)", p.id.PID, name(p.id.PID),
+			units.Duration(p.p99), units.Hertz(khz*1000), khz/top*100)
+		if khz/top < s.low {
+			line += ", low"
+		}
+		fmt.Println(line)
+	}
+}
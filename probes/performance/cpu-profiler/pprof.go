@@ -0,0 +1,117 @@
+// pprof profiles of the perf samples' stacks: -pprof rewrites one every
+// report, and the query API serves /debug/pprof/profile for
+// `go tool pprof http://host:port/debug/pprof/profile`
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"probepilot/pkg/flamegraph"
+	"probepilot/pkg/pprof"
+)
+
+// perfFreq is the rate of the perf samples, in Hz
+const perfFreq = 99
+
+// maxProfileWindow bounds ?seconds= of /debug/pprof/profile
+const maxProfileWindow = time.Hour
+
+// counts returns the samples of every tracked stack.
+func (s *stackSamples) counts() map[stackID]uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := make(map[stackID]uint64, s.stacks.Len())
+	s.stacks.Each(func(id stackID, count *uint64) bool {
+		counts[id] = *count
+		return true
+	})
+	return counts
+}
+
+// pprofProfile builds a CPU profile of counts, sampled over d from start:
+// every stack a sample tagged with its process, valued in samples and in
+// CPU time at one perf period per sample.
+func pprofProfile(counts map[stackID]uint64, start time.Time, d time.Duration) *pprof.Profile {
+	period := int64(time.Second / perfFreq)
+	p := &pprof.Profile{
+		SampleTypes: []pprof.ValueType{{Type: "samples", Unit: "count"}, {Type: "cpu", Unit: "nanoseconds"}},
+		PeriodType:  pprof.ValueType{Type: "cpu", Unit: "nanoseconds"},
+		Period:      period,
+		Time:        start,
+		Duration:    d,
+		Comments:    []string{fmt.Sprintf("probepilot cpu-profiler, cpu-clock at %dHz, counted per stack in BPF", perfFreq)},
+	}
+	for id, count := range counts {
+		if count == 0 {
+			continue
+		}
+		p.Samples = append(p.Samples, pprof.Sample{
+			Frames:    strings.Split(id.Frames, ";"),
+			Values:    []int64{int64(count), int64(count) * period},
+			Labels:    map[string]string{"comm": id.Comm},
+			NumLabels: map[string]int64{"pid": int64(id.PID)},
+		})
+	}
+	return p
+}
+
+// writePprof rewrites -pprof with the samples since the profiler started.
+func (cp *CPUProfiler) writePprof() {
+	p := pprofProfile(cp.stacks.counts(), cp.startTime, time.Since(cp.startTime))
+	if err := flamegraph.WriteFile(cp.pprofPath, p.Write); err != nil {
+		log.Printf("Warning: failed to write pprof profile: %v", err)
+	}
+}
+
+// Mount serves GET /debug/pprof/profile and the local history to Grafana
+// beside the query API. Without ?seconds= the profile is every sample
+// since the profiler started; with it, the samples counted over that many
+// seconds. Counts are drained from BPF every report, so windows shorter
+// than -report-interval may be empty.
+func (cp *CPUProfiler) Mount(mux *http.ServeMux) {
+	cp.history.Mount(mux)
+	mux.HandleFunc("/debug/pprof/profile", func(w http.ResponseWriter, r *http.Request) {
+		var window time.Duration
+		if s := r.URL.Query().Get("seconds"); s != "" {
+			n, err := strconv.ParseFloat(s, 64)
+			if err != nil || n < 0 {
+				http.Error(w, fmt.Sprintf("invalid seconds %q", s), http.StatusBadRequest)
+				return
+			}
+			window = time.Duration(n * float64(time.Second))
+			if window > maxProfileWindow {
+				http.Error(w, fmt.Sprintf("seconds %s exceeds %v", s, maxProfileWindow), http.StatusBadRequest)
+				return
+			}
+		}
+
+		var p *pprof.Profile
+		if window == 0 {
+			p = pprofProfile(cp.stacks.counts(), cp.startTime, time.Since(cp.startTime))
+		} else {
+			start, before := time.Now(), cp.stacks.counts()
+			select {
+			case <-time.After(window):
+			case <-r.Context().Done():
+				return
+			}
+			// Stacks evicted or of exited processes meanwhile drop out
+			after := cp.stacks.counts()
+			for id, count := range after {
+				after[id] = count - min(before[id], count)
+			}
+			p = pprofProfile(after, start, time.Since(start))
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", `attachment; filename="profile.pb.gz"`)
+		if err := p.Write(w); err != nil {
+			log.Printf("Warning: failed to serve pprof profile: %v", err)
+		}
+	})
+}
@@ -0,0 +1,350 @@
+// Run queue latency: how long tasks waited to run once woken or
+// preempted, kept by BPF as log2 histograms per process and per CPU and
+// drained every report, so a starved service shows as a high p99 rather
+// than hiding in runtime totals
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cilium/ebpf"
+
+	"probepilot/pkg/query"
+	"probepilot/pkg/topk"
+	"probepilot/pkg/units"
+)
+
+// Must match RUNQ_SLOTS in cpu_profiler.c
+const runqSlots = 40
+
+// runqQuantiles are the percentiles reported of run queue latency
+var runqQuantiles = []float64{0.5, 0.95, 0.99}
+
+// add merges the latencies of o into h
+func (h *RunqHist) add(o *RunqHist) {
+	for i := range h.Slots {
+		h.Slots[i] += o.Slots[i]
+	}
+	h.Count += o.Count
+	h.TotalNs += o.TotalNs
+}
+
+// since returns the latencies counted in h and not yet in prev, an
+// earlier read of the same histogram
+func (h *RunqHist) since(prev *RunqHist) RunqHist {
+	var d RunqHist
+	for i := range h.Slots {
+		d.Slots[i] = h.Slots[i] - min(prev.Slots[i], h.Slots[i])
+	}
+	d.Count = h.Count - min(prev.Count, h.Count)
+	d.TotalNs = h.TotalNs - min(prev.TotalNs, h.TotalNs)
+	return d
+}
+
+// quantile estimates the q-quantile of h, interpolating within the
+// power of two it falls in
+func (h *RunqHist) quantile(q float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := q * float64(h.Count)
+	var seen uint64
+	for slot, n := range h.Slots {
+		if n == 0 || float64(seen+n) < rank {
+			seen += n
+			continue
+		}
+		lo, hi := runqBound(slot-1), runqBound(slot)
+		return time.Duration(lo + (hi-lo)*(rank-float64(seen))/float64(n))
+	}
+	return time.Duration(runqBound(runqSlots - 1))
+}
+
+// runqBound is the upper bound of slot in ns, 2^slot, and 0 below slot 0
+func runqBound(slot int) float64 {
+	if slot < 0 {
+		return 0
+	}
+	return math.Ldexp(1, slot)
+}
+
+// percentiles formats the runqQuantiles of h
+func (h *RunqHist) percentiles() string {
+	return fmt.Sprintf("p50=%s p95=%s p99=%s", units.Duration(h.quantile(0.5)),
+		units.Duration(h.quantile(0.95)), units.Duration(h.quantile(0.99)))
+}
+
+// snapshot exports h as a classic histogram in seconds; the last slot,
+// which counts everything longer, is the +Inf bucket
+func (h *RunqHist) snapshot(name string, labels query.Labels) query.HistogramSample {
+	s := query.HistogramSample{
+		Name:       name,
+		Labels:     labels,
+		Count:      h.Count,
+		Sum:        time.Duration(h.TotalNs).Seconds(),
+		Bounds:     make([]float64, runqSlots-1),
+		Cumulative: make([]uint64, runqSlots-1),
+	}
+	var seen uint64
+	for slot := 0; slot < runqSlots-1; slot++ {
+		seen += h.Slots[slot]
+		s.Bounds[slot] = runqBound(slot) / 1e9
+		s.Cumulative[slot] = seen
+	}
+	return s
+}
+
+// runqStats is a histogram since the agent started and over the last
+// report interval
+type runqStats struct {
+	total, last RunqHist
+}
+
+// runqLatency holds the drained histograms. It is safe for concurrent
+// use, but drains must not overlap.
+type runqLatency struct {
+	mu sync.Mutex
+	// processes keeps those that waited the longest in total
+	processes *topk.Sketch[ProcKey, runqStats]
+	cpus      map[uint32]*runqStats
+	// read is runq_cpu_latency as last read; it only grows
+	read map[uint32]RunqHist
+	// gone are the processes that exited since the last drain
+	gone map[ProcKey]bool
+}
+
+func newRunqLatency(capacity int) *runqLatency {
+	return &runqLatency{
+		processes: topk.New[ProcKey, runqStats](capacity),
+		cpus:      make(map[uint32]*runqStats),
+		read:      make(map[uint32]RunqHist),
+		gone:      make(map[ProcKey]bool),
+	}
+}
+
+// drain moves the histograms of runq_latency into r and reads the growth
+// of runq_cpu_latency since the last drain.
+func (r *runqLatency) drain(coll *ebpf.Collection) error {
+	procMap, cpuMap := coll.Maps["runq_latency"], coll.Maps["runq_cpu_latency"]
+	if procMap == nil || cpuMap == nil {
+		return errors.New("no runq_latency maps in cpu_profiler.o")
+	}
+
+	var keys []ProcKey
+	var hists []RunqHist
+	var key ProcKey
+	var hist RunqHist
+	iter := procMap.Iterate()
+	for iter.Next(&key, &hist) {
+		keys = append(keys, key)
+		hists = append(hists, hist)
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("reading runq_latency: %v", err)
+	}
+	// As for stack counts, take each out atomically where the kernel can
+	for i := range keys {
+		err := procMap.LookupAndDelete(&keys[i], &hist)
+		switch {
+		case err == nil:
+			hists[i] = hist
+		case errors.Is(err, ebpf.ErrKeyNotExist):
+			hists[i] = RunqHist{}
+		default:
+			procMap.Delete(&keys[i])
+		}
+	}
+
+	cpus := make(map[uint32]RunqHist)
+	var cpu uint32
+	iter = cpuMap.Iterate()
+	for iter.Next(&cpu, &hist) {
+		if hist.Count > 0 {
+			cpus[cpu] = hist
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("reading runq_cpu_latency: %v", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.processes.Each(func(_ ProcKey, s *runqStats) bool {
+		s.last = RunqHist{}
+		return true
+	})
+	for i, id := range keys {
+		if hists[i].Count == 0 || r.gone[id] {
+			continue
+		}
+		s := r.processes.Add(id, hists[i].TotalNs)
+		s.total.add(&hists[i])
+		s.last = hists[i]
+	}
+	r.gone = make(map[ProcKey]bool)
+
+	for cpu, hist := range cpus {
+		prev := r.read[cpu]
+		s, ok := r.cpus[cpu]
+		if !ok {
+			s = &runqStats{}
+			r.cpus[cpu] = s
+		}
+		s.last = hist.since(&prev)
+		s.total = hist
+		r.read[cpu] = hist
+	}
+	return nil
+}
+
+// forget drops the histograms of a process that is gone.
+func (r *runqLatency) forget(id ProcKey) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.gone[id] = true
+	r.processes.Remove(id)
+}
+
+// host sums the last interval of every CPU.
+func (r *runqLatency) host() RunqHist {
+	var h RunqHist
+	for _, s := range r.cpus {
+		h.add(&s.last)
+	}
+	return h
+}
+
+// hostQuantile is the q-quantile of the last interval across CPUs.
+func (r *runqLatency) hostQuantile(q float64) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	host := r.host()
+	return host.quantile(q)
+}
+
+// cpuQuantiles is the q-quantile of the last interval of every CPU that
+// had waits in it.
+func (r *runqLatency) cpuQuantiles(q float64) map[uint32]time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	quantiles := make(map[uint32]time.Duration, len(r.cpus))
+	for cpu, s := range r.cpus {
+		if s.last.Count > 0 {
+			quantiles[cpu] = s.last.quantile(q)
+		}
+	}
+	return quantiles
+}
+
+// runqProc is a process and the p99 of its last interval's waits
+type runqProc struct {
+	id  ProcKey
+	p99 time.Duration
+}
+
+// slowest returns the n processes with the highest p99 over the last
+// interval.
+func (r *runqLatency) slowest(n int) []runqProc {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.slowestLocked(n)
+}
+
+func (r *runqLatency) slowestLocked(n int) []runqProc {
+	var procs []runqProc
+	r.processes.Each(func(id ProcKey, s *runqStats) bool {
+		if s.last.Count > 0 {
+			procs = append(procs, runqProc{id, s.last.quantile(0.99)})
+		}
+		return true
+	})
+	sort.Slice(procs, func(i, j int) bool { return procs[i].p99 > procs[j].p99 })
+	return procs[:min(n, len(procs))]
+}
+
+// histograms exports the histogram of every CPU since the agent started.
+func (r *runqLatency) histograms() []query.HistogramSample {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	hists := make([]query.HistogramSample, 0, len(r.cpus))
+	for cpu, s := range r.cpus {
+		hists = append(hists, s.total.snapshot("cpu_runq_latency_seconds", query.Labels{"cpu": strconv.FormatUint(uint64(cpu), 10)}))
+	}
+	return hists
+}
+
+// samples exports the percentiles of the last interval, host-wide and
+// per process, with each process's total wait.
+func (r *runqLatency) samples(name func(pid uint32) string) []query.Sample {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var samples []query.Sample
+	host := r.host()
+	for _, q := range runqQuantiles {
+		samples = append(samples, query.Sample{Name: "runq_latency_seconds",
+			Labels: query.Labels{"quantile": strconv.FormatFloat(q, 'f', -1, 64)}, Value: host.quantile(q).Seconds()})
+	}
+	r.processes.Each(func(id ProcKey, s *runqStats) bool {
+		labels := query.Labels{"pid": strconv.FormatUint(uint64(id.PID), 10), "comm": name(id.PID)}
+		samples = append(samples,
+			query.Sample{Name: "process_runq_wait_seconds_total", Labels: labels, Value: time.Duration(s.total.TotalNs).Seconds()},
+			query.Sample{Name: "process_runq_waits_total", Labels: labels, Value: float64(s.total.Count)},
+		)
+		if s.last.Count == 0 {
+			return true
+		}
+		for _, q := range runqQuantiles {
+			ql := query.Labels{"quantile": strconv.FormatFloat(q, 'f', -1, 64)}
+			for k, v := range labels {
+				ql[k] = v
+			}
+			samples = append(samples, query.Sample{Name: "process_runq_latency_seconds", Labels: ql, Value: s.last.quantile(q).Seconds()})
+		}
+		return true
+	})
+	return samples
+}
+
+// print logs the last interval's percentiles host-wide, of the n CPUs
+// and processes with the highest p99
+func (r *runqLatency) print(n int, name func(pid uint32) string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	host := r.host()
+	if host.Count == 0 {
+		return
+	}
+	fmt.Printf("\nRun queue latency: %s over %d waits\n", host.percentiles(), host.Count)
+
+	cpus := make([]uint32, 0, len(r.cpus))
+	for cpu, s := range r.cpus {
+		if s.last.Count > 0 {
+			cpus = append(cpus, cpu)
+		}
+	}
+	sort.Slice(cpus, func(i, j int) bool {
+		return r.cpus[cpus[i]].last.quantile(0.99) > r.cpus[cpus[j]].last.quantile(0.99)
+	})
+	for _, cpu := range cpus[:min(n, len(cpus))] {
+		s := r.cpus[cpu]
+		fmt.Printf("  CPU %d: %s, %d waits\n", cpu, s.last.percentiles(), s.last.Count)
+	}
+
+	procs := r.slowestLocked(n)
+	if len(procs) == 0 {
+		return
+	}
+	fmt.Printf("Top %d processes by run queue p99:\n", n)
+	for _, p := range procs {
+		s, _ := r.processes.Get(p.id)
+		fmt.Printf("  PID %d (%s): %s, %d waits, %s waiting\n", p.id.PID, name(p.id.PID),
+			s.last.percentiles(), s.last.Count, units.Duration(time.Duration(s.last.TotalNs)))
+	}
+}
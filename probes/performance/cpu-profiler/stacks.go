@@ -0,0 +1,302 @@
+// Stack sample counts, aggregated in BPF and drained every report
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cilium/ebpf"
+
+	"probepilot/pkg/flamegraph"
+	"probepilot/pkg/query"
+	"probepilot/pkg/symbolize"
+	"probepilot/pkg/topk"
+	"probepilot/pkg/units"
+)
+
+// Must match MAX_STACK_DEPTH in cpu_profiler.c
+const maxStackDepth = 127
+
+// stackID is an aggregated stack: a process and its folded frames, root
+// first and separated by ";", kernel frames suffixed _[k]. Stacks are
+// aggregated by name, not BPF stack id, so they survive the ids being
+// recycled between drains. Start is the process's start time, keeping a
+// recycled PID's stacks apart.
+type stackID struct {
+	PID    uint32
+	Start  uint64
+	Comm   string
+	Frames string
+}
+
+// stackRef is a stack as BPF counts it.
+type stackRef struct {
+	pid          uint32
+	start        uint64
+	user, kernel int32
+}
+
+// stackSamples holds the drained perf samples. It is safe for concurrent
+// use, but drains must not overlap.
+type stackSamples struct {
+	// folded names the stacks of the last drain. Their traces are freed
+	// once read, while samples keep referencing them; a stack id is the
+	// hash of its frames, so the same process and ids are the same stack.
+	folded map[stackRef]string
+
+	mu        sync.Mutex
+	stacks    *topk.Sketch[stackID, uint64]
+	processes *topk.Sketch[ProcKey, uint64]
+	// gone are the processes that exited since the last drain; their
+	// remaining counts are totalled but not kept
+	gone  map[ProcKey]bool
+	total uint64
+	// samples without a readable user or kernel stack
+	unwound uint64
+}
+
+func newStackSamples(capacity int) *stackSamples {
+	return &stackSamples{
+		stacks:    topk.New[stackID, uint64](capacity),
+		processes: topk.New[ProcKey, uint64](capacity),
+		gone:      make(map[ProcKey]bool),
+	}
+}
+
+// drain moves the counts of stack_counts into s, symbolizing their stacks,
+// and frees the stack traces it read so stack_traces does not fill up.
+func (s *stackSamples) drain(coll *ebpf.Collection, symbols *symbolize.Symbolizer) error {
+	counts, traces := coll.Maps["stack_counts"], coll.Maps["stack_traces"]
+	if counts == nil || traces == nil {
+		return errors.New("no stack_counts maps in cpu_profiler.o")
+	}
+
+	var keys []StackKey
+	var values []uint64
+	var key StackKey
+	var value uint64
+	iter := counts.Iterate()
+	for iter.Next(&key, &value) {
+		keys = append(keys, key)
+		values = append(values, value)
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("reading stack_counts: %v", err)
+	}
+
+	// Take each count out atomically where the kernel can (5.14+), so
+	// samples landing between reading and deleting are kept
+	for i := range keys {
+		var count uint64
+		err := counts.LookupAndDelete(&keys[i], &count)
+		switch {
+		case err == nil:
+			values[i] = count
+		case errors.Is(err, ebpf.ErrKeyNotExist):
+			values[i] = 0
+		default:
+			counts.Delete(&keys[i])
+		}
+	}
+
+	// Symbolize outside the lock; threads of a process share stacks
+	folded := make(map[stackRef]string)
+	ids := make([]stackID, len(keys))
+	for i, k := range keys {
+		if values[i] == 0 {
+			continue
+		}
+		ref := stackRef{k.PID, k.StartTime, k.UserStackID, k.KernelStackID}
+		frames, ok := folded[ref]
+		if !ok {
+			if frames, ok = s.folded[ref]; !ok {
+				frames = foldStack(traces, symbols, k)
+			}
+			folded[ref] = frames
+		}
+		ids[i] = stackID{PID: k.PID, Start: k.StartTime, Comm: string(bytes.TrimRight(k.Comm[:], "\x00")), Frames: frames}
+	}
+	used := make(map[int32]bool)
+	for ref := range folded {
+		used[ref.user], used[ref.kernel] = true, true
+	}
+	for id := range used {
+		if id >= 0 {
+			traces.Delete(uint32(id))
+		}
+	}
+	s.folded = folded
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, k := range keys {
+		count := values[i]
+		if count == 0 {
+			continue
+		}
+		s.total += count
+		if k.UserStackID < 0 && k.KernelStackID < 0 {
+			s.unwound += count
+		}
+		id := ProcKey{PID: k.PID, StartTime: k.StartTime}
+		if s.gone[id] {
+			continue
+		}
+		*s.stacks.Add(ids[i], count) += count
+		*s.processes.Add(id, count) += count
+	}
+	s.gone = make(map[ProcKey]bool)
+	return nil
+}
+
+// forget drops the stacks of a process that exited.
+func (s *stackSamples) forget(id ProcKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gone[id] = true
+	if _, ok := s.processes.Get(id); !ok {
+		return
+	}
+	s.processes.Remove(id)
+	var stale []stackID
+	s.stacks.Each(func(stack stackID, _ *uint64) bool {
+		if stack.PID == id.PID && stack.Start == id.StartTime {
+			stale = append(stale, stack)
+		}
+		return true
+	})
+	for _, stack := range stale {
+		s.stacks.Remove(stack)
+	}
+}
+
+// foldStack names the frames of k's stacks, root first.
+func foldStack(traces *ebpf.Map, symbols *symbolize.Symbolizer, k StackKey) string {
+	var parts []string
+	if addrs := readStack(traces, k.UserStackID); len(addrs) > 0 {
+		frames := symbols.ResolveStack(k.PID, addrs)
+		for i := len(frames) - 1; i >= 0; i-- {
+			parts = append(parts, frameName(frames[i]))
+		}
+	}
+	if addrs := readStack(traces, k.KernelStackID); len(addrs) > 0 {
+		frames := symbols.ResolveKernelStack(addrs)
+		for i := len(frames) - 1; i >= 0; i-- {
+			parts = append(parts, frameName(frames[i])+"_[k]")
+		}
+	}
+	if len(parts) == 0 {
+		return "[unknown]"
+	}
+	return strings.Join(parts, ";")
+}
+
+func readStack(traces *ebpf.Map, id int32) []uint64 {
+	if id < 0 {
+		return nil
+	}
+	var frames [maxStackDepth]uint64
+	if err := traces.Lookup(uint32(id), &frames); err != nil {
+		return nil
+	}
+	depth := 0
+	for depth < len(frames) && frames[depth] != 0 {
+		depth++
+	}
+	return frames[:depth]
+}
+
+// frameName is a frame's function, or its address where no symbol
+// covers it.
+func frameName(f symbolize.Frame) string {
+	if f.Function != "" {
+		return f.Function
+	}
+	if f.Module != "" {
+		return fmt.Sprintf("[%s+0x%x]", f.Module, f.Addr)
+	}
+	return fmt.Sprintf("[0x%x]", f.Addr)
+}
+
+// samples exports the drained counts to the local query API.
+func (s *stackSamples) samples(name func(pid uint32) string) []query.Sample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	samples := []query.Sample{
+		{Name: "cpu_perf_samples_total", Value: float64(s.total)},
+		{Name: "cpu_perf_samples_unwound_total", Value: float64(s.unwound)},
+		{Name: "cpu_stacks_tracked", Value: float64(s.stacks.Len())},
+	}
+	s.processes.Each(func(id ProcKey, count *uint64) bool {
+		labels := query.Labels{"pid": strconv.FormatUint(uint64(id.PID), 10), "comm": name(id.PID)}
+		samples = append(samples, query.Sample{Name: "process_cpu_samples_total", Labels: labels, Value: float64(*count)})
+		return true
+	})
+	return samples
+}
+
+// flameStacks returns the tracked stacks for folded and flame graph
+// output, each under its command, as stackcollapse-perf.pl folds them.
+func (s *stackSamples) flameStacks() []flamegraph.Stack {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stacks := make([]flamegraph.Stack, 0, s.stacks.Len())
+	s.stacks.Each(func(id stackID, count *uint64) bool {
+		frames := append([]string{id.Comm}, strings.Split(id.Frames, ";")...)
+		stacks = append(stacks, flamegraph.Stack{Frames: frames, Count: *count})
+		return true
+	})
+	return stacks
+}
+
+// writeProfiles rewrites -folded, -flamegraph and -pprof with the stacks
+// sampled since the profiler started.
+func (cp *CPUProfiler) writeProfiles() {
+	if cp.pprofPath != "" {
+		cp.writePprof()
+	}
+	if cp.foldedPath == "" && cp.flameGraphPath == "" {
+		return
+	}
+	stacks := cp.stacks.flameStacks()
+	if cp.foldedPath != "" {
+		err := flamegraph.WriteFile(cp.foldedPath, func(w io.Writer) error {
+			return flamegraph.WriteFolded(w, stacks)
+		})
+		if err != nil {
+			log.Printf("Warning: failed to write folded stacks: %v", err)
+		}
+	}
+	if cp.flameGraphPath != "" {
+		title := fmt.Sprintf("CPU, %s of %dHz samples from %s", units.Duration(time.Since(cp.startTime)), perfFreq, cp.startTime.Format(time.RFC3339))
+		err := flamegraph.WriteFile(cp.flameGraphPath, func(w io.Writer) error {
+			return flamegraph.WriteSVG(w, stacks, flamegraph.Options{Title: title})
+		})
+		if err != nil {
+			log.Printf("Warning: failed to write flame graph: %v", err)
+		}
+	}
+}
+
+// print writes the hottest stacks, leaf first, each cut to depth frames.
+func (s *stackSamples) print(n, depth int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Printf("Perf samples: %d counted in BPF, %d stacks, %d without a stack\n",
+		s.total, s.stacks.Len(), s.unwound)
+	for _, item := range s.stacks.Top(n) {
+		fmt.Printf("  %d samples, PID %d (%s):\n", *item.Value, item.Key.PID, item.Key.Comm)
+		frames := strings.Split(item.Key.Frames, ";")
+		for i := len(frames) - 1; i >= 0 && len(frames)-i <= depth; i-- {
+			fmt.Printf("    %s\n", frames[i])
+		}
+	}
+}
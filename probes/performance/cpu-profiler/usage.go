@@ -0,0 +1,233 @@
+// CPU usage: the share of the host's CPU time each process, and each
+// container and cgroup, ran for over the last report interval, and the
+// same summed by executable and container image across the processes
+// running them, so replicas of a service read as one
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"sort"
+	"time"
+
+	"probepilot/pkg/procfs"
+	"probepilot/pkg/query"
+	"probepilot/pkg/target"
+)
+
+// usage is the CPU usage of the last report interval, in percent of
+// every online CPU
+type usage struct {
+	// runtime is each process's total runtime at the last report
+	runtime    map[ProcKey]uint64
+	at         time.Time
+	cpus       int
+	processes  map[ProcKey]float64
+	containers map[string]float64
+	cgroups    map[uint64]*cgroupUsage
+	// binaries and images group processes by executable path and by the
+	// image of their container
+	binaries map[string]*groupUsage
+	images   map[string]*groupUsage
+}
+
+// groupUsage is the CPU usage of the processes sharing an executable or
+// image
+type groupUsage struct {
+	percent   float64
+	processes int
+}
+
+// kernelThreads groups the processes without an executable
+const kernelThreads = "[kernel]"
+
+func newUsage(start time.Time) *usage {
+	cpus, err := procfs.OnlineCPUs()
+	if err != nil {
+		log.Printf("Warning: failed to count CPUs, assuming %d: %v", runtime.NumCPU(), err)
+		cpus = runtime.NumCPU()
+	}
+	return &usage{
+		runtime:    make(map[ProcKey]uint64),
+		at:         start,
+		cpus:       cpus,
+		processes:  make(map[ProcKey]float64),
+		containers: make(map[string]float64),
+		cgroups:    make(map[uint64]*cgroupUsage),
+		binaries:   make(map[string]*groupUsage),
+		images:     make(map[string]*groupUsage),
+	}
+}
+
+// percent is the share of every CPU's time over interval that ns
+// nanoseconds of runtime are
+func (u *usage) percent(ns uint64, interval time.Duration) float64 {
+	if interval <= 0 {
+		return 0
+	}
+	return float64(ns) / float64(interval) / float64(u.cpus) * 100
+}
+
+// addGroup counts a process using pct percent in the group of key
+func addGroup(groups map[string]*groupUsage, key string, pct float64) {
+	g, ok := groups[key]
+	if !ok {
+		g = &groupUsage{}
+		groups[key] = g
+	}
+	g.percent += pct
+	g.processes++
+}
+
+// updateUsage computes the CPU usage of every tracked process, and of
+// their containers, cgroups, executables and images, since the last
+// report
+func (cp *CPUProfiler) updateUsage(now time.Time) {
+	u := cp.usage
+	interval := now.Sub(u.at)
+	u.at = now
+	u.processes = make(map[ProcKey]float64)
+	u.containers = make(map[string]float64)
+	u.cgroups = make(map[uint64]*cgroupUsage)
+	u.binaries = make(map[string]*groupUsage)
+	u.images = make(map[string]*groupUsage)
+	live := make(map[string]bool)
+	runtimes := make(map[ProcKey]uint64)
+	cp.processStats.Each(func(id ProcKey, stats *ProcessStats) bool {
+		// A process new to the sketch ran all its tracked runtime within
+		// the interval
+		delta := stats.TotalRuntime - u.runtime[id]
+		if stats.TotalRuntime < u.runtime[id] {
+			delta = stats.TotalRuntime
+		}
+		runtimes[id] = stats.TotalRuntime
+		pct := u.percent(delta, interval)
+		u.processes[id] = pct
+		if stats.CgroupID != 0 {
+			addCgroup(u.cgroups, stats.CgroupID, id, pct)
+		}
+		p := cp.procs.Get(id.PID)
+		if p == nil {
+			return true
+		}
+		exe := p.Exe
+		if exe == "" {
+			exe = kernelThreads
+		}
+		addGroup(u.binaries, exe, pct)
+		if c := target.ContainerID(p.Cgroup); c != "" {
+			u.containers[c] += pct
+			live[c] = true
+			if image := cp.containers.Image(c); image != "" {
+				addGroup(u.images, image, pct)
+			}
+		}
+		return true
+	})
+	u.runtime = runtimes
+	cp.containers.Forget(live)
+}
+
+// shortContainerID is a container ID as docker ps shows it
+func shortContainerID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// topContainers returns the n containers using the most CPU
+func (u *usage) topContainers(n int) []string {
+	ids := make([]string, 0, len(u.containers))
+	for id := range u.containers {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if u.containers[ids[i]] != u.containers[ids[j]] {
+			return u.containers[ids[i]] > u.containers[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+	if len(ids) > n {
+		ids = ids[:n]
+	}
+	return ids
+}
+
+// topGroups returns the n groups using the most CPU
+func topGroups(groups map[string]*groupUsage, n int) []string {
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if groups[keys[i]].percent != groups[keys[j]].percent {
+			return groups[keys[i]].percent > groups[keys[j]].percent
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
+
+// printContainerUsage prints the containers, executables and images
+// using the most CPU
+func (cp *CPUProfiler) printContainerUsage() {
+	if ids := cp.usage.topContainers(10); len(ids) > 0 {
+		fmt.Printf("\nTop 10 containers by CPU (%d CPUs):\n", cp.usage.cpus)
+		for _, id := range ids {
+			if name := cp.containers.Name(id); name != "" {
+				fmt.Printf("  %s (%s): CPU=%.1f%%\n", name, shortContainerID(id), cp.usage.containers[id])
+				continue
+			}
+			fmt.Printf("  %s: CPU=%.1f%%\n", shortContainerID(id), cp.usage.containers[id])
+		}
+	}
+	cp.printGroups("executables", cp.usage.binaries)
+	cp.printGroups("images", cp.usage.images)
+}
+
+// printGroups prints the 10 groups of kind using the most CPU
+func (cp *CPUProfiler) printGroups(kind string, groups map[string]*groupUsage) {
+	keys := topGroups(groups, 10)
+	if len(keys) == 0 {
+		return
+	}
+	fmt.Printf("\nTop 10 %s by CPU (%d CPUs):\n", kind, cp.usage.cpus)
+	for _, key := range keys {
+		g := groups[key]
+		fmt.Printf("  %s: CPU=%.1f%% across %d processes\n", key, g.percent, g.processes)
+	}
+}
+
+// usageSamples exports the CPU usage of containers, executables and
+// images; that of processes is exported with their other samples
+func (cp *CPUProfiler) usageSamples() []query.Sample {
+	samples := []query.Sample{{Name: "cpu_online", Value: float64(cp.usage.cpus)}}
+	for id, pct := range cp.usage.containers {
+		labels := query.Labels{"container": shortContainerID(id)}
+		if name := cp.containers.Name(id); name != "" {
+			labels["container_name"] = name
+		}
+		samples = append(samples, query.Sample{Name: "container_cpu_usage_percent", Labels: labels, Value: pct})
+	}
+	for exe, g := range cp.usage.binaries {
+		labels := query.Labels{"exe": exe}
+		samples = append(samples,
+			query.Sample{Name: "executable_cpu_usage_percent", Labels: labels, Value: g.percent},
+			query.Sample{Name: "executable_processes", Labels: labels, Value: float64(g.processes)},
+		)
+	}
+	for image, g := range cp.usage.images {
+		labels := query.Labels{"image": image}
+		samples = append(samples,
+			query.Sample{Name: "image_cpu_usage_percent", Labels: labels, Value: g.percent},
+			query.Sample{Name: "image_processes", Labels: labels, Value: float64(g.processes)},
+		)
+	}
+	return samples
+}
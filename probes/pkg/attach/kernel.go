@@ -0,0 +1,257 @@
+// Package attach contains the shared helpers probes use to hook their eBPF
+// programs into the kernel and into user-space binaries.
+package attach
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/features"
+	"github.com/cilium/ebpf/link"
+
+	"probepilot/pkg/platform"
+)
+
+// Mode selects how kernel functions are hooked.
+type Mode string
+
+const (
+	// ModeAuto prefers fentry/fexit where BPF trampolines are available
+	// and falls back to kprobes otherwise.
+	ModeAuto Mode = "auto"
+	// ModeFentry hooks functions through BPF trampolines (fentry/fexit).
+	ModeFentry Mode = "fentry"
+	// ModeKprobe hooks functions through kprobes/kretprobes.
+	ModeKprobe Mode = "kprobe"
+)
+
+// ParseMode validates a mode name taken from flags or config.
+func ParseMode(s string) (Mode, error) {
+	switch m := Mode(strings.ToLower(strings.TrimSpace(s))); m {
+	case "":
+		return ModeAuto, nil
+	case ModeAuto, ModeFentry, ModeKprobe:
+		return m, nil
+	default:
+		return "", fmt.Errorf("invalid attach mode %q (want auto, fentry or kprobe)", s)
+	}
+}
+
+// FentrySupported reports whether the running kernel can attach tracing
+// programs through BPF trampolines. This needs kernel BTF and 5.5+.
+func FentrySupported() bool {
+	report := platform.Current().Capabilities()
+	if !report.Supported || !report.Has(platform.FeatureBTF) {
+		return false
+	}
+	major, minor := platform.ParseKernelVersion(report.Kernel)
+	if major < 5 || (major == 5 && minor < 5) {
+		return false
+	}
+	return features.HaveProgramType(ebpf.Tracing) == nil
+}
+
+// Resolve turns ModeAuto into the concrete mode used on this host.
+func Resolve(mode Mode) Mode {
+	if mode == ModeAuto || mode == "" {
+		if FentrySupported() {
+			return ModeFentry
+		}
+		return ModeKprobe
+	}
+	return mode
+}
+
+// KernelFunc describes a hooked kernel function and the program variants
+// compiled for it. Either variant may be empty if the probe only ships one.
+type KernelFunc struct {
+	Symbol   string
+	Kprobe   string // kprobe/kretprobe program name
+	Fentry   string // fentry/fexit program name
+	Return   bool   // hook function return (kretprobe/fexit)
+	Optional bool   // missing symbol is a warning rather than an error
+}
+
+// Prepare drops program variants that will not be used from spec so the
+// collection loads on kernels without trampoline support. It must be
+// called before ebpf.NewCollection. Kprobe variants are always kept as
+// a per-function fallback.
+func Prepare(spec *ebpf.CollectionSpec, mode Mode, funcs []KernelFunc) {
+	if Resolve(mode) == ModeFentry {
+		return
+	}
+	for _, fn := range funcs {
+		if fn.Fentry != "" {
+			delete(spec.Programs, fn.Fentry)
+		}
+	}
+}
+
+// Report records how each kernel function ended up being hooked.
+type Report struct {
+	Requested Mode
+	Resolved  Mode
+	Attached  map[string]Mode
+	Failed    map[string]error
+}
+
+// String renders a one-line summary such as
+// "attach mode auto->fentry: tcp_sendmsg=fentry tcp_cleanup_rbuf=kprobe".
+func (r Report) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "attach mode %s->%s:", r.Requested, r.Resolved)
+
+	symbols := make([]string, 0, len(r.Attached)+len(r.Failed))
+	for sym := range r.Attached {
+		symbols = append(symbols, sym)
+	}
+	for sym := range r.Failed {
+		symbols = append(symbols, sym)
+	}
+	sort.Strings(symbols)
+	for _, sym := range symbols {
+		if mode, ok := r.Attached[sym]; ok {
+			fmt.Fprintf(&b, " %s=%s", sym, mode)
+		} else {
+			fmt.Fprintf(&b, " %s=failed", sym)
+		}
+	}
+	return b.String()
+}
+
+// Kernel attaches every function in funcs using the requested mode. When
+// an fentry attach fails for a single function the kprobe variant is used
+// instead, so one missing BTF entry does not cost the whole probe.
+// Failures of optional functions are reported but not returned.
+func Kernel(coll *ebpf.Collection, mode Mode, funcs []KernelFunc) ([]link.Link, Report, error) {
+	report := Report{
+		Requested: mode,
+		Resolved:  Resolve(mode),
+		Attached:  make(map[string]Mode),
+		Failed:    make(map[string]error),
+	}
+
+	var links []link.Link
+	for _, fn := range funcs {
+		l, used, err := attachFunc(coll, report.Resolved, fn)
+		if err != nil {
+			report.Failed[fn.Symbol] = err
+			if !fn.Optional {
+				for _, l := range links {
+					l.Close()
+				}
+				return nil, report, fmt.Errorf("attach %s: %w", fn.Symbol, err)
+			}
+			continue
+		}
+		links = append(links, l)
+		report.Attached[fn.Symbol] = used
+	}
+	return links, report, nil
+}
+
+func attachFunc(coll *ebpf.Collection, mode Mode, fn KernelFunc) (link.Link, Mode, error) {
+	var fentryErr error
+	if mode == ModeFentry && fn.Fentry != "" {
+		if prog := coll.Programs[fn.Fentry]; prog != nil {
+			attachType := ebpf.AttachTraceFEntry
+			if fn.Return {
+				attachType = ebpf.AttachTraceFExit
+			}
+			l, err := link.AttachTracing(link.TracingOptions{Program: prog, AttachType: attachType})
+			if err == nil {
+				return l, ModeFentry, nil
+			}
+			fentryErr = err
+		}
+	}
+
+	prog := coll.Programs[fn.Kprobe]
+	if fn.Kprobe == "" || prog == nil {
+		if fentryErr != nil {
+			return nil, "", fentryErr
+		}
+		return nil, "", fmt.Errorf("no program for %s", fn.Symbol)
+	}
+
+	var (
+		l   link.Link
+		err error
+	)
+	if fn.Return {
+		l, err = link.Kretprobe(fn.Symbol, prog, nil)
+	} else {
+		l, err = link.Kprobe(fn.Symbol, prog, nil)
+	}
+	if err != nil {
+		return nil, "", errors.Join(fentryErr, err)
+	}
+	return l, ModeKprobe, nil
+}
+
+// bpfStatsRunTime mirrors BPF_STATS_RUN_TIME from the kernel UAPI.
+const bpfStatsRunTime = 0
+
+// EnableRuntimeStats turns on kernel accounting of BPF program run time
+// until the returned closer is closed. It needs CAP_SYS_ADMIN.
+func EnableRuntimeStats() (io.Closer, error) {
+	return ebpf.EnableStats(bpfStatsRunTime)
+}
+
+// Overhead is the measured cost of one BPF program.
+type Overhead struct {
+	Runs    uint64
+	Runtime time.Duration
+}
+
+// PerRun returns the average time spent per program invocation.
+func (o Overhead) PerRun() time.Duration {
+	if o.Runs == 0 {
+		return 0
+	}
+	return o.Runtime / time.Duration(o.Runs)
+}
+
+// MeasureOverhead reads run counts and cumulative run time for the named
+// programs. Programs without statistics (stats disabled or program not
+// loaded) are omitted.
+func MeasureOverhead(coll *ebpf.Collection, names ...string) map[string]Overhead {
+	result := make(map[string]Overhead)
+	for _, name := range names {
+		prog := coll.Programs[name]
+		if prog == nil {
+			continue
+		}
+		info, err := prog.Info()
+		if err != nil {
+			continue
+		}
+		runs, ok := info.RunCount()
+		if !ok {
+			continue
+		}
+		runtime, _ := info.Runtime()
+		result[name] = Overhead{Runs: runs, Runtime: runtime}
+	}
+	return result
+}
+
+// ProgramNames returns the program names backing funcs for the mode each
+// function was attached with, suitable for MeasureOverhead.
+func (r Report) ProgramNames(funcs []KernelFunc) []string {
+	var names []string
+	for _, fn := range funcs {
+		switch r.Attached[fn.Symbol] {
+		case ModeFentry:
+			names = append(names, fn.Fentry)
+		case ModeKprobe:
+			names = append(names, fn.Kprobe)
+		}
+	}
+	return names
+}
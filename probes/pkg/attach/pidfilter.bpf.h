@@ -0,0 +1,45 @@
+/*
+ * In-kernel PID filtering for uprobes on shared libraries
+ *
+ * A uprobe on libc fires in every process that maps it. Programs that
+ * include this header return early for processes outside the set
+ * attach.PIDFilter maintains, before reserving ring buffer space or
+ * touching other maps:
+ *
+ *     __u32 pid = bpf_get_current_pid_tgid() >> 32;
+ *     if (!pid_filter_allowed(pid))
+ *         return 0;
+ *
+ * While the filter is off every process passes.
+ */
+
+#ifndef __PROBEPILOT_PIDFILTER_BPF_H
+#define __PROBEPILOT_PIDFILTER_BPF_H
+
+#define PID_FILTER_MAX 1024
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, PID_FILTER_MAX);
+    __type(key, __u32);  // TGID
+    __type(value, __u8);
+} pid_filter SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, 1);
+    __type(key, __u32);
+    __type(value, __u32);
+} pid_filter_on SEC(".maps");
+
+static __always_inline bool pid_filter_allowed(__u32 pid)
+{
+    __u32 key = 0;
+    __u32 *on = bpf_map_lookup_elem(&pid_filter_on, &key);
+
+    if (!on || !*on)
+        return true;
+    return bpf_map_lookup_elem(&pid_filter, &pid) != NULL;
+}
+
+#endif /* __PROBEPILOT_PIDFILTER_BPF_H */
@@ -0,0 +1,139 @@
+package attach
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cilium/ebpf"
+)
+
+// Map names and limits shared with pidfilter.bpf.h.
+const (
+	pidFilterMap   = "pid_filter"
+	pidFilterOnMap = "pid_filter_on"
+	pidFilterMax   = 1024
+)
+
+// PIDFilter restricts programs that include pidfilter.bpf.h to a set of
+// processes. Unlike a PID on the uprobe itself, one attachment serves
+// every target and the set can change while the probes stay attached.
+// It is safe for concurrent use.
+type PIDFilter struct {
+	mu      sync.Mutex
+	pids    *ebpf.Map
+	on      *ebpf.Map
+	set     map[uint32]bool
+	enabled bool
+}
+
+// NewPIDFilter returns the filter of coll, initially off.
+func NewPIDFilter(coll *ebpf.Collection) (*PIDFilter, error) {
+	pids, on := coll.Maps[pidFilterMap], coll.Maps[pidFilterOnMap]
+	if pids == nil || on == nil {
+		return nil, fmt.Errorf("no %s maps (include pidfilter.bpf.h)", pidFilterMap)
+	}
+	return &PIDFilter{pids: pids, on: on, set: make(map[uint32]bool)}, nil
+}
+
+// Add lets pids through and turns the filter on.
+func (f *PIDFilter) Add(pids ...uint32) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, pid := range pids {
+		if f.set[pid] {
+			continue
+		}
+		if len(f.set) >= pidFilterMax {
+			return fmt.Errorf("PID filter is full (%d processes)", pidFilterMax)
+		}
+		if err := f.pids.Put(pid, uint8(1)); err != nil {
+			return fmt.Errorf("add PID %d to filter: %w", pid, err)
+		}
+		f.set[pid] = true
+	}
+	return f.setOn(true)
+}
+
+// Remove stops letting pid through. The filter stays on when the set
+// empties, so removing the last target never starts tracing everything.
+func (f *PIDFilter) Remove(pid uint32) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.set[pid] {
+		return nil
+	}
+	if err := f.pids.Delete(pid); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return fmt.Errorf("remove PID %d from filter: %w", pid, err)
+	}
+	delete(f.set, pid)
+	return nil
+}
+
+// Clear empties the set and turns the filter off.
+func (f *PIDFilter) Clear() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.setOn(false); err != nil {
+		return err
+	}
+	for pid := range f.set {
+		if err := f.pids.Delete(pid); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return fmt.Errorf("remove PID %d from filter: %w", pid, err)
+		}
+		delete(f.set, pid)
+	}
+	return nil
+}
+
+func (f *PIDFilter) setOn(on bool) error {
+	var v uint32
+	if on {
+		v = 1
+	}
+	if err := f.on.Put(uint32(0), v); err != nil {
+		return fmt.Errorf("update %s: %w", pidFilterOnMap, err)
+	}
+	f.enabled = on
+	return nil
+}
+
+// Contains reports whether pid is let through, which is every PID while
+// the filter is off.
+func (f *PIDFilter) Contains(pid uint32) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return !f.enabled || f.set[pid]
+}
+
+// PIDs returns the filtered processes in ascending order.
+func (f *PIDFilter) PIDs() []uint32 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	pids := make([]uint32, 0, len(f.set))
+	for pid := range f.set {
+		pids = append(pids, pid)
+	}
+	sort.Slice(pids, func(i, j int) bool { return pids[i] < pids[j] })
+	return pids
+}
+
+// ParsePIDs parses a comma-separated PID list taken from flags or config.
+func ParsePIDs(s string) ([]uint32, error) {
+	var pids []uint32
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		pid, err := strconv.ParseUint(part, 10, 32)
+		if err != nil || pid == 0 {
+			return nil, fmt.Errorf("invalid PID %q", part)
+		}
+		pids = append(pids, uint32(pid))
+	}
+	return pids, nil
+}
@@ -0,0 +1,136 @@
+package attach
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/cilium/ebpf/link"
+)
+
+// AttachFunc attaches the programs of one hook and returns their links.
+type AttachFunc func() ([]link.Link, error)
+
+// Toggles holds hooks that can be detached and reattached while the agent
+// runs, so operators can switch expensive hooks on only while they need
+// them.
+type Toggles struct {
+	mu    sync.Mutex
+	hooks map[string]*toggle
+}
+
+type toggle struct {
+	attach AttachFunc
+	links  []link.Link
+	on     bool
+}
+
+// NewToggles returns an empty hook set.
+func NewToggles() *Toggles {
+	return &Toggles{hooks: make(map[string]*toggle)}
+}
+
+// Add registers a hook under name and attaches it when enabled is set.
+func (t *Toggles) Add(name string, attach AttachFunc, enabled bool) error {
+	t.mu.Lock()
+	t.hooks[name] = &toggle{attach: attach}
+	t.mu.Unlock()
+	if !enabled {
+		return nil
+	}
+	return t.Set(name, true)
+}
+
+// Set attaches or detaches the named hook. Setting a hook to its current
+// state is a no-op.
+func (t *Toggles) Set(name string, on bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h, ok := t.hooks[name]
+	if !ok {
+		return fmt.Errorf("unknown hook %q", name)
+	}
+	if h.on == on {
+		return nil
+	}
+	if !on {
+		closeLinks(h.links)
+		h.links, h.on = nil, false
+		return nil
+	}
+	links, err := h.attach()
+	if err != nil {
+		return fmt.Errorf("attach hook %s: %w", name, err)
+	}
+	h.links, h.on = links, true
+	return nil
+}
+
+// Grow runs grow for the named hook, telling it whether the hook is
+// attached, and adds the links it returns to the hook's. It holds the
+// lock Set attaches under, so a hook can take in a target found later,
+// e.g. a library a new process loaded, without racing a toggle.
+func (t *Toggles) Grow(name string, grow func(on bool) ([]link.Link, error)) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h, ok := t.hooks[name]
+	if !ok {
+		return fmt.Errorf("unknown hook %q", name)
+	}
+	links, err := grow(h.on)
+	if err != nil {
+		return fmt.Errorf("extend hook %s: %w", name, err)
+	}
+	h.links = append(h.links, links...)
+	return nil
+}
+
+// States reports which hooks are attached.
+func (t *Toggles) States() map[string]bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	states := make(map[string]bool, len(t.hooks))
+	for name, h := range t.hooks {
+		states[name] = h.on
+	}
+	return states
+}
+
+// Names lists the registered hooks in sorted order.
+func (t *Toggles) Names() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	names := make([]string, 0, len(t.hooks))
+	for name := range t.hooks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Links counts the links currently attached.
+func (t *Toggles) Links() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, h := range t.hooks {
+		n += len(h.links)
+	}
+	return n
+}
+
+// Close detaches every hook.
+func (t *Toggles) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, h := range t.hooks {
+		closeLinks(h.links)
+		h.links, h.on = nil, false
+	}
+}
+
+func closeLinks(links []link.Link) {
+	for _, l := range links {
+		l.Close()
+	}
+}
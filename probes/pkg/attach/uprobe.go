@@ -0,0 +1,391 @@
+package attach
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+)
+
+// Uprobes name their target by symbol, which only works out of the box
+// for binaries that kept .symtab. Distribution binaries are stripped, and
+// libraries export several versions of a symbol (malloc@GLIBC_2.2.5,
+// memcpy@@GLIBC_2.14), so ResolveSymbol looks in order at .symtab, at
+// .dynsym with its version tables, at a separate debug file under
+// /usr/lib/debug/.build-id, and at the debuginfod servers in
+// DEBUGINFOD_URLS. Addresses are turned into file offsets through the
+// program headers, which holds for PIE and prelinked binaries alike.
+
+// ErrSymbolNotFound is returned when no symbol source knows a symbol.
+var ErrSymbolNotFound = errors.New("symbol not found")
+
+// ResolvedSymbol is a function located in a binary.
+type ResolvedSymbol struct {
+	Name    string
+	Version string
+	// Address is the link-time virtual address of the symbol.
+	Address uint64
+	// Offset is the file offset uprobes take.
+	Offset uint64
+	// Source tells where the symbol was found: symtab, dynsym, debuglink
+	// or debuginfod.
+	Source string
+}
+
+// ResolveSymbol locates symbol in the binary or library at path. The
+// symbol may name a version: "malloc@GLIBC_2.2.5" matches that version
+// only, "malloc@@GLIBC_2.2.5" only if it is the default; a bare name takes
+// the default version.
+func ResolveSymbol(path, symbol string) (ResolvedSymbol, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return ResolvedSymbol{}, err
+	}
+	defer f.Close()
+
+	name, version, defaultOnly := splitSymbolVersion(symbol)
+	rs := ResolvedSymbol{Name: name, Version: version}
+	var errs []error
+
+	addr, err := lookupSymtab(f, symbol)
+	rs.Source = "symtab"
+	if errors.Is(err, ErrSymbolNotFound) {
+		addr, rs.Version, err = lookupDynsym(f, name, version, defaultOnly)
+		rs.Source = "dynsym"
+	}
+	if errors.Is(err, ErrSymbolNotFound) {
+		// Separate debug info keeps the full symbol table of a stripped
+		// binary at the same addresses
+		var debugPath string
+		debugPath, rs.Source, err = debugFile(f)
+		if err == nil {
+			addr, err = lookupDebugFile(debugPath, symbol)
+		}
+		if err != nil && !errors.Is(err, ErrSymbolNotFound) {
+			errs = append(errs, err)
+			err = ErrSymbolNotFound
+		}
+	}
+	if err != nil {
+		return ResolvedSymbol{}, fmt.Errorf("%s: %s: %w", path, symbol, errors.Join(append([]error{err}, errs...)...))
+	}
+
+	rs.Address = addr
+	if rs.Offset, err = fileOffset(f, addr); err != nil {
+		return ResolvedSymbol{}, fmt.Errorf("%s: %s: %w", path, symbol, err)
+	}
+	return rs, nil
+}
+
+// splitSymbolVersion splits "name@VER" and "name@@VER".
+func splitSymbolVersion(symbol string) (name, version string, defaultOnly bool) {
+	name, version, ok := strings.Cut(symbol, "@")
+	if !ok {
+		return symbol, "", false
+	}
+	if v, ok := strings.CutPrefix(version, "@"); ok {
+		return name, v, true
+	}
+	return name, version, false
+}
+
+// lookupSymtab searches .symtab, where versioned names appear literally
+// (memcpy@GLIBC_2.2.5) next to the bare default one.
+func lookupSymtab(f *elf.File, symbol string) (uint64, error) {
+	syms, err := f.Symbols()
+	if err != nil && !errors.Is(err, elf.ErrNoSymbols) {
+		return 0, err
+	}
+	for _, s := range syms {
+		if !isDefinedFunc(s) {
+			continue
+		}
+		if s.Name == symbol {
+			return s.Value, checkFunc(s)
+		}
+	}
+	return 0, ErrSymbolNotFound
+}
+
+func lookupDebugFile(path, symbol string) (uint64, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return lookupSymtab(f, symbol)
+}
+
+// sttGNUIFunc is STT_GNU_IFUNC, which debug/elf only names from Go 1.23.
+const sttGNUIFunc elf.SymType = 10
+
+func isDefinedFunc(s elf.Symbol) bool {
+	typ := elf.ST_TYPE(s.Info)
+	return (typ == elf.STT_FUNC || typ == sttGNUIFunc) &&
+		s.Section != elf.SHN_UNDEF && s.Value != 0
+}
+
+// checkFunc rejects ifunc resolvers: probing them fires once at load time
+// rather than on every call of the function they pick.
+func checkFunc(s elf.Symbol) error {
+	if elf.ST_TYPE(s.Info) == sttGNUIFunc {
+		return fmt.Errorf("%s is an ifunc resolver; probe the implementation it selects instead", s.Name)
+	}
+	return nil
+}
+
+// lookupDynsym searches .dynsym. Without a version the default definition
+// wins over hidden compatibility ones.
+func lookupDynsym(f *elf.File, name, version string, defaultOnly bool) (uint64, string, error) {
+	syms, err := f.DynamicSymbols()
+	if err != nil && !errors.Is(err, elf.ErrNoSymbols) {
+		return 0, "", err
+	}
+	versions, err := symbolVersions(f)
+	if err != nil {
+		return 0, "", err
+	}
+
+	var (
+		addr  uint64
+		found elf.Symbol
+		ver   string
+		ok    bool
+	)
+	for i, s := range syms {
+		if s.Name != name || !isDefinedFunc(s) {
+			continue
+		}
+		// DynamicSymbols skips the null symbol at index 0
+		v := versions[i+1]
+		switch {
+		case version != "" && v.name != version:
+			continue
+		case defaultOnly && v.hidden:
+			continue
+		case version == "" && ok && v.hidden:
+			continue // keep the earlier, possibly default, match
+		}
+		addr, found, ver, ok = s.Value, s, v.name, true
+		if !v.hidden {
+			break
+		}
+	}
+	if !ok {
+		return 0, "", ErrSymbolNotFound
+	}
+	return addr, ver, checkFunc(found)
+}
+
+type symbolVersion struct {
+	name   string
+	hidden bool // not the default version (name@VER rather than name@@VER)
+}
+
+// symbolVersions reads .gnu.version and .gnu.version_d into the version of
+// each dynamic symbol, indexed like .dynsym. Binaries without symbol
+// versioning get an empty version for every symbol.
+func symbolVersions(f *elf.File) (map[int]symbolVersion, error) {
+	versions := make(map[int]symbolVersion)
+	versym := f.SectionByType(elf.SHT_GNU_VERSYM)
+	verdef := f.SectionByType(elf.SHT_GNU_VERDEF)
+	if versym == nil || verdef == nil {
+		return versions, nil
+	}
+	symData, err := versym.Data()
+	if err != nil {
+		return nil, fmt.Errorf("read .gnu.version: %w", err)
+	}
+	defData, err := verdef.Data()
+	if err != nil {
+		return nil, fmt.Errorf("read .gnu.version_d: %w", err)
+	}
+	if int(verdef.Link) >= len(f.Sections) {
+		return nil, errors.New("invalid .gnu.version_d string table")
+	}
+	strtab, err := f.Sections[verdef.Link].Data()
+	if err != nil {
+		return nil, fmt.Errorf("read .dynstr: %w", err)
+	}
+
+	// Elf_Verdef: version, flags, ndx, cnt (u16), hash, aux, next (u32),
+	// followed by Elf_Verdaux: name, next (u32); the first aux names the
+	// version
+	names := make(map[uint16]string)
+	order := f.ByteOrder
+	for off := 0; off+20 <= len(defData); {
+		ndx := order.Uint16(defData[off+4:])
+		aux := off + int(order.Uint32(defData[off+12:]))
+		if aux+8 <= len(defData) {
+			names[ndx] = cString(strtab, order.Uint32(defData[aux:]))
+		}
+		next := int(order.Uint32(defData[off+16:]))
+		if next == 0 {
+			break
+		}
+		off += next
+	}
+
+	for i := 0; 2*i+2 <= len(symData); i++ {
+		v := order.Uint16(symData[2*i:])
+		versions[i] = symbolVersion{name: names[v&0x7fff], hidden: v&0x8000 != 0}
+	}
+	return versions, nil
+}
+
+func cString(b []byte, off uint32) string {
+	if int(off) >= len(b) {
+		return ""
+	}
+	b = b[off:]
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// buildID returns the GNU build ID of f in hex, or "" if it has none.
+func buildID(f *elf.File) string {
+	s := f.Section(".note.gnu.build-id")
+	if s == nil {
+		return ""
+	}
+	data, err := s.Data()
+	if err != nil || len(data) < 16 {
+		return ""
+	}
+	nameSize := f.ByteOrder.Uint32(data[0:4])
+	descSize := f.ByteOrder.Uint32(data[4:8])
+	start := 12 + int(align4(nameSize))
+	if start+int(descSize) > len(data) {
+		return ""
+	}
+	return hex.EncodeToString(data[start : start+int(descSize)])
+}
+
+// debugFile finds separate debug info for f: installed under
+// /usr/lib/debug/.build-id, or downloaded from debuginfod.
+func debugFile(f *elf.File) (path, source string, err error) {
+	id := buildID(f)
+	if len(id) < 3 {
+		return "", "", ErrSymbolNotFound
+	}
+	local := filepath.Join("/usr/lib/debug/.build-id", id[:2], id[2:]+".debug")
+	if _, err := os.Stat(local); err == nil {
+		return local, "debuglink", nil
+	}
+	path, err = Debuginfod(id)
+	return path, "debuginfod", err
+}
+
+// debuginfodTimeout bounds each debuginfod download.
+const debuginfodTimeout = 30 * time.Second
+
+// Debuginfod returns the path of the debug info for build ID id, fetched
+// from the servers in DEBUGINFOD_URLS into the cache elfutils uses
+// ($DEBUGINFOD_CACHE_PATH, else the user cache dir), so files are shared
+// with gdb and perf. It returns ErrSymbolNotFound if no server is set.
+func Debuginfod(id string) (string, error) {
+	urls := strings.Fields(os.Getenv("DEBUGINFOD_URLS"))
+	if len(urls) == 0 {
+		return "", ErrSymbolNotFound
+	}
+	cache := os.Getenv("DEBUGINFOD_CACHE_PATH")
+	if cache == "" {
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			return "", err
+		}
+		cache = filepath.Join(dir, "debuginfod_client")
+	}
+	path := filepath.Join(cache, id, "debuginfo")
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	client := &http.Client{Timeout: debuginfodTimeout}
+	var errs []error
+	for _, u := range urls {
+		err := fetchDebuginfo(client, strings.TrimSuffix(u, "/")+"/buildid/"+id+"/debuginfo", path)
+		if err == nil {
+			return path, nil
+		}
+		errs = append(errs, err)
+	}
+	return "", fmt.Errorf("debuginfod %s: %w", id, errors.Join(errs...))
+}
+
+func fetchDebuginfo(client *http.Client, url, path string) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	// Write aside and rename so a failed download never poisons the cache
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".debuginfo-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, resp.Body); err != nil {
+		tmp.Close()
+		return fmt.Errorf("%s: %w", url, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// UprobeOptions scopes a uprobe attachment.
+type UprobeOptions struct {
+	// PID limits the probe to one process; 0 traces every process running
+	// the binary.
+	PID int
+	// Return hooks function return (uretprobe).
+	Return bool
+}
+
+// Uprobe attaches the program prog of coll to symbol in the binary or
+// library at path, resolving the symbol with ResolveSymbol.
+func Uprobe(coll *ebpf.Collection, prog, path, symbol string, opts UprobeOptions) (link.Link, ResolvedSymbol, error) {
+	program := coll.Programs[prog]
+	if program == nil {
+		return nil, ResolvedSymbol{}, fmt.Errorf("no program %s", prog)
+	}
+	rs, err := ResolveSymbol(path, symbol)
+	if err != nil {
+		return nil, rs, err
+	}
+	ex, err := link.OpenExecutable(path)
+	if err != nil {
+		return nil, rs, err
+	}
+	uopts := &link.UprobeOptions{Address: rs.Offset, PID: opts.PID}
+	var l link.Link
+	if opts.Return {
+		l, err = ex.Uretprobe(rs.Name, program, uopts)
+	} else {
+		l, err = ex.Uprobe(rs.Name, program, uopts)
+	}
+	if err != nil {
+		return nil, rs, fmt.Errorf("attach %s to %s:%s: %w", prog, path, symbol, err)
+	}
+	return l, rs, nil
+}
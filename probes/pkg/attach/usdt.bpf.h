@@ -0,0 +1,112 @@
+/*
+ * USDT argument access for probes attached with attach.USDT
+ *
+ * attach.USDT writes where each argument of a probe site lives into
+ * usdt_specs and passes the slot as the BPF cookie of the uprobe, so a
+ * program handles every site of a probe the same way:
+ *
+ *     SEC("uprobe")
+ *     int query_start(struct pt_regs *ctx)
+ *     {
+ *         long query;
+ *         if (usdt_arg(ctx, 0, &query))
+ *             return 0;
+ *         ...
+ *     }
+ *
+ * libbpf's usdt.bpf.h needs the LINUX_HAS_BPF_COOKIE kconfig extern, which
+ * the Go loader does not provide, so this header assumes cookies (kernel
+ * 5.15+). Layouts must match usdtSpec in usdt.go.
+ */
+
+#ifndef __PROBEPILOT_USDT_BPF_H
+#define __PROBEPILOT_USDT_BPF_H
+
+#define USDT_MAX_ARGS 12
+#define USDT_MAX_SPECS 256
+
+enum usdt_arg_kind {
+    USDT_ARG_CONST,
+    USDT_ARG_REG,
+    USDT_ARG_REG_DEREF,
+};
+
+struct usdt_arg_spec {
+    __u64 val_off;    // constant, or offset from the register to dereference
+    __u32 kind;       // enum usdt_arg_kind
+    __s16 reg_off;    // offset of the register in struct pt_regs
+    __u8 is_signed;
+    __s8 bitshift;    // 64 - 8 * argument size
+};
+
+struct usdt_spec {
+    struct usdt_arg_spec args[USDT_MAX_ARGS];
+    __u32 arg_cnt;
+    __u32 pad;
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, USDT_MAX_SPECS);
+    __type(key, __u32);
+    __type(value, struct usdt_spec);
+} usdt_specs SEC(".maps");
+
+/* Number of arguments of the firing probe site, or -1 if unknown */
+static __always_inline int usdt_arg_cnt(struct pt_regs *ctx)
+{
+    __u32 id = bpf_get_attach_cookie(ctx);
+    struct usdt_spec *spec = bpf_map_lookup_elem(&usdt_specs, &id);
+
+    return spec ? (int)spec->arg_cnt : -1;
+}
+
+/*
+ * Read argument n (0-based) of the firing probe site into *res, sign- or
+ * zero-extended to 64 bits. Returns 0 on success.
+ */
+static __always_inline int usdt_arg(struct pt_regs *ctx, __u64 n, long *res)
+{
+    __u32 id = bpf_get_attach_cookie(ctx);
+    struct usdt_spec *spec = bpf_map_lookup_elem(&usdt_specs, &id);
+    struct usdt_arg_spec *arg;
+    unsigned long val;
+    int err;
+
+    *res = 0;
+    if (!spec || n >= USDT_MAX_ARGS || n >= spec->arg_cnt)
+        return -1;
+    arg = &spec->args[n];
+
+    switch (arg->kind) {
+    case USDT_ARG_CONST:
+        val = arg->val_off;
+        break;
+    case USDT_ARG_REG:
+        err = bpf_probe_read_kernel(&val, sizeof(val), (void *)ctx + arg->reg_off);
+        if (err)
+            return err;
+        break;
+    case USDT_ARG_REG_DEREF:
+        err = bpf_probe_read_kernel(&val, sizeof(val), (void *)ctx + arg->reg_off);
+        if (err)
+            return err;
+        err = bpf_probe_read_user(&val, sizeof(val), (void *)val + arg->val_off);
+        if (err)
+            return err;
+        /* Little-endian: the argument is in the low bytes already */
+        break;
+    default:
+        return -1;
+    }
+
+    /* Drop bytes beyond the argument's size, extending its sign if signed */
+    val <<= arg->bitshift;
+    if (arg->is_signed)
+        *res = ((long)val) >> arg->bitshift;
+    else
+        *res = val >> arg->bitshift;
+    return 0;
+}
+
+#endif /* __PROBEPILOT_USDT_BPF_H */
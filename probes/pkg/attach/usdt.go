@@ -0,0 +1,476 @@
+package attach
+
+import (
+	"bytes"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+)
+
+// USDT (statically defined tracepoints) are probe sites applications such
+// as PostgreSQL, MySQL, Python and Node compile in. Each site is an ELF
+// note in .note.stapsdt naming its provider, probe and where its arguments
+// live when it fires; an optional semaphore lets the application skip
+// preparing arguments while nobody traces it.
+//
+// USDT attaches a uprobe to every site of a probe and writes the site's
+// argument locations into the collection's usdt_specs map, indexed by the
+// BPF cookie of the link. Programs read arguments with usdt_arg() from
+// usdt.bpf.h next to this file, so they never deal with registers or
+// offsets. Cookies need kernel 5.15 or later.
+
+// USDTArgKind tells where an argument lives.
+type USDTArgKind uint32
+
+const (
+	// USDTArgConst is a constant encoded in the note.
+	USDTArgConst USDTArgKind = iota
+	// USDTArgReg is the value of a register.
+	USDTArgReg
+	// USDTArgRegDeref is a value in memory at a register plus an offset.
+	USDTArgRegDeref
+)
+
+// USDTArg is one parsed argument location.
+type USDTArg struct {
+	// Size is the argument's width in bytes.
+	Size   int
+	Signed bool
+	Kind   USDTArgKind
+	// Reg is the register holding the value or its address.
+	Reg string
+	// Value is the constant, or the offset from Reg to dereference.
+	Value int64
+}
+
+func (a USDTArg) String() string {
+	sign := ""
+	if a.Signed {
+		sign = "-"
+	}
+	switch a.Kind {
+	case USDTArgConst:
+		return fmt.Sprintf("%s%d@$%d", sign, a.Size, a.Value)
+	case USDTArgReg:
+		return fmt.Sprintf("%s%d@%s", sign, a.Size, a.Reg)
+	}
+	return fmt.Sprintf("%s%d@%d(%s)", sign, a.Size, a.Value, a.Reg)
+}
+
+// USDTProbe is one probe site.
+type USDTProbe struct {
+	Provider string
+	Name     string
+	// Offset is the file offset of the probed instruction, as uprobes
+	// take it.
+	Offset uint64
+	// SemaphoreOffset is the file offset of the probe's semaphore, or 0 if
+	// it has none.
+	SemaphoreOffset uint64
+	// RawArgs is the argument string of the note, e.g. "-4@%edi 8@-8(%rbp)".
+	RawArgs string
+	Args    []USDTArg
+}
+
+// ErrNoUSDT is returned for binaries without USDT notes.
+var ErrNoUSDT = errors.New("no USDT probes")
+
+const (
+	stapsdtNoteType = 3
+	stapsdtNoteName = "stapsdt"
+)
+
+// ReadUSDT lists the USDT probe sites of the ELF binary or library at path.
+func ReadUSDT(path string) ([]USDTProbe, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	notes := f.Section(".note.stapsdt")
+	if notes == nil {
+		return nil, fmt.Errorf("%s: %w", path, ErrNoUSDT)
+	}
+	data, err := notes.Data()
+	if err != nil {
+		return nil, fmt.Errorf("%s: read .note.stapsdt: %w", path, err)
+	}
+	// Sites record link-time addresses relative to .stapsdt.base, which
+	// prelinking may have moved
+	var base *elf.Section
+	if s := f.Section(".stapsdt.base"); s != nil {
+		base = s
+	}
+
+	var probes []USDTProbe
+	for len(data) >= 12 {
+		nameSize := f.ByteOrder.Uint32(data[0:4])
+		descSize := f.ByteOrder.Uint32(data[4:8])
+		noteType := f.ByteOrder.Uint32(data[8:12])
+		data = data[12:]
+		nameEnd, descEnd := align4(nameSize), align4(nameSize)+align4(descSize)
+		if uint64(len(data)) < uint64(descEnd) {
+			return nil, fmt.Errorf("%s: truncated USDT note", path)
+		}
+		name := string(bytes.TrimRight(data[:nameSize], "\x00"))
+		desc := data[nameEnd : nameEnd+descSize]
+		data = data[descEnd:]
+		if noteType != stapsdtNoteType || name != stapsdtNoteName {
+			continue
+		}
+
+		p, err := parseStapsdtNote(f, desc, base)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		probes = append(probes, p)
+	}
+	if len(probes) == 0 {
+		return nil, fmt.Errorf("%s: %w", path, ErrNoUSDT)
+	}
+	return probes, nil
+}
+
+func align4(n uint32) uint32 {
+	return (n + 3) &^ 3
+}
+
+// parseStapsdtNote decodes a note's pc, base and semaphore addresses
+// followed by the provider, name and argument strings.
+func parseStapsdtNote(f *elf.File, desc []byte, base *elf.Section) (USDTProbe, error) {
+	var p USDTProbe
+	addrSize := 8
+	if f.Class == elf.ELFCLASS32 {
+		addrSize = 4
+	}
+	if len(desc) < 3*addrSize {
+		return p, errors.New("truncated USDT note")
+	}
+	addr := func(i int) uint64 {
+		b := desc[i*addrSize:]
+		if addrSize == 4 {
+			return uint64(f.ByteOrder.Uint32(b))
+		}
+		return f.ByteOrder.Uint64(b)
+	}
+	pc, noteBase, sem := addr(0), addr(1), addr(2)
+	strs := strings.SplitN(string(desc[3*addrSize:]), "\x00", 4)
+	if len(strs) < 3 {
+		return p, errors.New("malformed USDT note strings")
+	}
+	p.Provider, p.Name, p.RawArgs = strs[0], strs[1], strs[2]
+
+	if base != nil && noteBase != 0 {
+		pc += base.Addr - noteBase
+	}
+	off, err := fileOffset(f, pc)
+	if err != nil {
+		return p, fmt.Errorf("probe %s:%s: %w", p.Provider, p.Name, err)
+	}
+	p.Offset = off
+	if sem != 0 {
+		if p.SemaphoreOffset, err = sectionOffset(f, sem); err != nil {
+			return p, fmt.Errorf("probe %s:%s semaphore: %w", p.Provider, p.Name, err)
+		}
+	}
+	if p.Args, err = ParseUSDTArgs(p.RawArgs, f.Machine); err != nil {
+		return p, fmt.Errorf("probe %s:%s: %w", p.Provider, p.Name, err)
+	}
+	return p, nil
+}
+
+// fileOffset maps a virtual address to its offset in the file through the
+// executable loadable segments.
+func fileOffset(f *elf.File, addr uint64) (uint64, error) {
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_LOAD && prog.Flags&elf.PF_X != 0 &&
+			addr >= prog.Vaddr && addr < prog.Vaddr+prog.Memsz {
+			return addr - prog.Vaddr + prog.Off, nil
+		}
+	}
+	return 0, fmt.Errorf("address 0x%x is in no executable segment", addr)
+}
+
+// sectionOffset maps a data address, such as a semaphore in .probes, to
+// its offset in the file, which is what the kernel expects for reference
+// counters.
+func sectionOffset(f *elf.File, addr uint64) (uint64, error) {
+	for _, s := range f.Sections {
+		if s.Type != elf.SHT_NOBITS && s.Flags&elf.SHF_ALLOC != 0 &&
+			addr >= s.Addr && addr < s.Addr+s.Size {
+			return addr - s.Addr + s.Offset, nil
+		}
+	}
+	return 0, fmt.Errorf("address 0x%x is in no section", addr)
+}
+
+var (
+	// x86: -4@%edi, 8@$42, 8@-8(%rbp), 4@(%rax)
+	x86ArgRe = regexp.MustCompile(`^(-?\d+)@(?:\$(-?\d+)|%(\w+)|(-?\d*)\(%(\w+)\))$`)
+	// arm64: -4@x0, 8@42, 8@[sp, 16], 4@[x1]
+	arm64ArgRe = regexp.MustCompile(`^(-?\d+)@(?:(-?\d+)|(\w+)|\[(\w+)(?:, ?(-?\d+))?\])$`)
+)
+
+// ParseUSDTArgs parses a note's space-separated argument locations for
+// the given architecture.
+func ParseUSDTArgs(s string, machine elf.Machine) ([]USDTArg, error) {
+	var args []USDTArg
+	for _, field := range strings.Fields(s) {
+		var arg USDTArg
+		var size, constant, reg, off, derefReg string
+		switch machine {
+		case elf.EM_X86_64:
+			m := x86ArgRe.FindStringSubmatch(field)
+			if m == nil {
+				return nil, fmt.Errorf("unsupported USDT argument %q", field)
+			}
+			size, constant, reg, off, derefReg = m[1], m[2], m[3], m[4], m[5]
+			if reg == "" && constant == "" && derefReg == "" {
+				return nil, fmt.Errorf("unsupported USDT argument %q", field)
+			}
+		case elf.EM_AARCH64:
+			m := arm64ArgRe.FindStringSubmatch(field)
+			if m == nil {
+				return nil, fmt.Errorf("unsupported USDT argument %q", field)
+			}
+			size, constant, reg, derefReg, off = m[1], m[2], m[3], m[4], m[5]
+		default:
+			return nil, fmt.Errorf("USDT arguments are not supported on %s", machine)
+		}
+
+		n, _ := strconv.Atoi(size)
+		if n < 0 {
+			arg.Signed, n = true, -n
+		}
+		if n != 1 && n != 2 && n != 4 && n != 8 {
+			return nil, fmt.Errorf("USDT argument %q has invalid size %d", field, n)
+		}
+		arg.Size = n
+		switch {
+		case constant != "":
+			arg.Kind = USDTArgConst
+			arg.Value, _ = strconv.ParseInt(constant, 10, 64)
+		case reg != "":
+			arg.Kind, arg.Reg = USDTArgReg, reg
+		default:
+			arg.Kind, arg.Reg = USDTArgRegDeref, derefReg
+			if off != "" && off != "-" {
+				arg.Value, _ = strconv.ParseInt(off, 10, 64)
+			}
+		}
+		if arg.Kind != USDTArgConst {
+			if _, err := regOffset(machine, arg.Reg); err != nil {
+				return nil, fmt.Errorf("USDT argument %q: %w", field, err)
+			}
+		}
+		args = append(args, arg)
+	}
+	if len(args) > usdtMaxArgs {
+		return nil, fmt.Errorf("USDT probe has %d arguments, at most %d are supported", len(args), usdtMaxArgs)
+	}
+	return args, nil
+}
+
+// x86RegOffsets are offsets into struct pt_regs of the 64-bit registers
+// and all their narrower names.
+var x86RegOffsets = func() map[string]int16 {
+	offsets := make(map[string]int16)
+	for off, names := range map[int16][]string{
+		0:   {"r15", "r15d", "r15w", "r15b"},
+		8:   {"r14", "r14d", "r14w", "r14b"},
+		16:  {"r13", "r13d", "r13w", "r13b"},
+		24:  {"r12", "r12d", "r12w", "r12b"},
+		32:  {"rbp", "ebp", "bp", "bpl"},
+		40:  {"rbx", "ebx", "bx", "bl"},
+		48:  {"r11", "r11d", "r11w", "r11b"},
+		56:  {"r10", "r10d", "r10w", "r10b"},
+		64:  {"r9", "r9d", "r9w", "r9b"},
+		72:  {"r8", "r8d", "r8w", "r8b"},
+		80:  {"rax", "eax", "ax", "al"},
+		88:  {"rcx", "ecx", "cx", "cl"},
+		96:  {"rdx", "edx", "dx", "dl"},
+		104: {"rsi", "esi", "si", "sil"},
+		112: {"rdi", "edi", "di", "dil"},
+		128: {"rip"},
+		152: {"rsp", "esp", "sp", "spl"},
+	} {
+		for _, name := range names {
+			offsets[name] = off
+		}
+	}
+	return offsets
+}()
+
+// regOffset returns the offset of reg in the uprobe's register context.
+func regOffset(machine elf.Machine, reg string) (int16, error) {
+	switch machine {
+	case elf.EM_X86_64:
+		if off, ok := x86RegOffsets[reg]; ok {
+			return off, nil
+		}
+	case elf.EM_AARCH64:
+		// struct user_pt_regs: regs[31], sp, pc
+		switch reg {
+		case "sp":
+			return 31 * 8, nil
+		case "pc":
+			return 32 * 8, nil
+		}
+		if len(reg) > 1 && (reg[0] == 'x' || reg[0] == 'w') {
+			if n, err := strconv.Atoi(reg[1:]); err == nil && n >= 0 && n <= 30 {
+				return int16(n * 8), nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("unknown register %q", reg)
+}
+
+// Limits and layouts shared with usdt.bpf.h.
+const (
+	usdtMaxArgs  = 12
+	usdtMaxSpecs = 256
+	usdtSpecsMap = "usdt_specs"
+)
+
+// usdtArgSpec mirrors struct usdt_arg_spec.
+type usdtArgSpec struct {
+	ValOff   uint64
+	Kind     uint32
+	RegOff   int16
+	Signed   uint8
+	BitShift int8
+}
+
+// usdtSpec mirrors struct usdt_spec.
+type usdtSpec struct {
+	Args   [usdtMaxArgs]usdtArgSpec
+	ArgCnt uint32
+	_      [4]byte
+}
+
+func newUSDTSpec(p USDTProbe, machine elf.Machine) (usdtSpec, error) {
+	var spec usdtSpec
+	spec.ArgCnt = uint32(len(p.Args))
+	for i, arg := range p.Args {
+		as := &spec.Args[i]
+		as.Kind = uint32(arg.Kind)
+		as.ValOff = uint64(arg.Value)
+		if arg.Signed {
+			as.Signed = 1
+		}
+		// Narrow values are shifted up and back down to drop the bytes
+		// beyond them, sign-extending if signed
+		as.BitShift = int8(64 - 8*arg.Size)
+		if arg.Kind != USDTArgConst {
+			off, err := regOffset(machine, arg.Reg)
+			if err != nil {
+				return spec, err
+			}
+			as.RegOff = off
+		}
+	}
+	return spec, nil
+}
+
+// usdtSpecIDs hands out usdt_specs slots per map, so probes attached at
+// different times never share one.
+var usdtSpecIDs = struct {
+	sync.Mutex
+	next map[*ebpf.Map]uint32
+}{next: make(map[*ebpf.Map]uint32)}
+
+func nextUSDTSpecID(m *ebpf.Map) (uint32, error) {
+	usdtSpecIDs.Lock()
+	defer usdtSpecIDs.Unlock()
+	id := usdtSpecIDs.next[m]
+	if id >= m.MaxEntries() || id >= usdtMaxSpecs {
+		return 0, fmt.Errorf("%s is full (%d probe sites)", usdtSpecsMap, id)
+	}
+	usdtSpecIDs.next[m] = id + 1
+	return id, nil
+}
+
+// USDTOptions scopes a USDT attachment.
+type USDTOptions struct {
+	// PID limits the probe to one process; 0 traces every process running
+	// the binary.
+	PID int
+}
+
+// USDT attaches the program prog of coll to every site of provider:name
+// in the binary or library at path. Semaphores are incremented by the
+// kernel while the links exist.
+func USDT(coll *ebpf.Collection, prog, path, provider, name string, opts USDTOptions) ([]link.Link, error) {
+	program := coll.Programs[prog]
+	if program == nil {
+		return nil, fmt.Errorf("no program %s", prog)
+	}
+	specs := coll.Maps[usdtSpecsMap]
+	if specs == nil {
+		return nil, fmt.Errorf("no %s map (include usdt.bpf.h)", usdtSpecsMap)
+	}
+
+	probes, err := ReadUSDT(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	machine := f.Machine
+	f.Close()
+
+	ex, err := link.OpenExecutable(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var links []link.Link
+	for _, p := range probes {
+		if p.Provider != provider || p.Name != name {
+			continue
+		}
+		spec, err := newUSDTSpec(p, machine)
+		if err != nil {
+			closeLinks(links)
+			return nil, err
+		}
+		id, err := nextUSDTSpecID(specs)
+		if err != nil {
+			closeLinks(links)
+			return nil, err
+		}
+		if err := specs.Put(id, spec); err != nil {
+			closeLinks(links)
+			return nil, fmt.Errorf("write %s: %w", usdtSpecsMap, err)
+		}
+		l, err := ex.Uprobe(provider+":"+name, program, &link.UprobeOptions{
+			Address:      p.Offset,
+			PID:          opts.PID,
+			RefCtrOffset: p.SemaphoreOffset,
+			Cookie:       uint64(id),
+		})
+		if err != nil {
+			closeLinks(links)
+			return nil, fmt.Errorf("attach %s:%s at 0x%x: %w", provider, name, p.Offset, err)
+		}
+		links = append(links, l)
+	}
+	if len(links) == 0 {
+		return nil, fmt.Errorf("%s: no USDT probe %s:%s", path, provider, name)
+	}
+	return links, nil
+}
+
+// Compile-time size check against struct usdt_spec
+var _ = [1]struct{}{}[unsafe.Sizeof(usdtSpec{})-200]
@@ -0,0 +1,213 @@
+// Package baseline records the aggregate behaviour of a running agent over
+// a window and compares a later run against it, for canary analysis: does
+// the new build or configuration regress latency, memory or throughput
+// beyond what run-to-run noise explains?
+//
+// A recording scrapes the agent's /metrics every interval. Histograms such
+// as tcp_rtt_seconds become the distribution of the values observed during
+// the window; counters ending in _total become per-interval rates and the
+// other samples per-interval gauges. Comparing two recordings tests each
+// histogram with a two-sample Kolmogorov-Smirnov test over the buckets and
+// each series with a Mann-Whitney U test, and reports the changes that are
+// both significant and large enough to matter.
+package baseline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"probepilot/pkg/export"
+	"probepilot/pkg/query"
+	"probepilot/pkg/schema"
+)
+
+// Distribution is the histogram of the values observed during a recording.
+type Distribution struct {
+	Name   string       `json:"name"`
+	Labels query.Labels `json:"labels,omitempty"`
+	// Bounds are the finite bucket upper bounds and Cumulative the number
+	// of observations at most each; Count includes the +Inf bucket.
+	Bounds     []float64 `json:"bounds"`
+	Cumulative []uint64  `json:"cumulative"`
+	Count      uint64    `json:"count"`
+	Sum        float64   `json:"sum"`
+}
+
+// Series kinds.
+const (
+	// Rate is a counter's increase per second over each interval.
+	Rate = "rate"
+	// Gauge is a sample's value at the end of each interval.
+	Gauge = "gauge"
+)
+
+// Series is one sample's values, one per interval.
+type Series struct {
+	Name   string       `json:"name"`
+	Labels query.Labels `json:"labels,omitempty"`
+	Kind   string       `json:"kind"`
+	Values []float64    `json:"values"`
+}
+
+// Baseline is a recording of an agent's metrics.
+type Baseline struct {
+	Schema     string          `json:"schema"`
+	Source     string          `json:"source"`
+	Start      time.Time       `json:"start"`
+	Duration   export.Duration `json:"duration"`
+	Interval   export.Duration `json:"interval"`
+	Histograms []Distribution  `json:"histograms"`
+	Series     []Series        `json:"series"`
+}
+
+// Record scrapes the agent at addr every interval for duration, or until
+// ctx is done, and returns what it observed. At least one full interval
+// must pass.
+func Record(ctx context.Context, addr string, duration, interval time.Duration) (*Baseline, error) {
+	if interval <= 0 || duration < interval {
+		return nil, fmt.Errorf("duration %s must be at least one interval (%s)", duration, interval)
+	}
+	s := NewScraper(addr)
+	first, err := s.scrape()
+	if err != nil {
+		return nil, err
+	}
+	b := &Baseline{
+		Schema:   schema.Tag(schema.Baseline),
+		Source:   addr,
+		Start:    first.time,
+		Interval: export.Duration(interval),
+	}
+	series := make(map[string]*Series)
+	prev := first
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	deadline := time.NewTimer(duration)
+	defer deadline.Stop()
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-deadline.C:
+			break loop
+		case <-ticker.C:
+		}
+		cur, err := s.scrape()
+		if err != nil {
+			return nil, err
+		}
+		addSeries(series, prev, cur)
+		prev = cur
+		// The last scrape may land just after the deadline; it still
+		// closes a full interval.
+		if cur.time.Sub(first.time) >= duration {
+			break
+		}
+	}
+	if prev == first {
+		return nil, fmt.Errorf("stopped before the first %s interval", interval)
+	}
+	b.Duration = export.Duration(prev.time.Sub(first.time))
+	b.Histograms = diffHistograms(first, prev)
+	for _, s := range series {
+		b.Series = append(b.Series, *s)
+	}
+	sort.Slice(b.Series, func(i, j int) bool {
+		return seriesKey(b.Series[i].Name, b.Series[i].Labels) < seriesKey(b.Series[j].Name, b.Series[j].Labels)
+	})
+	return b, nil
+}
+
+// addSeries appends the interval from prev to cur. Counters that went
+// backwards were reset by an agent restart and skip the interval.
+func addSeries(series map[string]*Series, prev, cur *snapshot) {
+	elapsed := cur.time.Sub(prev.time).Seconds()
+	for key, sample := range cur.samples {
+		kind, v := Gauge, sample.Value
+		if strings.HasSuffix(sample.Name, "_total") {
+			p, ok := prev.samples[key]
+			if !ok || sample.Value < p.Value || elapsed <= 0 {
+				continue
+			}
+			kind, v = Rate, (sample.Value-p.Value)/elapsed
+		}
+		s := series[key]
+		if s == nil {
+			s = &Series{Name: sample.Name, Labels: sample.Labels, Kind: kind}
+			series[key] = s
+		}
+		s.Values = append(s.Values, v)
+	}
+}
+
+// diffHistograms returns what each histogram observed between first and
+// last. Histograms that were reset, changed buckets or observed nothing
+// are left out.
+func diffHistograms(first, last *snapshot) []Distribution {
+	var out []Distribution
+	for key, l := range last.histograms {
+		d := *l
+		d.Cumulative = append([]uint64(nil), l.Cumulative...)
+		if f, ok := first.histograms[key]; ok {
+			if !sameBounds(f.Bounds, l.Bounds) || f.Count > l.Count {
+				continue
+			}
+			for i := range d.Cumulative {
+				d.Cumulative[i] -= f.Cumulative[i]
+			}
+			d.Count -= f.Count
+			d.Sum -= f.Sum
+		}
+		if d.Count == 0 {
+			continue
+		}
+		out = append(out, d)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return seriesKey(out[i].Name, out[i].Labels) < seriesKey(out[j].Name, out[j].Labels)
+	})
+	return out
+}
+
+func sameBounds(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Save writes b to path.
+func (b *Baseline) Save(path string) error {
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// Load reads a baseline written by Save.
+func Load(path string) (*Baseline, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var b Baseline
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := schema.Check(schema.Baseline, b.Schema); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &b, nil
+}
@@ -0,0 +1,331 @@
+package baseline
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"probepilot/pkg/query"
+)
+
+// Options tune what Compare reports.
+type Options struct {
+	// Alpha is the significance level of each test, e.g. 0.01.
+	Alpha float64
+	// MinChange is the smallest relative change worth reporting, e.g.
+	// 0.05; significant but smaller shifts of long recordings are noise
+	// to an operator.
+	MinChange float64
+}
+
+// DefaultOptions report changes of at least 5% at the 1% level.
+var DefaultOptions = Options{Alpha: 0.01, MinChange: 0.05}
+
+// Minimum sample sizes below which a metric is not compared.
+const (
+	minObservations = 20
+	minIntervals    = 5
+)
+
+// Finding is a significant change of one metric.
+type Finding struct {
+	Name   string
+	Labels query.Labels
+	// Category is latency, memory, errors or throughput, or empty for
+	// metrics where neither direction is known to be worse.
+	Category string
+	// Statistic names what Baseline and Current hold: a quantile such as
+	// p99 for histograms, the median for series.
+	Statistic         string
+	Baseline, Current float64
+	// Change is (Current-Baseline)/Baseline.
+	Change float64
+	P      float64
+	// Regression is set when the change goes the worse way for its
+	// category.
+	Regression bool
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s%s %s %g -> %g (%s, p=%.2g)", f.Name, f.Labels, f.Statistic, f.Baseline, f.Current, FormatChange(f.Change), f.P)
+}
+
+// FormatChange renders a relative change as a signed percentage.
+func FormatChange(c float64) string {
+	switch {
+	case math.IsInf(c, 1):
+		return "new"
+	case math.IsInf(c, -1):
+		return "gone"
+	}
+	return fmt.Sprintf("%+.1f%%", c*100)
+}
+
+// Report is the result of a comparison.
+type Report struct {
+	// Compared counts the metrics present in both recordings with enough
+	// data to test.
+	Compared int
+	Findings []Finding
+}
+
+// Regressions returns the findings that are regressions.
+func (r Report) Regressions() []Finding {
+	var out []Finding
+	for _, f := range r.Findings {
+		if f.Regression {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// Compare tests every metric of cur against the same metric in base and
+// returns the significant changes, regressions first.
+func Compare(base, cur *Baseline, opts Options) Report {
+	var r Report
+	baseHist := make(map[string]Distribution)
+	for _, d := range base.Histograms {
+		baseHist[seriesKey(d.Name, d.Labels)] = d
+	}
+	for _, d := range cur.Histograms {
+		b, ok := baseHist[seriesKey(d.Name, d.Labels)]
+		if !ok || !sameBounds(b.Bounds, d.Bounds) || b.Count < minObservations || d.Count < minObservations {
+			continue
+		}
+		r.Compared++
+		if f, ok := compareDistributions(b, d, opts); ok {
+			r.Findings = append(r.Findings, f)
+		}
+	}
+
+	baseSeries := make(map[string]Series)
+	for _, s := range base.Series {
+		baseSeries[seriesKey(s.Name, s.Labels)] = s
+	}
+	for _, s := range cur.Series {
+		b, ok := baseSeries[seriesKey(s.Name, s.Labels)]
+		if !ok || b.Kind != s.Kind || len(b.Values) < minIntervals || len(s.Values) < minIntervals {
+			continue
+		}
+		r.Compared++
+		if f, ok := compareSeries(b, s, opts); ok {
+			r.Findings = append(r.Findings, f)
+		}
+	}
+
+	sort.SliceStable(r.Findings, func(i, j int) bool {
+		a, b := r.Findings[i], r.Findings[j]
+		if a.Regression != b.Regression {
+			return a.Regression
+		}
+		return math.Abs(a.Change) > math.Abs(b.Change)
+	})
+	return r
+}
+
+// Quantiles reported for histograms; the largest relative shift is kept.
+var quantiles = []struct {
+	name string
+	q    float64
+}{
+	{"p50", 0.5},
+	{"p90", 0.9},
+	{"p99", 0.99},
+}
+
+func compareDistributions(base, cur Distribution, opts Options) (Finding, bool) {
+	// Two-sample Kolmogorov-Smirnov over the bucket bounds: the largest
+	// distance between the empirical CDFs.
+	n1, n2 := float64(base.Count), float64(cur.Count)
+	var d float64
+	for i := range base.Bounds {
+		if diff := math.Abs(float64(base.Cumulative[i])/n1 - float64(cur.Cumulative[i])/n2); diff > d {
+			d = diff
+		}
+	}
+	ne := n1 * n2 / (n1 + n2)
+	p := ksProbability((math.Sqrt(ne) + 0.12 + 0.11/math.Sqrt(ne)) * d)
+	if p >= opts.Alpha {
+		return Finding{}, false
+	}
+
+	f := Finding{Name: cur.Name, Labels: cur.Labels, Category: category(cur.Name, ""), P: p}
+	for _, q := range quantiles {
+		b, c := quantile(base, q.q), quantile(cur, q.q)
+		if change := relativeChange(b, c); f.Statistic == "" || math.Abs(change) > math.Abs(f.Change) {
+			f.Statistic, f.Baseline, f.Current, f.Change = q.name, b, c, change
+		}
+	}
+	if math.Abs(f.Change) < opts.MinChange {
+		return Finding{}, false
+	}
+	f.Regression = f.Category != "" && worse(f.Category, f.Change)
+	return f, true
+}
+
+// ksProbability is the asymptotic Kolmogorov distribution's tail,
+// Q(λ) = 2 Σ (-1)^(k-1) exp(-2k²λ²).
+func ksProbability(lambda float64) float64 {
+	if lambda < 0.2 {
+		return 1
+	}
+	var sum float64
+	sign := 2.0
+	for k := 1; k <= 100; k++ {
+		term := sign * math.Exp(-2*float64(k*k)*lambda*lambda)
+		sum += term
+		if math.Abs(term) < 1e-10 {
+			break
+		}
+		sign = -sign
+	}
+	return math.Max(0, math.Min(1, sum))
+}
+
+// quantile estimates the q-quantile by linear interpolation within its
+// bucket; quantiles in the +Inf bucket are clamped to the last bound.
+func quantile(d Distribution, q float64) float64 {
+	rank := q * float64(d.Count)
+	lower, below := 0.0, uint64(0)
+	for i, bound := range d.Bounds {
+		if c := d.Cumulative[i]; float64(c) >= rank {
+			if c == below {
+				return bound
+			}
+			return lower + (bound-lower)*(rank-float64(below))/float64(c-below)
+		}
+		lower, below = bound, d.Cumulative[i]
+	}
+	return lower
+}
+
+func compareSeries(base, cur Series, opts Options) (Finding, bool) {
+	p := mannWhitney(base.Values, cur.Values)
+	if p >= opts.Alpha {
+		return Finding{}, false
+	}
+	b, c := median(base.Values), median(cur.Values)
+	f := Finding{
+		Name:      cur.Name,
+		Labels:    cur.Labels,
+		Category:  category(cur.Name, cur.Kind),
+		Statistic: "median",
+		Baseline:  b,
+		Current:   c,
+		Change:    relativeChange(b, c),
+		P:         p,
+	}
+	if cur.Kind == Rate {
+		f.Statistic = "median rate/s"
+	}
+	if math.Abs(f.Change) < opts.MinChange {
+		return Finding{}, false
+	}
+	f.Regression = f.Category != "" && worse(f.Category, f.Change)
+	return f, true
+}
+
+// mannWhitney returns the two-sided p-value of the Mann-Whitney U test
+// under the normal approximation, corrected for ties.
+func mannWhitney(a, b []float64) float64 {
+	type obs struct {
+		v     float64
+		first bool
+	}
+	all := make([]obs, 0, len(a)+len(b))
+	for _, v := range a {
+		all = append(all, obs{v, true})
+	}
+	for _, v := range b {
+		all = append(all, obs{v, false})
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].v < all[j].v })
+
+	n := float64(len(all))
+	var rankSum, ties float64
+	for i := 0; i < len(all); {
+		j := i
+		for j < len(all) && all[j].v == all[i].v {
+			j++
+		}
+		rank := float64(i+j+1) / 2 // average of ranks i+1..j
+		for k := i; k < j; k++ {
+			if all[k].first {
+				rankSum += rank
+			}
+		}
+		t := float64(j - i)
+		ties += t*t*t - t
+		i = j
+	}
+
+	n1, n2 := float64(len(a)), float64(len(b))
+	u := rankSum - n1*(n1+1)/2
+	mean := n1 * n2 / 2
+	sigma := math.Sqrt(n1 * n2 / 12 * ((n + 1) - ties/(n*(n-1))))
+	if sigma == 0 {
+		return 1
+	}
+	z := math.Max(0, math.Abs(u-mean)-0.5) / sigma
+	return math.Erfc(z / math.Sqrt2)
+}
+
+func median(values []float64) float64 {
+	s := append([]float64(nil), values...)
+	sort.Float64s(s)
+	if len(s)%2 == 1 {
+		return s[len(s)/2]
+	}
+	return (s[len(s)/2-1] + s[len(s)/2]) / 2
+}
+
+func relativeChange(base, cur float64) float64 {
+	if base == 0 {
+		switch {
+		case cur > 0:
+			return math.Inf(1)
+		case cur < 0:
+			return math.Inf(-1)
+		}
+		return 0
+	}
+	return (cur - base) / math.Abs(base)
+}
+
+// Name fragments that place a metric in a category, checked in order.
+var categories = []struct {
+	category  string
+	kind      string // "" for any kind
+	fragments []string
+}{
+	{"errors", "", []string{"retransmit", "drop", "fail", "evict", "violation", "leak", "oom", "lost"}},
+	{"latency", "", []string{"_seconds", "rtt", "latency"}},
+	{"memory", Gauge, []string{"memory", "_bytes"}},
+	{"throughput", Rate, []string{"_bytes_total", "connections", "events", "samples", "delivered", "records"}},
+}
+
+// category classifies a metric; kind is empty for histograms.
+func category(name, kind string) string {
+	for _, c := range categories {
+		if c.kind != "" && c.kind != kind {
+			continue
+		}
+		for _, frag := range c.fragments {
+			if strings.Contains(name, frag) {
+				return c.category
+			}
+		}
+	}
+	return ""
+}
+
+// worse reports whether change goes the bad way for category: throughput
+// regresses when it falls, everything else when it rises.
+func worse(category string, change float64) bool {
+	if category == "throughput" {
+		return change < 0
+	}
+	return change > 0
+}
@@ -0,0 +1,224 @@
+package baseline
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"probepilot/pkg/query"
+)
+
+// snapshot is one scrape of an agent's /metrics.
+type snapshot struct {
+	time       time.Time
+	samples    map[string]query.Sample
+	histograms map[string]*Distribution
+}
+
+// Scraper reads an agent's metrics from its query API.
+type Scraper struct {
+	url    string
+	client *http.Client
+}
+
+// NewScraper returns a scraper of the query API at addr, given as for the
+// agents' -listen flag: host:port, unix:/path or an http URL.
+func NewScraper(addr string) *Scraper {
+	client := &http.Client{Timeout: 10 * time.Second}
+	url := addr
+	switch {
+	case strings.HasPrefix(addr, "unix:"):
+		path := strings.TrimPrefix(addr, "unix:")
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			},
+		}
+		url = "http://agent/metrics"
+	case !strings.Contains(addr, "://"):
+		url = "http://" + addr + "/metrics"
+	case !strings.HasSuffix(addr, "/metrics"):
+		url = strings.TrimSuffix(addr, "/") + "/metrics"
+	}
+	return &Scraper{url: url, client: client}
+}
+
+func (s *Scraper) scrape() (*snapshot, error) {
+	resp, err := s.client.Get(s.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", s.url, resp.Status)
+	}
+	snap, err := parseText(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("GET %s: %v", s.url, err)
+	}
+	snap.time = time.Now()
+	return snap, nil
+}
+
+// Samples scrapes the agent once and returns its samples, histogram
+// families left out.
+func (s *Scraper) Samples() ([]query.Sample, error) {
+	snap, err := s.scrape()
+	if err != nil {
+		return nil, err
+	}
+	samples := make([]query.Sample, 0, len(snap.samples))
+	for _, sample := range snap.samples {
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+// parseText reads the Prometheus text format as the agents write it: the
+// _bucket, _sum and _count samples of each histogram family make up one
+// Distribution per label set, every other line is a sample.
+func parseText(r io.Reader) (*snapshot, error) {
+	snap := &snapshot{samples: make(map[string]query.Sample), histograms: make(map[string]*Distribution)}
+	histogramFamilies := make(map[string]bool)
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if f := strings.Fields(line); len(f) == 4 && f[0] == "#" && f[1] == "TYPE" && f[3] == "histogram" {
+			histogramFamilies[f[2]] = true
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for n, line := range lines {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		s, err := parseSample(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n+1, err)
+		}
+		family, suffix := s.Name, ""
+		for _, suf := range []string{"_bucket", "_sum", "_count"} {
+			if base := strings.TrimSuffix(s.Name, suf); base != s.Name && histogramFamilies[base] {
+				family, suffix = base, suf
+			}
+		}
+		if suffix == "" {
+			snap.samples[seriesKey(s.Name, s.Labels)] = s
+			continue
+		}
+		le := s.Labels["le"]
+		delete(s.Labels, "le")
+		key := seriesKey(family, s.Labels)
+		d := snap.histograms[key]
+		if d == nil {
+			d = &Distribution{Name: family, Labels: s.Labels}
+			snap.histograms[key] = d
+		}
+		switch suffix {
+		case "_sum":
+			d.Sum = s.Value
+		case "_count":
+			d.Count = uint64(s.Value)
+		case "_bucket":
+			if le == "+Inf" {
+				continue
+			}
+			bound, err := strconv.ParseFloat(le, 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid le %q", n+1, le)
+			}
+			d.Bounds = append(d.Bounds, bound)
+			d.Cumulative = append(d.Cumulative, uint64(s.Value))
+		}
+	}
+	for _, d := range snap.histograms {
+		sort.Sort(byBound{d})
+	}
+	return snap, nil
+}
+
+type byBound struct{ d *Distribution }
+
+func (b byBound) Len() int           { return len(b.d.Bounds) }
+func (b byBound) Less(i, j int) bool { return b.d.Bounds[i] < b.d.Bounds[j] }
+func (b byBound) Swap(i, j int) {
+	b.d.Bounds[i], b.d.Bounds[j] = b.d.Bounds[j], b.d.Bounds[i]
+	b.d.Cumulative[i], b.d.Cumulative[j] = b.d.Cumulative[j], b.d.Cumulative[i]
+}
+
+// parseSample parses `name{label="value",...} value`.
+func parseSample(line string) (query.Sample, error) {
+	s := query.Sample{Labels: query.Labels{}}
+	rest := line
+	if i := strings.IndexAny(rest, "{ "); i < 0 {
+		return s, fmt.Errorf("missing value in %q", line)
+	} else {
+		s.Name, rest = rest[:i], rest[i:]
+	}
+	if strings.HasPrefix(rest, "{") {
+		rest = rest[1:]
+		for {
+			rest = strings.TrimLeft(rest, ", ")
+			if strings.HasPrefix(rest, "}") {
+				rest = rest[1:]
+				break
+			}
+			eq := strings.Index(rest, `="`)
+			if eq < 0 {
+				return s, fmt.Errorf("invalid labels in %q", line)
+			}
+			name := rest[:eq]
+			rest = rest[eq+2:]
+			var value strings.Builder
+			closed := false
+			for i := 0; i < len(rest); i++ {
+				c := rest[i]
+				if c == '\\' && i+1 < len(rest) {
+					i++
+					if rest[i] == 'n' {
+						value.WriteByte('\n')
+					} else {
+						value.WriteByte(rest[i])
+					}
+					continue
+				}
+				if c == '"' {
+					rest, closed = rest[i+1:], true
+					break
+				}
+				value.WriteByte(c)
+			}
+			if !closed {
+				return s, fmt.Errorf("unterminated label value in %q", line)
+			}
+			s.Labels[name] = value.String()
+		}
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return s, fmt.Errorf("missing value in %q", line)
+	}
+	v, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return s, fmt.Errorf("invalid value in %q", line)
+	}
+	s.Value = v
+	return s, nil
+}
+
+func seriesKey(name string, labels query.Labels) string {
+	return name + labels.String()
+}
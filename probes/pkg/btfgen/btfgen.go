@@ -0,0 +1,244 @@
+// Package btfgen generates Go struct definitions from the BTF embedded in
+// a compiled eBPF object, so the agents decode ring buffer records and map
+// values with types that cannot drift from the C definitions.
+package btfgen
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"strings"
+	"unicode"
+
+	"github.com/cilium/ebpf/btf"
+)
+
+// Options controls code generation.
+type Options struct {
+	// Package is the Go package name of the generated file.
+	Package string
+	// Source names the object the types were read from, for the header.
+	Source string
+	// Types lists the C struct names to generate.
+	Types []string
+	// Names overrides the generated Go identifier for a C type or field
+	// name, e.g. "tcp_event" -> "TCPEvent" or "saddr" -> "SAddr".
+	Names map[string]string
+	// Checks, if set, names a generated []layout.Check pairing every
+	// struct with its Go mirror, for layout.ValidateAll at load time.
+	Checks string
+}
+
+// initialisms are upper-cased as a whole when they form a name segment.
+var initialisms = map[string]bool{
+	"cpu": true, "id": true, "ip": true, "irq": true, "oom": true,
+	"pid": true, "rss": true, "rtt": true, "rx": true, "tcp": true,
+	"tid": true, "tx": true, "udp": true, "uid": true, "gid": true,
+}
+
+// GoName converts a C identifier to an exported Go identifier, applying
+// overrides first and common initialisms otherwise.
+func GoName(cname string, names map[string]string) string {
+	if name, ok := names[cname]; ok {
+		return name
+	}
+	var b strings.Builder
+	for _, part := range strings.Split(cname, "_") {
+		if part == "" {
+			continue
+		}
+		if initialisms[part] {
+			b.WriteString(strings.ToUpper(part))
+			continue
+		}
+		r := []rune(part)
+		r[0] = unicode.ToUpper(r[0])
+		b.WriteString(string(r))
+	}
+	return b.String()
+}
+
+// Generate renders Go definitions for the requested structs in spec. Any
+// struct referenced by a requested one is generated as well. Padding is
+// made explicit with blank fields so that the Go and C sizes agree, and a
+// compile-time assertion pins each size. With opts.Checks the same
+// structs are listed for the load-time check against the object's BTF.
+func Generate(spec *btf.Spec, opts Options) ([]byte, error) {
+	g := &generator{
+		opts:  opts,
+		types: make(map[string]*btf.Struct),
+	}
+	for _, name := range opts.Types {
+		var st *btf.Struct
+		if err := spec.TypeByName(name, &st); err != nil {
+			return nil, fmt.Errorf("struct %s: %w", name, err)
+		}
+		g.add(st)
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "// Code generated by btfgen from %s; DO NOT EDIT.\n\n", opts.Source)
+	fmt.Fprintf(&out, "package %s\n\n", opts.Package)
+	if opts.Checks != "" {
+		out.WriteString("import (\n\t\"unsafe\"\n\n\t\"probepilot/pkg/layout\"\n)\n\n")
+	} else {
+		out.WriteString("import \"unsafe\"\n\n")
+	}
+
+	for _, name := range g.order {
+		if err := g.writeStruct(&out, g.types[name]); err != nil {
+			return nil, err
+		}
+	}
+
+	out.WriteString("// Compile-time size checks against the BTF layout\n")
+	out.WriteString("var (\n")
+	for _, name := range g.order {
+		st := g.types[name]
+		fmt.Fprintf(&out, "\t_ = [1]struct{}{}[unsafe.Sizeof(%s{})-%d]\n", GoName(name, opts.Names), st.Size)
+	}
+	out.WriteString(")\n")
+
+	if opts.Checks != "" {
+		fmt.Fprintf(&out, "\n// %s pairs every struct above with its C struct, validated\n", opts.Checks)
+		out.WriteString("// against the BTF of the loaded object\n")
+		fmt.Fprintf(&out, "var %s = []layout.Check{\n", opts.Checks)
+		for _, name := range g.order {
+			fmt.Fprintf(&out, "\t{CType: %q, Value: %s{}},\n", name, GoName(name, opts.Names))
+		}
+		out.WriteString("}\n")
+	}
+
+	src, err := format.Source(out.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("format generated code: %w", err)
+	}
+	return src, nil
+}
+
+type generator struct {
+	opts  Options
+	types map[string]*btf.Struct
+	order []string
+}
+
+// add registers st and every named struct it embeds, dependencies first.
+func (g *generator) add(st *btf.Struct) {
+	if _, ok := g.types[st.Name]; ok {
+		return
+	}
+	g.types[st.Name] = st
+	for _, m := range st.Members {
+		if nested := nestedStruct(m.Type); nested != nil && nested.Name != "" {
+			g.add(nested)
+		}
+	}
+	g.order = append(g.order, st.Name)
+}
+
+func nestedStruct(typ btf.Type) *btf.Struct {
+	switch t := btf.UnderlyingType(typ).(type) {
+	case *btf.Struct:
+		return t
+	case *btf.Array:
+		return nestedStruct(t.Type)
+	}
+	return nil
+}
+
+func (g *generator) writeStruct(out *bytes.Buffer, st *btf.Struct) error {
+	goName := GoName(st.Name, g.opts.Names)
+	fmt.Fprintf(out, "// %s mirrors struct %s (%d bytes).\n", goName, st.Name, st.Size)
+	fmt.Fprintf(out, "type %s struct {\n", goName)
+
+	var offset uint32
+	for _, m := range st.Members {
+		if m.BitfieldSize > 0 {
+			return fmt.Errorf("struct %s: bitfield %s is not supported", st.Name, m.Name)
+		}
+		memberOffset := m.Offset.Bytes()
+		if memberOffset > offset {
+			fmt.Fprintf(out, "\t_ [%d]byte\n", memberOffset-offset)
+		}
+
+		goType, err := g.goType(m.Type)
+		if err != nil {
+			return fmt.Errorf("struct %s field %s: %w", st.Name, m.Name, err)
+		}
+		size, err := btf.Sizeof(m.Type)
+		if err != nil {
+			return fmt.Errorf("struct %s field %s: %w", st.Name, m.Name, err)
+		}
+
+		name := GoName(m.Name, g.opts.Names)
+		if m.Name == "" {
+			name = "_"
+		}
+		fmt.Fprintf(out, "\t%s %s\n", name, goType)
+		offset = memberOffset + uint32(size)
+	}
+	if st.Size > offset {
+		fmt.Fprintf(out, "\t_ [%d]byte\n", st.Size-offset)
+	}
+	out.WriteString("}\n\n")
+	return nil
+}
+
+func (g *generator) goType(typ btf.Type) (string, error) {
+	switch t := btf.UnderlyingType(typ).(type) {
+	case *btf.Int:
+		return intType(t)
+	case *btf.Enum:
+		return fmt.Sprintf("uint%d", t.Size*8), nil
+	case *btf.Pointer:
+		return "uint64", nil
+	case *btf.Array:
+		if elem, ok := btf.UnderlyingType(t.Type).(*btf.Int); ok && elem.Size == 1 {
+			return fmt.Sprintf("[%d]byte", t.Nelems), nil
+		}
+		elem, err := g.goType(t.Type)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("[%d]%s", t.Nelems, elem), nil
+	case *btf.Struct:
+		if t.Name == "" {
+			return "", fmt.Errorf("anonymous structs are not supported")
+		}
+		return GoName(t.Name, g.opts.Names), nil
+	default:
+		return "", fmt.Errorf("unsupported BTF type %s", typ)
+	}
+}
+
+func intType(t *btf.Int) (string, error) {
+	switch t.Size {
+	case 1, 2, 4, 8:
+	default:
+		return "", fmt.Errorf("unsupported integer size %d", t.Size)
+	}
+	if t.Encoding == btf.Bool {
+		return "bool", nil
+	}
+	if t.Encoding == btf.Signed {
+		return fmt.Sprintf("int%d", t.Size*8), nil
+	}
+	return fmt.Sprintf("uint%d", t.Size*8), nil
+}
+
+// ParseNames parses "c_name=GoName" pairs separated by commas.
+func ParseNames(s string) (map[string]string, error) {
+	names := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		cname, goName, ok := strings.Cut(pair, "=")
+		if !ok || cname == "" || goName == "" {
+			return nil, fmt.Errorf("invalid name mapping %q (want c_name=GoName)", pair)
+		}
+		names[cname] = goName
+	}
+	return names, nil
+}
@@ -0,0 +1,119 @@
+// Package clock turns the kernel's monotonic event timestamps into wall
+// clock time. BPF programs stamp events with bpf_ktime_get_ns, the
+// CLOCK_MONOTONIC nanoseconds since boot, which neither NTP steps nor
+// leap seconds move and which stands still while the host is suspended.
+// The wall clock does move, so the offset between the two measured at
+// startup drifts over a multi-day run. A Clock measures the offset again
+// every Recalibrate and converts with the latest one, so exported events
+// line up with logs stamped by the wall clock at the time.
+package clock
+
+import (
+	"sync"
+	"time"
+
+	"probepilot/pkg/query"
+)
+
+// Recalibrate is how often a Clock measures the offset again.
+const Recalibrate = 30 * time.Second
+
+// samples is how many readings a calibration takes; the one read in the
+// shortest window, least disturbed by preemption, wins.
+const samples = 5
+
+// Clock converts monotonic timestamps to wall clock time. It is safe for
+// concurrent use.
+type Clock struct {
+	mu           sync.Mutex
+	offset       int64 // wall clock minus monotonic, in ns
+	initial      int64
+	calibrated   time.Time
+	calibrations uint64
+	maxStep      time.Duration
+}
+
+// New returns a calibrated Clock.
+func New() *Clock {
+	c := &Clock{}
+	c.offset = measure()
+	c.initial = c.offset
+	c.calibrated = time.Now()
+	c.calibrations = 1
+	return c
+}
+
+// measure reads both clocks and returns their offset.
+func measure() int64 {
+	var best, window int64 = 0, -1
+	for i := 0; i < samples; i++ {
+		before := realtime()
+		mono := monotonic()
+		after := realtime()
+		if w := after - before; window < 0 || w < window {
+			best, window = before+w/2-mono, w
+		}
+	}
+	return best
+}
+
+// Calibrate measures the offset again and returns how far it moved.
+func (c *Clock) Calibrate() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calibrate()
+}
+
+func (c *Clock) calibrate() time.Duration {
+	offset := measure()
+	step := time.Duration(offset - c.offset)
+	c.offset = offset
+	c.calibrated = time.Now()
+	c.calibrations++
+	if abs(step) > abs(c.maxStep) {
+		c.maxStep = step
+	}
+	return step
+}
+
+// Wall returns the wall clock time of a monotonic timestamp in ns,
+// recalibrating first if the offset is older than Recalibrate. A nil Clock
+// returns the current time.
+func (c *Clock) Wall(mono uint64) time.Time {
+	if c == nil {
+		return time.Now()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.calibrated) >= Recalibrate {
+		c.calibrate()
+	}
+	return time.Unix(0, int64(mono)+c.offset)
+}
+
+// Now returns the current monotonic timestamp in ns, as BPF would stamp
+// an event now.
+func Now() uint64 {
+	return uint64(monotonic())
+}
+
+// Samples exports the calibrations to the local query API.
+func (c *Clock) Samples() []query.Sample {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return []query.Sample{
+		{Name: "clock_calibrations_total", Value: float64(c.calibrations)},
+		{Name: "clock_drift_seconds", Value: time.Duration(c.offset - c.initial).Seconds()},
+		{Name: "clock_step_max_seconds", Value: c.maxStep.Seconds()},
+	}
+}
+
+func abs(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
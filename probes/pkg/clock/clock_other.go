@@ -0,0 +1,13 @@
+//go:build !linux
+
+package clock
+
+import "time"
+
+// start anchors monotonic readings where the kernel's are unavailable;
+// timestamps then count from process start instead of boot.
+var start = time.Now()
+
+func monotonic() int64 { return int64(time.Since(start)) }
+
+func realtime() int64 { return time.Now().UnixNano() }
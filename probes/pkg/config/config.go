@@ -0,0 +1,488 @@
+// Package config reads probepilot.yaml, one file configuring every agent,
+// and environment overrides of it. Each probe has a section of settings
+// named after the agent's flags, with "_" or "-" between words, which may
+// be grouped, e.g. under filters or exporters, for readability:
+//
+//	schema: config/1.0
+//	defaults:
+//	  profile: balanced
+//	  report_interval: 30s
+//	  exporters:
+//	    otlp_metrics: http://otel-collector:4318
+//	probes:
+//	  memory:
+//	    filters:
+//	      pids: [1234, 5678]
+//	      comms: [java]
+//	  cpu:
+//	    enabled: false
+//	  tcpflow:
+//	    sampling_rate: 100
+//	    filters:
+//	      ports: [80, 443]
+//	      cgroups: [/kubepods.slice]
+//	plugins:
+//	  dns:
+//	    listen: 127.0.0.1:9470
+//
+// Settings under defaults apply to the agents that have the flag; a
+// probe's section must only name flags of its agent. Probe plugins have
+// their sections under plugins, named as the plugin names itself. enabled, true unless
+// set, chooses the probes probepilot run starts. Lists become
+// comma-separated flag values, and comms and cgroups stand for -comm and
+// -cgroup-path.
+//
+// A flag's value is taken, last one winning, from defaults, the probe's
+// section, $PROBEPILOT_<FLAG>, $PROBEPILOT_<PROBE>_<FLAG> and the command
+// line, e.g. PROBEPILOT_TCPFLOW_SAMPLING_RATE=10. The file is given by
+// -config or $PROBEPILOT_CONFIG. Errors name the offending key or
+// variable, e.g. "probepilot.yaml:12: probes.cpu.sampling_rate: unknown
+// setting (cpu has no -sampling-rate flag)".
+//
+// With -config-url, or $PROBEPILOT_CONFIG_URL, agents fetch the file from
+// a central endpoint instead, verifying its Ed25519 signature with
+// -config-key, and fetch it again every -config-poll; an agent whose
+// settings changed restarts itself in place to apply them. Unreachable,
+// they use the last file fetched, cached under -config-cache, and then
+// -config. A fleet file versions itself under the signature, so an old
+// one cannot be served again:
+//
+//	fleet:
+//	  serial: 42
+//	  not_after: 2026-12-01T00:00:00Z
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"probepilot/pkg/schema"
+)
+
+// Env names the variable giving the configuration file when there is no
+// -config flag.
+const Env = "PROBEPILOT_CONFIG"
+
+// envPrefix starts the names of variables overriding settings.
+const envPrefix = "PROBEPILOT_"
+
+// Probes are the sections of a configuration file, named as probepilot
+// run names the probes.
+var Probes = []string{"memory", "cpu", "tcpflow"}
+
+// aliases map setting names onto flags of another name.
+var aliases = map[string]string{
+	"comms":   "comm",
+	"cgroups": "cgroup-path",
+}
+
+// Setting is one value of the file for a flag.
+type Setting struct {
+	// Key is the setting's path, e.g. probes.memory.filters.pids.
+	Key  string
+	Line int
+	// Flag is the flag the setting is for.
+	Flag  string
+	Value string
+}
+
+// File is a parsed configuration file.
+type File struct {
+	Path     string
+	Schema   string
+	Defaults []Setting
+	// Sections holds the settings of each probe with a section.
+	Sections map[string][]Setting
+	// Serial and NotAfter version a fleet file, under fleet: agents
+	// reject a file with a lower serial than the last they applied, or
+	// past NotAfter. They are zero if the file has no fleet key.
+	Serial   uint64
+	NotAfter time.Time
+
+	disabled map[string]bool
+}
+
+// ReadFile reads and validates the configuration file at path.
+func ReadFile(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parse(path, data)
+}
+
+// parse reads and validates a configuration file read from path, a file
+// or a URL, which errors start with.
+func parse(path string, data []byte) (*File, error) {
+	root, err := parseYAML(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%v", path, err)
+	}
+	f := &File{Path: path, Sections: make(map[string][]Setting), disabled: make(map[string]bool)}
+	if err := f.decode(root); err != nil {
+		return nil, fmt.Errorf("%s:%v", path, err)
+	}
+	return f, nil
+}
+
+// keyError is an error about the key of a line; like the parser's errors
+// it starts with the line number, to follow the file name.
+func keyError(line int, key, format string, args ...any) error {
+	return fmt.Errorf("%d: %s: %s", line, key, fmt.Sprintf(format, args...))
+}
+
+func (f *File) decode(root *node) error {
+	for _, key := range root.keys {
+		n := root.items[key]
+		switch key {
+		case "schema":
+			if n.kind != scalarNode {
+				return keyError(n.line, key, "want a value, e.g. %s", schema.Tag(schema.Config))
+			}
+			if err := schema.Check(schema.Config, n.value); err != nil {
+				return keyError(n.line, key, "%v", err)
+			}
+			f.Schema = n.value
+		case "defaults":
+			if n.kind != mapNode {
+				return keyError(n.line, key, "want a mapping of settings")
+			}
+			settings, err := flatten(key, n)
+			if err != nil {
+				return err
+			}
+			for _, s := range settings {
+				if s.Key == "defaults.enabled" {
+					return keyError(s.Line, s.Key, "belongs in a probe's section")
+				}
+			}
+			f.Defaults = settings
+		case "probes":
+			if n.kind != mapNode {
+				return keyError(n.line, key, "want a section per probe: %s", strings.Join(Probes, ", "))
+			}
+			if err := f.decodeProbes(key, n); err != nil {
+				return err
+			}
+		case "plugins":
+			if n.kind != mapNode {
+				return keyError(n.line, key, "want a section per probe plugin")
+			}
+			if err := f.decodeProbes(key, n); err != nil {
+				return err
+			}
+		case "fleet":
+			if err := f.decodeFleet(key, n); err != nil {
+				return err
+			}
+		default:
+			return keyError(n.line, key, "unknown key (want schema, defaults, probes, plugins or fleet)")
+		}
+	}
+	return nil
+}
+
+// decodeFleet reads the serial and expiry of a fleet file.
+func (f *File) decodeFleet(prefix string, n *node) error {
+	if n.kind != mapNode {
+		return keyError(n.line, prefix, "want serial and not_after")
+	}
+	for _, name := range n.keys {
+		item, key := n.items[name], prefix+"."+name
+		if item.kind != scalarNode {
+			return keyError(item.line, key, "want a value")
+		}
+		var err error
+		switch name {
+		case "serial":
+			if f.Serial, err = strconv.ParseUint(item.value, 10, 64); err != nil || f.Serial == 0 {
+				return keyError(item.line, key, "want a positive integer, not %q", item.value)
+			}
+		case "not_after":
+			if f.NotAfter, err = time.Parse(time.RFC3339, item.value); err != nil {
+				return keyError(item.line, key, "want an RFC 3339 time, e.g. 2026-12-01T00:00:00Z, not %q", item.value)
+			}
+		default:
+			return keyError(item.line, key, "unknown key (want serial or not_after)")
+		}
+	}
+	if f.Serial == 0 || f.NotAfter.IsZero() {
+		return keyError(n.line, prefix, "want both serial and not_after")
+	}
+	return nil
+}
+
+// decodeProbes reads the sections of the built-in probes, or of plugins,
+// whose names only the plugins know.
+func (f *File) decodeProbes(prefix string, n *node) error {
+	for _, probe := range n.keys {
+		section := n.items[probe]
+		key := prefix + "." + probe
+		if prefix == "probes" && !known(probe) {
+			return keyError(section.line, key, "unknown probe (want one of %s)", strings.Join(Probes, ", "))
+		}
+		if prefix == "plugins" && known(probe) {
+			return keyError(section.line, key, "belongs under probes")
+		}
+		if section.kind == scalarNode && section.value == "" {
+			f.Sections[probe] = nil
+			continue
+		}
+		if section.kind != mapNode {
+			return keyError(section.line, key, "want a mapping of settings")
+		}
+		settings, err := flatten(key, section)
+		if err != nil {
+			return err
+		}
+		var kept []Setting
+		for _, s := range settings {
+			if s.Key != key+".enabled" {
+				kept = append(kept, s)
+				continue
+			}
+			switch s.Value {
+			case "true", "yes", "on":
+			case "false", "no", "off":
+				f.disabled[probe] = true
+			default:
+				return keyError(s.Line, s.Key, "invalid value %q (want true or false)", s.Value)
+			}
+		}
+		f.Sections[probe] = kept
+	}
+	return nil
+}
+
+func known(probe string) bool {
+	for _, p := range Probes {
+		if p == probe {
+			return true
+		}
+	}
+	return false
+}
+
+// flatten lists the settings of a mapping, descending into groups.
+func flatten(prefix string, n *node) ([]Setting, error) {
+	var settings []Setting
+	for _, name := range n.keys {
+		child := n.items[name]
+		key := prefix + "." + name
+		if flagName(name) == "config" || fleetFlag(flagName(name)) {
+			return nil, keyError(child.line, key, "a configuration file cannot name another")
+		}
+		switch child.kind {
+		case mapNode:
+			nested, err := flatten(key, child)
+			if err != nil {
+				return nil, err
+			}
+			settings = append(settings, nested...)
+		case listNode:
+			values := make([]string, len(child.list))
+			for i, item := range child.list {
+				values[i] = item.value
+			}
+			settings = append(settings, Setting{Key: key, Line: child.line, Flag: flagName(name), Value: strings.Join(values, ",")})
+		default:
+			settings = append(settings, Setting{Key: key, Line: child.line, Flag: flagName(name), Value: child.value})
+		}
+	}
+	return settings, nil
+}
+
+func flagName(name string) string {
+	name = strings.ReplaceAll(name, "_", "-")
+	if alias, ok := aliases[name]; ok {
+		return alias
+	}
+	return name
+}
+
+// Enabled reports whether probepilot run should start probe: the file
+// has its section and does not disable it. A file without sections
+// enables every probe.
+func (f *File) Enabled(probe string) bool {
+	if len(f.Sections) == 0 {
+		return true
+	}
+	_, ok := f.Sections[probe]
+	return ok && !f.disabled[probe]
+}
+
+// Settings are the file and environment settings of one probe's agent.
+// A nil File stands for no configuration file.
+type Settings struct {
+	File  *File
+	Probe string
+
+	// path is the local configuration file
+	path string
+	// fleet, if set, fetches File from a central endpoint
+	fleet   *Fleet
+	fs      *flag.FlagSet
+	restart atomic.Bool
+}
+
+// Load reads the configuration file that args, via -config, or the
+// environment name, for probe, one of Probes or a plugin. With neither, only the
+// environment configures the agent. With -config-url, the file is fetched
+// from there instead, falling back to the last one fetched and then to
+// -config.
+func Load(args []string, probe string) (*Settings, error) {
+	path, err := selected(args, "config", Env)
+	if err != nil {
+		return nil, err
+	}
+	s := &Settings{Probe: probe, path: path}
+	if s.fleet, err = newFleet(args, probe); err != nil {
+		return nil, err
+	}
+	if s.fleet != nil {
+		if s.File = s.fleet.load(); s.File != nil {
+			return s, nil
+		}
+	}
+	if path == "" {
+		return s, nil
+	}
+	if s.File, err = ReadFile(path); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// selected scans args for -<name>/--<name> ahead of flag parsing, as
+// profile.Selected does for -profile, falling back to $<env>.
+func selected(args []string, name, env string) (string, error) {
+	path := os.Getenv(env)
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			break
+		}
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		key, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if key != name {
+			continue
+		}
+		if !hasValue {
+			if i+1 >= len(args) {
+				return "", fmt.Errorf("flag needs an argument: -%s", name)
+			}
+			i++
+			value = args[i]
+		}
+		path = value
+	}
+	return path, nil
+}
+
+// Path is the local configuration file, or "" if there is none.
+func (s *Settings) Path() string {
+	return s.path
+}
+
+// settings lists the file's settings for the probe, defaults first.
+func (s *Settings) settings() []Setting {
+	if s.File == nil {
+		return nil
+	}
+	return append(append([]Setting(nil), s.File.Defaults...), s.File.Sections[s.Probe]...)
+}
+
+// Lookup returns the value the file and environment give flag name,
+// without the command line.
+func (s *Settings) Lookup(name string) (string, bool) {
+	value, found := "", false
+	for _, set := range s.settings() {
+		if set.Flag == name {
+			value, found = set.Value, true
+		}
+	}
+	for _, env := range s.envNames(name) {
+		if v, ok := os.LookupEnv(env); ok {
+			value, found = v, true
+		}
+	}
+	return value, found
+}
+
+// Args returns args preceded by the -profile the file or environment
+// selects, so profile.Selected picks it up and a -profile in args still
+// wins.
+func (s *Settings) Args(args []string) []string {
+	if name, ok := s.Lookup("profile"); ok {
+		return append([]string{"-profile=" + name}, args...)
+	}
+	return args
+}
+
+// envNames are the variables overriding flag name, the probe's last.
+func (s *Settings) envNames(name string) []string {
+	suffix := strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+	return []string{envPrefix + suffix, envPrefix + strings.ToUpper(s.Probe) + "_" + suffix}
+}
+
+// Apply sets the flags of fs from the file and environment. Call it after
+// defining the flags and before parsing the command line, which then
+// overrides them. Settings of the probe's section for flags fs lacks are
+// errors; defaults are skipped by agents without the flag.
+func (s *Settings) Apply(fs *flag.FlagSet) error {
+	s.fs = fs
+	for _, set := range s.settings() {
+		f := fs.Lookup(set.Flag)
+		if f == nil {
+			if strings.HasPrefix(set.Key, "defaults.") {
+				continue
+			}
+			return fmt.Errorf("%s:%d: %s: unknown setting (%s has no -%s flag)", s.File.Path, set.Line, set.Key, s.Probe, set.Flag)
+		}
+		if err := fs.Set(set.Flag, set.Value); err != nil {
+			return fmt.Errorf("%s:%d: %s: invalid value %q for -%s: %v", s.File.Path, set.Line, set.Key, set.Value, set.Flag, err)
+		}
+	}
+
+	// Variables of flags the agent lacks may be meant for other agents
+	var err error
+	var names []string
+	fs.VisitAll(func(f *flag.Flag) { names = append(names, f.Name) })
+	sort.Strings(names)
+	for _, name := range names {
+		if name == "config" || fleetFlag(name) {
+			continue
+		}
+		for _, env := range s.envNames(name) {
+			value, ok := os.LookupEnv(env)
+			if !ok || err != nil {
+				continue
+			}
+			if e := fs.Set(name, value); e != nil {
+				err = fmt.Errorf("$%s: invalid value %q for -%s: %v", env, value, name, e)
+			}
+		}
+	}
+	return err
+}
+
+// String summarises where the settings come from, e.g.
+// "/etc/probepilot.yaml (4 settings)".
+func (s *Settings) String() string {
+	desc := "flags and environment only"
+	if s.File != nil {
+		desc = fmt.Sprintf("%s (%d settings)", s.File.Path, len(s.settings()))
+	}
+	if s.fleet != nil && s.fleet.Poll > 0 {
+		desc += fmt.Sprintf(", polling %s every %v", s.fleet.URL, s.fleet.Poll)
+	}
+	return desc
+}
@@ -0,0 +1,418 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"probepilot/pkg/platform"
+)
+
+// Variables naming the fleet settings when there are no flags.
+const (
+	URLEnv   = "PROBEPILOT_CONFIG_URL"
+	KeyEnv   = "PROBEPILOT_CONFIG_KEY"
+	CacheEnv = "PROBEPILOT_CONFIG_CACHE"
+	PollEnv  = "PROBEPILOT_CONFIG_POLL"
+)
+
+// DefaultCacheDir keeps the last fleet configuration each agent fetched.
+const DefaultCacheDir = "/var/lib/probepilot/fleet"
+
+// DefaultPoll is how often agents fetch the fleet configuration again.
+const DefaultPoll = time.Minute
+
+const (
+	// fetchTimeout bounds fetching the file and its signature
+	fetchTimeout = 10 * time.Second
+	// maxFetched bounds a fetched file
+	maxFetched = 1 << 20
+)
+
+// fleetFlags configure the fleet configuration, scanned ahead of flag
+// parsing as -config is; a configuration file cannot set them.
+var fleetFlags = map[string]string{
+	"config-url":   URLEnv,
+	"config-key":   KeyEnv,
+	"config-cache": CacheEnv,
+	"config-poll":  PollEnv,
+}
+
+func fleetFlag(name string) bool {
+	_, ok := fleetFlags[name]
+	return ok
+}
+
+// Fleet fetches the configuration file from a central endpoint, so that
+// changing one file rolls settings out to every agent. The file is signed
+// with Ed25519: URL+".sig" holds the base64 signature of its bytes, e.g.
+// made with
+//
+//	openssl pkeyutl -sign -rawin -inkey fleet.pem -in probepilot.yaml | base64 -w0 > probepilot.yaml.sig
+//
+// and files whose signature Key does not verify are rejected. The
+// signature says nothing of when a file was made, so the file carries its
+// own serial and expiry under fleet: a file past its fleet.not_after, or
+// with a lower fleet.serial than the one applied or cached, is rejected
+// too, and an old signed file cannot be served again to roll agents back.
+type Fleet struct {
+	URL string
+	Key ed25519.PublicKey
+	// Cache keeps the last file fetched, and Cache+".sig" its signature,
+	// for when URL cannot be reached.
+	Cache string
+	// Poll is how often Watch fetches the file again, 0 for never.
+	Poll time.Duration
+
+	client *http.Client
+	// digest is that of the settings in use, and rejected that of the
+	// last file Watch rejected, so it warns once
+	digest   string
+	rejected [sha256.Size]byte
+	// serial is that of the file applied, or else cached; older files
+	// are rejected
+	serial uint64
+}
+
+// newFleet reads the fleet settings of args and the environment, or
+// returns nil without -config-url.
+func newFleet(args []string, probe string) (*Fleet, error) {
+	values := make(map[string]string, len(fleetFlags))
+	for name, env := range fleetFlags {
+		v, err := selected(args, name, env)
+		if err != nil {
+			return nil, err
+		}
+		values[name] = v
+	}
+	if values["config-url"] == "" {
+		return nil, nil
+	}
+	fl := &Fleet{
+		URL:    values["config-url"],
+		Cache:  filepath.Join(DefaultCacheDir, probe+".yaml"),
+		Poll:   DefaultPoll,
+		client: &http.Client{Timeout: fetchTimeout},
+	}
+	if !strings.HasPrefix(fl.URL, "http://") && !strings.HasPrefix(fl.URL, "https://") {
+		return nil, fmt.Errorf("invalid -config-url %q (want an http or https URL)", fl.URL)
+	}
+	if values["config-key"] == "" {
+		return nil, errors.New("-config-url needs -config-key, the public key its files are signed with")
+	}
+	key, err := readKey(values["config-key"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid -config-key: %v", err)
+	}
+	fl.Key = key
+	if v := values["config-cache"]; v != "" {
+		fl.Cache = v
+	}
+	if v := values["config-poll"]; v != "" {
+		if fl.Poll, err = time.ParseDuration(v); err != nil || fl.Poll < 0 {
+			return nil, fmt.Errorf("invalid -config-poll %q (want a duration, 0 to fetch once)", v)
+		}
+	}
+	return fl, nil
+}
+
+// readKey reads an Ed25519 public key in PEM, as openssl pkey -pubout
+// writes it.
+func readKey(path string) (ed25519.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("%s: want a PEM public key", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	ed, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: want an Ed25519 key, not %T", path, key)
+	}
+	return ed, nil
+}
+
+// RegisterFleetFlags defines the fleet flags on fs, with the values Load
+// found, so the command line parses.
+func (s *Settings) RegisterFleetFlags(fs *flag.FlagSet) {
+	var fl Fleet
+	if s.fleet != nil {
+		fl = *s.fleet
+	}
+	fs.String("config-url", fl.URL,
+		"http(s) URL to fetch the YAML configuration from, signed, instead of -config, which it falls back to with the last file fetched (default $"+URLEnv+")")
+	fs.String("config-key", "",
+		"PEM file of the Ed25519 public key -config-url files are signed with (default $"+KeyEnv+")")
+	fs.String("config-cache", fl.Cache,
+		"file keeping the last -config-url file fetched, for when it cannot be reached (default "+DefaultCacheDir+"/<probe>.yaml or $"+CacheEnv+")")
+	fs.Duration("config-poll", fl.Poll,
+		"how often to fetch -config-url again, restarting the agent when its settings change; 0 fetches once (default $"+PollEnv+" or "+DefaultPoll.String()+")")
+}
+
+// load fetches the file, or else reads the one cached, returning nil, with
+// a warning, for the local file to be used instead.
+func (fl *Fleet) load() *File {
+	// The cached file, even expired, is as old as fetched files may be
+	if data, sig, err := fl.readCache(); err == nil {
+		if f, err := fl.verify(fl.Cache, data, sig); err == nil {
+			fl.serial = f.Serial
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+	defer cancel()
+	data, sig, err := fl.fetch(ctx)
+	if err == nil {
+		var f *File
+		if f, err = fl.open(fl.URL, data, sig); err == nil {
+			fl.save(data, sig)
+			fl.serial = f.Serial
+			return f
+		}
+	}
+	if fl.Cache == "" {
+		log.Printf("Warning: fleet configuration: %v; using the local configuration", err)
+		return nil
+	}
+	f, cacheErr := fl.openCache()
+	if cacheErr != nil {
+		log.Printf("Warning: fleet configuration: %v; no cached copy either (%v), using the local configuration", err, cacheErr)
+		return nil
+	}
+	log.Printf("Warning: fleet configuration: %v; using the copy cached in %s", err, fl.Cache)
+	fl.serial = f.Serial
+	return f
+}
+
+// fetch gets the file and its signature.
+func (fl *Fleet) fetch(ctx context.Context) (data, sig []byte, err error) {
+	if data, err = fl.get(ctx, fl.URL); err != nil {
+		return nil, nil, err
+	}
+	if sig, err = fl.get(ctx, fl.URL+".sig"); err != nil {
+		return nil, nil, err
+	}
+	return data, sig, nil
+}
+
+func (fl *Fleet) get(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := fl.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxFetched+1))
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s: %w", url, err)
+	}
+	if len(data) > maxFetched {
+		return nil, fmt.Errorf("fetching %s: larger than %d bytes", url, maxFetched)
+	}
+	return data, nil
+}
+
+// open verifies the signature of a file read from path, parses it and
+// checks it is current: signed with a serial no older than the one
+// applied, and not expired.
+func (fl *Fleet) open(path string, data, sig []byte) (*File, error) {
+	f, err := fl.verify(path, data, sig)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case f.Serial == 0:
+		return nil, fmt.Errorf("%s: no fleet.serial and fleet.not_after, which signed files must carry", path)
+	case time.Now().After(f.NotAfter):
+		return nil, fmt.Errorf("%s: expired at %s (fleet.not_after)", path, f.NotAfter.Format(time.RFC3339))
+	case f.Serial < fl.serial:
+		return nil, fmt.Errorf("%s: fleet.serial %d is older than %d, already applied", path, f.Serial, fl.serial)
+	}
+	return f, nil
+}
+
+// verify verifies the signature of a file read from path and parses it.
+func (fl *Fleet) verify(path string, data, sig []byte) (*File, error) {
+	raw, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(sig)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid signature: %v", path, err)
+	}
+	if !ed25519.Verify(fl.Key, data, raw) {
+		return nil, fmt.Errorf("%s: signature does not match -config-key", path)
+	}
+	return parse(path, data)
+}
+
+// save caches a verified file and its signature, each replaced at once;
+// a crash in between leaves a pair that fails to verify, which is
+// ignored.
+func (fl *Fleet) save(data, sig []byte) {
+	if fl.Cache == "" {
+		return
+	}
+	err := os.MkdirAll(filepath.Dir(fl.Cache), 0o755)
+	if err == nil {
+		err = writeFile(fl.Cache+".sig", sig)
+	}
+	if err == nil {
+		err = writeFile(fl.Cache, data)
+	}
+	if err != nil {
+		log.Printf("Warning: cannot cache the fleet configuration: %v", err)
+	}
+}
+
+// writeFile replaces path by renaming a temporary file onto it.
+func writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// readCache reads the cached file and its signature.
+func (fl *Fleet) readCache() (data, sig []byte, err error) {
+	if fl.Cache == "" {
+		return nil, nil, errors.New("no cache")
+	}
+	if data, err = os.ReadFile(fl.Cache); err != nil {
+		return nil, nil, err
+	}
+	if sig, err = os.ReadFile(fl.Cache + ".sig"); err != nil {
+		return nil, nil, err
+	}
+	return data, sig, nil
+}
+
+// openCache reads the cached file, verifying it again.
+func (fl *Fleet) openCache() (*File, error) {
+	data, sig, err := fl.readCache()
+	if err != nil {
+		return nil, err
+	}
+	return fl.open(fl.Cache, data, sig)
+}
+
+// digest identifies the settings f gives the agent's flags, so that
+// changes to other probes' settings, or to comments, restart nothing.
+func (s *Settings) digest(f *File) string {
+	var b strings.Builder
+	for _, set := range (&Settings{File: f, Probe: s.Probe}).settings() {
+		if s.fs != nil && s.fs.Lookup(set.Flag) == nil {
+			continue
+		}
+		fmt.Fprintf(&b, "%s=%s\n", set.Flag, set.Value)
+	}
+	return b.String()
+}
+
+// check rejects files that name flags the agent lacks in its section,
+// which would stop it from starting again.
+func (s *Settings) check(f *File) error {
+	if s.fs == nil {
+		return nil
+	}
+	for _, set := range f.Sections[s.Probe] {
+		if s.fs.Lookup(set.Flag) == nil {
+			return fmt.Errorf("%s:%d: %s: unknown setting (%s has no -%s flag)", f.Path, set.Line, set.Key, s.Probe, set.Flag)
+		}
+	}
+	return nil
+}
+
+// Watch fetches the fleet configuration every -config-poll until ctx is
+// done. When the agent's settings change, it calls stop for the agent to
+// shut down, and Restart to start again with them. Files that do not
+// verify or parse are logged and ignored. Without -config-url, Watch
+// returns at once.
+func (s *Settings) Watch(ctx context.Context, stop func()) {
+	fl := s.fleet
+	if fl == nil || fl.Poll <= 0 {
+		return
+	}
+	if s.File != nil {
+		fl.digest = s.digest(s.File)
+	}
+	for {
+		// Jitter spreads the fetches of a fleet started at once
+		wait := fl.Poll + time.Duration(rand.Int63n(int64(fl.Poll)/10+1))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		data, sig, err := fl.fetch(ctx)
+		if err != nil {
+			log.Printf("Warning: fleet configuration: %v", err)
+			continue
+		}
+		// A file is rejected with its signature, which may be updated after it
+		sum := sha256.Sum256(append(append([]byte(nil), data...), sig...))
+		if sum == fl.rejected {
+			continue
+		}
+		f, err := fl.open(fl.URL, data, sig)
+		if err == nil {
+			err = s.check(f)
+		}
+		if err != nil {
+			fl.rejected = sum
+			log.Printf("Warning: fleet configuration rejected, keeping the current one: %v", err)
+			continue
+		}
+		if s.digest(f) == fl.digest {
+			// A newer file is cached all the same, raising the serial
+			// a replay must reach
+			if f.Serial > fl.serial {
+				fl.save(data, sig)
+				fl.serial = f.Serial
+			}
+			continue
+		}
+		fl.save(data, sig)
+		fl.serial = f.Serial
+		log.Printf("Fleet configuration changed at %s, restarting to apply it", fl.URL)
+		s.restart.Store(true)
+		stop()
+		return
+	}
+}
+
+// Restart starts the agent again, with the same arguments and
+// environment, if Watch stopped it. Agents defer it first, so it runs
+// after every other deferred cleanup.
+func (s *Settings) Restart() {
+	if !s.restart.Load() {
+		return
+	}
+	if err := platform.Reexec(); err != nil {
+		log.Printf("Warning: cannot restart for the new fleet configuration: %v", err)
+	}
+}
@@ -0,0 +1,241 @@
+package config
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fleetServer serves a signed fleet file and its signature, or 503 when
+// it has none
+type fleetServer struct {
+	mu        sync.Mutex
+	data, sig []byte
+}
+
+func (s *fleetServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data == nil {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, ".sig") {
+		w.Write(s.sig)
+		return
+	}
+	w.Write(s.data)
+}
+
+func (s *fleetServer) serve(data, sig []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data, s.sig = data, sig
+}
+
+// fleetFile is a fleet file of the given serial and expiry setting the
+// memory tracker's report interval to interval
+func fleetFile(serial uint64, notAfter time.Time, interval string) []byte {
+	return []byte(fmt.Sprintf("fleet:\n  serial: %d\n  not_after: %s\nprobes:\n  memory:\n    report_interval: %s\n",
+		serial, notAfter.UTC().Format(time.RFC3339), interval))
+}
+
+func sign(key ed25519.PrivateKey, data []byte) []byte {
+	return []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(key, data)) + "\n")
+}
+
+type fleetTest struct {
+	key    ed25519.PrivateKey
+	server *fleetServer
+	url    string
+	cache  string
+	client *http.Client
+}
+
+func newFleetTest(t *testing.T) *fleetTest {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fleetServer{}
+	srv := httptest.NewServer(server)
+	t.Cleanup(srv.Close)
+	return &fleetTest{
+		key:    key,
+		server: server,
+		url:    srv.URL + "/probepilot.yaml",
+		cache:  filepath.Join(t.TempDir(), "memory.yaml"),
+		client: srv.Client(),
+	}
+}
+
+// fleet is a Fleet as an agent starting afresh has it
+func (ft *fleetTest) fleet() *Fleet {
+	return &Fleet{
+		URL:    ft.url,
+		Key:    ft.key.Public().(ed25519.PublicKey),
+		Cache:  ft.cache,
+		client: ft.client,
+	}
+}
+
+// serve serves a file of serial, signed
+func (ft *fleetTest) serve(serial uint64, notAfter time.Time, interval string) {
+	data := fleetFile(serial, notAfter, interval)
+	ft.server.serve(data, sign(ft.key, data))
+}
+
+func interval(f *File) string {
+	if f == nil {
+		return ""
+	}
+	for _, set := range f.Sections["memory"] {
+		if set.Flag == "report-interval" {
+			return set.Value
+		}
+	}
+	return "?"
+}
+
+func TestFleetLoad(t *testing.T) {
+	ft := newFleetTest(t)
+	ft.serve(3, time.Now().Add(time.Hour), "10s")
+	fl := ft.fleet()
+	f := fl.load()
+	if got := interval(f); got != "10s" {
+		t.Fatalf("loaded report_interval %q, want 10s", got)
+	}
+	if fl.serial != 3 || f.Serial != 3 {
+		t.Errorf("serial = %d, file serial %d, want 3", fl.serial, f.Serial)
+	}
+	if _, err := os.Stat(ft.cache + ".sig"); err != nil {
+		t.Errorf("file not cached: %v", err)
+	}
+}
+
+func TestFleetRejectsReplay(t *testing.T) {
+	ft := newFleetTest(t)
+	notAfter := time.Now().Add(time.Hour)
+	ft.serve(5, notAfter, "5s")
+	fl := ft.fleet()
+	if got := interval(fl.load()); got != "5s" {
+		t.Fatalf("loaded report_interval %q, want 5s", got)
+	}
+
+	// An older file, though signed and current, does not replace it
+	old := fleetFile(4, notAfter, "4s")
+	if _, err := fl.open(ft.url, old, sign(ft.key, old)); err == nil || !strings.Contains(err.Error(), "older than 5") {
+		t.Errorf("opened serial 4 after 5: %v", err)
+	}
+
+	// Nor after a restart: the cached file raises the serial, and the
+	// agent keeps to it
+	ft.server.serve(old, sign(ft.key, old))
+	restarted := ft.fleet()
+	f := restarted.load()
+	if got := interval(f); got != "5s" {
+		t.Errorf("restarted agent loaded report_interval %q, want the cached 5s", got)
+	}
+	if restarted.serial != 5 {
+		t.Errorf("restarted agent at serial %d, want 5", restarted.serial)
+	}
+}
+
+func TestFleetAcceptsEqualSerial(t *testing.T) {
+	ft := newFleetTest(t)
+	notAfter := time.Now().Add(time.Hour)
+	ft.serve(7, notAfter, "7s")
+	fl := ft.fleet()
+	fl.load()
+
+	// Republishing a file under the same serial, e.g. with a new expiry,
+	// is not a replay
+	same := fleetFile(7, notAfter.Add(time.Hour), "7s")
+	f, err := fl.open(ft.url, same, sign(ft.key, same))
+	if err != nil {
+		t.Fatalf("rejected the same serial: %v", err)
+	}
+	if f.Serial != 7 {
+		t.Errorf("serial %d, want 7", f.Serial)
+	}
+
+	newer := fleetFile(8, notAfter, "8s")
+	if _, err := fl.open(ft.url, newer, sign(ft.key, newer)); err != nil {
+		t.Errorf("rejected a newer serial: %v", err)
+	}
+}
+
+func TestFleetExpired(t *testing.T) {
+	ft := newFleetTest(t)
+	ft.serve(2, time.Now().Add(-time.Minute), "2s")
+	if f := ft.fleet().load(); f != nil {
+		t.Errorf("loaded an expired file, report_interval %s", interval(f))
+	}
+
+	// An expired file in the cache is not fallen back to either
+	data := fleetFile(2, time.Now().Add(-time.Minute), "2s")
+	if err := os.WriteFile(ft.cache, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(ft.cache+".sig", sign(ft.key, data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ft.server.serve(nil, nil)
+	if f := ft.fleet().load(); f != nil {
+		t.Errorf("fell back to an expired cache, report_interval %s", interval(f))
+	}
+
+	// A cache still current is
+	data = fleetFile(2, time.Now().Add(time.Hour), "3s")
+	os.WriteFile(ft.cache, data, 0o644)
+	os.WriteFile(ft.cache+".sig", sign(ft.key, data), 0o644)
+	if got := interval(ft.fleet().load()); got != "3s" {
+		t.Errorf("fell back to report_interval %q, want the cached 3s", got)
+	}
+}
+
+func TestFleetRejectsUnsigned(t *testing.T) {
+	ft := newFleetTest(t)
+	_, other, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notAfter := time.Now().Add(time.Hour)
+	data := fleetFile(1, notAfter, "1s")
+	tampered := fleetFile(1, notAfter, "9s")
+	unversioned := []byte("probes:\n  memory:\n    report_interval: 1s\n")
+
+	tests := []struct {
+		name      string
+		data, sig []byte
+	}{
+		{"unsigned", data, nil},
+		{"not base64", data, []byte("not a signature")},
+		{"other key", data, sign(other, data)},
+		{"tampered", tampered, sign(ft.key, data)},
+		{"no serial", unversioned, sign(ft.key, unversioned)},
+	}
+	for _, tt := range tests {
+		fl := ft.fleet()
+		if _, err := fl.open(ft.url, tt.data, tt.sig); err == nil {
+			t.Errorf("%s: opened", tt.name)
+		}
+		ft.server.serve(tt.data, tt.sig)
+		if f := fl.load(); f != nil {
+			t.Errorf("%s: loaded report_interval %s", tt.name, interval(f))
+		}
+		if _, err := os.Stat(ft.cache); !os.IsNotExist(err) {
+			t.Errorf("%s: cached", tt.name)
+		}
+	}
+}
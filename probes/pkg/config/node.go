@@ -0,0 +1,65 @@
+package config
+
+import "fmt"
+
+// Node is a value of a YAML document in the subset configuration files
+// use, for the other files probepilot reads, e.g. generic probe specs.
+type Node struct {
+	n *node
+}
+
+// ParseYAML parses data into its root, a mapping. Errors start with the
+// line number, e.g. "3: duplicate key".
+func ParseYAML(data []byte) (Node, error) {
+	root, err := parseYAML(data)
+	if err != nil {
+		return Node{}, err
+	}
+	return Node{root}, nil
+}
+
+// Line is the line the value starts on.
+func (n Node) Line() int {
+	return n.n.line
+}
+
+// IsMap reports whether the value is a mapping.
+func (n Node) IsMap() bool {
+	return n.n.kind == mapNode
+}
+
+// IsList reports whether the value is a list.
+func (n Node) IsList() bool {
+	return n.n.kind == listNode
+}
+
+// Value is the value of a scalar, "" for mappings and lists.
+func (n Node) Value() string {
+	return n.n.value
+}
+
+// Keys are the keys of a mapping, in file order.
+func (n Node) Keys() []string {
+	return n.n.keys
+}
+
+// Get returns the value of key in a mapping.
+func (n Node) Get(key string) (Node, bool) {
+	child, ok := n.n.items[key]
+	return Node{child}, ok
+}
+
+// List returns the items of a list.
+func (n Node) List() []Node {
+	items := make([]Node, len(n.n.list))
+	for i, item := range n.n.list {
+		items[i] = Node{item}
+	}
+	return items
+}
+
+// Errorf returns an error about the value of key, starting with its line
+// number like the parser's errors.
+func (n Node) Errorf(key, format string, args ...any) error {
+	return keyError(n.n.line, key, "%s", fmt.Sprintf(format, args...))
+}
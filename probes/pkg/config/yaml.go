@@ -0,0 +1,288 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The subset of YAML configuration files use: block mappings, block and
+// flow ([a, b]) lists of values, plain and quoted scalars and comments.
+// Anchors, multi-line strings, flow mappings and multiple documents are
+// rejected rather than misread. It is parsed here to keep the agents free
+// of dependencies. Errors start with the line number, e.g. "3: duplicate
+// key".
+
+type nodeKind int
+
+const (
+	scalarNode nodeKind = iota
+	mapNode
+	listNode
+)
+
+type node struct {
+	kind  nodeKind
+	line  int
+	value string // scalarNode
+
+	keys  []string // mapNode, in file order
+	items map[string]*node
+	list  []*node // listNode
+}
+
+type yamlLine struct {
+	num    int
+	indent int
+	text   string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+// parseYAML parses data into a tree whose root is a mapping.
+func parseYAML(data []byte) (*node, error) {
+	lines, err := splitLines(string(data))
+	if err != nil {
+		return nil, err
+	}
+	p := &yamlParser{lines: lines}
+	if len(lines) == 0 {
+		return &node{kind: mapNode, line: 1, items: map[string]*node{}}, nil
+	}
+	if isListItem(lines[0].text) {
+		return nil, fmt.Errorf("%d: the file must be a mapping, not a list", lines[0].num)
+	}
+	root, err := p.mapping(lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, fmt.Errorf("%d: unexpected indentation", p.lines[p.pos].num)
+	}
+	return root, nil
+}
+
+// splitLines drops comments and blank lines and measures indentation.
+func splitLines(data string) ([]yamlLine, error) {
+	var lines []yamlLine
+	for i, raw := range strings.Split(data, "\n") {
+		num := i + 1
+		text := strings.TrimRight(stripComment(raw), " \t\r")
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("%d: tabs are not allowed in indentation", num)
+		}
+		if trimmed == "---" && len(lines) == 0 {
+			continue
+		}
+		if trimmed == "---" || trimmed == "..." {
+			return nil, fmt.Errorf("%d: only one document is supported", num)
+		}
+		switch trimmed[0] {
+		case '&', '*', '!', '|', '>', '{':
+			return nil, fmt.Errorf("%d: unsupported YAML syntax %q", num, trimmed[:1])
+		}
+		lines = append(lines, yamlLine{num: num, indent: len(text) - len(trimmed), text: trimmed})
+	}
+	return lines, nil
+}
+
+// stripComment cuts a # comment, one starting the line or preceded by
+// a space outside quotes.
+func stripComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t'):
+			return s[:i]
+		}
+	}
+	return s
+}
+
+func isListItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+func (p *yamlParser) mapping(indent int) (*node, error) {
+	n := &node{kind: mapNode, line: p.lines[p.pos].num, items: map[string]*node{}}
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent < indent {
+			break
+		}
+		if l.indent > indent {
+			return nil, fmt.Errorf("%d: unexpected indentation", l.num)
+		}
+		if isListItem(l.text) {
+			return nil, fmt.Errorf("%d: list item where a key was expected", l.num)
+		}
+		key, rest, ok := cutKey(l.text)
+		if !ok {
+			return nil, fmt.Errorf("%d: want key: value, got %q", l.num, l.text)
+		}
+		key, err := scalar(key, l.num)
+		if err != nil {
+			return nil, err
+		}
+		if _, dup := n.items[key]; dup {
+			return nil, fmt.Errorf("%d: duplicate key %q", l.num, key)
+		}
+		p.pos++
+
+		var child *node
+		switch {
+		case rest != "":
+			child, err = flowValue(rest, l.num)
+		case p.pos < len(p.lines) && p.lines[p.pos].indent > indent:
+			next := p.lines[p.pos]
+			if isListItem(next.text) {
+				child, err = p.listBlock(next.indent)
+			} else {
+				child, err = p.mapping(next.indent)
+			}
+		case p.pos < len(p.lines) && p.lines[p.pos].indent == indent && isListItem(p.lines[p.pos].text):
+			// A list may sit at its key's indentation
+			child, err = p.listBlock(indent)
+		default:
+			child = &node{kind: scalarNode, line: l.num}
+		}
+		if err != nil {
+			return nil, err
+		}
+		n.keys = append(n.keys, key)
+		n.items[key] = child
+	}
+	return n, nil
+}
+
+func (p *yamlParser) listBlock(indent int) (*node, error) {
+	n := &node{kind: listNode, line: p.lines[p.pos].num}
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent < indent || (l.indent == indent && !isListItem(l.text)) {
+			break
+		}
+		if l.indent > indent {
+			return nil, fmt.Errorf("%d: unexpected indentation", l.num)
+		}
+		rest := strings.TrimSpace(strings.TrimPrefix(l.text, "-"))
+		if _, _, isMap := cutKey(rest); isMap || rest == "" {
+			return nil, fmt.Errorf("%d: list items must be values", l.num)
+		}
+		item, err := flowValue(rest, l.num)
+		if err != nil {
+			return nil, err
+		}
+		n.list = append(n.list, item)
+		p.pos++
+	}
+	return n, nil
+}
+
+// cutKey splits "key: value" at the first colon outside quotes followed
+// by a space or the end of the line.
+func cutKey(text string) (key, rest string, ok bool) {
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ':' && (i+1 == len(text) || text[i+1] == ' '):
+			return strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+1:]), i > 0
+		}
+	}
+	return "", "", false
+}
+
+// flowValue parses a scalar or a flow list such as [80, 443].
+func flowValue(s string, line int) (*node, error) {
+	if strings.IndexByte("{&*!|>", s[0]) >= 0 {
+		return nil, fmt.Errorf("%d: unsupported YAML syntax %q", line, s[:1])
+	}
+	if !strings.HasPrefix(s, "[") {
+		v, err := scalar(s, line)
+		return &node{kind: scalarNode, line: line, value: v}, err
+	}
+	if !strings.HasSuffix(s, "]") {
+		return nil, fmt.Errorf("%d: unterminated list %q", line, s)
+	}
+	n := &node{kind: listNode, line: line}
+	inner := strings.TrimSpace(s[1 : len(s)-1])
+	if inner == "" {
+		return n, nil
+	}
+	var quote byte
+	start := 0
+	for i := 0; i <= len(inner); i++ {
+		if i < len(inner) {
+			c := inner[i]
+			switch {
+			case quote != 0:
+				if c == '\\' && quote == '"' {
+					i++
+				} else if c == quote {
+					quote = 0
+				}
+				continue
+			case c == '"' || c == '\'':
+				quote = c
+				continue
+			case c == '[' || c == '{':
+				return nil, fmt.Errorf("%d: nested lists and mappings are not supported", line)
+			case c != ',':
+				continue
+			}
+		}
+		v, err := scalar(strings.TrimSpace(inner[start:i]), line)
+		if err != nil {
+			return nil, err
+		}
+		n.list = append(n.list, &node{kind: scalarNode, line: line, value: v})
+		start = i + 1
+	}
+	return n, nil
+}
+
+// scalar unquotes a plain, 'single' or "double" quoted scalar.
+func scalar(s string, line int) (string, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("%d: invalid quoted string %s", line, s)
+		}
+		return v, nil
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return "", fmt.Errorf("%d: invalid quoted string %s", line, s)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	}
+	if s == "~" || s == "null" {
+		return "", nil
+	}
+	return s, nil
+}
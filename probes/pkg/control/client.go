@@ -0,0 +1,80 @@
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"probepilot/pkg/schema"
+)
+
+// Client is a connection to an agent's control socket.
+type Client struct {
+	conn    net.Conn
+	scanner *bufio.Scanner
+}
+
+// Dial connects to the control socket at path.
+func Dial(path string) (*Client, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	return &Client{conn: conn, scanner: scanner}, nil
+}
+
+// Send writes one request line.
+func (c *Client) Send(line string) error {
+	_, err := fmt.Fprintln(c.conn, line)
+	return err
+}
+
+// Receive reads the next reply.
+func (c *Client) Receive() (Response, error) {
+	var resp Response
+	if !c.scanner.Scan() {
+		if err := c.scanner.Err(); err != nil {
+			return resp, err
+		}
+		return resp, fmt.Errorf("agent closed the connection")
+	}
+	if err := json.Unmarshal(c.scanner.Bytes(), &resp); err != nil {
+		return resp, fmt.Errorf("invalid reply: %w", err)
+	}
+	return resp, nil
+}
+
+// Do sends a command and waits for its reply. It must not be used for
+// tail, which replies with a stream.
+func (c *Client) Do(line string) (Response, error) {
+	if err := c.Send(line); err != nil {
+		return Response{}, err
+	}
+	return c.Receive()
+}
+
+// Negotiate checks that the agent speaks a control protocol this client
+// understands. Agents that predate the version command speak 1.0.
+func (c *Client) Negotiate() error {
+	resp, err := c.Do("version")
+	if err != nil {
+		return err
+	}
+	tag := resp.Output
+	if resp.Error != "" {
+		if !strings.HasPrefix(resp.Error, "unknown command") {
+			return fmt.Errorf("version: %s", resp.Error)
+		}
+		tag = ""
+	}
+	return schema.Check(schema.Control, tag)
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,319 @@
+// Package control serves a small line-based control protocol on a local
+// UNIX socket, so an operator can inspect and steer a running agent: set
+// event filters, take snapshots, toggle hooks and tail live events.
+//
+// Each request is one line of text, a command name followed by its
+// argument. Each reply is one JSON object per line. While a tail is active
+// the agent streams {"event": ...} lines until the client sends any line.
+package control
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"probepilot/pkg/attach"
+	"probepilot/pkg/query"
+	"probepilot/pkg/schema"
+)
+
+// Handler runs a command with the rest of the request line as argument.
+type Handler func(arg string) (string, error)
+
+// Event is one live event as published to tailing clients.
+type Event struct {
+	Labels query.Labels
+	Text   string
+}
+
+// Response is one reply line.
+type Response struct {
+	Output string `json:"output,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Event  string `json:"event,omitempty"`
+}
+
+// tailBuffer is how many events a slow tailing client may lag behind
+// before events are dropped for it.
+const tailBuffer = 256
+
+type command struct {
+	usage   string
+	handler Handler
+}
+
+// Server dispatches control commands for one agent.
+type Server struct {
+	src query.Source
+
+	mu       sync.Mutex
+	commands map[string]command
+	filter   []query.Matcher
+	subs     map[chan Event]struct{}
+	tailing  atomic.Int32
+}
+
+// NewServer returns a server with the built-in commands: help, version,
+// filter, snapshot over the samples of src, and tail.
+func NewServer(src query.Source) *Server {
+	s := &Server{
+		src:      src,
+		commands: make(map[string]command),
+		subs:     make(map[chan Event]struct{}),
+	}
+	s.Handle("help", "list commands", s.help)
+	s.Handle("version", "print the control protocol schema, e.g. control/1.0", func(string) (string, error) {
+		return schema.Tag(schema.Control), nil
+	})
+	s.Handle("filter", "filter [matchers|clear]: show, set or clear the event filter, e.g. filter comm=~\"java.*\"", s.setFilter)
+	s.Handle("snapshot", "snapshot [metric]: print current samples matching the filter", s.snapshot)
+	s.Handle("tail", "stream live events matching the filter until a line is sent", nil)
+	return s
+}
+
+// Handle registers a command, replacing any command of the same name.
+func (s *Server) Handle(name, usage string, h Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commands[name] = command{usage: usage, handler: h}
+}
+
+// HandleHooks registers the hooks and hook commands over t. A source that
+// is a sync.Locker is held locked while a hook is attached or detached,
+// as attaching records what it resolved in the agent's state.
+func (s *Server) HandleHooks(t *attach.Toggles) {
+	s.Handle("hooks", "list hooks and whether they are attached", func(string) (string, error) {
+		states := t.States()
+		var b strings.Builder
+		for _, name := range t.Names() {
+			state := "off"
+			if states[name] {
+				state = "on"
+			}
+			fmt.Fprintf(&b, "%s %s\n", name, state)
+		}
+		return strings.TrimSuffix(b.String(), "\n"), nil
+	})
+	s.Handle("hook", "hook <name> on|off: attach or detach a hook", func(arg string) (string, error) {
+		fields := strings.Fields(arg)
+		if len(fields) != 2 || (fields[1] != "on" && fields[1] != "off") {
+			return "", errors.New("usage: hook <name> on|off")
+		}
+		if l, ok := s.src.(sync.Locker); ok {
+			l.Lock()
+			defer l.Unlock()
+		}
+		if err := t.Set(fields[0], fields[1] == "on"); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("hook %s %s", fields[0], fields[1]), nil
+	})
+}
+
+// Match reports whether labels pass the current filter.
+func (s *Server) Match(labels query.Labels) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return query.MatchLabels(s.filter, labels)
+}
+
+// Publish hands e to every tailing client whose buffer has room. It is
+// cheap while nobody tails, so agents can call it for every event.
+func (s *Server) Publish(e Event) {
+	if s == nil || s.tailing.Load() == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !query.MatchLabels(s.filter, e.Labels) {
+		return
+	}
+	for ch := range s.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+func (s *Server) help(string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.commands))
+	for name := range s.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := make([]string, len(names))
+	for i, name := range names {
+		lines[i] = fmt.Sprintf("%-10s %s", name, s.commands[name].usage)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func (s *Server) setFilter(arg string) (string, error) {
+	arg = strings.TrimSpace(arg)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch arg {
+	case "":
+	case "clear":
+		s.filter = nil
+	default:
+		matchers, err := query.ParseMatchers(arg)
+		if err != nil {
+			return "", err
+		}
+		s.filter = matchers
+	}
+	return "filter: " + describe(s.filter), nil
+}
+
+func describe(matchers []query.Matcher) string {
+	if len(matchers) == 0 {
+		return "none"
+	}
+	parts := make([]string, len(matchers))
+	for i, m := range matchers {
+		parts[i] = m.String()
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func (s *Server) snapshot(arg string) (string, error) {
+	name := strings.TrimSpace(arg)
+	s.mu.Lock()
+	filter := s.filter
+	s.mu.Unlock()
+
+	var lines []string
+	for _, sample := range query.SamplesOf(s.src) {
+		if name != "" && sample.Name != name {
+			continue
+		}
+		if !query.MatchLabels(filter, sample.Labels) {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s%s %g", sample.Name, sample.Labels, sample.Value))
+	}
+	sort.Strings(lines)
+	if len(lines) == 0 {
+		return "no samples", nil
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// exec runs one request line.
+func (s *Server) exec(line string) Response {
+	name, arg, _ := strings.Cut(strings.TrimSpace(line), " ")
+	s.mu.Lock()
+	cmd, ok := s.commands[name]
+	s.mu.Unlock()
+	if !ok || cmd.handler == nil {
+		return Response{Error: fmt.Sprintf("unknown command %q (try help)", name)}
+	}
+	out, err := cmd.handler(arg)
+	if err != nil {
+		return Response{Error: err.Error()}
+	}
+	return Response{Output: out}
+}
+
+// Serve accepts control connections on l until ctx is done.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go s.serveConn(ctx, conn)
+	}
+}
+
+func (s *Server) serveConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	enc := json.NewEncoder(conn)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case line, ok := <-lines:
+			if !ok {
+				return
+			}
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			if strings.TrimSpace(line) == "tail" {
+				if err := s.tail(ctx, enc, lines); err != nil {
+					return
+				}
+				continue
+			}
+			if err := enc.Encode(s.exec(line)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// tail streams events to enc until the client sends a line.
+func (s *Server) tail(ctx context.Context, enc *json.Encoder, lines <-chan string) error {
+	ch := make(chan Event, tailBuffer)
+	s.mu.Lock()
+	s.subs[ch] = struct{}{}
+	s.mu.Unlock()
+	s.tailing.Add(1)
+	defer func() {
+		s.tailing.Add(-1)
+		s.mu.Lock()
+		delete(s.subs, ch)
+		s.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case e := <-ch:
+			if err := enc.Encode(Response{Event: e.Text}); err != nil {
+				return err
+			}
+		case _, ok := <-lines:
+			if !ok {
+				return errors.New("client closed")
+			}
+			return enc.Encode(Response{Output: "tail stopped"})
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package control
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SocketOptions controls who may connect to the agent's UNIX sockets.
+// Access is granted through file permissions alone, so local tooling can
+// reach the agent without a network port being opened.
+type SocketOptions struct {
+	// Mode is the socket file mode. Connecting needs write permission.
+	Mode os.FileMode
+	// Group, if set, owns the socket so its members can be granted access
+	// with a group-writable mode such as 0660.
+	Group string
+}
+
+// DefaultSocketMode limits sockets to the agent's user.
+const DefaultSocketMode os.FileMode = 0o600
+
+// RegisterFlags defines the socket permission flags on fs. The returned
+// function parses their values once fs has been parsed.
+func RegisterFlags(fs *flag.FlagSet) func() (SocketOptions, error) {
+	mode := fs.String("socket-mode", "0600", "file mode of the agent's UNIX sockets")
+	group := fs.String("socket-group", "", "group owning the agent's UNIX sockets (default: the agent's group)")
+
+	return func() (SocketOptions, error) {
+		m, err := strconv.ParseUint(*mode, 8, 32)
+		if err != nil || m > 0o777 {
+			return SocketOptions{}, fmt.Errorf("invalid -socket-mode %q (want octal permissions, e.g. 0660)", *mode)
+		}
+		if m&0o002 != 0 {
+			return SocketOptions{}, fmt.Errorf("invalid -socket-mode %q: sockets must not be world-writable", *mode)
+		}
+		return SocketOptions{Mode: os.FileMode(m), Group: *group}, nil
+	}
+}
+
+// IsUnix reports whether addr names a UNIX socket: "unix:/path" or an
+// absolute path.
+func IsUnix(addr string) bool {
+	return strings.HasPrefix(addr, "unix:") || strings.HasPrefix(addr, "/")
+}
+
+// Listen listens on addr, a UNIX socket as accepted by IsUnix or a TCP
+// host:port. UNIX sockets get the mode and group of opts.
+func Listen(addr string, opts SocketOptions) (net.Listener, error) {
+	if !IsUnix(addr) {
+		return net.Listen("tcp", addr)
+	}
+	path := strings.TrimPrefix(addr, "unix:")
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	if err := removeStale(path); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.apply(path); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// apply sets the socket's permissions. The socket is created under the
+// process umask, which leaves it unwritable for others until the
+// requested mode is set.
+func (o SocketOptions) apply(path string) error {
+	if o.Group != "" {
+		g, err := user.LookupGroup(o.Group)
+		if err != nil {
+			return err
+		}
+		gid, err := strconv.Atoi(g.Gid)
+		if err != nil {
+			return fmt.Errorf("group %s: invalid gid %q", o.Group, g.Gid)
+		}
+		if err := os.Chown(path, -1, gid); err != nil {
+			return err
+		}
+	}
+	mode := o.Mode
+	if mode == 0 {
+		mode = DefaultSocketMode
+	}
+	return os.Chmod(path, mode)
+}
+
+// removeStale removes a socket left behind by an agent that did not shut
+// down cleanly. It refuses to touch other files or a socket in use.
+func removeStale(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,214 @@
+// Package core prepares the agents' CO-RE eBPF objects for the running
+// kernel. The objects are compiled once against vmlinux.h and carry
+// relocations for every kernel struct field they read; at load time those
+// are resolved against the running kernel's BTF, so the same object runs
+// across kernel versions whose struct layouts differ.
+//
+// Detect finds the kernel BTF and probes the kernel features the objects
+// depend on. Kernels built without BTF can still run the probes with a
+// BTF file for their exact release, e.g. from BTFHub, given by path or
+// dropped into one of SearchPaths as <release>.btf. Prepare then keeps the
+// programs whose relocations resolve on this kernel and drops the others,
+// so a probe loses one hook instead of failing to load, unless the hook is
+// one the agent cannot run without.
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/btf"
+	"github.com/cilium/ebpf/features"
+
+	"probepilot/pkg/platform"
+)
+
+// SearchPaths are the directories searched for <release>.btf when the
+// kernel exposes no BTF of its own.
+var SearchPaths = []string{
+	"/var/lib/probepilot/btf",
+	"/usr/lib/probepilot/btf",
+}
+
+// Kernel describes the running kernel as the loaders see it.
+type Kernel struct {
+	Release string
+	// Types is the kernel BTF relocations resolve against, or nil if none
+	// was found.
+	Types *btf.Spec
+	// BTFSource is where Types came from: /sys/kernel/btf/vmlinux, a
+	// vmlinux image or a BTF file.
+	BTFSource string
+	// RingBuf is false on kernels known to lack BPF ring buffers (before
+	// 5.8), which every probe streams its events through.
+	RingBuf bool
+}
+
+// Detect finds the kernel BTF and probes kernel features. path names a BTF
+// file to use instead of the kernel's own; failing to read it is an error,
+// while finding no BTF at all is not: Prepare reports what cannot run.
+func Detect(path string) (*Kernel, error) {
+	k := &Kernel{Release: platform.Current().Capabilities().Kernel, RingBuf: true}
+	if errors.Is(features.HaveMapType(ebpf.RingBuf), ebpf.ErrNotSupported) {
+		k.RingBuf = false
+	}
+
+	if path != "" {
+		spec, err := btf.LoadSpec(path)
+		if err != nil {
+			return nil, fmt.Errorf("kernel BTF %s: %w", path, err)
+		}
+		k.Types, k.BTFSource = spec, path
+		return k, nil
+	}
+	if spec, err := btf.LoadKernelSpec(); err == nil {
+		k.Types, k.BTFSource = spec, "/sys/kernel/btf/vmlinux"
+		if _, err := os.Stat(k.BTFSource); err != nil {
+			k.BTFSource = "vmlinux image"
+		}
+		return k, nil
+	}
+	if k.Release == "" {
+		return k, nil
+	}
+	for _, dir := range SearchPaths {
+		file := filepath.Join(dir, k.Release+".btf")
+		if _, err := os.Stat(file); err != nil {
+			continue
+		}
+		spec, err := btf.LoadSpec(file)
+		if err != nil {
+			return nil, fmt.Errorf("kernel BTF %s: %w", file, err)
+		}
+		k.Types, k.BTFSource = spec, file
+		break
+	}
+	return k, nil
+}
+
+// String renders a one-line summary such as
+// "kernel 6.1.0-13-amd64 btf=/sys/kernel/btf/vmlinux ringbuf=true".
+func (k *Kernel) String() string {
+	source := k.BTFSource
+	if source == "" {
+		source = "none"
+	}
+	return fmt.Sprintf("kernel %s btf=%s ringbuf=%t", k.Release, source, k.RingBuf)
+}
+
+// Err explains why no probe can load on this kernel, or returns nil.
+func (k *Kernel) Err() error {
+	if !k.RingBuf {
+		return fmt.Errorf("kernel %s has no BPF ring buffer support (needs 5.8+)", k.Release)
+	}
+	return nil
+}
+
+// Options returns the collection options that relocate against k.Types.
+func (k *Kernel) Options() ebpf.CollectionOptions {
+	return ebpf.CollectionOptions{Programs: ebpf.ProgramOptions{KernelTypes: k.Types}}
+}
+
+// Dropped is a program Prepare removed, and why.
+type Dropped struct {
+	Program string
+	Err     error
+}
+
+func (d Dropped) String() string {
+	return fmt.Sprintf("%s: %v", d.Program, d.Err)
+}
+
+// Prepare removes the programs of spec that cannot load on k: those whose
+// CO-RE relocations do not resolve against its BTF, or every program that
+// has relocations when there is no BTF. It must be called before the
+// collection is created. Dropping one of the required programs is an
+// error instead, naming a way to provide BTF where that is what is missing.
+func (k *Kernel) Prepare(spec *ebpf.CollectionSpec, required ...string) ([]Dropped, error) {
+	needed := make(map[string]bool, len(required))
+	for _, name := range required {
+		needed[name] = true
+	}
+	names := make([]string, 0, len(spec.Programs))
+	for name := range spec.Programs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var dropped []Dropped
+	var errs []error
+	for _, name := range names {
+		err := k.relocate(spec.Programs[name])
+		if err == nil {
+			continue
+		}
+		if needed[name] {
+			errs = append(errs, fmt.Errorf("program %s: %w", name, err))
+			continue
+		}
+		delete(spec.Programs, name)
+		dropped = append(dropped, Dropped{Program: name, Err: err})
+	}
+	if len(errs) > 0 {
+		err := errors.Join(errs...)
+		if k.Types == nil {
+			err = fmt.Errorf("%w; provide BTF for kernel %s with -kernel-btf or as <release>.btf in %s",
+				err, k.Release, strings.Join(SearchPaths, " or "))
+		}
+		return dropped, err
+	}
+	return dropped, nil
+}
+
+// errNoBTF reports a program with relocations on a kernel without BTF.
+var errNoBTF = errors.New("needs kernel BTF for its CO-RE relocations")
+
+// relocate checks that the CO-RE relocations of prog resolve against the
+// kernel types. A relocation of a field or type the kernel lacks resolves
+// to a poisoned instruction the verifier rejects if it is reachable; in
+// programs that test for the field or type first, it is taken to be
+// guarded and the program kept.
+func (k *Kernel) relocate(prog *ebpf.ProgramSpec) error {
+	var relos []*btf.CORERelocation
+	guarded := false
+	for i := range prog.Instructions {
+		if relo := btf.CORERelocationMetadata(&prog.Instructions[i]); relo != nil {
+			relos = append(relos, relo)
+			guarded = guarded || checksExistence(relo)
+		}
+	}
+	if len(relos) == 0 {
+		return nil
+	}
+	if k.Types == nil {
+		return errNoBTF
+	}
+	fixups, err := btf.CORERelocate(relos, k.Types, prog.ByteOrder)
+	if err != nil || guarded {
+		return err
+	}
+	for i, fixup := range fixups {
+		if strings.HasSuffix(fixup.String(), "=poison") {
+			return fmt.Errorf("kernel lacks the target of %s", relos[i])
+		}
+	}
+	return nil
+}
+
+// checksExistence reports whether relo is a bpf_core_*_exists check. The
+// relocation kind is only exposed through String, e.g.
+// "CORERelocation(field_exists, ...)".
+func checksExistence(relo *btf.CORERelocation) bool {
+	s := relo.String()
+	for _, kind := range []string{"field_exists", "type_exists", "enumval_exists"} {
+		if strings.HasPrefix(s, "CORERelocation("+kind+",") {
+			return true
+		}
+	}
+	return false
+}
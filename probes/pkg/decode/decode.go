@@ -0,0 +1,68 @@
+// Package decode turns raw ring buffer records into Go values in a way
+// that is correct on both little- and big-endian hosts.
+package decode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// ByteOrder is the order eBPF programs write integers in, which is always
+// the host's native order (s390x and some MIPS/PowerPC targets are
+// big-endian).
+var ByteOrder binary.ByteOrder = binary.NativeEndian
+
+// ErrShortRecord is returned when a record is smaller than the value it is
+// decoded into.
+var ErrShortRecord = errors.New("record too short")
+
+// Record decodes raw into v, which must be a pointer to a fixed-size
+// value such as a generated event struct.
+func Record(raw []byte, v any) error {
+	size := binary.Size(v)
+	if size < 0 {
+		return fmt.Errorf("decode: %T has no fixed size", v)
+	}
+	if len(raw) < size {
+		return fmt.Errorf("%w: %d bytes, want %d for %T", ErrShortRecord, len(raw), size, v)
+	}
+	return binary.Read(bytes.NewReader(raw[:size]), ByteOrder, v)
+}
+
+// IPv4 converts an address copied verbatim from a kernel socket field
+// (network byte order in memory, read as a native integer) to net.IP.
+func IPv4(addr uint32) net.IP {
+	var b [4]byte
+	ByteOrder.PutUint32(b[:], addr)
+	return net.IPv4(b[0], b[1], b[2], b[3])
+}
+
+// Addr4 is IPv4 as a netip.Addr, which is comparable and so can key maps.
+func Addr4(addr uint32) netip.Addr {
+	var b [4]byte
+	ByteOrder.PutUint32(b[:], addr)
+	return netip.AddrFrom4(b)
+}
+
+// IPv4ToRaw is the inverse of IPv4, for populating BPF filter maps keyed
+// by raw socket addresses.
+func IPv4ToRaw(ip net.IP) (uint32, bool) {
+	v4 := ip.To4()
+	if v4 == nil {
+		return 0, false
+	}
+	return ByteOrder.Uint32(v4), true
+}
+
+// Port converts a port copied verbatim from a socket field (network byte
+// order) to host order. Ports already converted with bpf_ntohs must not
+// go through this function.
+func Port(raw uint16) uint16 {
+	var b [2]byte
+	ByteOrder.PutUint16(b[:], raw)
+	return binary.BigEndian.Uint16(b[:])
+}
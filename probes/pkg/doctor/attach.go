@@ -0,0 +1,136 @@
+package doctor
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/rlimit"
+)
+
+// attachTest attaches a program that does nothing to one kind of hook.
+type attachTest struct {
+	name  string
+	prog  ebpf.ProgramType
+	typ   ebpf.AttachType
+	to    string
+	hint  string
+	run   func(prog *ebpf.Program) (link.Link, error)
+	probe func() error
+}
+
+// attachTests cover the kinds of hooks the probes attach to, at targets
+// every kernel and the probepilot binary have.
+var attachTests = []attachTest{
+	{
+		name: "tracepoint sched/sched_process_exit", prog: ebpf.TracePoint,
+		hint: "tracepoints need CONFIG_BPF_EVENTS and a mounted tracefs",
+		run: func(prog *ebpf.Program) (link.Link, error) {
+			return link.Tracepoint("sched", "sched_process_exit", prog, nil)
+		},
+	},
+	{
+		name: "kprobe do_exit", prog: ebpf.Kprobe,
+		hint: "kprobes need CONFIG_KPROBES and CONFIG_BPF_EVENTS",
+		run: func(prog *ebpf.Program) (link.Link, error) {
+			return link.Kprobe("do_exit", prog, nil)
+		},
+	},
+	{
+		name: "fentry do_exit", prog: ebpf.Tracing, typ: ebpf.AttachTraceFEntry, to: "do_exit",
+		hint: "fentry needs kernel BTF and 5.5 or later; -attach-mode kprobe does without",
+		run: func(prog *ebpf.Program) (link.Link, error) {
+			return link.AttachTracing(link.TracingOptions{Program: prog})
+		},
+	},
+	{
+		name: "uprobe libc getpid", prog: ebpf.Kprobe,
+		hint: "uprobes need CONFIG_UPROBE_EVENTS",
+		run: func(prog *ebpf.Program) (link.Link, error) {
+			libc, err := findLibc()
+			if err != nil {
+				return nil, err
+			}
+			ex, err := link.OpenExecutable(libc)
+			if err != nil {
+				return nil, err
+			}
+			return ex.Uprobe("getpid", prog, nil)
+		},
+	},
+	{
+		name: "ring buffer map",
+		hint: "ring buffers need 5.8 or later",
+		probe: func() error {
+			m, err := ebpf.NewMap(&ebpf.MapSpec{Type: ebpf.RingBuf, MaxEntries: uint32(os.Getpagesize())})
+			if err != nil {
+				return err
+			}
+			return m.Close()
+		},
+	},
+}
+
+// libcDirs are searched for libc.so.6 by the uprobe test
+var libcDirs = []string{"/lib/x86_64-linux-gnu", "/lib/aarch64-linux-gnu", "/usr/lib64", "/lib64", "/usr/lib", "/lib"}
+
+func findLibc() (string, error) {
+	for _, dir := range libcDirs {
+		path := filepath.Join(dir, "libc.so.6")
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", errors.New("no libc.so.6 found")
+}
+
+// AttachTests loads a program that does nothing and attaches it, one
+// hook at a time, to a tracepoint, a kprobe, an fentry hook and a libc
+// uprobe, and creates a ring buffer: what the probes' own programs need.
+func AttachTests() []Check {
+	if err := rlimit.RemoveMemlock(); err != nil {
+		return []Check{{Name: "attach tests", Status: Skip, Detail: err.Error(),
+			Hint: "run as root or with CAP_BPF, CAP_PERFMON and CAP_SYS_RESOURCE"}}
+	}
+	checks := make([]Check, 0, len(attachTests))
+	for _, t := range attachTests {
+		c := Check{Name: t.name, Detail: "attached"}
+		if err := t.attach(); err != nil {
+			c.Status, c.Detail, c.Hint = Fail, err.Error(), t.hint
+			if errors.Is(err, os.ErrPermission) {
+				c.Status, c.Hint = Skip, "run as root or with CAP_BPF and CAP_PERFMON"
+			}
+		}
+		checks = append(checks, c)
+	}
+	return checks
+}
+
+func (t attachTest) attach() error {
+	if t.probe != nil {
+		return t.probe()
+	}
+	prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Type:       t.prog,
+		AttachType: t.typ,
+		AttachTo:   t.to,
+		License:    "GPL",
+		Instructions: asm.Instructions{
+			asm.Mov.Imm(asm.R0, 0),
+			asm.Return(),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("load: %w", err)
+	}
+	defer prog.Close()
+	l, err := t.run(prog)
+	if err != nil {
+		return fmt.Errorf("attach: %w", err)
+	}
+	return l.Close()
+}
@@ -0,0 +1,373 @@
+// Package doctor diagnoses whether the probes can run on a host: the
+// kernel's eBPF features, configuration and BTF, tracefs and the cgroup
+// hierarchy, attaching minimal programs to each kind of hook, tracers
+// that may get in the way, and every hook of the probes' attach plans.
+// Each finding that is not fine comes with a hint at the remedy.
+package doctor
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"probepilot/pkg/attach"
+	"probepilot/pkg/core"
+	"probepilot/pkg/plan"
+	"probepilot/pkg/platform"
+	"probepilot/pkg/procfs"
+)
+
+// Status is the outcome of a check.
+type Status int
+
+const (
+	OK Status = iota
+	// Skip marks checks that do not apply, e.g. a hook without a
+	// checkable target.
+	Skip
+	// Warn marks what degrades probes but lets them run.
+	Warn
+	// Fail marks what keeps probes from running.
+	Fail
+)
+
+var statusNames = []string{"ok", "skip", "warn", "FAIL"}
+
+func (s Status) String() string {
+	if s < 0 || int(s) >= len(statusNames) {
+		return fmt.Sprintf("status(%d)", int(s))
+	}
+	return statusNames[s]
+}
+
+// Check is one finding.
+type Check struct {
+	Name   string
+	Status Status
+	Detail string
+	// Hint says how to fix what is not OK.
+	Hint string
+}
+
+// Worst returns the worst status of checks, OK for none.
+func Worst(checks []Check) Status {
+	worst := OK
+	for _, c := range checks {
+		if c.Status > worst && c.Status != Skip {
+			worst = c.Status
+		}
+	}
+	return worst
+}
+
+// Host checks the eBPF backend, kernel BTF, tracefs, cgroups and the
+// sysctls and lockdown mode that restrict eBPF.
+func Host() []Check {
+	report := platform.Current().Capabilities()
+	checks := []Check{{Name: "platform", Detail: report.String()}}
+	if err := report.Err(); err != nil {
+		checks[0].Status, checks[0].Hint = Fail, "the probes need Linux 4.4 or later, 5.8 or later for ring buffers"
+		return checks
+	}
+
+	kernel, err := core.Detect("")
+	switch {
+	case err != nil:
+		checks = append(checks, Check{Name: "btf", Status: Fail, Detail: err.Error()})
+	case kernel.Types == nil:
+		checks = append(checks, Check{Name: "btf", Status: Fail, Detail: "no kernel BTF",
+			Hint: "build the kernel with CONFIG_DEBUG_INFO_BTF=y, or put <release>.btf from BTFHub in " + strings.Join(core.SearchPaths, " or ") + " or pass -kernel-btf"})
+	default:
+		checks = append(checks, Check{Name: "btf", Detail: kernel.BTFSource})
+	}
+	if kernel != nil {
+		c := Check{Name: "ring buffer", Detail: "BPF_MAP_TYPE_RINGBUF supported"}
+		if err := kernel.Err(); err != nil {
+			c.Status, c.Detail, c.Hint = Fail, err.Error(), "upgrade to kernel 5.8 or later"
+		}
+		checks = append(checks, c)
+	}
+
+	if dir := tracefs(); dir != "" {
+		checks = append(checks, Check{Name: "tracefs", Detail: dir})
+	} else {
+		checks = append(checks, Check{Name: "tracefs", Status: Fail, Detail: "not mounted",
+			Hint: "mount -t tracefs nodev /sys/kernel/tracing"})
+	}
+	checks = append(checks, cgroups())
+
+	if v, err := readSysctl("kernel/unprivileged_bpf_disabled"); err == nil && v != "0" && os.Geteuid() != 0 {
+		checks = append(checks, Check{Name: "unprivileged bpf", Status: Warn, Detail: "disabled (" + v + ")",
+			Hint: "run the agents as root or with CAP_BPF, CAP_PERFMON and CAP_SYS_RESOURCE"})
+	}
+	if v, err := readSysctl("kernel/perf_event_paranoid"); err == nil {
+		c := Check{Name: "perf_event_paranoid", Detail: v}
+		if n, _ := strconv.Atoi(v); n > 2 && os.Geteuid() != 0 {
+			c.Status, c.Hint = Warn, "run the CPU profiler as root or with CAP_PERFMON, or sysctl kernel.perf_event_paranoid=2"
+		}
+		checks = append(checks, c)
+	}
+	if raw, err := os.ReadFile("/sys/kernel/security/lockdown"); err == nil {
+		c := Check{Name: "lockdown", Detail: strings.TrimSpace(string(raw))}
+		if strings.Contains(c.Detail, "[confidentiality]") {
+			c.Status, c.Hint = Fail, "lockdown=confidentiality forbids reading kernel memory from BPF; boot with lockdown=integrity or none"
+		}
+		checks = append(checks, c)
+	}
+	return checks
+}
+
+// tracefs returns the mounted tracefs directory, or "".
+func tracefs() string {
+	for _, dir := range []string{"/sys/kernel/tracing", "/sys/kernel/debug/tracing"} {
+		if _, err := os.Stat(filepath.Join(dir, "events")); err == nil {
+			return dir
+		}
+	}
+	return ""
+}
+
+func cgroups() Check {
+	c := Check{Name: "cgroups"}
+	switch {
+	case exists("/sys/fs/cgroup/cgroup.controllers"):
+		c.Detail = "v2 (unified)"
+	case exists("/sys/fs/cgroup/unified/cgroup.controllers"):
+		c.Detail = "hybrid, v2 at /sys/fs/cgroup/unified"
+	case exists("/sys/fs/cgroup"):
+		c.Status, c.Detail = Warn, "v1"
+		c.Hint = "containers are attributed by their first v1 hierarchy; boot with systemd.unified_cgroup_hierarchy=1 for cgroup v2"
+	default:
+		c.Status, c.Detail, c.Hint = Warn, "not mounted", "mount cgroup2 on /sys/fs/cgroup to attribute events to containers"
+	}
+	return c
+}
+
+func readSysctl(name string) (string, error) {
+	raw, err := os.ReadFile(procfs.Path("sys", name))
+	return strings.TrimSpace(string(raw)), err
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// kernelOptions are the options the probes need, and what each is for.
+var kernelOptions = []struct {
+	name     string
+	required bool
+	purpose  string
+}{
+	{"CONFIG_BPF_SYSCALL", true, "eBPF"},
+	{"CONFIG_BPF_JIT", false, "fast eBPF programs"},
+	{"CONFIG_BPF_EVENTS", true, "attaching eBPF to kprobes, uprobes and tracepoints"},
+	{"CONFIG_DEBUG_INFO_BTF", false, "CO-RE relocations without a BTF file"},
+	{"CONFIG_KPROBES", false, "kprobe hooks"},
+	{"CONFIG_UPROBE_EVENTS", false, "allocator uprobes of the memory tracker"},
+	{"CONFIG_TRACEPOINTS", true, "tracepoint hooks"},
+	{"CONFIG_PERF_EVENTS", true, "perf event sampling of the CPU profiler"},
+	{"CONFIG_CGROUP_BPF", false, "cgroup-scoped programs"},
+	{"CONFIG_PSI", false, "pressure stall information in OOM reports"},
+}
+
+// KernelConfig checks the kernel options the probes depend on, read from
+// /proc/config.gz or /boot/config-<release>.
+func KernelConfig() []Check {
+	config, source, err := readKernelConfig()
+	if err != nil {
+		return []Check{{Name: "kernel config", Status: Skip, Detail: err.Error(),
+			Hint: "modprobe configs exposes /proc/config.gz"}}
+	}
+	var checks []Check
+	for _, opt := range kernelOptions {
+		c := Check{Name: opt.name, Detail: config[opt.name] + " (" + opt.purpose + ")"}
+		if v := config[opt.name]; v != "y" && v != "m" {
+			c.Detail = "not set (" + opt.purpose + ")"
+			c.Status, c.Hint = Warn, fmt.Sprintf("rebuild the kernel with %s=y", opt.name)
+			if opt.required {
+				c.Status = Fail
+			}
+		}
+		checks = append(checks, c)
+	}
+	if len(checks) > 0 {
+		checks[0].Detail += ", from " + source
+	}
+	return checks
+}
+
+func readKernelConfig() (map[string]string, string, error) {
+	var r io.Reader
+	source := procfs.Path("config.gz")
+	if raw, err := os.ReadFile(source); err == nil {
+		gz, err := gzip.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return nil, "", fmt.Errorf("%s: %v", source, err)
+		}
+		r = gz
+	} else {
+		source = "/boot/config-" + platform.Current().Capabilities().Kernel
+		raw, err := os.ReadFile(source)
+		if err != nil {
+			return nil, "", fmt.Errorf("no /proc/config.gz or %s", source)
+		}
+		r = bytes.NewReader(raw)
+	}
+	config := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if name, value, ok := strings.Cut(scanner.Text(), "="); ok && strings.HasPrefix(name, "CONFIG_") {
+			config[name] = value
+		}
+	}
+	return config, source, scanner.Err()
+}
+
+// tracers are programs whose probes share the kernel's tracing
+// infrastructure with the agents.
+var tracers = []string{"bpftrace", "perf", "trace-cmd", "sysdig", "falco", "tracee", "tetragon", "pixie", "bcc", "execsnoop", "opensnoop", "profile", "offcputime"}
+
+// Conflicts looks for tracers that may get in the way: a function tracer
+// set in tracefs, kprobes and uprobes created by other tools, and running
+// tracing programs.
+func Conflicts() []Check {
+	var checks []Check
+	if dir := tracefs(); dir != "" {
+		if raw, err := os.ReadFile(filepath.Join(dir, "current_tracer")); err == nil {
+			if tracer := strings.TrimSpace(string(raw)); tracer != "nop" {
+				checks = append(checks, Check{Name: "ftrace", Status: Warn, Detail: "current_tracer is " + tracer,
+					Hint: "echo nop > " + filepath.Join(dir, "current_tracer") + " unless the tracer is wanted; it slows every hooked function"})
+			}
+		}
+		for _, file := range []string{"kprobe_events", "uprobe_events"} {
+			raw, err := os.ReadFile(filepath.Join(dir, file))
+			if err != nil {
+				continue
+			}
+			if events := strings.TrimSpace(string(raw)); events != "" {
+				lines := strings.Count(events, "\n") + 1
+				checks = append(checks, Check{Name: file, Status: Warn, Detail: fmt.Sprintf("%d left by other tools", lines),
+					Hint: "stale probes of crashed tracers keep firing; clear them with echo > " + filepath.Join(dir, file)})
+			}
+		}
+	}
+	if procs, err := procfs.Scan(); err == nil {
+		self := uint32(os.Getpid())
+		for _, p := range procs {
+			if p.PID == self {
+				continue
+			}
+			for _, t := range tracers {
+				if p.Comm == t {
+					checks = append(checks, Check{Name: "tracer", Status: Warn, Detail: fmt.Sprintf("%s running as PID %d", p.Comm, p.PID),
+						Hint: "tracers hooking the same functions add up in overhead and compete for perf and ring buffer memory"})
+				}
+			}
+		}
+	}
+	if len(checks) == 0 {
+		checks = append(checks, Check{Name: "tracers", Detail: "none found"})
+	}
+	return checks
+}
+
+// Hooks checks each hook of p against the host: that the tracepoint,
+// kernel function or library symbol exists. Hooks the plan dropped fail
+// where they are core, and warn where they are optional.
+func Hooks(p *plan.Plan) []Check {
+	symbols := kernelSymbols()
+	dropped := make(map[string]bool, len(p.Dropped))
+	for _, d := range p.Dropped {
+		dropped[d.Program] = true
+	}
+	var checks []Check
+	for _, h := range p.Hooks {
+		c := checkHook(h, symbols)
+		c.Name = h.Kind + " " + h.Target
+		if dropped[h.Program] && c.Status == OK {
+			c.Status, c.Detail = Warn, "dropped: the program does not load on this kernel"
+			c.Hint = "check the kernel BTF; -dry-run shows why"
+		}
+		// Only core hooks are needed to run
+		if c.Status == Fail && h.Set != "" {
+			c.Status = Warn
+		}
+		checks = append(checks, c)
+	}
+	return checks
+}
+
+func checkHook(h plan.Hook, symbols map[string]bool) Check {
+	switch h.Kind {
+	case "tracepoint":
+		dir := tracefs()
+		if dir == "" {
+			return Check{Status: Fail, Detail: "no tracefs", Hint: "mount -t tracefs nodev /sys/kernel/tracing"}
+		}
+		if !exists(filepath.Join(dir, "events", h.Target)) {
+			return Check{Status: Fail, Detail: "no such tracepoint", Hint: "the kernel is too old for it or built without it"}
+		}
+		return Check{Detail: "available"}
+	case "kprobe", "kretprobe", "fentry", "fexit":
+		if symbols == nil {
+			return Check{Status: Skip, Detail: "kernel symbols unreadable", Hint: "run as root to read /proc/kallsyms"}
+		}
+		if !symbols[h.Target] {
+			return Check{Status: Fail, Detail: "no such kernel function", Hint: "the function was renamed or inlined in this kernel"}
+		}
+		return Check{Detail: "available"}
+	case "uprobe", "uretprobe":
+		i := strings.LastIndexByte(h.Target, ':')
+		if i < 0 {
+			return Check{Status: Skip, Detail: "resolved at run time"}
+		}
+		path, symbol := h.Target[:i], h.Target[i+1:]
+		if !filepath.IsAbs(path) {
+			return Check{Status: Fail, Detail: path, Hint: "install the library or point the agent at it"}
+		}
+		if _, err := attach.ResolveSymbol(path, symbol); err != nil {
+			return Check{Status: Fail, Detail: err.Error(), Hint: "the library does not export the symbol; it may be stripped"}
+		}
+		return Check{Detail: "available"}
+	case "perf_event":
+		if !exists(procfs.Path("sys", "kernel", "perf_event_paranoid")) {
+			return Check{Status: Fail, Detail: "no perf events", Hint: "rebuild the kernel with CONFIG_PERF_EVENTS=y"}
+		}
+		return Check{Detail: "available"}
+	}
+	return Check{Status: Skip, Detail: "not checked"}
+}
+
+// kernelSymbols returns the functions of /proc/kallsyms, or nil where
+// their addresses, and so their names, are hidden from this user.
+func kernelSymbols() map[string]bool {
+	f, err := os.Open(procfs.Path("kallsyms"))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	symbols := make(map[string]bool)
+	visible := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || (fields[1] != "t" && fields[1] != "T") {
+			continue
+		}
+		if strings.Trim(fields[0], "0") != "" {
+			visible = true
+		}
+		symbols[fields[2]] = true
+	}
+	if !visible {
+		return nil
+	}
+	return symbols
+}
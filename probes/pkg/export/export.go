@@ -0,0 +1,425 @@
+// Package export delivers records to network collectors in batches: it
+// groups records by count and time, compresses each batch with gzip or
+// zstd, retries failed deliveries with exponential backoff and parks
+// batches a collector keeps refusing in an on-disk spool, replayed once
+// the collector accepts data again. Transient outages thus delay data
+// instead of losing it. The webhook and Kafka sinks of package route use
+// it; each exporter only supplies how a batch is encoded and sent.
+package export
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"probepilot/pkg/seal"
+)
+
+// Compression algorithms of request bodies, named as in Content-Encoding.
+const (
+	None = "none"
+	Gzip = "gzip"
+	Zstd = "zstd"
+)
+
+// Duration is a time.Duration read from config files as "5s" or "250ms".
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Options configures an exporter. Zero fields take the defaults.
+type Options struct {
+	// BatchSize is the most records per request (default 1, no batching).
+	BatchSize int `json:"batch_size,omitempty"`
+	// BatchInterval flushes partial batches (default 1s).
+	BatchInterval Duration `json:"batch_interval,omitempty"`
+	// Compression is none, gzip or zstd (default none).
+	Compression string `json:"compression,omitempty"`
+	// Retries is how often a failed batch is retried before it is spooled
+	// (default 3).
+	Retries int `json:"retries,omitempty"`
+	// Backoff is the first retry delay, doubled up to MaxBackoff (default
+	// 500ms and 30s).
+	Backoff    Duration `json:"backoff,omitempty"`
+	MaxBackoff Duration `json:"max_backoff,omitempty"`
+	// SpoolDir keeps batches that exhausted their retries; without it they
+	// are dropped.
+	SpoolDir string `json:"spool_dir,omitempty"`
+	// SpoolLimit caps the spool in bytes, evicting the oldest batches
+	// (default 64 MiB).
+	SpoolLimit int64 `json:"spool_limit_bytes,omitempty"`
+	// SpoolKey seals spooled batches with AES-256-GCM under the key a
+	// seal spec names, e.g. "file:/etc/probepilot/seal.key"; see package
+	// seal. Batches spooled unsealed before are still replayed.
+	SpoolKey string `json:"spool_key,omitempty"`
+}
+
+// Defaults of Options.
+const (
+	DefaultBatchInterval = Duration(time.Second)
+	DefaultRetries       = 3
+	DefaultBackoff       = Duration(500 * time.Millisecond)
+	DefaultMaxBackoff    = Duration(30 * time.Second)
+	DefaultSpoolLimit    = 64 << 20
+)
+
+// Validate checks o.
+func (o Options) Validate() error {
+	switch o.Compression {
+	case "", None, Gzip, Zstd:
+	default:
+		return fmt.Errorf("unknown compression %q (want none, gzip or zstd)", o.Compression)
+	}
+	if o.BatchSize < 0 || o.Retries < 0 || o.SpoolLimit < 0 {
+		return errors.New("batch_size, retries and spool_limit_bytes must not be negative")
+	}
+	if o.BatchInterval < 0 || o.Backoff < 0 || o.MaxBackoff < 0 {
+		return errors.New("batch_interval, backoff and max_backoff must not be negative")
+	}
+	if o.SpoolKey != "" {
+		if o.SpoolDir == "" {
+			return errors.New("spool_key without spool_dir")
+		}
+		if err := seal.ValidSpec(o.SpoolKey); err != nil {
+			return fmt.Errorf("spool_key: %v", err)
+		}
+	}
+	return nil
+}
+
+// String summarizes o with defaults applied, e.g. "batches of 500 every
+// 1s, zstd, 3 retries, spool /var/spool/probepilot up to 64 MiB".
+func (o Options) String() string {
+	o = o.withDefaults()
+	var b strings.Builder
+	if o.BatchSize > 1 {
+		fmt.Fprintf(&b, "batches of %d every %s", o.BatchSize, time.Duration(o.BatchInterval))
+	} else {
+		b.WriteString("unbatched")
+	}
+	if o.Compression != None {
+		fmt.Fprintf(&b, ", %s", o.Compression)
+	}
+	fmt.Fprintf(&b, ", %d retries", o.Retries)
+	if o.SpoolDir != "" {
+		fmt.Fprintf(&b, ", spool %s up to %d MiB", o.SpoolDir, o.SpoolLimit>>20)
+		if o.SpoolKey != "" {
+			fmt.Fprintf(&b, " sealed under %s", o.SpoolKey)
+		}
+	} else {
+		b.WriteString(", no spool")
+	}
+	return b.String()
+}
+
+func (o Options) withDefaults() Options {
+	if o.BatchSize == 0 {
+		o.BatchSize = 1
+	}
+	if o.BatchInterval == 0 {
+		o.BatchInterval = DefaultBatchInterval
+	}
+	if o.Compression == "" {
+		o.Compression = None
+	}
+	if o.Retries == 0 {
+		o.Retries = DefaultRetries
+	}
+	if o.Backoff == 0 {
+		o.Backoff = DefaultBackoff
+	}
+	if o.MaxBackoff == 0 {
+		o.MaxBackoff = DefaultMaxBackoff
+	}
+	if o.SpoolLimit == 0 {
+		o.SpoolLimit = DefaultSpoolLimit
+	}
+	return o
+}
+
+// Encoder turns a batch of records into one request body.
+type Encoder func(records [][]byte) ([]byte, error)
+
+// Sender delivers one body. encoding is its Content-Encoding, "" if it is
+// not compressed.
+type Sender func(body []byte, encoding string) error
+
+// permanent marks errors retrying cannot fix.
+type permanent struct{ err error }
+
+func (p permanent) Error() string { return p.err.Error() }
+func (p permanent) Unwrap() error { return p.err }
+
+// Permanent wraps an error a Sender knows retrying will not fix, such as
+// a 400 response; the batch is dropped without retries or spooling.
+func Permanent(err error) error {
+	return permanent{err}
+}
+
+// Stats counts what an exporter did with its records.
+type Stats struct {
+	Batches  uint64 // delivered batches, including replays
+	Records  uint64 // records in delivered batches, excluding replays
+	Retries  uint64
+	Spooled  uint64 // batches written to the spool
+	Replayed uint64 // spooled batches delivered later
+	Dropped  uint64 // records lost to a full queue, permanent errors or a full spool
+	// SpoolBytes is the current spool size.
+	SpoolBytes int64
+}
+
+// queueSize is how many records may wait for their batch before Add
+// drops records.
+const queueSize = 4096
+
+// Exporter batches records for one destination. Records are delivered
+// from its own goroutine.
+type Exporter struct {
+	name   string
+	opts   Options
+	encode Encoder
+	send   Sender
+	spool  *spool
+
+	queue chan []byte
+	stop  chan struct{}
+	done  chan struct{}
+	once  sync.Once
+
+	batches, records, retries, spooled, replayed, dropped atomic.Uint64
+}
+
+// New starts an exporter named name, which also names its spool
+// subdirectory.
+func New(name string, opts Options, encode Encoder, send Sender) (*Exporter, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	e := &Exporter{
+		name:   name,
+		opts:   opts.withDefaults(),
+		encode: encode,
+		send:   send,
+		queue:  make(chan []byte, queueSize),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if opts.SpoolDir != "" {
+		key, err := seal.Load(opts.SpoolKey)
+		if err != nil {
+			return nil, fmt.Errorf("spool: %v", err)
+		}
+		s, err := openSpool(opts.SpoolDir, name, e.opts.SpoolLimit, key)
+		if err != nil {
+			return nil, err
+		}
+		e.spool = s
+	}
+	go e.run()
+	return e, nil
+}
+
+// Add queues one encoded record. It never blocks and reports false when
+// the record was dropped because the queue is full.
+func (e *Exporter) Add(record []byte) bool {
+	select {
+	case e.queue <- record:
+		return true
+	default:
+		e.dropped.Add(1)
+		return false
+	}
+}
+
+// Close delivers the queued records, trying each remaining batch once
+// before spooling it, and stops the exporter.
+func (e *Exporter) Close() {
+	e.once.Do(func() {
+		close(e.stop)
+		<-e.done
+	})
+}
+
+// Stats returns the exporter's counters.
+func (e *Exporter) Stats() Stats {
+	s := Stats{
+		Batches:  e.batches.Load(),
+		Records:  e.records.Load(),
+		Retries:  e.retries.Load(),
+		Spooled:  e.spooled.Load(),
+		Replayed: e.replayed.Load(),
+		Dropped:  e.dropped.Load(),
+	}
+	if e.spool != nil {
+		s.SpoolBytes = e.spool.size()
+	}
+	return s
+}
+
+func (e *Exporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(time.Duration(e.opts.BatchInterval))
+	defer ticker.Stop()
+
+	var batch [][]byte
+	for {
+		select {
+		case r := <-e.queue:
+			batch = append(batch, r)
+			if len(batch) >= e.opts.BatchSize {
+				e.flush(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				e.flush(batch)
+				batch = nil
+			}
+			e.replay()
+		case <-e.stop:
+			for drained := false; !drained; {
+				select {
+				case r := <-e.queue:
+					batch = append(batch, r)
+					if len(batch) >= e.opts.BatchSize {
+						e.flush(batch)
+						batch = nil
+					}
+				default:
+					drained = true
+				}
+			}
+			if len(batch) > 0 {
+				e.flush(batch)
+			}
+			return
+		}
+	}
+}
+
+func (e *Exporter) stopping() bool {
+	select {
+	case <-e.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// flush encodes, compresses and delivers one batch.
+func (e *Exporter) flush(batch [][]byte) {
+	body, err := e.encode(batch)
+	if err != nil {
+		e.dropped.Add(uint64(len(batch)))
+		return
+	}
+	body, encoding, err := compress(body, e.opts.Compression)
+	if err != nil {
+		e.dropped.Add(uint64(len(batch)))
+		return
+	}
+	if err := e.deliver(body, encoding); err != nil {
+		if errors.As(err, new(permanent)) || !e.park(body, encoding) {
+			e.dropped.Add(uint64(len(batch)))
+		}
+		return
+	}
+	e.records.Add(uint64(len(batch)))
+	// The collector is back; catch up on what it missed
+	e.replay()
+}
+
+// deliver sends body, retrying with exponential backoff and jitter. Once
+// the exporter is stopping each batch gets a single attempt.
+func (e *Exporter) deliver(body []byte, encoding string) error {
+	backoff := time.Duration(e.opts.Backoff)
+	for attempt := 0; ; attempt++ {
+		err := e.send(body, encoding)
+		if err == nil {
+			e.batches.Add(1)
+			return nil
+		}
+		if errors.As(err, new(permanent)) || attempt >= e.opts.Retries || e.stopping() {
+			return err
+		}
+		e.retries.Add(1)
+		// +-20% so agents restarted together do not retry in lockstep
+		jitter := time.Duration(rand.Int63n(int64(backoff)/5*2+1)) - backoff/5
+		select {
+		case <-time.After(backoff + jitter):
+		case <-e.stop:
+		}
+		if backoff *= 2; backoff > time.Duration(e.opts.MaxBackoff) {
+			backoff = time.Duration(e.opts.MaxBackoff)
+		}
+	}
+}
+
+// park spools a batch that exhausted its retries.
+func (e *Exporter) park(body []byte, encoding string) bool {
+	if e.spool == nil {
+		return false
+	}
+	if err := e.spool.push(body, encoding); err != nil {
+		return false
+	}
+	e.spooled.Add(1)
+	return true
+}
+
+// replay delivers spooled batches oldest first, once each, until one
+// fails.
+func (e *Exporter) replay() {
+	if e.spool == nil {
+		return
+	}
+	for !e.stopping() {
+		body, encoding, ok := e.spool.peek()
+		if !ok {
+			return
+		}
+		if err := e.send(body, encoding); err != nil && !errors.As(err, new(permanent)) {
+			return
+		} else if err == nil {
+			e.batches.Add(1)
+			e.replayed.Add(1)
+		}
+		e.spool.pop()
+	}
+}
+
+// compress encodes body with algorithm and returns its Content-Encoding.
+func compress(body []byte, algorithm string) ([]byte, string, error) {
+	switch algorithm {
+	case Gzip:
+		var b bytes.Buffer
+		zw := gzip.NewWriter(&b)
+		if _, err := zw.Write(body); err != nil {
+			return nil, "", err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, "", err
+		}
+		return b.Bytes(), Gzip, nil
+	case Zstd:
+		return zstdCompress(body), Zstd, nil
+	}
+	return body, "", nil
+}
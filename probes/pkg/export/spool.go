@@ -0,0 +1,152 @@
+package export
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"probepilot/pkg/seal"
+)
+
+// spool is an on-disk FIFO of encoded batches, one file per batch named
+// by sequence number and Content-Encoding, e.g. 00000000000000000042.gzip.
+// It survives restarts, so batches spooled before an agent upgrade are
+// replayed by the next one. With a key, batches are sealed on disk.
+type spool struct {
+	dir   string
+	limit int64
+	key   *seal.Key
+
+	mu    sync.Mutex
+	files []spoolFile // oldest first
+	bytes int64
+	next  uint64
+}
+
+type spoolFile struct {
+	seq      uint64
+	encoding string
+	size     int64
+}
+
+func (f spoolFile) name() string {
+	ext := f.encoding
+	if ext == "" {
+		ext = None
+	}
+	return fmt.Sprintf("%020d.%s", f.seq, ext)
+}
+
+func openSpool(dir, name string, limit int64, key *seal.Key) (*spool, error) {
+	s := &spool{dir: filepath.Join(dir, name), limit: limit, key: key}
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return nil, fmt.Errorf("spool: %v", err)
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("spool: %v", err)
+	}
+	for _, ent := range entries {
+		seqPart, ext, ok := strings.Cut(ent.Name(), ".")
+		seq, err := strconv.ParseUint(seqPart, 10, 64)
+		if !ok || err != nil || ent.IsDir() {
+			continue // temporary or foreign files
+		}
+		info, err := ent.Info()
+		if err != nil {
+			continue
+		}
+		if ext == None {
+			ext = ""
+		}
+		s.files = append(s.files, spoolFile{seq: seq, encoding: ext, size: info.Size()})
+		s.bytes += info.Size()
+		if seq >= s.next {
+			s.next = seq + 1
+		}
+	}
+	sort.Slice(s.files, func(i, j int) bool { return s.files[i].seq < s.files[j].seq })
+	return s, nil
+}
+
+// push appends a batch, evicting the oldest ones past the limit.
+func (s *spool) push(body []byte, encoding string) error {
+	if s.key != nil {
+		body = s.key.Seal(body)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if int64(len(body)) > s.limit {
+		return fmt.Errorf("spool: batch of %d bytes exceeds the %d byte limit", len(body), s.limit)
+	}
+	for len(s.files) > 0 && s.bytes+int64(len(body)) > s.limit {
+		s.removeOldest()
+	}
+	f := spoolFile{seq: s.next, encoding: encoding, size: int64(len(body))}
+	// Write aside and rename so a crash never leaves half a batch
+	tmp := filepath.Join(s.dir, ".tmp-"+f.name())
+	if err := os.WriteFile(tmp, body, 0o600); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("spool: %v", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, f.name())); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("spool: %v", err)
+	}
+	s.next++
+	s.files = append(s.files, f)
+	s.bytes += f.size
+	return nil
+}
+
+// peek returns the oldest batch. Unreadable files, and sealed ones
+// without the key to open them, are skipped.
+func (s *spool) peek() ([]byte, string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.files) > 0 {
+		f := s.files[0]
+		body, err := os.ReadFile(filepath.Join(s.dir, f.name()))
+		if err == nil && seal.IsSealed(body) {
+			if s.key == nil {
+				err = errors.New("sealed")
+			} else {
+				body, err = s.key.Open(body)
+			}
+		}
+		if err == nil {
+			return body, f.encoding, true
+		}
+		log.Printf("Warning: spool %s: dropping %s: %v", s.dir, f.name(), err)
+		s.removeOldest()
+	}
+	return nil, "", false
+}
+
+// pop removes the oldest batch.
+func (s *spool) pop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.files) > 0 {
+		s.removeOldest()
+	}
+}
+
+func (s *spool) removeOldest() {
+	f := s.files[0]
+	os.Remove(filepath.Join(s.dir, f.name()))
+	s.files = s.files[1:]
+	s.bytes -= f.size
+}
+
+func (s *spool) size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bytes
+}
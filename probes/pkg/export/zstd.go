@@ -0,0 +1,348 @@
+package export
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// A small Zstandard (RFC 8878) encoder, so agents can compress exports
+// without a cgo or third-party dependency. It finds matches greedily with
+// a hash table, stores literals raw and codes sequences with the
+// predefined FSE tables, which needs no table description in the stream.
+// That gives up some ratio against the reference encoder but compresses
+// repetitive JSON batches well, and any zstd decoder reads the output.
+
+const (
+	zstdMagic        = 0xFD2FB528
+	zstdMaxBlockSize = 128 << 10
+	zstdMinMatch     = 4
+	zstdHashLog      = 16
+	// Offset codes above 28 have no predefined probability
+	zstdMaxOffset = 1<<28 - 4
+)
+
+// Predefined distributions of literal lengths, match lengths and offset
+// codes (RFC 8878 3.1.1.3.2.2).
+var (
+	llDefaultNorm = []int16{4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1, -1, -1, -1, -1}
+	mlDefaultNorm = []int16{1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1, -1, -1}
+	ofDefaultNorm = []int16{1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1}
+
+	llTable = newFSETable(llDefaultNorm, 6)
+	mlTable = newFSETable(mlDefaultNorm, 6)
+	ofTable = newFSETable(ofDefaultNorm, 5)
+)
+
+// Baselines and extra bits of literal length codes 16-35 and match length
+// codes 32-52; smaller codes stand for their value.
+var (
+	llBase = []uint32{16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512,
+		1024, 2048, 4096, 8192, 16384, 32768, 65536}
+	llBits = []uint8{1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	mlBase = []uint32{35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259,
+		515, 1027, 2051, 4099, 8195, 16387, 32771, 65539}
+	mlBits = []uint8{1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+)
+
+// fseTable is an FSE compression table built from a normalized
+// distribution the way decoders build their decoding table.
+type fseTable struct {
+	log    uint
+	states []uint16
+	syms   []fseSymbol
+}
+
+type fseSymbol struct {
+	deltaNbBits    uint32
+	deltaFindState int32
+}
+
+func newFSETable(norm []int16, tableLog uint) *fseTable {
+	size := 1 << tableLog
+	mask := size - 1
+	t := &fseTable{log: tableLog, states: make([]uint16, size), syms: make([]fseSymbol, len(norm))}
+
+	// Low probability symbols take the top cells, the rest are spread
+	symbols := make([]int, size)
+	cumul := make([]int, len(norm)+1)
+	high := size - 1
+	for s, n := range norm {
+		if n == -1 {
+			cumul[s+1] = cumul[s] + 1
+			symbols[high] = s
+			high--
+		} else {
+			cumul[s+1] = cumul[s] + int(n)
+		}
+	}
+	step := size>>1 + size>>3 + 3
+	pos := 0
+	for s, n := range norm {
+		for i := 0; i < int(n); i++ {
+			symbols[pos] = s
+			pos = (pos + step) & mask
+			for pos > high {
+				pos = (pos + step) & mask
+			}
+		}
+	}
+	for u := 0; u < size; u++ {
+		s := symbols[u]
+		t.states[cumul[s]] = uint16(size + u)
+		cumul[s]++
+	}
+
+	total := 0
+	for s, n := range norm {
+		switch n {
+		case 0:
+		case -1, 1:
+			t.syms[s] = fseSymbol{
+				deltaNbBits:    uint32(tableLog<<16) - uint32(size),
+				deltaFindState: int32(total - 1),
+			}
+			total++
+		default:
+			maxBitsOut := tableLog - uint(bits.Len32(uint32(n-1))-1)
+			minStatePlus := uint32(n) << maxBitsOut
+			t.syms[s] = fseSymbol{
+				deltaNbBits:    uint32(maxBitsOut<<16) - minStatePlus,
+				deltaFindState: int32(total - int(n)),
+			}
+			total += int(n)
+		}
+	}
+	return t
+}
+
+type fseState struct {
+	t     *fseTable
+	value uint32
+}
+
+func (t *fseTable) init(sym uint8) fseState {
+	st := t.syms[sym]
+	nbBitsOut := (st.deltaNbBits + 1<<15) >> 16
+	value := nbBitsOut<<16 - st.deltaNbBits
+	return fseState{t: t, value: uint32(t.states[int32(value>>nbBitsOut)+st.deltaFindState])}
+}
+
+func (s *fseState) encode(w *bitWriter, sym uint8) {
+	st := s.t.syms[sym]
+	nbBitsOut := (s.value + st.deltaNbBits) >> 16
+	w.add(uint64(s.value), uint(nbBitsOut))
+	s.value = uint32(s.t.states[int32(s.value>>nbBitsOut)+st.deltaFindState])
+}
+
+func (s *fseState) flush(w *bitWriter) {
+	w.add(uint64(s.value), s.t.log)
+}
+
+// bitWriter writes bits least significant first, the order decoders read
+// back from the end of the stream.
+type bitWriter struct {
+	out   []byte
+	acc   uint64
+	nbits uint
+}
+
+func (w *bitWriter) add(v uint64, n uint) {
+	if n == 0 {
+		return
+	}
+	w.acc |= (v & (1<<n - 1)) << w.nbits
+	w.nbits += n
+	for w.nbits >= 8 {
+		w.out = append(w.out, byte(w.acc))
+		w.acc >>= 8
+		w.nbits -= 8
+	}
+}
+
+// close appends the end mark decoders look for and pads to a byte.
+func (w *bitWriter) close() []byte {
+	w.add(1, 1)
+	if w.nbits > 0 {
+		w.out = append(w.out, byte(w.acc))
+	}
+	return w.out
+}
+
+type sequence struct {
+	litLen, matchLen, offset uint32
+}
+
+func llCode(v uint32) uint8 {
+	if v < 16 {
+		return uint8(v)
+	}
+	for i := len(llBase) - 1; ; i-- {
+		if v >= llBase[i] {
+			return uint8(16 + i)
+		}
+	}
+}
+
+func mlCode(v uint32) uint8 {
+	if v < 35 {
+		return uint8(v - 3)
+	}
+	for i := len(mlBase) - 1; ; i-- {
+		if v >= mlBase[i] {
+			return uint8(32 + i)
+		}
+	}
+}
+
+// zstdCompress returns src as a single-segment Zstandard frame.
+func zstdCompress(src []byte) []byte {
+	out := binary.LittleEndian.AppendUint32(nil, zstdMagic)
+	// Single segment with an 8-byte content size: no window descriptor
+	out = append(out, 0xE0)
+	out = binary.LittleEndian.AppendUint64(out, uint64(len(src)))
+
+	table := make([]int32, 1<<zstdHashLog)
+	for i := range table {
+		table[i] = -1
+	}
+	for start := 0; ; {
+		end := start + zstdMaxBlockSize
+		if end > len(src) {
+			end = len(src)
+		}
+		last := end == len(src)
+		out = appendBlock(out, src, start, end, table, last)
+		if last {
+			return out
+		}
+		start = end
+	}
+}
+
+func hash4(b []byte) uint32 {
+	return (binary.LittleEndian.Uint32(b) * 2654435761) >> (32 - zstdHashLog)
+}
+
+// appendBlock compresses src[start:end], matching against everything
+// before it, and falls back to a raw block when that does not pay.
+func appendBlock(out, src []byte, start, end int, table []int32, last bool) []byte {
+	var seqs []sequence
+	var literals []byte
+	anchor := start
+	for i := start; i+zstdMinMatch <= end; {
+		h := hash4(src[i:])
+		cand := int(table[h])
+		table[h] = int32(i)
+		if cand < 0 || i-cand > zstdMaxOffset ||
+			binary.LittleEndian.Uint32(src[cand:]) != binary.LittleEndian.Uint32(src[i:]) {
+			i++
+			continue
+		}
+		n := zstdMinMatch
+		for i+n < end && src[cand+n] == src[i+n] {
+			n++
+		}
+		literals = append(literals, src[anchor:i]...)
+		seqs = append(seqs, sequence{litLen: uint32(i - anchor), matchLen: uint32(n), offset: uint32(i - cand)})
+		i += n
+		anchor = i
+	}
+	literals = append(literals, src[anchor:end]...)
+
+	var block []byte
+	if len(seqs) > 0 {
+		block = appendLiterals(nil, literals)
+		block = appendSequences(block, seqs)
+	}
+	header := uint32(0)
+	if last {
+		header = 1
+	}
+	if len(seqs) == 0 || len(block) >= end-start {
+		header |= uint32(end-start) << 3 // raw
+		out = append(out, byte(header), byte(header>>8), byte(header>>16))
+		return append(out, src[start:end]...)
+	}
+	header |= 2<<1 | uint32(len(block))<<3
+	out = append(out, byte(header), byte(header>>8), byte(header>>16))
+	return append(out, block...)
+}
+
+// appendLiterals writes a raw literals section.
+func appendLiterals(out, lit []byte) []byte {
+	n := len(lit)
+	switch {
+	case n < 32:
+		out = append(out, byte(n<<3))
+	case n < 4096:
+		out = append(out, byte(1<<2|n<<4), byte(n>>4))
+	default:
+		out = append(out, byte(3<<2|n<<4), byte(n>>4), byte(n>>12))
+	}
+	return append(out, lit...)
+}
+
+// appendSequences writes the sequences section with predefined tables.
+// Sequences are coded last to first so decoders read them in order.
+func appendSequences(out []byte, seqs []sequence) []byte {
+	n := len(seqs)
+	switch {
+	case n < 128:
+		out = append(out, byte(n))
+	case n < 0x7F00:
+		out = append(out, byte(n>>8+128), byte(n))
+	default:
+		out = append(out, 255, byte(n-0x7F00), byte((n-0x7F00)>>8))
+	}
+	out = append(out, 0) // predefined mode for all three tables
+
+	type coded struct {
+		ll, ml, of       uint8
+		llExtra, mlExtra uint32
+		ofBase           uint32
+	}
+	codes := make([]coded, n)
+	for i, s := range seqs {
+		c := coded{ll: llCode(s.litLen), ml: mlCode(s.matchLen)}
+		if c.ll >= 16 {
+			c.llExtra = s.litLen - llBase[c.ll-16]
+		}
+		if c.ml >= 32 {
+			c.mlExtra = s.matchLen - mlBase[c.ml-32]
+		}
+		// Offset values 1-3 are repeat offsets; real offsets are shifted
+		// past them
+		c.ofBase = s.offset + 3
+		c.of = uint8(bits.Len32(c.ofBase) - 1)
+		codes[i] = c
+	}
+	extra := func(w *bitWriter, c coded) {
+		if c.ll >= 16 {
+			w.add(uint64(c.llExtra), uint(llBits[c.ll-16]))
+		}
+		if c.ml >= 32 {
+			w.add(uint64(c.mlExtra), uint(mlBits[c.ml-32]))
+		}
+		w.add(uint64(c.ofBase), uint(c.of))
+	}
+
+	var w bitWriter
+	c := codes[n-1]
+	ml, of, ll := mlTable.init(c.ml), ofTable.init(c.of), llTable.init(c.ll)
+	extra(&w, c)
+	for i := n - 2; i >= 0; i-- {
+		c := codes[i]
+		of.encode(&w, c.of)
+		ml.encode(&w, c.ml)
+		ll.encode(&w, c.ll)
+		extra(&w, c)
+	}
+	ml.flush(&w)
+	of.flush(&w)
+	ll.flush(&w)
+	return append(out, w.close()...)
+}
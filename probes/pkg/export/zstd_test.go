@@ -0,0 +1,95 @@
+package export
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// zstdInputs covers empty and tiny inputs, raw and compressed blocks, long
+// matches and offsets, and inputs spanning several blocks
+func zstdInputs() map[string][]byte {
+	rng := rand.New(rand.NewSource(1))
+	random := make([]byte, 200<<10)
+	rng.Read(random)
+
+	var batch strings.Builder
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&batch, `{"name":"tcp_flow_bytes_tx","labels":{"pid":"%d","comm":"nginx"},"value":%d}`+"\n", i%37, rng.Intn(1<<20))
+	}
+
+	// Random words, so matches come at varied lengths and offsets
+	words := []string{"alloc", "free", "mmap", "java", "nginx", "retransmit", "0x7f12", "{", "}", ","}
+	var mixed bytes.Buffer
+	for mixed.Len() < 300<<10 {
+		mixed.WriteString(words[rng.Intn(len(words))])
+		if rng.Intn(50) == 0 {
+			mixed.Write(random[:rng.Intn(64)])
+		}
+	}
+
+	return map[string][]byte{
+		"empty":   {},
+		"byte":    {'x'},
+		"short":   []byte("abc"),
+		"repeat":  bytes.Repeat([]byte("a"), 1<<20),
+		"random":  random,
+		"batch":   []byte(batch.String()),
+		"mixed":   mixed.Bytes(),
+		"period":  bytes.Repeat([]byte("0123456789abcdef"), 20000),
+		"trailer": append(bytes.Repeat([]byte("abcd"), 100), "xyz"...),
+	}
+}
+
+func TestZstdFrameHeader(t *testing.T) {
+	for name, in := range zstdInputs() {
+		out := zstdCompress(in)
+		if len(out) < 13 || binary.LittleEndian.Uint32(out) != zstdMagic {
+			t.Errorf("%s: frame does not start with the magic number", name)
+			continue
+		}
+		if size := binary.LittleEndian.Uint64(out[5:]); size != uint64(len(in)) {
+			t.Errorf("%s: content size %d, want %d", name, size, len(in))
+		}
+	}
+}
+
+func TestZstdCompresses(t *testing.T) {
+	in := zstdInputs()
+	for _, name := range []string{"repeat", "batch", "period"} {
+		if out := zstdCompress(in[name]); len(out) > len(in[name])/4 {
+			t.Errorf("%s: %d bytes compressed to %d", name, len(in[name]), len(out))
+		}
+	}
+	// Incompressible input falls back to raw blocks, at little cost
+	if out := zstdCompress(in["random"]); len(out) > len(in["random"])+64 {
+		t.Errorf("random: %d bytes grew to %d", len(in["random"]), len(out))
+	}
+}
+
+// TestZstdRoundTrip decodes the frames with the reference zstd tool, the
+// decoder collectors use, where it is installed
+func TestZstdRoundTrip(t *testing.T) {
+	zstd, err := exec.LookPath("zstd")
+	if err != nil {
+		t.Skip("zstd not installed")
+	}
+	for name, in := range zstdInputs() {
+		cmd := exec.Command(zstd, "-d", "-c", "-q")
+		cmd.Stdin = bytes.NewReader(zstdCompress(in))
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			t.Errorf("%s: zstd -d: %v: %s", name, err, stderr.String())
+			continue
+		}
+		if !bytes.Equal(out, in) {
+			t.Errorf("%s: decoded %d bytes differing from the %d compressed", name, len(out), len(in))
+		}
+	}
+}
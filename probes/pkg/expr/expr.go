@@ -0,0 +1,511 @@
+// Package expr evaluates filter expressions over events, in a subset of
+// the Common Expression Language (CEL):
+//
+//	event.size > 1<<20 && event.comm.startsWith("java")
+//	event.type in ["oom", "connect_failed"] || text.contains("retransmit")
+//	has(event.container) ? event.container != "kube-proxy" : true
+//
+// event holds the event's labels by name, as event.comm or
+// event["comm"], and text its text. Labels are strings, compared and
+// computed with as numbers where the other side is a number, so
+// event.size > 1024 compares sizes, not strings.
+//
+// The operators are CEL's, with Go's << and >>: ! - * / % << >> + - == !=
+// < <= > >= in && || and ?:. The functions are size, int, double, string
+// and has, and the string methods startsWith, endsWith, contains, matches
+// (an RE2 regular expression, unanchored) and size.
+//
+// As in CEL, && and || absorb errors their other side decides: a missing
+// label fails event.size > 1024, but not event.type == "exit" ||
+// event.size > 1024 for an exit event.
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"probepilot/pkg/query"
+)
+
+// Program is a compiled expression.
+type Program struct {
+	src  string
+	root node
+}
+
+// Compile parses src.
+func Compile(src string) (*Program, error) {
+	p := &parser{lex: lexer{input: src}}
+	p.next()
+	root, err := p.parseCond()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %s", p.tok)
+	}
+	return &Program{src: src, root: root}, nil
+}
+
+func (p *Program) String() string {
+	return p.src
+}
+
+// Match evaluates the program over an event. It is an error if the
+// program does not evaluate to a bool, e.g. for want of a label.
+func (p *Program) Match(labels query.Labels, text string) (bool, error) {
+	v, err := p.root.eval(&env{labels: labels, text: text})
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("%s is %s, not a bool", p.src, typeName(v))
+	}
+	return b, nil
+}
+
+// env is what an expression is evaluated over.
+type env struct {
+	labels query.Labels
+	text   string
+}
+
+// A value is a string, int64, float64, bool or []any.
+type node interface {
+	eval(e *env) (any, error)
+}
+
+type literal struct{ v any }
+
+func (n *literal) eval(*env) (any, error) { return n.v, nil }
+
+type eventNode struct{}
+
+func (eventNode) eval(*env) (any, error) {
+	return nil, errors.New("event is not a value; name a label, e.g. event.comm")
+}
+
+type textNode struct{}
+
+func (textNode) eval(e *env) (any, error) { return e.text, nil }
+
+type fieldNode struct{ name node }
+
+func (n *fieldNode) label(e *env) (string, bool, error) {
+	v, err := n.name.eval(e)
+	if err != nil {
+		return "", false, err
+	}
+	name, ok := v.(string)
+	if !ok {
+		return "", false, fmt.Errorf("label names are strings, not %s", typeName(v))
+	}
+	value, ok := e.labels[name]
+	if !ok {
+		return name, false, nil
+	}
+	return value, true, nil
+}
+
+func (n *fieldNode) eval(e *env) (any, error) {
+	v, ok, err := n.label(e)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("no label %q", v)
+	}
+	return v, nil
+}
+
+type hasNode struct{ field *fieldNode }
+
+func (n *hasNode) eval(e *env) (any, error) {
+	_, ok, err := n.field.label(e)
+	return ok, err
+}
+
+type listNode struct{ items []node }
+
+func (n *listNode) eval(e *env) (any, error) {
+	list := make([]any, len(n.items))
+	for i, item := range n.items {
+		v, err := item.eval(e)
+		if err != nil {
+			return nil, err
+		}
+		list[i] = v
+	}
+	return list, nil
+}
+
+type condNode struct{ c, t, f node }
+
+func (n *condNode) eval(e *env) (any, error) {
+	c, err := n.c.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := c.(bool)
+	if !ok {
+		return nil, fmt.Errorf("condition is %s, not a bool", typeName(c))
+	}
+	if b {
+		return n.t.eval(e)
+	}
+	return n.f.eval(e)
+}
+
+type unaryNode struct {
+	op string
+	x  node
+}
+
+func (n *unaryNode) eval(e *env) (any, error) {
+	v, err := n.x.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	if n.op == "!" {
+		b, ok := v.(bool)
+		if !ok {
+			return nil, fmt.Errorf("! of %s", typeName(v))
+		}
+		return !b, nil
+	}
+	switch v := number(v).(type) {
+	case int64:
+		return -v, nil
+	case float64:
+		return -v, nil
+	}
+	return nil, fmt.Errorf("- of %s", typeName(v))
+}
+
+type binaryNode struct {
+	op   string
+	x, y node
+}
+
+func (n *binaryNode) eval(e *env) (any, error) {
+	if n.op == "&&" || n.op == "||" {
+		return n.logical(e)
+	}
+	x, err := n.x.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	y, err := n.y.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "in":
+		list, ok := y.([]any)
+		if !ok {
+			return nil, fmt.Errorf("in takes a list, not %s", typeName(y))
+		}
+		for _, item := range list {
+			if eq, err := equal(x, item); err == nil && eq {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "==", "!=":
+		eq, err := equal(x, y)
+		if err != nil {
+			return nil, err
+		}
+		return eq == (n.op == "=="), nil
+	case "<", "<=", ">", ">=":
+		c, err := compare(x, y)
+		if err != nil {
+			return nil, err
+		}
+		switch n.op {
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		}
+		return c >= 0, nil
+	}
+	return arithmetic(n.op, x, y)
+}
+
+// logical evaluates && and ||, whose errors are absorbed when the other
+// side decides the result.
+func (n *binaryNode) logical(e *env) (any, error) {
+	decides := n.op == "||"
+	x, xerr := boolOf(n.x.eval(e))
+	if xerr == nil && x == decides {
+		return decides, nil
+	}
+	y, yerr := boolOf(n.y.eval(e))
+	if yerr == nil && y == decides {
+		return decides, nil
+	}
+	if xerr != nil {
+		return nil, xerr
+	}
+	if yerr != nil {
+		return nil, yerr
+	}
+	return !decides, nil
+}
+
+func boolOf(v any, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("&& and || take bools, not %s", typeName(v))
+	}
+	return b, nil
+}
+
+type callNode struct {
+	fn   string
+	args []node
+	re   *regexp.Regexp
+}
+
+func (n *callNode) eval(e *env) (any, error) {
+	args := make([]any, len(n.args))
+	for i, arg := range n.args {
+		v, err := arg.eval(e)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	switch n.fn {
+	case "size":
+		switch v := args[0].(type) {
+		case string:
+			return int64(len([]rune(v))), nil
+		case []any:
+			return int64(len(v)), nil
+		}
+		return nil, fmt.Errorf("size of %s", typeName(args[0]))
+	case "int":
+		switch v := number(args[0]).(type) {
+		case int64:
+			return v, nil
+		case float64:
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				return nil, fmt.Errorf("int of %v", v)
+			}
+			return int64(v), nil
+		}
+		return nil, fmt.Errorf("int of %s", typeName(args[0]))
+	case "double":
+		switch v := number(args[0]).(type) {
+		case int64:
+			return float64(v), nil
+		case float64:
+			return v, nil
+		}
+		return nil, fmt.Errorf("double of %s", typeName(args[0]))
+	case "string":
+		switch v := args[0].(type) {
+		case string:
+			return v, nil
+		case int64:
+			return strconv.FormatInt(v, 10), nil
+		case float64:
+			return strconv.FormatFloat(v, 'g', -1, 64), nil
+		case bool:
+			return strconv.FormatBool(v), nil
+		}
+		return nil, fmt.Errorf("string of %s", typeName(args[0]))
+	}
+
+	// The string methods
+	s, ok := args[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("%s of %s", n.fn, typeName(args[0]))
+	}
+	arg, ok := args[1].(string)
+	if !ok {
+		return nil, fmt.Errorf("%s takes a string, not %s", n.fn, typeName(args[1]))
+	}
+	switch n.fn {
+	case "startsWith":
+		return strings.HasPrefix(s, arg), nil
+	case "endsWith":
+		return strings.HasSuffix(s, arg), nil
+	case "contains":
+		return strings.Contains(s, arg), nil
+	case "matches":
+		re := n.re
+		if re == nil {
+			var err error
+			if re, err = regexp.Compile(arg); err != nil {
+				return nil, err
+			}
+		}
+		return re.MatchString(s), nil
+	}
+	return nil, fmt.Errorf("unknown function %s", n.fn)
+}
+
+// number returns v as an int64 or float64 if it is or spells a number,
+// else v itself.
+func number(v any) any {
+	s, ok := v.(string)
+	if !ok {
+		return v
+	}
+	if i, err := strconv.ParseInt(s, 0, 64); err == nil {
+		return i
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f
+	}
+	return v
+}
+
+func isNumber(v any) bool {
+	switch v.(type) {
+	case int64, float64:
+		return true
+	}
+	return false
+}
+
+// operands converts a label compared or computed with a number.
+func operands(x, y any) (any, any) {
+	if isNumber(x) || isNumber(y) {
+		return number(x), number(y)
+	}
+	return x, y
+}
+
+func float(v any) float64 {
+	if i, ok := v.(int64); ok {
+		return float64(i)
+	}
+	return v.(float64)
+}
+
+func equal(x, y any) (bool, error) {
+	x, y = operands(x, y)
+	switch {
+	case isNumber(x) && isNumber(y):
+		c, err := compare(x, y)
+		return c == 0, err
+	case typeName(x) == typeName(y) && typeName(x) != "list":
+		return x == y, nil
+	}
+	return false, fmt.Errorf("cannot compare %s and %s", typeName(x), typeName(y))
+}
+
+func compare(x, y any) (int, error) {
+	x, y = operands(x, y)
+	if isNumber(x) && isNumber(y) {
+		if a, ok := x.(int64); ok {
+			if b, ok := y.(int64); ok {
+				switch {
+				case a < b:
+					return -1, nil
+				case a > b:
+					return 1, nil
+				}
+				return 0, nil
+			}
+		}
+		a, b := float(x), float(y)
+		switch {
+		case a < b:
+			return -1, nil
+		case a > b:
+			return 1, nil
+		}
+		return 0, nil
+	}
+	if a, ok := x.(string); ok {
+		if b, ok := y.(string); ok {
+			return strings.Compare(a, b), nil
+		}
+	}
+	return 0, fmt.Errorf("cannot order %s and %s", typeName(x), typeName(y))
+}
+
+func arithmetic(op string, x, y any) (any, error) {
+	if op == "+" {
+		if a, ok := x.(string); ok {
+			if b, ok := y.(string); ok && !(isNumber(number(a)) && isNumber(number(b))) {
+				return a + b, nil
+			}
+		}
+	}
+	x, y = number(x), number(y)
+	if !isNumber(x) || !isNumber(y) {
+		return nil, fmt.Errorf("%s of %s and %s", op, typeName(x), typeName(y))
+	}
+	a, aInt := x.(int64)
+	b, bInt := y.(int64)
+	if aInt && bInt {
+		switch op {
+		case "+":
+			return a + b, nil
+		case "-":
+			return a - b, nil
+		case "*":
+			return a * b, nil
+		case "/", "%":
+			if b == 0 {
+				return nil, errors.New("division by zero")
+			}
+			if op == "/" {
+				return a / b, nil
+			}
+			return a % b, nil
+		case "<<", ">>":
+			if b < 0 || b > 63 {
+				return nil, fmt.Errorf("shift by %d", b)
+			}
+			if op == "<<" {
+				return a << b, nil
+			}
+			return a >> b, nil
+		}
+	}
+	fa, fb := float(x), float(y)
+	switch op {
+	case "+":
+		return fa + fb, nil
+	case "-":
+		return fa - fb, nil
+	case "*":
+		return fa * fb, nil
+	case "/":
+		return fa / fb, nil
+	}
+	return nil, fmt.Errorf("%s takes integers", op)
+}
+
+func typeName(v any) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case int64:
+		return "int"
+	case float64:
+		return "double"
+	case bool:
+		return "bool"
+	case []any:
+		return "list"
+	}
+	return "null"
+}
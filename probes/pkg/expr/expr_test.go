@@ -0,0 +1,93 @@
+package expr
+
+import (
+	"testing"
+
+	"probepilot/pkg/query"
+)
+
+var event = query.Labels{
+	"type":      "alloc",
+	"comm":      "java-worker",
+	"size":      "2097152",
+	"pid":       "42",
+	"container": "kube-proxy",
+}
+
+const text = "large allocation of 2MiB, retransmit"
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		src  string
+		want bool
+	}{
+		{`event.size > 1<<20 && event.comm.startsWith("java")`, true},
+		{`event.size > 1024 * 4096`, false},
+		{`event["comm"] == "java-worker"`, true},
+		{`event.type in ["oom", "connect_failed"] || text.contains("retransmit")`, true},
+		{`event.type in ["oom", "connect_failed"]`, false},
+		{`has(event.container) ? event.container != "kube-proxy" : true`, false},
+		{`has(event.missing) ? false : true`, true},
+		{`event.comm.matches("^java-[a-z]+$")`, true},
+		{`event.comm.endsWith("worker") && !event.comm.contains("python")`, true},
+		{`event.comm.size() == 11 && size(text) > 10`, true},
+		{`int(event.pid) % 2 == 0 && double(event.pid) / 4.0 == 10.5`, true},
+		{`string(event.pid + 1) == "43"`, true},
+		{`-event.pid < 0 && event.size >> 20 == 2`, true},
+		// A missing label fails a comparison, but not one || decides
+		{`event.type == "alloc" || event.missing > 1`, true},
+		{`event.type == "exit" && event.missing > 1`, false},
+	}
+	for _, tt := range tests {
+		p, err := Compile(tt.src)
+		if err != nil {
+			t.Errorf("Compile(%q): %v", tt.src, err)
+			continue
+		}
+		got, err := p.Match(event, text)
+		if err != nil {
+			t.Errorf("%q: %v", tt.src, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestMatchErrors(t *testing.T) {
+	for _, src := range []string{
+		`event.missing > 1`,
+		`event.size`,
+		`event.comm + 1`,
+		`1 / 0 == 1`,
+	} {
+		p, err := Compile(src)
+		if err != nil {
+			t.Errorf("Compile(%q): %v", src, err)
+			continue
+		}
+		if got, err := p.Match(event, text); err == nil {
+			t.Errorf("%q = %v, want error", src, got)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, src := range []string{
+		``,
+		`event.size >`,
+		`(event.size > 1`,
+		`event.comm.startsWith(`,
+		`unknown(event.comm)`,
+		`event.comm.matches("(")`,
+		`event.type in ["a", `,
+		`"unterminated`,
+		`true ? false`,
+		`event.size > 1 1`,
+	} {
+		if p, err := Compile(src); err == nil {
+			t.Errorf("Compile(%q) = %v, want error", src, p)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package expr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokInt
+	tokFloat
+	tokString
+	tokOp
+	tokLParen
+	tokRParen
+	tokLBracket
+	tokRBracket
+	tokComma
+	tokDot
+	tokError
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of expression"
+	case tokString:
+		return strconv.Quote(t.text)
+	case tokError:
+		return t.text
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// operators, longest first so that "<=" is not read as "<"
+var operators = []string{"&&", "||", "==", "!=", "<=", ">=", "<<", ">>", "<", ">", "!", "+", "-", "*", "/", "%", "?", ":"}
+
+type lexer struct {
+	input string
+	pos   int
+}
+
+func (l *lexer) next() token {
+	for l.pos < len(l.input) && strings.ContainsRune(" \t\r\n", rune(l.input[l.pos])) {
+		l.pos++
+	}
+	start := l.pos
+	if l.pos >= len(l.input) {
+		return token{kind: tokEOF, pos: start}
+	}
+	c := l.input[l.pos]
+	switch {
+	case c == '(':
+		l.pos++
+		return token{kind: tokLParen, text: "(", pos: start}
+	case c == ')':
+		l.pos++
+		return token{kind: tokRParen, text: ")", pos: start}
+	case c == '[':
+		l.pos++
+		return token{kind: tokLBracket, text: "[", pos: start}
+	case c == ']':
+		l.pos++
+		return token{kind: tokRBracket, text: "]", pos: start}
+	case c == ',':
+		l.pos++
+		return token{kind: tokComma, text: ",", pos: start}
+	case c == '.' && !(l.pos+1 < len(l.input) && isDigit(l.input[l.pos+1])):
+		l.pos++
+		return token{kind: tokDot, text: ".", pos: start}
+	case c == '"' || c == '\'':
+		return l.lexString(c)
+	case isDigit(c) || c == '.':
+		return l.lexNumber()
+	case isIdentStart(c):
+		for l.pos < len(l.input) && isIdentChar(l.input[l.pos]) {
+			l.pos++
+		}
+		return token{kind: tokIdent, text: l.input[start:l.pos], pos: start}
+	}
+	for _, op := range operators {
+		if strings.HasPrefix(l.input[l.pos:], op) {
+			l.pos += len(op)
+			return token{kind: tokOp, text: op, pos: start}
+		}
+	}
+	l.pos++
+	return token{kind: tokError, text: fmt.Sprintf("unexpected character %q", c), pos: start}
+}
+
+func (l *lexer) lexNumber() token {
+	start := l.pos
+	if strings.HasPrefix(l.input[l.pos:], "0x") || strings.HasPrefix(l.input[l.pos:], "0X") {
+		l.pos += 2
+		for l.pos < len(l.input) && strings.ContainsRune("0123456789abcdefABCDEF", rune(l.input[l.pos])) {
+			l.pos++
+		}
+		return token{kind: tokInt, text: l.input[start:l.pos], pos: start}
+	}
+	kind := tokInt
+	for l.pos < len(l.input) {
+		c := l.input[l.pos]
+		switch {
+		case isDigit(c):
+		case c == '.' || c == 'e' || c == 'E':
+			kind = tokFloat
+		case (c == '+' || c == '-') && (l.input[l.pos-1] == 'e' || l.input[l.pos-1] == 'E'):
+		default:
+			return token{kind: kind, text: l.input[start:l.pos], pos: start}
+		}
+		l.pos++
+	}
+	return token{kind: kind, text: l.input[start:l.pos], pos: start}
+}
+
+// lexString reads a string in single or double quotes, with Go escapes.
+func (l *lexer) lexString(quote byte) token {
+	start := l.pos
+	l.pos++
+	var b strings.Builder
+	for l.pos < len(l.input) {
+		c := l.input[l.pos]
+		if c == quote {
+			l.pos++
+			return token{kind: tokString, text: b.String(), pos: start}
+		}
+		if c != '\\' {
+			b.WriteByte(c)
+			l.pos++
+			continue
+		}
+		r, _, tail, err := strconv.UnquoteChar(l.input[l.pos:], quote)
+		if err != nil {
+			return token{kind: tokError, text: "invalid escape in string", pos: l.pos}
+		}
+		b.WriteRune(r)
+		l.pos = len(l.input) - len(tail)
+	}
+	return token{kind: tokError, text: "unterminated string", pos: start}
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentChar(c byte) bool { return isIdentStart(c) || isDigit(c) }
@@ -0,0 +1,291 @@
+package expr
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// precedence of binary operators; higher binds tighter
+var precedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3, "!=": 3, "<": 3, "<=": 3, ">": 3, ">=": 3, "in": 3,
+	"+": 4, "-": 4,
+	"*": 5, "/": 5, "%": 5, "<<": 5, ">>": 5,
+}
+
+// functions are the global functions, by number of arguments
+var functions = map[string]int{
+	"size":   1,
+	"int":    1,
+	"double": 1,
+	"string": 1,
+	"has":    1,
+}
+
+// methods are the string methods, by number of arguments besides the
+// receiver
+var methods = map[string]int{
+	"startsWith": 1,
+	"endsWith":   1,
+	"contains":   1,
+	"matches":    1,
+	"size":       0,
+}
+
+type parser struct {
+	lex lexer
+	tok token
+}
+
+func (p *parser) next() {
+	p.tok = p.lex.next()
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("parse error at char %d: %s", p.tok.pos+1, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) expect(kind tokenKind, what string) (token, error) {
+	tok := p.tok
+	if tok.kind != kind {
+		return tok, p.errorf("expected %s, got %s", what, tok)
+	}
+	p.next()
+	return tok, nil
+}
+
+// parseCond parses a conditional, c ? a : b, or anything binding tighter.
+func (p *parser) parseCond() (node, error) {
+	c, err := p.parseExpr(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokOp || p.tok.text != "?" {
+		return c, nil
+	}
+	p.next()
+	t, err := p.parseCond()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokOp || p.tok.text != ":" {
+		return nil, p.errorf("expected ':', got %s", p.tok)
+	}
+	p.next()
+	f, err := p.parseCond()
+	if err != nil {
+		return nil, err
+	}
+	return &condNode{c: c, t: t, f: f}, nil
+}
+
+// parseExpr is a precedence-climbing parser for binary operators.
+func (p *parser) parseExpr(minPrec int) (node, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.tok.kind == tokOp || (p.tok.kind == tokIdent && p.tok.text == "in") {
+		prec, ok := precedence[p.tok.text]
+		if !ok || prec <= minPrec {
+			break
+		}
+		op := p.tok.text
+		p.next()
+		rhs, err := p.parseExpr(prec)
+		if err != nil {
+			return nil, err
+		}
+		lhs = &binaryNode{op: op, x: lhs, y: rhs}
+	}
+	return lhs, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.tok.kind == tokOp && (p.tok.text == "!" || p.tok.text == "-") {
+		op := p.tok.text
+		p.next()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{op: op, x: x}, nil
+	}
+	x, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	return p.parsePostfix(x)
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	tok := p.tok
+	switch tok.kind {
+	case tokInt:
+		p.next()
+		v, err := strconv.ParseInt(tok.text, 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parse error at char %d: invalid integer %q", tok.pos+1, tok.text)
+		}
+		return &literal{v: v}, nil
+	case tokFloat:
+		p.next()
+		v, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parse error at char %d: invalid number %q", tok.pos+1, tok.text)
+		}
+		return &literal{v: v}, nil
+	case tokString:
+		p.next()
+		return &literal{v: tok.text}, nil
+	case tokLParen:
+		p.next()
+		x, err := p.parseCond()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokRParen, "')'"); err != nil {
+			return nil, err
+		}
+		return x, nil
+	case tokLBracket:
+		p.next()
+		items, err := p.parseArgs(tokRBracket, "']'")
+		if err != nil {
+			return nil, err
+		}
+		return &listNode{items: items}, nil
+	case tokIdent:
+		p.next()
+		switch tok.text {
+		case "true":
+			return &literal{v: true}, nil
+		case "false":
+			return &literal{v: false}, nil
+		case "event":
+			return eventNode{}, nil
+		case "text":
+			return textNode{}, nil
+		}
+		if p.tok.kind == tokLParen {
+			return p.parseCall(tok)
+		}
+		return nil, fmt.Errorf("parse error at char %d: unknown name %q (want event or text)", tok.pos+1, tok.text)
+	}
+	return nil, p.errorf("unexpected %s", tok)
+}
+
+// parsePostfix parses the field accesses, indexes and method calls
+// following x.
+func (p *parser) parsePostfix(x node) (node, error) {
+	for {
+		switch p.tok.kind {
+		case tokDot:
+			p.next()
+			name, err := p.expect(tokIdent, "field or method name")
+			if err != nil {
+				return nil, err
+			}
+			if p.tok.kind == tokLParen {
+				if x, err = p.parseMethod(x, name); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if _, ok := x.(eventNode); !ok {
+				return nil, fmt.Errorf("parse error at char %d: only event has fields", name.pos+1)
+			}
+			x = &fieldNode{name: &literal{v: name.text}}
+		case tokLBracket:
+			p.next()
+			index, err := p.parseCond()
+			if err != nil {
+				return nil, err
+			}
+			if _, err := p.expect(tokRBracket, "']'"); err != nil {
+				return nil, err
+			}
+			if _, ok := x.(eventNode); !ok {
+				return nil, p.errorf("only event can be indexed")
+			}
+			x = &fieldNode{name: index}
+		default:
+			return x, nil
+		}
+	}
+}
+
+func (p *parser) parseArgs(end tokenKind, what string) ([]node, error) {
+	var args []node
+	for p.tok.kind != end {
+		arg, err := p.parseCond()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if p.tok.kind != tokComma {
+			break
+		}
+		p.next()
+	}
+	if _, err := p.expect(end, what); err != nil {
+		return nil, err
+	}
+	return args, nil
+}
+
+func (p *parser) parseCall(name token) (node, error) {
+	want, ok := functions[name.text]
+	if !ok {
+		return nil, fmt.Errorf("parse error at char %d: unknown function %q", name.pos+1, name.text)
+	}
+	p.next()
+	args, err := p.parseArgs(tokRParen, "')'")
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != want {
+		return nil, fmt.Errorf("parse error at char %d: %s takes %d argument", name.pos+1, name.text, want)
+	}
+	if name.text == "has" {
+		f, ok := args[0].(*fieldNode)
+		if !ok {
+			return nil, fmt.Errorf("parse error at char %d: has takes a field, e.g. has(event.stack)", name.pos+1)
+		}
+		return &hasNode{field: f}, nil
+	}
+	return &callNode{fn: name.text, args: args}, nil
+}
+
+func (p *parser) parseMethod(recv node, name token) (node, error) {
+	want, ok := methods[name.text]
+	if !ok {
+		return nil, fmt.Errorf("parse error at char %d: unknown method %q", name.pos+1, name.text)
+	}
+	p.next()
+	args, err := p.parseArgs(tokRParen, "')'")
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != want {
+		return nil, fmt.Errorf("parse error at char %d: %s takes %d argument", name.pos+1, name.text, want)
+	}
+	call := &callNode{fn: name.text, args: append([]node{recv}, args...)}
+	// Literal patterns compile once, and their errors surface here
+	if name.text == "matches" {
+		if lit, ok := args[0].(*literal); ok {
+			s, ok := lit.v.(string)
+			if !ok {
+				return nil, fmt.Errorf("parse error at char %d: matches takes a string", name.pos+1)
+			}
+			re, err := regexp.Compile(s)
+			if err != nil {
+				return nil, fmt.Errorf("parse error at char %d: invalid regexp %q: %v", name.pos+1, s, err)
+			}
+			call.re = re
+		}
+	}
+	return call, nil
+}
@@ -0,0 +1,219 @@
+// Package flamegraph renders sampled stacks the way perf and FlameGraph
+// users expect: as folded stacks, one "frame;frame;frame count" line per
+// stack, which flamegraph.pl, speedscope and inferno read, and as a
+// self-contained SVG flame graph that needs none of them.
+//
+// Kernel frames are told apart by the _[k] suffix flamegraph.pl uses, and
+// drawn in its kernel color.
+package flamegraph
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"html"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Stack is a stack sampled Count times, its frames root first.
+type Stack struct {
+	Frames []string
+	Count  uint64
+}
+
+// Options lays out an SVG flame graph.
+type Options struct {
+	// Title is drawn above the graph, "Flame Graph" if empty
+	Title string
+	// Width is the image width in pixels, 1200 if 0
+	Width int
+	// Unit names what Count counts in tooltips, "samples" if empty
+	Unit string
+}
+
+const (
+	defaultWidth = 1200
+	frameHeight  = 16
+	fontSize     = 12
+	// fontWidth is the average glyph width relative to fontSize, for
+	// deciding how much of a name fits in its frame
+	fontWidth  = 0.59
+	padding    = 10
+	titleSpace = 3 * frameHeight
+	// minWidth hides frames too narrow to see, in pixels
+	minWidth = 0.1
+)
+
+// WriteFolded writes stacks as folded stacks, busiest first. Semicolons
+// within a frame would split it, so they are replaced by colons.
+func WriteFolded(w io.Writer, stacks []Stack) error {
+	bw := bufio.NewWriter(w)
+	for _, s := range sorted(stacks) {
+		frames := make([]string, len(s.Frames))
+		for i, f := range s.Frames {
+			frames[i] = strings.ReplaceAll(f, ";", ":")
+		}
+		if _, err := fmt.Fprintf(bw, "%s %d\n", strings.Join(frames, ";"), s.Count); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// node is a frame in the merged call tree.
+type node struct {
+	name     string
+	count    uint64
+	children map[string]*node
+}
+
+func (n *node) child(name string) *node {
+	c, ok := n.children[name]
+	if !ok {
+		c = &node{name: name, children: make(map[string]*node)}
+		n.children[name] = c
+	}
+	return c
+}
+
+// sortedChildren orders children by name, as flamegraph.pl does, so the
+// same stacks always draw the same graph.
+func (n *node) sortedChildren() []*node {
+	children := make([]*node, 0, len(n.children))
+	for _, c := range n.children {
+		children = append(children, c)
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].name < children[j].name })
+	return children
+}
+
+// WriteSVG draws stacks as a flame graph: every frame a box as wide as
+// the share of samples it was on the stack for, callees stacked above
+// their callers under a root spanning all samples. Frames show their
+// name, count and share when hovered.
+func WriteSVG(w io.Writer, stacks []Stack, opts Options) error {
+	if opts.Title == "" {
+		opts.Title = "Flame Graph"
+	}
+	if opts.Width <= 0 {
+		opts.Width = defaultWidth
+	}
+	if opts.Unit == "" {
+		opts.Unit = "samples"
+	}
+
+	root := &node{name: "all", children: make(map[string]*node)}
+	depth := 0
+	for _, s := range stacks {
+		if s.Count == 0 {
+			continue
+		}
+		root.count += s.Count
+		n := root
+		for _, f := range s.Frames {
+			n = n.child(f)
+			n.count += s.Count
+		}
+		depth = max(depth, len(s.Frames))
+	}
+
+	width := float64(opts.Width - 2*padding)
+	height := titleSpace + (depth+1)*frameHeight + 2*padding
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, `<?xml version="1.0" standalone="no"?>
+<svg version="1.1" width="%d" height="%d" viewBox="0 0 %d %d" xmlns="http://www.w3.org/2000/svg">
+<style>text { font-family: Verdana, sans-serif; font-size: %dpx; fill: #000; } .frame:hover rect { stroke: #000; stroke-width: 0.5; }</style>
+<rect x="0" y="0" width="100%%" height="100%%" fill="#f8f8f8"/>
+<text x="%d" y="%d" text-anchor="middle" style="font-size: %dpx">%s</text>
+`, opts.Width, height, opts.Width, height, fontSize, opts.Width/2, 2*frameHeight, fontSize+5, html.EscapeString(opts.Title))
+
+	// The root sits at the bottom, callees above it
+	var draw func(n *node, x float64, level int)
+	draw = func(n *node, x float64, level int) {
+		if root.count == 0 {
+			return
+		}
+		fw := width * float64(n.count) / float64(root.count)
+		if fw < minWidth {
+			return
+		}
+		y := height - padding - (level+1)*frameHeight
+		share := 100 * float64(n.count) / float64(root.count)
+		fmt.Fprintf(bw, `<g class="frame"><title>%s (%d %s, %.2f%%)</title><rect x="%.1f" y="%d" width="%.1f" height="%d" rx="2" fill="%s"/>`,
+			html.EscapeString(n.name), n.count, opts.Unit, share, padding+x, y, fw, frameHeight-1, color(n.name))
+		if label := fit(n.name, fw); label != "" {
+			fmt.Fprintf(bw, `<text x="%.1f" y="%d">%s</text>`, padding+x+3, y+frameHeight-4, html.EscapeString(label))
+		}
+		bw.WriteString("</g>\n")
+		for _, c := range n.sortedChildren() {
+			draw(c, x, level+1)
+			x += width * float64(c.count) / float64(root.count)
+		}
+	}
+	draw(root, 0, 0)
+	bw.WriteString("</svg>\n")
+	return bw.Flush()
+}
+
+// fit cuts name to what fits in a frame w pixels wide, marking the cut
+// with "..", or nothing if not even a few characters do.
+func fit(name string, w float64) string {
+	chars := int((w - 6) / (fontSize * fontWidth))
+	switch {
+	case chars < 3:
+		return ""
+	case chars >= len(name):
+		return name
+	}
+	return name[:chars-2] + ".."
+}
+
+// color picks a frame's color from its name, so a function keeps its
+// color across graphs: warm hues for user frames, orange for kernel ones.
+func color(name string) string {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	v := h.Sum32()
+	r1, r2, r3 := float64(v&0xff)/255, float64(v>>8&0xff)/255, float64(v>>16&0xff)/255
+	if strings.HasSuffix(name, "_[k]") {
+		return fmt.Sprintf("rgb(%d,%d,%d)", 205+int(50*r1), 120+int(60*r2), int(40*r3))
+	}
+	return fmt.Sprintf("rgb(%d,%d,%d)", 205+int(50*r3), int(230*r1), int(55*r2))
+}
+
+// sorted orders stacks by count, busiest first, then by frames.
+func sorted(stacks []Stack) []Stack {
+	out := append([]Stack(nil), stacks...)
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return strings.Join(out[i].Frames, ";") < strings.Join(out[j].Frames, ";")
+	})
+	return out
+}
+
+// WriteFile replaces the file at path with what write writes, through a
+// temporary file so readers never see a partial graph.
+func WriteFile(path string, write func(io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,392 @@
+// Package flowlog reads back the connections the TCP flow monitor
+// recorded as JSON lines or a binary event log, for searching flow history on the host itself:
+// its connect, accept and close events attribute each connection to the
+// processes at either end, and its stats snapshots carry the bytes,
+// retransmits and RTT of every connection it tracked.
+package flowlog
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"probepilot/pkg/output"
+	"probepilot/pkg/query"
+	"probepilot/pkg/schema"
+)
+
+// DefaultPath is where flows are searched unless told otherwise; the
+// TCP flow monitor records there with
+// -output json -output-file /var/log/probepilot/tcp-flow.jsonl.
+const DefaultPath = "/var/log/probepilot/tcp-flow.jsonl"
+
+// probe is the agent whose records are read.
+const probe = "tcp-flow"
+
+// Process is a process at one end of a connection.
+type Process struct {
+	PID  uint32 `json:"pid"`
+	Comm string `json:"comm,omitempty"`
+}
+
+// Flow is one connection as recorded, from the end that connected to the
+// end that accepted.
+type Flow struct {
+	Src   netip.AddrPort `json:"src"`
+	Dst   netip.AddrPort `json:"dst"`
+	First time.Time      `json:"first_seen"`
+	Last  time.Time      `json:"last_seen"`
+	// Client and Server are the processes that connected and accepted,
+	// when they are on this host
+	Client *Process `json:"client,omitempty"`
+	Server *Process `json:"server,omitempty"`
+	// BytesTX went from Src to Dst and BytesRX back, as estimated at the
+	// last snapshot the connection was tracked in
+	BytesTX     float64       `json:"bytes_tx"`
+	BytesRX     float64       `json:"bytes_rx"`
+	Retransmits float64       `json:"retransmits,omitempty"`
+	RTT         time.Duration `json:"rtt_ns,omitempty"`
+	// State is open, closed or failed
+	State string `json:"state"`
+	// Directed is set when a connect or accept event told which end
+	// connected; otherwise the end with the lower port is taken for the
+	// server
+	Directed bool `json:"directed"`
+}
+
+// endpoints identify a connection whichever end it was seen from: a is
+// the lower endpoint
+type endpoints struct{ a, b netip.AddrPort }
+
+func pair(x, y netip.AddrPort) (endpoints, bool) {
+	if compare(x, y) > 0 {
+		return endpoints{y, x}, true
+	}
+	return endpoints{x, y}, false
+}
+
+// compare orders endpoints by address, then port
+func compare(x, y netip.AddrPort) int {
+	if c := x.Addr().Compare(y.Addr()); c != 0 {
+		return c
+	}
+	return int(x.Port()) - int(y.Port())
+}
+
+// conn accumulates the records of one connection
+type conn struct {
+	flow  Flow
+	procs map[netip.AddrPort]*Process // by local endpoint
+	// tx went from a to b, rx back
+	tx, rx float64
+}
+
+// Log is the connections of one or more recordings.
+type Log struct {
+	// Since, if set, has binary event logs, indexed by time, read from
+	// it on instead of from their start. Flows seen since still count,
+	// but those connected before lose the processes their connect and
+	// accept events named.
+	Since time.Time
+
+	conns map[endpoints]*conn
+}
+
+// New returns an empty Log.
+func New() *Log {
+	return &Log{conns: make(map[endpoints]*conn)}
+}
+
+// ReadFile adds the records of a recording, gzipped if its name ends in
+// .gz, as rotated logs are, or a binary event log.
+func (l *Log) ReadFile(path string) error {
+	if binary, err := output.IsLog(path); err != nil {
+		return err
+	} else if binary {
+		return l.readLog(path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+	if err := l.Read(r); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// Read adds the records of r, JSON lines as -output json writes them.
+// Lines that are not JSON objects and records of other probes are
+// skipped, so logs mixed into the recording do no harm.
+func (l *Log) Read(r io.Reader) error {
+	br := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		line, err := br.ReadBytes('\n')
+		if line = bytes.TrimSpace(line); len(line) > 0 && line[0] == '{' {
+			var rec output.Record
+			if err := json.Unmarshal(line, &rec); err != nil {
+				return fmt.Errorf("line %d: %w", n, err)
+			}
+			if err := schema.Check(schema.Output, rec.Schema); err != nil {
+				return fmt.Errorf("line %d: %w", n, err)
+			}
+			if rec.Probe == probe {
+				l.add(&rec)
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readLog adds the records of a binary event log from l.Since on.
+func (l *Log) readLog(path string) error {
+	r, err := output.OpenLog(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if r.Probe() != probe {
+		return nil
+	}
+	if !l.Since.IsZero() {
+		if err := r.Seek(l.Since); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	for {
+		rec, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		l.add(rec)
+	}
+}
+
+func (l *Log) add(rec *output.Record) {
+	switch rec.Kind {
+	case output.KindEvent:
+		l.event(rec.Time, rec.Labels)
+	case output.KindStats:
+		for _, s := range rec.Samples {
+			l.sample(rec.Time, s)
+		}
+	}
+}
+
+// conn returns the connection between x and y, seen at t
+func (l *Log) conn(x, y netip.AddrPort, t time.Time) *conn {
+	key, _ := pair(x, y)
+	c, ok := l.conns[key]
+	if !ok {
+		c = &conn{flow: Flow{Src: key.a, Dst: key.b, First: t, Last: t, State: "open"}, procs: make(map[netip.AddrPort]*Process)}
+		l.conns[key] = c
+	}
+	if t.Before(c.flow.First) {
+		c.flow.First = t
+	}
+	if t.After(c.flow.Last) {
+		c.flow.Last = t
+	}
+	return c
+}
+
+// event accounts an event of the socket at saddr:sport
+func (l *Log) event(t time.Time, labels query.Labels) {
+	local, remote, ok := addrs(labels)
+	if !ok {
+		return
+	}
+	c := l.conn(local, remote, t)
+	if pid, err := strconv.ParseUint(labels["pid"], 10, 32); err == nil && pid != 0 {
+		c.procs[local] = &Process{PID: uint32(pid), Comm: labels["comm"]}
+	}
+	switch labels["type"] {
+	case "connect":
+		c.flow.Src, c.flow.Dst, c.flow.Directed = local, remote, true
+	case "accept":
+		c.flow.Src, c.flow.Dst, c.flow.Directed = remote, local, true
+	case "connect_failed":
+		c.flow.Src, c.flow.Dst, c.flow.Directed = local, remote, true
+		c.flow.State = "failed"
+	case "close":
+		if c.flow.State == "open" {
+			c.flow.State = "closed"
+		}
+	}
+}
+
+// sample accounts a per-connection sample of a stats snapshot; the
+// snapshot's counts are cumulative while the connection is tracked
+func (l *Log) sample(t time.Time, s output.Sample) {
+	if !strings.HasPrefix(s.Name, "tcp_flow_") {
+		return
+	}
+	x, y, ok := addrs(s.Labels)
+	if !ok {
+		return
+	}
+	c := l.conn(x, y, t)
+	_, swapped := pair(x, y)
+	switch s.Name {
+	case "tcp_flow_bytes_tx", "tcp_flow_bytes_rx":
+		// tx went from the sample's saddr to its daddr
+		if (s.Name == "tcp_flow_bytes_tx") == swapped {
+			c.rx = s.Value
+		} else {
+			c.tx = s.Value
+		}
+	case "tcp_flow_retransmits_total":
+		c.flow.Retransmits = s.Value
+	case "tcp_flow_rtt_avg_seconds":
+		c.flow.RTT = time.Duration(s.Value * float64(time.Second))
+	case "tcp_flow_rtt_avg":
+		// Logged by monitors before RTTs were exported in seconds, as
+		// the kernel keeps them: microseconds, shifted by 3
+		c.flow.RTT = time.Duration(s.Value / 8 * float64(time.Microsecond))
+	}
+}
+
+// addrs are the saddr:sport and daddr:dport of labels
+func addrs(labels query.Labels) (src, dst netip.AddrPort, ok bool) {
+	saddr, err1 := netip.ParseAddr(labels["saddr"])
+	daddr, err2 := netip.ParseAddr(labels["daddr"])
+	sport, err3 := strconv.ParseUint(labels["sport"], 10, 16)
+	dport, err4 := strconv.ParseUint(labels["dport"], 10, 16)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		return src, dst, false
+	}
+	return netip.AddrPortFrom(saddr, uint16(sport)), netip.AddrPortFrom(daddr, uint16(dport)), true
+}
+
+// Query selects flows; zero fields match every flow.
+type Query struct {
+	// Src and Dst match the addresses of the connecting and accepting
+	// ends
+	Src, Dst netip.Prefix
+	// Port matches the accepting end's port
+	Port uint16
+	// PID and Comm match the process at either end
+	PID  uint32
+	Comm string
+	// Since and Until bound when the flow was seen
+	Since, Until time.Time
+}
+
+// Search returns the flows q matches, oldest first.
+func (l *Log) Search(q Query) []Flow {
+	var flows []Flow
+	for key, c := range l.conns {
+		f := c.resolve(key)
+		if q.matches(&f) {
+			flows = append(flows, f)
+		}
+	}
+	sort.Slice(flows, func(i, j int) bool {
+		if !flows[i].First.Equal(flows[j].First) {
+			return flows[i].First.Before(flows[j].First)
+		}
+		return compare(flows[i].Src, flows[j].Src) < 0
+	})
+	return flows
+}
+
+// resolve completes a connection's flow: its direction, byte counts and
+// processes
+func (c *conn) resolve(key endpoints) Flow {
+	f := c.flow
+	if !f.Directed && f.Src.Port() < f.Dst.Port() {
+		f.Src, f.Dst = f.Dst, f.Src
+	}
+	f.BytesTX, f.BytesRX = c.tx, c.rx
+	if f.Src != key.a {
+		f.BytesTX, f.BytesRX = c.rx, c.tx
+	}
+	f.Client, f.Server = c.procs[f.Src], c.procs[f.Dst]
+	return f
+}
+
+func (q *Query) matches(f *Flow) bool {
+	switch {
+	case q.Src.IsValid() && !q.Src.Contains(f.Src.Addr()):
+		return false
+	case q.Dst.IsValid() && !q.Dst.Contains(f.Dst.Addr()):
+		return false
+	case q.Port != 0 && f.Dst.Port() != q.Port:
+		return false
+	case !q.Since.IsZero() && f.Last.Before(q.Since):
+		return false
+	case !q.Until.IsZero() && f.First.After(q.Until):
+		return false
+	}
+	if q.PID == 0 && q.Comm == "" {
+		return true
+	}
+	for _, p := range []*Process{f.Client, f.Server} {
+		if p != nil && (q.PID == 0 || p.PID == q.PID) && (q.Comm == "" || p.Comm == q.Comm) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParsePrefix parses an address or CIDR prefix, e.g. 10.0.0.5 or
+// 10.0.0.0/8; an empty string is the zero prefix, matching every
+// address.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	if s == "" {
+		return netip.Prefix{}, nil
+	}
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		return p.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// ParseTime parses a time as -since and -until take it: a duration ago,
+// e.g. 2h, or an RFC 3339 time. An empty string is the zero time.
+func ParseTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q (want a duration ago, e.g. 2h, or an RFC 3339 time)", s)
+	}
+	return t, nil
+}
@@ -0,0 +1,177 @@
+package generic
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// source is where a field is read from.
+type source int
+
+const (
+	// fromCtx is the program's context: the registers of a kprobe, the
+	// record of a tracepoint
+	fromCtx source = iota
+	fromPID
+	fromTID
+	fromCPU
+)
+
+// field is a value a hook's program reads.
+type field struct {
+	name   string
+	src    source
+	off    int16
+	size   int
+	signed bool
+}
+
+// builtins are the fields of every hook.
+var builtins = []field{
+	{name: "pid", src: fromPID},
+	{name: "tid", src: fromTID},
+	{name: "cpu", src: fromCPU},
+}
+
+// regs are the offsets in struct pt_regs of a function's arguments and
+// return value.
+var regs = map[string]struct {
+	args []int16
+	ret  int16
+}{
+	// di, si, dx, cx, r8, r9; ax
+	"amd64": {args: []int16{112, 104, 96, 88, 72, 64}, ret: 80},
+	// x0 to x7; x0
+	"arm64": {args: []int16{0, 8, 16, 24, 32, 40, 48, 56}, ret: 0},
+}
+
+// tracefsDirs are where tracefs is mounted, the first found used.
+var tracefsDirs = []string{"/sys/kernel/tracing", "/sys/kernel/debug/tracing"}
+
+// hookFields returns the fields a hook may name.
+func hookFields(h Hook) (map[string]field, error) {
+	fields := make(map[string]field)
+	for _, f := range builtins {
+		fields[f.name] = f
+	}
+	switch h.Kind {
+	case Kprobe, Kretprobe:
+		r, ok := regs[runtime.GOARCH]
+		if !ok {
+			return nil, fmt.Errorf("reading kprobe arguments is not supported on %s", runtime.GOARCH)
+		}
+		if h.Kind == Kretprobe {
+			fields["retval"] = field{name: "retval", off: r.ret, size: 8, signed: true}
+			break
+		}
+		for i, off := range r.args {
+			name := "arg" + strconv.Itoa(i)
+			fields[name] = field{name: name, off: off, size: 8}
+		}
+	case Tracepoint:
+		category, name, _ := strings.Cut(h.Target, "/")
+		tp, err := readFormat(category, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range tp {
+			fields[f.name] = f
+		}
+	}
+	return fields, nil
+}
+
+// resolve looks the field named name up, naming the fields there are if
+// it is not one of them.
+func resolve(fields map[string]field, name string) (field, error) {
+	if f, ok := fields[name]; ok {
+		return f, nil
+	}
+	names := make([]string, 0, len(fields))
+	for n := range fields {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return field{}, fmt.Errorf("unknown field %q (want one of %s)", name, strings.Join(names, ", "))
+}
+
+// readFormat reads the numeric fields of a tracepoint from its format in
+// tracefs:
+//
+//	format:
+//		field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+//		field:dev_t dev;	offset:8;	size:4;	signed:0;
+//		field:char rwbs[8];	offset:28;	size:8;	signed:1;
+//
+// Arrays and strings are left out.
+func readFormat(category, name string) ([]field, error) {
+	var f *os.File
+	var err error
+	for _, dir := range tracefsDirs {
+		f, err = os.Open(filepath.Join(dir, "events", category, name, "format"))
+		if !errors.Is(err, os.ErrNotExist) {
+			break
+		}
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("tracepoint %s/%s not found in tracefs (is it mounted at %s?)", category, name, tracefsDirs[0])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("tracepoint %s/%s: %w", category, name, err)
+	}
+	defer f.Close()
+	var fields []field
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if fd, ok := parseFormatField(s.Text()); ok {
+			fields = append(fields, fd)
+		}
+	}
+	return fields, s.Err()
+}
+
+// parseFormatField parses a numeric field's line of a tracepoint format.
+func parseFormatField(line string) (field, bool) {
+	var f field
+	var decl string
+	for _, part := range strings.Split(strings.TrimSpace(line), ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), ":")
+		if !ok {
+			continue
+		}
+		var err error
+		switch key {
+		case "field":
+			decl = value
+		case "offset":
+			var off int
+			off, err = strconv.Atoi(value)
+			f.off = int16(off)
+		case "size":
+			f.size, err = strconv.Atoi(value)
+		case "signed":
+			f.signed = value == "1"
+		}
+		if err != nil {
+			return field{}, false
+		}
+	}
+	if decl == "" || strings.Contains(decl, "[") || strings.Contains(decl, "__data_loc") {
+		return field{}, false
+	}
+	switch f.size {
+	case 1, 2, 4, 8:
+	default:
+		return field{}, false
+	}
+	words := strings.Fields(decl)
+	f.name = strings.TrimLeft(words[len(words)-1], "*")
+	return f, true
+}
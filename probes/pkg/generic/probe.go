@@ -0,0 +1,393 @@
+package generic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+
+	"probepilot/pkg/decode"
+	"probepilot/pkg/plugin"
+	"probepilot/pkg/procfs"
+	"probepilot/pkg/query"
+	"probepilot/pkg/units"
+)
+
+// Latency histogram bounds: buckets of 2^minSlot ns, about 1µs, to
+// 2^maxSlot ns, about 69s.
+const (
+	minSlot = 10
+	maxSlot = 36
+)
+
+// Probe runs the hooks of a spec.
+type Probe struct {
+	env   *plugin.Env
+	hooks []compiled
+	spec  *ebpf.CollectionSpec
+	coll  *ebpf.Collection
+	links []link.Link
+	procs *procfs.Cache
+
+	mu sync.Mutex
+	// slow counts the slow calls reported, by hook
+	slow []uint64
+}
+
+// NewProbe resolves the fields the hooks of spec name, reading the
+// formats of their tracepoints, and builds their programs.
+func NewProbe(spec *Spec, env *plugin.Env) (*Probe, error) {
+	p := &Probe{env: env, procs: procfs.NewCache(), slow: make([]uint64, len(spec.Hooks))}
+	for _, h := range spec.Hooks {
+		c, err := compile(h)
+		if err != nil {
+			return nil, fmt.Errorf("hook %s: %w", h.Name, err)
+		}
+		p.hooks = append(p.hooks, c)
+	}
+	p.spec = collectionSpec(p.hooks, spec.MaxKeys)
+	return p, nil
+}
+
+// compile resolves the fields of h.
+func compile(h Hook) (compiled, error) {
+	c := compiled{Hook: h}
+	fields, err := hookFields(h)
+	if err != nil {
+		return c, err
+	}
+	if h.By != "" {
+		f, err := resolve(fields, h.By)
+		if err != nil {
+			return c, fmt.Errorf("by: %w", err)
+		}
+		c.by = &f
+	}
+	if h.Sum != "" {
+		f, err := resolve(fields, h.Sum)
+		if err != nil {
+			return c, fmt.Errorf("sum: %w", err)
+		}
+		c.sum = &f
+	}
+	for _, cond := range h.Where {
+		f, err := resolve(fields, cond.Field)
+		if err != nil {
+			return c, fmt.Errorf("where: %w", err)
+		}
+		c.where = append(c.where, condition{Condition: cond, field: f})
+	}
+	return c, nil
+}
+
+// Load loads the programs and counts the hits of by values beyond the
+// stats map as otherBy.
+func (p *Probe) Load() error {
+	coll, err := ebpf.NewCollection(p.spec)
+	if err != nil {
+		return err
+	}
+	p.coll = coll
+	stats := coll.Maps[statsMap]
+	for i, h := range p.hooks {
+		if h.by == nil {
+			continue
+		}
+		n := 1
+		if h.Latency {
+			n = slots
+		}
+		for slot := 0; slot < n; slot++ {
+			if err := stats.Put(statKey{Hook: uint32(i), Slot: uint32(slot), By: otherBy}, statValue{}); err != nil {
+				return fmt.Errorf("hook %s: %w", h.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Attach attaches every hook, a timed one at its function's entry and
+// return.
+func (p *Probe) Attach() error {
+	for i, h := range p.hooks {
+		name := "h" + strconv.Itoa(i)
+		var links []link.Link
+		var err error
+		switch {
+		case h.Latency:
+			var entry, ret link.Link
+			if entry, err = link.Kprobe(h.Target, p.coll.Programs[name+"_entry"], nil); err == nil {
+				links = append(links, entry)
+				if ret, err = link.Kretprobe(h.Target, p.coll.Programs[name+"_return"], nil); err == nil {
+					links = append(links, ret)
+				}
+			}
+		case h.Kind == Kprobe:
+			var l link.Link
+			if l, err = link.Kprobe(h.Target, p.coll.Programs[name], nil); err == nil {
+				links = append(links, l)
+			}
+		case h.Kind == Kretprobe:
+			var l link.Link
+			if l, err = link.Kretprobe(h.Target, p.coll.Programs[name], nil); err == nil {
+				links = append(links, l)
+			}
+		case h.Kind == Tracepoint:
+			category, event, _ := strings.Cut(h.Target, "/")
+			var l link.Link
+			if l, err = link.Tracepoint(category, event, p.coll.Programs[name], nil); err == nil {
+				links = append(links, l)
+			}
+		}
+		p.links = append(p.links, links...)
+		if err != nil {
+			return fmt.Errorf("hook %s: %s %s: %w", h.Name, h.Kind, h.Target, err)
+		}
+		log.Printf("Attached hook %s to %s %s", h.Name, h.Kind, h.Target)
+	}
+	return nil
+}
+
+// Events returns the ring buffer of slow calls.
+func (p *Probe) Events() *ebpf.Map {
+	if p.coll == nil {
+		return nil
+	}
+	return p.coll.Maps[eventsMap]
+}
+
+// Handle reports a slow call.
+func (p *Probe) Handle(record []byte) error {
+	var e slowEvent
+	if err := decode.Record(record, &e); err != nil {
+		return err
+	}
+	if int(e.Hook) >= len(p.hooks) {
+		return fmt.Errorf("slow call of unknown hook %d", e.Hook)
+	}
+	h := p.hooks[e.Hook]
+	p.mu.Lock()
+	p.slow[e.Hook]++
+	p.mu.Unlock()
+
+	latency := time.Duration(e.Latency)
+	labels := query.Labels{
+		"type":       "slow_call",
+		"hook":       h.Name,
+		"function":   h.Target,
+		"pid":        strconv.FormatUint(uint64(e.PID), 10),
+		"comm":       p.procs.Name(e.PID),
+		"latency_ns": strconv.FormatUint(e.Latency, 10),
+	}
+	p.procs.AddPIDLabels(labels, e.PID)
+	text := fmt.Sprintf("slow call %s: %s took %s (over %s) pid=%d comm=%s",
+		h.Name, h.Target, units.Duration(latency), units.Duration(h.Slow), e.PID, labels["comm"])
+	if h.by != nil {
+		labels[h.By] = byValue(e.By)
+		text += fmt.Sprintf(" %s=%s", h.By, labels[h.By])
+	}
+	p.env.EventAt(e.Timestamp, labels, text)
+	return nil
+}
+
+// hookStats are the stats of a hook for one by value.
+type hookStats struct {
+	by    uint64
+	total statValue
+	// buckets count latencies by slot
+	buckets [slots]uint64
+}
+
+// read reads the stats map, by hook.
+func (p *Probe) read() ([][]*hookStats, error) {
+	if p.coll == nil {
+		return nil, errors.New("hooks not loaded")
+	}
+	byHook := make([]map[uint64]*hookStats, len(p.hooks))
+	for i := range byHook {
+		byHook[i] = make(map[uint64]*hookStats)
+	}
+	var key statKey
+	var value statValue
+	iter := p.coll.Maps[statsMap].Iterate()
+	for iter.Next(&key, &value) {
+		if int(key.Hook) >= len(p.hooks) || key.Slot >= slots {
+			continue
+		}
+		s, ok := byHook[key.Hook][key.By]
+		if !ok {
+			s = &hookStats{by: key.By}
+			byHook[key.Hook][key.By] = s
+		}
+		if key.Slot == 0 {
+			s.total = value
+		} else {
+			s.buckets[key.Slot] = value.Count
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("reading stats: %w", err)
+	}
+	stats := make([][]*hookStats, len(p.hooks))
+	for i, m := range byHook {
+		for _, s := range m {
+			if s.total.Count > 0 {
+				stats[i] = append(stats[i], s)
+			}
+		}
+		sort.Slice(stats[i], func(a, b int) bool { return stats[i][a].total.Count > stats[i][b].total.Count })
+	}
+	return stats, nil
+}
+
+// byValue formats a by value, "other" for those beyond the stats map.
+func byValue(v uint64) string {
+	if v == otherBy {
+		return "other"
+	}
+	return strconv.FormatUint(v, 10)
+}
+
+// histogram is the latency histogram of s, in seconds.
+func (s *hookStats) histogram(labels query.Labels) query.HistogramSample {
+	h := query.HistogramSample{Name: "generic_latency_seconds", Labels: labels,
+		Count: s.total.Count, Sum: float64(s.total.Sum) / 1e9}
+	var cumulative uint64
+	for slot := 1; slot < slots; slot++ {
+		cumulative += s.buckets[slot]
+		if slot >= minSlot && slot <= maxSlot {
+			h.Bounds = append(h.Bounds, math.Ldexp(1, slot)/1e9)
+			h.Cumulative = append(h.Cumulative, cumulative)
+		}
+	}
+	return h
+}
+
+// quantile is the upper bound of the bucket of the q quantile of the
+// latencies of s.
+func (s *hookStats) quantile(q float64) time.Duration {
+	rank := uint64(math.Ceil(q * float64(s.total.Count)))
+	var cumulative uint64
+	for slot := 1; slot < slots; slot++ {
+		cumulative += s.buckets[slot]
+		if cumulative >= rank {
+			return time.Duration(math.Ldexp(1, slot))
+		}
+	}
+	return 0
+}
+
+// Samples exports the hits of every hook by its by value, the sums of
+// its sum field and its latencies, and the slow calls reported.
+func (p *Probe) Samples() []query.Sample {
+	stats, err := p.read()
+	if err != nil {
+		log.Printf("Warning: %v", err)
+		return nil
+	}
+	p.mu.Lock()
+	slow := append([]uint64(nil), p.slow...)
+	p.mu.Unlock()
+	var samples []query.Sample
+	for i, h := range p.hooks {
+		for _, s := range stats[i] {
+			labels := query.Labels{"hook": h.Name}
+			if h.by != nil {
+				labels[h.By] = byValue(s.by)
+			}
+			samples = append(samples, query.Sample{Name: "generic_hits_total", Labels: labels, Value: float64(s.total.Count)})
+			switch {
+			case h.sum != nil:
+				samples = append(samples, query.Sample{Name: "generic_sum_total",
+					Labels: withLabel(labels, "field", h.Sum), Value: float64(s.total.Sum)})
+			case h.Latency:
+				samples = append(samples, s.histogram(labels).Samples()...)
+			}
+		}
+		if h.Slow > 0 {
+			samples = append(samples, query.Sample{Name: "generic_slow_calls_total",
+				Labels: query.Labels{"hook": h.Name}, Value: float64(slow[i])})
+		}
+	}
+	return samples
+}
+
+func withLabel(labels query.Labels, name, value string) query.Labels {
+	out := make(query.Labels, len(labels)+1)
+	for k, v := range labels {
+		out[k] = v
+	}
+	out[name] = value
+	return out
+}
+
+// Stats prints the hits of every hook, with the by values hit most.
+func (p *Probe) Stats(ctx context.Context) {
+	stats, err := p.read()
+	if err != nil {
+		log.Printf("Warning: %v", err)
+		return
+	}
+	fmt.Printf("\n=== Generic hooks ===\n")
+	for i, h := range p.hooks {
+		var total hookStats
+		for _, s := range stats[i] {
+			total.total.Count += s.total.Count
+			total.total.Sum += s.total.Sum
+			for slot, n := range s.buckets {
+				total.buckets[slot] += n
+			}
+		}
+		line := fmt.Sprintf("%s (%s %s): %d hits", h.Name, h.Kind, h.Target, total.total.Count)
+		switch {
+		case h.sum != nil:
+			line += fmt.Sprintf(", %s sum %d", h.Sum, total.total.Sum)
+		case h.Latency && total.total.Count > 0:
+			line += fmt.Sprintf(", latency avg %s, p50 <%s, p99 <%s",
+				units.Duration(time.Duration(total.total.Sum/total.total.Count)),
+				units.Duration(total.quantile(0.5)), units.Duration(total.quantile(0.99)))
+		}
+		if h.Slow > 0 {
+			p.mu.Lock()
+			line += fmt.Sprintf(", %d slower than %s", p.slow[i], units.Duration(h.Slow))
+			p.mu.Unlock()
+		}
+		fmt.Println(line)
+		if h.by == nil {
+			continue
+		}
+		top := stats[i]
+		if len(top) > 5 {
+			top = top[:5]
+		}
+		for _, s := range top {
+			line := fmt.Sprintf("  %s=%s: %d hits", h.By, byValue(s.by), s.total.Count)
+			if h.sum != nil {
+				line += fmt.Sprintf(", %s sum %d", h.Sum, s.total.Sum)
+			}
+			fmt.Println(line)
+		}
+	}
+}
+
+// Close detaches the hooks and unloads the programs.
+func (p *Probe) Close() error {
+	for _, l := range p.links {
+		l.Close()
+	}
+	p.links = nil
+	if p.coll != nil {
+		p.coll.Close()
+		p.coll = nil
+	}
+	return nil
+}
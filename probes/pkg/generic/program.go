@@ -0,0 +1,383 @@
+package generic
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+)
+
+// Maps of the programs.
+const (
+	statsMap  = "stats"
+	startsMap = "starts"
+	eventsMap = "events"
+)
+
+// Sizes of the maps.
+const (
+	// maxInFlight bounds the calls being timed at once; the LRU map
+	// drops the oldest, whose return was missed
+	maxInFlight = 10240
+	eventsSize  = 256 << 10
+)
+
+// slots are the keys of a hook's stats beside its by value: its total,
+// slot 0, and for a timed hook the log2 latency buckets 1 to 64, bucket
+// s counting latencies under 2^s ns.
+const slots = 65
+
+// otherBy is the by value of the hits of by values beyond the map.
+const otherBy = ^uint64(0)
+
+// statKey keys the stats map.
+type statKey struct {
+	Hook uint32
+	Slot uint32
+	By   uint64
+}
+
+// statValue counts the hits of a key and sums their sum field, or
+// latencies.
+type statValue struct {
+	Count uint64
+	Sum   uint64
+}
+
+// slowEvent is a call slower than its hook's slow.
+type slowEvent struct {
+	Hook      uint32
+	PID       uint32
+	By        uint64
+	Latency   uint64
+	Timestamp uint64
+}
+
+// Stack offsets of the programs: the stats key and the value inserted
+// for it, the key and value of a call being timed, and a slow event.
+const (
+	keyOff       = -16
+	valueOff     = -32
+	startKeyOff  = -48
+	startOff     = -64
+	slowEventOff = -96
+	slowEventLen = 32
+)
+
+// bpfNoExist makes a map update fail if the key is there.
+const bpfNoExist = 1
+
+// builder emits a program's instructions.
+type builder struct {
+	insns  asm.Instructions
+	labels int
+	// mark is the label of the next instruction
+	mark string
+}
+
+func (b *builder) emit(insns ...asm.Instruction) {
+	for _, ins := range insns {
+		if b.mark != "" {
+			ins = ins.WithSymbol(b.mark)
+			b.mark = ""
+		}
+		b.insns = append(b.insns, ins)
+	}
+}
+
+// label returns a new label.
+func (b *builder) label() string {
+	b.labels++
+	return "l" + strconv.Itoa(b.labels)
+}
+
+// place labels the next instruction.
+func (b *builder) place(label string) {
+	if b.mark != "" {
+		b.emit(asm.Mov.Reg(asm.R0, asm.R0))
+	}
+	b.mark = label
+}
+
+// exit ends the program, returning 0.
+func (b *builder) exit() {
+	b.place("exit")
+	b.emit(asm.Mov.Imm(asm.R0, 0), asm.Return())
+}
+
+// load reads f into dst, which must not be R0 to R5 if f is read with
+// a helper.
+func (b *builder) load(f field, dst asm.Register) {
+	switch f.src {
+	case fromPID:
+		b.emit(asm.FnGetCurrentPidTgid.Call(), asm.RSh.Imm(asm.R0, 32), asm.Mov.Reg(dst, asm.R0))
+	case fromTID:
+		b.emit(asm.FnGetCurrentPidTgid.Call(), asm.Mov.Reg32(dst, asm.R0))
+	case fromCPU:
+		b.emit(asm.FnGetSmpProcessorId.Call(), asm.Mov.Reg(dst, asm.R0))
+	default:
+		b.emit(asm.LoadMem(dst, asm.R6, f.off, sizeOf(f.size)))
+		if f.signed && f.size < 8 {
+			shift := int32(64 - 8*f.size)
+			b.emit(asm.LSh.Imm(dst, shift), asm.ArSh.Imm(dst, shift))
+		}
+	}
+}
+
+func sizeOf(n int) asm.Size {
+	switch n {
+	case 1:
+		return asm.Byte
+	case 2:
+		return asm.Half
+	case 4:
+		return asm.Word
+	}
+	return asm.DWord
+}
+
+// where jumps to exit unless every condition holds, reading the fields
+// into R9.
+func (b *builder) where(conds []condition) {
+	for _, c := range conds {
+		b.load(c.field, asm.R9)
+		b.emit(asm.LoadImm(asm.R1, c.Value, asm.DWord))
+		signed := c.field.signed || c.Value < 0
+		var op asm.JumpOp
+		// Jump out on the opposite
+		switch c.Op {
+		case "==":
+			op = asm.JNE
+		case "!=":
+			op = asm.JEq
+		case "<":
+			op = pick(signed, asm.JSGE, asm.JGE)
+		case "<=":
+			op = pick(signed, asm.JSGT, asm.JGT)
+		case ">":
+			op = pick(signed, asm.JSLE, asm.JLE)
+		case ">=":
+			op = pick(signed, asm.JSLT, asm.JLT)
+		}
+		b.emit(op.Reg(asm.R9, asm.R1, "exit"))
+	}
+}
+
+func pick(signed bool, s, u asm.JumpOp) asm.JumpOp {
+	if signed {
+		return s
+	}
+	return u
+}
+
+// count adds a hit, and sum, to the stats of the key on the stack,
+// inserting the key if it is new, or counting it as otherBy if the map
+// is full.
+func (b *builder) count(sum asm.Register) {
+	found, done := b.label(), b.label()
+	lookup := func() {
+		b.emit(
+			asm.LoadMapPtr(asm.R1, 0).WithReference(statsMap),
+			asm.Mov.Reg(asm.R2, asm.RFP),
+			asm.Add.Imm(asm.R2, keyOff),
+			asm.FnMapLookupElem.Call(),
+		)
+	}
+	lookup()
+	b.emit(asm.JNE.Imm(asm.R0, 0, found))
+	b.emit(
+		asm.StoreImm(asm.RFP, valueOff, 0, asm.DWord),
+		asm.StoreImm(asm.RFP, valueOff+8, 0, asm.DWord),
+		asm.LoadMapPtr(asm.R1, 0).WithReference(statsMap),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, keyOff),
+		asm.Mov.Reg(asm.R3, asm.RFP),
+		asm.Add.Imm(asm.R3, valueOff),
+		asm.Mov.Imm(asm.R4, bpfNoExist),
+		asm.FnMapUpdateElem.Call(),
+	)
+	// Another CPU may have inserted it first
+	lookup()
+	b.emit(asm.JNE.Imm(asm.R0, 0, found))
+	// otherBy is inserted by Load
+	b.emit(asm.StoreImm(asm.RFP, keyOff+8, -1, asm.DWord))
+	lookup()
+	b.emit(asm.JEq.Imm(asm.R0, 0, done))
+	b.place(found)
+	addSum := asm.StoreXAdd(asm.R0, sum, asm.DWord)
+	addSum.Offset = 8
+	b.emit(asm.Mov.Imm(asm.R1, 1), asm.StoreXAdd(asm.R0, asm.R1, asm.DWord), addSum)
+	b.place(done)
+}
+
+// setKey writes the stats key of hook, slot 0, and the by value in by
+// to the stack.
+func (b *builder) setKey(hook int, by asm.Register) {
+	b.emit(
+		asm.StoreImm(asm.RFP, keyOff, int64(hook), asm.Word),
+		asm.StoreImm(asm.RFP, keyOff+4, 0, asm.Word),
+		asm.StoreMem(asm.RFP, keyOff+8, by, asm.DWord),
+	)
+}
+
+// loadOrZero reads f into dst, or zeroes dst if there is no field.
+func (b *builder) loadOrZero(f *field, dst asm.Register) {
+	if f == nil {
+		b.emit(asm.Mov.Imm(dst, 0))
+		return
+	}
+	b.load(*f, dst)
+}
+
+// compiled is a hook with its fields resolved.
+type compiled struct {
+	Hook
+	by, sum *field
+	where   []condition
+}
+
+// condition is a Condition with its field resolved.
+type condition struct {
+	Condition
+	field field
+}
+
+// countProgram counts the hits of hook h, the hook'th, by its by field,
+// and sums its sum field.
+func countProgram(hook int, h compiled) asm.Instructions {
+	var b builder
+	b.emit(asm.Mov.Reg(asm.R6, asm.R1))
+	b.where(h.where)
+	b.loadOrZero(h.by, asm.R7)
+	b.loadOrZero(h.sum, asm.R8)
+	b.setKey(hook, asm.R7)
+	b.count(asm.R8)
+	b.exit()
+	return b.insns
+}
+
+// entryProgram notes when a timed function was called, and its by
+// value, which only its arguments may give.
+func entryProgram(hook int, h compiled) asm.Instructions {
+	var b builder
+	b.emit(asm.Mov.Reg(asm.R6, asm.R1))
+	b.where(h.where)
+	b.loadOrZero(h.by, asm.R7)
+	b.emit(
+		asm.FnGetCurrentPidTgid.Call(),
+		asm.StoreMem(asm.RFP, startKeyOff, asm.R0, asm.DWord),
+		asm.StoreImm(asm.RFP, startKeyOff+8, int64(hook), asm.DWord),
+		asm.StoreMem(asm.RFP, startOff+8, asm.R7, asm.DWord),
+		asm.FnKtimeGetNs.Call(),
+		asm.StoreMem(asm.RFP, startOff, asm.R0, asm.DWord),
+		asm.LoadMapPtr(asm.R1, 0).WithReference(startsMap),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, startKeyOff),
+		asm.Mov.Reg(asm.R3, asm.RFP),
+		asm.Add.Imm(asm.R3, startOff),
+		asm.Mov.Imm(asm.R4, 0),
+		asm.FnMapUpdateElem.Call(),
+	)
+	b.exit()
+	return b.insns
+}
+
+// returnProgram times a call from its entry, adding the latency to the
+// hook's total and log2 bucket, and reports it if slow.
+func returnProgram(hook int, h compiled) asm.Instructions {
+	var b builder
+	b.emit(
+		asm.FnGetCurrentPidTgid.Call(),
+		asm.StoreMem(asm.RFP, startKeyOff, asm.R0, asm.DWord),
+		asm.StoreImm(asm.RFP, startKeyOff+8, int64(hook), asm.DWord),
+		asm.LoadMapPtr(asm.R1, 0).WithReference(startsMap),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, startKeyOff),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, "exit"),
+		asm.LoadMem(asm.R8, asm.R0, 0, asm.DWord),
+		asm.LoadMem(asm.R7, asm.R0, 8, asm.DWord),
+		asm.FnKtimeGetNs.Call(),
+		asm.StoreMem(asm.RFP, slowEventOff+24, asm.R0, asm.DWord),
+		asm.Sub.Reg(asm.R0, asm.R8),
+		asm.Mov.Reg(asm.R8, asm.R0),
+		asm.LoadMapPtr(asm.R1, 0).WithReference(startsMap),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, startKeyOff),
+		asm.FnMapDeleteElem.Call(),
+	)
+	b.setKey(hook, asm.R7)
+	b.count(asm.R8)
+
+	// The bucket, 1 + floor(log2(latency)), by binary search
+	b.emit(asm.Mov.Reg(asm.R1, asm.R8), asm.Mov.Imm(asm.R9, 1))
+	for _, shift := range []int32{32, 16, 8, 4, 2, 1} {
+		skip := b.label()
+		b.emit(
+			asm.Mov.Reg(asm.R2, asm.R1),
+			asm.RSh.Imm(asm.R2, shift),
+			asm.JEq.Imm(asm.R2, 0, skip),
+			asm.Mov.Reg(asm.R1, asm.R2),
+			asm.Add.Imm(asm.R9, shift),
+		)
+		b.place(skip)
+	}
+	// count may have moved the key to otherBy
+	b.emit(
+		asm.StoreMem(asm.RFP, keyOff+4, asm.R9, asm.Word),
+		asm.StoreMem(asm.RFP, keyOff+8, asm.R7, asm.DWord),
+	)
+	b.count(asm.R8)
+
+	if h.Slow > 0 {
+		b.emit(
+			asm.LoadImm(asm.R1, int64(h.Slow), asm.DWord),
+			asm.JLT.Reg(asm.R8, asm.R1, "exit"),
+			asm.StoreImm(asm.RFP, slowEventOff, int64(hook), asm.Word),
+			asm.LoadMem(asm.R1, asm.RFP, startKeyOff, asm.DWord),
+			asm.RSh.Imm(asm.R1, 32),
+			asm.StoreMem(asm.RFP, slowEventOff+4, asm.R1, asm.Word),
+			asm.StoreMem(asm.RFP, slowEventOff+8, asm.R7, asm.DWord),
+			asm.StoreMem(asm.RFP, slowEventOff+16, asm.R8, asm.DWord),
+			asm.LoadMapPtr(asm.R1, 0).WithReference(eventsMap),
+			asm.Mov.Reg(asm.R2, asm.RFP),
+			asm.Add.Imm(asm.R2, slowEventOff),
+			asm.Mov.Imm(asm.R3, slowEventLen),
+			asm.Mov.Imm(asm.R4, 0),
+			asm.FnRingbufOutput.Call(),
+		)
+	}
+	b.exit()
+	return b.insns
+}
+
+// collectionSpec builds the maps and programs of the hooks. Programs are
+// named hN, or hN_entry and hN_return for a timed hook.
+func collectionSpec(hooks []compiled, maxKeys int) *ebpf.CollectionSpec {
+	spec := &ebpf.CollectionSpec{
+		Maps: map[string]*ebpf.MapSpec{
+			statsMap: {Name: statsMap, Type: ebpf.Hash, KeySize: 16, ValueSize: 16,
+				MaxEntries: uint32(maxKeys + len(hooks)*slots)},
+			startsMap: {Name: startsMap, Type: ebpf.LRUHash, KeySize: 16, ValueSize: 16, MaxEntries: maxInFlight},
+			eventsMap: {Name: eventsMap, Type: ebpf.RingBuf, MaxEntries: eventsSize},
+		},
+		Programs: make(map[string]*ebpf.ProgramSpec),
+	}
+	add := func(name string, typ ebpf.ProgramType, insns asm.Instructions) {
+		spec.Programs[name] = &ebpf.ProgramSpec{Name: name, Type: typ, License: "GPL", Instructions: insns}
+	}
+	for i, h := range hooks {
+		name := fmt.Sprintf("h%d", i)
+		switch {
+		case h.Latency:
+			add(name+"_entry", ebpf.Kprobe, entryProgram(i, h))
+			add(name+"_return", ebpf.Kprobe, returnProgram(i, h))
+		case h.Kind == Tracepoint:
+			add(name, ebpf.TracePoint, countProgram(i, h))
+		default:
+			add(name, ebpf.Kprobe, countProgram(i, h))
+		}
+	}
+	return spec
+}
@@ -0,0 +1,260 @@
+// Package generic is the low-code path to a one-off probe: a YAML spec
+// lists kprobes, kretprobes and tracepoints, and for each what to count,
+// sum, group by, filter on and time, and generic builds and attaches the
+// BPF programs, no C needed:
+//
+//	schema: generic/1.0
+//	hooks:
+//	  reads:
+//	    kprobe: vfs_read
+//	    latency: true
+//	    slow: 10ms
+//	    by: pid
+//	  block_io:
+//	    tracepoint: block/block_rq_issue
+//	    by: dev
+//	    sum: nr_sector
+//	    where: [nr_sector >= 8]
+//
+// A hook counts its hits by the by field, if any, and sums its sum field.
+// A kprobe with latency also times the function to its return, with a
+// histogram of the latencies, and reports calls slower than slow as
+// events. The fields are pid, tid and cpu, and a kprobe's arguments arg0
+// to arg5 (arg7 on arm64), a kretprobe's retval and a tracepoint's
+// numeric fields, as its format in tracefs names them. The conditions of where, all of which
+// must hold, compare a field with a number.
+//
+// The programs are built by NewProbe and run by the probepilot-probe-
+// generic plugin.
+package generic
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"probepilot/pkg/config"
+	"probepilot/pkg/schema"
+)
+
+// Kind is what a hook attaches to.
+type Kind string
+
+// Kinds of hooks.
+const (
+	Kprobe     Kind = "kprobe"
+	Kretprobe  Kind = "kretprobe"
+	Tracepoint Kind = "tracepoint"
+)
+
+// DefaultMaxKeys bounds the by values counted over all hooks; hits of
+// values beyond are counted as "other".
+const DefaultMaxKeys = 10240
+
+// Spec is a spec file.
+type Spec struct {
+	Hooks []Hook
+	// MaxKeys bounds the by values counted over all hooks
+	MaxKeys int
+}
+
+// Hook is a kprobe, kretprobe or tracepoint and what to extract there.
+type Hook struct {
+	// Name names the hook in metrics and events
+	Name string
+	Kind Kind
+	// Target is the kernel function, or the tracepoint as category/name
+	Target string
+	// Latency times a kprobe's function to its return
+	Latency bool
+	// Slow is the latency above which a call is reported, 0 for none
+	Slow time.Duration
+	// By is the field hits are grouped by, "" for none
+	By string
+	// Sum is the field summed over hits, "" for none
+	Sum string
+	// Where are the conditions a hit must meet
+	Where []Condition
+}
+
+// Condition compares a field with a number.
+type Condition struct {
+	Field string
+	// Op is one of == != < <= > >=
+	Op    string
+	Value int64
+}
+
+func (c Condition) String() string {
+	return fmt.Sprintf("%s %s %d", c.Field, c.Op, c.Value)
+}
+
+// validName keeps hook names usable as label values and in map keys.
+var validName = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// ops are the comparisons of conditions, longest first so <= is not
+// read as <.
+var ops = []string{"==", "!=", "<=", ">=", "<", ">"}
+
+// ReadSpec reads and validates a spec file. Errors name the offending
+// key, e.g. "generic.yaml:4: hooks.reads.latency: only kprobes are timed".
+func ReadSpec(path string) (*Spec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := ParseSpec(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%v", path, err)
+	}
+	return s, nil
+}
+
+// ParseSpec parses and validates a spec.
+func ParseSpec(data []byte) (*Spec, error) {
+	root, err := config.ParseYAML(data)
+	if err != nil {
+		return nil, err
+	}
+	s := &Spec{MaxKeys: DefaultMaxKeys}
+	for _, key := range root.Keys() {
+		n, _ := root.Get(key)
+		switch key {
+		case "schema":
+			if err := schema.Check(schema.Generic, n.Value()); err != nil {
+				return nil, n.Errorf(key, "%v", err)
+			}
+		case "max_keys":
+			v, err := strconv.Atoi(n.Value())
+			if err != nil || v <= 0 {
+				return nil, n.Errorf(key, "invalid value %q (want a positive number)", n.Value())
+			}
+			s.MaxKeys = v
+		case "hooks":
+			if !n.IsMap() {
+				return nil, n.Errorf(key, "want a mapping of hooks by name")
+			}
+			for _, name := range n.Keys() {
+				h, _ := n.Get(name)
+				hook, err := parseHook(key+"."+name, name, h)
+				if err != nil {
+					return nil, err
+				}
+				s.Hooks = append(s.Hooks, hook)
+			}
+		default:
+			return nil, n.Errorf(key, "unknown key (want schema, max_keys or hooks)")
+		}
+	}
+	if len(s.Hooks) == 0 {
+		return nil, root.Errorf("hooks", "no hooks listed")
+	}
+	return s, nil
+}
+
+func parseHook(prefix, name string, n config.Node) (Hook, error) {
+	h := Hook{Name: name}
+	if !validName.MatchString(name) {
+		return h, n.Errorf(prefix, "invalid name (want lowercase letters, digits and _)")
+	}
+	if !n.IsMap() {
+		return h, n.Errorf(prefix, "want a mapping of kprobe, kretprobe or tracepoint and fields")
+	}
+	for _, key := range n.Keys() {
+		v, _ := n.Get(key)
+		k := prefix + "." + key
+		if v.IsMap() || (v.IsList() && key != "where") {
+			return h, v.Errorf(k, "want a value")
+		}
+		switch key {
+		case "kprobe", "kretprobe", "tracepoint":
+			if h.Kind != "" {
+				return h, v.Errorf(k, "hook is already a %s", h.Kind)
+			}
+			h.Kind, h.Target = Kind(key), v.Value()
+			if h.Target == "" {
+				return h, v.Errorf(k, "want a kernel function or category/name")
+			}
+			if h.Kind == Tracepoint && strings.Count(h.Target, "/") != 1 {
+				return h, v.Errorf(k, "invalid tracepoint %q (want category/name, e.g. block/block_rq_issue)", h.Target)
+			}
+		case "latency":
+			switch v.Value() {
+			case "true", "yes", "on":
+				h.Latency = true
+			case "false", "no", "off":
+			default:
+				return h, v.Errorf(k, "invalid value %q (want true or false)", v.Value())
+			}
+		case "slow":
+			d, err := time.ParseDuration(v.Value())
+			if err != nil || d <= 0 {
+				return h, v.Errorf(k, "invalid duration %q", v.Value())
+			}
+			h.Slow = d
+		case "by":
+			h.By = v.Value()
+		case "sum":
+			h.Sum = v.Value()
+		case "where":
+			conds := []config.Node{v}
+			if v.IsList() {
+				conds = v.List()
+			}
+			for _, c := range conds {
+				cond, err := parseCondition(c.Value())
+				if err != nil {
+					return h, c.Errorf(k, "%v", err)
+				}
+				h.Where = append(h.Where, cond)
+			}
+		default:
+			return h, v.Errorf(k, "unknown key (want kprobe, kretprobe, tracepoint, latency, slow, by, sum or where)")
+		}
+	}
+	// errAt is an error about the value of key, on its line
+	errAt := func(key, msg string) error {
+		v, _ := n.Get(key)
+		return v.Errorf(prefix+"."+key, "%s", msg)
+	}
+	switch {
+	case h.Kind == "":
+		return h, n.Errorf(prefix, "want one of kprobe, kretprobe or tracepoint")
+	case h.Latency && h.Kind != Kprobe:
+		return h, errAt("latency", "only kprobes are timed")
+	case h.Slow > 0 && !h.Latency:
+		return h, errAt("slow", "needs latency: true")
+	case h.Latency && h.Sum != "":
+		return h, errAt("sum", "a timed hook sums its latencies")
+	}
+	return h, nil
+}
+
+// parseCondition parses "field op number", e.g. "nr_sector >= 8".
+func parseCondition(s string) (Condition, error) {
+	for _, op := range ops {
+		field, value, ok := strings.Cut(s, op)
+		if !ok {
+			continue
+		}
+		c := Condition{Field: strings.TrimSpace(field), Op: op}
+		value = strings.TrimSpace(value)
+		v, err := strconv.ParseInt(value, 0, 64)
+		if err != nil {
+			u, uerr := strconv.ParseUint(value, 0, 64)
+			if uerr != nil {
+				return c, fmt.Errorf("invalid number %q in %q", value, s)
+			}
+			v = int64(u)
+		}
+		c.Value = v
+		if c.Field == "" {
+			return c, fmt.Errorf("no field in %q", s)
+		}
+		return c, nil
+	}
+	return Condition{}, fmt.Errorf("invalid condition %q (want field op number, op one of %s)", s, strings.Join(ops, " "))
+}
@@ -0,0 +1,52 @@
+package histogram
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// RegisterFlags defines the histogram flags on fs. The returned function
+// parses their values once fs has been parsed.
+func RegisterFlags(fs *flag.FlagSet) func() (Options, error) {
+	mode := fs.String("histograms", string(Both), "histogram layout exported on /metrics: classic, native or both")
+	schema := fs.Int("histogram-schema", DefaultSchema, "initial native histogram resolution (-4..8); each step halves bucket width")
+	buckets := fs.String("histogram-buckets", "", "classic bucket boundaries as name=b1,b2,... separated by ';', e.g. tcp_rtt_seconds=0.001,0.01,0.1")
+
+	return func() (Options, error) {
+		o := Options{Mode: Mode(*mode), Schema: int32(*schema)}
+		switch o.Mode {
+		case Classic, Native, Both:
+		default:
+			return o, fmt.Errorf("invalid -histograms %q (want classic, native or both)", *mode)
+		}
+		if *schema < MinSchema || *schema > MaxSchema {
+			return o, fmt.Errorf("invalid -histogram-schema %d (want %d..%d)", *schema, MinSchema, MaxSchema)
+		}
+		for _, spec := range splitTrim(*buckets, ";") {
+			name, list, ok := strings.Cut(spec, "=")
+			if !ok || name == "" {
+				return o, fmt.Errorf("invalid -histogram-buckets entry %q (want name=b1,b2,...)", spec)
+			}
+			bounds, err := ParseBuckets(list)
+			if err != nil {
+				return o, fmt.Errorf("invalid -histogram-buckets entry %q: %w", spec, err)
+			}
+			if o.Buckets == nil {
+				o.Buckets = make(map[string][]float64)
+			}
+			o.Buckets[strings.TrimSpace(name)] = bounds
+		}
+		return o, nil
+	}
+}
+
+func splitTrim(s, sep string) []string {
+	var parts []string
+	for _, part := range strings.Split(s, sep) {
+		if part = strings.TrimSpace(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
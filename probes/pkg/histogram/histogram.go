@@ -0,0 +1,319 @@
+// Package histogram records latency and size distributions (RTT,
+// allocation sizes, run queue and I/O latency) for export as Prometheus
+// histograms: classic buckets with configurable boundaries, native
+// histograms with exponential buckets, or both.
+//
+// Native buckets need no boundaries up front: at schema s, bucket i covers
+// (2^((i-1)/2^s), 2^(i/2^s)], so every bucket spans the same relative
+// width whatever the unit. When a histogram spreads over more than
+// MaxNativeBuckets buckets its schema is lowered, halving the resolution,
+// as Prometheus client libraries do.
+//
+// Observations may carry exemplars, labels identifying the event behind
+// them, so a spike on a dashboard leads to the flow or process that caused
+// it. Each classic bucket keeps its latest exemplar; native histograms
+// keep the largest recent observations, which are the outliers worth
+// following.
+package histogram
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"probepilot/pkg/query"
+)
+
+// Mode selects the bucket layouts a histogram keeps.
+type Mode string
+
+const (
+	Classic Mode = "classic"
+	Native  Mode = "native"
+	Both    Mode = "both"
+)
+
+// Schema bounds and defaults of native histograms.
+const (
+	MinSchema        = -4
+	MaxSchema        = 8
+	DefaultSchema    = 3 // buckets ~9% wide
+	MaxNativeBuckets = 160
+)
+
+// Options configures the histograms of one agent.
+type Options struct {
+	Mode Mode
+	// Schema is the initial resolution of native buckets.
+	Schema int32
+	// Buckets overrides the classic boundaries of histograms by name.
+	Buckets map[string][]float64
+}
+
+// DefaultOptions keeps both layouts at the default schema.
+func DefaultOptions() Options {
+	return Options{Mode: Both, Schema: DefaultSchema}
+}
+
+// New returns the histogram name, with classic boundaries from the
+// options or else bounds.
+func (o Options) New(name string, bounds []float64) *Histogram {
+	if b, ok := o.Buckets[name]; ok {
+		bounds = b
+	}
+	h := &Histogram{name: name}
+	if o.Mode != Native {
+		h.bounds = append([]float64(nil), bounds...)
+		sort.Float64s(h.bounds)
+		h.counts = make([]uint64, len(h.bounds))
+		h.bucketExemplars = make([]*query.Exemplar, len(h.bounds)+1)
+	}
+	if o.Mode != Classic {
+		h.native = true
+		h.schema = o.Schema
+		h.positive = make(map[int]uint64)
+	}
+	return h
+}
+
+// Histogram is one distribution. It is safe for concurrent use.
+type Histogram struct {
+	name string
+
+	mu     sync.Mutex
+	count  uint64
+	sum    float64
+	bounds []float64
+	counts []uint64 // per bucket, not cumulative
+
+	// Latest exemplar of each classic bucket, +Inf last
+	bucketExemplars []*query.Exemplar
+	// Largest observations within ExemplarTTL, for native histograms
+	exemplars []query.Exemplar
+
+	native    bool
+	schema    int32
+	zeroCount uint64
+	positive  map[int]uint64
+}
+
+// Name returns the metric name of h.
+func (h *Histogram) Name() string {
+	return h.name
+}
+
+// Exemplar retention of native histograms.
+const (
+	MaxExemplars = 10
+	ExemplarTTL  = 5 * time.Minute
+)
+
+// Observe records one value. Negative values and NaN are ignored; every
+// distribution recorded here is non-negative.
+func (h *Histogram) Observe(v float64) {
+	h.ObserveWithExemplar(v, nil)
+}
+
+// ObserveWithExemplar records one value with labels identifying the event
+// behind it. Labels that would push the exemplar past MaxExemplarRunes
+// characters are dropped; with no labels no exemplar is kept.
+func (h *Histogram) ObserveWithExemplar(v float64, labels query.Labels) {
+	if !(v >= 0) {
+		return
+	}
+	var ex *query.Exemplar
+	if labels = fitExemplarLabels(labels); len(labels) > 0 {
+		ex = &query.Exemplar{Labels: labels, Value: v, Timestamp: time.Now()}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.count++
+	h.sum += v
+	if h.counts != nil {
+		i := sort.SearchFloat64s(h.bounds, v)
+		if i < len(h.bounds) {
+			h.counts[i]++
+		}
+		if ex != nil {
+			h.bucketExemplars[i] = ex
+		}
+	}
+	if !h.native {
+		return
+	}
+	if ex != nil {
+		h.keepExemplar(*ex)
+	}
+	if v <= ZeroThreshold {
+		h.zeroCount++
+		return
+	}
+	h.positive[nativeIndex(h.schema, v)]++
+	for len(h.positive) > MaxNativeBuckets && h.schema > MinSchema {
+		h.halveResolution()
+	}
+}
+
+// keepExemplar keeps ex if it is among the largest observations not older
+// than ExemplarTTL.
+func (h *Histogram) keepExemplar(ex query.Exemplar) {
+	live := h.exemplars[:0]
+	for _, e := range h.exemplars {
+		if ex.Timestamp.Sub(e.Timestamp) < ExemplarTTL {
+			live = append(live, e)
+		}
+	}
+	h.exemplars = live
+	if len(h.exemplars) < MaxExemplars {
+		h.exemplars = append(h.exemplars, ex)
+		return
+	}
+	min := 0
+	for i, e := range h.exemplars {
+		if e.Value < h.exemplars[min].Value {
+			min = i
+		}
+	}
+	if ex.Value >= h.exemplars[min].Value {
+		h.exemplars[min] = ex
+	}
+}
+
+// fitExemplarLabels returns the labels that fit into MaxExemplarRunes.
+func fitExemplarLabels(labels query.Labels) query.Labels {
+	if len(labels) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	fit := make(query.Labels, len(labels))
+	n := 0
+	for _, k := range names {
+		runes := utf8.RuneCountInString(k) + utf8.RuneCountInString(labels[k])
+		if n+runes > query.MaxExemplarRunes {
+			continue
+		}
+		n += runes
+		fit[k] = labels[k]
+	}
+	return fit
+}
+
+// ZeroThreshold is the width of the native zero bucket. Latencies and
+// sizes are never fractional enough to need a wider one.
+const ZeroThreshold = 2.938735877055719e-39 // 2^-128
+
+// nativeIndex returns the bucket of v > 0 at schema: the smallest i with
+// v <= 2^(i/2^schema). Frexp keeps exact powers of two on their bucket's
+// upper bound.
+func nativeIndex(schema int32, v float64) int {
+	frac, exp := math.Frexp(v) // v = frac * 2^exp, frac in [0.5, 1)
+	if schema > 0 {
+		bounds := nativeBounds[schema]
+		return sort.SearchFloat64s(bounds, frac) + (exp-1)*len(bounds)
+	}
+	i := exp
+	if frac == 0.5 {
+		i--
+	}
+	offset := (1 << -schema) - 1
+	return (i + offset) >> -schema
+}
+
+// nativeBounds[s] holds 2^(j/2^s - 1) for j in [0, 2^s), the bucket
+// boundaries within one power of two as Frexp fractions.
+var nativeBounds = func() [MaxSchema + 1][]float64 {
+	var b [MaxSchema + 1][]float64
+	for s := 1; s <= MaxSchema; s++ {
+		n := 1 << s
+		b[s] = make([]float64, n)
+		for j := 0; j < n; j++ {
+			b[s][j] = math.Exp2(float64(j)/float64(n) - 1)
+		}
+	}
+	return b
+}()
+
+// halveResolution merges pairs of native buckets: bucket i at schema s
+// lies within bucket ceil(i/2) at schema s-1.
+func (h *Histogram) halveResolution() {
+	merged := make(map[int]uint64, len(h.positive)/2+1)
+	for i, n := range h.positive {
+		merged[(i+1)>>1] += n
+	}
+	h.positive = merged
+	h.schema--
+}
+
+// Snapshot returns h as an exported sample with the given labels.
+func (h *Histogram) Snapshot(labels query.Labels) query.HistogramSample {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := query.HistogramSample{
+		Name:   h.name,
+		Labels: labels,
+		Count:  h.count,
+		Sum:    h.sum,
+	}
+	if h.counts != nil {
+		s.Bounds = append([]float64{}, h.bounds...)
+		s.Cumulative = make([]uint64, len(h.counts))
+		var n uint64
+		for i, c := range h.counts {
+			n += c
+			s.Cumulative[i] = n
+		}
+		s.BucketExemplars = append([]*query.Exemplar(nil), h.bucketExemplars...)
+	}
+	if h.native {
+		s.Native = true
+		s.Schema = h.schema
+		s.ZeroThreshold = ZeroThreshold
+		s.ZeroCount = h.zeroCount
+		s.Positive = make(map[int]uint64, len(h.positive))
+		for i, n := range h.positive {
+			s.Positive[i] = n
+		}
+		s.Exemplars = append([]query.Exemplar(nil), h.exemplars...)
+	}
+	return s
+}
+
+// ExponentialBuckets returns n boundaries starting at start, each factor
+// times the previous.
+func ExponentialBuckets(start, factor float64, n int) []float64 {
+	bounds := make([]float64, n)
+	for i := range bounds {
+		bounds[i] = start
+		start *= factor
+	}
+	return bounds
+}
+
+// ParseBuckets parses comma-separated ascending boundaries, e.g.
+// "0.001,0.01,0.1,1".
+func ParseBuckets(s string) ([]float64, error) {
+	var bounds []float64
+	for _, part := range splitTrim(s, ",") {
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, fmt.Errorf("invalid bucket boundary %q", part)
+		}
+		if len(bounds) > 0 && v <= bounds[len(bounds)-1] {
+			return nil, fmt.Errorf("bucket boundaries must ascend: %v after %v", v, bounds[len(bounds)-1])
+		}
+		bounds = append(bounds, v)
+	}
+	if len(bounds) == 0 {
+		return nil, fmt.Errorf("no bucket boundaries in %q", s)
+	}
+	return bounds, nil
+}
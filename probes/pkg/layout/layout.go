@@ -0,0 +1,165 @@
+// Package layout checks at load time that the Go structs an agent decodes
+// records into still match the structs described by the BTF of the eBPF
+// object it loaded. An object and agent built from different revisions
+// otherwise decode garbage without any error.
+package layout
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/cilium/ebpf/btf"
+)
+
+// ErrNoBTF is returned when the object carries no type information, so
+// layouts cannot be checked.
+var ErrNoBTF = errors.New("object has no BTF")
+
+// Check pairs a C struct name with a Go value of the mirroring type.
+type Check struct {
+	CType string
+	Value any
+}
+
+// Mismatch describes one difference between a C struct and its Go mirror.
+type Mismatch struct {
+	CType  string
+	Field  string
+	Detail string
+}
+
+func (m Mismatch) Error() string {
+	if m.Field == "" {
+		return fmt.Sprintf("struct %s: %s", m.CType, m.Detail)
+	}
+	return fmt.Sprintf("struct %s field %s: %s", m.CType, m.Field, m.Detail)
+}
+
+// ValidateAll runs every check and joins all mismatches into one error.
+func ValidateAll(spec *btf.Spec, checks ...Check) error {
+	if spec == nil {
+		return ErrNoBTF
+	}
+	var errs []error
+	for _, c := range checks {
+		if err := Validate(spec, c.CType, c.Value); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Validate compares the layout of the Go struct value against the BTF
+// struct named ctype: total size, and the offset and size of every named
+// member in declaration order, down through nested structs and the
+// lengths of arrays. Blank Go fields (explicit padding) are ignored.
+func Validate(spec *btf.Spec, ctype string, value any) error {
+	if spec == nil {
+		return ErrNoBTF
+	}
+
+	var st *btf.Struct
+	if err := spec.TypeByName(ctype, &st); err != nil {
+		return Mismatch{CType: ctype, Detail: fmt.Sprintf("not found in BTF: %v", err)}
+	}
+
+	goType := reflect.TypeOf(value)
+	for goType.Kind() == reflect.Pointer {
+		goType = goType.Elem()
+	}
+	if goType.Kind() != reflect.Struct {
+		return fmt.Errorf("layout: %s is not a struct", goType)
+	}
+	return errors.Join(compareStruct(ctype, "", st, goType)...)
+}
+
+// compareStruct compares st with the Go struct goType, naming the
+// members of a nested struct after the path to it, e.g. "key.pid".
+func compareStruct(ctype, path string, st *btf.Struct, goType reflect.Type) []error {
+	var errs []error
+	if uintptr(st.Size) != goType.Size() {
+		errs = append(errs, Mismatch{
+			CType:  ctype,
+			Field:  path,
+			Detail: fmt.Sprintf("size is %d bytes in BTF but %d bytes in Go (%s)", st.Size, goType.Size(), goType),
+		})
+	}
+
+	fields := namedFields(goType)
+	members := namedMembers(st)
+	if len(fields) != len(members) {
+		errs = append(errs, Mismatch{
+			CType:  ctype,
+			Field:  path,
+			Detail: fmt.Sprintf("has %d fields in BTF but %d in Go (%s)", len(members), len(fields), goType),
+		})
+	}
+
+	for i := 0; i < len(fields) && i < len(members); i++ {
+		f, m := fields[i], members[i]
+		name := m.Name
+		if path != "" {
+			name = path + "." + m.Name
+		}
+		size, err := btf.Sizeof(m.Type)
+		if err != nil {
+			errs = append(errs, Mismatch{CType: ctype, Field: name, Detail: err.Error()})
+			continue
+		}
+		if m.BitfieldSize > 0 {
+			errs = append(errs, Mismatch{CType: ctype, Field: name, Detail: "bitfields cannot be mirrored"})
+			continue
+		}
+		offset := uintptr(m.Offset.Bytes())
+		if f.Offset != offset || f.Type.Size() != uintptr(size) {
+			errs = append(errs, Mismatch{
+				CType: ctype,
+				Field: name,
+				Detail: fmt.Sprintf("offset %d size %d in BTF, but Go field %s has offset %d size %d",
+					offset, size, f.Name, f.Offset, f.Type.Size()),
+			})
+			continue
+		}
+		errs = append(errs, compareMember(ctype, name, m.Type, f.Type)...)
+	}
+	return errs
+}
+
+// compareMember compares the inside of a member whose offset and size
+// match: the members of a struct, the length and elements of an array.
+func compareMember(ctype, name string, typ btf.Type, goType reflect.Type) []error {
+	switch t := btf.UnderlyingType(typ).(type) {
+	case *btf.Struct:
+		if goType.Kind() != reflect.Struct {
+			return []error{Mismatch{CType: ctype, Field: name, Detail: fmt.Sprintf("is a struct in BTF but %s in Go", goType)}}
+		}
+		return compareStruct(ctype, name, t, goType)
+	case *btf.Array:
+		if goType.Kind() != reflect.Array || goType.Len() != int(t.Nelems) {
+			return []error{Mismatch{CType: ctype, Field: name, Detail: fmt.Sprintf("is an array of %d in BTF but %s in Go", t.Nelems, goType)}}
+		}
+		return compareMember(ctype, name+"[]", t.Type, goType.Elem())
+	}
+	return nil
+}
+
+func namedFields(t reflect.Type) []reflect.StructField {
+	var fields []reflect.StructField
+	for i := 0; i < t.NumField(); i++ {
+		if f := t.Field(i); f.Name != "_" {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+func namedMembers(st *btf.Struct) []btf.Member {
+	var members []btf.Member
+	for _, m := range st.Members {
+		if m.Name != "" {
+			members = append(members, m)
+		}
+	}
+	return members
+}
@@ -0,0 +1,71 @@
+package limits
+
+import (
+	"runtime/metrics"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// heapMetric is the live heap, the part of the agent's memory that the
+// userspace aggregates account for.
+const heapMetric = "/memory/classes/heap/objects:bytes"
+
+// Budget caps the memory userspace aggregates (flow tables, per-process
+// stats, leak candidates) may grow to. Agents ask Allow before creating a
+// new aggregate entry and drop the entry when the heap is over budget.
+type Budget struct {
+	limit   uint64
+	dropped atomic.Uint64
+
+	mu      sync.Mutex
+	checked time.Time
+	over    bool
+	sample  []metrics.Sample
+}
+
+// NewBudget creates a budget of limit bytes; zero never refuses.
+func NewBudget(limit uint64) *Budget {
+	return &Budget{
+		limit:  limit,
+		sample: []metrics.Sample{{Name: heapMetric}},
+	}
+}
+
+// Allow reports whether a new aggregate entry may be created. The heap is
+// sampled at most once per second, so Allow is cheap on hot paths.
+func (b *Budget) Allow() bool {
+	if b == nil || b.limit == 0 {
+		return true
+	}
+
+	b.mu.Lock()
+	if now := time.Now(); now.Sub(b.checked) >= time.Second {
+		b.checked = now
+		metrics.Read(b.sample)
+		b.over = b.sample[0].Value.Kind() == metrics.KindUint64 && b.sample[0].Value.Uint64() > b.limit
+	}
+	over := b.over
+	b.mu.Unlock()
+
+	if over {
+		b.dropped.Add(1)
+	}
+	return !over
+}
+
+// Dropped returns how many entries were refused.
+func (b *Budget) Dropped() uint64 {
+	if b == nil {
+		return 0
+	}
+	return b.dropped.Load()
+}
+
+// Limit returns the budget in bytes.
+func (b *Budget) Limit() uint64 {
+	if b == nil {
+		return 0
+	}
+	return b.limit
+}
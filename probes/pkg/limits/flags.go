@@ -0,0 +1,55 @@
+package limits
+
+import (
+	"flag"
+	"fmt"
+)
+
+// RegisterFlags defines the resource limit flags on fs. The returned
+// function parses their values once fs has been parsed.
+func RegisterFlags(fs *flag.FlagSet) func() (Limits, error) {
+	ringbuf := fs.String("ringbuf-size", "", "ring buffer size, e.g. 1M (default: as compiled)")
+	mapEntries := fs.String("map-entries", "", "max_entries overrides as name=entries pairs, e.g. flow_map=65536")
+	nice := fs.Int("nice", 0, "scheduling niceness of the agent (-20..19)")
+	oomScoreAdj := fs.Int("oom-score-adj", 0, "oom_score_adj of the agent (-1000..1000)")
+	cpus := fs.String("cpus", "", "CPU list to pin the agent to, e.g. 0-1")
+	memoryLimit := fs.String("memory-limit", "", "cap on the agent's userspace memory, e.g. 256M")
+	topK := fs.Int("top-k", DefaultTopK, "entries kept per process, flow and stack aggregate; lighter entries are evicted")
+
+	return func() (Limits, error) {
+		var l Limits
+		if *ringbuf != "" {
+			size, err := ParseSize(*ringbuf)
+			if err != nil || size == 0 || size > 1<<31 {
+				return l, fmt.Errorf("invalid -ringbuf-size %q", *ringbuf)
+			}
+			l.RingBufferSize = uint32(size)
+		}
+		entries, err := ParseMapEntries(*mapEntries)
+		if err != nil {
+			return l, err
+		}
+		l.MapEntries = entries
+		if *nice < -20 || *nice > 19 {
+			return l, fmt.Errorf("invalid -nice %d (want -20..19)", *nice)
+		}
+		l.Nice = *nice
+		if *oomScoreAdj < -1000 || *oomScoreAdj > 1000 {
+			return l, fmt.Errorf("invalid -oom-score-adj %d (want -1000..1000)", *oomScoreAdj)
+		}
+		l.OOMScoreAdj = *oomScoreAdj
+		if l.CPUs, err = ParseCPUList(*cpus); err != nil {
+			return l, err
+		}
+		if *memoryLimit != "" {
+			if l.MemoryLimit, err = ParseSize(*memoryLimit); err != nil {
+				return l, fmt.Errorf("invalid -memory-limit: %w", err)
+			}
+		}
+		if *topK < 1 {
+			return l, fmt.Errorf("invalid -top-k %d (want at least 1)", *topK)
+		}
+		l.TopK = *topK
+		return l, nil
+	}
+}
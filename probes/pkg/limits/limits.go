@@ -0,0 +1,229 @@
+// Package limits bounds the resources a probe agent takes from the host it
+// observes: eBPF map and ring buffer sizes at load time, the agent's own
+// scheduling priority, CPU affinity and OOM score, and the memory its
+// userspace aggregates may grow to.
+package limits
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	"github.com/cilium/ebpf"
+)
+
+// Limits configures the resource caps of one agent. Zero values leave the
+// corresponding setting untouched.
+type Limits struct {
+	// RingBufferSize resizes every ring buffer map, in bytes. It is rounded
+	// up to a power of two of at least one page, as the kernel requires.
+	RingBufferSize uint32
+	// MapEntries overrides max_entries of maps by name.
+	MapEntries map[string]uint32
+	// Nice is the agent's scheduling niceness (-20..19).
+	Nice int
+	// OOMScoreAdj is written to /proc/self/oom_score_adj (-1000..1000).
+	// Positive values make the kernel kill the agent before workloads.
+	OOMScoreAdj int
+	// CPUs pins the agent to the listed CPUs.
+	CPUs []int
+	// MemoryLimit caps the agent's userspace memory, in bytes. It sets the
+	// Go runtime's soft limit and the aggregate Budget.
+	MemoryLimit uint64
+	// TopK caps the entries of each high-cardinality aggregate (processes,
+	// flows, stacks); lighter entries make way for heavier ones.
+	TopK int
+}
+
+// DefaultTopK is the TopK used when none is set.
+const DefaultTopK = 10000
+
+// TopKEntries returns TopK, or DefaultTopK if it is unset.
+func (l Limits) TopKEntries() int {
+	if l.TopK > 0 {
+		return l.TopK
+	}
+	return DefaultTopK
+}
+
+// ApplySpec resizes maps in spec before the collection is loaded.
+func (l Limits) ApplySpec(spec *ebpf.CollectionSpec) error {
+	if l.RingBufferSize > 0 {
+		size := ringBufferSize(l.RingBufferSize)
+		for _, m := range spec.Maps {
+			if m.Type == ebpf.RingBuf {
+				m.MaxEntries = size
+			}
+		}
+	}
+	for name, entries := range l.MapEntries {
+		m, ok := spec.Maps[name]
+		if !ok {
+			return fmt.Errorf("map %s: not in object", name)
+		}
+		if m.Type == ebpf.RingBuf {
+			entries = ringBufferSize(entries)
+		}
+		if entries == 0 {
+			return fmt.Errorf("map %s: max_entries must be positive", name)
+		}
+		m.MaxEntries = entries
+	}
+	return nil
+}
+
+// ringBufferSize rounds size up to a power of two of at least one page.
+func ringBufferSize(size uint32) uint32 {
+	page := uint32(os.Getpagesize())
+	if size < page {
+		return page
+	}
+	n := page
+	for n < size && n < 1<<31 {
+		n <<= 1
+	}
+	return n
+}
+
+// ApplyProcess applies the process-level limits to the running agent.
+// Every setting is attempted; the errors are joined.
+func (l Limits) ApplyProcess() error {
+	var errs []error
+	if l.MemoryLimit > 0 {
+		debug.SetMemoryLimit(int64(l.MemoryLimit))
+	}
+	if l.Nice != 0 {
+		if err := setNice(l.Nice); err != nil {
+			errs = append(errs, fmt.Errorf("set nice %d: %w", l.Nice, err))
+		}
+	}
+	if l.OOMScoreAdj != 0 {
+		if err := setOOMScoreAdj(l.OOMScoreAdj); err != nil {
+			errs = append(errs, fmt.Errorf("set oom_score_adj %d: %w", l.OOMScoreAdj, err))
+		}
+	}
+	if len(l.CPUs) > 0 {
+		if err := setAffinity(l.CPUs); err != nil {
+			errs = append(errs, fmt.Errorf("set CPU affinity %v: %w", l.CPUs, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// String summarizes the configured limits for startup logs.
+func (l Limits) String() string {
+	var parts []string
+	if l.RingBufferSize > 0 {
+		parts = append(parts, "ringbuf="+FormatSize(uint64(ringBufferSize(l.RingBufferSize))))
+	}
+	for name, entries := range l.MapEntries {
+		parts = append(parts, fmt.Sprintf("%s=%d", name, entries))
+	}
+	if l.Nice != 0 {
+		parts = append(parts, fmt.Sprintf("nice=%d", l.Nice))
+	}
+	if l.OOMScoreAdj != 0 {
+		parts = append(parts, fmt.Sprintf("oom_score_adj=%d", l.OOMScoreAdj))
+	}
+	if len(l.CPUs) > 0 {
+		parts = append(parts, fmt.Sprintf("cpus=%v", l.CPUs))
+	}
+	if l.MemoryLimit > 0 {
+		parts = append(parts, "memory="+FormatSize(l.MemoryLimit))
+	}
+	if l.TopK > 0 && l.TopK != DefaultTopK {
+		parts = append(parts, fmt.Sprintf("top_k=%d", l.TopK))
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, " ")
+}
+
+// ParseMapEntries parses "name=entries" pairs separated by commas.
+func ParseMapEntries(s string) (map[string]uint32, error) {
+	entries := make(map[string]uint32)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid map size %q (want name=entries)", pair)
+		}
+		n, err := ParseSize(value)
+		if err != nil || n == 0 || n > 1<<32-1 {
+			return nil, fmt.Errorf("invalid map size %q", pair)
+		}
+		entries[name] = uint32(n)
+	}
+	return entries, nil
+}
+
+// ParseCPUList parses a CPU list such as "0-3,6".
+func ParseCPUList(s string) ([]int, error) {
+	var cpus []int
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		lo, hi, isRange := strings.Cut(part, "-")
+		first, err := strconv.Atoi(lo)
+		if err != nil || first < 0 {
+			return nil, fmt.Errorf("invalid CPU list entry %q", part)
+		}
+		last := first
+		if isRange {
+			last, err = strconv.Atoi(hi)
+			if err != nil || last < first {
+				return nil, fmt.Errorf("invalid CPU list entry %q", part)
+			}
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+// ParseSize parses a byte count with an optional K, M or G suffix (powers
+// of 1024), e.g. "512K" or "256M".
+func ParseSize(s string) (uint64, error) {
+	s = strings.TrimSpace(strings.ToUpper(s))
+	s = strings.TrimSuffix(s, "B")
+	shift := 0
+	switch {
+	case strings.HasSuffix(s, "K"):
+		shift = 10
+	case strings.HasSuffix(s, "M"):
+		shift = 20
+	case strings.HasSuffix(s, "G"):
+		shift = 30
+	}
+	if shift > 0 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n << shift, nil
+}
+
+// FormatSize renders a byte count with the largest exact K/M/G suffix.
+func FormatSize(n uint64) string {
+	switch {
+	case n >= 1<<30 && n%(1<<30) == 0:
+		return fmt.Sprintf("%dG", n>>30)
+	case n >= 1<<20 && n%(1<<20) == 0:
+		return fmt.Sprintf("%dM", n>>20)
+	case n >= 1<<10 && n%(1<<10) == 0:
+		return fmt.Sprintf("%dK", n>>10)
+	}
+	return strconv.FormatUint(n, 10)
+}
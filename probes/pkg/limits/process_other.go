@@ -0,0 +1,11 @@
+//go:build !linux
+
+package limits
+
+import "errors"
+
+var errUnsupported = errors.New("not supported on this platform")
+
+func setNice(int) error        { return errUnsupported }
+func setOOMScoreAdj(int) error { return errUnsupported }
+func setAffinity([]int) error  { return errUnsupported }
@@ -0,0 +1,24 @@
+package maps
+
+import (
+	"errors"
+
+	"github.com/cilium/ebpf"
+)
+
+// DropsMap names the per-CPU array in which probes count the records their
+// ring buffer had no room for, at key 0.
+const DropsMap = "ringbuf_drops"
+
+// ErrNoDropsMap is returned by RingbufDrops for objects that do not count
+// their drops.
+var ErrNoDropsMap = errors.New("no " + DropsMap + " map")
+
+// RingbufDrops sums over every CPU the records the programs of coll could
+// not reserve room for in their ring buffer.
+func RingbufDrops(coll *ebpf.Collection) (uint64, error) {
+	if coll == nil || coll.Maps[DropsMap] == nil {
+		return 0, ErrNoDropsMap
+	}
+	return LookupAggregated[uint32, uint64](coll.Maps[DropsMap], 0, nil)
+}
@@ -0,0 +1,153 @@
+// Package maps provides typed helpers for reading eBPF maps from probes.
+package maps
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/cilium/ebpf"
+)
+
+// ErrNotPerCPU is returned when a per-CPU helper is used on a map that
+// stores a single value per key.
+var ErrNotPerCPU = errors.New("map is not a per-CPU map")
+
+// IsPerCPU reports whether m keeps one value per possible CPU.
+func IsPerCPU(m *ebpf.Map) bool {
+	switch m.Type() {
+	case ebpf.PerCPUHash, ebpf.PerCPUArray, ebpf.LRUCPUHash, ebpf.PerCPUCGroupStorage:
+		return true
+	}
+	return false
+}
+
+// LookupPerCPU returns the value of key on every possible CPU, indexed by
+// CPU number. A plain Lookup into a single V silently reads only the first
+// CPU's slot, which is why per-CPU maps must go through this helper.
+func LookupPerCPU[K, V any](m *ebpf.Map, key K) ([]V, error) {
+	if !IsPerCPU(m) {
+		return nil, fmt.Errorf("lookup %s: %w", m, ErrNotPerCPU)
+	}
+	var values []V
+	if err := m.Lookup(key, &values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// Merge folds the value from one CPU into an accumulator.
+type Merge[V any] func(acc *V, v V)
+
+// LookupAggregated looks up key and folds the per-CPU values with merge.
+// A nil merge sums every numeric field (see Sum).
+func LookupAggregated[K, V any](m *ebpf.Map, key K, merge Merge[V]) (V, error) {
+	var acc V
+	values, err := LookupPerCPU[K, V](m, key)
+	if err != nil {
+		return acc, err
+	}
+	return Reduce(values, merge), nil
+}
+
+// AggregateAll iterates a per-CPU hash or array and returns every key with
+// its per-CPU values folded by merge. A nil merge sums numeric fields.
+func AggregateAll[K comparable, V any](m *ebpf.Map, merge Merge[V]) (map[K]V, error) {
+	if !IsPerCPU(m) {
+		return nil, fmt.Errorf("iterate %s: %w", m, ErrNotPerCPU)
+	}
+
+	result := make(map[K]V)
+	var (
+		key    K
+		values []V
+	)
+	iter := m.Iterate()
+	for iter.Next(&key, &values) {
+		result[key] = Reduce(values, merge)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("iterate %s: %w", m, err)
+	}
+	return result, nil
+}
+
+// Reduce folds values with merge, or with Sum when merge is nil.
+func Reduce[V any](values []V, merge Merge[V]) V {
+	if merge == nil {
+		return Sum(values)
+	}
+	var acc V
+	for _, v := range values {
+		merge(&acc, v)
+	}
+	return acc
+}
+
+// Number is any integer or floating point type.
+type Number interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr |
+		~float32 | ~float64
+}
+
+// SumNumbers adds up per-CPU scalar values such as packet counters.
+func SumNumbers[V Number](values []V) V {
+	var total V
+	for _, v := range values {
+		total += v
+	}
+	return total
+}
+
+// MaxNumbers returns the largest per-CPU value, for gauges such as
+// timestamps where summing makes no sense.
+func MaxNumbers[V Number](values []V) V {
+	var largest V
+	for i, v := range values {
+		if i == 0 || v > largest {
+			largest = v
+		}
+	}
+	return largest
+}
+
+// Sum adds the per-CPU copies of a value field by field. Numeric fields,
+// including those in nested structs and arrays, are summed. Byte arrays
+// (comm names) and other fields keep the value from the first CPU.
+func Sum[V any](values []V) V {
+	var acc V
+	if len(values) == 0 {
+		return acc
+	}
+	acc = values[0]
+	dst := reflect.ValueOf(&acc).Elem()
+	for _, v := range values[1:] {
+		addValue(dst, reflect.ValueOf(v))
+	}
+	return acc
+}
+
+func addValue(dst, src reflect.Value) {
+	switch dst.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		dst.SetInt(dst.Int() + src.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		dst.SetUint(dst.Uint() + src.Uint())
+	case reflect.Float32, reflect.Float64:
+		dst.SetFloat(dst.Float() + src.Float())
+	case reflect.Struct:
+		for i := 0; i < dst.NumField(); i++ {
+			if dst.Field(i).CanSet() {
+				addValue(dst.Field(i), src.Field(i))
+			}
+		}
+	case reflect.Array:
+		if k := dst.Type().Elem().Kind(); k == reflect.Int8 || k == reflect.Uint8 {
+			return
+		}
+		for i := 0; i < dst.Len(); i++ {
+			addValue(dst.Index(i), src.Index(i))
+		}
+	}
+}
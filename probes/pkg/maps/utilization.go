@@ -0,0 +1,121 @@
+package maps
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/cilium/ebpf"
+)
+
+// DefaultWarnPercent is the fill level at which maps are reported as
+// needing a resize.
+const DefaultWarnPercent = 80
+
+// Utilization is the fill level of one map.
+type Utilization struct {
+	Name       string
+	Type       ebpf.MapType
+	Entries    uint32
+	MaxEntries uint32
+}
+
+// Percent is the share of max_entries in use.
+func (u Utilization) Percent() float64 {
+	if u.MaxEntries == 0 {
+		return 0
+	}
+	return 100 * float64(u.Entries) / float64(u.MaxEntries)
+}
+
+// Evicts reports whether the map makes room by evicting old entries when
+// full, rather than rejecting inserts.
+func (u Utilization) Evicts() bool {
+	return u.Type == ebpf.LRUHash || u.Type == ebpf.LRUCPUHash
+}
+
+func (u Utilization) String() string {
+	return fmt.Sprintf("%s: %d/%d (%.1f%%)", u.Name, u.Entries, u.MaxEntries, u.Percent())
+}
+
+// Recommendation returns resize guidance once the map is at least
+// warnPercent full, or "" while it has headroom. The suggested size
+// doubles current usage, rounded up to a power of two.
+func (u Utilization) Recommendation(warnPercent float64) string {
+	if u.Percent() < warnPercent {
+		return ""
+	}
+	suggested := uint32(1)
+	for suggested < 2*u.Entries && suggested < 1<<31 {
+		suggested <<= 1
+	}
+	consequence := "new entries will be silently dropped when it is full"
+	if u.Evicts() {
+		consequence = "the oldest entries are being evicted early"
+	}
+	return fmt.Sprintf("map %s is %.0f%% full (%d/%d); %s. Raise it with -map-entries %s=%d",
+		u.Name, u.Percent(), u.Entries, u.MaxEntries, consequence, u.Name, suggested)
+}
+
+// keyed reports whether t holds a variable number of keyed entries. Array
+// maps are always "full" and ring buffers have no entries to count.
+func keyed(t ebpf.MapType) bool {
+	switch t {
+	case ebpf.Hash, ebpf.LRUHash, ebpf.PerCPUHash, ebpf.LRUCPUHash,
+		ebpf.StackTrace, ebpf.LPMTrie, ebpf.HashOfMaps:
+		return true
+	}
+	return false
+}
+
+// Count returns the number of entries in m by walking its keys.
+func Count(m *ebpf.Map) (uint32, error) {
+	var (
+		count uint32
+		key   []byte
+		next  = make([]byte, m.KeySize())
+	)
+	// Entries deleted during the walk can restart it; bound it so a busy
+	// map cannot keep us iterating forever
+	limit := m.MaxEntries() + 1
+	for count < limit {
+		var prev interface{}
+		if key != nil {
+			prev = key
+		}
+		if err := m.NextKey(prev, next); err != nil {
+			if errors.Is(err, ebpf.ErrKeyNotExist) {
+				return count, nil
+			}
+			return count, err
+		}
+		count++
+		key = append(key[:0], next...)
+	}
+	return m.MaxEntries(), nil
+}
+
+// Measure returns the utilization of every keyed map in coll, sorted by
+// name. Maps that cannot be walked are skipped.
+func Measure(coll *ebpf.Collection) []Utilization {
+	var result []Utilization
+	for name, m := range coll.Maps {
+		if !keyed(m.Type()) {
+			continue
+		}
+		entries, err := Count(m)
+		if err != nil {
+			continue
+		}
+		result = append(result, Utilization{
+			Name:       name,
+			Type:       m.Type(),
+			Entries:    entries,
+			MaxEntries: m.MaxEntries(),
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
@@ -0,0 +1,107 @@
+//go:build linux
+
+package netif
+
+import (
+	"encoding/binary"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// readLinks dumps the interfaces of the agent's network namespace with
+// RTM_GETLINK.
+func readLinks() ([]Interface, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(fd)
+	tv := unix.NsecToTimeval(int64(500e6))
+	unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv)
+
+	msg := make([]byte, unix.SizeofNlMsghdr+unix.SizeofIfInfomsg)
+	binary.NativeEndian.PutUint32(msg[0:], uint32(len(msg)))
+	binary.NativeEndian.PutUint16(msg[4:], unix.RTM_GETLINK)
+	binary.NativeEndian.PutUint16(msg[6:], unix.NLM_F_REQUEST|unix.NLM_F_DUMP)
+	binary.NativeEndian.PutUint32(msg[8:], 1)
+	msg[unix.SizeofNlMsghdr] = unix.AF_UNSPEC
+	if err := unix.Sendto(fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+
+	var links []Interface
+	buf := make([]byte, 64<<10)
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, err
+		}
+		for b := buf[:n]; len(b) >= unix.SizeofNlMsghdr; {
+			size := int(binary.NativeEndian.Uint32(b[0:]))
+			if size < unix.SizeofNlMsghdr || size > len(b) {
+				break
+			}
+			data := b[unix.SizeofNlMsghdr:size]
+			switch binary.NativeEndian.Uint16(b[4:]) {
+			case unix.NLMSG_DONE:
+				return links, nil
+			case unix.NLMSG_ERROR:
+				if len(data) >= 4 {
+					if errno := -int32(binary.NativeEndian.Uint32(data)); errno != 0 {
+						return nil, unix.Errno(errno)
+					}
+				}
+			case unix.RTM_NEWLINK:
+				if len(data) >= unix.SizeofIfInfomsg {
+					links = append(links, parseLink(data))
+				}
+			}
+			b = b[min(nlmAlign(size), len(b)):]
+		}
+	}
+}
+
+// parseLink parses a struct ifinfomsg and its attributes.
+func parseLink(data []byte) Interface {
+	i := Interface{Index: binary.NativeEndian.Uint32(data[4:])}
+	for typ, value := range attrs(data[unix.SizeofIfInfomsg:]) {
+		switch typ {
+		case unix.IFLA_IFNAME:
+			i.Name = strings.TrimRight(string(value), "\x00")
+		case unix.IFLA_LINK:
+			if len(value) >= 4 {
+				i.Parent = binary.NativeEndian.Uint32(value)
+			}
+		case unix.IFLA_LINKINFO:
+			info := attrs(value)
+			i.Kind = strings.TrimRight(string(info[unix.IFLA_INFO_KIND]), "\x00")
+			// IFLA_VLAN_ID, IFLA_VXLAN_ID and IFLA_GENEVE_ID are alike
+			id := attrs(info[unix.IFLA_INFO_DATA])[unix.IFLA_VXLAN_ID]
+			switch {
+			case i.Kind == KindVLAN && len(id) >= 2:
+				i.ID = uint32(binary.NativeEndian.Uint16(id))
+			case (i.Kind == KindVXLAN || i.Kind == KindGeneve) && len(id) >= 4:
+				i.ID = binary.NativeEndian.Uint32(id)
+			}
+		}
+	}
+	return i
+}
+
+// attrs splits netlink attributes by type, the last of each kept.
+func attrs(b []byte) map[uint16][]byte {
+	m := make(map[uint16][]byte)
+	for len(b) >= unix.SizeofRtAttr {
+		size := int(binary.NativeEndian.Uint16(b[0:]))
+		if size < unix.SizeofRtAttr || size > len(b) {
+			break
+		}
+		// NLA_F_NESTED and NLA_F_NET_BYTEORDER are flags
+		m[binary.NativeEndian.Uint16(b[2:])&0x3fff] = b[unix.SizeofRtAttr:size]
+		b = b[min(nlmAlign(size), len(b)):]
+	}
+	return m
+}
+
+func nlmAlign(n int) int { return (n + unix.NLMSG_ALIGNTO - 1) &^ (unix.NLMSG_ALIGNTO - 1) }
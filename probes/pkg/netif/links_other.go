@@ -0,0 +1,7 @@
+//go:build !linux
+
+package netif
+
+import "errors"
+
+func readLinks() ([]Interface, error) { return nil, errors.New("rtnetlink unsupported") }
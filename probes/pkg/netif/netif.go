@@ -0,0 +1,196 @@
+// Package netif names the network interfaces events carry the index of,
+// and tells the overlays they are part of: VLANs, and VXLAN or Geneve
+// tunnels. Interfaces of the agent's network namespace are read with
+// rtnetlink, with their kind and VLAN ID or network identifier; those of
+// other namespaces, e.g. of pods, by name only, from the net/igmp table
+// under /proc/<pid> of a process in them. Interface indexes are only
+// unique within a namespace, so interfaces are keyed by both.
+package netif
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"probepilot/pkg/procfs"
+)
+
+// DefaultRescan is how often at most a namespace is read again for an
+// interface it did not have.
+const DefaultRescan = 5 * time.Second
+
+// Link kinds of the overlays.
+const (
+	KindVLAN   = "vlan"
+	KindVXLAN  = "vxlan"
+	KindGeneve = "geneve"
+)
+
+// Key identifies an interface: its network namespace, by inode, and its
+// index there.
+type Key struct {
+	NetNS uint32
+	Index uint32
+}
+
+// Interface is a network interface.
+type Interface struct {
+	Index uint32
+	Name  string
+	// Kind is the link kind, e.g. "vlan", "vxlan", "veth" or "bridge";
+	// "" for physical devices and the interfaces of other namespaces
+	Kind string
+	// ID is the VLAN ID of a VLAN, the network identifier (VNI) of a
+	// VXLAN or Geneve tunnel
+	ID uint32
+	// Parent is the index of the device a VLAN or tunnel is on, 0 if none
+	Parent uint32
+}
+
+// Overlay returns the kind and ID of the overlay the interface is part
+// of, or "" if none.
+func (i Interface) Overlay() (string, uint32) {
+	switch i.Kind {
+	case KindVLAN, KindVXLAN, KindGeneve:
+		return i.Kind, i.ID
+	}
+	return "", 0
+}
+
+func (i Interface) String() string {
+	if kind, id := i.Overlay(); kind != "" {
+		return fmt.Sprintf("%s (%s %d)", i.Name, kind, id)
+	}
+	return i.Name
+}
+
+// Table resolves interfaces, caching every namespace it read. It is safe
+// for concurrent use.
+type Table struct {
+	// Rescan is how often at most a namespace is read again
+	Rescan time.Duration
+
+	mu      sync.Mutex
+	own     uint32
+	links   map[Key]Interface
+	scanned map[uint32]time.Time
+}
+
+// New returns a table reading a namespace again at most every rescan.
+func New(rescan time.Duration) *Table {
+	own, _ := netNS("self")
+	return &Table{Rescan: rescan, own: own, links: make(map[Key]Interface), scanned: make(map[uint32]time.Time)}
+}
+
+// Lookup returns the interface of key, reading its namespace, the
+// agent's or pid's, if it is not known yet; a nil table knows none.
+func (t *Table) Lookup(key Key, pid uint32) (Interface, bool) {
+	if t == nil || key.Index == 0 {
+		return Interface{}, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if i, ok := t.links[key]; ok {
+		return i, true
+	}
+	rescan := t.Rescan
+	if rescan == 0 {
+		rescan = DefaultRescan
+	}
+	now := time.Now()
+	if now.Sub(t.scanned[key.NetNS]) < rescan {
+		return Interface{}, false
+	}
+	t.scanned[key.NetNS] = now
+	var links []Interface
+	var err error
+	switch {
+	case key.NetNS == t.own || key.NetNS == 0:
+		links, err = readLinks()
+	case pid != 0:
+		// The process must still be in the namespace
+		if ns, _ := netNS(strconv.FormatUint(uint64(pid), 10)); ns == key.NetNS {
+			links, err = readIGMP(strconv.FormatUint(uint64(pid), 10))
+		}
+	}
+	if err != nil {
+		return Interface{}, false
+	}
+	for _, i := range links {
+		t.links[Key{NetNS: key.NetNS, Index: i.Index}] = i
+	}
+	i, ok := t.links[key]
+	return i, ok
+}
+
+// Own returns the inode of the agent's network namespace, 0 if unknown.
+func (t *Table) Own() uint32 {
+	if t == nil {
+		return 0
+	}
+	return t.own
+}
+
+// netNS returns the inode of the network namespace of the process named
+// dir under the procfs root, e.g. "self".
+func netNS(dir string) (uint32, error) {
+	link, err := os.Readlink(procfs.Path(dir, "ns", "net"))
+	if err != nil {
+		return 0, err
+	}
+	// net:[4026531840]
+	_, inode, ok := strings.Cut(link, "[")
+	if !ok {
+		return 0, fmt.Errorf("unexpected namespace link %q", link)
+	}
+	n, err := strconv.ParseUint(strings.TrimSuffix(inode, "]"), 10, 32)
+	return uint32(n), err
+}
+
+var errNoInterfaces = errors.New("no interfaces listed")
+
+// readIGMP reads the interfaces of the namespace of the process named
+// dir from its net/igmp table, which lists every interface with IPv4 by
+// index and name:
+//
+//	Idx	Device    : Count Querier	Group    Users Timer	Reporter
+//	1	lo        :     1      V3
+//					010000E0     1 0:00000000		0
+func readIGMP(dir string) ([]Interface, error) {
+	f, err := os.Open(procfs.Path(dir, "net", "igmp"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var links []Interface
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Text()
+		if line == "" || line[0] == '\t' || line[0] == ' ' {
+			// Groups of the interface above
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		index, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			continue
+		}
+		// Names of 10 characters or more run into the colon
+		links = append(links, Interface{Index: uint32(index), Name: strings.TrimSuffix(fields[1], ":")})
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(links) == 0 {
+		return nil, errNoInterfaces
+	}
+	return links, nil
+}
@@ -0,0 +1,81 @@
+package otlp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"probepilot/pkg/export"
+	"probepilot/pkg/query"
+)
+
+// Severity numbers of the OTLP log data model.
+const (
+	SeverityInfo  = 9
+	SeverityWarn  = 13
+	SeverityError = 17
+)
+
+// Event is an event to export as a log record.
+type Event struct {
+	Time time.Time
+	// Severity is the probe's name for the severity, e.g. critical, and
+	// SeverityNumber its OTLP number.
+	Severity       string
+	SeverityNumber int
+	Labels         query.Labels
+	Text           string
+}
+
+type logRecord struct {
+	TimeUnixNano         string     `json:"timeUnixNano"`
+	ObservedTimeUnixNano string     `json:"observedTimeUnixNano"`
+	SeverityNumber       int        `json:"severityNumber"`
+	SeverityText         string     `json:"severityText"`
+	Body                 anyValue   `json:"body"`
+	Attributes           []keyValue `json:"attributes,omitempty"`
+	TraceID              string     `json:"traceId,omitempty"`
+	SpanID               string     `json:"spanId,omitempty"`
+}
+
+// LogRecord encodes e as an OTLP log record. Its trace_id and span_id
+// labels, set on the events of flows that carried a traceparent, become
+// the record's trace context, so collectors correlate it with the spans
+// of the request.
+func LogRecord(e Event) ([]byte, error) {
+	r := logRecord{
+		TimeUnixNano:         nanos(e.Time),
+		ObservedTimeUnixNano: nanos(time.Now()),
+		SeverityNumber:       e.SeverityNumber,
+		SeverityText:         e.Severity,
+		Body:                 anyValue{StringValue: e.Text},
+		TraceID:              e.Labels["trace_id"],
+		SpanID:               e.Labels["span_id"],
+	}
+	r.Attributes = attributes(e.Labels, "trace_id", "span_id")
+	return json.Marshal(r)
+}
+
+// NewLogExporter returns an exporter named name delivering the log
+// records of probe, as encoded by LogRecord, to the collector at
+// endpoint.
+func NewLogExporter(name, endpoint string, headers map[string]string, probe string, opts export.Options) (*export.Exporter, error) {
+	url, err := SignalURL(endpoint, LogsPath)
+	if err != nil {
+		return nil, err
+	}
+	return export.New(name, opts, logBatch(newResource(probe)), sender(url, headers))
+}
+
+// logBatch wraps a batch of log records into one export request.
+func logBatch(res resource) export.Encoder {
+	head, _ := json.Marshal(res)
+	return func(records [][]byte) ([]byte, error) {
+		var b bytes.Buffer
+		fmt.Fprintf(&b, `{"resourceLogs":[{"resource":%s,"scopeLogs":[{"scope":{"name":%q},"logRecords":[`, head, ScopeName)
+		b.Write(bytes.Join(records, []byte{','}))
+		b.WriteString(`]}]}]}`)
+		return b.Bytes(), nil
+	}
+}
@@ -0,0 +1,252 @@
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"probepilot/pkg/export"
+	"probepilot/pkg/query"
+	"probepilot/pkg/units"
+)
+
+// aggregationCumulative is AGGREGATION_TEMPORALITY_CUMULATIVE.
+const aggregationCumulative = 2
+
+type resourceMetrics struct {
+	Resource     resource       `json:"resource"`
+	ScopeMetrics []scopeMetrics `json:"scopeMetrics"`
+}
+
+type scopeMetrics struct {
+	Scope   scope    `json:"scope"`
+	Metrics []metric `json:"metrics"`
+}
+
+type metric struct {
+	Name string `json:"name"`
+	// Unit is the UCUM code of the unit the name ends in
+	Unit      string     `json:"unit,omitempty"`
+	Gauge     *gauge     `json:"gauge,omitempty"`
+	Sum       *sum       `json:"sum,omitempty"`
+	Histogram *histogram `json:"histogram,omitempty"`
+}
+
+type gauge struct {
+	DataPoints []numberPoint `json:"dataPoints"`
+}
+
+type sum struct {
+	AggregationTemporality int           `json:"aggregationTemporality"`
+	IsMonotonic            bool          `json:"isMonotonic"`
+	DataPoints             []numberPoint `json:"dataPoints"`
+}
+
+type numberPoint struct {
+	Attributes        []keyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string     `json:"timeUnixNano"`
+	AsDouble          float64    `json:"asDouble"`
+}
+
+type histogram struct {
+	AggregationTemporality int              `json:"aggregationTemporality"`
+	DataPoints             []histogramPoint `json:"dataPoints"`
+}
+
+type histogramPoint struct {
+	Attributes        []keyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	TimeUnixNano      string     `json:"timeUnixNano"`
+	Count             string     `json:"count"`
+	Sum               float64    `json:"sum"`
+	BucketCounts      []string   `json:"bucketCounts"`
+	ExplicitBounds    []float64  `json:"explicitBounds"`
+}
+
+// MetricPusher pushes snapshots of an agent's samples to a collector as
+// OTLP metrics. Samples named *_total, counters by Prometheus convention,
+// become cumulative monotonic sums starting when the pusher was created;
+// the histograms of a query.HistogramSource become explicit bucket
+// histograms; all other samples are gauges. A nil MetricPusher pushes
+// nothing.
+type MetricPusher struct {
+	exp   *export.Exporter
+	res   resource
+	url   string
+	start time.Time
+}
+
+// NewMetricPusher returns a pusher of probe's metrics to the collector at
+// endpoint, or a nil MetricPusher if endpoint is empty.
+func NewMetricPusher(endpoint string, headers map[string]string, probe string, opts export.Options) (*MetricPusher, error) {
+	if endpoint == "" {
+		return nil, nil
+	}
+	url, err := SignalURL(endpoint, MetricsPath)
+	if err != nil {
+		return nil, err
+	}
+	exp, err := export.New(probe+"-otlp-metrics", opts, metricBatch, sender(url, headers))
+	if err != nil {
+		return nil, err
+	}
+	return &MetricPusher{exp: exp, res: newResource(probe), url: url, start: time.Now()}, nil
+}
+
+// metricBatch sends the snapshots of a batch, each its own resourceMetrics
+// entry, in one request.
+func metricBatch(records [][]byte) ([]byte, error) {
+	body := []byte(`{"resourceMetrics":[`)
+	body = append(body, bytes.Join(records, []byte{','})...)
+	return append(body, "]}"...), nil
+}
+
+// URL is where the pusher delivers.
+func (p *MetricPusher) URL() string {
+	return p.url
+}
+
+// Push queues a snapshot of src.
+func (p *MetricPusher) Push(src query.Source) {
+	if p == nil {
+		return
+	}
+	data, err := json.Marshal(p.snapshot(src, time.Now()))
+	if err != nil {
+		return
+	}
+	p.exp.Add(data)
+}
+
+// Run pushes a snapshot every interval until ctx is done, logging when
+// snapshots are lost.
+func (p *MetricPusher) Run(ctx context.Context, src query.Source, interval time.Duration) {
+	if p == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var dropped uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.Push(src)
+		}
+		if d := p.exp.Stats().Dropped; d > dropped {
+			log.Printf("Warning: %d OTLP metric snapshots for %s lost so far", d, p.url)
+			dropped = d
+		}
+	}
+}
+
+// Stats returns the counters of the pusher's exporter.
+func (p *MetricPusher) Stats() export.Stats {
+	if p == nil {
+		return export.Stats{}
+	}
+	return p.exp.Stats()
+}
+
+// Close delivers the queued snapshots; push a last one first to send the
+// final counts.
+func (p *MetricPusher) Close() {
+	if p == nil {
+		return
+	}
+	p.exp.Close()
+}
+
+func (p *MetricPusher) snapshot(src query.Source, now time.Time) resourceMetrics {
+	samples, hists := query.Snapshot(src)
+	// Histograms are also flattened into samples; send them once
+	skip := make(map[string]bool, 3*len(hists))
+	for _, h := range hists {
+		skip[h.Name+"_bucket"], skip[h.Name+"_sum"], skip[h.Name+"_count"] = true, true, true
+	}
+
+	metrics := make(map[string]*metric)
+	for _, s := range samples {
+		// JSON has no NaN or infinity
+		if skip[s.Name] || math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+			continue
+		}
+		m := metrics[s.Name]
+		if m == nil {
+			m = &metric{Name: s.Name, Unit: units.UCUM(units.OfMetric(s.Name))}
+			if strings.HasSuffix(s.Name, "_total") {
+				m.Sum = &sum{AggregationTemporality: aggregationCumulative, IsMonotonic: true}
+			} else {
+				m.Gauge = &gauge{}
+			}
+			metrics[s.Name] = m
+		}
+		pt := numberPoint{Attributes: attributes(s.Labels), TimeUnixNano: nanos(now), AsDouble: s.Value}
+		if m.Sum != nil {
+			pt.StartTimeUnixNano = nanos(p.start)
+			m.Sum.DataPoints = append(m.Sum.DataPoints, pt)
+		} else {
+			m.Gauge.DataPoints = append(m.Gauge.DataPoints, pt)
+		}
+	}
+	for _, h := range hists {
+		m := metrics[h.Name]
+		if m == nil {
+			m = &metric{Name: h.Name, Unit: units.UCUM(units.OfMetric(h.Name)),
+				Histogram: &histogram{AggregationTemporality: aggregationCumulative}}
+			metrics[h.Name] = m
+		}
+		if m.Histogram == nil {
+			continue
+		}
+		m.Histogram.DataPoints = append(m.Histogram.DataPoints, histogramPointOf(h, p.start, now))
+	}
+
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	sm := scopeMetrics{Scope: scope{Name: ScopeName}, Metrics: make([]metric, len(names))}
+	for i, name := range names {
+		sm.Metrics[i] = *metrics[name]
+	}
+	return resourceMetrics{Resource: p.res, ScopeMetrics: []scopeMetrics{sm}}
+}
+
+// histogramPointOf converts the classic buckets of h, cumulative, into
+// OTLP's per-bucket counts, the last one above every bound.
+func histogramPointOf(h query.HistogramSample, start, now time.Time) histogramPoint {
+	bounds, cumulative := h.ClassicBuckets()
+	if bounds == nil {
+		bounds = []float64{}
+	}
+	counts := make([]string, len(bounds)+1)
+	var below uint64
+	for i, c := range cumulative {
+		counts[i] = strconv.FormatUint(c-below, 10)
+		below = c
+	}
+	counts[len(bounds)] = strconv.FormatUint(h.Count-below, 10)
+	total := h.Sum
+	if math.IsNaN(total) || math.IsInf(total, 0) {
+		total = 0
+	}
+	return histogramPoint{
+		Attributes:        attributes(h.Labels),
+		StartTimeUnixNano: nanos(start),
+		TimeUnixNano:      nanos(now),
+		Count:             strconv.FormatUint(h.Count, 10),
+		Sum:               total,
+		BucketCounts:      counts,
+		ExplicitBounds:    bounds,
+	}
+}
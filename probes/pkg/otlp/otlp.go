@@ -0,0 +1,142 @@
+// Package otlp exports to OpenTelemetry collectors over OTLP/HTTP with
+// the JSON encoding, which every collector's otlp receiver accepts
+// without a protobuf dependency in the agents. Routed events become log
+// records, carrying the trace and span IDs of the flows they belong to,
+// and an agent's samples become metrics pushed every report interval.
+// Delivery goes through package export, so both are batched, retried and
+// optionally spooled like any other exporter.
+//
+// Endpoints are the collector's base URL, e.g. http://otel-collector:4318;
+// the signal path, /v1/logs or /v1/metrics, is appended unless the URL
+// already ends with it.
+package otlp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"probepilot/pkg/export"
+	"probepilot/pkg/query"
+)
+
+// Signal paths of OTLP/HTTP.
+const (
+	LogsPath    = "/v1/logs"
+	MetricsPath = "/v1/metrics"
+)
+
+// ScopeName is the instrumentation scope of everything probepilot exports.
+const ScopeName = "probepilot"
+
+// sendTimeout bounds each request so a hung collector only delays its
+// own exporter.
+const sendTimeout = 5 * time.Second
+
+// SignalURL returns the URL of signal path under endpoint.
+func SignalURL(endpoint, path string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid OTLP endpoint %q (want e.g. http://otel-collector:4318)", endpoint)
+	}
+	if !strings.HasSuffix(u.Path, path) {
+		u.Path = strings.TrimSuffix(u.Path, "/") + path
+	}
+	return u.String(), nil
+}
+
+// sender posts OTLP/JSON bodies to url. As the OTLP specification asks,
+// 429, 502, 503 and 504 are retried and other client and server errors
+// are permanent.
+func sender(url string, headers map[string]string) export.Sender {
+	client := &http.Client{Timeout: sendTimeout}
+	return func(body []byte, encoding string) error {
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return export.Permanent(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if encoding != "" {
+			req.Header.Set("Content-Encoding", encoding)
+		}
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		switch {
+		case resp.StatusCode/100 == 2:
+			return nil
+		case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode == http.StatusBadGateway,
+			resp.StatusCode == http.StatusServiceUnavailable, resp.StatusCode == http.StatusGatewayTimeout:
+			return fmt.Errorf("POST %s: %s", url, resp.Status)
+		}
+		return export.Permanent(fmt.Errorf("POST %s: %s", url, resp.Status))
+	}
+}
+
+// resource describes the agent: service.name is probepilot-<probe>.
+type resource struct {
+	Attributes []keyValue `json:"attributes"`
+}
+
+func newResource(probe string) resource {
+	attrs := []keyValue{stringAttr("service.name", "probepilot-"+probe)}
+	if host, err := os.Hostname(); err == nil {
+		attrs = append(attrs, stringAttr("host.name", host))
+	}
+	return resource{Attributes: attrs}
+}
+
+type scope struct {
+	Name string `json:"name"`
+}
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+func stringAttr(key, value string) keyValue {
+	return keyValue{Key: key, Value: anyValue{StringValue: value}}
+}
+
+// attributes converts labels, sorted by name so equal series encode alike.
+func attributes(labels query.Labels, skip ...string) []keyValue {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	attrs := make([]keyValue, 0, len(keys))
+next:
+	for _, k := range keys {
+		for _, s := range skip {
+			if k == s {
+				continue next
+			}
+		}
+		attrs = append(attrs, stringAttr(k, labels[k]))
+	}
+	return attrs
+}
+
+// nanos encodes a time as OTLP/JSON does 64-bit integers: a decimal string.
+func nanos(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
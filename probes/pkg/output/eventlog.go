@@ -0,0 +1,604 @@
+package output
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	"probepilot/pkg/query"
+	"probepilot/pkg/schema"
+)
+
+// Binary event logs: -output binary appends records to -output-file in a
+// compact, length-prefixed format instead of JSON lines, with an index
+// after every chunk of records so that readers seek to a time rather than
+// scan the file:
+//
+//	log    = header chunk*
+//	header = "PPEVLOG\n" string(schema tag) string(probe)
+//	chunk  = record* index
+//	record = 'R' uvarint(len) payload crc32c(payload)
+//	index  = 'X' uvarint(len) payload crc32c(payload) offset(index) "PPIX"
+//
+// Integers are little-endian, offsets 8 bytes. A record's strings are
+// numbered as they first appear in its chunk and referred to by number
+// after, so every chunk decodes on its own. An index gives the offset and
+// time range of its chunk, the latest time up to it and skip pointers to
+// earlier indexes, so finding the first chunk reaching a time reads a few
+// indexes. The trailer of an index, its offset and "PPIX", lets readers
+// find the last index from the end of the file.
+const (
+	logMagic    = "PPEVLOG\n"
+	indexMagic  = "PPIX"
+	frameRecord = 'R'
+	frameIndex  = 'X'
+	trailerSize = 8 + len(indexMagic)
+	// A chunk ends with an index after chunkRecords records or
+	// chunkBytes bytes
+	chunkRecords = 4096
+	chunkBytes   = 1 << 20
+	// maxFrame bounds a frame's payload, so that a corrupt length is
+	// not allocated
+	maxFrame = 64 << 20
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errCorrupt reports a frame that cannot be read back.
+var errCorrupt = errors.New("corrupt event log")
+
+// skip points to an earlier index.
+type skip struct {
+	offset int64
+	// maxTime is the latest record time up to that index
+	maxTime int64
+}
+
+// index is the payload of an index frame. Indexes are numbered from 1;
+// skips[k] points to the latest earlier index whose number is a multiple
+// of 2^k, so skips[0] is the previous index.
+type index struct {
+	number           uint64
+	chunk            int64 // offset of the chunk's first frame
+	records          uint64
+	minTime, maxTime int64 // of the chunk's records, in Unix ns
+	cumMax           int64 // latest record time up to the chunk's end
+	skips            []skip
+}
+
+func (x *index) append(b []byte) []byte {
+	b = binary.AppendUvarint(b, x.number)
+	b = binary.AppendUvarint(b, uint64(x.chunk))
+	b = binary.AppendUvarint(b, x.records)
+	b = binary.AppendVarint(b, x.minTime)
+	b = binary.AppendVarint(b, x.maxTime)
+	b = binary.AppendVarint(b, x.cumMax)
+	b = binary.AppendUvarint(b, uint64(len(x.skips)))
+	for _, s := range x.skips {
+		b = binary.AppendUvarint(b, uint64(s.offset))
+		b = binary.AppendVarint(b, s.maxTime)
+	}
+	return b
+}
+
+func decodeIndex(b []byte) (*index, error) {
+	d := decoder{b: b}
+	x := &index{
+		number:  d.uvarint(),
+		chunk:   int64(d.uvarint()),
+		records: d.uvarint(),
+		minTime: d.varint(),
+		maxTime: d.varint(),
+		cumMax:  d.varint(),
+	}
+	n := d.uvarint()
+	if n > 64 {
+		return nil, errCorrupt
+	}
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		x.skips = append(x.skips, skip{offset: int64(d.uvarint()), maxTime: d.varint()})
+	}
+	return x, d.done()
+}
+
+// decoder reads the varints and strings of a payload, remembering the
+// first error.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) bytes(n uint64) []byte {
+	if n > uint64(len(d.b)) {
+		d.fail()
+		return nil
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes(d.uvarint()))
+}
+
+func (d *decoder) fail() {
+	if d.err == nil {
+		d.err = errCorrupt
+	}
+	d.b = nil
+}
+
+// done reports the first error, or trailing bytes.
+func (d *decoder) done() error {
+	if d.err == nil && len(d.b) > 0 {
+		d.err = errCorrupt
+	}
+	return d.err
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// dictionary numbers the strings of a chunk as the writer appends them:
+// 0 and the string for one not seen yet, its number plus 1 after.
+type dictionary map[string]uint64
+
+func (d dictionary) append(b []byte, s string) []byte {
+	if id, ok := d[s]; ok {
+		return binary.AppendUvarint(b, id+1)
+	}
+	d[s] = uint64(len(d))
+	b = binary.AppendUvarint(b, 0)
+	return appendString(b, s)
+}
+
+func (d dictionary) appendLabels(b []byte, labels query.Labels) []byte {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	b = binary.AppendUvarint(b, uint64(len(keys)))
+	for _, k := range keys {
+		b = d.append(b, k)
+		b = d.append(b, labels[k])
+	}
+	return b
+}
+
+// appendRecord encodes the payload of a record: kind, time, monotonic
+// time, labels, text and samples.
+func (d dictionary) appendRecord(b []byte, r *Record) []byte {
+	b = d.append(b, r.Kind)
+	b = binary.AppendVarint(b, r.Time.UnixNano())
+	b = binary.AppendUvarint(b, r.Monotonic)
+	b = d.appendLabels(b, r.Labels)
+	b = appendString(b, r.Text)
+	b = binary.AppendUvarint(b, uint64(len(r.Samples)))
+	for _, s := range r.Samples {
+		b = d.append(b, s.Name)
+		b = d.appendLabels(b, s.Labels)
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(s.Value))
+	}
+	return b
+}
+
+// stringTable is a chunk's strings as the reader meets them.
+type stringTable []string
+
+func (s *stringTable) read(d *decoder) string {
+	id := d.uvarint()
+	if id == 0 {
+		str := d.string()
+		*s = append(*s, str)
+		return str
+	}
+	if id > uint64(len(*s)) {
+		d.fail()
+		return ""
+	}
+	return (*s)[id-1]
+}
+
+func (s *stringTable) readLabels(d *decoder) query.Labels {
+	n := d.uvarint()
+	if n == 0 || n > uint64(len(d.b)) {
+		if n != 0 {
+			d.fail()
+		}
+		return nil
+	}
+	labels := make(query.Labels, n)
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		k := s.read(d)
+		labels[k] = s.read(d)
+	}
+	return labels
+}
+
+func (s *stringTable) readRecord(b []byte, probe string) (*Record, error) {
+	d := decoder{b: b}
+	r := &Record{Schema: schema.Tag(schema.Output), Probe: probe}
+	r.Kind = s.read(&d)
+	r.Time = time.Unix(0, d.varint()).UTC()
+	r.Monotonic = d.uvarint()
+	r.Labels = s.readLabels(&d)
+	r.Text = d.string()
+	n := d.uvarint()
+	if n > uint64(len(d.b)) {
+		d.fail()
+	}
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		sample := Sample{Name: s.read(&d), Labels: s.readLabels(&d)}
+		if bits := d.bytes(8); bits != nil {
+			sample.Value = math.Float64frombits(binary.LittleEndian.Uint64(bits))
+		}
+		r.Samples = append(r.Samples, sample)
+	}
+	if err := d.done(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func appendHeader(b []byte, probe string) []byte {
+	b = append(b, logMagic...)
+	b = appendString(b, schema.Tag(schema.EventLog))
+	return appendString(b, probe)
+}
+
+// readHeader reads the header of an event log, returning its probe and
+// the offset of its first frame.
+func readHeader(r io.ReaderAt) (probe string, start int64, err error) {
+	br := bufio.NewReader(io.NewSectionReader(r, 0, math.MaxInt64))
+	magic := make([]byte, len(logMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != logMagic {
+		return "", 0, errors.New("not a probepilot event log")
+	}
+	start = int64(len(logMagic))
+	var fields [2]string
+	for i := range fields {
+		n, err := binary.ReadUvarint(br)
+		if err != nil || n > 1024 {
+			return "", 0, errCorrupt
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return "", 0, errCorrupt
+		}
+		fields[i] = string(b)
+		start += int64(uvarintLen(n)) + int64(n)
+	}
+	if err := schema.Check(schema.EventLog, fields[0]); err != nil {
+		return "", 0, err
+	}
+	return fields[1], start, nil
+}
+
+func uvarintLen(n uint64) int {
+	var b [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(b[:], n)
+}
+
+// appendFrame frames payload; index frames get their trailer, naming off,
+// where the frame starts.
+func appendFrame(b []byte, typ byte, payload []byte, off int64) []byte {
+	b = append(b, typ)
+	b = binary.AppendUvarint(b, uint64(len(payload)))
+	b = append(b, payload...)
+	b = binary.LittleEndian.AppendUint32(b, crc32.Checksum(payload, crcTable))
+	if typ == frameIndex {
+		b = binary.LittleEndian.AppendUint64(b, uint64(off))
+		b = append(b, indexMagic...)
+	}
+	return b
+}
+
+// readFrame reads the next frame, returning its type, payload and size.
+// A frame cut short, as by a crash or a write under way, is
+// io.ErrUnexpectedEOF.
+func readFrame(br *bufio.Reader) (typ byte, payload []byte, size int64, err error) {
+	if typ, err = br.ReadByte(); err != nil {
+		return 0, nil, 0, err
+	}
+	if typ != frameRecord && typ != frameIndex {
+		return 0, nil, 0, fmt.Errorf("%w: unknown frame %q", errCorrupt, typ)
+	}
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return 0, nil, 0, io.ErrUnexpectedEOF
+	}
+	if n > maxFrame {
+		return 0, nil, 0, fmt.Errorf("%w: frame of %d bytes", errCorrupt, n)
+	}
+	rest := int(n) + 4
+	if typ == frameIndex {
+		rest += trailerSize
+	}
+	b := make([]byte, rest)
+	if _, err := io.ReadFull(br, b); err != nil {
+		return 0, nil, 0, io.ErrUnexpectedEOF
+	}
+	payload = b[:n]
+	if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(b[n:]) {
+		return 0, nil, 0, fmt.Errorf("%w: checksum mismatch", errCorrupt)
+	}
+	if typ == frameIndex && string(b[len(b)-len(indexMagic):]) != indexMagic {
+		return 0, nil, 0, fmt.Errorf("%w: index without trailer", errCorrupt)
+	}
+	return typ, payload, 1 + int64(uvarintLen(n)) + int64(rest), nil
+}
+
+func readFrameAt(r io.ReaderAt, off int64) (typ byte, payload []byte, size int64, err error) {
+	return readFrame(bufio.NewReaderSize(io.NewSectionReader(r, off, math.MaxInt64-off), 512))
+}
+
+// findLastIndex finds the last index of the log from its end, searching
+// back for a trailer that names a valid index frame ending right before
+// it. It returns the index, where its frame starts and the offset past
+// its trailer.
+func findLastIndex(r io.ReaderAt, start, size int64) (x *index, at, end int64, ok bool) {
+	const window = 1 << 20
+	buf := make([]byte, window)
+	for end := size; end-start >= int64(trailerSize); {
+		from := end - window
+		if from < start {
+			from = start
+		}
+		b := buf[:end-from]
+		if _, err := r.ReadAt(b, from); err != nil && err != io.EOF {
+			return nil, 0, 0, false
+		}
+		for i := bytes.LastIndex(b, []byte(indexMagic)); i >= 0; i = bytes.LastIndex(b[:i], []byte(indexMagic)) {
+			magic := from + int64(i)
+			if magic-8 < start {
+				continue
+			}
+			var off [8]byte
+			if _, err := r.ReadAt(off[:], magic-8); err != nil {
+				continue
+			}
+			at := int64(binary.LittleEndian.Uint64(off[:]))
+			if at < start || at >= magic {
+				continue
+			}
+			typ, payload, n, err := readFrameAt(r, at)
+			if err != nil || typ != frameIndex || at+n != magic+int64(len(indexMagic)) {
+				continue
+			}
+			if x, err := decodeIndex(payload); err == nil {
+				return x, at, at + n, true
+			}
+		}
+		if from == start {
+			break
+		}
+		// Overlap the windows by a magic but a byte, so that one across
+		// them is found
+		end = from + int64(len(indexMagic)) - 1
+	}
+	return nil, 0, 0, false
+}
+
+// logWriter appends records to a binary event log.
+type logWriter struct {
+	f     *os.File
+	w     *bufio.Writer
+	probe string
+	// off is where the next frame goes
+	off   int64
+	dict  dictionary
+	chunk index
+	// last[k] is the latest index whose number is a multiple of 2^k
+	last   []skip
+	cumMax int64
+	next   uint64
+	// payload and frame are reused for every record
+	payload, frame []byte
+}
+
+// openLogWriter opens the event log of probe at path, creating it or
+// appending to it. A record torn by a crash is cut off, and the records
+// written since the last index are indexed first.
+func openLogWriter(path, probe string) (*logWriter, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	w := &logWriter{f: f, probe: probe, cumMax: math.MinInt64, next: 1}
+	if err := w.open(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return w, nil
+}
+
+func (w *logWriter) open() error {
+	info, err := w.f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		header := appendHeader(nil, w.probe)
+		if _, err := w.f.Write(header); err != nil {
+			return err
+		}
+		w.off = int64(len(header))
+		w.w = bufio.NewWriter(w.f)
+		w.startChunk()
+		return nil
+	}
+	probe, start, err := readHeader(w.f)
+	if err != nil {
+		return err
+	}
+	if probe != w.probe {
+		return fmt.Errorf("the event log of %s, not %s", probe, w.probe)
+	}
+	w.off = start
+	if last, at, end, ok := findLastIndex(w.f, start, info.Size()); ok {
+		w.resume(last, at, end)
+	}
+	if _, err := w.f.Seek(w.off, io.SeekStart); err != nil {
+		return err
+	}
+	w.w = bufio.NewWriter(w.f)
+	w.startChunk()
+	return w.recoverTail()
+}
+
+// resume continues the numbering and skip pointers after index last,
+// whose frame is at at and ends at end.
+func (w *logWriter) resume(last *index, at, end int64) {
+	w.last = append([]skip(nil), last.skips...)
+	w.cumMax = last.cumMax
+	w.next = last.number
+	w.advance(skip{offset: at, maxTime: last.cumMax})
+	w.off = end
+}
+
+// advance records index w.next, at s, in the skip pointers.
+func (w *logWriter) advance(s skip) {
+	for k := 0; k < 64 && w.next%(1<<k) == 0; k++ {
+		if k == len(w.last) {
+			w.last = append(w.last, s)
+		} else {
+			w.last[k] = s
+		}
+	}
+	w.next++
+}
+
+// recoverTail reads the records after the last index, cuts the log
+// before the first one that cannot be read, and indexes them.
+func (w *logWriter) recoverTail() error {
+	br := bufio.NewReader(io.NewSectionReader(w.f, w.off, math.MaxInt64-w.off))
+	var strs stringTable
+	for {
+		typ, payload, n, err := readFrame(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil || typ != frameRecord {
+			// An index here is one whose trailer was torn
+			break
+		}
+		r, err := strs.readRecord(payload, w.probe)
+		if err != nil {
+			break
+		}
+		w.off += n
+		w.add(r.Time.UnixNano())
+	}
+	if err := w.f.Truncate(w.off); err != nil {
+		return err
+	}
+	if _, err := w.f.Seek(w.off, io.SeekStart); err != nil {
+		return err
+	}
+	if w.chunk.records > 0 {
+		return w.writeIndex()
+	}
+	return nil
+}
+
+func (w *logWriter) startChunk() {
+	w.chunk = index{chunk: w.off, minTime: math.MaxInt64, maxTime: math.MinInt64}
+	w.dict = make(dictionary)
+}
+
+// add accounts a record at t, in Unix ns, to the chunk.
+func (w *logWriter) add(t int64) {
+	w.chunk.records++
+	if t < w.chunk.minTime {
+		w.chunk.minTime = t
+	}
+	if t > w.chunk.maxTime {
+		w.chunk.maxTime = t
+	}
+	if t > w.cumMax {
+		w.cumMax = t
+	}
+}
+
+func (w *logWriter) write(r *Record) error {
+	w.payload = w.dict.appendRecord(w.payload[:0], r)
+	w.frame = appendFrame(w.frame[:0], frameRecord, w.payload, w.off)
+	if _, err := w.w.Write(w.frame); err != nil {
+		return err
+	}
+	w.off += int64(len(w.frame))
+	w.add(r.Time.UnixNano())
+	if w.chunk.records >= chunkRecords || w.off-w.chunk.chunk >= chunkBytes {
+		return w.writeIndex()
+	}
+	return nil
+}
+
+// writeIndex ends the chunk with its index and flushes it.
+func (w *logWriter) writeIndex() error {
+	x := w.chunk
+	x.number = w.next
+	x.cumMax = w.cumMax
+	x.skips = append([]skip(nil), w.last...)
+	at := w.off
+	frame := appendFrame(nil, frameIndex, x.append(nil), at)
+	if _, err := w.w.Write(frame); err != nil {
+		return err
+	}
+	w.off += int64(len(frame))
+	w.advance(skip{offset: at, maxTime: x.cumMax})
+	w.startChunk()
+	return w.w.Flush()
+}
+
+// flush hands the records written so far to the file.
+func (w *logWriter) flush() error {
+	return w.w.Flush()
+}
+
+// Close indexes the last chunk, so that the log ends with an index.
+func (w *logWriter) Close() error {
+	var err error
+	if w.chunk.records > 0 {
+		err = w.writeIndex()
+	}
+	if ferr := w.w.Flush(); err == nil {
+		err = ferr
+	}
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
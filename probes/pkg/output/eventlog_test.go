@@ -0,0 +1,212 @@
+package output
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"probepilot/pkg/query"
+	"probepilot/pkg/schema"
+)
+
+var logStart = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// testRecord is the i-th record of a test log, one a second
+func testRecord(i int) *Record {
+	r := &Record{
+		Schema:    schema.Tag(schema.Output),
+		Kind:      "event",
+		Probe:     "memory-tracker",
+		Time:      logStart.Add(time.Duration(i) * time.Second),
+		Monotonic: uint64(i) * 1e9,
+		Labels:    query.Labels{"pid": strconv.Itoa(i % 7), "comm": "java"},
+		Text:      "allocation " + strconv.Itoa(i),
+	}
+	if i%3 == 0 {
+		r.Kind = "stats"
+		r.Labels = nil
+		r.Samples = []Sample{
+			{Name: "memory_events_total", Value: float64(i)},
+			{Name: "process_memory_current", Labels: query.Labels{"pid": "1"}, Value: 1.5},
+		}
+	}
+	return r
+}
+
+func writeTestLog(t *testing.T, path string, from, to int) {
+	t.Helper()
+	w, err := openLogWriter(path, "memory-tracker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := from; i < to; i++ {
+		if err := w.write(testRecord(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readTestLog reads the records of the log from t on, or from the start
+// if t is zero
+func readTestLog(t *testing.T, path string, since time.Time) []*Record {
+	t.Helper()
+	r, err := OpenLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if !since.IsZero() {
+		if err := r.Seek(since); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var records []*Record
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return records
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+}
+
+func TestEventLogRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.log")
+	n := 2*chunkRecords + 100
+	writeTestLog(t, path, 0, n)
+
+	records := readTestLog(t, path, time.Time{})
+	if len(records) != n {
+		t.Fatalf("read %d records, want %d", len(records), n)
+	}
+	for i, r := range records {
+		if want := testRecord(i); !reflect.DeepEqual(r, want) {
+			t.Fatalf("record %d = %+v, want %+v", i, r, want)
+		}
+	}
+	if ok, err := IsLog(path); !ok || err != nil {
+		t.Errorf("IsLog = %v, %v", ok, err)
+	}
+}
+
+func TestEventLogSeek(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.log")
+	n := 5*chunkRecords + 10
+	writeTestLog(t, path, 0, n)
+
+	for _, i := range []int{0, 1, chunkRecords - 1, chunkRecords, 3*chunkRecords + 17, n - 1} {
+		since := testRecord(i).Time
+		records := readTestLog(t, path, since)
+		// Seek lands on the chunk holding since; earlier records of that
+		// chunk come first, no more
+		skipped := n - len(records)
+		if skipped > i || i-skipped >= chunkRecords {
+			t.Errorf("Seek(record %d) read from record %d", i, skipped)
+		}
+	}
+	if records := readTestLog(t, path, logStart.Add(time.Duration(n)*time.Second)); len(records) != 0 {
+		t.Errorf("Seek past the end read %d records", len(records))
+	}
+}
+
+func TestEventLogRecoversTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.log")
+	writeTestLog(t, path, 0, 10)
+
+	// A crash leaves records after the last index, the last one torn
+	w, err := openLogWriter(path, "memory-tracker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 10; i < 15; i++ {
+		if err := w.write(testRecord(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.flush(); err != nil {
+		t.Fatal(err)
+	}
+	w.f.Close()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	// Readers stop at the torn record, and the next writer cuts it off
+	// and appends after the records before it
+	if records := readTestLog(t, path, time.Time{}); len(records) != 14 {
+		t.Errorf("read %d records of a torn log, want 14", len(records))
+	}
+	writeTestLog(t, path, 15, 20)
+	records := readTestLog(t, path, time.Time{})
+	var texts []string
+	for _, r := range records {
+		texts = append(texts, r.Text)
+	}
+	var want []string
+	for i := 0; i < 20; i++ {
+		if i != 14 {
+			want = append(want, testRecord(i).Text)
+		}
+	}
+	if !reflect.DeepEqual(texts, want) {
+		t.Errorf("recovered log holds %v, want %v", texts, want)
+	}
+}
+
+func TestEventLogRejects(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "events.log")
+	writeTestLog(t, path, 0, 1)
+	if _, err := openLogWriter(path, "tcp-flow"); err == nil {
+		t.Error("appended to the log of another probe")
+	}
+
+	other := filepath.Join(dir, "events.json")
+	if err := os.WriteFile(other, []byte(`{"kind":"event"}`+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := IsLog(other); ok {
+		t.Error("IsLog accepted JSON lines")
+	}
+	if _, err := OpenLog(other); err == nil {
+		t.Error("OpenLog accepted JSON lines")
+	}
+
+	// A corrupt record is reported, not decoded
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := OpenLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	data[r.start+3] ^= 0xff
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	r, err = OpenLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := r.Next(); err == nil || errors.Is(err, io.EOF) {
+		t.Errorf("read a corrupt record: %v", err)
+	}
+}
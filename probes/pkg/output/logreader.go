@@ -0,0 +1,137 @@
+package output
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+// IsLog reports whether the file at path is a binary event log.
+func IsLog(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	magic := make([]byte, len(logMagic))
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return false, nil
+	}
+	return string(magic) == logMagic, nil
+}
+
+// LogReader reads the records of a binary event log, oldest first, from
+// its start or from a time Seek finds.
+type LogReader struct {
+	f     *os.File
+	probe string
+	start int64
+
+	br      *bufio.Reader
+	strings stringTable
+}
+
+// OpenLog opens the binary event log at path, -output binary writes.
+func OpenLog(path string) (*LogReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	probe, start, err := readHeader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	r := &LogReader{f: f, probe: probe, start: start}
+	r.seek(start)
+	return r, nil
+}
+
+// Probe is the agent that wrote the log.
+func (r *LogReader) Probe() string {
+	return r.probe
+}
+
+// seek reads on from the chunk starting at off.
+func (r *LogReader) seek(off int64) {
+	r.br = bufio.NewReaderSize(io.NewSectionReader(r.f, off, math.MaxInt64-off), 64<<10)
+	r.strings = r.strings[:0]
+}
+
+// Seek moves to the first chunk holding records at or after t, following
+// the indexes back from the last one. Records before t may still come
+// first, from that chunk or if times went back, so callers filter. A log
+// that has no index, written by an agent that crashed before its first,
+// is read from the start.
+func (r *LogReader) Seek(t time.Time) error {
+	info, err := r.f.Stat()
+	if err != nil {
+		return err
+	}
+	since := t.UnixNano()
+	last, _, end, ok := findLastIndex(r.f, r.start, info.Size())
+	switch {
+	case !ok:
+		r.seek(r.start)
+		return nil
+	case last.cumMax < since:
+		// Only records written after the last index can be as late
+		r.seek(end)
+		return nil
+	}
+	// Times up to each index only grow: walk back to the earliest index
+	// whose time reaches t, taking the longest skip that still does
+	cur := last
+	for {
+		var next *index
+		for k := len(cur.skips) - 1; k >= 0; k-- {
+			if s := cur.skips[k]; s.maxTime >= since {
+				typ, payload, _, err := readFrameAt(r.f, s.offset)
+				if err == nil && typ != frameIndex {
+					err = errCorrupt
+				}
+				if err == nil {
+					next, err = decodeIndex(payload)
+				}
+				if err != nil {
+					return fmt.Errorf("index at %d: %w", s.offset, err)
+				}
+				break
+			}
+		}
+		if next == nil {
+			r.seek(cur.chunk)
+			return nil
+		}
+		cur = next
+	}
+}
+
+// Next returns the next record, or io.EOF after the last. A record cut
+// short at the end, as one the agent is writing, ends the log too.
+func (r *LogReader) Next() (*Record, error) {
+	for {
+		typ, payload, _, err := readFrame(r.br)
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		if typ == frameIndex {
+			// The next chunk numbers its strings afresh
+			r.strings = r.strings[:0]
+			continue
+		}
+		return r.strings.readRecord(payload, r.probe)
+	}
+}
+
+// Close closes the log.
+func (r *LogReader) Close() error {
+	return r.f.Close()
+}
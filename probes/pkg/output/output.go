@@ -0,0 +1,219 @@
+// Package output writes what an agent reports as JSON lines instead of
+// text, for log shippers such as Filebeat or the Splunk forwarder to pick
+// up without parsing free-form prints. Each line is one object tagged with
+// the output schema: an event as it is routed, or a snapshot of the
+// agent's samples taken every report interval.
+//
+//	{"schema":"output/1.0","kind":"event","probe":"memory-tracker","time":"2024-05-01T12:00:00.123456789Z","monotonic_ns":81234567890,"labels":{"comm":"java","pid":"4242","type":"oom"},"text":"oom pid=4242 comm=java addr=0x0 size=0"}
+//	{"schema":"output/1.0","kind":"stats","probe":"memory-tracker","time":"2024-05-01T12:00:10Z","monotonic_ns":91234567890,"samples":[{"name":"memory_events_total","value":1200}]}
+//
+// -output binary appends the same records to a binary event log instead,
+// compact and indexed by time so that LogReader seeks to a time range
+// rather than scanning the file; see eventlog.go for the format.
+//
+// Logs stay on stderr in every format.
+package output
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"probepilot/pkg/clock"
+	"probepilot/pkg/query"
+	"probepilot/pkg/schema"
+)
+
+// Formats of -output.
+const (
+	Text   = "text"
+	JSON   = "json"
+	Binary = "binary"
+)
+
+// Kinds of records.
+const (
+	KindEvent = "event"
+	KindStats = "stats"
+)
+
+// Options selects the format and destination of an agent's output.
+type Options struct {
+	Format string
+	// File receives JSON lines instead of stdout, or the binary event
+	// log; it is appended to.
+	File string
+}
+
+// Destination names where JSON lines go.
+func (o Options) Destination() string {
+	if o.File != "" {
+		return o.File
+	}
+	return "stdout"
+}
+
+// RegisterFlags defines the output flags on fs. The returned function
+// parses their values once fs has been parsed.
+func RegisterFlags(fs *flag.FlagSet) func() (Options, error) {
+	format := fs.String("output", Text, "output format: text, json for one JSON object per event and stats snapshot, or binary for the same records in an event log indexed by time, in -output-file")
+	file := fs.String("output-file", "", "file to append JSON lines or the binary event log to (default: stdout, for JSON lines)")
+
+	return func() (Options, error) {
+		switch *format {
+		case Text:
+			if *file != "" {
+				return Options{}, fmt.Errorf("-output-file needs -output json")
+			}
+		case JSON:
+		case Binary:
+			if *file == "" {
+				return Options{}, fmt.Errorf("-output binary needs -output-file")
+			}
+		default:
+			return Options{}, fmt.Errorf("invalid -output %q (want text, json or binary)", *format)
+		}
+		return Options{Format: *format, File: *file}, nil
+	}
+}
+
+// Record is one line of JSON output.
+type Record struct {
+	Schema    string       `json:"schema"`
+	Kind      string       `json:"kind"`
+	Probe     string       `json:"probe"`
+	Time      time.Time    `json:"time"`
+	Monotonic uint64       `json:"monotonic_ns,omitempty"`
+	Labels    query.Labels `json:"labels,omitempty"`
+	Text      string       `json:"text,omitempty"`
+	Samples   []Sample     `json:"samples,omitempty"`
+}
+
+// Sample is a sample of a stats snapshot.
+type Sample struct {
+	Name   string       `json:"name"`
+	Labels query.Labels `json:"labels,omitempty"`
+	Value  float64      `json:"value"`
+}
+
+// Writer writes the JSON lines, or binary event log, of one probe. It is
+// safe for concurrent use. A nil Writer stands for text output, so agents can tell the
+// formats apart with JSON and call Event unconditionally.
+type Writer struct {
+	probe string
+	clock *clock.Clock
+
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+	enc    *json.Encoder
+	// log, under -output binary, takes the records instead of enc
+	log    *logWriter
+	failed bool
+}
+
+// Open returns the Writer of probe under opts, or nil for text output.
+func Open(opts Options, probe string) (*Writer, error) {
+	if opts.Format != JSON && opts.Format != Binary {
+		return nil, nil
+	}
+	w := &Writer{probe: probe, clock: clock.New(), w: os.Stdout}
+	if opts.Format == Binary {
+		l, err := openLogWriter(opts.File, probe)
+		if err != nil {
+			return nil, err
+		}
+		w.log, w.closer = l, l
+		return w, nil
+	}
+	if opts.File != "" {
+		f, err := os.OpenFile(opts.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		w.w, w.closer = f, f
+	}
+	w.enc = json.NewEncoder(w.w)
+	return w, nil
+}
+
+// JSON reports whether the agent writes records, as JSON lines or a
+// binary event log, rather than text.
+func (w *Writer) JSON() bool {
+	return w != nil
+}
+
+// Event writes an event that happened now.
+func (w *Writer) Event(labels query.Labels, text string) {
+	w.EventAt(clock.Now(), labels, text)
+}
+
+// EventAt writes an event stamped by BPF at mono, monotonic ns.
+func (w *Writer) EventAt(mono uint64, labels query.Labels, text string) {
+	if w == nil {
+		return
+	}
+	w.write(Record{Kind: KindEvent, Time: w.clock.Wall(mono), Monotonic: mono, Labels: labels, Text: text})
+}
+
+// Stats writes a snapshot of samples taken now.
+func (w *Writer) Stats(samples []query.Sample) {
+	if w == nil {
+		return
+	}
+	mono := clock.Now()
+	r := Record{Kind: KindStats, Time: w.clock.Wall(mono), Monotonic: mono, Samples: make([]Sample, 0, len(samples))}
+	for _, s := range samples {
+		// JSON has no NaN or infinity
+		if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+			continue
+		}
+		r.Samples = append(r.Samples, Sample{Name: s.Name, Labels: s.Labels, Value: s.Value})
+	}
+	w.write(r)
+}
+
+// write encodes r as one line, or appends it to the event log, handing
+// the log's records to the file with every stats snapshot. After the
+// first failed write, e.g. to a closed pipe, the Writer logs the error
+// and stops writing.
+func (w *Writer) write(r Record) {
+	r.Schema, r.Probe = schema.Tag(schema.Output), w.probe
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.failed {
+		return
+	}
+	if w.log != nil {
+		err := w.log.write(&r)
+		if err == nil && r.Kind == KindStats {
+			err = w.log.flush()
+		}
+		if err != nil {
+			w.failed = true
+			log.Printf("Warning: binary output stopped: %v", err)
+		}
+		return
+	}
+	if err := w.enc.Encode(r); err != nil {
+		w.failed = true
+		log.Printf("Warning: JSON output stopped: %v", err)
+	}
+}
+
+// Close closes the output file, indexing the last records of an event
+// log.
+func (w *Writer) Close() error {
+	if w == nil || w.closer == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.closer.Close()
+}
@@ -0,0 +1,336 @@
+// Package plan describes what an agent would do under its configuration
+// without doing it: the programs it loads and whether the kernel verifier
+// accepts them, the hooks it attaches, the filters applied to events and
+// where events and metrics go. Agents print a plan for -dry-run, so a new
+// probe configuration can be reviewed before it is deployed.
+package plan
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/rlimit"
+
+	"probepilot/pkg/attach"
+	"probepilot/pkg/core"
+	"probepilot/pkg/profile"
+	"probepilot/pkg/route"
+)
+
+// Overhead is a coarse estimate of what a hook costs the host.
+type Overhead int
+
+const (
+	// Low hooks fire rarely or at a fixed rate, e.g. OOM kills or 99Hz
+	// sampling.
+	Low Overhead = iota
+	// Medium hooks fire with scheduler or connection activity.
+	Medium
+	// High hooks fire on hot paths such as every malloc or page
+	// allocation.
+	High
+)
+
+var overheadNames = []string{"low", "medium", "high"}
+
+func (o Overhead) String() string {
+	if o < 0 || int(o) >= len(overheadNames) {
+		return fmt.Sprintf("overhead(%d)", int(o))
+	}
+	return overheadNames[o]
+}
+
+// Hook is one attach point.
+type Hook struct {
+	// Set is the optional hook set the hook belongs to (see profile), or
+	// empty for core hooks.
+	Set string
+	// Kind is tracepoint, kprobe, kretprobe, fentry, fexit, uprobe,
+	// uretprobe or perf_event.
+	Kind    string
+	Target  string
+	Program string
+	// Enabled is false for hook sets the profile leaves detached; they
+	// can still be switched on through the control socket.
+	Enabled bool
+	Cost    Overhead
+}
+
+// KernelHooks returns the hooks of funcs as attach.Kernel would attach
+// them in mode on this host.
+func KernelHooks(set string, mode attach.Mode, funcs []attach.KernelFunc, enabled bool, cost Overhead) []Hook {
+	resolved := attach.Resolve(mode)
+	hooks := make([]Hook, 0, len(funcs))
+	for _, fn := range funcs {
+		h := Hook{Set: set, Kind: "kprobe", Target: fn.Symbol, Program: fn.Kprobe, Enabled: enabled, Cost: cost}
+		if fn.Return {
+			h.Kind = "kretprobe"
+		}
+		if resolved == attach.ModeFentry && fn.Fentry != "" {
+			h.Kind, h.Program = "fentry", fn.Fentry
+			if fn.Return {
+				h.Kind = "fexit"
+			}
+		}
+		hooks = append(hooks, h)
+	}
+	return hooks
+}
+
+// Program is a program of the agent's object.
+type Program struct {
+	Name         string
+	Type         ebpf.ProgramType
+	Instructions int
+}
+
+// Setting is a named filter or export destination.
+type Setting struct {
+	Name, Value string
+}
+
+// Plan is what an agent would load, attach, filter and export.
+type Plan struct {
+	Agent   string
+	Profile profile.Profile
+	Object  string
+	Kernel  string
+
+	Programs []Program
+	// Dropped are the programs that cannot run on this kernel.
+	Dropped []core.Dropped
+	Hooks   []Hook
+	Filters []Setting
+	Exports []Setting
+
+	// verified is set once the verifier accepted every program, skipped
+	// when verification could not run here.
+	verified  bool
+	skipped   string
+	verifyErr error
+}
+
+// New starts the plan of agent running prof.
+func New(agent string, prof profile.Profile) *Plan {
+	return &Plan{Agent: agent, Profile: prof}
+}
+
+// Core records the kernel the programs were prepared for and those
+// core.Kernel.Prepare dropped.
+func (p *Plan) Core(k *core.Kernel, dropped []core.Dropped) {
+	p.Kernel = k.String()
+	p.Dropped = dropped
+}
+
+// Verify loads the programs of object, already prepared by the agent, to
+// run them past the kernel verifier, and unloads them again. Hosts where
+// the agent lacks the privileges to load programs, or eBPF altogether,
+// skip verification rather than fail it.
+func (p *Plan) Verify(object string, spec *ebpf.CollectionSpec, opts ebpf.CollectionOptions) {
+	p.Object = object
+	for name, ps := range spec.Programs {
+		p.Programs = append(p.Programs, Program{Name: name, Type: ps.Type, Instructions: len(ps.Instructions)})
+	}
+	sort.Slice(p.Programs, func(i, j int) bool { return p.Programs[i].Name < p.Programs[j].Name })
+
+	if err := rlimit.RemoveMemlock(); err != nil {
+		p.skipped = err.Error()
+		return
+	}
+	coll, err := ebpf.NewCollectionWithOptions(spec, opts)
+	switch {
+	case err == nil:
+		coll.Close()
+		p.verified = true
+	case errors.Is(err, os.ErrPermission):
+		p.skipped = "loading programs needs root or CAP_BPF"
+	case errors.Is(err, ebpf.ErrNotSupported):
+		p.skipped = "no eBPF support on this host"
+	default:
+		p.verifyErr = err
+	}
+}
+
+// Filter records a filter applied to events.
+func (p *Plan) Filter(name, value string) {
+	p.Filters = append(p.Filters, Setting{name, value})
+}
+
+// Export records a destination of events or metrics.
+func (p *Plan) Export(name, value string) {
+	p.Exports = append(p.Exports, Setting{name, value})
+}
+
+// Routes records the sinks the routing file at path routes the agent's
+// events to. It fails where route.Load would.
+func (p *Plan) Routes(path string) error {
+	if path == "" {
+		return nil
+	}
+	cfg, err := route.LoadConfig(path)
+	if err != nil {
+		return err
+	}
+	if _, ok := cfg.Probes[p.Agent]; !ok {
+		return fmt.Errorf("%s: no rules for probe %s", path, p.Agent)
+	}
+	for _, name := range cfg.Routed(p.Agent) {
+		sink := cfg.Sinks[name]
+		value := fmt.Sprintf("%s %s", sink.Type, sink.Destination())
+		if sink.Type == "webhook" || sink.Type == "kafka" {
+			value += " (" + sink.Export.String() + ")"
+		}
+		p.Export("sink "+name, value)
+	}
+	return nil
+}
+
+// Overhead estimates the plan's overhead class: that of its costliest
+// enabled hook.
+func (p *Plan) Overhead() Overhead {
+	o := Low
+	for _, h := range p.Hooks {
+		if h.Enabled && h.Cost > o {
+			o = h.Cost
+		}
+	}
+	return o
+}
+
+// Err returns the verifier error, if the kernel rejected a program.
+func (p *Plan) Err() error {
+	return p.verifyErr
+}
+
+// Write prints the plan for review.
+func (p *Plan) Write(out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Dry run of %s, profile %s\n", p.Agent, p.Profile)
+	if p.Kernel != "" {
+		fmt.Fprintf(w, "Target %s\n", p.Kernel)
+	}
+
+	fmt.Fprintf(w, "\nPrograms (%s):\n", p.Object)
+	for _, prog := range p.Programs {
+		fmt.Fprintf(w, "  %s\t%s\t%d insns\n", prog.Name, prog.Type, prog.Instructions)
+	}
+	dropped := make(map[string]bool, len(p.Dropped))
+	for _, d := range p.Dropped {
+		fmt.Fprintf(w, "  %s\tdropped\t%v\n", d.Program, d.Err)
+		dropped[d.Program] = true
+	}
+	switch {
+	case p.verified:
+		fmt.Fprintln(w, "  verifier: accepted")
+	case p.verifyErr != nil:
+		fmt.Fprintf(w, "  verifier: REJECTED: %v\n", p.verifyErr)
+	default:
+		fmt.Fprintf(w, "  verifier: skipped (%s)\n", p.skipped)
+	}
+
+	fmt.Fprintln(w, "\nAttach plan:")
+	fmt.Fprintln(w, "  SET\tKIND\tTARGET\tPROGRAM\tSTATE\tCOST")
+	for _, h := range p.Hooks {
+		set, state := h.Set, "attach"
+		if set == "" {
+			set = "core"
+		}
+		switch {
+		case dropped[h.Program]:
+			state = "dropped"
+		case !h.Enabled:
+			state = "detached"
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\t%s\n", set, h.Kind, h.Target, h.Program, state, h.Cost)
+	}
+
+	writeSettings(w, "Filters", p.Filters)
+	writeSettings(w, "Exports", p.Exports)
+
+	fmt.Fprintf(w, "\nEstimated overhead: %s\n", p.Overhead())
+	return w.Flush()
+}
+
+// Read reads back the hooks and verifier outcome of a plan Write printed,
+// e.g. by an agent's -dry-run, for tools checking plans against a host.
+func Read(r io.Reader) (*Plan, error) {
+	p := &Plan{}
+	inHooks := false
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "Dry run of "):
+			p.Agent, _, _ = strings.Cut(strings.TrimPrefix(line, "Dry run of "), ",")
+		case line == "verifier: accepted":
+			p.verified = true
+		case strings.HasPrefix(line, "verifier: REJECTED: "):
+			p.verifyErr = errors.New(strings.TrimPrefix(line, "verifier: REJECTED: "))
+		case strings.HasPrefix(line, "verifier: skipped ("):
+			p.skipped = strings.TrimSuffix(strings.TrimPrefix(line, "verifier: skipped ("), ")")
+		case line == "Attach plan:":
+			inHooks = true
+		case inHooks && line == "":
+			inHooks = false
+		case inHooks && !strings.HasPrefix(line, "SET"):
+			// Columns are padded with two spaces or more, targets have
+			// single spaces at most
+			cols := columnSep.Split(line, -1)
+			if len(cols) != 6 {
+				return nil, fmt.Errorf("malformed hook line %q", line)
+			}
+			h := Hook{Kind: cols[1], Target: cols[2], Program: cols[3], Enabled: cols[4] == "attach"}
+			if cols[0] != "core" {
+				h.Set = cols[0]
+			}
+			for i, name := range overheadNames {
+				if cols[5] == name {
+					h.Cost = Overhead(i)
+				}
+			}
+			if cols[4] == "dropped" {
+				p.Dropped = append(p.Dropped, core.Dropped{Program: h.Program})
+			}
+			p.Hooks = append(p.Hooks, h)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if p.Agent == "" {
+		return nil, errors.New("no plan found")
+	}
+	return p, nil
+}
+
+var columnSep = regexp.MustCompile(`\s{2,}`)
+
+// Verdict describes what the verifier made of the programs: accepted,
+// rejected with its error, or skipped and why.
+func (p *Plan) Verdict() string {
+	switch {
+	case p.verified:
+		return "accepted"
+	case p.verifyErr != nil:
+		return "rejected: " + p.verifyErr.Error()
+	}
+	return "skipped (" + p.skipped + ")"
+}
+
+func writeSettings(w io.Writer, title string, settings []Setting) {
+	fmt.Fprintf(w, "\n%s:\n", title)
+	if len(settings) == 0 {
+		fmt.Fprintln(w, "  none")
+	}
+	for _, s := range settings {
+		fmt.Fprintf(w, "  %s\t%s\n", s.Name, s.Value)
+	}
+}
@@ -0,0 +1,80 @@
+//go:build linux
+
+package platform
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+func init() {
+	Register("linux", func() Backend { return ebpfBackend{} })
+}
+
+// ebpfBackend is the Linux eBPF backend used by all shipped probes.
+type ebpfBackend struct{}
+
+func (ebpfBackend) Name() string { return "ebpf" }
+
+func (ebpfBackend) Capabilities() Report {
+	release := kernelRelease()
+	major, minor := ParseKernelVersion(release)
+
+	report := Report{
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		Backend:   "ebpf",
+		Kernel:    release,
+		Supported: true,
+		Features: map[string]bool{
+			FeatureBTF:         exists("/sys/kernel/btf/vmlinux"),
+			FeatureTracefs:     tracefsPath() != "",
+			FeatureRingBuffer:  kernelAtLeast(major, minor, 5, 8),
+			FeatureKprobes:     exists("/sys/bus/event_source/devices/kprobe"),
+			FeatureUprobes:     exists("/sys/bus/event_source/devices/uprobe"),
+			FeatureTracepoints: tracefsPath() != "",
+			FeaturePerfEvents:  exists("/proc/sys/kernel/perf_event_paranoid"),
+		},
+	}
+
+	// README documents 4.4 as the minimum for basic eBPF support
+	if major != 0 && !kernelAtLeast(major, minor, 4, 4) {
+		report.Supported = false
+		report.Reason = fmt.Sprintf("kernel %s is older than 4.4", release)
+	}
+	return report
+}
+
+// kernelRelease returns the running kernel release, e.g. "6.1.0-13-amd64".
+func kernelRelease() string {
+	var uts syscall.Utsname
+	if err := syscall.Uname(&uts); err != nil {
+		return ""
+	}
+	var b strings.Builder
+	for _, c := range uts.Release {
+		if c == 0 {
+			break
+		}
+		b.WriteByte(byte(c))
+	}
+	return b.String()
+}
+
+// tracefsPath returns the mounted tracefs directory, or "" if none is found.
+func tracefsPath() string {
+	for _, path := range []string{"/sys/kernel/tracing", "/sys/kernel/debug/tracing"} {
+		if exists(path + "/events") {
+			return path
+		}
+	}
+	return ""
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !windows
+
+package platform
+
+import "runtime"
+
+func init() {
+	Register(runtime.GOOS, func() Backend {
+		return unsupported{
+			name:   "none",
+			reason: "no tracing backend for " + runtime.GOOS + " (DTrace backend not implemented); probes require Linux eBPF",
+		}
+	})
+}
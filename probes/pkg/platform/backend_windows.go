@@ -0,0 +1,21 @@
+//go:build windows
+
+package platform
+
+func init() {
+	Register("windows", func() Backend { return etwBackend{} })
+}
+
+// etwBackend is the placeholder for an Event Tracing for Windows backend.
+// It compiles and reports itself as unsupported until ETW sessions and
+// providers are wired up behind the probe interface.
+type etwBackend struct{}
+
+func (etwBackend) Name() string { return "etw" }
+
+func (etwBackend) Capabilities() Report {
+	return unsupported{
+		name:   "etw",
+		reason: "ETW backend is not implemented yet; probes require Linux eBPF",
+	}.Capabilities()
+}
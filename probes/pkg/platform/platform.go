@@ -0,0 +1,136 @@
+// Package platform abstracts the kernel tracing backend a probe runs on.
+//
+// On Linux the backend is eBPF. Every other platform gets a backend that
+// compiles cleanly and reports itself as unsupported, so library consumers
+// can build cross-platform and probes can fail with a clear capability
+// report instead of an obscure load error. New backends (ETW on Windows,
+// DTrace on the BSDs/macOS) plug in through Register.
+package platform
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrUnsupported is returned when the current platform has no working
+// tracing backend.
+var ErrUnsupported = errors.New("unsupported platform")
+
+// Feature names reported in a capability report.
+const (
+	FeatureBTF         = "btf"
+	FeatureTracefs     = "tracefs"
+	FeatureRingBuffer  = "ringbuf"
+	FeatureKprobes     = "kprobes"
+	FeatureUprobes     = "uprobes"
+	FeatureTracepoints = "tracepoints"
+	FeaturePerfEvents  = "perf_events"
+)
+
+// Report describes what the current platform's backend can do.
+type Report struct {
+	OS        string          `json:"os"`
+	Arch      string          `json:"arch"`
+	Backend   string          `json:"backend"`
+	Kernel    string          `json:"kernel,omitempty"`
+	Supported bool            `json:"supported"`
+	Reason    string          `json:"reason,omitempty"`
+	Features  map[string]bool `json:"features,omitempty"`
+}
+
+// Has reports whether the named feature is available.
+func (r Report) Has(feature string) bool {
+	return r.Features[feature]
+}
+
+// Err returns ErrUnsupported wrapped with the report's reason when the
+// backend cannot run probes, and nil otherwise.
+func (r Report) Err() error {
+	if r.Supported {
+		return nil
+	}
+	return fmt.Errorf("%w: %s/%s (%s backend): %s", ErrUnsupported, r.OS, r.Arch, r.Backend, r.Reason)
+}
+
+// String renders the report as a short human-readable summary.
+func (r Report) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "platform=%s/%s backend=%s", r.OS, r.Arch, r.Backend)
+	if r.Kernel != "" {
+		fmt.Fprintf(&b, " kernel=%s", r.Kernel)
+	}
+	if !r.Supported {
+		fmt.Fprintf(&b, " supported=false reason=%q", r.Reason)
+		return b.String()
+	}
+
+	names := make([]string, 0, len(r.Features))
+	for name := range r.Features {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&b, " %s=%t", name, r.Features[name])
+	}
+	return b.String()
+}
+
+// Backend is a kernel tracing facility probes can be built on.
+type Backend interface {
+	// Name identifies the backend, e.g. "ebpf" or "etw".
+	Name() string
+	// Capabilities probes the host and reports what the backend supports.
+	Capabilities() Report
+}
+
+var (
+	mu       sync.RWMutex
+	backends = map[string]func() Backend{}
+)
+
+// Register installs a backend factory for the given GOOS, replacing the
+// built-in one. It is the extension point for out-of-tree backends.
+func Register(goos string, factory func() Backend) {
+	mu.Lock()
+	defer mu.Unlock()
+	backends[goos] = factory
+}
+
+// Current returns the backend for the running platform.
+func Current() Backend {
+	mu.RLock()
+	factory, ok := backends[runtime.GOOS]
+	mu.RUnlock()
+	if ok {
+		return factory()
+	}
+	return unsupported{name: "none", reason: "no tracing backend is available for " + runtime.GOOS}
+}
+
+// Check returns the current platform's capability report together with a
+// non-nil error when probes cannot run on it.
+func Check() (Report, error) {
+	report := Current().Capabilities()
+	return report, report.Err()
+}
+
+// unsupported is the backend used where no tracing facility is implemented.
+type unsupported struct {
+	name   string
+	reason string
+}
+
+func (u unsupported) Name() string { return u.name }
+
+func (u unsupported) Capabilities() Report {
+	return Report{
+		OS:      runtime.GOOS,
+		Arch:    runtime.GOARCH,
+		Backend: u.name,
+		Reason:  u.reason,
+	}
+}
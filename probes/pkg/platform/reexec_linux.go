@@ -0,0 +1,17 @@
+package platform
+
+import (
+	"os"
+	"syscall"
+)
+
+// Reexec replaces the process with a new run of its executable, with the
+// same arguments and environment, keeping its PID, so supervisors do not
+// notice. File descriptors opened close-on-exec, as eBPF links are, close.
+func Reexec() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(exe, os.Args, os.Environ())
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package platform
+
+import "errors"
+
+// Reexec fails: restarting in place needs Linux.
+func Reexec() error { return errors.New("restarting needs Linux") }
@@ -0,0 +1,25 @@
+package platform
+
+import (
+	"strconv"
+	"strings"
+)
+
+// ParseKernelVersion extracts the major and minor version from a kernel
+// release string such as "5.15.0-91-generic". It returns zeros when the
+// string cannot be parsed.
+func ParseKernelVersion(release string) (major, minor int) {
+	parts := strings.SplitN(release, ".", 3)
+	if len(parts) < 2 {
+		return 0, 0
+	}
+	major, _ = strconv.Atoi(parts[0])
+	minor, _ = strconv.Atoi(strings.TrimRightFunc(parts[1], func(r rune) bool {
+		return r < '0' || r > '9'
+	}))
+	return major, minor
+}
+
+func kernelAtLeast(major, minor, wantMajor, wantMinor int) bool {
+	return major > wantMajor || (major == wantMajor && minor >= wantMinor)
+}
@@ -0,0 +1,386 @@
+// Package plugin lets third parties ship probes outside this repository.
+// A plugin is an executable named probepilot-probe-<name> that calls Main
+// with a Probe of its own; Main gives it the flags, configuration file
+// section, routing, OTLP export, JSON output, query API, control socket
+// and run summary of the built-in agents:
+//
+//	func main() {
+//		plugin.Main(plugin.Info{Name: "dns", Description: "DNS queries and latencies"},
+//			func(env *plugin.Env) (plugin.Probe, error) {
+//				return NewDNSProbe(env), nil
+//			})
+//	}
+//
+// The probe emits its events through env.Event, which routes, exports
+// and tails them like an agent's own, and its metrics through Samples,
+// which the query API, OTLP, JSON stats and the run summary read along
+// with the routing counters.
+//
+// probepilot finds plugins in $PROBEPILOT_PLUGIN_DIR, DefaultDir and
+// $PATH, and shakes hands with each by running it with -plugin-info: the
+// plugin prints its Info as JSON, tagged with the plugin schema, and
+// exits. A plugin of another major version of the schema is not run.
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+
+	"probepilot/pkg/attach"
+	"probepilot/pkg/clock"
+	"probepilot/pkg/config"
+	"probepilot/pkg/control"
+	"probepilot/pkg/export"
+	"probepilot/pkg/otlp"
+	"probepilot/pkg/output"
+	"probepilot/pkg/probe"
+	"probepilot/pkg/procfs"
+	"probepilot/pkg/profile"
+	"probepilot/pkg/query"
+	"probepilot/pkg/route"
+	"probepilot/pkg/schema"
+	"probepilot/pkg/summary"
+	"probepilot/pkg/target"
+)
+
+// Prefix starts the names of plugin executables.
+const Prefix = "probepilot-probe-"
+
+// DirEnv names a directory to look for plugins in before DefaultDir.
+const DirEnv = "PROBEPILOT_PLUGIN_DIR"
+
+// DefaultDir is where packages install plugins.
+const DefaultDir = "/usr/lib/probepilot/plugins"
+
+// InfoFlag makes a plugin print its Info and exit.
+const InfoFlag = "plugin-info"
+
+// Info describes a plugin to probepilot.
+type Info struct {
+	Schema string `json:"schema"`
+	// Name is the probe's name: its probepilot subcommand, configuration
+	// file section and the probe label of its events.
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// After names the probes whose attachment this one relies on, e.g.
+	// an exec tracer whose events it reacts to; probepilot run starts it
+	// once they are ready.
+	After []string `json:"after,omitempty"`
+}
+
+// validName keeps plugin names usable as subcommands, configuration
+// sections and environment variable names.
+var validName = regexp.MustCompile(`^[a-z][a-z0-9]*$`)
+
+// Validate checks that info names a plugin probepilot can run.
+func (info Info) Validate() error {
+	if err := schema.Check(schema.Plugin, info.Schema); err != nil {
+		return err
+	}
+	if !validName.MatchString(info.Name) {
+		return fmt.Errorf("invalid plugin name %q (want lowercase letters and digits)", info.Name)
+	}
+	for _, p := range config.Probes {
+		if p == info.Name {
+			return fmt.Errorf("plugin name %q is taken by a built-in probe", info.Name)
+		}
+	}
+	for _, name := range info.After {
+		if !validName.MatchString(name) || name == info.Name {
+			return fmt.Errorf("invalid probe %q in after of plugin %q", name, info.Name)
+		}
+	}
+	return nil
+}
+
+// Probe is a plugin's eBPF probe. Stats is only called for text output;
+// with -output json the plugin's samples are written instead.
+type Probe interface {
+	probe.Probe
+	query.Source
+}
+
+// Targeted is implemented by probes that scope themselves with a
+// target.Filter, which Main then keeps current.
+type Targeted interface {
+	Targets() *target.Filter
+}
+
+// Hooked is implemented by probes with hooks an operator may toggle
+// through the control socket.
+type Hooked interface {
+	Hooks() *attach.Toggles
+}
+
+// Env is what a plugin's probe gets from the agent.
+type Env struct {
+	Info    Info
+	Profile profile.Profile
+	// Targets is the targeting of -targets and its shorthands, for
+	// target.NewFilter, or nil.
+	Targets *target.Config
+	// Control is the control socket's server; probes may add commands.
+	Control *control.Server
+
+	router *route.Router
+	output *output.Writer
+}
+
+// Event delivers an event of the probe now.
+func (e *Env) Event(labels query.Labels, text string) {
+	e.EventAt(clock.Now(), labels, text)
+}
+
+// EventAt delivers an event stamped by BPF at mono, monotonic ns, to
+// tailing control clients, the routes and the JSON output.
+func (e *Env) EventAt(mono uint64, labels query.Labels, text string) {
+	e.Control.Publish(control.Event{Labels: labels, Text: text})
+	e.router.RouteAt(mono, labels, text)
+	e.output.EventAt(mono, labels, text)
+}
+
+// JSON reports whether the agent writes JSON lines rather than text, so
+// the probe should not print.
+func (e *Env) JSON() bool {
+	return e.output.JSON()
+}
+
+// agent runs a plugin's probe with the agent's own output and samples.
+type agent struct {
+	Probe
+	env   *Env
+	queue *probe.Queue
+}
+
+func (a *agent) Stats(ctx context.Context) {
+	if a.env.output.JSON() {
+		a.env.output.Stats(a.Samples())
+		return
+	}
+	a.Probe.Stats(ctx)
+	if a.queue != nil {
+		log.Printf("Event queue: %s", a.queue)
+	}
+}
+
+func (a *agent) Samples() []query.Sample {
+	samples := append(a.Probe.Samples(), a.env.router.Samples()...)
+	return append(samples, a.queue.Samples()...)
+}
+
+// Priority ranks records for the event queue by the probe's own ranking,
+// if it has one.
+func (a *agent) Priority(record []byte) probe.Priority {
+	if p, ok := a.Probe.(probe.Prioritizer); ok {
+		return p.Priority(record)
+	}
+	return probe.PriorityNormal
+}
+
+// Stalled delivers the watchdog's stalls as probe_stall events, and tells
+// the probe if it wants to know.
+func (a *agent) Stalled(s probe.Stall) {
+	a.env.Event(s.Labels(), s.String())
+	if sr, ok := a.Probe.(probe.StallReporter); ok {
+		sr.Stalled(s)
+	}
+}
+
+// Close closes the probe, then delivers its queued events.
+func (a *agent) Close() error {
+	err := a.Probe.Close()
+	a.env.router.Close()
+	a.env.output.Close()
+	return err
+}
+
+// Main runs the plugin described by info with the probe newProbe returns,
+// until interrupted, and exits.
+func Main(info Info, newProbe func(env *Env) (Probe, error)) {
+	if info.Schema == "" {
+		info.Schema = schema.Tag(schema.Plugin)
+	}
+	if len(os.Args) == 2 && (os.Args[1] == "-"+InfoFlag || os.Args[1] == "--"+InfoFlag) {
+		if err := json.NewEncoder(os.Stdout).Encode(info); err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	run := summary.Start(info.Name, flag.CommandLine)
+	if err := info.Validate(); err != nil {
+		run.Fatal(summary.StageConfig, "Invalid plugin: %v", err)
+	}
+	settings, err := config.Load(os.Args[1:], info.Name)
+	if err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	// Deferred first, so it runs after every other deferred cleanup
+	defer settings.Restart()
+	prof, err := profile.Selected(settings.Args(os.Args[1:]))
+	if err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	flag.Bool(InfoFlag, false, "print the plugin's name and description as JSON for probepilot, then exit")
+	flag.String("config", settings.Path(),
+		"YAML file of per-probe settings, overridden by $PROBEPILOT_* and flags (default $PROBEPILOT_CONFIG)")
+	settings.RegisterFleetFlags(flag.CommandLine)
+	flag.String("profile", prof.Name, profile.Usage())
+	reportInterval := flag.Duration("report-interval", prof.ReportInterval,
+		"how often to print statistics")
+	watchdog := probe.RegisterWatchdogFlag(flag.CommandLine)
+	eventQueue := probe.RegisterQueueFlag(flag.CommandLine)
+	parseSocket := control.RegisterFlags(flag.CommandLine)
+	parseOutput := output.RegisterFlags(flag.CommandLine)
+	parseHook := route.RegisterHookFlags(flag.CommandLine)
+	parseFilter := route.RegisterFilterFlag(flag.CommandLine)
+	parseCoalesce := route.RegisterCoalesceFlags(flag.CommandLine)
+	listen := flag.String("listen", "",
+		"address for the local query API: host:port, e.g. 127.0.0.1:9470, or unix:/path (disabled if empty)")
+	controlSocket := flag.String("control", "",
+		"UNIX socket for probepilot attach, e.g. /run/probepilot/"+info.Name+".sock (disabled if empty)")
+	routes := flag.String("routes", "",
+		"JSON file of per-probe event severity and routing rules (disabled if empty)")
+	otlpMetrics := flag.String("otlp-metrics", "",
+		"OpenTelemetry collector to push metrics to every report interval over OTLP/HTTP, e.g. http://otel-collector:4318 (disabled if empty)")
+	otlpLogs := flag.String("otlp-logs", "",
+		"OpenTelemetry collector to export the -otlp-log-events classes of events to as OTLP log records, e.g. http://otel-collector:4318 (disabled if empty)")
+	otlpLogEvents := flag.String("otlp-log-events", route.DefaultLogClasses,
+		"comma-separated classes of events for -otlp-logs: oom, security, connection_failure, self_health, process_exit, memory_pressure or all")
+	parseTargets := target.RegisterFlags(flag.CommandLine)
+	procfs.RegisterFlags(flag.CommandLine)
+	if err := settings.Apply(flag.CommandLine); err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	flag.Parse()
+
+	sockOpts, err := parseSocket()
+	if err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	outOpts, err := parseOutput()
+	if err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	targetConfig, err := parseTargets()
+	if err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	logTap, err := route.OTLPLogs(*otlpLogs, *otlpLogEvents)
+	if err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	hookConfig, err := parseHook()
+	if err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	eventFilter, err := parseFilter()
+	if err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	coalesceConfig, err := parseCoalesce()
+	if err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	queue, err := probe.NewQueue(*eventQueue)
+	if err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	router, err := route.Load(*routes, info.Name, logTap)
+	if err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	hook, err := route.StartHook(hookConfig, info.Name)
+	if err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	if err := router.Use(hook); err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	if err := router.Filter(eventFilter); err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	if err := router.Coalesce(coalesceConfig); err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	out, err := output.Open(outOpts, info.Name)
+	if err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	metrics, err := otlp.NewMetricPusher(*otlpMetrics, nil, info.Name, export.Options{})
+	if err != nil {
+		run.Fatal(summary.StageConfig, "Invalid configuration: %v", err)
+	}
+	log.Printf("Profile: %s", prof)
+	log.Printf("Configuration: %s", settings)
+
+	env := &Env{Info: info, Profile: prof, Targets: targetConfig, router: router, output: out}
+	a := &agent{env: env, queue: queue}
+	env.Control = control.NewServer(query.SourceFunc(a.Samples))
+	p, err := newProbe(env)
+	if err != nil {
+		run.Fatal(summary.StageLoad, "Failed to create "+info.Name+" probe: %v", err)
+	}
+	a.Probe = p
+	defer a.Close()
+	if h, ok := p.(Hooked); ok {
+		env.Control.HandleHooks(h.Hooks())
+	}
+	run.SetSource(a)
+
+	runner := probe.Runner{ReportInterval: *reportInterval, Watchdog: *watchdog, Queue: queue}
+	if err := runner.Start(a); err != nil {
+		run.Fatal(probe.Stage(err), "Failed to start "+info.Name+" probe: %v", err)
+	}
+
+	ctx, cancel := probe.SignalContext()
+	defer cancel()
+
+	// Restart when the fleet configuration changes the agent's settings
+	go settings.Watch(ctx, cancel)
+
+	if t, ok := p.(Targeted); ok && t.Targets() != nil {
+		go t.Targets().Run(ctx)
+	}
+	if *listen != "" {
+		l, err := control.Listen(*listen, sockOpts)
+		if err != nil {
+			run.Fatal(summary.StageConfig, "Failed to listen for the query API: %v", err)
+		}
+		go func() {
+			if err := query.Serve(ctx, l, a); err != nil {
+				log.Printf("Query API error: %v", err)
+			}
+		}()
+		log.Printf("Query API listening on %s", *listen)
+	}
+	if *controlSocket != "" {
+		l, err := control.Listen("unix:"+*controlSocket, sockOpts)
+		if err != nil {
+			run.Fatal(summary.StageConfig, "Failed to listen on the control socket: %v", err)
+		}
+		go func() {
+			if err := env.Control.Serve(ctx, l); err != nil {
+				log.Printf("Control socket error: %v", err)
+			}
+		}()
+		log.Printf("Control socket listening on %s", *controlSocket)
+	}
+	if metrics != nil {
+		log.Printf("OTLP metrics: pushing to %s every %v", metrics.URL(), *reportInterval)
+	}
+	go metrics.Run(ctx, a, *reportInterval)
+
+	if err := runner.Run(ctx, a); err != nil {
+		run.Fatal(summary.StageRun, info.Name+" probe error: %v", err)
+	}
+	metrics.Push(a)
+	metrics.Close()
+	run.Finish()
+	log.Printf("%s probe stopped", info.Name)
+}
@@ -0,0 +1,201 @@
+// Package policy checks observed connections against the communication a
+// deployment expects, so traffic the network policy was never meant to
+// allow shows up as drift instead of going unnoticed.
+//
+// A policy file lists the allowed flows; everything else is a violation:
+//
+//	{
+//	  "allow": [
+//	    {"name": "web to db", "src": "10.0.1.0/24", "dst": "10.0.2.5", "ports": "5432"},
+//	    {"name": "egress https", "src": "10.0.0.0/8", "ports": "443,8443"},
+//	    {"name": "local", "src": "127.0.0.0/8", "dst": "127.0.0.0/8"}
+//	  ]
+//	}
+//
+// Src and dst take an address or CIDR prefix and ports a comma-separated
+// list of ports and ranges such as 8000-8100; an omitted field matches
+// anything. A flow's source is the connecting side and its port the
+// destination port, whichever end of the connection the agent observes.
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Flow is a connection from Src to Dst:Port.
+type Flow struct {
+	Src, Dst netip.Addr
+	Port     uint16
+}
+
+func (f Flow) String() string {
+	return fmt.Sprintf("%s -> %s", f.Src, netip.AddrPortFrom(f.Dst, f.Port))
+}
+
+// Rule allows the flows it matches.
+type Rule struct {
+	Name  string `json:"name,omitempty"`
+	Src   string `json:"src,omitempty"`
+	Dst   string `json:"dst,omitempty"`
+	Ports string `json:"ports,omitempty"`
+
+	src, dst netip.Prefix
+	ports    Ports
+}
+
+// Ports is a set of ports and port ranges.
+type Ports []portRange
+
+type portRange struct {
+	lo, hi uint16
+}
+
+// Contains reports whether port is in ps; an empty set contains every
+// port.
+func (ps Ports) Contains(port uint16) bool {
+	if len(ps) == 0 {
+		return true
+	}
+	for _, pr := range ps {
+		if port >= pr.lo && port <= pr.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// String names the rule, falling back to its fields.
+func (r Rule) String() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return fmt.Sprintf("%s -> %s:%s", orAny(r.Src), orAny(r.Dst), orAny(r.Ports))
+}
+
+func orAny(s string) string {
+	if s == "" {
+		return "any"
+	}
+	return s
+}
+
+func (r *Rule) compile() error {
+	var err error
+	if r.src, err = ParsePrefix(r.Src); err != nil {
+		return fmt.Errorf("src: %v", err)
+	}
+	if r.dst, err = ParsePrefix(r.Dst); err != nil {
+		return fmt.Errorf("dst: %v", err)
+	}
+	if r.ports, err = ParsePorts(r.Ports); err != nil {
+		return fmt.Errorf("ports: %v", err)
+	}
+	return nil
+}
+
+// ParsePrefix parses an address or CIDR prefix; "" matches any address.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	if s == "" {
+		return netip.Prefix{}, nil
+	}
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return p.Masked(), nil
+	}
+	a, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(a, a.BitLen()), nil
+}
+
+// ParsePorts parses a comma-separated list of ports and ranges such as
+// 8000-8100; "" is every port.
+func ParsePorts(s string) (Ports, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var ranges Ports
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		lo, hi, isRange := strings.Cut(field, "-")
+		if !isRange {
+			hi = lo
+		}
+		l, err1 := strconv.ParseUint(lo, 10, 16)
+		h, err2 := strconv.ParseUint(hi, 10, 16)
+		if err1 != nil || err2 != nil || l == 0 || l > h {
+			return nil, fmt.Errorf("invalid port or range %q", field)
+		}
+		ranges = append(ranges, portRange{uint16(l), uint16(h)})
+	}
+	return ranges, nil
+}
+
+// MatchPrefix reports whether a is in p, a prefix from ParsePrefix.
+func MatchPrefix(p netip.Prefix, a netip.Addr) bool {
+	return !p.IsValid() || p.Contains(a)
+}
+
+// Matches reports whether r allows f.
+func (r Rule) Matches(f Flow) bool {
+	if !MatchPrefix(r.src, f.Src) || !MatchPrefix(r.dst, f.Dst) {
+		return false
+	}
+	return r.ports.Contains(f.Port)
+}
+
+// Policy is the set of allowed flows.
+type Policy struct {
+	Allow []Rule `json:"allow"`
+}
+
+// Load reads and validates the policy file at path, or returns a nil
+// Policy if path is empty.
+func Load(path string) (*Policy, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var p Policy
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(p.Allow) == 0 {
+		return nil, fmt.Errorf("%s: no allow rules, every flow would be a violation", path)
+	}
+	for i := range p.Allow {
+		if err := p.Allow[i].compile(); err != nil {
+			return nil, fmt.Errorf("%s: rule %d (%s): %v", path, i+1, p.Allow[i], err)
+		}
+	}
+	return &p, nil
+}
+
+// Allowed returns the first rule allowing f, and false if f violates the
+// policy. A nil Policy allows everything.
+func (p *Policy) Allowed(f Flow) (Rule, bool) {
+	if p == nil {
+		return Rule{}, true
+	}
+	for _, r := range p.Allow {
+		if r.Matches(f) {
+			return r, true
+		}
+	}
+	return Rule{}, false
+}
@@ -0,0 +1,208 @@
+// Package pprof writes sampled stacks as pprof profiles, the gzipped
+// profile.proto `go tool pprof`, Speedscope and most continuous profilers
+// read, without depending on the pprof module: the handful of messages a
+// profile of named frames needs are encoded by hand.
+//
+// Frames are given root first, as folded stacks are, and become one
+// function and location each; kernel frames keep their _[k] suffix off
+// the function name and are attributed to the [kernel.kallsyms] file, as
+// perf does.
+package pprof
+
+import (
+	"compress/gzip"
+	"io"
+	"strings"
+	"time"
+)
+
+// KernelSuffix marks kernel frames, as in folded stacks.
+const KernelSuffix = "_[k]"
+
+// ValueType names what a sample value counts and its unit, e.g.
+// "samples"/"count" or "cpu"/"nanoseconds".
+type ValueType struct {
+	Type, Unit string
+}
+
+// Sample is a stack and its values, one per Profile.SampleTypes.
+type Sample struct {
+	// Frames are root first
+	Frames []string
+	Values []int64
+	// Labels and NumLabels tag the sample, e.g. comm and pid
+	Labels    map[string]string
+	NumLabels map[string]int64
+}
+
+// Profile is a set of samples.
+type Profile struct {
+	SampleTypes []ValueType
+	// PeriodType and Period are the sampling interval, e.g. cpu and
+	// 1e9/99 nanoseconds
+	PeriodType ValueType
+	Period     int64
+	// Time and Duration are when and for how long samples were taken
+	Time     time.Time
+	Duration time.Duration
+	Samples  []Sample
+	Comments []string
+}
+
+// Write writes p gzipped, as `go tool pprof` reads it.
+func (p *Profile) Write(w io.Writer) error {
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(p.encode()); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// profile.proto field numbers
+const (
+	profileSampleType        = 1
+	profileSample            = 2
+	profileLocation          = 4
+	profileFunction          = 5
+	profileStringTable       = 6
+	profileTimeNanos         = 9
+	profileDurationNanos     = 10
+	profilePeriodType        = 11
+	profilePeriod            = 12
+	profileComment           = 13
+	profileDefaultSampleType = 14
+
+	valueTypeType = 1
+	valueTypeUnit = 2
+
+	sampleLocationID = 1
+	sampleValue      = 2
+	sampleLabel      = 3
+
+	labelKey = 1
+	labelStr = 2
+	labelNum = 3
+
+	locationID   = 1
+	locationLine = 4
+
+	lineFunctionID = 1
+
+	functionID         = 1
+	functionName       = 2
+	functionSystemName = 3
+	functionFilename   = 4
+)
+
+// encoder builds a profile's string table and deduplicates its
+// functions, one location each.
+type encoder struct {
+	strings   map[string]int64
+	table     []string
+	functions map[string]uint64
+	order     []string
+}
+
+func (e *encoder) str(s string) int64 {
+	if i, ok := e.strings[s]; ok {
+		return i
+	}
+	i := int64(len(e.table))
+	e.strings[s] = i
+	e.table = append(e.table, s)
+	return i
+}
+
+// location returns the location of frame, the same as its function's ID.
+func (e *encoder) location(frame string) uint64 {
+	if id, ok := e.functions[frame]; ok {
+		return id
+	}
+	id := uint64(len(e.order) + 1)
+	e.functions[frame] = id
+	e.order = append(e.order, frame)
+	return id
+}
+
+func (e *encoder) valueType(v ValueType) []byte {
+	var b buffer
+	b.int64(valueTypeType, e.str(v.Type))
+	b.int64(valueTypeUnit, e.str(v.Unit))
+	return b
+}
+
+func (p *Profile) encode() []byte {
+	e := &encoder{strings: make(map[string]int64), functions: make(map[string]uint64)}
+	e.str("")
+
+	var b buffer
+	for _, t := range p.SampleTypes {
+		b.message(profileSampleType, e.valueType(t))
+	}
+	for _, s := range p.Samples {
+		var sb buffer
+		// Locations are leaf first
+		ids := make([]uint64, len(s.Frames))
+		for i, frame := range s.Frames {
+			ids[len(ids)-1-i] = e.location(frame)
+		}
+		sb.packedUint64(sampleLocationID, ids)
+		values := make([]uint64, len(s.Values))
+		for i, v := range s.Values {
+			values[i] = uint64(v)
+		}
+		sb.packedUint64(sampleValue, values)
+		for _, k := range sortedKeys(s.Labels) {
+			var lb buffer
+			lb.int64(labelKey, e.str(k))
+			lb.int64(labelStr, e.str(s.Labels[k]))
+			sb.message(sampleLabel, lb)
+		}
+		for _, k := range sortedKeys(s.NumLabels) {
+			var lb buffer
+			lb.int64(labelKey, e.str(k))
+			lb.int64(labelNum, s.NumLabels[k])
+			sb.message(sampleLabel, lb)
+		}
+		b.message(profileSample, sb)
+	}
+	for i, frame := range e.order {
+		id := uint64(i + 1)
+		var line buffer
+		line.uint64(lineFunctionID, id)
+		var lb buffer
+		lb.uint64(locationID, id)
+		lb.message(locationLine, line)
+		b.message(profileLocation, lb)
+
+		name, file := frame, ""
+		if strings.HasSuffix(frame, KernelSuffix) {
+			name, file = strings.TrimSuffix(frame, KernelSuffix), "[kernel.kallsyms]"
+		}
+		var fb buffer
+		fb.uint64(functionID, id)
+		fb.int64(functionName, e.str(name))
+		fb.int64(functionSystemName, e.str(name))
+		fb.int64(functionFilename, e.str(file))
+		b.message(profileFunction, fb)
+	}
+	if !p.Time.IsZero() {
+		b.int64(profileTimeNanos, p.Time.UnixNano())
+	}
+	b.int64(profileDurationNanos, int64(p.Duration))
+	if p.PeriodType != (ValueType{}) {
+		b.message(profilePeriodType, e.valueType(p.PeriodType))
+	}
+	b.int64(profilePeriod, p.Period)
+	for _, c := range p.Comments {
+		b.int64(profileComment, e.str(c))
+	}
+	if len(p.SampleTypes) > 0 {
+		b.int64(profileDefaultSampleType, e.str(p.SampleTypes[len(p.SampleTypes)-1].Type))
+	}
+	// The string table goes last, once every string is in it
+	for _, s := range e.table {
+		b.string(profileStringTable, s)
+	}
+	return b
+}
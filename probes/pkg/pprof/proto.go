@@ -0,0 +1,72 @@
+package pprof
+
+import "sort"
+
+// buffer encodes protobuf fields.
+type buffer []byte
+
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+func (b *buffer) varint(v uint64) {
+	for v >= 0x80 {
+		*b = append(*b, byte(v)|0x80)
+		v >>= 7
+	}
+	*b = append(*b, byte(v))
+}
+
+func (b *buffer) tag(field, wire int) {
+	b.varint(uint64(field)<<3 | uint64(wire))
+}
+
+// uint64 and int64 write a varint field, omitted if zero as proto3 does.
+func (b *buffer) uint64(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	b.tag(field, wireVarint)
+	b.varint(v)
+}
+
+func (b *buffer) int64(field int, v int64) {
+	b.uint64(field, uint64(v))
+}
+
+func (b *buffer) bytes(field int, data []byte) {
+	b.tag(field, wireBytes)
+	b.varint(uint64(len(data)))
+	*b = append(*b, data...)
+}
+
+// string writes a string field even if empty, for the string table whose
+// first entry must be "".
+func (b *buffer) string(field int, s string) {
+	b.bytes(field, []byte(s))
+}
+
+func (b *buffer) message(field int, m buffer) {
+	b.bytes(field, m)
+}
+
+func (b *buffer) packedUint64(field int, vs []uint64) {
+	if len(vs) == 0 {
+		return
+	}
+	var packed buffer
+	for _, v := range vs {
+		packed.varint(v)
+	}
+	b.bytes(field, packed)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,333 @@
+// Package probe is the skeleton the agents run on. An agent implements
+// Probe for what is specific to it, its programs, hooks and records, and a
+// Runner does the rest: lifting the memlock limit, loading and attaching
+// in order, reading the ring buffer until shutdown, and the periodic
+// report and history sampling. Its watchdog recovers a reader that stops
+// reading, or a Handle that never returns, and its queue sheds bulk
+// records first when Handle falls behind the reader.
+//
+//	p := NewMyProbe(config)
+//	defer p.Close()
+//	r := probe.Runner{ReportInterval: *reportInterval}
+//	if err := r.Start(p); err != nil {
+//		run.Fatal(probe.Stage(err), "Failed to start my probe: %v", err)
+//	}
+//	ctx, stop := probe.SignalContext()
+//	defer stop()
+//	if err := r.Run(ctx, p); err != nil {
+//		run.Fatal(summary.StageRun, "My probe error: %v", err)
+//	}
+package probe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/ringbuf"
+	"github.com/cilium/ebpf/rlimit"
+
+	"probepilot/pkg/summary"
+)
+
+// Probe is an agent's eBPF probe. A Probe that is also a sync.Locker is
+// held locked while Handle, Stats and RecordHistory run, as they run on
+// different goroutines; the query API and exporters read its samples under the same
+// lock, through query.Snapshot.
+type Probe interface {
+	// Load loads the probe's programs and maps into the kernel.
+	Load() error
+	// Attach hooks the loaded programs.
+	Attach() error
+	// Events returns the ring buffer map the probe streams records
+	// through; the Runner reads it and passes each record to Handle.
+	Events() *ebpf.Map
+	// Handle processes one ring buffer record.
+	Handle(record []byte) error
+	// Stats prints the probe's statistics and checks its alerts; the
+	// Runner calls it every report interval and once at shutdown, when
+	// ctx is already done.
+	Stats(ctx context.Context)
+	// Close detaches and unloads whatever was loaded and attached. It is
+	// safe to call after a failed Load or Attach.
+	Close() error
+}
+
+// HistoryRecorder is implemented by probes that keep a local metric
+// history, sampled every second under the probe's lock, like Stats.
+type HistoryRecorder interface {
+	RecordHistory(now time.Time)
+}
+
+// Error is a failure to start a probe, tagged with the stage it failed in.
+type Error struct {
+	Stage summary.Stage
+	Err   error
+}
+
+func (e *Error) Error() string { return e.Err.Error() }
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// Stage returns the stage err failed in, StageRun if it does not say.
+func Stage(err error) summary.Stage {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Stage
+	}
+	return summary.StageRun
+}
+
+// DefaultReportInterval is used when a Runner sets no ReportInterval.
+const DefaultReportInterval = 10 * time.Second
+
+// Runner drives a Probe.
+type Runner struct {
+	// ReportInterval is how often Stats runs.
+	ReportInterval time.Duration
+	// Watchdog is how long the reader may leave records BPF wrote unread,
+	// or Handle take over one record, before the Runner recovers; 0
+	// disables the watchdog.
+	Watchdog time.Duration
+	// Queue holds records between the reader and Handle, which then runs
+	// on a goroutine of its own; nil handles each record as it is read.
+	Queue *Queue
+
+	events *ebpf.Map
+	// mu guards reader, which the watchdog and shutdown close
+	mu     sync.Mutex
+	reader *ringbuf.Reader
+	// closed is set at shutdown, reopen when the watchdog closed the
+	// reader for Run to open it again
+	closed, reopen bool
+
+	records atomic.Uint64
+	errors  atomic.Uint64
+	// handling is when Handle started on the record it is handling, in
+	// ns since the epoch, 0 between records
+	handling atomic.Int64
+	stalls   atomic.Uint64
+}
+
+// Start lifts the memlock limit, then loads and attaches p and opens its
+// ring buffer. Errors are *Error, so Stage tells which step failed.
+func (r *Runner) Start(p Probe) error {
+	if err := rlimit.RemoveMemlock(); err != nil {
+		return &Error{summary.StageLoad, fmt.Errorf("failed to remove memlock: %w", err)}
+	}
+	if err := p.Load(); err != nil {
+		return &Error{summary.StageLoad, fmt.Errorf("failed to load eBPF programs: %w", err)}
+	}
+	if err := p.Attach(); err != nil {
+		return &Error{summary.StageAttach, fmt.Errorf("failed to attach eBPF programs: %w", err)}
+	}
+	events := p.Events()
+	if events == nil {
+		return &Error{summary.StageLoad, errors.New("probe has no events ring buffer")}
+	}
+	reader, err := ringbuf.NewReader(events)
+	if err != nil {
+		return &Error{summary.StageLoad, fmt.Errorf("failed to create ring buffer reader: %w", err)}
+	}
+	r.events = events
+	r.reader = reader
+	return nil
+}
+
+// Run reads p's events, reports and samples its history until ctx is
+// done, then prints the final statistics. Errors handling single records
+// are logged, not returned.
+func (r *Runner) Run(ctx context.Context, p Probe) error {
+	if r.reader == nil {
+		return errors.New("probe runner not started")
+	}
+	interval := r.ReportInterval
+	if interval <= 0 {
+		interval = DefaultReportInterval
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go r.tick(ctx, done, p, interval)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		r.mu.Lock()
+		r.closed = true
+		r.reader.Close()
+		r.mu.Unlock()
+	}()
+	if r.Watchdog > 0 {
+		go r.watch(ctx, done, p)
+	}
+	var handled chan struct{}
+	if r.Queue != nil {
+		handled = make(chan struct{})
+		go r.handleQueued(p, handled)
+	}
+	prioritizer, _ := p.(Prioritizer)
+	lock := locker(p)
+
+	r.mu.Lock()
+	reader := r.reader
+	r.mu.Unlock()
+	var err error
+	for {
+		record, readErr := reader.Read()
+		if readErr != nil {
+			if errors.Is(readErr, ringbuf.ErrClosed) {
+				if reader, err = r.reopenReader(); reader != nil {
+					continue
+				}
+				break
+			}
+			// A reader that fails outside of shutdown stays failed
+			err = fmt.Errorf("reading the ring buffer: %w", readErr)
+			break
+		}
+		r.records.Add(1)
+		if r.Queue == nil {
+			r.handle(p, record.RawSample)
+			continue
+		}
+		priority := PriorityNormal
+		if prioritizer != nil {
+			priority = prioritizer.Priority(record.RawSample)
+		}
+		r.Queue.push(priority, record.RawSample)
+	}
+	if r.Queue != nil {
+		r.Queue.close()
+		<-handled
+	}
+	lock.Lock()
+	p.Stats(ctx)
+	lock.Unlock()
+	return err
+}
+
+// locker is p's lock if it has one, else a lock that does nothing.
+func locker(p Probe) sync.Locker {
+	if l, ok := p.(sync.Locker); ok {
+		return l
+	}
+	return noLock{}
+}
+
+type noLock struct{}
+
+func (noLock) Lock()   {}
+func (noLock) Unlock() {}
+
+// handleQueued handles the queued records until the queue is closed and
+// drained.
+func (r *Runner) handleQueued(p Probe, handled chan<- struct{}) {
+	defer close(handled)
+	for {
+		record, ok := r.Queue.pop()
+		if !ok {
+			return
+		}
+		r.handle(p, record)
+	}
+}
+
+// handle passes record to p.Handle. The watchdog times Handle from when
+// it holds p's lock, not while it waits on Stats for it.
+func (r *Runner) handle(p Probe, record []byte) {
+	lock := locker(p)
+	lock.Lock()
+	defer lock.Unlock()
+	r.handling.Store(time.Now().UnixNano())
+	if err := p.Handle(record); err != nil {
+		r.errors.Add(1)
+		log.Printf("Error processing event: %v", err)
+	}
+	r.handling.Store(0)
+}
+
+func (r *Runner) tick(ctx context.Context, done <-chan struct{}, p Probe, interval time.Duration) {
+	report := time.NewTicker(interval)
+	defer report.Stop()
+	lock := locker(p)
+	var history HistoryRecorder
+	var sampler <-chan time.Time
+	if h, ok := p.(HistoryRecorder); ok {
+		t := time.NewTicker(time.Second)
+		defer t.Stop()
+		history, sampler = h, t.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-done:
+			return
+		case now := <-sampler:
+			lock.Lock()
+			history.RecordHistory(now)
+			lock.Unlock()
+		case <-report.C:
+			lock.Lock()
+			p.Stats(ctx)
+			lock.Unlock()
+		}
+	}
+}
+
+// Records returns how many records Run has read, and how many of them
+// the probe failed to handle.
+func (r *Runner) Records() (read, failed uint64) {
+	return r.records.Load(), r.errors.Load()
+}
+
+// SignalContext returns a context cancelled on SIGINT or SIGTERM.
+func SignalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-sigs:
+			log.Println("Received interrupt signal, shutting down...")
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(sigs)
+	}()
+	return ctx, cancel
+}
+
+// Object returns the path of the agent's compiled eBPF object: name in the
+// working directory if it is there, else name next to the executable, where
+// the Makefiles build it, so an agent started by probepilot from elsewhere
+// still finds it.
+func Object(name string) string {
+	if fileExists(name) {
+		return name
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return name
+	}
+	if path := filepath.Join(filepath.Dir(exe), name); fileExists(path) {
+		return path
+	}
+	return name
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,242 @@
+package probe
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+
+	"probepilot/pkg/query"
+)
+
+// DefaultQueue is the -event-queue agents run with unless told otherwise.
+const DefaultQueue = 8192
+
+// RegisterQueueFlag defines -event-queue on fs, for NewQueue.
+func RegisterQueueFlag(fs *flag.FlagSet) *int {
+	return fs.Int("event-queue", DefaultQueue,
+		"records read from the ring buffer that may wait to be handled; when handling falls behind, bulk records such as per-packet sends are shed first and critical ones such as OOM kills and state changes never (handled as read if 0)")
+}
+
+// Priority ranks records for shedding when the queue is full.
+type Priority uint8
+
+const (
+	// PriorityBulk records, such as per-packet sends or single
+	// allocations, are shed first.
+	PriorityBulk Priority = iota
+	// PriorityNormal records are shed once no bulk ones are queued.
+	PriorityNormal
+	// PriorityCritical records, such as OOM kills, security events and
+	// state changes, are never shed: the reader waits for room instead.
+	PriorityCritical
+
+	numPriorities = 3
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityBulk:
+		return "bulk"
+	case PriorityNormal:
+		return "normal"
+	case PriorityCritical:
+		return "critical"
+	}
+	return fmt.Sprintf("priority(%d)", uint8(p))
+}
+
+// Prioritizer is implemented by probes that rank their records; the
+// records of probes that do not are all PriorityNormal. Priority runs on
+// the reader's goroutine, so it should only look at the record.
+type Prioritizer interface {
+	Priority(record []byte) Priority
+}
+
+// Queue holds the records read from the ring buffer until Handle takes
+// them, in the order read. When full, the oldest queued record of a lower
+// priority than the one read is shed for it, else the one read is, unless
+// it is critical. It is safe for concurrent use, and its methods are safe
+// on a nil Queue, which queues nothing.
+type Queue struct {
+	capacity int
+
+	mu sync.Mutex
+	// cond is signalled when records are queued or taken, and on close
+	cond *sync.Cond
+	// queued holds the records of each priority, oldest first, tagged
+	// with the order they were read in
+	queued [numPriorities][]queuedRecord
+	seq    uint64
+	len    int
+	peak   int
+	closed bool
+	shed   [numPriorities]uint64
+	// waits counts critical records the reader waited for room for
+	waits uint64
+}
+
+type queuedRecord struct {
+	seq    uint64
+	record []byte
+}
+
+// QueueStats is a snapshot of a Queue's counters.
+type QueueStats struct {
+	Capacity int
+	// Depth is the records queued now, Peak the most ever queued
+	Depth, Peak int
+	// Shed counts the records shed by priority
+	Shed [numPriorities]uint64
+	// Waits counts the critical records the reader waited for room for
+	Waits uint64
+}
+
+// NewQueue returns a queue of capacity records, or nil if capacity is 0.
+func NewQueue(capacity int) (*Queue, error) {
+	if capacity < 0 {
+		return nil, fmt.Errorf("invalid -event-queue %d (want >= 0)", capacity)
+	}
+	if capacity == 0 {
+		return nil, nil
+	}
+	q := &Queue{capacity: capacity}
+	q.cond = sync.NewCond(&q.mu)
+	return q, nil
+}
+
+// push queues record, shedding a record if the queue is full, and
+// reports false once the queue is closed.
+func (q *Queue) push(p Priority, record []byte) bool {
+	if p >= numPriorities {
+		p = PriorityCritical
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	waited := false
+	for q.len >= q.capacity && !q.closed {
+		if lower, ok := q.lowest(p); ok {
+			q.queued[lower][0].record = nil
+			q.queued[lower] = q.queued[lower][1:]
+			q.len--
+			q.shed[lower]++
+			break
+		}
+		if p != PriorityCritical {
+			q.shed[p]++
+			return true
+		}
+		if !waited {
+			waited = true
+			q.waits++
+		}
+		q.cond.Wait()
+	}
+	if q.closed {
+		return false
+	}
+	q.seq++
+	q.queued[p] = append(q.queued[p], queuedRecord{seq: q.seq, record: record})
+	q.len++
+	q.peak = max(q.peak, q.len)
+	q.cond.Broadcast()
+	return true
+}
+
+// lowest returns the lowest priority below p with records queued.
+func (q *Queue) lowest(p Priority) (Priority, bool) {
+	for lower := PriorityBulk; lower < p && lower < PriorityCritical; lower++ {
+		if len(q.queued[lower]) > 0 {
+			return lower, true
+		}
+	}
+	return 0, false
+}
+
+// pop takes the oldest record, waiting for one, and reports false once
+// the queue is closed and drained.
+func (q *Queue) pop() ([]byte, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.len == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.len == 0 {
+		return nil, false
+	}
+	oldest := -1
+	for p := range q.queued {
+		if len(q.queued[p]) > 0 && (oldest < 0 || q.queued[p][0].seq < q.queued[oldest][0].seq) {
+			oldest = p
+		}
+	}
+	record := q.queued[oldest][0].record
+	q.queued[oldest][0].record = nil
+	q.queued[oldest] = q.queued[oldest][1:]
+	q.len--
+	q.cond.Broadcast()
+	return record, true
+}
+
+// close stops push from queueing; pop drains what is queued.
+func (q *Queue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// Stats returns the queue's counters.
+func (q *Queue) Stats() QueueStats {
+	if q == nil {
+		return QueueStats{}
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return QueueStats{Capacity: q.capacity, Depth: q.len, Peak: q.peak, Shed: q.shed, Waits: q.waits}
+}
+
+// String summarizes the queue for statistics, e.g. "12/8192 queued (peak
+// 8192), shed 1042 bulk, 3 normal".
+func (q *Queue) String() string {
+	if q == nil {
+		return "disabled"
+	}
+	s := q.Stats()
+	text := fmt.Sprintf("%d/%d queued (peak %d)", s.Depth, s.Capacity, s.Peak)
+	var shed []string
+	for p, n := range s.Shed {
+		if n > 0 {
+			shed = append(shed, fmt.Sprintf("%d %s", n, Priority(p)))
+		}
+	}
+	if len(shed) > 0 {
+		text += ", shed " + strings.Join(shed, ", ")
+	}
+	if s.Waits > 0 {
+		text += fmt.Sprintf(", reader waited %d times for room for critical records", s.Waits)
+	}
+	return text
+}
+
+// Samples exports the queue's depth and shed counters.
+func (q *Queue) Samples() []query.Sample {
+	if q == nil {
+		return nil
+	}
+	s := q.Stats()
+	samples := []query.Sample{
+		{Name: "event_queue_capacity", Value: float64(s.Capacity)},
+		{Name: "event_queue_depth", Value: float64(s.Depth)},
+		{Name: "event_queue_peak", Value: float64(s.Peak)},
+		{Name: "event_queue_critical_waits_total", Value: float64(s.Waits)},
+	}
+	for p, n := range s.Shed {
+		samples = append(samples, query.Sample{
+			Name:   "event_queue_shed_total",
+			Labels: query.Labels{"priority": Priority(p).String()},
+			Value:  float64(n),
+		})
+	}
+	return samples
+}
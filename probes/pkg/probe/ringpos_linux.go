@@ -0,0 +1,46 @@
+//go:build linux
+
+package probe
+
+import (
+	"os"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+)
+
+// ringPositions reads how far BPF has written a ring buffer and how far
+// its reader has read it, from the pages the kernel shares them in: the
+// consumer position first, the producer position in the page after.
+type ringPositions struct {
+	consumer, producer []byte
+}
+
+func openRingPositions(m *ebpf.Map) (*ringPositions, error) {
+	page := os.Getpagesize()
+	consumer, err := unix.Mmap(m.FD(), 0, page, unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	producer, err := unix.Mmap(m.FD(), int64(page), page, unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		unix.Munmap(consumer)
+		return nil, err
+	}
+	return &ringPositions{consumer: consumer, producer: producer}, nil
+}
+
+// positions returns the producer and consumer positions, in bytes
+// written and read since the ring buffer was created.
+func (p *ringPositions) positions() (produced, consumed uint64) {
+	produced = atomic.LoadUint64((*uint64)(unsafe.Pointer(&p.producer[0])))
+	consumed = atomic.LoadUint64((*uint64)(unsafe.Pointer(&p.consumer[0])))
+	return produced, consumed
+}
+
+func (p *ringPositions) Close() {
+	unix.Munmap(p.producer)
+	unix.Munmap(p.consumer)
+}
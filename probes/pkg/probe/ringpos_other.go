@@ -0,0 +1,19 @@
+//go:build !linux
+
+package probe
+
+import (
+	"errors"
+
+	"github.com/cilium/ebpf"
+)
+
+type ringPositions struct{}
+
+func openRingPositions(*ebpf.Map) (*ringPositions, error) {
+	return nil, errors.New("ring buffers need Linux")
+}
+
+func (*ringPositions) positions() (produced, consumed uint64) { return 0, 0 }
+
+func (*ringPositions) Close() {}
@@ -0,0 +1,184 @@
+package probe
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/cilium/ebpf/ringbuf"
+
+	"probepilot/pkg/platform"
+	"probepilot/pkg/query"
+)
+
+// DefaultWatchdog is the -watchdog agents run with unless told otherwise.
+const DefaultWatchdog = 30 * time.Second
+
+// RegisterWatchdogFlag defines -watchdog on fs, for Runner.Watchdog.
+func RegisterWatchdogFlag(fs *flag.FlagSet) *time.Duration {
+	return fs.Duration("watchdog", DefaultWatchdog,
+		"how long the ring buffer may hold records unread, or one record take to handle, before the agent reopens its reader or restarts, raising a probe_stall alert (0 disables it)")
+}
+
+// StallKind tells what the watchdog found stalled.
+type StallKind string
+
+const (
+	// StallReader is a reader that stopped reading while BPF kept
+	// writing records.
+	StallReader StallKind = "reader"
+	// StallHandler is a Handle that did not return from a record.
+	StallHandler StallKind = "handler"
+)
+
+// Actions the Runner takes on stalls.
+const (
+	ActionReopenReader = "reopen_reader"
+	ActionRestart      = "restart"
+)
+
+// Stall is a stall the watchdog found.
+type Stall struct {
+	Kind StallKind
+	// For is how long nothing moved.
+	For time.Duration
+	// Unread is the bytes of records BPF wrote that the reader had not
+	// read, for reader stalls.
+	Unread uint64
+	// Action is what the Runner does about it.
+	Action string
+}
+
+func (s Stall) String() string {
+	switch s.Kind {
+	case StallReader:
+		return fmt.Sprintf("ring buffer reader stalled for %v with %d bytes unread, reopening it", s.For.Round(time.Second), s.Unread)
+	case StallHandler:
+		return fmt.Sprintf("event handler stuck on one record for %v, restarting the agent unless it returns", s.For.Round(time.Second))
+	}
+	return fmt.Sprintf("%s stalled for %v (%s)", s.Kind, s.For.Round(time.Second), s.Action)
+}
+
+// Labels are those of the probe_stall event raising s.
+func (s Stall) Labels() query.Labels {
+	return query.Labels{"type": "probe_stall", "stall": string(s.Kind), "action": s.Action}
+}
+
+// StallReporter is implemented by probes that raise the watchdog's stalls
+// as self-health alerts. Stalled runs on the watchdog's goroutine, and
+// for handler stalls while Handle is stuck, so it must not take the
+// probe's lock.
+type StallReporter interface {
+	Stalled(s Stall)
+}
+
+// Stalls returns how many stalls the watchdog found.
+func (r *Runner) Stalls() uint64 {
+	return r.stalls.Load()
+}
+
+// watch checks every quarter of Watchdog that records move. A reader that
+// leaves records unread, with Handle idle, is closed for Run to open it
+// again. A Handle stuck on a record cannot be interrupted: after Watchdog
+// the stall is reported, and after twice that the agent execs itself
+// anew, its eBPF links closing with their file descriptors, without the
+// cleanups and final statistics of a shutdown.
+func (r *Runner) watch(ctx context.Context, done <-chan struct{}, p Probe) {
+	ring, err := openRingPositions(r.events)
+	if err != nil {
+		log.Printf("Warning: the watchdog cannot follow the ring buffer, only handlers are watched: %v", err)
+	} else {
+		defer ring.Close()
+	}
+	period := r.Watchdog / 4
+	if period < 100*time.Millisecond {
+		period = 100 * time.Millisecond
+	}
+	t := time.NewTicker(period)
+	defer t.Stop()
+
+	var consumed uint64
+	// progress is when records last moved, and reported when the Handle
+	// last reported stuck started
+	progress := time.Now()
+	var reported int64
+	for {
+		var now time.Time
+		select {
+		case <-ctx.Done():
+			return
+		case <-done:
+			return
+		case now = <-t.C:
+		}
+		if start := r.handling.Load(); start != 0 {
+			// The reader waits on Handle
+			progress = now
+			stuck := now.Sub(time.Unix(0, start))
+			switch {
+			case stuck >= 2*r.Watchdog:
+				log.Printf("Watchdog: event handler stuck for %v, restarting", stuck.Round(time.Second))
+				if err := platform.Reexec(); err != nil {
+					log.Printf("Warning: the watchdog cannot restart the agent: %v", err)
+				}
+				return
+			case stuck >= r.Watchdog && start != reported:
+				reported = start
+				r.stalled(p, Stall{Kind: StallHandler, For: stuck, Action: ActionRestart})
+			}
+			continue
+		}
+		if ring == nil {
+			continue
+		}
+		produced, cons := ring.positions()
+		if cons != consumed || produced == cons {
+			consumed, progress = cons, now
+			continue
+		}
+		if stuck := now.Sub(progress); stuck >= r.Watchdog {
+			r.stalled(p, Stall{Kind: StallReader, For: stuck, Unread: produced - cons, Action: ActionReopenReader})
+			r.closeReader()
+			progress = now
+		}
+	}
+}
+
+func (r *Runner) stalled(p Probe, s Stall) {
+	r.stalls.Add(1)
+	log.Printf("Warning: watchdog: %s", s)
+	if sr, ok := p.(StallReporter); ok {
+		sr.Stalled(s)
+	}
+}
+
+// closeReader closes the reader for Run to open it again.
+func (r *Runner) closeReader() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	r.reopen = true
+	r.reader.Close()
+}
+
+// reopenReader opens the ring buffer again after the watchdog closed the
+// reader, returning nil at shutdown. The new reader goes on from where
+// the last stopped.
+func (r *Runner) reopenReader() (*ringbuf.Reader, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed || !r.reopen {
+		return nil, nil
+	}
+	r.reopen = false
+	reader, err := ringbuf.NewReader(r.events)
+	if err != nil {
+		return nil, fmt.Errorf("reopening the ring buffer: %w", err)
+	}
+	r.reader = reader
+	return reader, nil
+}
@@ -0,0 +1,125 @@
+package procfs
+
+import (
+	"strconv"
+	"sync"
+)
+
+// Cache holds process metadata keyed by PID. It is backfilled from /proc
+// at startup so events from processes that started before the agent are
+// attributed from the first reporting interval, and filled lazily for
+// processes seen later.
+type Cache struct {
+	// OnAdd, if set, is called for every process added to the cache,
+	// e.g. to mirror metadata into eBPF filter or metadata maps.
+	OnAdd func(*Process)
+
+	mu    sync.RWMutex
+	procs map[uint32]*Process
+}
+
+// NewCache returns an empty cache.
+func NewCache() *Cache {
+	return &Cache{procs: make(map[uint32]*Process)}
+}
+
+// Backfill scans /proc and adds every running process, returning how
+// many were added.
+func (c *Cache) Backfill() (int, error) {
+	procs, err := Scan()
+	if err != nil {
+		return 0, err
+	}
+	for _, p := range procs {
+		c.Put(p)
+	}
+	return len(procs), nil
+}
+
+// Put adds or replaces the entry for p.PID.
+func (c *Cache) Put(p *Process) {
+	c.mu.Lock()
+	c.procs[p.PID] = p
+	c.mu.Unlock()
+
+	if c.OnAdd != nil {
+		c.OnAdd(p)
+	}
+}
+
+// Lookup returns the cached entry for pid without touching /proc.
+func (c *Cache) Lookup(pid uint32) (*Process, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	p, ok := c.procs[pid]
+	return p, ok
+}
+
+// Get returns the entry for pid, reading it from /proc on a cache miss.
+// It returns nil if the process is gone.
+func (c *Cache) Get(pid uint32) *Process {
+	if p, ok := c.Lookup(pid); ok {
+		return p
+	}
+	p, err := ReadProcess(pid)
+	if err != nil {
+		return nil
+	}
+	c.Put(p)
+	return p
+}
+
+// Name returns the command name of pid, or "" if it is unknown.
+func (c *Cache) Name(pid uint32) string {
+	if p := c.Get(pid); p != nil {
+		return p.Comm
+	}
+	return ""
+}
+
+// NamespacedPID returns the PID pid has in its own PID namespace, and
+// whether that differs from pid, i.e. the process is in a container with
+// a namespace of its own.
+func (c *Cache) NamespacedPID(pid uint32) (uint32, bool) {
+	p := c.Get(pid)
+	if p == nil {
+		return 0, false
+	}
+	nspid := p.NamespacedPID()
+	return nspid, nspid != pid
+}
+
+// HostPID returns the PID, as probes report it, of the cached process
+// known as nspid in the PID namespace with inode ns.
+func (c *Cache) HostPID(ns uint64, nspid uint32) (uint32, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for pid, p := range c.procs {
+		if p.PIDNamespace == ns && p.NamespacedPID() == nspid {
+			return pid, true
+		}
+	}
+	return 0, false
+}
+
+// AddPIDLabels adds the ns_pid label to the labels of pid's events and
+// samples when the process has a PID of its own namespace.
+func (c *Cache) AddPIDLabels(labels map[string]string, pid uint32) {
+	if nspid, ok := c.NamespacedPID(pid); ok {
+		labels["ns_pid"] = strconv.FormatUint(uint64(nspid), 10)
+	}
+}
+
+// Remove drops pid from the cache, e.g. when the process exits.
+func (c *Cache) Remove(pid uint32) {
+	c.mu.Lock()
+	delete(c.procs, pid)
+	c.mu.Unlock()
+}
+
+// Len returns the number of cached processes.
+func (c *Cache) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.procs)
+}
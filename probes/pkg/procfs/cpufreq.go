@@ -0,0 +1,80 @@
+package procfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SysCPU holds the cpu<N> directories of sysfs with each CPU's cpufreq,
+// cpuidle and thermal_throttle. Agents running in a container with the
+// host's /sys mounted elsewhere override it.
+var SysCPU = "/sys/devices/system/cpu"
+
+// CPUFreq is how a CPU's frequency is scaled and the idle states it can
+// enter, from sysfs. Fields a kernel or CPU does not expose, such as
+// cpufreq in most virtual machines, are left zero.
+type CPUFreq struct {
+	// MinKHz and MaxKHz are the hardware's frequency range,
+	// cpuinfo_min_freq and cpuinfo_max_freq
+	MinKHz uint64
+	MaxKHz uint64
+	// CurKHz is the frequency it runs at, scaling_cur_freq
+	CurKHz uint64
+	// Governor and Driver pick the frequency, e.g. "powersave" of
+	// "intel_pstate"
+	Governor string
+	Driver   string
+	// IdleStates names the cpuidle states by index, e.g. "POLL", "C1E"
+	IdleStates []string
+	// ThermalThrottles counts the times the core was throttled for heat
+	// since boot, core_throttle_count on x86
+	ThermalThrottles uint64
+}
+
+// ReadCPUFreq reads the frequency scaling and idle states of cpu; it fails
+// only if the CPU is not in sysfs.
+func ReadCPUFreq(cpu int) (CPUFreq, error) {
+	dir := filepath.Join(SysCPU, "cpu"+strconv.Itoa(cpu))
+	if _, err := os.Stat(dir); err != nil {
+		return CPUFreq{}, err
+	}
+	var f CPUFreq
+	f.MinKHz = readSysUint(filepath.Join(dir, "cpufreq", "cpuinfo_min_freq"))
+	f.MaxKHz = readSysUint(filepath.Join(dir, "cpufreq", "cpuinfo_max_freq"))
+	f.CurKHz = readSysUint(filepath.Join(dir, "cpufreq", "scaling_cur_freq"))
+	f.Governor = readSysString(filepath.Join(dir, "cpufreq", "scaling_governor"))
+	f.Driver = readSysString(filepath.Join(dir, "cpufreq", "scaling_driver"))
+	f.ThermalThrottles = readSysUint(filepath.Join(dir, "thermal_throttle", "core_throttle_count"))
+	for i := 0; ; i++ {
+		name := readSysString(filepath.Join(dir, "cpuidle", fmt.Sprintf("state%d", i), "name"))
+		if name == "" {
+			break
+		}
+		f.IdleStates = append(f.IdleStates, name)
+	}
+	return f, nil
+}
+
+// IdleState names idle state index, or "state<index>" if it has no name.
+func (f CPUFreq) IdleState(index uint32) string {
+	if int(index) < len(f.IdleStates) {
+		return f.IdleStates[index]
+	}
+	return fmt.Sprintf("state%d", index)
+}
+
+func readSysString(path string) string {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(raw))
+}
+
+func readSysUint(path string) uint64 {
+	n, _ := strconv.ParseUint(readSysString(path), 10, 64)
+	return n
+}
@@ -0,0 +1,82 @@
+package procfs
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The kernel, and so every probe, reports PIDs of the initial PID
+// namespace: the host's. A process in a container knows itself by the
+// PID of its own namespace, which is what kubectl exec and docker exec
+// show; enrichment adds it to reports as the ns_pid label. For this the
+// agent needs the host's view of /proc: it runs in the host's PID
+// namespace, or the host's /proc is mounted into its container and
+// passed as -proc-root.
+
+// initPIDNamespace is the inode of the initial PID namespace,
+// PROC_PID_INIT_INO.
+const initPIDNamespace = 0xeffffffc
+
+// RegisterFlags defines -proc-root on fs, overriding Root.
+func RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&Root, "proc-root", Root,
+		"procfs of the host, e.g. /host/proc when the agent runs in a container with its own PID namespace")
+}
+
+// NamespacedPID returns the PID p has in its own PID namespace, which is
+// PID for processes outside containers.
+func (p *Process) NamespacedPID() uint32 {
+	if len(p.NSPIDs) == 0 {
+		return p.PID
+	}
+	return p.NSPIDs[len(p.NSPIDs)-1]
+}
+
+// parseStatusNSpid parses the NSpid line of /proc/<pid>/status: the PIDs
+// of the process from the namespace of the procfs mount down to its own.
+// Kernels before 4.1 have no such line.
+func parseStatusNSpid(raw []byte) []uint32 {
+	for _, line := range strings.Split(string(raw), "\n") {
+		if !strings.HasPrefix(line, "NSpid:") {
+			continue
+		}
+		var pids []uint32
+		for _, field := range strings.Fields(line[len("NSpid:"):]) {
+			pid, err := strconv.ParseUint(field, 10, 32)
+			if err != nil {
+				return nil
+			}
+			pids = append(pids, uint32(pid))
+		}
+		return pids
+	}
+	return nil
+}
+
+// pidNamespace returns the inode of the PID namespace of the process
+// named dir under Root, read from its ns/pid link, "pid:[<inode>]".
+func pidNamespace(dir string) (uint64, error) {
+	link, err := os.Readlink(Path(dir, "ns", "pid"))
+	if err != nil {
+		return 0, err
+	}
+	inode := strings.TrimSuffix(strings.TrimPrefix(link, "pid:["), "]")
+	return strconv.ParseUint(inode, 10, 64)
+}
+
+// CheckHostPIDs returns an error if the processes under Root are not
+// seen with the host's PIDs, as from a container's own /proc, where the
+// PIDs probes report would name other processes or none.
+func CheckHostPIDs() error {
+	ns, err := pidNamespace("1")
+	if err != nil {
+		return fmt.Errorf("cannot tell the PID namespace of %s: %v", Root, err)
+	}
+	if ns != initPIDNamespace {
+		return fmt.Errorf("%s shows a container's PID namespace, not the host's; kernel PIDs will be misattributed (run in the host's PID namespace or pass the host's /proc as -proc-root)", Root)
+	}
+	return nil
+}
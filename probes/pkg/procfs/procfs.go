@@ -0,0 +1,184 @@
+// Package procfs reads process metadata from /proc and keeps an
+// enrichment cache that probes use to attribute kernel events to
+// processes by name, command line, owner and cgroup.
+package procfs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Root is the procfs mount point. Agents running in a container with the
+// host's /proc mounted elsewhere (e.g. /host/proc) override it.
+var Root = "/proc"
+
+// Process is the metadata known about a running process.
+type Process struct {
+	PID       uint32
+	PPID      uint32
+	Comm      string
+	Exe       string
+	Cmdline   []string
+	UID       uint32
+	StartTime uint64 // clock ticks since boot, field 22 of /proc/<pid>/stat
+	Cgroup    string // cgroup v2 path, or the first v1 hierarchy's path
+	// NSPIDs are the PIDs of the process in the nested PID namespaces it
+	// is in, from Root's down to its own
+	NSPIDs []uint32
+	// PIDNamespace is the inode of the process's own PID namespace
+	PIDNamespace uint64
+}
+
+// Path joins elements under the procfs root.
+func Path(elem ...string) string {
+	return filepath.Join(append([]string{Root}, elem...)...)
+}
+
+// ReadProcess collects metadata for pid. Fields that cannot be read
+// (permissions, kernel threads without an exe) are left empty; only a
+// missing or unparsable stat file is an error.
+func ReadProcess(pid uint32) (*Process, error) {
+	dir := strconv.FormatUint(uint64(pid), 10)
+
+	stat, err := os.ReadFile(Path(dir, "stat"))
+	if err != nil {
+		return nil, err
+	}
+	p, err := parseStat(stat)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", Path(dir, "stat"), err)
+	}
+
+	if exe, err := os.Readlink(Path(dir, "exe")); err == nil {
+		p.Exe = exe
+	}
+	if raw, err := os.ReadFile(Path(dir, "cmdline")); err == nil {
+		p.Cmdline = splitCmdline(raw)
+	}
+	if raw, err := os.ReadFile(Path(dir, "status")); err == nil {
+		p.UID = parseStatusUID(raw)
+		p.NSPIDs = parseStatusNSpid(raw)
+	}
+	if ns, err := pidNamespace(dir); err == nil {
+		p.PIDNamespace = ns
+	}
+	if raw, err := os.ReadFile(Path(dir, "cgroup")); err == nil {
+		p.Cgroup = parseCgroup(raw)
+	}
+	return p, nil
+}
+
+// ListPIDs returns the PIDs of all processes currently visible in procfs.
+func ListPIDs() ([]uint32, error) {
+	entries, err := os.ReadDir(Root)
+	if err != nil {
+		return nil, err
+	}
+	pids := make([]uint32, 0, len(entries))
+	for _, e := range entries {
+		pid, err := strconv.ParseUint(e.Name(), 10, 32)
+		if err != nil || !e.IsDir() {
+			continue
+		}
+		pids = append(pids, uint32(pid))
+	}
+	return pids, nil
+}
+
+// Scan reads metadata for every running process, skipping processes that
+// exit while the scan is in progress.
+func Scan() ([]*Process, error) {
+	pids, err := ListPIDs()
+	if err != nil {
+		return nil, err
+	}
+	procs := make([]*Process, 0, len(pids))
+	for _, pid := range pids {
+		p, err := ReadProcess(pid)
+		if err != nil {
+			continue
+		}
+		procs = append(procs, p)
+	}
+	return procs, nil
+}
+
+// parseStat parses /proc/<pid>/stat. The comm field may contain spaces
+// and parentheses, so it is delimited by the first '(' and last ')'.
+func parseStat(raw []byte) (*Process, error) {
+	open := bytes.IndexByte(raw, '(')
+	end := bytes.LastIndexByte(raw, ')')
+	if open < 0 || end < open {
+		return nil, fmt.Errorf("malformed stat line")
+	}
+
+	pid, err := strconv.ParseUint(strings.TrimSpace(string(raw[:open])), 10, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fields after the comm start at field 3 (state)
+	fields := strings.Fields(string(raw[end+1:]))
+	if len(fields) < 20 {
+		return nil, fmt.Errorf("stat has %d fields after comm", len(fields))
+	}
+	ppid, _ := strconv.ParseUint(fields[1], 10, 32)
+	start, _ := strconv.ParseUint(fields[19], 10, 64)
+
+	return &Process{
+		PID:       uint32(pid),
+		PPID:      uint32(ppid),
+		Comm:      string(raw[open+1 : end]),
+		StartTime: start,
+	}, nil
+}
+
+func splitCmdline(raw []byte) []string {
+	raw = bytes.TrimRight(raw, "\x00")
+	if len(raw) == 0 {
+		return nil
+	}
+	parts := bytes.Split(raw, []byte{0})
+	args := make([]string, len(parts))
+	for i, p := range parts {
+		args[i] = string(p)
+	}
+	return args
+}
+
+func parseStatusUID(raw []byte) uint32 {
+	for _, line := range strings.Split(string(raw), "\n") {
+		if !strings.HasPrefix(line, "Uid:") {
+			continue
+		}
+		fields := strings.Fields(line[len("Uid:"):])
+		if len(fields) == 0 {
+			return 0
+		}
+		uid, _ := strconv.ParseUint(fields[0], 10, 32)
+		return uint32(uid)
+	}
+	return 0
+}
+
+// parseCgroup prefers the unified (v2) hierarchy entry "0::/path".
+func parseCgroup(raw []byte) string {
+	var first string
+	for _, line := range strings.Split(strings.TrimSpace(string(raw)), "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if parts[0] == "0" && parts[1] == "" {
+			return parts[2]
+		}
+		if first == "" {
+			first = parts[2]
+		}
+	}
+	return first
+}
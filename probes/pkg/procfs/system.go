@@ -0,0 +1,185 @@
+package procfs
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Meminfo is the system's memory, from /proc/meminfo, in bytes.
+type Meminfo struct {
+	Total     uint64
+	Free      uint64
+	Available uint64
+	Buffers   uint64
+	Cached    uint64
+	Slab      uint64
+	SwapTotal uint64
+	SwapFree  uint64
+}
+
+// ReadMeminfo reads /proc/meminfo.
+func ReadMeminfo() (Meminfo, error) {
+	raw, err := os.ReadFile(Path("meminfo"))
+	if err != nil {
+		return Meminfo{}, err
+	}
+	var m Meminfo
+	parseKB(raw, map[string]*uint64{
+		"MemTotal:":     &m.Total,
+		"MemFree:":      &m.Free,
+		"MemAvailable:": &m.Available,
+		"Buffers:":      &m.Buffers,
+		"Cached:":       &m.Cached,
+		"Slab:":         &m.Slab,
+		"SwapTotal:":    &m.SwapTotal,
+		"SwapFree:":     &m.SwapFree,
+	})
+	return m, nil
+}
+
+// OnlineCPUs counts the CPUs online, the cpu<N> lines of /proc/stat.
+func OnlineCPUs() (int, error) {
+	raw, err := os.ReadFile(Path("stat"))
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, line := range strings.Split(string(raw), "\n") {
+		if len(line) > 3 && strings.HasPrefix(line, "cpu") && line[3] >= '0' && line[3] <= '9' {
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("no CPUs in %s", Path("stat"))
+	}
+	return n, nil
+}
+
+// ReadPressure returns the pressure stall lines of resource, "cpu",
+// "memory" or "io", from /proc/pressure, e.g. "some avg10=1.52 avg60=0.87
+// avg300=0.23 total=5829381". Kernels before 4.20, or without
+// CONFIG_PSI, have none.
+func ReadPressure(resource string) ([]string, error) {
+	raw, err := os.ReadFile(Path("pressure", resource))
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimSpace(string(raw)), "\n"), nil
+}
+
+// Pressure is the pressure stall information of a resource: how long
+// some task was stalled on it, and how long every non-idle task was at
+// once (full, not reported for cpu before 5.13).
+type Pressure struct {
+	Some PressureStall
+	Full PressureStall
+}
+
+// PressureStall is one line of a pressure file: the percentage of time
+// stalled over the last 10, 60 and 300 seconds, and the total time
+// stalled since boot.
+type PressureStall struct {
+	Avg10  float64
+	Avg60  float64
+	Avg300 float64
+	Total  time.Duration
+}
+
+// ReadPressureStall reads and parses the pressure stall lines of
+// resource; see ReadPressure.
+func ReadPressureStall(resource string) (Pressure, error) {
+	var p Pressure
+	lines, err := ReadPressure(resource)
+	if err != nil {
+		return p, err
+	}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		var s *PressureStall
+		switch fields[0] {
+		case "some":
+			s = &p.Some
+		case "full":
+			s = &p.Full
+		default:
+			continue
+		}
+		for _, f := range fields[1:] {
+			key, value, _ := strings.Cut(f, "=")
+			if key == "total" {
+				us, err := strconv.ParseUint(value, 10, 64)
+				if err != nil {
+					return p, fmt.Errorf("invalid %s pressure line %q", resource, line)
+				}
+				s.Total = time.Duration(us) * time.Microsecond
+				continue
+			}
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return p, fmt.Errorf("invalid %s pressure line %q", resource, line)
+			}
+			switch key {
+			case "avg10":
+				s.Avg10 = v
+			case "avg60":
+				s.Avg60 = v
+			case "avg300":
+				s.Avg300 = v
+			}
+		}
+	}
+	return p, nil
+}
+
+// SlabCache is one slab cache of /proc/slabinfo.
+type SlabCache struct {
+	Name          string
+	ActiveObjects uint64
+	Objects       uint64
+	ObjectSize    uint64
+}
+
+// ActiveBytes is the memory of the cache's objects in use.
+func (c SlabCache) ActiveBytes() uint64 {
+	return c.ActiveObjects * c.ObjectSize
+}
+
+// ReadSlabinfo reads the slab caches of /proc/slabinfo, which only root
+// may read.
+func ReadSlabinfo() ([]SlabCache, error) {
+	raw, err := os.ReadFile(Path("slabinfo"))
+	if err != nil {
+		return nil, err
+	}
+	return parseSlabinfo(string(raw))
+}
+
+// parseSlabinfo parses slabinfo version 2.x: after the version and
+// header lines, "<name> <active_objs> <num_objs> <objsize> ..." per cache.
+func parseSlabinfo(raw string) ([]SlabCache, error) {
+	lines := strings.Split(strings.TrimSpace(raw), "\n")
+	if len(lines) == 0 || !strings.HasPrefix(lines[0], "slabinfo - version: 2.") {
+		return nil, fmt.Errorf("unsupported slabinfo version %q", lines[0])
+	}
+	var caches []SlabCache
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		active, err1 := strconv.ParseUint(fields[1], 10, 64)
+		total, err2 := strconv.ParseUint(fields[2], 10, 64)
+		size, err3 := strconv.ParseUint(fields[3], 10, 64)
+		if err1 != nil || err2 != nil || err3 != nil {
+			continue
+		}
+		caches = append(caches, SlabCache{Name: fields[0], ActiveObjects: active, Objects: total, ObjectSize: size})
+	}
+	return caches, nil
+}
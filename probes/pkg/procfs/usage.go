@@ -0,0 +1,121 @@
+package procfs
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Usage is the memory the kernel accounts to a process, in bytes.
+type Usage struct {
+	// RSS is the resident set, VmRSS of /proc/<pid>/status
+	RSS uint64
+	// PSS is the resident set with shared pages divided among the
+	// processes sharing them, Pss of /proc/<pid>/smaps_rollup; 0 where
+	// smaps_rollup is missing (kernels before 4.14) or unreadable
+	PSS uint64
+	// Swap is swapped out anonymous memory, VmSwap
+	Swap uint64
+	// VSZ is the virtual address space, VmSize
+	VSZ uint64
+}
+
+// ReadUsage reads the memory usage of pid. Kernel threads have none and
+// report zeros.
+func ReadUsage(pid uint32) (Usage, error) {
+	dir := strconv.FormatUint(uint64(pid), 10)
+	raw, err := os.ReadFile(Path(dir, "status"))
+	if err != nil {
+		return Usage{}, err
+	}
+	var u Usage
+	fields := map[string]*uint64{"VmRSS:": &u.RSS, "VmSwap:": &u.Swap, "VmSize:": &u.VSZ}
+	parseKB(raw, fields)
+	if raw, err := os.ReadFile(Path(dir, "smaps_rollup")); err == nil {
+		parseKB(raw, map[string]*uint64{"Pss:": &u.PSS})
+	}
+	return u, nil
+}
+
+// parseKB sets the fields named by the "Name: <n> kB" lines of raw to
+// their values in bytes.
+func parseKB(raw []byte, fields map[string]*uint64) {
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		f := strings.Fields(scanner.Text())
+		if len(f) != 3 || f[2] != "kB" {
+			continue
+		}
+		if dst, ok := fields[f[0]]; ok {
+			if kb, err := strconv.ParseUint(f[1], 10, 64); err == nil {
+				*dst = kb << 10
+			}
+		}
+	}
+}
+
+// Heap is the memory backing the heap of a process, in bytes resident or
+// swapped, from /proc/<pid>/smaps.
+type Heap struct {
+	// Brk is that of the [heap] mapping, which brk grows
+	Brk uint64
+	// Anon is that of the private, writable anonymous mappings, where
+	// allocators keep their arenas and large blocks, and threads their
+	// stacks
+	Anon uint64
+	// Mappings counts those anonymous mappings
+	Mappings int
+}
+
+// Footprint is all the memory backing the heap.
+func (h Heap) Footprint() uint64 {
+	return h.Brk + h.Anon
+}
+
+// ReadHeap reads the heap of pid. Walking smaps costs the kernel a page
+// table walk of every mapping, so it is read less often than ReadUsage.
+func ReadHeap(pid uint32) (Heap, error) {
+	raw, err := os.ReadFile(Path(strconv.FormatUint(uint64(pid), 10), "smaps"))
+	if err != nil {
+		return Heap{}, err
+	}
+	return parseSmaps(raw), nil
+}
+
+// parseSmaps sums the Rss and Swap of the heap mappings of smaps.
+func parseSmaps(raw []byte) Heap {
+	var h Heap
+	// dst is what the mapping whose fields are being read adds to
+	var dst *uint64
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		f := strings.Fields(scanner.Text())
+		if len(f) == 0 {
+			continue
+		}
+		if !strings.HasSuffix(f[0], ":") {
+			// A mapping: address range, perms, offset, dev, inode, path
+			dst = nil
+			if len(f) < 5 {
+				continue
+			}
+			switch {
+			case len(f) > 5 && f[5] == "[heap]":
+				dst = &h.Brk
+			case len(f) == 5 && f[4] == "0" && strings.HasPrefix(f[1], "rw") && strings.HasSuffix(f[1], "p"):
+				dst = &h.Anon
+				h.Mappings++
+			}
+			continue
+		}
+		if dst == nil || len(f) != 3 || f[2] != "kB" || (f[0] != "Rss:" && f[0] != "Swap:") {
+			continue
+		}
+		if kb, err := strconv.ParseUint(f[1], 10, 64); err == nil {
+			*dst += kb << 10
+		}
+	}
+	return h
+}
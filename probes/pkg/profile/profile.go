@@ -0,0 +1,200 @@
+// Package profile defines the built-in configuration presets shared by all
+// probes. A preset picks the optional hook sets, sampling rate, report
+// interval and history retention, so `-profile deep` gives a sensible
+// trade-off without setting every option. Explicit flags still win.
+package profile
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"probepilot/pkg/attach"
+)
+
+// Optional hook sets. Core hooks (tracepoints a probe cannot work without)
+// are always attached.
+const (
+	// HookUprobes traces the allocator functions of libc and libstdc++
+	// for every process.
+	HookUprobes = "uprobes"
+	// HookPageAlloc traces the kernel page allocator.
+	HookPageAlloc = "page-alloc"
+	// HookKmem traces the kernel's kmalloc and slab cache allocations.
+	HookKmem = "kmem"
+	// HookPageFaults traces user page faults.
+	HookPageFaults = "page-faults"
+	// HookSwap traces swap-ins, swap-outs and direct reclaim.
+	HookSwap = "swap"
+	// HookIRQ traces hard and soft interrupt entry.
+	HookIRQ = "irq"
+	// HookTCPData traces tcp_sendmsg/tcp_cleanup_rbuf for byte accounting.
+	HookTCPData = "tcp-data"
+	// HookDeepCapture lets alerts escalate to temporary deep captures.
+	HookDeepCapture = "deep-capture"
+)
+
+// Profile is a named preset.
+type Profile struct {
+	Name        string
+	Description string
+
+	// Hooks enables optional hook sets by name.
+	Hooks map[string]bool
+	// AttachMode selects fentry or kprobes for hot kernel functions.
+	AttachMode attach.Mode
+	// SamplingRate is passed to probes that sample events.
+	SamplingRate uint32
+	// ReportInterval is how often probes print and export statistics.
+	ReportInterval time.Duration
+	// Retention is the local history resolution spec (see tsdb).
+	Retention string
+	// GrowthAlert is the per-report memory growth that fires an alert.
+	GrowthAlert uint64
+	// CaptureDuration bounds escalated deep captures.
+	CaptureDuration time.Duration
+}
+
+// Enabled reports whether the optional hook set is enabled.
+func (p Profile) Enabled(hook string) bool {
+	return p.Hooks[hook]
+}
+
+// String lists the profile name and its enabled hook sets.
+func (p Profile) String() string {
+	hooks := make([]string, 0, len(p.Hooks))
+	for h, on := range p.Hooks {
+		if on {
+			hooks = append(hooks, h)
+		}
+	}
+	sort.Strings(hooks)
+	if len(hooks) == 0 {
+		return p.Name + " (core hooks only)"
+	}
+	return fmt.Sprintf("%s (hooks: %s)", p.Name, strings.Join(hooks, ", "))
+}
+
+// Default is the profile used when none is selected.
+const Default = "balanced"
+
+var builtin = map[string]Profile{
+	"low-overhead": {
+		Name:            "low-overhead",
+		Description:     "core tracepoints only, coarse reports; safe to leave on everywhere",
+		Hooks:           map[string]bool{},
+		AttachMode:      attach.ModeAuto,
+		SamplingRate:    10000,
+		ReportInterval:  60 * time.Second,
+		Retention:       "10s:1h,5m:24h,1h:720h",
+		GrowthAlert:     0,
+		CaptureDuration: 0,
+	},
+	"balanced": {
+		Name:        "balanced",
+		Description: "all hooks at default rates, escalating to deep captures on alerts",
+		Hooks: map[string]bool{
+			HookUprobes:     true,
+			HookPageAlloc:   true,
+			HookPageFaults:  true,
+			HookSwap:        true,
+			HookIRQ:         true,
+			HookTCPData:     true,
+			HookDeepCapture: true,
+		},
+		AttachMode:      attach.ModeAuto,
+		SamplingRate:    1000,
+		ReportInterval:  15 * time.Second,
+		Retention:       "1s:1h,1m:24h,1h:720h",
+		GrowthAlert:     256 << 20,
+		CaptureDuration: 2 * time.Minute,
+	},
+	"deep": {
+		Name:        "deep",
+		Description: "every hook, no sampling, frequent reports and long deep captures",
+		Hooks: map[string]bool{
+			HookUprobes:     true,
+			HookPageAlloc:   true,
+			HookKmem:        true,
+			HookPageFaults:  true,
+			HookSwap:        true,
+			HookIRQ:         true,
+			HookTCPData:     true,
+			HookDeepCapture: true,
+		},
+		AttachMode:      attach.ModeAuto,
+		SamplingRate:    1,
+		ReportInterval:  5 * time.Second,
+		Retention:       "1s:6h,1m:72h,1h:720h",
+		GrowthAlert:     64 << 20,
+		CaptureDuration: 5 * time.Minute,
+	},
+}
+
+// aliases maps alternative spellings onto built-in names.
+var aliases = map[string]string{
+	"low":             "low-overhead",
+	"deep-inspection": "deep",
+}
+
+// Names returns the built-in profile names, sorted.
+func Names() []string {
+	names := make([]string, 0, len(builtin))
+	for name := range builtin {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Lookup returns the named built-in profile.
+func Lookup(name string) (Profile, error) {
+	if alias, ok := aliases[name]; ok {
+		name = alias
+	}
+	p, ok := builtin[name]
+	if !ok {
+		return Profile{}, fmt.Errorf("unknown profile %q (want one of %s)", name, strings.Join(Names(), ", "))
+	}
+	return p, nil
+}
+
+// Selected scans command-line arguments for -profile/--profile ahead of
+// flag parsing, so the selected profile can supply flag defaults and any
+// explicitly set flag overrides it.
+func Selected(args []string) (Profile, error) {
+	name := Default
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			break
+		}
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		key, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if key != "profile" {
+			continue
+		}
+		if !hasValue {
+			if i+1 >= len(args) {
+				return Profile{}, fmt.Errorf("flag needs an argument: -profile")
+			}
+			i++
+			value = args[i]
+		}
+		name = value
+	}
+	return Lookup(name)
+}
+
+// Usage describes the built-in profiles for flag help text.
+func Usage() string {
+	var b strings.Builder
+	b.WriteString("configuration preset:")
+	for _, name := range Names() {
+		fmt.Fprintf(&b, "\n  %s: %s", name, builtin[name].Description)
+	}
+	return b.String()
+}
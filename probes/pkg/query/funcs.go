@@ -0,0 +1,143 @@
+package query
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// function describes a callable: topk-style selectors take a scalar then
+// a vector, aggregations take a single vector and support "by".
+type function struct {
+	topK      bool
+	aggregate func(values []float64) float64
+}
+
+var functions = map[string]function{
+	"top":    {topK: true},
+	"bottom": {topK: true},
+	"sum":    {aggregate: sumOf},
+	"avg":    {aggregate: func(v []float64) float64 { return sumOf(v) / float64(len(v)) }},
+	"min":    {aggregate: minOf},
+	"max":    {aggregate: maxOf},
+	"count":  {aggregate: func(v []float64) float64 { return float64(len(v)) }},
+}
+
+func checkCall(c *Call) error {
+	fn := functions[c.Func]
+	if fn.topK {
+		if len(c.Args) != 2 {
+			return fmt.Errorf("%s expects 2 arguments (k, vector), got %d", c.Func, len(c.Args))
+		}
+		if len(c.By) > 0 {
+			return fmt.Errorf("%s does not support by", c.Func)
+		}
+		return nil
+	}
+	if len(c.Args) != 1 {
+		return fmt.Errorf("%s expects 1 argument, got %d", c.Func, len(c.Args))
+	}
+	return nil
+}
+
+func evalCall(samples []Sample, c *Call) (Result, error) {
+	fn := functions[c.Func]
+	if fn.topK {
+		return evalTopK(samples, c)
+	}
+
+	arg, err := EvalExpr(samples, c.Args[0])
+	if err != nil {
+		return Result{}, err
+	}
+	if arg.IsScalar() {
+		return Result{}, fmt.Errorf("%s expects a vector argument", c.Func)
+	}
+
+	// Group by the requested labels; without "by" everything is one group
+	type group struct {
+		labels Labels
+		values []float64
+	}
+	groups := make(map[string]*group)
+	var order []string
+	for _, s := range arg.Vector {
+		labels := Labels{}
+		for _, name := range c.By {
+			if v, ok := s.Labels[name]; ok {
+				labels[name] = v
+			}
+		}
+		key := labels.String()
+		g, ok := groups[key]
+		if !ok {
+			g = &group{labels: labels}
+			groups[key] = g
+			order = append(order, key)
+		}
+		g.values = append(g.values, s.Value)
+	}
+
+	out := make([]Sample, 0, len(order))
+	for _, key := range order {
+		g := groups[key]
+		out = append(out, Sample{Labels: g.labels, Value: fn.aggregate(g.values)})
+	}
+	return Result{Vector: out}, nil
+}
+
+func evalTopK(samples []Sample, c *Call) (Result, error) {
+	k, err := EvalExpr(samples, c.Args[0])
+	if err != nil {
+		return Result{}, err
+	}
+	if !k.IsScalar() {
+		return Result{}, fmt.Errorf("%s expects a scalar k", c.Func)
+	}
+	arg, err := EvalExpr(samples, c.Args[1])
+	if err != nil {
+		return Result{}, err
+	}
+	if arg.IsScalar() {
+		return Result{}, fmt.Errorf("%s expects a vector argument", c.Func)
+	}
+
+	vec := append([]Sample(nil), arg.Vector...)
+	if c.Func == "top" {
+		sort.SliceStable(vec, func(i, j int) bool { return vec[i].Value > vec[j].Value })
+	} else {
+		sort.SliceStable(vec, func(i, j int) bool { return vec[i].Value < vec[j].Value })
+	}
+	n := int(*k.Scalar)
+	if n < 0 {
+		n = 0
+	}
+	if n < len(vec) {
+		vec = vec[:n]
+	}
+	return Result{Vector: vec}, nil
+}
+
+func sumOf(values []float64) float64 {
+	var total float64
+	for _, v := range values {
+		total += v
+	}
+	return total
+}
+
+func minOf(values []float64) float64 {
+	smallest := math.Inf(1)
+	for _, v := range values {
+		smallest = math.Min(smallest, v)
+	}
+	return smallest
+}
+
+func maxOf(values []float64) float64 {
+	largest := math.Inf(-1)
+	for _, v := range values {
+		largest = math.Max(largest, v)
+	}
+	return largest
+}
@@ -0,0 +1,129 @@
+package query
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// HistogramSample is one histogram as exported on /metrics. It carries
+// classic buckets, native (exponential) buckets or both.
+type HistogramSample struct {
+	Name   string
+	Labels Labels
+	Count  uint64
+	Sum    float64
+
+	// Bounds are the classic bucket upper bounds, ascending and without
+	// +Inf; Cumulative[i] counts observations <= Bounds[i].
+	Bounds     []float64
+	Cumulative []uint64
+	// BucketExemplars holds the latest exemplar of each classic bucket,
+	// with the +Inf bucket last; entries are nil for buckets without one.
+	BucketExemplars []*Exemplar
+
+	// Native marks the native bucket fields as set. Bucket i of Positive
+	// covers (base^(i-1), base^i] with base = 2^(2^-Schema); values up to
+	// ZeroThreshold are counted in ZeroCount.
+	Native        bool
+	Schema        int32
+	ZeroThreshold float64
+	ZeroCount     uint64
+	Positive      map[int]uint64
+
+	// Exemplars are the largest recent observations, exported with native
+	// buckets, which have no per-bucket exemplars.
+	Exemplars []Exemplar
+}
+
+// Exemplar links an observation to the event behind it, e.g. by trace,
+// flow or process labels.
+type Exemplar struct {
+	Labels    Labels
+	Value     float64
+	Timestamp time.Time
+}
+
+// MaxExemplarRunes is the most characters the label names and values of
+// an exemplar may hold together, per OpenMetrics.
+const MaxExemplarRunes = 128
+
+// HistogramSource is implemented by sources that also export histograms.
+type HistogramSource interface {
+	Histograms() []HistogramSample
+}
+
+// NativeBound returns the upper bound of native bucket i at schema.
+func NativeBound(schema int32, i int) float64 {
+	return math.Exp2(float64(i) * math.Exp2(-float64(schema)))
+}
+
+// ClassicBuckets returns h's classic buckets, deriving them from its
+// native buckets if it has none, for formats without native histograms.
+func (h HistogramSample) ClassicBuckets() (bounds []float64, cumulative []uint64) {
+	if h.Bounds != nil || !h.Native {
+		return h.Bounds, h.Cumulative
+	}
+	keys := make([]int, 0, len(h.Positive))
+	for k := range h.Positive {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	n := h.ZeroCount
+	if h.ZeroCount > 0 {
+		bounds = append(bounds, h.ZeroThreshold)
+		cumulative = append(cumulative, n)
+	}
+	for _, k := range keys {
+		n += h.Positive[k]
+		bounds = append(bounds, NativeBound(h.Schema, k))
+		cumulative = append(cumulative, n)
+	}
+	return bounds, cumulative
+}
+
+// ClassicExemplars returns one exemplar slot per bucket of bounds, plus
+// +Inf. Without recorded per-bucket exemplars, each bucket gets the
+// largest of h.Exemplars falling into it.
+func (h HistogramSample) ClassicExemplars(bounds []float64) []*Exemplar {
+	if len(h.BucketExemplars) == len(bounds)+1 && h.Bounds != nil {
+		return h.BucketExemplars
+	}
+	if len(h.Exemplars) == 0 {
+		return nil
+	}
+	slots := make([]*Exemplar, len(bounds)+1)
+	for i := range h.Exemplars {
+		e := &h.Exemplars[i]
+		j := sort.SearchFloat64s(bounds, e.Value)
+		if slots[j] == nil || e.Value > slots[j].Value {
+			slots[j] = e
+		}
+	}
+	return slots
+}
+
+// Samples flattens h into classic _bucket, _sum and _count samples, so
+// histograms can be queried like any other metric.
+func (h HistogramSample) Samples() []Sample {
+	bounds, cumulative := h.ClassicBuckets()
+	samples := make([]Sample, 0, len(bounds)+3)
+	for i, b := range bounds {
+		samples = append(samples, Sample{Name: h.Name + "_bucket", Labels: h.withLE(formatValue(b)), Value: float64(cumulative[i])})
+	}
+	samples = append(samples,
+		Sample{Name: h.Name + "_bucket", Labels: h.withLE("+Inf"), Value: float64(h.Count)},
+		Sample{Name: h.Name + "_sum", Labels: h.Labels, Value: h.Sum},
+		Sample{Name: h.Name + "_count", Labels: h.Labels, Value: float64(h.Count)},
+	)
+	return samples
+}
+
+func (h HistogramSample) withLE(le string) Labels {
+	labels := make(Labels, len(h.Labels)+1)
+	for k, v := range h.Labels {
+		labels[k] = v
+	}
+	labels["le"] = le
+	return labels
+}
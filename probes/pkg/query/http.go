@@ -0,0 +1,127 @@
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Mounter is implemented by sources that serve more than their samples,
+// e.g. profiles or the history, beside the query API.
+type Mounter interface {
+	Mount(mux *http.ServeMux)
+}
+
+// Handler serves GET /api/v1/query?expr=... against src. Responses follow
+// the shape of the Prometheus instant query API so existing tooling can
+// read them. GET /metrics exposes src for Prometheus to scrape. A src
+// that is a Mounter adds its own endpoints.
+func Handler(src Source) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", MetricsHandler(src))
+	if m, ok := src.(Mounter); ok {
+		m.Mount(mux)
+	}
+	mux.HandleFunc("/api/v1/query", func(w http.ResponseWriter, r *http.Request) {
+		expr := r.URL.Query().Get("expr")
+		if expr == "" {
+			expr = r.URL.Query().Get("query")
+		}
+		if expr == "" {
+			writeError(w, http.StatusBadRequest, "missing expr parameter")
+			return
+		}
+
+		res, err := Eval(src, expr)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, response{Status: "success", Data: encodeResult(res, time.Now())})
+	})
+	return mux
+}
+
+// ListenAndServe serves Handler(src) on addr until ctx is cancelled.
+func ListenAndServe(ctx context.Context, addr string, src Source) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return Serve(ctx, l, src)
+}
+
+// Serve serves Handler(src) on l until ctx is cancelled, so the API can
+// also be offered on a UNIX socket.
+func Serve(ctx context.Context, l net.Listener, src Source) error {
+	srv := &http.Server{
+		Handler:           Handler(src),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+type response struct {
+	Status string      `json:"status"`
+	Data   interface{} `json:"data,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+type vectorSample struct {
+	Metric map[string]string `json:"metric"`
+	Value  [2]interface{}    `json:"value"`
+}
+
+func encodeResult(res Result, now time.Time) interface{} {
+	ts := float64(now.UnixMilli()) / 1000
+	if res.IsScalar() {
+		return map[string]interface{}{
+			"resultType": "scalar",
+			"result":     [2]interface{}{ts, formatValue(*res.Scalar)},
+		}
+	}
+	samples := make([]vectorSample, 0, len(res.Vector))
+	for _, s := range res.Vector {
+		metric := make(map[string]string, len(s.Labels)+1)
+		for k, v := range s.Labels {
+			metric[k] = v
+		}
+		if s.Name != "" {
+			metric["__name__"] = s.Name
+		}
+		samples = append(samples, vectorSample{Metric: metric, Value: [2]interface{}{ts, formatValue(s.Value)}})
+	}
+	return map[string]interface{}{
+		"resultType": "vector",
+		"result":     samples,
+	}
+}
+
+// formatValue renders values as strings, like Prometheus, so NaN and Inf
+// survive JSON encoding.
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, response{Status: "error", Error: msg})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
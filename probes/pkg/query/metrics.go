@@ -0,0 +1,392 @@
+package query
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+
+	"probepilot/pkg/units"
+)
+
+// Content types of the exposition formats. Prometheus only scrapes native
+// histograms over protobuf; the text formats carry classic buckets, and
+// only OpenMetrics carries exemplars.
+const (
+	textContentType        = "text/plain; version=0.0.4; charset=utf-8"
+	openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+	protobufContentType    = "application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited"
+)
+
+// MetricsHandler serves src in the Prometheus exposition formats:
+// protobuf or OpenMetrics if the scraper accepts them, text otherwise.
+// Histograms of a HistogramSource are exported as histograms with their
+// exemplars, the remaining samples as untyped metrics.
+func MetricsHandler(src Source) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		samples, hists := Snapshot(src)
+		families := groupSamples(samples, hists)
+
+		bw := bufio.NewWriter(w)
+		switch negotiate(r.Header.Get("Accept")) {
+		case protobufContentType:
+			w.Header().Set("Content-Type", protobufContentType)
+			writeProtobuf(bw, families, hists)
+		case openMetricsContentType:
+			w.Header().Set("Content-Type", openMetricsContentType)
+			writeText(bw, families, hists, true)
+		default:
+			w.Header().Set("Content-Type", textContentType)
+			writeText(bw, families, hists, false)
+		}
+		bw.Flush()
+	})
+}
+
+// negotiate picks the richest format the Accept header allows, protobuf
+// before OpenMetrics before text, as Prometheus itself prefers.
+func negotiate(accept string) string {
+	format := textContentType
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch {
+		case mt == "application/vnd.google.protobuf" &&
+			params["proto"] == "io.prometheus.client.MetricFamily" && params["encoding"] == "delimited":
+			return protobufContentType
+		case mt == "application/openmetrics-text":
+			format = openMetricsContentType
+		}
+	}
+	return format
+}
+
+type family struct {
+	name    string
+	samples []Sample
+}
+
+// groupSamples groups samples into families by name, sorted, leaving out
+// the flattened series of hists.
+func groupSamples(samples []Sample, hists []HistogramSample) []family {
+	skip := make(map[string]bool, 3*len(hists))
+	for _, h := range hists {
+		skip[h.Name+"_bucket"], skip[h.Name+"_sum"], skip[h.Name+"_count"] = true, true, true
+	}
+	byName := make(map[string][]Sample)
+	for _, s := range samples {
+		if s.Name == "" || skip[s.Name] {
+			continue
+		}
+		byName[s.Name] = append(byName[s.Name], s)
+	}
+	families := make([]family, 0, len(byName))
+	for name, ss := range byName {
+		families = append(families, family{name: name, samples: ss})
+	}
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+	return families
+}
+
+// writeText writes the text format, or OpenMetrics with exemplars.
+func writeText(w io.Writer, families []family, hists []HistogramSample, openMetrics bool) {
+	untyped := "untyped"
+	if openMetrics {
+		untyped = "unknown"
+	}
+	for _, f := range families {
+		fmt.Fprintf(w, "# TYPE %s %s\n", f.name, untyped)
+		if openMetrics {
+			writeUnit(w, f.name)
+		}
+		for _, s := range f.samples {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, textLabels(s.Labels), textValue(s.Value))
+		}
+	}
+	typed := make(map[string]bool)
+	for _, h := range hists {
+		if !typed[h.Name] {
+			fmt.Fprintf(w, "# TYPE %s histogram\n", h.Name)
+			if openMetrics {
+				writeUnit(w, h.Name)
+			}
+			typed[h.Name] = true
+		}
+		var exemplars []*Exemplar
+		if openMetrics {
+			bounds, _ := h.ClassicBuckets()
+			exemplars = h.ClassicExemplars(bounds)
+		}
+		// Samples lists the buckets first, in the order of exemplars
+		for i, s := range h.Samples() {
+			fmt.Fprintf(w, "%s%s %s", s.Name, textLabels(s.Labels), textValue(s.Value))
+			if i < len(exemplars) && exemplars[i] != nil {
+				e := exemplars[i]
+				fmt.Fprintf(w, " # %s %s %.3f", textLabels(e.Labels), textValue(e.Value),
+					float64(e.Timestamp.UnixMilli())/1000)
+			}
+			fmt.Fprintln(w)
+		}
+	}
+	if openMetrics {
+		fmt.Fprintln(w, "# EOF")
+	}
+}
+
+// writeUnit writes the UNIT of a family whose name ends in its unit, as
+// OpenMetrics requires; counters ending in _total have none.
+func writeUnit(w io.Writer, name string) {
+	if unit := units.OfMetric(name); unit != "" && strings.HasSuffix(name, "_"+unit) {
+		fmt.Fprintf(w, "# UNIT %s %s\n", name, unit)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func textLabels(l Labels) string {
+	if len(l) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(l))
+	for k := range l {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, k, labelEscaper.Replace(l[k]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func textValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return formatValue(v)
+}
+
+// Field numbers and metric types of io.prometheus.client.MetricFamily
+// (prometheus/client_model metrics.proto).
+const (
+	typeUntyped   = 3
+	typeHistogram = 4
+
+	familyName, familyType, familyMetric = 1, 3, 4
+	metricLabel, metricUntyped           = 1, 5
+	metricHistogram                      = 7
+	labelName, labelValue                = 1, 2
+	untypedValue                         = 1
+
+	histCount, histSum, histBucket = 1, 2, 3
+	histSchema, histZeroThreshold  = 5, 6
+	histZeroCount                  = 7
+	histPositiveSpan               = 12
+	histPositiveDelta              = 13
+	histExemplars                  = 16
+	bucketCount, bucketUpperBound  = 1, 2
+	bucketExemplar                 = 3
+	spanOffset, spanLength         = 1, 2
+
+	// Exemplar labels are field 1, like metric labels
+	exemplarValue, exemplarTimestamp = 2, 3
+	timestampSeconds, timestampNanos = 1, 2
+)
+
+func writeProtobuf(w io.Writer, families []family, hists []HistogramSample) {
+	var lenBuf [binary.MaxVarintLen64]byte
+	writeFamily := func(f *pbuf) {
+		n := binary.PutUvarint(lenBuf[:], uint64(len(f.b)))
+		w.Write(lenBuf[:n])
+		w.Write(f.b)
+	}
+	for _, f := range families {
+		var pf pbuf
+		pf.string(familyName, f.name)
+		pf.varint(familyType, typeUntyped)
+		for _, s := range f.samples {
+			var m pbuf
+			m.labels(s.Labels)
+			var u pbuf
+			u.double(untypedValue, s.Value)
+			m.message(metricUntyped, &u)
+			pf.message(familyMetric, &m)
+		}
+		writeFamily(&pf)
+	}
+
+	byName := make(map[string][]HistogramSample)
+	var names []string
+	for _, h := range hists {
+		if _, ok := byName[h.Name]; !ok {
+			names = append(names, h.Name)
+		}
+		byName[h.Name] = append(byName[h.Name], h)
+	}
+	for _, name := range names {
+		var pf pbuf
+		pf.string(familyName, name)
+		pf.varint(familyType, typeHistogram)
+		for _, h := range byName[name] {
+			var m pbuf
+			m.labels(h.Labels)
+			m.message(metricHistogram, encodeHistogram(h))
+			pf.message(familyMetric, &m)
+		}
+		writeFamily(&pf)
+	}
+}
+
+func encodeHistogram(h HistogramSample) *pbuf {
+	var p pbuf
+	p.varint(histCount, h.Count)
+	p.double(histSum, h.Sum)
+	for i, bound := range h.Bounds {
+		var b pbuf
+		b.varint(bucketCount, h.Cumulative[i])
+		b.double(bucketUpperBound, bound)
+		if i < len(h.BucketExemplars) && h.BucketExemplars[i] != nil {
+			b.message(bucketExemplar, encodeExemplar(*h.BucketExemplars[i]))
+		}
+		p.message(histBucket, &b)
+	}
+	// The +Inf bucket is implied unless it has an exemplar to carry
+	if n := len(h.Bounds); h.Bounds != nil && n < len(h.BucketExemplars) && h.BucketExemplars[n] != nil {
+		var b pbuf
+		b.varint(bucketCount, h.Count)
+		b.double(bucketUpperBound, math.Inf(1))
+		b.message(bucketExemplar, encodeExemplar(*h.BucketExemplars[n]))
+		p.message(histBucket, &b)
+	}
+	if !h.Native {
+		return &p
+	}
+	for _, e := range h.Exemplars {
+		p.message(histExemplars, encodeExemplar(e))
+	}
+	p.varint(histSchema, zigzag(int64(h.Schema)))
+	p.double(histZeroThreshold, h.ZeroThreshold)
+	p.varint(histZeroCount, h.ZeroCount)
+
+	keys := make([]int, 0, len(h.Positive))
+	for k := range h.Positive {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	if len(keys) == 0 {
+		// An empty span marks the histogram native even before its first
+		// observation
+		var s pbuf
+		s.varint(spanOffset, 0)
+		s.varint(spanLength, 0)
+		p.message(histPositiveSpan, &s)
+		return &p
+	}
+
+	// Consecutive buckets share a span; counts are delta-encoded across
+	// spans
+	var deltas pbuf
+	var prev int64
+	start, length := keys[0], 0
+	last := keys[0] - 1
+	flush := func(offset int) {
+		var s pbuf
+		s.varint(spanOffset, zigzag(int64(offset)))
+		s.varint(spanLength, uint64(length))
+		p.message(histPositiveSpan, &s)
+	}
+	offset := start
+	for _, k := range keys {
+		if k != last+1 {
+			flush(offset)
+			offset, length = k-last-1, 0
+		}
+		n := int64(h.Positive[k])
+		deltas.b = binary.AppendUvarint(deltas.b, zigzag(n-prev))
+		prev = n
+		length++
+		last = k
+	}
+	flush(offset)
+	p.bytes(histPositiveDelta, deltas.b)
+	return &p
+}
+
+func encodeExemplar(e Exemplar) *pbuf {
+	var p pbuf
+	p.labels(e.Labels)
+	p.double(exemplarValue, e.Value)
+	var ts pbuf
+	ts.varint(timestampSeconds, uint64(e.Timestamp.Unix()))
+	ts.varint(timestampNanos, uint64(e.Timestamp.Nanosecond()))
+	p.message(exemplarTimestamp, &ts)
+	return &p
+}
+
+func zigzag(v int64) uint64 {
+	return uint64(v<<1) ^ uint64(v>>63)
+}
+
+// pbuf appends protobuf fields; it covers just what the exposition needs.
+type pbuf struct {
+	b []byte
+}
+
+func (p *pbuf) tag(field, wireType int) {
+	p.b = binary.AppendUvarint(p.b, uint64(field<<3|wireType))
+}
+
+func (p *pbuf) varint(field int, v uint64) {
+	p.tag(field, 0)
+	p.b = binary.AppendUvarint(p.b, v)
+}
+
+func (p *pbuf) double(field int, v float64) {
+	p.tag(field, 1)
+	p.b = binary.LittleEndian.AppendUint64(p.b, math.Float64bits(v))
+}
+
+func (p *pbuf) bytes(field int, b []byte) {
+	p.tag(field, 2)
+	p.b = binary.AppendUvarint(p.b, uint64(len(b)))
+	p.b = append(p.b, b...)
+}
+
+func (p *pbuf) string(field int, s string) {
+	p.bytes(field, []byte(s))
+}
+
+func (p *pbuf) message(field int, m *pbuf) {
+	p.bytes(field, m.b)
+}
+
+func (p *pbuf) labels(l Labels) {
+	keys := make([]string, 0, len(l))
+	for k := range l {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var lp pbuf
+		lp.string(labelName, k)
+		lp.string(labelValue, l[k])
+		p.message(metricLabel, &lp)
+	}
+}
@@ -0,0 +1,474 @@
+package query
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Expr is a parsed query expression.
+type Expr interface {
+	String() string
+}
+
+// MatchOp is a label matcher operator.
+type MatchOp string
+
+const (
+	MatchEqual     MatchOp = "="
+	MatchNotEqual  MatchOp = "!="
+	MatchRegexp    MatchOp = "=~"
+	MatchNotRegexp MatchOp = "!~"
+)
+
+// Matcher selects series by a label value.
+type Matcher struct {
+	Label string
+	Op    MatchOp
+	Value string
+
+	re *regexp.Regexp
+}
+
+// Matches reports whether v satisfies the matcher. Regular expressions are
+// anchored, as in PromQL.
+func (m Matcher) Matches(v string) bool {
+	switch m.Op {
+	case MatchEqual:
+		return v == m.Value
+	case MatchNotEqual:
+		return v != m.Value
+	case MatchRegexp:
+		return m.re.MatchString(v)
+	case MatchNotRegexp:
+		return !m.re.MatchString(v)
+	}
+	return false
+}
+
+func (m Matcher) String() string {
+	return fmt.Sprintf("%s%s%q", m.Label, m.Op, m.Value)
+}
+
+// Selector picks samples by metric name and label matchers.
+type Selector struct {
+	Name     string
+	Matchers []Matcher
+}
+
+func (s *Selector) String() string {
+	if len(s.Matchers) == 0 {
+		return s.Name
+	}
+	parts := make([]string, len(s.Matchers))
+	for i, m := range s.Matchers {
+		parts[i] = m.String()
+	}
+	return s.Name + "{" + strings.Join(parts, ",") + "}"
+}
+
+// Number is a scalar literal.
+type Number struct {
+	Value float64
+}
+
+func (n *Number) String() string {
+	return strconv.FormatFloat(n.Value, 'g', -1, 64)
+}
+
+// Call is a function or aggregation such as top(10, x) or sum by (comm) (x).
+type Call struct {
+	Func string
+	By   []string
+	Args []Expr
+}
+
+func (c *Call) String() string {
+	args := make([]string, len(c.Args))
+	for i, a := range c.Args {
+		args[i] = a.String()
+	}
+	by := ""
+	if len(c.By) > 0 {
+		by = " by (" + strings.Join(c.By, ", ") + ")"
+	}
+	return fmt.Sprintf("%s%s(%s)", c.Func, by, strings.Join(args, ", "))
+}
+
+// Binary is an arithmetic or comparison operation. Comparisons filter the
+// vector side instead of producing booleans.
+type Binary struct {
+	Op       string
+	LHS, RHS Expr
+}
+
+func (b *Binary) String() string {
+	return fmt.Sprintf("(%s %s %s)", b.LHS, b.Op, b.RHS)
+}
+
+// Parse parses a query expression.
+func Parse(input string) (Expr, error) {
+	p := &parser{lex: lexer{input: input}}
+	p.next()
+	expr, err := p.parseExpr(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %s", p.tok)
+	}
+	return expr, nil
+}
+
+// ParseMatchers parses a bare list of label matchers, with or without
+// braces, e.g. `comm=~"java.*", pid!="1"`.
+func ParseMatchers(input string) ([]Matcher, error) {
+	input = strings.TrimSpace(input)
+	if !strings.HasPrefix(input, "{") {
+		input = "{" + input + "}"
+	}
+	p := &parser{lex: lexer{input: input}}
+	p.next()
+	expr, err := p.parseSelector("")
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %s", p.tok)
+	}
+	return expr.(*Selector).Matchers, nil
+}
+
+// MatchLabels reports whether labels satisfy every matcher.
+func MatchLabels(matchers []Matcher, labels Labels) bool {
+	for _, m := range matchers {
+		if !m.Matches(labels[m.Label]) {
+			return false
+		}
+	}
+	return true
+}
+
+// precedence of binary operators; higher binds tighter
+var precedence = map[string]int{
+	"==": 1, "!=": 1, "<": 1, "<=": 1, ">": 1, ">=": 1,
+	"+": 2, "-": 2,
+	"*": 3, "/": 3, "%": 3,
+}
+
+type parser struct {
+	lex lexer
+	tok token
+}
+
+func (p *parser) next() {
+	p.tok = p.lex.next()
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("parse error at char %d: %s", p.tok.pos+1, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) expect(kind tokenKind, what string) (token, error) {
+	tok := p.tok
+	if tok.kind != kind {
+		return tok, p.errorf("expected %s, got %s", what, tok)
+	}
+	p.next()
+	return tok, nil
+}
+
+// parseExpr is a precedence-climbing parser for binary operators.
+func (p *parser) parseExpr(minPrec int) (Expr, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.tok.kind == tokOp {
+		prec, ok := precedence[p.tok.text]
+		if !ok || prec <= minPrec {
+			break
+		}
+		op := p.tok.text
+		p.next()
+		rhs, err := p.parseExpr(prec)
+		if err != nil {
+			return nil, err
+		}
+		lhs = &Binary{Op: op, LHS: lhs, RHS: rhs}
+	}
+	return lhs, nil
+}
+
+func (p *parser) parseUnary() (Expr, error) {
+	switch p.tok.kind {
+	case tokNumber:
+		v, err := strconv.ParseFloat(p.tok.text, 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %q", p.tok.text)
+		}
+		p.next()
+		return &Number{Value: v}, nil
+	case tokOp:
+		if p.tok.text == "-" {
+			p.next()
+			expr, err := p.parseUnary()
+			if err != nil {
+				return nil, err
+			}
+			return &Binary{Op: "*", LHS: &Number{Value: -1}, RHS: expr}, nil
+		}
+	case tokLParen:
+		p.next()
+		expr, err := p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokRParen, "')'"); err != nil {
+			return nil, err
+		}
+		return expr, nil
+	case tokIdent:
+		name := p.tok.text
+		p.next()
+		if p.tok.kind == tokLParen || (p.tok.kind == tokIdent && p.tok.text == "by") {
+			return p.parseCall(name)
+		}
+		return p.parseSelector(name)
+	}
+	return nil, p.errorf("unexpected %s", p.tok)
+}
+
+func (p *parser) parseCall(name string) (Expr, error) {
+	if _, ok := functions[name]; !ok {
+		return nil, p.errorf("unknown function %q", name)
+	}
+	call := &Call{Func: name}
+	if p.tok.kind == tokIdent && p.tok.text == "by" {
+		p.next()
+		labels, err := p.parseLabelList()
+		if err != nil {
+			return nil, err
+		}
+		call.By = labels
+	}
+	if _, err := p.expect(tokLParen, "'('"); err != nil {
+		return nil, err
+	}
+	for p.tok.kind != tokRParen {
+		arg, err := p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+		call.Args = append(call.Args, arg)
+		if p.tok.kind != tokComma {
+			break
+		}
+		p.next()
+	}
+	if _, err := p.expect(tokRParen, "')'"); err != nil {
+		return nil, err
+	}
+	if err := checkCall(call); err != nil {
+		return nil, p.errorf("%v", err)
+	}
+	return call, nil
+}
+
+func (p *parser) parseLabelList() ([]string, error) {
+	if _, err := p.expect(tokLParen, "'('"); err != nil {
+		return nil, err
+	}
+	var labels []string
+	for p.tok.kind != tokRParen {
+		tok, err := p.expect(tokIdent, "label name")
+		if err != nil {
+			return nil, err
+		}
+		labels = append(labels, tok.text)
+		if p.tok.kind != tokComma {
+			break
+		}
+		p.next()
+	}
+	if _, err := p.expect(tokRParen, "')'"); err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
+
+func (p *parser) parseSelector(name string) (Expr, error) {
+	sel := &Selector{Name: name}
+	if p.tok.kind != tokLBrace {
+		return sel, nil
+	}
+	p.next()
+	for p.tok.kind != tokRBrace {
+		label, err := p.expect(tokIdent, "label name")
+		if err != nil {
+			return nil, err
+		}
+		op, err := p.expect(tokOp, "label matcher")
+		if err != nil {
+			return nil, err
+		}
+		value, err := p.expect(tokString, "quoted label value")
+		if err != nil {
+			return nil, err
+		}
+
+		m := Matcher{Label: label.text, Op: MatchOp(op.text), Value: value.text}
+		switch m.Op {
+		case MatchEqual, MatchNotEqual:
+		case MatchRegexp, MatchNotRegexp:
+			re, err := regexp.Compile("^(?:" + m.Value + ")$")
+			if err != nil {
+				return nil, p.errorf("invalid regexp %q: %v", m.Value, err)
+			}
+			m.re = re
+		default:
+			return nil, p.errorf("invalid label matcher %q", op.text)
+		}
+		sel.Matchers = append(sel.Matchers, m)
+
+		if p.tok.kind != tokComma {
+			break
+		}
+		p.next()
+	}
+	if _, err := p.expect(tokRBrace, "'}'"); err != nil {
+		return nil, err
+	}
+	return sel, nil
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokOp
+	tokLParen
+	tokRParen
+	tokLBrace
+	tokRBrace
+	tokComma
+	tokError
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of input"
+	case tokString:
+		return strconv.Quote(t.text)
+	case tokError:
+		return t.text
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+type lexer struct {
+	input string
+	pos   int
+}
+
+func (l *lexer) next() token {
+	for l.pos < len(l.input) && unicode.IsSpace(rune(l.input[l.pos])) {
+		l.pos++
+	}
+	start := l.pos
+	if l.pos >= len(l.input) {
+		return token{kind: tokEOF, pos: start}
+	}
+
+	c := l.input[l.pos]
+	switch {
+	case c == '(':
+		l.pos++
+		return token{kind: tokLParen, text: "(", pos: start}
+	case c == ')':
+		l.pos++
+		return token{kind: tokRParen, text: ")", pos: start}
+	case c == '{':
+		l.pos++
+		return token{kind: tokLBrace, text: "{", pos: start}
+	case c == '}':
+		l.pos++
+		return token{kind: tokRBrace, text: "}", pos: start}
+	case c == ',':
+		l.pos++
+		return token{kind: tokComma, text: ",", pos: start}
+	case c == '"' || c == '\'':
+		return l.lexString(c)
+	case isDigit(c) || (c == '.' && l.pos+1 < len(l.input) && isDigit(l.input[l.pos+1])):
+		for l.pos < len(l.input) && (isDigit(l.input[l.pos]) || strings.IndexByte(".eE", l.input[l.pos]) >= 0 ||
+			((l.input[l.pos] == '+' || l.input[l.pos] == '-') && strings.IndexByte("eE", l.input[l.pos-1]) >= 0)) {
+			l.pos++
+		}
+		return token{kind: tokNumber, text: l.input[start:l.pos], pos: start}
+	case isIdentStart(c):
+		for l.pos < len(l.input) && (isIdentStart(l.input[l.pos]) || isDigit(l.input[l.pos])) {
+			l.pos++
+		}
+		return token{kind: tokIdent, text: l.input[start:l.pos], pos: start}
+	}
+
+	// Two-character operators first
+	for _, op := range []string{"=~", "!~", "!=", "==", "<=", ">="} {
+		if strings.HasPrefix(l.input[l.pos:], op) {
+			l.pos += len(op)
+			return token{kind: tokOp, text: op, pos: start}
+		}
+	}
+	if strings.IndexByte("=<>+-*/%", c) >= 0 {
+		l.pos++
+		return token{kind: tokOp, text: string(c), pos: start}
+	}
+	l.pos++
+	return token{kind: tokError, text: fmt.Sprintf("unexpected character %q", c), pos: start}
+}
+
+func (l *lexer) lexString(quote byte) token {
+	start := l.pos
+	l.pos++
+	for l.pos < len(l.input) {
+		switch l.input[l.pos] {
+		case '\\':
+			l.pos += 2
+			continue
+		case quote:
+			l.pos++
+			raw := l.input[start:l.pos]
+			if quote == '\'' {
+				raw = `"` + strings.ReplaceAll(raw[1:len(raw)-1], `"`, `\"`) + `"`
+			}
+			s, err := strconv.Unquote(raw)
+			if err != nil {
+				// Keep regexp escapes such as \d that Go strings reject
+				s = l.input[start+1 : l.pos-1]
+			}
+			return token{kind: tokString, text: s, pos: start}
+		}
+		l.pos++
+	}
+	return token{kind: tokError, text: "unterminated string", pos: start}
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
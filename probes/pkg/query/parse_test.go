@@ -0,0 +1,81 @@
+package query
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{`process_memory_current`, `process_memory_current`},
+		{`x{a="b",c!="d"}`, `x{a="b",c!="d"}`},
+		{`x{a='b'}`, `x{a="b"}`},
+		{`x{a="\"q\""}`, `x{a="\"q\""}`},
+		{`top(10, process_memory_current{comm=~"java.*"})`, `top(10, process_memory_current{comm=~"java.*"})`},
+		{`sum by (comm) (process_cpu_runtime_seconds_total)`, `sum by (comm)(process_cpu_runtime_seconds_total)`},
+		{`avg by (a, b) (x)`, `avg by (a, b)(x)`},
+		{`tcp_flow_bytes_tx > 1e6`, `(tcp_flow_bytes_tx > 1e+06)`},
+		{`a + 2 * 3`, `(a + (2 * 3))`},
+		{`(a + 2) * 3`, `((a + 2) * 3)`},
+	}
+	for _, tt := range tests {
+		e, err := Parse(tt.in)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.in, err)
+			continue
+		}
+		if got := e.String(); got != tt.want {
+			t.Errorf("Parse(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{``, "unexpected end of input"},
+		{`x{`, "expected label name"},
+		{`1 +`, "unexpected end of input"},
+		{`top(x)`, "top expects 2 arguments"},
+		{`sum(a, b)`, "sum expects 1 argument"},
+		{`foo(x)`, `unknown function "foo"`},
+		{`sum(x) by (a)`, `unexpected "by"`},
+		{`x{a=~"("}`, "invalid regexp"},
+		{`x{a="b`, "unterminated"},
+	}
+	for _, tt := range tests {
+		e, err := Parse(tt.in)
+		if err == nil {
+			t.Errorf("Parse(%q) = %s, want error", tt.in, e)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Parse(%q) error %q, want it to mention %q", tt.in, err, tt.want)
+		}
+	}
+}
+
+func TestMatchers(t *testing.T) {
+	matchers, err := ParseMatchers(`comm=~"java|python", pid!="1", state!~"Z.*"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		labels Labels
+		want   bool
+	}{
+		{Labels{"comm": "java", "pid": "42", "state": "R"}, true},
+		{Labels{"comm": "python", "pid": "42"}, true},
+		{Labels{"comm": "javac", "pid": "42"}, false}, // regexps are anchored
+		{Labels{"comm": "java", "pid": "1"}, false},
+		{Labels{"comm": "java", "pid": "42", "state": "Zombie"}, false},
+	}
+	for _, tt := range tests {
+		if got := MatchLabels(matchers, tt.labels); got != tt.want {
+			t.Errorf("MatchLabels(%s, %s) = %v, want %v", matchers, tt.labels, got, tt.want)
+		}
+	}
+}
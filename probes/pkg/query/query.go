@@ -0,0 +1,213 @@
+// Package query implements a small PromQL-like expression language over
+// the samples an agent holds locally, so users can slice live data
+// without exporting it to an external TSDB first:
+//
+//	top(10, process_memory_current{comm=~"java.*"})
+//	sum by (comm) (process_cpu_runtime_seconds_total)
+//	tcp_flow_bytes_tx > 1e6
+package query
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Labels identify a series within a metric.
+type Labels map[string]string
+
+// String renders labels in sorted order, e.g. {comm="java",pid="42"}.
+func (l Labels) String() string {
+	keys := make([]string, 0, len(l))
+	for k := range l {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%s=%q", k, l[k])
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// Sample is one labeled value of a metric.
+type Sample struct {
+	Name   string
+	Labels Labels
+	Value  float64
+}
+
+// Source provides the samples a query is evaluated against.
+type Source interface {
+	Samples() []Sample
+}
+
+// Snapshot returns the samples of src, and its histograms if it is a
+// HistogramSource. A src that is a sync.Locker, as the agents are, is
+// held locked meanwhile: its records are handled on another goroutine.
+func Snapshot(src Source) ([]Sample, []HistogramSample) {
+	if l, ok := src.(sync.Locker); ok {
+		l.Lock()
+		defer l.Unlock()
+	}
+	var hists []HistogramSample
+	if hs, ok := src.(HistogramSource); ok {
+		hists = hs.Histograms()
+	}
+	return src.Samples(), hists
+}
+
+// SamplesOf returns the samples of src, locked like Snapshot.
+func SamplesOf(src Source) []Sample {
+	if l, ok := src.(sync.Locker); ok {
+		l.Lock()
+		defer l.Unlock()
+	}
+	return src.Samples()
+}
+
+// SourceFunc adapts a function to Source.
+type SourceFunc func() []Sample
+
+// Samples calls f.
+func (f SourceFunc) Samples() []Sample {
+	return f()
+}
+
+// Result is the value of an expression: either a scalar or a vector.
+type Result struct {
+	Scalar *float64
+	Vector []Sample
+}
+
+// IsScalar reports whether the result is a scalar.
+func (r Result) IsScalar() bool {
+	return r.Scalar != nil
+}
+
+// Eval parses and evaluates expr against src.
+func Eval(src Source, expr string) (Result, error) {
+	e, err := Parse(expr)
+	if err != nil {
+		return Result{}, err
+	}
+	return EvalExpr(SamplesOf(src), e)
+}
+
+// EvalExpr evaluates a parsed expression against samples.
+func EvalExpr(samples []Sample, e Expr) (Result, error) {
+	switch e := e.(type) {
+	case *Number:
+		v := e.Value
+		return Result{Scalar: &v}, nil
+	case *Selector:
+		return Result{Vector: selectSamples(samples, e)}, nil
+	case *Binary:
+		return evalBinary(samples, e)
+	case *Call:
+		return evalCall(samples, e)
+	}
+	return Result{}, fmt.Errorf("unsupported expression %s", e)
+}
+
+func selectSamples(samples []Sample, sel *Selector) []Sample {
+	var out []Sample
+	for _, s := range samples {
+		if s.Name != sel.Name {
+			continue
+		}
+		if MatchLabels(sel.Matchers, s.Labels) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func evalBinary(samples []Sample, b *Binary) (Result, error) {
+	lhs, err := EvalExpr(samples, b.LHS)
+	if err != nil {
+		return Result{}, err
+	}
+	rhs, err := EvalExpr(samples, b.RHS)
+	if err != nil {
+		return Result{}, err
+	}
+
+	switch {
+	case lhs.IsScalar() && rhs.IsScalar():
+		if isComparison(b.Op) {
+			return Result{}, fmt.Errorf("comparison %s between two scalars", b.Op)
+		}
+		v := arith(b.Op, *lhs.Scalar, *rhs.Scalar)
+		return Result{Scalar: &v}, nil
+	case !lhs.IsScalar() && !rhs.IsScalar():
+		return Result{}, fmt.Errorf("operator %s between two vectors is not supported", b.Op)
+	}
+
+	// Vector op scalar, or scalar op vector
+	vec, scalar, vecLeft := lhs.Vector, rhs.Scalar, true
+	if lhs.IsScalar() {
+		vec, scalar, vecLeft = rhs.Vector, lhs.Scalar, false
+	}
+	var out []Sample
+	for _, s := range vec {
+		l, r := s.Value, *scalar
+		if !vecLeft {
+			l, r = r, l
+		}
+		if isComparison(b.Op) {
+			if compare(b.Op, l, r) {
+				out = append(out, s)
+			}
+			continue
+		}
+		s.Name = ""
+		s.Value = arith(b.Op, l, r)
+		out = append(out, s)
+	}
+	return Result{Vector: out}, nil
+}
+
+func isComparison(op string) bool {
+	switch op {
+	case "==", "!=", "<", "<=", ">", ">=":
+		return true
+	}
+	return false
+}
+
+func compare(op string, l, r float64) bool {
+	switch op {
+	case "==":
+		return l == r
+	case "!=":
+		return l != r
+	case "<":
+		return l < r
+	case "<=":
+		return l <= r
+	case ">":
+		return l > r
+	case ">=":
+		return l >= r
+	}
+	return false
+}
+
+func arith(op string, l, r float64) float64 {
+	switch op {
+	case "+":
+		return l + r
+	case "-":
+		return l - r
+	case "*":
+		return l * r
+	case "/":
+		return l / r
+	case "%":
+		return math.Mod(l, r)
+	}
+	return math.NaN()
+}
@@ -0,0 +1,85 @@
+package query
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+var testSamples = SourceFunc(func() []Sample {
+	return []Sample{
+		{Name: "mem", Labels: Labels{"comm": "java", "pid": "1"}, Value: 300},
+		{Name: "mem", Labels: Labels{"comm": "java", "pid": "2"}, Value: 100},
+		{Name: "mem", Labels: Labels{"comm": "nginx", "pid": "3"}, Value: 200},
+		{Name: "cpu", Labels: Labels{"comm": "java", "pid": "1"}, Value: 0.5},
+	}
+})
+
+// values renders a vector as its values by label set, for comparison
+func values(samples []Sample) map[string]float64 {
+	out := make(map[string]float64, len(samples))
+	for _, s := range samples {
+		out[s.Labels.String()] = s.Value
+	}
+	return out
+}
+
+func TestEval(t *testing.T) {
+	tests := []struct {
+		expr string
+		want map[string]float64
+	}{
+		{`mem{comm="java"}`, map[string]float64{`{comm="java",pid="1"}`: 300, `{comm="java",pid="2"}`: 100}},
+		{`mem > 150`, map[string]float64{`{comm="java",pid="1"}`: 300, `{comm="nginx",pid="3"}`: 200}},
+		{`mem / 100`, map[string]float64{`{comm="java",pid="1"}`: 3, `{comm="java",pid="2"}`: 1, `{comm="nginx",pid="3"}`: 2}},
+		{`sum by (comm) (mem)`, map[string]float64{`{comm="java"}`: 400, `{comm="nginx"}`: 200}},
+		{`count(mem)`, map[string]float64{`{}`: 3}},
+		{`max(cpu)`, map[string]float64{`{}`: 0.5}},
+		{`top(1, mem)`, map[string]float64{`{comm="java",pid="1"}`: 300}},
+		{`bottom(2, mem)`, map[string]float64{`{comm="java",pid="2"}`: 100, `{comm="nginx",pid="3"}`: 200}},
+		{`absent`, map[string]float64{}},
+	}
+	for _, tt := range tests {
+		r, err := Eval(testSamples, tt.expr)
+		if err != nil {
+			t.Errorf("Eval(%q): %v", tt.expr, err)
+			continue
+		}
+		if r.IsScalar() {
+			t.Errorf("Eval(%q) = scalar %v, want a vector", tt.expr, *r.Scalar)
+			continue
+		}
+		if got := values(r.Vector); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Eval(%q) = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestEvalScalar(t *testing.T) {
+	r, err := Eval(testSamples, `(1 + 2) * 4 - 10 / 5`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.IsScalar() || *r.Scalar != 10 {
+		t.Errorf("got %+v, want scalar 10", r)
+	}
+	for _, expr := range []string{`1 < 2`, `mem + cpu`} {
+		if _, err := Eval(testSamples, expr); err == nil {
+			t.Errorf("Eval(%q) succeeded, want error", expr)
+		}
+	}
+}
+
+func TestTopOrder(t *testing.T) {
+	r, err := Eval(testSamples, `top(3, mem)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]float64, len(r.Vector))
+	for i, s := range r.Vector {
+		got[i] = s.Value
+	}
+	if !sort.SliceIsSorted(got, func(i, j int) bool { return got[i] > got[j] }) || len(got) != 3 {
+		t.Errorf("top(3, mem) = %v, want 3 values, largest first", got)
+	}
+}
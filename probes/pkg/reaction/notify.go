@@ -0,0 +1,136 @@
+package reaction
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Notifier is told of alerts as they fire, e.g. to page someone before a
+// leaking process is killed.
+type Notifier interface {
+	Notify(ctx context.Context, alert Alert) error
+	String() string
+}
+
+// notifyTimeout bounds one notification.
+const notifyTimeout = 10 * time.Second
+
+// ParseNotifier parses a notifier spec as -alert-notify takes it:
+//
+//	exec:<command> [args]  runs the command with the alert as JSON on stdin
+//	                       and in $PROBEPILOT_ALERT_* variables
+//	http(s)://host/path    POSTs the alert as JSON
+//
+// An empty spec is no notifier, nil.
+func ParseNotifier(spec string) (Notifier, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	if command, ok := strings.CutPrefix(spec, "exec:"); ok {
+		args := strings.Fields(command)
+		if len(args) == 0 {
+			return nil, errors.New("exec: notifier needs a command")
+		}
+		return execNotifier(args), nil
+	}
+	u, err := url.Parse(spec)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid alert notifier %q (want exec:<command> or an http(s) URL)", spec)
+	}
+	return webhookNotifier(spec), nil
+}
+
+// Notify tells n of alert in the background, logging failures. A nil n
+// does nothing.
+func Notify(ctx context.Context, n Notifier, alert Alert) {
+	if n == nil {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+		defer cancel()
+		if err := n.Notify(ctx, alert); err != nil {
+			log.Printf("Warning: failed to notify %s of %s: %v", n, alert.Name, err)
+		}
+	}()
+}
+
+// alertJSON is an alert as notifiers receive it.
+type alertJSON struct {
+	Name     string    `json:"name"`
+	Severity string    `json:"severity"`
+	PID      uint32    `json:"pid,omitempty"`
+	Message  string    `json:"message"`
+	FiredAt  time.Time `json:"fired_at"`
+	Host     string    `json:"host,omitempty"`
+}
+
+func encode(alert Alert) ([]byte, error) {
+	host, _ := os.Hostname()
+	return json.Marshal(alertJSON{alert.Name, alert.Severity, alert.PID, alert.Message, alert.FiredAt, host})
+}
+
+type execNotifier []string
+
+func (n execNotifier) Notify(ctx context.Context, alert Alert) error {
+	body, err := encode(alert)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, n[0], n[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = append(os.Environ(),
+		"PROBEPILOT_ALERT_NAME="+alert.Name,
+		"PROBEPILOT_ALERT_SEVERITY="+alert.Severity,
+		"PROBEPILOT_ALERT_PID="+strconv.FormatUint(uint64(alert.PID), 10),
+		"PROBEPILOT_ALERT_MESSAGE="+alert.Message,
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+func (n execNotifier) String() string {
+	return "exec:" + strings.Join(n, " ")
+}
+
+type webhookNotifier string
+
+func (n webhookNotifier) Notify(ctx context.Context, alert Alert) error {
+	body, err := encode(alert)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, string(n), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s answered %s", n, resp.Status)
+	}
+	return nil
+}
+
+func (n webhookNotifier) String() string {
+	return string(n)
+}
@@ -0,0 +1,163 @@
+// Package reaction lets an alert trigger a temporary escalation, such as
+// attaching deeper probes to the offending process for a few minutes, and
+// attaches whatever the escalation captured back to the alert.
+package reaction
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Alert is a threshold that tripped in an agent.
+type Alert struct {
+	Name     string
+	Severity string
+	PID      uint32 // 0 when the alert is not about a single process
+	Message  string
+	FiredAt  time.Time
+}
+
+func (a Alert) String() string {
+	if a.PID != 0 {
+		return fmt.Sprintf("%s[pid=%d]: %s", a.Name, a.PID, a.Message)
+	}
+	return fmt.Sprintf("%s: %s", a.Name, a.Message)
+}
+
+// Action performs an escalation. It should capture until ctx is done,
+// then return a human-readable report of what it found.
+type Action func(ctx context.Context, alert Alert) (string, error)
+
+// Escalation binds an action to the alerts that trigger it.
+type Escalation struct {
+	Name string
+	// Alerts lists the alert names that trigger the escalation; empty
+	// matches every alert.
+	Alerts []string
+	// Duration bounds how long the action runs.
+	Duration time.Duration
+	// Cooldown suppresses repeated escalations for the same alert and PID.
+	Cooldown time.Duration
+	Action   Action
+}
+
+func (e Escalation) matches(a Alert) bool {
+	if len(e.Alerts) == 0 {
+		return true
+	}
+	for _, name := range e.Alerts {
+		if name == a.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// Report is the outcome of one escalation, attached to its alert.
+type Report struct {
+	Alert      Alert
+	Escalation string
+	Started    time.Time
+	Finished   time.Time
+	Body       string
+	Err        error
+}
+
+// maxReports bounds the reports kept for Reports.
+const maxReports = 32
+
+// Reactor runs escalations for fired alerts. It is safe for concurrent use.
+type Reactor struct {
+	// OnReport, if set, is called when an escalation finishes.
+	OnReport func(Report)
+
+	escalations []Escalation
+
+	mu      sync.Mutex
+	running map[string]bool
+	last    map[string]time.Time
+	reports []Report
+	wg      sync.WaitGroup
+}
+
+// NewReactor creates a reactor with the given escalations.
+func NewReactor(escalations ...Escalation) *Reactor {
+	return &Reactor{
+		escalations: escalations,
+		running:     make(map[string]bool),
+		last:        make(map[string]time.Time),
+	}
+}
+
+// Fire starts every escalation matching alert, unless one is already
+// running or cooling down for the same alert and PID. It returns the
+// number of escalations started; they finish in the background.
+func (r *Reactor) Fire(ctx context.Context, alert Alert) int {
+	if alert.FiredAt.IsZero() {
+		alert.FiredAt = time.Now()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	started := 0
+	for _, esc := range r.escalations {
+		if !esc.matches(alert) {
+			continue
+		}
+		key := fmt.Sprintf("%s/%s/%d", esc.Name, alert.Name, alert.PID)
+		if r.running[key] {
+			continue
+		}
+		if last, ok := r.last[key]; ok && alert.FiredAt.Sub(last) < esc.Cooldown {
+			continue
+		}
+		r.running[key] = true
+		r.last[key] = alert.FiredAt
+		started++
+
+		r.wg.Add(1)
+		go r.run(ctx, key, esc, alert)
+	}
+	return started
+}
+
+func (r *Reactor) run(ctx context.Context, key string, esc Escalation, alert Alert) {
+	defer r.wg.Done()
+
+	log.Printf("Escalating %s: %s for %v", alert, esc.Name, esc.Duration)
+	runCtx, cancel := context.WithTimeout(ctx, esc.Duration)
+	defer cancel()
+
+	report := Report{Alert: alert, Escalation: esc.Name, Started: time.Now()}
+	report.Body, report.Err = esc.Action(runCtx, alert)
+	report.Finished = time.Now()
+
+	r.mu.Lock()
+	delete(r.running, key)
+	r.reports = append(r.reports, report)
+	if len(r.reports) > maxReports {
+		r.reports = r.reports[len(r.reports)-maxReports:]
+	}
+	onReport := r.OnReport
+	r.mu.Unlock()
+
+	if onReport != nil {
+		onReport(report)
+	}
+}
+
+// Reports returns the most recent escalation reports, oldest first.
+func (r *Reactor) Reports() []Report {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Report(nil), r.reports...)
+}
+
+// Wait blocks until all running escalations have finished.
+func (r *Reactor) Wait() {
+	r.wg.Wait()
+}
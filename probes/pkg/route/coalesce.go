@@ -0,0 +1,211 @@
+package route
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"probepilot/pkg/query"
+)
+
+// CountLabel is the label of a coalesced event holding how many
+// identical events it stands for.
+const CountLabel = "count"
+
+// maxCoalescing bounds the distinct events held back at once; events
+// beyond are routed as they come.
+const maxCoalescing = 4096
+
+// CoalesceConfig is the coalescing stage -event-coalesce sets up.
+type CoalesceConfig struct {
+	// Window is how long identical events are collected for, 0 for not
+	// at all
+	Window time.Duration
+	// Ignore names the labels that do not tell events apart, such as
+	// addresses
+	Ignore []string
+}
+
+// RegisterCoalesceFlags registers -event-coalesce and
+// -event-coalesce-ignore on fs and returns their parser.
+func RegisterCoalesceFlags(fs *flag.FlagSet) func() (CoalesceConfig, error) {
+	window := fs.Duration("event-coalesce", 0,
+		"window over which identical events, with the same labels, are collapsed into one carrying a count label before they are routed, e.g. 5s (disabled if 0)")
+	ignore := fs.String("event-coalesce-ignore", "",
+		"comma-separated labels left out when -event-coalesce tells events apart, e.g. addr,latency_ns")
+
+	return func() (CoalesceConfig, error) {
+		c := CoalesceConfig{Window: *window}
+		if c.Window < 0 {
+			return CoalesceConfig{}, fmt.Errorf("invalid -event-coalesce %v (want >= 0)", c.Window)
+		}
+		for _, name := range strings.Split(*ignore, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				c.Ignore = append(c.Ignore, name)
+			}
+		}
+		if c.Window == 0 && len(c.Ignore) > 0 {
+			return CoalesceConfig{}, errors.New("-event-coalesce-ignore needs -event-coalesce")
+		}
+		return c, nil
+	}
+}
+
+// String describes the stage, e.g. "identical events over 5s, ignoring
+// addr".
+func (c CoalesceConfig) String() string {
+	s := fmt.Sprintf("identical events over %v", c.Window)
+	if len(c.Ignore) > 0 {
+		s += ", ignoring " + strings.Join(c.Ignore, ",")
+	}
+	return s
+}
+
+// coalesced is the first of a run of identical events and how many
+// there were.
+type coalesced struct {
+	mono   uint64
+	labels query.Labels
+	text   string
+	count  uint64
+	opened time.Time
+}
+
+// coalescer holds identical events back for a window and hands each run
+// of them on as one. It is safe for concurrent use.
+type coalescer struct {
+	config CoalesceConfig
+	ignore map[string]bool
+	// emit routes a run once its window closes
+	emit func(mono uint64, labels query.Labels, text string)
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+
+	mu      sync.Mutex
+	pending map[string]*coalesced
+	// held counts the events folded into an earlier one, overflow those
+	// routed as they came with maxCoalescing runs open
+	held, overflow uint64
+}
+
+func newCoalescer(c CoalesceConfig, emit func(uint64, query.Labels, string)) *coalescer {
+	co := &coalescer{
+		config:  c,
+		ignore:  make(map[string]bool, len(c.Ignore)),
+		emit:    emit,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		pending: make(map[string]*coalesced),
+	}
+	for _, name := range c.Ignore {
+		co.ignore[name] = true
+	}
+	go co.run()
+	return co
+}
+
+// key identifies events by their labels but the ignored ones.
+func (co *coalescer) key(labels query.Labels) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		if !co.ignore[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(labels[name])
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+// add holds an event back, reporting false if it is to be routed now
+// instead.
+func (co *coalescer) add(mono uint64, labels query.Labels, text string) bool {
+	key := co.key(labels)
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	if c, ok := co.pending[key]; ok {
+		c.count++
+		co.held++
+		return true
+	}
+	if len(co.pending) >= maxCoalescing {
+		co.overflow++
+		return false
+	}
+	co.pending[key] = &coalesced{mono: mono, labels: labels, text: text, count: 1, opened: time.Now()}
+	return true
+}
+
+// run hands on the runs whose window closed until stopped, then the rest.
+func (co *coalescer) run() {
+	defer close(co.done)
+	tick := co.config.Window / 4
+	if tick < 10*time.Millisecond {
+		tick = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			co.flush(now.Add(-co.config.Window))
+		case <-co.stop:
+			co.flush(time.Time{})
+			return
+		}
+	}
+}
+
+// flush hands on the runs opened before cutoff, every run if it is zero,
+// oldest first.
+func (co *coalescer) flush(cutoff time.Time) {
+	var due []*coalesced
+	co.mu.Lock()
+	for key, c := range co.pending {
+		if cutoff.IsZero() || !c.opened.After(cutoff) {
+			due = append(due, c)
+			delete(co.pending, key)
+		}
+	}
+	co.mu.Unlock()
+	sort.Slice(due, func(i, j int) bool { return due[i].mono < due[j].mono })
+	for _, c := range due {
+		labels := c.labels
+		if c.count > 1 {
+			labels = make(query.Labels, len(c.labels)+1)
+			for k, v := range c.labels {
+				labels[k] = v
+			}
+			labels[CountLabel] = strconv.FormatUint(c.count, 10)
+		}
+		co.emit(c.mono, labels, c.text)
+	}
+}
+
+// close hands on every run held back.
+func (co *coalescer) close() {
+	co.once.Do(func() { close(co.stop) })
+	<-co.done
+}
+
+func (co *coalescer) samples() []query.Sample {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	return []query.Sample{
+		{Name: "route_coalesced_total", Value: float64(co.held)},
+		{Name: "route_coalesce_overflow_total", Value: float64(co.overflow)},
+		{Name: "route_coalesce_pending", Value: float64(len(co.pending))},
+	}
+}
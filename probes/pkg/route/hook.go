@@ -0,0 +1,258 @@
+package route
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"probepilot/pkg/expr"
+	"probepilot/pkg/query"
+)
+
+// HookConfig selects the WASM module -event-hook runs events through
+// before they are routed, and how.
+//
+// The module is a WASI command, run by an external WASI runtime for as
+// long as the agent runs. It reads one event per line on stdin as JSON,
+// {"probe": "tcp-flow", "labels": {...}, "text": "..."}, and answers
+// each with one line on stdout: the event, with its labels and text
+// changed or not, or an empty line or null to drop it. A module that
+// answers late, garbles an answer or exits is stopped, and events are
+// routed unchanged from then on.
+type HookConfig struct {
+	// Module is the .wasm file, or "" for no hook.
+	Module string
+	// Runtime is the command running Module, which is appended to it,
+	// e.g. "wasmtime run".
+	Runtime string
+	// Timeout is how long the module may take to answer one event.
+	Timeout time.Duration
+}
+
+// DefaultHookRuntime runs hooks unless -event-hook-runtime says
+// otherwise.
+const DefaultHookRuntime = "wasmtime run"
+
+// wasmMagic starts every WASM module.
+var wasmMagic = []byte("\x00asm")
+
+// RegisterHookFlags defines the event hook flags on fs. The returned
+// function parses their values once fs has been parsed.
+func RegisterHookFlags(fs *flag.FlagSet) func() (HookConfig, error) {
+	module := fs.String("event-hook", "",
+		"WASI module to transform, enrich or drop events with before they are routed, one JSON event per line on stdin and stdout (disabled if empty)")
+	runtime := fs.String("event-hook-runtime", DefaultHookRuntime,
+		"command running the -event-hook module, e.g. \"wasmer run\"")
+	timeout := fs.Duration("event-hook-timeout", 50*time.Millisecond,
+		"how long the -event-hook module may take per event before it is stopped")
+
+	return func() (HookConfig, error) {
+		c := HookConfig{Module: *module, Runtime: *runtime, Timeout: *timeout}
+		if c.Module == "" {
+			return c, nil
+		}
+		if len(strings.Fields(c.Runtime)) == 0 {
+			return HookConfig{}, errors.New("-event-hook needs an -event-hook-runtime")
+		}
+		if c.Timeout <= 0 {
+			return HookConfig{}, fmt.Errorf("invalid -event-hook-timeout %v (want > 0)", c.Timeout)
+		}
+		f, err := os.Open(c.Module)
+		if err != nil {
+			return HookConfig{}, fmt.Errorf("-event-hook: %v", err)
+		}
+		defer f.Close()
+		magic := make([]byte, len(wasmMagic))
+		if _, err := io.ReadFull(f, magic); err != nil || !bytes.Equal(magic, wasmMagic) {
+			return HookConfig{}, fmt.Errorf("-event-hook: %s is not a WASM module", c.Module)
+		}
+		return c, nil
+	}
+}
+
+// RegisterFilterFlag defines -event-filter on fs. The returned function
+// compiles its expression once fs has been parsed, or returns nil if it
+// is empty.
+func RegisterFilterFlag(fs *flag.FlagSet) func() (*expr.Program, error) {
+	src := fs.String("event-filter", "",
+		"CEL expression events must satisfy to be routed or exported, e.g. 'event.size > 1<<20 && event.comm.startsWith(\"java\")' (disabled if empty)")
+	return func() (*expr.Program, error) {
+		if *src == "" {
+			return nil, nil
+		}
+		prog, err := expr.Compile(*src)
+		if err != nil {
+			return nil, fmt.Errorf("-event-filter: %v", err)
+		}
+		return prog, nil
+	}
+}
+
+// String describes the hook, e.g. "classify.wasm (wasmtime run, 50ms
+// per event)".
+func (c HookConfig) String() string {
+	return fmt.Sprintf("%s (%s, %v per event)", c.Module, c.Runtime, c.Timeout)
+}
+
+// hookEvent is an event as a hook module reads and writes it.
+type hookEvent struct {
+	Probe  string       `json:"probe,omitempty"`
+	Labels query.Labels `json:"labels"`
+	Text   string       `json:"text"`
+}
+
+// Hook is a running event hook module. It is safe for concurrent use.
+type Hook struct {
+	config HookConfig
+	probe  string
+
+	mu      sync.Mutex
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	answers chan []byte
+	failed  bool
+
+	kept, dropped, failures atomic.Uint64
+}
+
+// StartHook starts the module of c for the events of probe, or returns
+// nil if c has none.
+func StartHook(c HookConfig, probe string) (*Hook, error) {
+	if c.Module == "" {
+		return nil, nil
+	}
+	args := append(strings.Fields(c.Runtime), c.Module)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("event hook %s: %v", c.Module, err)
+	}
+	h := &Hook{config: c, probe: probe, cmd: cmd, stdin: stdin, answers: make(chan []byte)}
+	go h.read(stdout)
+	return h, nil
+}
+
+// read passes the module's answers on until it exits.
+func (h *Hook) read(stdout io.Reader) {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		h.answers <- append([]byte(nil), scanner.Bytes()...)
+	}
+	close(h.answers)
+}
+
+// Process runs an event through the module and returns it as the module
+// answered, or ok false if it dropped the event. Once the module failed,
+// events pass unchanged.
+func (h *Hook) Process(labels query.Labels, text string) (query.Labels, string, bool) {
+	if h == nil {
+		return labels, text, true
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.failed {
+		return labels, text, true
+	}
+	out, keep, err := h.call(hookEvent{Probe: h.probe, Labels: labels, Text: text})
+	if err != nil {
+		h.failures.Add(1)
+		log.Printf("Warning: event hook %s failed, routing events unchanged: %v", h.config.Module, err)
+		h.stop()
+		return labels, text, true
+	}
+	if !keep {
+		h.dropped.Add(1)
+		return nil, "", false
+	}
+	h.kept.Add(1)
+	return out.Labels, out.Text, true
+}
+
+// call sends e to the module and waits for its answer; h.mu must be held.
+func (h *Hook) call(e hookEvent) (hookEvent, bool, error) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return hookEvent{}, false, err
+	}
+	if _, err := h.stdin.Write(append(line, '\n')); err != nil {
+		return hookEvent{}, false, err
+	}
+	timer := time.NewTimer(h.config.Timeout)
+	defer timer.Stop()
+	var answer []byte
+	select {
+	case a, ok := <-h.answers:
+		if !ok {
+			return hookEvent{}, false, errors.New("module exited")
+		}
+		answer = bytes.TrimSpace(a)
+	case <-timer.C:
+		return hookEvent{}, false, fmt.Errorf("no answer within %v", h.config.Timeout)
+	}
+	if len(answer) == 0 || string(answer) == "null" {
+		return hookEvent{}, false, nil
+	}
+	var out hookEvent
+	if err := json.Unmarshal(answer, &out); err != nil {
+		return hookEvent{}, false, fmt.Errorf("invalid answer %q: %v", answer, err)
+	}
+	return out, true, nil
+}
+
+// stop ends the module for good; h.mu must be held.
+func (h *Hook) stop() {
+	if h.failed {
+		return
+	}
+	h.failed = true
+	h.stdin.Close()
+	h.cmd.Process.Kill()
+	// Unblock the reader so Wait can reap the module
+	go func() {
+		for range h.answers {
+		}
+	}()
+	h.cmd.Wait()
+}
+
+// Samples exports the hook's counters.
+func (h *Hook) Samples() []query.Sample {
+	if h == nil {
+		return nil
+	}
+	return []query.Sample{
+		{Name: "event_hook_events_total", Labels: query.Labels{"result": "kept"}, Value: float64(h.kept.Load())},
+		{Name: "event_hook_events_total", Labels: query.Labels{"result": "dropped"}, Value: float64(h.dropped.Load())},
+		{Name: "event_hook_errors_total", Value: float64(h.failures.Load())},
+	}
+}
+
+// Close stops the module.
+func (h *Hook) Close() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.stop()
+}
@@ -0,0 +1,537 @@
+// Package route classifies agent events by severity and routes them to
+// external sinks according to declarative rules, so that, for example, OOM
+// kills page someone through a webhook and syslog while routine flow
+// events only feed Kafka.
+//
+// Rules are read from a JSON file shared by all probes, keyed by probe:
+//
+//	{
+//	  "schema": "routes/1.0",
+//	  "sinks": {
+//	    "oncall": {"type": "webhook", "url": "https://alerts.example.com/hook"},
+//	    "syslog": {"type": "syslog", "address": "unix:/dev/log"},
+//	    "flows":  {"type": "kafka", "url": "http://kafka-rest:8082", "topic": "flows",
+//	               "export": {"batch_size": 500, "compression": "zstd", "spool_dir": "/var/spool/probepilot"}}
+//	  },
+//	  "probes": {
+//	    "memory-tracker": {
+//	      "rules": [
+//	        {"match": "type=\"oom\"", "severity": "critical", "routes": ["oncall", "syslog"]},
+//	        {"match": "type=\"memory_growth\"", "severity": "warn", "routes": ["syslog"]}
+//	      ]
+//	    },
+//	    "tcp-flow": {
+//	      "default": {"severity": "info", "routes": ["flows"]}
+//	    }
+//	  }
+//	}
+//
+// The first rule whose label matchers match an event decides its severity
+// and routes; events no rule matches take the probe's default, which
+// routes nowhere unless configured. A Tap, such as the one -otlp-logs
+// sets up, additionally delivers classes of events to its own sink. A
+// Hook, set up by -event-hook, may rewrite or drop events first, an
+// expression of -event-filter decides which are routed at all, and
+// -event-coalesce collapses bursts of identical events into one with a
+// count label.
+package route
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"probepilot/pkg/clock"
+	"probepilot/pkg/export"
+	"probepilot/pkg/expr"
+	"probepilot/pkg/query"
+	"probepilot/pkg/schema"
+)
+
+// Severity grades an event.
+type Severity int
+
+const (
+	Info Severity = iota
+	Warn
+	Critical
+)
+
+var severityNames = []string{"info", "warn", "critical"}
+
+func (s Severity) String() string {
+	if s < 0 || int(s) >= len(severityNames) {
+		return fmt.Sprintf("severity(%d)", int(s))
+	}
+	return severityNames[s]
+}
+
+// ParseSeverity parses info, warn (or warning) and critical.
+func ParseSeverity(s string) (Severity, error) {
+	switch strings.ToLower(s) {
+	case "", "info":
+		return Info, nil
+	case "warn", "warning":
+		return Warn, nil
+	case "critical", "crit":
+		return Critical, nil
+	}
+	return Info, fmt.Errorf("unknown severity %q (want info, warn or critical)", s)
+}
+
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *Severity) UnmarshalText(text []byte) error {
+	v, err := ParseSeverity(string(text))
+	*s = v
+	return err
+}
+
+// Rule assigns a severity and routes to the events its matchers select.
+type Rule struct {
+	// Match holds label matchers, e.g. type="oom",comm=~"java.*". An
+	// empty Match selects every event.
+	Match    string   `json:"match"`
+	Severity Severity `json:"severity"`
+	Routes   []string `json:"routes"`
+
+	matchers []query.Matcher
+}
+
+// ProbeConfig is the rules of one probe.
+type ProbeConfig struct {
+	Rules   []Rule `json:"rules"`
+	Default Rule   `json:"default"`
+}
+
+func (pc ProbeConfig) all() []Rule {
+	return append(append([]Rule(nil), pc.Rules...), pc.Default)
+}
+
+// Config is the routing file.
+type Config struct {
+	// Schema is the routes schema the file was written for, e.g.
+	// "routes/1.0"; files without one are read as 1.0.
+	Schema string                 `json:"schema,omitempty"`
+	Sinks  map[string]SinkConfig  `json:"sinks"`
+	Probes map[string]ProbeConfig `json:"probes"`
+}
+
+// LoadConfig reads and validates a routing file.
+func LoadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var cfg Config
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &cfg, nil
+}
+
+func (c *Config) validate() error {
+	if err := schema.Check(schema.Routes, c.Schema); err != nil {
+		return fmt.Errorf("schema: %v", err)
+	}
+	for name, sink := range c.Sinks {
+		if err := sink.validate(); err != nil {
+			return fmt.Errorf("sink %s: %v", name, err)
+		}
+	}
+	for probe, pc := range c.Probes {
+		rules := pc.all()
+		for i := range rules {
+			rule := &rules[i]
+			if rule.Match != "" {
+				matchers, err := query.ParseMatchers(rule.Match)
+				if err != nil {
+					return fmt.Errorf("probe %s: rule %q: %v", probe, rule.Match, err)
+				}
+				rule.matchers = matchers
+			}
+			for _, r := range rule.Routes {
+				if _, ok := c.Sinks[r]; !ok {
+					return fmt.Errorf("probe %s: rule %q routes to unknown sink %q", probe, rule.Match, r)
+				}
+			}
+		}
+		pc.Rules, pc.Default = rules[:len(pc.Rules)], rules[len(pc.Rules)]
+		c.Probes[probe] = pc
+	}
+	return nil
+}
+
+// Routed returns the sorted names of the sinks probe's rules route to.
+func (c *Config) Routed(probe string) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, rule := range c.Probes[probe].all() {
+		for _, name := range rule.Routes {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Message is one routed event as delivered to sinks. Schema tags it with
+// the event schema, e.g. "event/1.1", so collectors can reject messages of
+// a major version they do not know.
+//
+// An event carries two timestamps: Monotonic, the kernel's
+// CLOCK_MONOTONIC nanoseconds it was stamped with, which orders the
+// events of one host exactly, and Time, that instant on the wall clock as
+// corrected by the latest calibration, which lines it up with external
+// logs (since event/1.1).
+type Message struct {
+	Schema    string       `json:"schema"`
+	Probe     string       `json:"probe"`
+	Severity  Severity     `json:"severity"`
+	Time      time.Time    `json:"time"`
+	Monotonic uint64       `json:"monotonic_ns,omitempty"`
+	Labels    query.Labels `json:"labels,omitempty"`
+	Text      string       `json:"text"`
+}
+
+// queueSize is how many messages a slow sink may lag behind before
+// messages are dropped for it.
+const queueSize = 1024
+
+// outlet delivers to one sink from its own goroutine, so a slow webhook
+// never stalls event processing or the other sinks.
+type outlet struct {
+	name  string
+	sink  Sink
+	queue chan Message
+
+	sent, dropped, failed atomic.Uint64
+}
+
+func (o *outlet) run(wg *sync.WaitGroup) {
+	defer wg.Done()
+	for m := range o.queue {
+		if err := o.sink.Send(m); err != nil {
+			o.failed.Add(1)
+			continue
+		}
+		o.sent.Add(1)
+	}
+	o.sink.Close()
+}
+
+// Router classifies and routes the events of one probe. A nil Router
+// routes nothing, so agents can call Route unconditionally.
+type Router struct {
+	probe string
+	rules ProbeConfig
+	clock *clock.Clock
+
+	outlets  map[string]*outlet
+	taps     []*Tap
+	hook     *Hook
+	filter   *expr.Program
+	coalesce *coalescer
+	wg       sync.WaitGroup
+
+	mu     sync.Mutex
+	closed bool
+	counts map[[2]string]uint64 // severity, sink
+
+	// Events the filter rejected, or could not evaluate
+	filtered, filterErrors atomic.Uint64
+}
+
+// New returns the router of probe under cfg and taps, starting a
+// delivery goroutine for every sink the probe's rules route to and every
+// tap. Nil taps are skipped.
+func New(cfg *Config, probe string, taps ...*Tap) (*Router, error) {
+	r := &Router{
+		probe:   probe,
+		rules:   cfg.Probes[probe],
+		clock:   clock.New(),
+		outlets: make(map[string]*outlet),
+		counts:  make(map[[2]string]uint64),
+	}
+	for _, name := range cfg.Routed(probe) {
+		sink, err := newSink(cfg.Sinks[name], name, probe)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("sink %s: %v", name, err)
+		}
+		r.start(name, sink)
+	}
+	for _, t := range taps {
+		if t == nil {
+			continue
+		}
+		if _, ok := r.outlets[t.Name]; ok {
+			r.Close()
+			return nil, fmt.Errorf("sink %s: also defined by the routing file", t.Name)
+		}
+		sink, err := newSink(t.Sink, t.Name, probe)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("sink %s: %v", t.Name, err)
+		}
+		r.start(t.Name, sink)
+		r.taps = append(r.taps, t)
+	}
+	return r, nil
+}
+
+func (r *Router) start(name string, sink Sink) {
+	o := &outlet{name: name, sink: sink, queue: make(chan Message, queueSize)}
+	r.outlets[name] = o
+	r.wg.Add(1)
+	go o.run(&r.wg)
+}
+
+// Use runs every event through h before it is classified; the router
+// stops h when closed. A nil Router has nothing to run a hook for.
+func (r *Router) Use(h *Hook) error {
+	if h == nil {
+		return nil
+	}
+	if r == nil {
+		h.Close()
+		return errors.New("-event-hook needs -routes or -otlp-logs to export events to")
+	}
+	r.hook = h
+	return nil
+}
+
+// Filter routes only the events for which prog holds, after any hook.
+// A nil Router has nothing to filter.
+func (r *Router) Filter(prog *expr.Program) error {
+	if prog == nil {
+		return nil
+	}
+	if r == nil {
+		return errors.New("-event-filter needs -routes or -otlp-logs to export events to")
+	}
+	r.filter = prog
+	return nil
+}
+
+// Coalesce collapses the identical events routed within c.Window, after
+// any hook and filter, into one; the router hands on those held back when
+// closed. A nil Router has nothing to coalesce.
+func (r *Router) Coalesce(c CoalesceConfig) error {
+	if c.Window == 0 {
+		return nil
+	}
+	if r == nil {
+		return errors.New("-event-coalesce needs -routes or -otlp-logs to export events to")
+	}
+	r.coalesce = newCoalescer(c, r.route)
+	return nil
+}
+
+// Classify returns the rule deciding labels' severity and routes.
+func (r *Router) Classify(labels query.Labels) Rule {
+	for _, rule := range r.rules.Rules {
+		if query.MatchLabels(rule.matchers, labels) {
+			return rule
+		}
+	}
+	return r.rules.Default
+}
+
+// Route classifies an event that happened now and queues it for each of
+// its routes.
+func (r *Router) Route(labels query.Labels, text string) {
+	r.RouteAt(clock.Now(), labels, text)
+}
+
+// RouteAt classifies an event stamped by BPF at mono, monotonic ns, and
+// queues it for each of its routes.
+func (r *Router) RouteAt(mono uint64, labels query.Labels, text string) {
+	if r == nil {
+		return
+	}
+	labels, text, ok := r.hook.Process(labels, text)
+	if !ok {
+		return
+	}
+	if r.filter != nil {
+		match, err := r.filter.Match(labels, text)
+		if err != nil {
+			r.filterErrors.Add(1)
+		}
+		if !match {
+			r.filtered.Add(1)
+			return
+		}
+	}
+	if r.coalesce != nil && r.coalesce.add(mono, labels, text) {
+		return
+	}
+	r.route(mono, labels, text)
+}
+
+// route classifies an event that passed the hook, filter and coalescing
+// and queues it for each of its routes.
+func (r *Router) route(mono uint64, labels query.Labels, text string) {
+	rule := r.Classify(labels)
+	if len(rule.Routes) == 0 && len(r.taps) == 0 {
+		return
+	}
+	m := Message{Schema: schema.Tag(schema.Event), Probe: r.probe, Severity: rule.Severity,
+		Time: r.clock.Wall(mono), Monotonic: mono, Labels: labels, Text: text}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	for _, name := range rule.Routes {
+		r.deliver(name, m)
+	}
+	for _, t := range r.taps {
+		class, ok := t.classify(labels)
+		if !ok {
+			continue
+		}
+		tapped := m
+		tapped.Severity = class.Rule.Severity
+		tapped.Labels = make(query.Labels, len(labels)+1)
+		for k, v := range labels {
+			tapped.Labels[k] = v
+		}
+		tapped.Labels["event_class"] = class.Name
+		r.deliver(t.Name, tapped)
+	}
+}
+
+// deliver queues m for the sink name; r.mu must be held.
+func (r *Router) deliver(name string, m Message) {
+	r.counts[[2]string{m.Severity.String(), name}]++
+	o := r.outlets[name]
+	select {
+	case o.queue <- m:
+	default:
+		o.dropped.Add(1)
+	}
+}
+
+// Samples exports routing counters to the local query API.
+func (r *Router) Samples() []query.Sample {
+	if r == nil {
+		return nil
+	}
+	samples := append(r.clock.Samples(), r.hook.Samples()...)
+	if r.filter != nil {
+		samples = append(samples,
+			query.Sample{Name: "route_filtered_total", Value: float64(r.filtered.Load())},
+			query.Sample{Name: "route_filter_errors_total", Value: float64(r.filterErrors.Load())},
+		)
+	}
+	if r.coalesce != nil {
+		samples = append(samples, r.coalesce.samples()...)
+	}
+	r.mu.Lock()
+	for key, n := range r.counts {
+		samples = append(samples, query.Sample{
+			Name:   "routed_events_total",
+			Labels: query.Labels{"severity": key[0], "sink": key[1]},
+			Value:  float64(n),
+		})
+	}
+	r.mu.Unlock()
+	names := make([]string, 0, len(r.outlets))
+	for name := range r.outlets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		o := r.outlets[name]
+		labels := query.Labels{"sink": name}
+		samples = append(samples,
+			query.Sample{Name: "route_delivered_total", Labels: labels, Value: float64(o.sent.Load())},
+			query.Sample{Name: "route_dropped_total", Labels: labels, Value: float64(o.dropped.Load())},
+			query.Sample{Name: "route_failed_total", Labels: labels, Value: float64(o.failed.Load())},
+		)
+		// Batching sinks deliver asynchronously; report what reached the
+		// collector
+		if s, ok := o.sink.(interface{ Stats() export.Stats }); ok {
+			st := s.Stats()
+			samples = append(samples,
+				query.Sample{Name: "route_export_batches_total", Labels: labels, Value: float64(st.Batches)},
+				query.Sample{Name: "route_export_records_total", Labels: labels, Value: float64(st.Records)},
+				query.Sample{Name: "route_export_retries_total", Labels: labels, Value: float64(st.Retries)},
+				query.Sample{Name: "route_export_spooled_total", Labels: labels, Value: float64(st.Spooled)},
+				query.Sample{Name: "route_export_replayed_total", Labels: labels, Value: float64(st.Replayed)},
+				query.Sample{Name: "route_export_dropped_total", Labels: labels, Value: float64(st.Dropped)},
+				query.Sample{Name: "route_export_spool_bytes", Labels: labels, Value: float64(st.SpoolBytes)},
+			)
+		}
+	}
+	return samples
+}
+
+// Close delivers queued messages and closes the sinks.
+func (r *Router) Close() {
+	if r == nil {
+		return
+	}
+	if r.coalesce != nil {
+		r.coalesce.close()
+	}
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	r.closed = true
+	for _, o := range r.outlets {
+		close(o.queue)
+	}
+	r.mu.Unlock()
+	r.wg.Wait()
+	r.hook.Close()
+}
+
+// Load reads the routing file at path and returns the router of probe
+// under it and taps, or a nil Router if path is empty and there are no
+// taps.
+func Load(path, probe string, taps ...*Tap) (*Router, error) {
+	cfg := &Config{}
+	if path != "" {
+		var err error
+		if cfg, err = LoadConfig(path); err != nil {
+			return nil, err
+		}
+		if _, ok := cfg.Probes[probe]; !ok {
+			return nil, fmt.Errorf("%s: no rules for probe %s", path, probe)
+		}
+	} else if !tapped(taps) {
+		return nil, nil
+	}
+	return New(cfg, probe, taps...)
+}
+
+func tapped(taps []*Tap) bool {
+	for _, t := range taps {
+		if t != nil {
+			return true
+		}
+	}
+	return false
+}
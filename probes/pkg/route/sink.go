@@ -0,0 +1,330 @@
+package route
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"probepilot/pkg/export"
+	"probepilot/pkg/otlp"
+	"probepilot/pkg/schema"
+)
+
+// Sink delivers routed messages to one destination.
+type Sink interface {
+	Send(Message) error
+	Close() error
+}
+
+// SinkConfig declares a sink. Type selects which fields apply:
+//
+//	webhook  url: messages are POSTed as JSON
+//	syslog   address: "unix:/dev/log", "udp:host:514" or "tcp:host:514"
+//	kafka    url, topic: records are produced through a Kafka REST proxy
+//	otlp     url: messages are OTLP log records sent to the collector at
+//	         url, e.g. http://otel-collector:4318
+//	log      messages go to the agent's own log
+//
+// Export configures batching, compression, retries and spooling of the
+// webhook, kafka and otlp sinks; see export.Options. A webhook batching more than
+// one message POSTs them as a JSON array.
+//
+// Schema optionally pins the event schema the destination reads, e.g.
+// "event/1"; routing files fail to load when this build writes a major
+// version the destination does not understand.
+type SinkConfig struct {
+	Type    string            `json:"type"`
+	Schema  string            `json:"schema,omitempty"`
+	URL     string            `json:"url,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Address string            `json:"address,omitempty"`
+	Topic   string            `json:"topic,omitempty"`
+	Export  export.Options    `json:"export,omitempty"`
+}
+
+func (c SinkConfig) validate() error {
+	if c.Schema != "" {
+		name, v, err := schema.ParseTag(c.Schema)
+		if err != nil {
+			return fmt.Errorf("schema: %v", err)
+		}
+		if name != schema.Event {
+			return fmt.Errorf("schema: sinks receive %s, not %s", schema.Event, name)
+		}
+		if err := schema.CheckReader(schema.Event, v); err != nil {
+			return fmt.Errorf("schema: %v", err)
+		}
+	}
+	if c.Export != (export.Options{}) {
+		if c.Type != "webhook" && c.Type != "kafka" && c.Type != "otlp" {
+			return fmt.Errorf("export options apply to webhook, kafka and otlp sinks, not %s", c.Type)
+		}
+		if err := c.Export.Validate(); err != nil {
+			return fmt.Errorf("export: %v", err)
+		}
+	}
+	switch c.Type {
+	case "webhook":
+		return validURL(c.URL)
+	case "kafka":
+		if c.Topic == "" {
+			return errors.New("kafka sinks need a topic")
+		}
+		return validURL(c.URL)
+	case "otlp":
+		_, err := otlp.SignalURL(c.URL, otlp.LogsPath)
+		return err
+	case "syslog":
+		_, _, err := syslogAddr(c.Address)
+		return err
+	case "log":
+		return nil
+	}
+	return fmt.Errorf("unknown sink type %q (want webhook, syslog, kafka, otlp or log)", c.Type)
+}
+
+// Destination describes where the sink delivers, e.g. a webhook URL or
+// the Kafka REST endpoint of its topic.
+func (c SinkConfig) Destination() string {
+	switch c.Type {
+	case "webhook":
+		return c.URL
+	case "kafka":
+		return strings.TrimSuffix(c.URL, "/") + "/topics/" + url.PathEscape(c.Topic)
+	case "otlp":
+		url, _ := otlp.SignalURL(c.URL, otlp.LogsPath)
+		return url
+	case "syslog":
+		return c.Address
+	case "log":
+		return "agent log"
+	}
+	return ""
+}
+
+func validURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url %q", s)
+	}
+	return nil
+}
+
+// sendTimeout bounds each delivery so a hung endpoint only delays its own
+// queue.
+const sendTimeout = 5 * time.Second
+
+func newSink(c SinkConfig, name, probe string) (Sink, error) {
+	client := &http.Client{Timeout: sendTimeout}
+	switch c.Type {
+	case "webhook":
+		send := func(body []byte, encoding string) error {
+			return post(client, c.URL, "application/json", encoding, c.Headers, body)
+		}
+		exp, err := export.New(probe+"-"+name, c.Export, webhookBatch(c.Export.BatchSize), send)
+		if err != nil {
+			return nil, err
+		}
+		return &batchSink{exp: exp, record: func(m Message) ([]byte, error) {
+			return json.Marshal(m)
+		}}, nil
+	case "kafka":
+		topicURL := c.Destination()
+		send := func(body []byte, encoding string) error {
+			return post(client, topicURL, "application/vnd.kafka.json.v2+json", encoding, c.Headers, body)
+		}
+		exp, err := export.New(probe+"-"+name, c.Export, kafkaBatch, send)
+		if err != nil {
+			return nil, err
+		}
+		return &batchSink{exp: exp, record: func(m Message) ([]byte, error) {
+			return json.Marshal(map[string]interface{}{"key": m.Probe, "value": m})
+		}}, nil
+	case "otlp":
+		exp, err := otlp.NewLogExporter(probe+"-"+name, c.URL, c.Headers, probe, c.Export)
+		if err != nil {
+			return nil, err
+		}
+		return &batchSink{exp: exp, record: func(m Message) ([]byte, error) {
+			return otlp.LogRecord(otlp.Event{Time: m.Time, Severity: m.Severity.String(),
+				SeverityNumber: otlpSeverity[m.Severity], Labels: m.Labels, Text: m.Text})
+		}}, nil
+	case "syslog":
+		network, addr, err := syslogAddr(c.Address)
+		if err != nil {
+			return nil, err
+		}
+		return &syslogSink{network: network, addr: addr, tag: "probepilot-" + probe}, nil
+	case "log":
+		return logSink{}, nil
+	}
+	return nil, fmt.Errorf("unknown sink type %q", c.Type)
+}
+
+// post sends body and treats any non-2xx status as a failed delivery.
+// Client errors other than 408 and 429 are permanent: the same body would
+// be refused again.
+func post(client *http.Client, url, contentType, encoding string, headers map[string]string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(schema.Header, schema.Tag(schema.Event))
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		err := fmt.Errorf("POST %s: %s", url, resp.Status)
+		if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusRequestTimeout &&
+			resp.StatusCode != http.StatusTooManyRequests {
+			return export.Permanent(err)
+		}
+		return err
+	}
+	return nil
+}
+
+// batchSink hands messages to an exporter, which delivers them from its
+// own goroutine.
+type batchSink struct {
+	exp    *export.Exporter
+	record func(Message) ([]byte, error)
+}
+
+func (s *batchSink) Send(m Message) error {
+	data, err := s.record(m)
+	if err != nil {
+		return err
+	}
+	if !s.exp.Add(data) {
+		return errors.New("export queue full")
+	}
+	return nil
+}
+
+func (s *batchSink) Close() error {
+	s.exp.Close()
+	return nil
+}
+
+func (s *batchSink) Stats() export.Stats {
+	return s.exp.Stats()
+}
+
+// webhookBatch posts a lone message as before batching existed, and
+// batches as JSON arrays.
+func webhookBatch(batchSize int) export.Encoder {
+	return func(records [][]byte) ([]byte, error) {
+		if batchSize <= 1 && len(records) == 1 {
+			return records[0], nil
+		}
+		return append(append([]byte{'['}, bytes.Join(records, []byte{','})...), ']'), nil
+	}
+}
+
+// kafkaBatch produces a batch as one request to the REST proxy API, which
+// keeps a Kafka client and its broker discovery out of the agents.
+func kafkaBatch(records [][]byte) ([]byte, error) {
+	body := []byte(`{"records":[`)
+	body = append(body, bytes.Join(records, []byte{','})...)
+	return append(body, "]}"...), nil
+}
+
+var otlpSeverity = map[Severity]int{
+	Info:     otlp.SeverityInfo,
+	Warn:     otlp.SeverityWarn,
+	Critical: otlp.SeverityError,
+}
+
+// syslogSink writes RFC 3164 messages, which local daemons and remote
+// collectors alike accept. It is implemented here rather than with
+// log/syslog so agents build on every platform.
+type syslogSink struct {
+	network, addr, tag string
+	conn               net.Conn
+}
+
+func syslogAddr(address string) (network, addr string, err error) {
+	network, addr, ok := strings.Cut(address, ":")
+	if !ok || addr == "" {
+		return "", "", fmt.Errorf("invalid syslog address %q (want unix:/dev/log, udp:host:port or tcp:host:port)", address)
+	}
+	switch network {
+	case "unix":
+		// /dev/log is a datagram socket on most systems
+		return "unixgram", addr, nil
+	case "udp", "tcp":
+		return network, addr, nil
+	}
+	return "", "", fmt.Errorf("invalid syslog network %q (want unix, udp or tcp)", network)
+}
+
+// syslogFacility is LOG_DAEMON.
+const syslogFacility = 3 << 3
+
+var syslogPriority = map[Severity]int{
+	Info:     6, // LOG_INFO
+	Warn:     4, // LOG_WARNING
+	Critical: 2, // LOG_CRIT
+}
+
+func (s *syslogSink) Send(m Message) error {
+	line := fmt.Sprintf("<%d>%s %s[%d]: [%s] %s",
+		syslogFacility|syslogPriority[m.Severity], m.Time.Format(time.Stamp),
+		s.tag, os.Getpid(), m.Severity, m.Text)
+	if s.network == "tcp" {
+		line += "\n"
+	}
+	// Reconnect once, e.g. after the syslog daemon restarted
+	for attempt := 0; ; attempt++ {
+		if s.conn == nil {
+			conn, err := net.DialTimeout(s.network, s.addr, sendTimeout)
+			if err != nil {
+				return err
+			}
+			s.conn = conn
+		}
+		s.conn.SetWriteDeadline(time.Now().Add(sendTimeout))
+		_, err := io.WriteString(s.conn, line)
+		if err == nil || attempt > 0 {
+			return err
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+func (s *syslogSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+type logSink struct{}
+
+func (logSink) Send(m Message) error {
+	log.Printf("[%s] %s: %s", strings.ToUpper(m.Severity.String()), m.Probe, m.Text)
+	return nil
+}
+
+func (logSink) Close() error { return nil }
@@ -0,0 +1,106 @@
+package route
+
+import (
+	"fmt"
+	"strings"
+
+	"probepilot/pkg/query"
+)
+
+// Tap delivers classes of events to one sink on top of the routing
+// rules, whatever severity and routes the rules give them, so that
+// -otlp-logs exports OOM kills without a routing file and without taking
+// them from the routes a file gives them.
+type Tap struct {
+	Name string
+	Sink SinkConfig
+	// Classes are tried in order; the first to match an event decides
+	// its severity and is added to its labels as event_class.
+	Classes []Class
+}
+
+// Class is a named kind of event and the rule that selects it.
+type Class struct {
+	Name string
+	Rule Rule
+}
+
+// EventClasses are the classes of events a Tap can select.
+var EventClasses = []Class{
+	{Name: "oom", Rule: Rule{Match: `type="oom"`, Severity: Critical}},
+	{Name: "security", Rule: Rule{Match: `type=~"policy_violation|wx_mapping"`, Severity: Warn}},
+	{Name: "connection_failure", Rule: Rule{Match: `type="connect_failed"`, Severity: Warn}},
+	{Name: "self_health", Rule: Rule{Match: `type=~"probe_stall|sampling_adjusted"`, Severity: Critical}},
+	{Name: "process_exit", Rule: Rule{Match: `type="exit"`, Severity: Info}},
+	{Name: "memory_pressure", Rule: Rule{Match: `type="pressure_incident"`, Severity: Warn}},
+}
+
+// DefaultLogClasses are the classes -otlp-logs exports unless told
+// otherwise.
+const DefaultLogClasses = "oom,security,connection_failure,self_health"
+
+// OTLPLogs returns the tap exporting the comma-separated classes of
+// events, or all of them, to the collector at endpoint as OTLP log
+// records; it returns nil if endpoint is empty.
+func OTLPLogs(endpoint, classes string) (*Tap, error) {
+	if endpoint == "" {
+		return nil, nil
+	}
+	t := &Tap{Name: "otlp-logs", Sink: SinkConfig{Type: "otlp", URL: endpoint}}
+	if err := t.Sink.validate(); err != nil {
+		return nil, err
+	}
+	for _, name := range strings.Split(classes, ",") {
+		name = strings.TrimSpace(name)
+		if name == "all" {
+			t.Classes = append(t.Classes, EventClasses...)
+			continue
+		}
+		c, ok := eventClass(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown event class %q (want all or %s)", name, strings.Join(classNames(EventClasses), ", "))
+		}
+		t.Classes = append(t.Classes, c)
+	}
+	for i := range t.Classes {
+		matchers, err := query.ParseMatchers(t.Classes[i].Rule.Match)
+		if err != nil {
+			return nil, fmt.Errorf("event class %s: %v", t.Classes[i].Name, err)
+		}
+		t.Classes[i].Rule.matchers = matchers
+	}
+	return t, nil
+}
+
+func eventClass(name string) (Class, bool) {
+	for _, c := range EventClasses {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return Class{}, false
+}
+
+func classNames(classes []Class) []string {
+	names := make([]string, len(classes))
+	for i, c := range classes {
+		names[i] = c.Name
+	}
+	return names
+}
+
+// String describes where the tap delivers which classes, e.g.
+// "otlp http://otel-collector:4318/v1/logs (oom, security)".
+func (t *Tap) String() string {
+	return fmt.Sprintf("%s %s (%s)", t.Sink.Type, t.Sink.Destination(), strings.Join(classNames(t.Classes), ", "))
+}
+
+// classify returns the first class of t matching labels.
+func (t *Tap) classify(labels query.Labels) (Class, bool) {
+	for _, c := range t.Classes {
+		if query.MatchLabels(c.Rule.matchers, labels) {
+			return c, true
+		}
+	}
+	return Class{}, false
+}
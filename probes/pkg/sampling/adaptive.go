@@ -0,0 +1,128 @@
+package sampling
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"time"
+
+	"probepilot/pkg/query"
+)
+
+// MaxAdaptiveRate bounds how far Adaptive raises a sampling rate.
+const MaxAdaptiveRate = 1024
+
+// adaptiveCalm is how many observations without drops it takes to lower
+// a raised rate.
+const adaptiveCalm = 3
+
+// RegisterAdaptiveFlag defines -adaptive-sampling on fs, the Threshold of
+// NewAdaptive.
+func RegisterAdaptiveFlag(fs *flag.FlagSet) *float64 {
+	return fs.Float64("adaptive-sampling", 0,
+		fmt.Sprintf("ring buffer drops per second above which the in-kernel sampling rate is doubled every report, up to 1 in %d, and halved back toward the configured rate after %d reports without drops (disabled if 0)", MaxAdaptiveRate, adaptiveCalm))
+}
+
+// Adaptive follows the records a probe's ring buffer drops and, given a
+// threshold, the sampling rate they call for: drops past the threshold
+// double the rate, so that data thins out evenly rather than in bursts
+// of lost records, and a run of observations without drops halves it
+// back toward the configured rate. Without a threshold it only counts.
+type Adaptive struct {
+	base, rate uint32
+	threshold  float64
+
+	drops  uint64
+	at     time.Time
+	perSec float64
+	calm   int
+	// raised and lowered count the changes of rate
+	raised, lowered uint64
+}
+
+// NewAdaptive starts at the configured rate base; threshold is in drops
+// per second, 0 for a fixed rate.
+func NewAdaptive(base uint32, threshold float64) (*Adaptive, error) {
+	if threshold < 0 {
+		return nil, fmt.Errorf("invalid -adaptive-sampling %v (want >= 0)", threshold)
+	}
+	base = max(base, 1)
+	return &Adaptive{base: base, rate: base, threshold: threshold}, nil
+}
+
+// Observe takes the drops counted so far at now and returns the rate to
+// sample at, and whether it changed.
+func (a *Adaptive) Observe(drops uint64, now time.Time) (uint32, bool) {
+	if a.at.IsZero() || drops < a.drops {
+		a.drops, a.at = drops, now
+		return a.rate, false
+	}
+	dropped, elapsed := drops-a.drops, now.Sub(a.at).Seconds()
+	a.drops, a.at = drops, now
+	if elapsed <= 0 {
+		return a.rate, false
+	}
+	a.perSec = float64(dropped) / elapsed
+	if a.threshold == 0 {
+		return a.rate, false
+	}
+	switch {
+	case a.perSec > a.threshold && a.rate < MaxAdaptiveRate:
+		a.calm = 0
+		a.rate = min(a.rate*2, MaxAdaptiveRate)
+		a.raised++
+		return a.rate, true
+	case dropped > 0:
+		a.calm = 0
+	case a.rate > a.base:
+		if a.calm++; a.calm >= adaptiveCalm {
+			a.calm = 0
+			a.rate = max(a.rate/2, a.base)
+			a.lowered++
+			return a.rate, true
+		}
+	}
+	return a.rate, false
+}
+
+// Rate is the rate to sample at.
+func (a *Adaptive) Rate() uint32 {
+	return a.rate
+}
+
+// Drops is the records dropped so far.
+func (a *Adaptive) Drops() uint64 {
+	return a.drops
+}
+
+// Labels are those of the sampling_adjusted event announcing a change of
+// rate from prev.
+func (a *Adaptive) Labels(prev uint32) query.Labels {
+	return query.Labels{
+		"type":          "sampling_adjusted",
+		"sampling_rate": strconv.FormatUint(uint64(a.rate), 10),
+		"previous_rate": strconv.FormatUint(uint64(prev), 10),
+		"drops_per_sec": strconv.FormatFloat(a.perSec, 'f', 1, 64),
+	}
+}
+
+// String describes the drops and the rate, e.g. "1200 records dropped
+// (35.0/s), sampling raised to 1 in 8 from 1 in 1".
+func (a *Adaptive) String() string {
+	s := fmt.Sprintf("%d records dropped (%.1f/s)", a.drops, a.perSec)
+	if a.rate != a.base {
+		s += fmt.Sprintf(", sampling raised to 1 in %d from 1 in %d", a.rate, a.base)
+	}
+	return s
+}
+
+// Samples exports the drops and the rate.
+func (a *Adaptive) Samples() []query.Sample {
+	return []query.Sample{
+		{Name: "ringbuf_dropped_records_total", Value: float64(a.drops)},
+		{Name: "ringbuf_drops_per_second", Value: a.perSec},
+		{Name: "sampling_adaptive_rate", Value: float64(a.rate)},
+		{Name: "sampling_rate_changes_total", Labels: query.Labels{"direction": "raised"}, Value: float64(a.raised)},
+		{Name: "sampling_rate_changes_total", Labels: query.Labels{"direction": "lowered"}, Value: float64(a.lowered)},
+	}
+}
@@ -0,0 +1,162 @@
+// Package sampling extrapolates aggregates built from randomly sampled
+// events. A probe sampling at rate N keeps each event with probability
+// 1/N, so counts and sums seen in userspace are roughly 1/N of the truth;
+// the estimates here scale them back up and say how far off they may be,
+// so dashboards do not read sampled counts as absolutes.
+package sampling
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"probepilot/pkg/query"
+)
+
+// z95 is the normal quantile of a two-sided 95% confidence interval.
+const z95 = 1.96
+
+// Confidence grades an estimate by its relative error.
+type Confidence string
+
+const (
+	Exact  Confidence = "exact"
+	High   Confidence = "high"
+	Medium Confidence = "medium"
+	Low    Confidence = "low"
+)
+
+// Counter accumulates the sampled events of one aggregate.
+type Counter struct {
+	Count      uint64
+	Sum        float64
+	SumSquares float64
+}
+
+// Add records one sampled event of size v.
+func (c *Counter) Add(v float64) {
+	c.Count++
+	c.Sum += v
+	c.SumSquares += v * v
+}
+
+// Merge adds the sampled events of o, of another aggregate.
+func (c *Counter) Merge(o Counter) {
+	c.Count += o.Count
+	c.Sum += o.Sum
+	c.SumSquares += o.SumSquares
+}
+
+// Rescale converts the events sampled at rate from into those that would
+// have been sampled at rate to, so that estimates at the new rate still
+// cover the events seen before the change.
+func (c *Counter) Rescale(from, to uint32) {
+	if from == to || from == 0 || to == 0 {
+		return
+	}
+	f := float64(from) / float64(to)
+	c.Count = uint64(math.Round(float64(c.Count) * f))
+	c.Sum *= f
+	c.SumSquares *= f * f
+}
+
+// Estimate is an aggregate extrapolated from sampled events.
+type Estimate struct {
+	// Observed is the value seen in the sampled events.
+	Observed float64
+	// Value is the extrapolated total.
+	Value float64
+	// Error is the half-width of the 95% confidence interval of Value.
+	Error float64
+	// Rate is the sampling rate, 1 in Rate events.
+	Rate uint32
+}
+
+// Sampled reports whether the estimate was extrapolated at all.
+func (e Estimate) Sampled() bool {
+	return e.Rate > 1
+}
+
+// RelativeError is Error as a share of Value.
+func (e Estimate) RelativeError() float64 {
+	if e.Value == 0 {
+		if e.Error == 0 {
+			return 0
+		}
+		return math.Inf(1)
+	}
+	return e.Error / e.Value
+}
+
+// Confidence grades the estimate: within 5% is high, within 20% medium.
+func (e Estimate) Confidence() Confidence {
+	switch rel := e.RelativeError(); {
+	case !e.Sampled():
+		return Exact
+	case rel <= 0.05:
+		return High
+	case rel <= 0.2:
+		return Medium
+	default:
+		return Low
+	}
+}
+
+func (e Estimate) String() string {
+	if !e.Sampled() {
+		return strconv.FormatFloat(e.Value, 'f', -1, 64)
+	}
+	return fmt.Sprintf("~%.0f ±%.0f (sampled 1:%d, %s confidence)", e.Value, e.Error, e.Rate, e.Confidence())
+}
+
+// CountEstimate extrapolates the number of events. With no event seen the
+// error is the rule-of-three bound on how many could have been missed.
+func CountEstimate(c Counter, rate uint32) Estimate {
+	e := Estimate{Observed: float64(c.Count), Rate: rate}
+	if rate <= 1 {
+		e.Value = e.Observed
+		return e
+	}
+	n, p := float64(rate), 1/float64(rate)
+	e.Value = e.Observed * n
+	if c.Count == 0 {
+		e.Error = 3 * n
+		return e
+	}
+	e.Error = z95 * math.Sqrt(e.Observed*(1-p)) * n
+	return e
+}
+
+// SumEstimate extrapolates the sum of event sizes with the Horvitz-Thompson
+// estimator; its variance comes from the sampled sizes' squares.
+func SumEstimate(c Counter, rate uint32) Estimate {
+	e := Estimate{Observed: c.Sum, Rate: rate}
+	if rate <= 1 {
+		e.Value = e.Observed
+		return e
+	}
+	n, p := float64(rate), 1/float64(rate)
+	e.Value = c.Sum * n
+	e.Error = z95 * math.Sqrt(c.SumSquares*(1-p)) * n
+	return e
+}
+
+// Samples exports an aggregate under name. Exact values are exported as
+// is. Sampled ones carry a sampling_rate label and are joined by
+// name_estimate and name_estimate_error, the extrapolated value and its
+// 95% confidence half-width.
+func Samples(name string, labels query.Labels, e Estimate) []query.Sample {
+	if !e.Sampled() {
+		return []query.Sample{{Name: name, Labels: labels, Value: e.Value}}
+	}
+	annotated := make(query.Labels, len(labels)+1)
+	for k, v := range labels {
+		annotated[k] = v
+	}
+	annotated["sampling_rate"] = strconv.FormatUint(uint64(e.Rate), 10)
+	return []query.Sample{
+		{Name: name, Labels: annotated, Value: e.Observed},
+		{Name: name + "_estimate", Labels: annotated, Value: e.Value},
+		{Name: name + "_estimate_error", Labels: annotated, Value: e.Error},
+	}
+}
@@ -0,0 +1,162 @@
+// Package schema versions the documents agents export: routed events,
+// JSON output lines and binary event logs, run summaries, the control
+// protocol, the routing, targeting and configuration files, baselines,
+// the plugin handshake, generic probe specs and leak reports.
+// Each document names its schema and version, e.g. "event/1.1", so
+// collectors and agents of different releases can tell during a rolling
+// upgrade whether they understand each other.
+//
+// Versions follow two rules. A minor bump only adds optional fields, which
+// older readers ignore, so any reader of the same major version accepts a
+// document. A major bump removes, renames or changes the meaning of a
+// field, and readers of another major version reject the document rather
+// than misread it.
+package schema
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Schemas agents write.
+const (
+	// Event is a routed event as delivered to sinks (route.Message).
+	Event = "event"
+	// Summary is the run summary written by -summary-json.
+	Summary = "summary"
+	// Control is the control socket protocol.
+	Control = "control"
+	// Routes is the routing rules file read by -routes.
+	Routes = "routes"
+	// Baseline is a recording written by probepilot baseline record.
+	Baseline = "baseline"
+	// Targets is the targeting file read by -targets.
+	Targets = "targets"
+	// Output is a line written by -output json.
+	Output = "output"
+	// Config is the configuration file read by -config.
+	Config = "config"
+	// Plugin is the handshake a probe plugin prints for -plugin-info.
+	Plugin = "plugin"
+	// EventLog is the header of a binary event log written by -output
+	// binary.
+	EventLog = "eventlog"
+	// Generic is the spec of hooks the generic probe plugin attaches.
+	Generic = "generic"
+	// Leaks is the leak report written by the memory tracker's
+	// -leak-report.
+	Leaks = "leaks"
+)
+
+// current holds the version of each schema this build writes.
+var current = map[string]Version{
+	Event:    {1, 1},
+	Summary:  {1, 0},
+	Control:  {1, 0},
+	Routes:   {1, 0},
+	Baseline: {1, 0},
+	Targets:  {1, 0},
+	Output:   {1, 0},
+	Config:   {1, 0},
+	Plugin:   {1, 0},
+	EventLog: {1, 0},
+	Generic:  {1, 0},
+	Leaks:    {1, 0},
+}
+
+// Header carries the schema tag of HTTP deliveries and responses.
+const Header = "X-Probepilot-Schema"
+
+// ErrIncompatible reports a document of a major version the reader does
+// not understand.
+var ErrIncompatible = errors.New("incompatible schema version")
+
+// Version is a major.minor schema version.
+type Version struct {
+	Major, Minor int
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+// ParseVersion parses "1" or "1.2".
+func ParseVersion(s string) (Version, error) {
+	major, minor, hasMinor := strings.Cut(strings.TrimPrefix(s, "v"), ".")
+	var v Version
+	var err error
+	if v.Major, err = strconv.Atoi(major); err != nil || v.Major < 1 {
+		return Version{}, fmt.Errorf("invalid schema version %q", s)
+	}
+	if hasMinor {
+		if v.Minor, err = strconv.Atoi(minor); err != nil || v.Minor < 0 {
+			return Version{}, fmt.Errorf("invalid schema version %q", s)
+		}
+	}
+	return v, nil
+}
+
+// Accepts reports whether a reader at v understands documents written at
+// doc: both share the major version.
+func (v Version) Accepts(doc Version) bool {
+	return v.Major == doc.Major
+}
+
+// Current returns the version of schema this build writes.
+func Current(schema string) Version {
+	v, ok := current[schema]
+	if !ok {
+		panic("schema: unknown schema " + schema)
+	}
+	return v
+}
+
+// Tag returns the tag documents of schema carry, e.g. "event/1.1".
+func Tag(schema string) string {
+	return schema + "/" + Current(schema).String()
+}
+
+// ParseTag splits a tag such as "event/1.0" into schema and version.
+func ParseTag(tag string) (string, Version, error) {
+	name, ver, ok := strings.Cut(tag, "/")
+	if !ok || name == "" {
+		return "", Version{}, fmt.Errorf("invalid schema tag %q (want name/version, e.g. %s)", tag, Tag(Event))
+	}
+	v, err := ParseVersion(ver)
+	if err != nil {
+		return "", Version{}, err
+	}
+	return name, v, nil
+}
+
+// Check validates the tag of a document that should be of schema against
+// what this build reads. An empty tag predates versioning and is read as
+// version 1.0.
+func Check(schema, tag string) error {
+	if tag == "" {
+		tag = schema + "/1.0"
+	}
+	name, v, err := ParseTag(tag)
+	if err != nil {
+		return err
+	}
+	if name != schema {
+		return fmt.Errorf("schema %q is not %q", name, schema)
+	}
+	if cur := Current(schema); !cur.Accepts(v) {
+		return fmt.Errorf("%w: %s %s, this build reads %s %d.x", ErrIncompatible, schema, v, schema, cur.Major)
+	}
+	return nil
+}
+
+// CheckReader validates that a peer reading schema at version peer
+// understands what this build writes, e.g. a collector pinned to an event
+// schema.
+func CheckReader(schema string, peer Version) error {
+	if cur := Current(schema); !peer.Accepts(cur) {
+		return fmt.Errorf("%w: peer reads %s %d.x, this build writes %s", ErrIncompatible, schema, peer.Major, Tag(schema))
+	}
+	return nil
+}
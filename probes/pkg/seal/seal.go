@@ -0,0 +1,203 @@
+// Package seal encrypts files the agents keep on disk, such as spooled
+// export batches and memory snapshots, which hold command lines, paths
+// and addresses that may be sensitive at rest. Files are sealed with
+// AES-256-GCM under a key named by a spec:
+//
+//	env:PROBEPILOT_SEAL_KEY        the key in an environment variable
+//	file:/etc/probepilot/seal.key  the key in a file, e.g. one a secrets
+//	                               manager or KMS agent keeps current
+//	exec:/usr/local/bin/get-key    the output of a command, e.g. one that
+//	                               asks a KMS to decrypt a wrapped key
+//
+// A key is 32 bytes, given raw or as hex or base64. A sealed file is
+// Magic, a random nonce and the ciphertext; files written a record at a
+// time hold one sealed record per line, base64-encoded, so they can still
+// be appended to. probepilot unseal decrypts either.
+package seal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Magic starts every sealed file.
+const Magic = "ppseal1\n"
+
+// execTimeout bounds how long an exec: key command may take.
+const execTimeout = 30 * time.Second
+
+// Key seals and opens data. It is safe for concurrent use.
+type Key struct {
+	spec string
+	aead cipher.AEAD
+}
+
+// ValidSpec checks the syntax of a key spec without loading the key.
+func ValidSpec(spec string) error {
+	kind, arg, ok := strings.Cut(spec, ":")
+	if !ok || arg == "" {
+		return fmt.Errorf("invalid key %q (want env:VAR, file:PATH or exec:COMMAND)", spec)
+	}
+	switch kind {
+	case "env", "file":
+		return nil
+	case "exec":
+		if len(strings.Fields(arg)) == 0 {
+			return fmt.Errorf("invalid key %q: no command to run", spec)
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid key %q: unknown source %q (want env, file or exec)", spec, kind)
+}
+
+// Load reads the key spec names, or returns a nil Key if spec is empty.
+func Load(spec string) (*Key, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	if err := ValidSpec(spec); err != nil {
+		return nil, err
+	}
+	kind, arg, _ := strings.Cut(spec, ":")
+	var material []byte
+	switch kind {
+	case "env":
+		v, ok := os.LookupEnv(arg)
+		if !ok {
+			return nil, fmt.Errorf("key %s: $%s is not set", spec, arg)
+		}
+		material = []byte(v)
+	case "file":
+		data, err := os.ReadFile(arg)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %v", spec, err)
+		}
+		material = data
+	case "exec":
+		ctx, cancel := context.WithTimeout(context.Background(), execTimeout)
+		defer cancel()
+		fields := strings.Fields(arg)
+		out, err := exec.CommandContext(ctx, fields[0], fields[1:]...).Output()
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %v", spec, err)
+		}
+		material = out
+	}
+	key, err := decodeKey(material)
+	if err != nil {
+		return nil, fmt.Errorf("key %s: %v", spec, err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("key %s: %v", spec, err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("key %s: %v", spec, err)
+	}
+	return &Key{spec: spec, aead: aead}, nil
+}
+
+// decodeKey reads 32 key bytes, raw or as hex or base64.
+func decodeKey(material []byte) ([]byte, error) {
+	if len(material) == 32 {
+		return material, nil
+	}
+	s := strings.TrimSpace(string(material))
+	if key, err := hex.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, errors.New("want 32 bytes, raw or as hex or base64")
+}
+
+// String names k by its spec, never the key itself.
+func (k *Key) String() string {
+	return "AES-256-GCM under " + k.spec
+}
+
+// Seal encrypts data into a sealed file.
+func (k *Key) Seal(data []byte) []byte {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic("seal: no randomness: " + err.Error())
+	}
+	out := make([]byte, 0, len(Magic)+len(nonce)+len(data)+k.aead.Overhead())
+	out = append(append(out, Magic...), nonce...)
+	return k.aead.Seal(out, nonce, data, []byte(Magic))
+}
+
+// Open decrypts a sealed file.
+func (k *Key) Open(sealed []byte) ([]byte, error) {
+	if !IsSealed(sealed) {
+		return nil, errors.New("not sealed")
+	}
+	rest := sealed[len(Magic):]
+	if len(rest) < k.aead.NonceSize() {
+		return nil, errors.New("sealed data truncated")
+	}
+	nonce, ciphertext := rest[:k.aead.NonceSize()], rest[k.aead.NonceSize():]
+	data, err := k.aead.Open(nil, nonce, ciphertext, []byte(Magic))
+	if err != nil {
+		return nil, errors.New("sealed data corrupt or sealed under another key")
+	}
+	return data, nil
+}
+
+// SealLine encrypts one record of a file written a record at a time: the
+// sealed record, base64-encoded and newline-terminated.
+func (k *Key) SealLine(record []byte) []byte {
+	sealed := k.Seal(record)
+	line := make([]byte, base64.StdEncoding.EncodedLen(len(sealed))+1)
+	base64.StdEncoding.Encode(line, sealed)
+	line[len(line)-1] = '\n'
+	return line
+}
+
+// OpenFile decrypts the content of a sealed file, whole or a record per
+// line, whose records are concatenated.
+func (k *Key) OpenFile(data []byte) ([]byte, error) {
+	if IsSealed(data) {
+		return k.Open(data)
+	}
+	var out bytes.Buffer
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(make([]byte, 64*1024), 64<<20)
+	for n := 1; sc.Scan(); n++ {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		sealed, err := base64.StdEncoding.DecodeString(sc.Text())
+		if err != nil {
+			return nil, fmt.Errorf("line %d: not a sealed record", n)
+		}
+		record, err := k.Open(sealed)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		out.Write(record)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// IsSealed reports whether data is a sealed file.
+func IsSealed(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(Magic))
+}
@@ -0,0 +1,402 @@
+// Package selftest validates the probes end to end on a new host. It runs
+// workloads whose behaviour is known in advance, a leaky allocator, a CPU
+// burner, a TCP client whose connections are forced into retransmits and
+// one sending over a veth pair that netem delays and drops packets on,
+// and checks through each agent's query API that the probe saw what the
+// workload did, within a tolerance.
+//
+// Every workload runs in a child process so the probes see it as a task
+// of its own. Options.Command starts the calling program again with
+// WorkloadEnv naming the workload; that program must hand control to
+// RunWorkload. The child reports the label value the probe will know it
+// by, waits for the parent to read the agent's starting value, runs, and
+// stays alive until the parent is done measuring.
+package selftest
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"probepilot/pkg/baseline"
+	"probepilot/pkg/query"
+)
+
+// WorkloadEnv names the workload a child process started by Run performs.
+const WorkloadEnv = "PROBEPILOT_SELFTEST_WORKLOAD"
+
+// Workloads.
+const (
+	Leak       = "leak"
+	Burn       = "burn"
+	Retransmit = "retransmit"
+	Veth       = "veth"
+)
+
+// cpuSampleRate is the frequency of the CPU profiler's perf event, which
+// samples a busy thread that many times per second.
+const cpuSampleRate = 99
+
+// Options configure a self-test.
+type Options struct {
+	// Command starts this program in workload mode, e.g. the executable
+	// and the subcommand that calls RunWorkload.
+	Command []string
+	// Query API addresses of the agents to test, as for their -listen
+	// flag; agents left empty are skipped.
+	Memory, CPU, TCP string
+
+	// LeakBytes is how much memory the allocator leaks, touching every
+	// page of it.
+	LeakBytes uint64
+	// Burn is how long the CPU burner spins.
+	Burn time.Duration
+	// Connections is how many connections the TCP client opens to a
+	// listener whose accept queue is full; each retransmits its SYN. The
+	// veth checks open as many.
+	Connections int
+
+	// Veth also checks the TCP flow monitor over a veth pair into a
+	// network namespace: its flows, bytes, RTT and retransmits. Each
+	// connection sends VethBytes, netem delays them by VethDelay, and
+	// for retransmits drops VethLoss percent of the packets.
+	Veth      bool
+	VethBytes uint64
+	VethDelay time.Duration
+	VethLoss  float64
+
+	// Tolerance is the relative error allowed between what a workload did
+	// and what its probe reports, e.g. 0.25.
+	Tolerance float64
+	// Timeout bounds how long to wait for a probe to catch up after its
+	// workload finished.
+	Timeout time.Duration
+}
+
+// DefaultOptions leak 64 MiB, burn 3s and open 4 connections, which
+// over a veth pair send 1 MiB each, delayed by 20ms, losing 5% of their
+// packets for retransmits.
+var DefaultOptions = Options{
+	LeakBytes:   64 << 20,
+	Burn:        3 * time.Second,
+	Connections: 4,
+	VethBytes:   1 << 20,
+	VethDelay:   20 * time.Millisecond,
+	VethLoss:    5,
+	Tolerance:   0.25,
+	Timeout:     30 * time.Second,
+}
+
+// Result is the outcome of one workload.
+type Result struct {
+	Workload string
+	Agent    string
+	Metric   string
+	// Expected is what the workload did in the metric's unit and
+	// Measured how much the metric moved while it ran.
+	Expected, Measured float64
+	// AtLeast is set for checks that only bound Measured from below.
+	AtLeast bool
+	Pass    bool
+	Err     error
+	// Hint suggests what to look at when the check fails.
+	Hint string
+}
+
+func (r Result) String() string {
+	switch {
+	case r.Err != nil:
+		return fmt.Sprintf("%s: %v", r.Workload, r.Err)
+	case r.AtLeast:
+		return fmt.Sprintf("%s: %s moved %g, want at least %g", r.Workload, r.Metric, r.Measured, r.Expected)
+	}
+	return fmt.Sprintf("%s: %s moved %g, want %g", r.Workload, r.Metric, r.Measured, r.Expected)
+}
+
+// check pairs a workload with the metric its probe reports it in.
+type check struct {
+	workload string
+	agent    string
+	addr     string
+	metric   string
+	// label is the label the workload's ready value is matched against.
+	label    string
+	arg      string
+	expected float64
+	atLeast  bool
+	// count measures how many samples match, e.g. flows, rather than
+	// their sum.
+	count bool
+	hint  string
+}
+
+func (o Options) checks() []check {
+	var checks []check
+	if o.Memory != "" {
+		// The tracker counts what mmap maps; page faults are counted
+		// apart, not as allocations
+		checks = append(checks, check{
+			workload: Leak,
+			agent:    "memory-tracker",
+			addr:     o.Memory,
+			metric:   "process_memory_allocated_total",
+			label:    "pid",
+			arg:      strconv.FormatUint(o.LeakBytes, 10),
+			expected: float64(o.LeakBytes),
+			hint:     "mmap is traced by the core syscalls/sys_enter_mmap and sys_exit_mmap tracepoints; check the tracker attached them",
+		})
+	}
+	if o.CPU != "" {
+		checks = append(checks, check{
+			workload: Burn,
+			agent:    "cpu-profiler",
+			addr:     o.CPU,
+			metric:   "process_cpu_samples_total",
+			label:    "pid",
+			arg:      o.Burn.String(),
+			expected: math.Round(o.Burn.Seconds() * cpuSampleRate),
+			hint:     "samples come from a perf event, counted in BPF and read every -report-interval; check the profiler attached it",
+		})
+	}
+	if o.TCP != "" {
+		checks = append(checks, check{
+			workload: Retransmit,
+			agent:    "tcp-flow",
+			addr:     o.TCP,
+			metric:   "tcp_flow_retransmits_total",
+			label:    "dport",
+			arg:      strconv.Itoa(o.Connections),
+			expected: float64(o.Connections),
+			atLeast:  true,
+			hint:     "loopback flows must not be filtered out of the monitor",
+		})
+		if o.Veth {
+			checks = append(checks, o.vethChecks()...)
+		}
+	}
+	return checks
+}
+
+// Run runs the workload of every configured agent in turn and checks its
+// probe. It returns an error only if no agent is configured.
+func Run(ctx context.Context, opts Options) ([]Result, error) {
+	checks := opts.checks()
+	if len(checks) == 0 {
+		return nil, errors.New("no agent to test")
+	}
+	if len(opts.Command) == 0 {
+		return nil, errors.New("no command to start workloads with")
+	}
+	results := make([]Result, 0, len(checks))
+	for _, c := range checks {
+		r := Result{Workload: c.workload, Agent: c.agent, Metric: c.metric, Expected: c.expected, AtLeast: c.atLeast}
+		r.Measured, r.Err = c.run(ctx, opts)
+		if r.Err == nil {
+			r.Pass = c.pass(r.Measured, opts.Tolerance)
+		}
+		if !r.Pass {
+			r.Hint = c.hint
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+func (c check) pass(measured, tolerance float64) bool {
+	if c.atLeast {
+		return measured >= c.expected
+	}
+	return math.Abs(measured-c.expected) <= tolerance*c.expected
+}
+
+// run starts the workload, runs it and returns how far the metric moved,
+// waiting up to opts.Timeout for it to pass.
+func (c check) run(ctx context.Context, opts Options) (float64, error) {
+	child, err := startWorkload(ctx, opts.Command, c.workload)
+	if err != nil {
+		return 0, err
+	}
+	defer child.stop()
+
+	id, err := child.expect("ready")
+	if err != nil {
+		return 0, err
+	}
+	labels := query.Labels{c.label: id}
+	scraper := baseline.NewScraper(c.addr)
+	before, err := c.measure(scraper, labels)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", c.agent, err)
+	}
+
+	if err := child.send("start " + c.arg); err != nil {
+		return 0, err
+	}
+	if _, err := child.expect("done"); err != nil {
+		return 0, err
+	}
+
+	// Events reach the agent through its ring buffer; poll until the
+	// metric passes or the probe had its time
+	deadline := time.Now().Add(opts.Timeout)
+	for {
+		after, err := c.measure(scraper, labels)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", c.agent, err)
+		}
+		measured := after - before
+		if c.pass(measured, opts.Tolerance) || !time.Now().Before(deadline) {
+			return measured, nil
+		}
+		select {
+		case <-ctx.Done():
+			return measured, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// measure adds up, or counts, the samples of the check's metric carrying
+// labels.
+func (c check) measure(s *baseline.Scraper, labels query.Labels) (float64, error) {
+	samples, err := s.Samples()
+	if err != nil {
+		return 0, err
+	}
+	var total float64
+	for _, sample := range samples {
+		if sample.Name != c.metric {
+			continue
+		}
+		match := true
+		for name, value := range labels {
+			if sample.Labels[name] != value {
+				match = false
+				break
+			}
+		}
+		switch {
+		case match && c.count:
+			total++
+		case match:
+			total += sample.Value
+		}
+	}
+	return total, nil
+}
+
+// workloadProcess is a running workload child, driven over its stdin and
+// stdout one line at a time.
+type workloadProcess struct {
+	name  string
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	lines *bufio.Scanner
+}
+
+func startWorkload(ctx context.Context, command []string, name string) (*workloadProcess, error) {
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Env = append(os.Environ(), WorkloadEnv+"="+name)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("starting %s workload: %w", name, err)
+	}
+	return &workloadProcess{name: name, cmd: cmd, stdin: stdin, lines: bufio.NewScanner(stdout)}, nil
+}
+
+func (w *workloadProcess) send(line string) error {
+	if _, err := fmt.Fprintln(w.stdin, line); err != nil {
+		return fmt.Errorf("%s workload: %w", w.name, err)
+	}
+	return nil
+}
+
+// expect reads the next line, which must be verb followed by an optional
+// value, and returns the value. A workload that failed says error instead.
+func (w *workloadProcess) expect(verb string) (string, error) {
+	if !w.lines.Scan() {
+		if err := w.lines.Err(); err != nil {
+			return "", fmt.Errorf("%s workload: %w", w.name, err)
+		}
+		return "", fmt.Errorf("%s workload exited early", w.name)
+	}
+	got, value, _ := strings.Cut(w.lines.Text(), " ")
+	switch got {
+	case verb:
+		return value, nil
+	case "error":
+		return "", fmt.Errorf("%s workload: %s", w.name, value)
+	}
+	return "", fmt.Errorf("%s workload: got %q, want %s", w.name, w.lines.Text(), verb)
+}
+
+// stop lets the workload exit, releasing what it held on to.
+func (w *workloadProcess) stop() {
+	w.stdin.Close()
+	w.cmd.Wait()
+}
+
+// RunWorkload performs the named workload as the child of Run, reading
+// its commands from in and answering on out.
+func RunWorkload(name string, in io.Reader, out io.Writer) error {
+	lines := bufio.NewScanner(in)
+	w, err := newWorkload(name)
+	if err != nil {
+		fmt.Fprintf(out, "error %v\n", err)
+		return err
+	}
+	// Workloads holding on to more than memory, e.g. a network namespace,
+	// release it on exit
+	if c, ok := w.(io.Closer); ok {
+		defer c.Close()
+	}
+	id, err := w.ready()
+	if err != nil {
+		fmt.Fprintf(out, "error %v\n", err)
+		return err
+	}
+	fmt.Fprintf(out, "ready %s\n", id)
+
+	if !lines.Scan() {
+		return lines.Err()
+	}
+	arg, ok := strings.CutPrefix(lines.Text(), "start ")
+	if !ok {
+		return fmt.Errorf("unexpected command %q", lines.Text())
+	}
+	if err := w.run(arg); err != nil {
+		fmt.Fprintf(out, "error %v\n", err)
+		return err
+	}
+	fmt.Fprintln(out, "done")
+
+	// Hold on to whatever the workload leaked until the parent measured it
+	for lines.Scan() {
+	}
+	return nil
+}
+
+// workload is one of the known patterns.
+type workload interface {
+	// ready prepares the workload and returns the label value its probe
+	// will report it under.
+	ready() (string, error)
+	// run performs the workload with the argument sent by the parent.
+	run(arg string) error
+}
@@ -0,0 +1,105 @@
+package selftest
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// vethWorkload is what the veth workload does, as the parent sends it.
+type vethWorkload struct {
+	// Connections each send Bytes from the host to a listener in the
+	// namespace.
+	Connections int
+	Bytes       uint64
+	// Delay and Loss, a percentage, are netem's on the host's end of the
+	// pair, so they apply to the data and not to its acknowledgements.
+	Delay time.Duration
+	Loss  float64
+}
+
+func (v vethWorkload) String() string {
+	return fmt.Sprintf("connections=%d bytes=%d delay=%s loss=%g", v.Connections, v.Bytes, v.Delay, v.Loss)
+}
+
+func parseVethWorkload(arg string) (vethWorkload, error) {
+	var v vethWorkload
+	for _, field := range strings.Fields(arg) {
+		name, value, _ := strings.Cut(field, "=")
+		var err error
+		switch name {
+		case "connections":
+			v.Connections, err = strconv.Atoi(value)
+		case "bytes":
+			v.Bytes, err = strconv.ParseUint(value, 10, 64)
+		case "delay":
+			v.Delay, err = time.ParseDuration(value)
+		case "loss":
+			v.Loss, err = strconv.ParseFloat(value, 64)
+		default:
+			return v, fmt.Errorf("unknown veth workload setting %q", name)
+		}
+		if err != nil {
+			return v, fmt.Errorf("veth workload %s: %w", name, err)
+		}
+	}
+	return v, nil
+}
+
+// vethChecks run the TCP flow monitor's checks over a veth pair into a
+// network namespace, each with a pair of its own: the flows and bytes of
+// connections, the RTT netem delays them by and the retransmits of the
+// packets it drops.
+func (o Options) vethChecks() []check {
+	clean := vethWorkload{Connections: o.Connections, Bytes: o.VethBytes, Delay: o.VethDelay}
+	single := clean
+	single.Connections = 1
+	lossy := clean
+	lossy.Loss = o.VethLoss
+	const sampled = "the monitor must send every event, -sampling-rate 1, for exact counts"
+	return []check{
+		{
+			workload: Veth,
+			agent:    "tcp-flow",
+			addr:     o.TCP,
+			metric:   "tcp_flow_bytes_tx",
+			label:    "dport",
+			arg:      clean.String(),
+			expected: float64(clean.Connections),
+			count:    true,
+			hint:     "every connection must be a flow of its own, keyed by both endpoints",
+		},
+		{
+			workload: Veth,
+			agent:    "tcp-flow",
+			addr:     o.TCP,
+			metric:   "tcp_flow_bytes_tx",
+			label:    "dport",
+			arg:      clean.String(),
+			expected: float64(clean.Bytes) * float64(clean.Connections),
+			hint:     "bytes are counted from tcp_sendmsg events; " + sampled,
+		},
+		{
+			workload: Veth,
+			agent:    "tcp-flow",
+			addr:     o.TCP,
+			metric:   "tcp_flow_rtt_avg_seconds",
+			label:    "dport",
+			arg:      single.String(),
+			expected: single.Delay.Seconds(),
+			hint:     "RTTs are the sockets' smoothed RTT, in seconds; netem must delay the host's end of the pair",
+		},
+		{
+			workload: Veth,
+			agent:    "tcp-flow",
+			addr:     o.TCP,
+			metric:   "tcp_flow_retransmits_total",
+			label:    "dport",
+			arg:      lossy.String(),
+			expected: float64(lossy.Connections),
+			atLeast:  true,
+			hint:     "retransmits come from the tcp_retransmit_skb tracepoint; netem must drop packets on the host's end of the pair",
+		},
+	}
+}
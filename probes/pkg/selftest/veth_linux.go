@@ -0,0 +1,189 @@
+//go:build linux
+
+package selftest
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// The veth pair's /30: the host's end and the namespace's.
+const (
+	vethHostAddr = "10.213.0.1"
+	vethPeerAddr = "10.213.0.2"
+	vethPrefix   = 30
+)
+
+// vethPair sends data from the host to a listener in a network namespace
+// of its own over a veth pair, shaped by netem. It sets both up with ip
+// and tc from iproute2, and deletes them on Close.
+type vethPair struct {
+	netns      string
+	host, peer string
+	listener   net.Listener
+	conns      []net.Conn
+}
+
+func newVethPair() *vethPair {
+	pid := strconv.Itoa(os.Getpid())
+	return &vethPair{netns: "probepilot-selftest-" + pid, host: "ppst" + pid + "h", peer: "ppst" + pid + "n"}
+}
+
+// iproute runs an iproute2 command, returning its output in the error.
+func iproute(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %w: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (v *vethPair) ready() (string, error) {
+	for _, tool := range []string{"ip", "tc"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return "", fmt.Errorf("the veth workload needs iproute2: %w", err)
+		}
+	}
+	// RunWorkload closes the pair, however far setting it up got
+	if err := v.setUp(); err != nil {
+		return "", err
+	}
+	l, err := v.listen()
+	if err != nil {
+		return "", err
+	}
+	v.listener = l
+	go v.serve()
+	return strconv.Itoa(l.Addr().(*net.TCPAddr).Port), nil
+}
+
+// setUp creates the namespace and the pair, and addresses both ends
+func (v *vethPair) setUp() error {
+	peer := fmt.Sprintf("%s/%d", vethPeerAddr, vethPrefix)
+	host := fmt.Sprintf("%s/%d", vethHostAddr, vethPrefix)
+	for _, args := range [][]string{
+		{"netns", "add", v.netns},
+		{"link", "add", v.host, "type", "veth", "peer", "name", v.peer},
+		{"link", "set", v.peer, "netns", v.netns},
+		{"addr", "add", host, "dev", v.host},
+		{"link", "set", v.host, "up"},
+		{"-n", v.netns, "addr", "add", peer, "dev", v.peer},
+		{"-n", v.netns, "link", "set", v.peer, "up"},
+		{"-n", v.netns, "link", "set", "lo", "up"},
+	} {
+		if err := iproute("ip", args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listen opens a listener in the namespace: a socket belongs to the
+// namespace of the thread that created it
+func (v *vethPair) listen() (net.Listener, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	self, err := os.Open("/proc/thread-self/ns/net")
+	if err != nil {
+		return nil, err
+	}
+	defer self.Close()
+	ns, err := os.Open("/run/netns/" + v.netns)
+	if err != nil {
+		return nil, err
+	}
+	defer ns.Close()
+	if err := unix.Setns(int(ns.Fd()), unix.CLONE_NEWNET); err != nil {
+		return nil, fmt.Errorf("entering %s: %w", v.netns, err)
+	}
+	l, listenErr := net.Listen("tcp", net.JoinHostPort(vethPeerAddr, "0"))
+	if err := unix.Setns(int(self.Fd()), unix.CLONE_NEWNET); err != nil {
+		// The thread is stuck in the namespace; locked, it exits with
+		// its goroutine instead of going back to the scheduler
+		runtime.LockOSThread()
+		if l != nil {
+			l.Close()
+		}
+		return nil, fmt.Errorf("leaving %s: %w", v.netns, err)
+	}
+	return l, listenErr
+}
+
+// serve reads every connection to its end
+func (v *vethPair) serve() {
+	for {
+		conn, err := v.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		}()
+	}
+}
+
+func (v *vethPair) run(arg string) error {
+	w, err := parseVethWorkload(arg)
+	if err != nil {
+		return err
+	}
+	if w.Delay > 0 || w.Loss > 0 {
+		netem := []string{"qdisc", "replace", "dev", v.host, "root", "netem",
+			"delay", fmt.Sprintf("%dus", w.Delay.Microseconds()), "loss", fmt.Sprintf("%g%%", w.Loss)}
+		if err := iproute("tc", netem...); err != nil {
+			return err
+		}
+	}
+	addr := net.JoinHostPort(vethPeerAddr, strconv.Itoa(v.listener.Addr().(*net.TCPAddr).Port))
+	data := make([]byte, w.Bytes)
+	errs := make(chan error, w.Connections)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < w.Connections; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				errs <- err
+				return
+			}
+			// Connections stay open until the parent measured them, so
+			// the monitor still tracks their flows
+			mu.Lock()
+			v.conns = append(v.conns, conn)
+			mu.Unlock()
+			if _, err := conn.Write(data); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// Close closes the connections and the listener, then deletes the pair
+// and the namespace.
+func (v *vethPair) Close() error {
+	for _, conn := range v.conns {
+		conn.Close()
+	}
+	if v.listener != nil {
+		v.listener.Close()
+	}
+	// Deleting either end deletes the pair, which is gone already when
+	// setting up failed before creating it
+	iproute("ip", "link", "del", v.host)
+	return iproute("ip", "netns", "del", v.netns)
+}
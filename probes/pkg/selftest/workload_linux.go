@@ -0,0 +1,179 @@
+//go:build linux
+
+package selftest
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func newWorkload(name string) (workload, error) {
+	switch name {
+	case Leak:
+		return &leaker{}, nil
+	case Burn:
+		return &burner{start: make(chan time.Duration), done: make(chan struct{})}, nil
+	case Retransmit:
+		return &retransmitter{}, nil
+	case Veth:
+		return newVethPair(), nil
+	}
+	return nil, fmt.Errorf("unknown workload %q", name)
+}
+
+// leakChunk is how much the allocator maps at a time.
+const leakChunk = 4 << 20
+
+// leaker maps anonymous memory and touches every page of it, never
+// unmapping it.
+type leaker struct {
+	chunks [][]byte
+}
+
+func (l *leaker) ready() (string, error) {
+	return strconv.Itoa(os.Getpid()), nil
+}
+
+func (l *leaker) run(arg string) error {
+	total, err := strconv.ParseUint(arg, 10, 64)
+	if err != nil {
+		return fmt.Errorf("leak size: %w", err)
+	}
+	page := os.Getpagesize()
+	for left := total; left > 0; {
+		n := uint64(leakChunk)
+		if left < n {
+			n = left
+		}
+		b, err := unix.Mmap(-1, 0, int(n), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+		if err != nil {
+			return fmt.Errorf("mmap: %w", err)
+		}
+		// One fault per page: a transparent huge page would take a whole
+		// chunk in one
+		if err := unix.Madvise(b, unix.MADV_NOHUGEPAGE); err != nil {
+			return fmt.Errorf("madvise: %w", err)
+		}
+		for i := 0; i < len(b); i += page {
+			b[i] = 1
+		}
+		l.chunks = append(l.chunks, b)
+		left -= n
+	}
+	return nil
+}
+
+// burner spins one OS thread of its otherwise idle process, whose PID the
+// CPU profiler counts its samples under, through burnOuter and burnInner
+// so stack profiles show a known stack.
+type burner struct {
+	start chan time.Duration
+	done  chan struct{}
+}
+
+func (b *burner) ready() (string, error) {
+	go func() {
+		// The goroutine exits with the thread locked, which ends the
+		// thread too
+		runtime.LockOSThread()
+		burnOuter(<-b.start)
+		close(b.done)
+	}()
+	return strconv.Itoa(os.Getpid()), nil
+}
+
+func (b *burner) run(arg string) error {
+	d, err := time.ParseDuration(arg)
+	if err != nil {
+		return fmt.Errorf("burn duration: %w", err)
+	}
+	b.start <- d
+	<-b.done
+	return nil
+}
+
+var burnSink uint64
+
+//go:noinline
+func burnOuter(d time.Duration) {
+	var x uint64
+	for deadline := time.Now().Add(d); time.Now().Before(deadline); {
+		x = burnInner(x)
+	}
+	burnSink = x
+}
+
+//go:noinline
+func burnInner(x uint64) uint64 {
+	for i := 0; i < 1<<16; i++ {
+		x = x*6364136223846793005 + 1442695040888963407
+	}
+	return x
+}
+
+// synWait is how long each client connection waits; SYNs are
+// retransmitted after 1s and 3s.
+const synWait = 3500 * time.Millisecond
+
+// retransmitter listens on loopback with an accept queue of one that it
+// never drains. Once a first connection fills the queue the kernel drops
+// further SYNs, and their clients retransmit them.
+type retransmitter struct {
+	addr string
+}
+
+func (r *retransmitter) ready() (string, error) {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return "", fmt.Errorf("socket: %w", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		unix.Close(fd)
+		return "", fmt.Errorf("bind: %w", err)
+	}
+	if err := unix.Listen(fd, 0); err != nil {
+		unix.Close(fd)
+		return "", fmt.Errorf("listen: %w", err)
+	}
+	sa, err := unix.Getsockname(fd)
+	if err != nil {
+		unix.Close(fd)
+		return "", fmt.Errorf("getsockname: %w", err)
+	}
+	port := sa.(*unix.SockaddrInet4).Port
+	r.addr = net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	return strconv.Itoa(port), nil
+}
+
+func (r *retransmitter) run(arg string) error {
+	n, err := strconv.Atoi(arg)
+	if err != nil {
+		return fmt.Errorf("connections: %w", err)
+	}
+	filler, err := net.Dial("tcp", r.addr)
+	if err != nil {
+		return fmt.Errorf("filling the accept queue: %w", err)
+	}
+	defer filler.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Timing out is the point
+			if conn, err := net.DialTimeout("tcp", r.addr, synWait); err == nil {
+				conn.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package selftest
+
+import "errors"
+
+func newWorkload(string) (workload, error) {
+	return nil, errors.New("selftest workloads need Linux")
+}
@@ -0,0 +1,141 @@
+// Package service names the endpoints of connections after the logical
+// services they belong to, so traffic can be reported as a matrix of
+// services talking to each other rather than as raw address and port
+// tuples.
+//
+// A services file maps ports, addresses and container labels to names;
+// the first rule an endpoint matches names it:
+//
+//	{
+//	  "services": [
+//	    {"name": "postgres", "ports": "5432"},
+//	    {"name": "redis", "ports": "6379", "addrs": "10.0.4.0/24"},
+//	    {"name": "api", "labels": {"app": "api"}},
+//	    {"name": "web", "labels": {"com.docker.compose.service": "web"}}
+//	  ]
+//	}
+//
+// Ports and addrs take the syntax of policy files, and labels must all be
+// on the container of the endpoint's process, so they only name the
+// endpoints of processes on this host; an omitted field matches anything.
+// Endpoints no rule matches are Unknown.
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+
+	"probepilot/pkg/policy"
+)
+
+// Unknown names the endpoints no rule matches.
+const Unknown = "unknown"
+
+// Endpoint is one end of a connection. Labels are those of the container
+// of the process owning it, nil for remote endpoints.
+type Endpoint struct {
+	Addr   netip.Addr
+	Port   uint16
+	Labels map[string]string
+}
+
+// Rule names the endpoints it matches.
+type Rule struct {
+	Name   string            `json:"name"`
+	Ports  string            `json:"ports,omitempty"`
+	Addrs  string            `json:"addrs,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+
+	ports policy.Ports
+	addrs netip.Prefix
+}
+
+func (r *Rule) compile() error {
+	if r.Name == "" {
+		return fmt.Errorf("no name")
+	}
+	if r.Ports == "" && r.Addrs == "" && len(r.Labels) == 0 {
+		return fmt.Errorf("no ports, addrs or labels, every endpoint would match")
+	}
+	var err error
+	if r.ports, err = policy.ParsePorts(r.Ports); err != nil {
+		return fmt.Errorf("ports: %v", err)
+	}
+	if r.addrs, err = policy.ParsePrefix(r.Addrs); err != nil {
+		return fmt.Errorf("addrs: %v", err)
+	}
+	return nil
+}
+
+// Matches reports whether r names e.
+func (r Rule) Matches(e Endpoint) bool {
+	if !r.ports.Contains(e.Port) || !policy.MatchPrefix(r.addrs, e.Addr) {
+		return false
+	}
+	for k, v := range r.Labels {
+		if got, ok := e.Labels[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Map is the rules of a services file.
+type Map struct {
+	Services []Rule `json:"services"`
+}
+
+// Load reads and validates the services file at path, or returns a nil
+// Map if path is empty.
+func Load(path string) (*Map, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var m Map
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&m); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(m.Services) == 0 {
+		return nil, fmt.Errorf("%s: no services", path)
+	}
+	for i := range m.Services {
+		if err := m.Services[i].compile(); err != nil {
+			return nil, fmt.Errorf("%s: service %d (%s): %v", path, i+1, m.Services[i].Name, err)
+		}
+	}
+	return &m, nil
+}
+
+// Name returns the service of e, Unknown if no rule matches it.
+func (m *Map) Name(e Endpoint) string {
+	for _, r := range m.Services {
+		if r.Matches(e) {
+			return r.Name
+		}
+	}
+	return Unknown
+}
+
+// NeedsLabels reports whether any rule matches labels, which are then
+// worth looking up for local endpoints.
+func (m *Map) NeedsLabels() bool {
+	for _, r := range m.Services {
+		if len(r.Labels) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Map) String() string {
+	return fmt.Sprintf("%d services", len(m.Services))
+}
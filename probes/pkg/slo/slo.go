@@ -0,0 +1,385 @@
+// Package slo tracks latency service level objectives over the values
+// agents observe, such as "99% of RTTs to the database under 20ms", and
+// computes their rolling compliance and error budget burn rates.
+//
+// Objectives are read from a JSON file shared by all probes; each agent
+// tracks those over metrics it observes:
+//
+//	{
+//	  "slos": [
+//	    {"name": "db-rtt", "metric": "tcp_rtt_seconds", "match": "daddr=\"10.0.2.5\",dport=\"5432\"",
+//	     "threshold": "20ms", "objective": 0.99},
+//	    {"name": "run-slices", "metric": "cpu_run_slice_seconds", "match": "comm=~\"postgres.*\"",
+//	     "threshold": "5ms", "objective": 0.999, "window": "6h"}
+//	  ]
+//	}
+//
+// An observation is good when it is at most threshold, given in the
+// metric's unit or as a duration for metrics in seconds. Compliance is the
+// good fraction over the rolling window (default 24h). The burn rate over
+// a period is its bad fraction divided by the error budget 1-objective: at
+// 1 the budget lasts exactly the window, at 14.4 a 30-day budget is gone
+// in two days.
+//
+// Burn alerts follow the multiwindow scheme of the Google SRE workbook: a
+// fast burn fires when both the 1h and 5m burn rates exceed 14.4, a slow
+// burn when both the 6h and 30m rates exceed 6. The short period makes
+// alerts resolve soon after the burn stops.
+package slo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"probepilot/pkg/export"
+	"probepilot/pkg/query"
+)
+
+// Threshold is a latency bound, read as a number or a duration string
+// such as "20ms", which is converted to seconds.
+type Threshold float64
+
+func (t *Threshold) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		var v float64
+		if err := json.Unmarshal(data, &v); err != nil {
+			return errors.New("threshold must be a number or a duration such as \"20ms\"")
+		}
+		*t = Threshold(v)
+		return nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("threshold: %v", err)
+	}
+	*t = Threshold(d.Seconds())
+	return nil
+}
+
+// SLO is one objective.
+type SLO struct {
+	Name   string `json:"name"`
+	Metric string `json:"metric"`
+	// Match holds label matchers selecting the observations that count,
+	// e.g. daddr="10.0.2.5"; an empty Match counts every observation.
+	Match     string    `json:"match,omitempty"`
+	Threshold Threshold `json:"threshold"`
+	// Objective is the fraction of observations that must be good, e.g.
+	// 0.99 for a p99 objective.
+	Objective float64 `json:"objective"`
+	// Window is the rolling compliance window (default 24h).
+	Window export.Duration `json:"window,omitempty"`
+
+	matchers []query.Matcher
+}
+
+// DefaultWindow is the compliance window of objectives that set none.
+const DefaultWindow = 24 * time.Hour
+
+func (o *SLO) validate() error {
+	if o.Name == "" {
+		return errors.New("missing name")
+	}
+	if o.Metric == "" {
+		return errors.New("missing metric")
+	}
+	if o.Objective <= 0 || o.Objective >= 1 {
+		return fmt.Errorf("objective %v must be between 0 and 1, e.g. 0.99", o.Objective)
+	}
+	if o.Threshold <= 0 {
+		return errors.New("threshold must be positive")
+	}
+	if o.Window == 0 {
+		o.Window = export.Duration(DefaultWindow)
+	}
+	if time.Duration(o.Window) < time.Minute {
+		return errors.New("window must be at least 1m")
+	}
+	if o.Match != "" {
+		m, err := query.ParseMatchers(o.Match)
+		if err != nil {
+			return fmt.Errorf("match: %v", err)
+		}
+		o.matchers = m
+	}
+	return nil
+}
+
+// Config is the SLO file.
+type Config struct {
+	SLOs []SLO `json:"slos"`
+}
+
+// LoadConfig reads and validates an SLO file.
+func LoadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var cfg Config
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	seen := make(map[string]bool)
+	for i := range cfg.SLOs {
+		o := &cfg.SLOs[i]
+		if err := o.validate(); err != nil {
+			return nil, fmt.Errorf("%s: slo %d %s: %v", path, i+1, o.Name, err)
+		}
+		if seen[o.Name] {
+			return nil, fmt.Errorf("%s: duplicate slo %s", path, o.Name)
+		}
+		seen[o.Name] = true
+	}
+	return &cfg, nil
+}
+
+// Burn alert windows and thresholds.
+var (
+	burnWindows = []time.Duration{5 * time.Minute, 30 * time.Minute, time.Hour, 6 * time.Hour}
+
+	alerts = []struct {
+		speed       string
+		long, short time.Duration
+		rate        float64
+	}{
+		{"fast", time.Hour, 5 * time.Minute, 14.4},
+		{"slow", 6 * time.Hour, 30 * time.Minute, 6},
+	}
+)
+
+// slot counts the observations of one minute.
+type slot struct {
+	minute      int64
+	good, total uint64
+}
+
+type tracked struct {
+	SLO
+	slots       []slot
+	good, total uint64
+	burning     map[string]bool // by alert speed
+}
+
+func (t *tracked) observe(now time.Time, good bool) {
+	minute := now.Unix() / 60
+	s := &t.slots[minute%int64(len(t.slots))]
+	if s.minute != minute {
+		*s = slot{minute: minute}
+	}
+	s.total++
+	t.total++
+	if good {
+		s.good++
+		t.good++
+	}
+}
+
+// counts sums the last d of observations, the current minute included.
+func (t *tracked) counts(now time.Time, d time.Duration) (good, total uint64) {
+	minute := now.Unix() / 60
+	oldest := minute - int64(d/time.Minute) + 1
+	for _, s := range t.slots {
+		if s.minute >= oldest && s.minute <= minute {
+			good += s.good
+			total += s.total
+		}
+	}
+	return good, total
+}
+
+func (t *tracked) burnRate(now time.Time, d time.Duration) float64 {
+	good, total := t.counts(now, d)
+	if total == 0 {
+		return 0
+	}
+	return float64(total-good) / float64(total) / (1 - t.Objective)
+}
+
+// Burn is a burn alert that started or stopped firing.
+type Burn struct {
+	SLO    string
+	Metric string
+	// Speed is fast or slow.
+	Speed string
+	// Rate is the burn rate over the long window.
+	Rate, Threshold float64
+	Window          time.Duration
+	Resolved        bool
+}
+
+func (b Burn) String() string {
+	if b.Resolved {
+		return fmt.Sprintf("SLO %s %s burn resolved (%.1fx over %s)", b.SLO, b.Speed, b.Rate, formatWindow(b.Window))
+	}
+	return fmt.Sprintf("SLO %s burning error budget %.1fx over %s (%s burn threshold %gx)",
+		b.SLO, b.Rate, formatWindow(b.Window), b.Speed, b.Threshold)
+}
+
+// Labels labels the burn as a routed event.
+func (b Burn) Labels() query.Labels {
+	typ := "slo_burn"
+	if b.Resolved {
+		typ = "slo_burn_resolved"
+	}
+	return query.Labels{"type": typ, "slo": b.SLO, "metric": b.Metric, "burn": b.Speed}
+}
+
+// Tracker tracks the objectives of one agent. A nil Tracker tracks
+// nothing, so agents can call Observe unconditionally.
+type Tracker struct {
+	mu   sync.Mutex
+	slos []*tracked
+	now  func() time.Time
+}
+
+// Load reads the SLO file at path and returns a tracker of the objectives
+// over metrics, or a nil Tracker if path is empty or none apply.
+func Load(path string, metrics ...string) (*Tracker, error) {
+	if path == "" {
+		return nil, nil
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	return New(cfg, metrics...), nil
+}
+
+// New returns a tracker of the objectives in cfg over metrics, or nil if
+// none apply.
+func New(cfg *Config, metrics ...string) *Tracker {
+	t := &Tracker{now: time.Now}
+	for _, o := range cfg.SLOs {
+		for _, m := range metrics {
+			if o.Metric != m {
+				continue
+			}
+			window := time.Duration(o.Window)
+			if longest := burnWindows[len(burnWindows)-1]; window < longest {
+				window = longest
+			}
+			t.slos = append(t.slos, &tracked{
+				SLO:     o,
+				slots:   make([]slot, window/time.Minute+1),
+				burning: make(map[string]bool),
+			})
+		}
+	}
+	if len(t.slos) == 0 {
+		return nil
+	}
+	return t
+}
+
+// Observe counts v towards the objectives over metric whose matchers
+// select labels.
+func (t *Tracker) Observe(metric string, labels query.Labels, v float64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	for _, s := range t.slos {
+		if s.Metric == metric && query.MatchLabels(s.matchers, labels) {
+			s.observe(now, v <= float64(s.Threshold))
+		}
+	}
+}
+
+// Check evaluates the burn alerts and returns those that started or
+// stopped firing since the last check.
+func (t *Tracker) Check() []Burn {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	var burns []Burn
+	for _, s := range t.slos {
+		for _, a := range alerts {
+			long := s.burnRate(now, a.long)
+			firing := long > a.rate && s.burnRate(now, a.short) > a.rate
+			if firing == s.burning[a.speed] {
+				continue
+			}
+			s.burning[a.speed] = firing
+			burns = append(burns, Burn{
+				SLO:       s.Name,
+				Metric:    s.Metric,
+				Speed:     a.speed,
+				Rate:      long,
+				Threshold: a.rate,
+				Window:    a.long,
+				Resolved:  !firing,
+			})
+		}
+	}
+	return burns
+}
+
+// Samples exports compliance, error budget and burn rates per objective.
+func (t *Tracker) Samples() []query.Sample {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	var samples []query.Sample
+	for _, s := range t.slos {
+		labels := query.Labels{"slo": s.Name}
+		samples = append(samples,
+			query.Sample{Name: "slo_objective_ratio", Labels: labels, Value: s.Objective},
+			query.Sample{Name: "slo_threshold", Labels: labels, Value: float64(s.Threshold)},
+			query.Sample{Name: "slo_events_total", Labels: labels, Value: float64(s.total)},
+			query.Sample{Name: "slo_good_events_total", Labels: labels, Value: float64(s.good)},
+		)
+		if good, total := s.counts(now, time.Duration(s.Window)); total > 0 {
+			compliance := float64(good) / float64(total)
+			samples = append(samples,
+				query.Sample{Name: "slo_compliance_ratio", Labels: labels, Value: compliance},
+				query.Sample{Name: "slo_error_budget_remaining_ratio", Labels: labels,
+					Value: 1 - (1-compliance)/(1-s.Objective)},
+			)
+		}
+		for _, w := range burnWindows {
+			samples = append(samples, query.Sample{
+				Name:   "slo_burn_rate",
+				Labels: query.Labels{"slo": s.Name, "window": formatWindow(w)},
+				Value:  s.burnRate(now, w),
+			})
+		}
+		for _, a := range alerts {
+			firing := 0.0
+			if s.burning[a.speed] {
+				firing = 1
+			}
+			samples = append(samples, query.Sample{
+				Name:   "slo_burn_alert",
+				Labels: query.Labels{"slo": s.Name, "burn": a.speed},
+				Value:  firing,
+			})
+		}
+	}
+	return samples
+}
+
+// formatWindow renders 5m, 30m, 1h and 6h as Prometheus durations.
+func formatWindow(d time.Duration) string {
+	if d%time.Hour == 0 {
+		return strconv.Itoa(int(d/time.Hour)) + "h"
+	}
+	return strconv.Itoa(int(d/time.Minute)) + "m"
+}
@@ -0,0 +1,102 @@
+//go:build linux
+
+package sockmap
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+
+	"golang.org/x/sys/unix"
+)
+
+// The sock_diag messages, which golang.org/x/sys does not define:
+// struct inet_diag_req_v2 and the head of struct inet_diag_msg, each
+// around a struct inet_diag_sockid.
+const (
+	sockDiagByFamily = 20
+	sizeofSockID     = 48
+	sizeofDiagReq    = 8 + sizeofSockID
+	// idiag_inode follows the socket ID and expires, rqueue, wqueue and
+	// uid
+	diagMsgInode = 4 + sizeofSockID + 16
+)
+
+var errUnsupported = errors.New("sock_diag unsupported")
+
+// diag asks sock_diag for the socket t in the agent's network
+// namespace, returning its inode or 0 and why.
+func diag(t Tuple) (uint64, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, unix.NETLINK_SOCK_DIAG)
+	if err != nil {
+		return 0, err
+	}
+	defer unix.Close(fd)
+	tv := unix.NsecToTimeval(int64(100e6))
+	unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv)
+
+	family, src, dst := unix.AF_INET, t.Local.Addr().AsSlice(), t.Remote.Addr().AsSlice()
+	if len(src) == 16 || len(dst) == 16 {
+		family = unix.AF_INET6
+		src, dst = as16(t.Local.Addr()), as16(t.Remote.Addr())
+	}
+	protocol := unix.IPPROTO_TCP
+	if t.Proto == UDP {
+		protocol = unix.IPPROTO_UDP
+	}
+
+	msg := make([]byte, unix.SizeofNlMsghdr+sizeofDiagReq)
+	binary.NativeEndian.PutUint32(msg[0:], uint32(len(msg)))
+	binary.NativeEndian.PutUint16(msg[4:], sockDiagByFamily)
+	binary.NativeEndian.PutUint16(msg[6:], unix.NLM_F_REQUEST)
+	binary.NativeEndian.PutUint32(msg[8:], 1)
+	req := msg[unix.SizeofNlMsghdr:]
+	req[0], req[1] = byte(family), byte(protocol)
+	binary.NativeEndian.PutUint32(req[4:], ^uint32(0)) // every state
+	id := req[8:]
+	binary.BigEndian.PutUint16(id[0:], t.Local.Port())
+	binary.BigEndian.PutUint16(id[2:], t.Remote.Port())
+	copy(id[4:20], src)
+	copy(id[20:36], dst)
+	// No cookie: INET_DIAG_NOCOOKIE
+	binary.NativeEndian.PutUint32(id[40:], ^uint32(0))
+	binary.NativeEndian.PutUint32(id[44:], ^uint32(0))
+
+	if err := unix.Sendto(fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 4096)
+	n, _, err := unix.Recvfrom(fd, buf, 0)
+	if err != nil {
+		return 0, err
+	}
+	for b := buf[:n]; len(b) >= unix.SizeofNlMsghdr; {
+		size := int(binary.NativeEndian.Uint32(b[0:]))
+		if size < unix.SizeofNlMsghdr || size > len(b) {
+			break
+		}
+		data := b[unix.SizeofNlMsghdr:size]
+		switch binary.NativeEndian.Uint16(b[4:]) {
+		case unix.NLMSG_ERROR:
+			if len(data) >= 4 {
+				if errno := -int32(binary.NativeEndian.Uint32(data)); errno != 0 {
+					return 0, unix.Errno(errno)
+				}
+			}
+		case sockDiagByFamily:
+			if len(data) >= diagMsgInode+4 {
+				return uint64(binary.NativeEndian.Uint32(data[diagMsgInode:])), nil
+			}
+		}
+		b = b[min(nlmAlign(size), len(b)):]
+	}
+	return 0, unix.ENOENT
+}
+
+func nlmAlign(n int) int { return (n + unix.NLMSG_ALIGNTO - 1) &^ (unix.NLMSG_ALIGNTO - 1) }
+
+// as16 returns addr as 16 bytes, IPv4 addresses mapped to IPv6.
+func as16(addr netip.Addr) []byte {
+	b := addr.As16()
+	return b[:]
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package sockmap
+
+import "errors"
+
+var errUnsupported = errors.New("sock_diag unsupported")
+
+func diag(t Tuple) (uint64, error) { return 0, errUnsupported }
@@ -0,0 +1,235 @@
+// Package sockmap maps sockets to the processes that own them, for
+// events the kernel raises without process context: TCP state changes
+// and retransmits happen in softirq or timers, where the current task is
+// whichever one was interrupted. A socket is found by its addresses, with
+// sock_diag in the agent's network namespace or in the /proc/<pid>/net
+// tables of every namespace, and its owner by the socket:[inode] links
+// under /proc/<pid>/fd. Socket inodes are unique across namespaces, so
+// sockets of containers are attributed like any other.
+package sockmap
+
+import (
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"probepilot/pkg/procfs"
+	"probepilot/pkg/query"
+)
+
+// Proto is the transport protocol of a socket.
+type Proto uint8
+
+const (
+	TCP Proto = iota + 1
+	UDP
+)
+
+func (p Proto) String() string {
+	if p == UDP {
+		return "udp"
+	}
+	return "tcp"
+}
+
+// Tuple identifies a socket by its protocol and addresses. Listening and
+// unconnected sockets have no remote address.
+type Tuple struct {
+	Proto         Proto
+	Local, Remote netip.AddrPort
+}
+
+// Owner is the process owning a socket.
+type Owner struct {
+	PID   uint32
+	Comm  string
+	Inode uint64
+}
+
+// Defaults of a Mapper's zero fields.
+const (
+	DefaultRescan = time.Second
+	DefaultTTL    = time.Minute
+)
+
+// Mapper resolves tuples to owners, caching both the scans of /proc and
+// the answers. It is safe for concurrent use.
+type Mapper struct {
+	// Rescan is how often at most /proc is rescanned for a socket a
+	// lookup cannot find
+	Rescan time.Duration
+	// TTL is how long an answer, found or not, is kept
+	TTL time.Duration
+
+	mu      sync.Mutex
+	owners  map[uint64]Owner // by socket inode, from the last scan
+	tables  map[Tuple]uint64 // sockets of every namespace, from the last scan
+	cache   map[Tuple]answer
+	scanned time.Time
+	// noDiag is set once sock_diag failed, e.g. without CAP_NET_ADMIN
+	// in a restricted container; the tables do without it
+	noDiag bool
+
+	hits, misses, scans uint64
+}
+
+type answer struct {
+	owner   Owner
+	found   bool
+	expires time.Time
+}
+
+// New returns a mapper rescanning /proc at most every rescan.
+func New(rescan time.Duration) *Mapper {
+	return &Mapper{Rescan: rescan}
+}
+
+// Lookup returns the owner of the socket t; a nil mapper knows none. A
+// connection whose own socket is not found, e.g. one still waiting to be
+// accepted, is credited to the listening socket of its local port.
+func (m *Mapper) Lookup(t Tuple) (Owner, bool) {
+	if m == nil {
+		return Owner{}, false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	a, ok := m.cache[t]
+	if !ok || now.After(a.expires) {
+		a = m.resolve(t, now)
+		if m.cache == nil {
+			m.cache = make(map[Tuple]answer)
+		}
+		m.cache[t] = a
+	}
+	if a.found {
+		m.hits++
+	} else {
+		m.misses++
+	}
+	return a.owner, a.found
+}
+
+// Forget drops the cached answer for t, e.g. once its connection closed
+// and the tuple may be reused by another process.
+func (m *Mapper) Forget(t Tuple) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	delete(m.cache, t)
+	m.mu.Unlock()
+}
+
+func (m *Mapper) resolve(t Tuple, now time.Time) answer {
+	ttl := m.TTL
+	if ttl == 0 {
+		ttl = DefaultTTL
+	}
+	rescan := m.Rescan
+	if rescan == 0 {
+		rescan = DefaultRescan
+	}
+	for scanned := false; ; scanned = true {
+		if inode := m.inode(t); inode != 0 {
+			if o, ok := m.owners[inode]; ok {
+				return answer{owner: o, found: true, expires: now.Add(ttl)}
+			}
+		}
+		if scanned || now.Sub(m.scanned) < rescan {
+			return answer{expires: now.Add(ttl)}
+		}
+		m.scan()
+		m.scanned = now
+	}
+}
+
+// inode returns the inode of the socket t, or of the socket bound to its
+// local port, or 0
+func (m *Mapper) inode(t Tuple) uint64 {
+	if !m.noDiag && t.Remote.IsValid() {
+		inode, err := diag(t)
+		if err == errUnsupported || os.IsPermission(err) {
+			m.noDiag = true
+		}
+		if inode != 0 {
+			return inode
+		}
+	}
+	if inode := m.tables[t]; inode != 0 {
+		return inode
+	}
+	port := t.Local.Port()
+	for _, addr := range []netip.Addr{t.Local.Addr(), netip.IPv4Unspecified(), netip.IPv6Unspecified()} {
+		if inode := m.tables[Tuple{Proto: t.Proto, Local: netip.AddrPortFrom(addr, port)}]; inode != 0 {
+			return inode
+		}
+	}
+	return 0
+}
+
+// scan rebuilds the owners of every socket and the tables of every
+// network namespace from /proc. Processes that exit or cannot be read
+// meanwhile are skipped.
+func (m *Mapper) scan() {
+	m.scans++
+	pids, err := procfs.ListPIDs()
+	if err != nil {
+		return
+	}
+	owners := make(map[uint64]Owner, len(m.owners))
+	tables := make(map[Tuple]uint64, len(m.tables))
+	namespaces := make(map[string]bool)
+	for _, pid := range pids {
+		dir := strconv.FormatUint(uint64(pid), 10)
+		if ns, err := os.Readlink(procfs.Path(dir, "ns", "net")); err == nil && !namespaces[ns] {
+			namespaces[ns] = true
+			readTables(dir, tables)
+		}
+		fds, err := os.ReadDir(procfs.Path(dir, "fd"))
+		if err != nil {
+			continue
+		}
+		var comm string
+		for _, fd := range fds {
+			link, err := os.Readlink(procfs.Path(dir, "fd", fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			inode, err := strconv.ParseUint(strings.TrimSuffix(link[len("socket:["):], "]"), 10, 64)
+			if err != nil {
+				continue
+			}
+			// A socket shared after a fork stays credited to the
+			// lowest PID, usually the parent
+			if _, ok := owners[inode]; ok {
+				continue
+			}
+			if comm == "" {
+				raw, _ := os.ReadFile(procfs.Path(dir, "comm"))
+				comm = strings.TrimSpace(string(raw))
+			}
+			owners[inode] = Owner{PID: pid, Comm: comm, Inode: inode}
+		}
+	}
+	m.owners, m.tables = owners, tables
+}
+
+// Samples reports how lookups fared and what the last scan found.
+func (m *Mapper) Samples() []query.Sample {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return []query.Sample{
+		{Name: "socket_owner_lookups_total", Labels: query.Labels{"result": "found"}, Value: float64(m.hits)},
+		{Name: "socket_owner_lookups_total", Labels: query.Labels{"result": "unknown"}, Value: float64(m.misses)},
+		{Name: "socket_owner_scans_total", Value: float64(m.scans)},
+		{Name: "socket_owner_sockets", Value: float64(len(m.owners))},
+	}
+}
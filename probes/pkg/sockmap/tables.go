@@ -0,0 +1,73 @@
+package sockmap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+
+	"probepilot/pkg/procfs"
+)
+
+// tcpListen is the st column of a listening TCP socket.
+const tcpListen = "0A"
+
+// readTables adds the sockets of the network namespace of the process
+// named dir under the procfs root, from its net/tcp, tcp6, udp and udp6
+// tables. Listening TCP sockets are added without a remote address, like
+// unconnected UDP sockets are.
+func readTables(dir string, tables map[Tuple]uint64) {
+	for _, table := range []struct {
+		name  string
+		proto Proto
+	}{{"tcp", TCP}, {"tcp6", TCP}, {"udp", UDP}, {"udp6", UDP}} {
+		f, err := os.Open(procfs.Path(dir, "net", table.name))
+		if err != nil {
+			continue
+		}
+		s := bufio.NewScanner(f)
+		s.Scan() // header
+		for s.Scan() {
+			// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+			fields := strings.Fields(s.Text())
+			if len(fields) < 10 {
+				continue
+			}
+			local, err1 := parseAddrPort(fields[1])
+			remote, err2 := parseAddrPort(fields[2])
+			inode, err3 := strconv.ParseUint(fields[9], 10, 64)
+			if err1 != nil || err2 != nil || err3 != nil || inode == 0 {
+				continue
+			}
+			t := Tuple{Proto: table.proto, Local: local, Remote: remote}
+			if fields[3] == tcpListen || remote.Port() == 0 {
+				t.Remote = netip.AddrPort{}
+			}
+			tables[t] = inode
+		}
+		f.Close()
+	}
+}
+
+// parseAddrPort parses an address of the /proc/net tables, e.g.
+// 0100007F:1F90 for 127.0.0.1:8080: the address's 32-bit words in host
+// byte order, in hex, and the port in hex.
+func parseAddrPort(s string) (netip.AddrPort, error) {
+	addrHex, portHex, _ := strings.Cut(s, ":")
+	port, err := strconv.ParseUint(portHex, 16, 16)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	raw, err := hex.DecodeString(addrHex)
+	if err != nil || (len(raw) != 4 && len(raw) != 16) {
+		return netip.AddrPort{}, strconv.ErrSyntax
+	}
+	for i := 0; i < len(raw); i += 4 {
+		binary.NativeEndian.PutUint32(raw[i:], binary.BigEndian.Uint32(raw[i:]))
+	}
+	addr, _ := netip.AddrFromSlice(raw)
+	return netip.AddrPortFrom(addr.Unmap(), uint16(port)), nil
+}
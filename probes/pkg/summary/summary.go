@@ -0,0 +1,185 @@
+// Package summary gives the probe agents distinct exit codes and writes a
+// machine-readable summary of each run, so wrappers and CI jobs can tell a
+// clean stop from a configuration, permission or attach failure without
+// scraping logs.
+package summary
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"probepilot/pkg/platform"
+	"probepilot/pkg/query"
+	"probepilot/pkg/schema"
+)
+
+// Code is an agent exit code.
+type Code int
+
+const (
+	// ExitOK is a clean stop, e.g. after SIGINT or SIGTERM.
+	ExitOK Code = 0
+	// ExitFailure is a runtime error after the probes were attached.
+	ExitFailure Code = 1
+	// ExitConfig is an invalid flag or configuration value. It matches the
+	// code the flag package uses for parse errors.
+	ExitConfig Code = 2
+	// ExitPermission means the agent lacked the privileges to load or
+	// attach eBPF programs.
+	ExitPermission Code = 3
+	// ExitAttach means eBPF programs failed to load or attach.
+	ExitAttach Code = 4
+	// ExitUnsupported means the platform has no usable tracing backend.
+	ExitUnsupported Code = 5
+)
+
+var codeNames = map[Code]string{
+	ExitOK:          "ok",
+	ExitFailure:     "failure",
+	ExitConfig:      "config_error",
+	ExitPermission:  "permission_error",
+	ExitAttach:      "attach_error",
+	ExitUnsupported: "unsupported_platform",
+}
+
+func (c Code) String() string {
+	if name, ok := codeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("code_%d", int(c))
+}
+
+// Stage is the phase of a run an error happened in.
+type Stage string
+
+const (
+	StageConfig Stage = "config"
+	StageLoad   Stage = "load"
+	StageAttach Stage = "attach"
+	StageRun    Stage = "run"
+)
+
+// Classify maps an error in stage to an exit code. Permission errors are
+// reported as such wherever they happen, since they are fixed the same way.
+func Classify(stage Stage, err error) Code {
+	switch {
+	case errors.Is(err, os.ErrPermission):
+		return ExitPermission
+	case errors.Is(err, platform.ErrUnsupported):
+		return ExitUnsupported
+	}
+	switch stage {
+	case StageConfig:
+		return ExitConfig
+	case StageLoad, StageAttach:
+		return ExitAttach
+	}
+	return ExitFailure
+}
+
+// Error describes the error that ended a run.
+type Error struct {
+	Stage   Stage  `json:"stage"`
+	Message string `json:"message"`
+}
+
+// Summary is the JSON document written at exit. Schema tags it with the
+// summary schema, e.g. "summary/1.0".
+type Summary struct {
+	Schema          string             `json:"schema"`
+	Agent           string             `json:"agent"`
+	Status          string             `json:"status"`
+	ExitCode        int                `json:"exit_code"`
+	StartedAt       time.Time          `json:"started_at"`
+	StoppedAt       time.Time          `json:"stopped_at"`
+	DurationSeconds float64            `json:"duration_seconds"`
+	Stats           map[string]float64 `json:"stats,omitempty"`
+	Error           *Error             `json:"error,omitempty"`
+}
+
+// Run tracks one agent run and writes its summary on exit.
+type Run struct {
+	agent   string
+	started time.Time
+	path    *string
+
+	mu     sync.Mutex
+	source query.Source
+}
+
+// Start begins a run of agent and defines the -summary-json flag on fs.
+func Start(agent string, fs *flag.FlagSet) *Run {
+	return &Run{
+		agent:   agent,
+		started: time.Now(),
+		path:    fs.String("summary-json", "", "write a JSON run summary to this path at exit"),
+	}
+}
+
+// SetSource sets where the run statistics are read from at exit. The
+// summary holds the sum of every metric over its series.
+func (r *Run) SetSource(src query.Source) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.source = src
+}
+
+// Fatal logs err, writes the summary and exits with the code Classify
+// assigns it. It replaces log.Fatalf in the agents' main functions.
+func (r *Run) Fatal(stage Stage, format string, err error) {
+	log.Printf(format, err)
+	code := Classify(stage, err)
+	r.write(code, &Error{Stage: stage, Message: err.Error()})
+	os.Exit(int(code))
+}
+
+// Finish writes the summary of a clean stop.
+func (r *Run) Finish() {
+	r.write(ExitOK, nil)
+}
+
+func (r *Run) write(code Code, runErr *Error) {
+	if *r.path == "" {
+		return
+	}
+	now := time.Now()
+	s := Summary{
+		Schema:          schema.Tag(schema.Summary),
+		Agent:           r.agent,
+		Status:          code.String(),
+		ExitCode:        int(code),
+		StartedAt:       r.started,
+		StoppedAt:       now,
+		DurationSeconds: now.Sub(r.started).Seconds(),
+		Stats:           r.stats(),
+		Error:           runErr,
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		log.Printf("Warning: failed to encode run summary: %v", err)
+		return
+	}
+	if err := os.WriteFile(*r.path, append(data, '\n'), 0o644); err != nil {
+		log.Printf("Warning: failed to write run summary: %v", err)
+	}
+}
+
+func (r *Run) stats() map[string]float64 {
+	r.mu.Lock()
+	src := r.source
+	r.mu.Unlock()
+	if src == nil {
+		return nil
+	}
+	stats := make(map[string]float64)
+	for _, s := range query.SamplesOf(src) {
+		stats[s.Name] += s.Value
+	}
+	return stats
+}
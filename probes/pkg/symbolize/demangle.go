@@ -0,0 +1,1174 @@
+package symbolize
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Demangle returns the readable form of an Itanium C++ (_Z...) or Rust
+// (legacy _ZN...h<hash>E or v0 _R...) symbol name. Names that are not
+// mangled, or use constructs the demangler does not know, are returned
+// unchanged so a frame never loses its symbol, as are names malformed
+// enough to trip the demanglers up.
+func Demangle(name string) (demangled string) {
+	defer func() {
+		if recover() != nil {
+			demangled = name
+		}
+	}()
+	if strings.HasPrefix(name, "_R") {
+		if s, err := demangleRustV0(name); err == nil {
+			return s
+		}
+		return name
+	}
+	if !strings.HasPrefix(name, "_Z") {
+		return name
+	}
+	if s, ok := demangleRustLegacy(name); ok {
+		return s
+	}
+	if s, err := demangleItanium(name); err == nil {
+		return s
+	}
+	return name
+}
+
+var errBadMangling = errors.New("invalid mangled name")
+
+// The Itanium demangler builds a small tree of types so declarators such
+// as pointers to functions and arrays print inside out, the way C++
+// spells them.
+
+type nodeKind int
+
+const (
+	kindName nodeKind = iota
+	kindQualified
+	kindPointer
+	kindLRef
+	kindRRef
+	kindFunction
+	kindArray
+	kindMemberPointer
+	kindPack
+	kindArgPack
+)
+
+type node struct {
+	kind  nodeKind
+	name  string  // kindName
+	inner *node   // qualified, pointer, reference, array, pack, member type
+	quals string  // kindQualified and function cv/ref qualifiers
+	ret   *node   // kindFunction; nil for a bare function encoding
+	args  []*node // kindFunction parameters, kindArgPack elements
+	dim   string  // kindArray
+	class *node   // kindMemberPointer
+}
+
+func nameNode(s string) *node { return &node{kind: kindName, name: s} }
+
+func (n *node) String() string {
+	var b strings.Builder
+	n.printLeft(&b)
+	n.printRight(&b)
+	return b.String()
+}
+
+// hasRight reports whether n prints a part after the declarator.
+func (n *node) hasRight() bool {
+	switch n.kind {
+	case kindFunction, kindArray:
+		return true
+	case kindQualified:
+		return n.inner.hasRight()
+	}
+	return false
+}
+
+func (n *node) printLeft(b *strings.Builder) {
+	switch n.kind {
+	case kindName:
+		b.WriteString(n.name)
+	case kindQualified:
+		n.inner.printLeft(b)
+		b.WriteString(n.quals)
+	case kindPointer, kindLRef, kindRRef:
+		n.inner.printLeft(b)
+		if n.inner.hasRight() {
+			if !strings.HasSuffix(b.String(), " ") {
+				b.WriteString(" ")
+			}
+			b.WriteString("(")
+		}
+		b.WriteString(map[nodeKind]string{kindPointer: "*", kindLRef: "&", kindRRef: "&&"}[n.kind])
+	case kindFunction:
+		if n.ret != nil {
+			n.ret.printLeft(b)
+			b.WriteString(" ")
+		}
+	case kindArray:
+		n.inner.printLeft(b)
+	case kindMemberPointer:
+		n.inner.printLeft(b)
+		if n.inner.hasRight() {
+			b.WriteString("(")
+		} else {
+			b.WriteString(" ")
+		}
+		b.WriteString(n.class.String())
+		b.WriteString("::*")
+	case kindPack:
+		n.inner.printLeft(b)
+	case kindArgPack:
+		b.WriteString(joinNodes(n.args))
+	}
+}
+
+func (n *node) printRight(b *strings.Builder) {
+	switch n.kind {
+	case kindQualified:
+		n.inner.printRight(b)
+	case kindPointer, kindLRef, kindRRef:
+		if n.inner.hasRight() {
+			b.WriteString(")")
+		}
+		n.inner.printRight(b)
+	case kindFunction:
+		b.WriteString("(")
+		b.WriteString(joinNodes(n.args))
+		b.WriteString(")")
+		if n.ret != nil {
+			n.ret.printRight(b)
+		}
+		b.WriteString(n.quals)
+	case kindArray:
+		b.WriteString(" [")
+		b.WriteString(n.dim)
+		b.WriteString("]")
+		n.inner.printRight(b)
+	case kindMemberPointer:
+		if n.inner.hasRight() {
+			b.WriteString(")")
+		}
+		n.inner.printRight(b)
+	case kindPack:
+		n.inner.printRight(b)
+		b.WriteString("...")
+	}
+}
+
+// joinNodes lists nodes, an argument pack among them in its place; an
+// empty pack prints nothing.
+func joinNodes(nodes []*node) string {
+	parts := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		if n.kind == kindArgPack && len(n.args) == 0 {
+			continue
+		}
+		parts = append(parts, n.String())
+	}
+	return strings.Join(parts, ", ")
+}
+
+// expandPack expands a pack expansion over the argument pack its pattern
+// refers to, as Dp RT_ over <int, double> reads int&, double&. ok is
+// false if the pattern refers to no argument pack.
+func expandPack(pattern *node) (expanded *node, ok bool) {
+	pack := pattern
+	for pack != nil && pack.kind != kindArgPack {
+		pack = pack.inner
+	}
+	if pack == nil {
+		return nil, false
+	}
+	expanded = &node{kind: kindArgPack}
+	for _, arg := range pack.args {
+		expanded.args = append(expanded.args, replacePack(pattern, arg))
+	}
+	return expanded, true
+}
+
+// replacePack copies pattern with its argument pack replaced by arg.
+func replacePack(pattern, arg *node) *node {
+	if pattern.kind == kindArgPack {
+		return arg
+	}
+	n := *pattern
+	n.inner = replacePack(pattern.inner, arg)
+	return &n
+}
+
+// itanium parses one mangled name.
+type itanium struct {
+	s   string
+	pos int
+
+	subs []*node
+	// tmplArgs are the template arguments T_ refers to: the last argument
+	// list of the entity's own name
+	tmplArgs     []*node
+	tagTemplates bool
+}
+
+func (p *itanium) peek() byte {
+	if p.pos < len(p.s) {
+		return p.s[p.pos]
+	}
+	return 0
+}
+
+func (p *itanium) peekAt(i int) byte {
+	if p.pos+i < len(p.s) {
+		return p.s[p.pos+i]
+	}
+	return 0
+}
+
+func (p *itanium) consume(prefix string) bool {
+	if strings.HasPrefix(p.s[p.pos:], prefix) {
+		p.pos += len(prefix)
+		return true
+	}
+	return false
+}
+
+func (p *itanium) expect(c byte) error {
+	if p.peek() != c {
+		return errBadMangling
+	}
+	p.pos++
+	return nil
+}
+
+func demangleItanium(name string) (string, error) {
+	p := &itanium{s: name, pos: 2, tagTemplates: true}
+
+	// Clones such as .cold or .isra.0 trail the encoding
+	suffix := ""
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		p.s = name[:i]
+		for _, clone := range splitClones(name[i:]) {
+			suffix += " [clone " + clone + "]"
+		}
+	}
+
+	out, err := p.encoding()
+	if err != nil {
+		return "", err
+	}
+	if p.pos != len(p.s) {
+		return "", errBadMangling
+	}
+	return out + suffix, nil
+}
+
+// splitClones splits ".isra.0.cold" into ".isra.0" and ".cold".
+func splitClones(s string) []string {
+	var clones []string
+	for s != "" {
+		end := 1
+		for end < len(s) && s[end] != '.' {
+			end++
+		}
+		// Numeric parts belong to the clone before them
+		for end < len(s) && end+1 < len(s) && s[end+1] >= '0' && s[end+1] <= '9' {
+			end++
+			for end < len(s) && s[end] != '.' {
+				end++
+			}
+		}
+		clones = append(clones, s[:end])
+		s = s[end:]
+	}
+	return clones
+}
+
+// encoding ::= <name> <bare-function-type> | <name> | <special-name>
+func (p *itanium) encoding() (string, error) {
+	if c := p.peek(); c == 'T' || c == 'G' {
+		return p.specialName()
+	}
+
+	p.tagTemplates = true
+	name, info, err := p.name()
+	if err != nil {
+		return "", err
+	}
+	p.tagTemplates = false
+	if p.pos == len(p.s) || p.peek() == 'E' || p.peek() == '.' {
+		return name, nil
+	}
+
+	// Template functions other than constructors, destructors and
+	// conversion operators mangle their return type first
+	var ret *node
+	if info.template && !info.ctorDtorConv {
+		if ret, err = p.typ(); err != nil {
+			return "", err
+		}
+	}
+	params, err := p.bareFunctionType()
+	if err != nil {
+		return "", err
+	}
+	fn := &node{kind: kindFunction, ret: ret, args: params, quals: info.quals}
+	var b strings.Builder
+	if ret != nil {
+		ret.printLeft(&b)
+		if !ret.hasRight() {
+			b.WriteString(" ")
+		}
+	}
+	b.WriteString(name)
+	b.WriteString("(")
+	b.WriteString(joinNodes(fn.args))
+	b.WriteString(")")
+	if ret != nil {
+		ret.printRight(&b)
+	}
+	b.WriteString(fn.quals)
+	return b.String(), nil
+}
+
+func (p *itanium) bareFunctionType() ([]*node, error) {
+	var params []*node
+	for p.pos < len(p.s) && p.peek() != 'E' && p.peek() != '.' {
+		t, err := p.typ()
+		if err != nil {
+			return nil, err
+		}
+		params = append(params, t)
+	}
+	if len(params) == 0 {
+		return nil, errBadMangling
+	}
+	// A lone void means no parameters
+	if len(params) == 1 && params[0].kind == kindName && params[0].name == "void" {
+		params = nil
+	}
+	return params, nil
+}
+
+func (p *itanium) specialName() (string, error) {
+	prefixes := []struct {
+		code, text string
+	}{
+		{"TV", "vtable for "},
+		{"TT", "VTT for "},
+		{"TI", "typeinfo for "},
+		{"TS", "typeinfo name for "},
+	}
+	for _, pr := range prefixes {
+		if p.consume(pr.code) {
+			t, err := p.typ()
+			if err != nil {
+				return "", err
+			}
+			return pr.text + t.String(), nil
+		}
+	}
+
+	switch {
+	case p.consume("Th"):
+		if err := p.callOffset('h'); err != nil {
+			return "", err
+		}
+		enc, err := p.encoding()
+		return "non-virtual thunk to " + enc, err
+	case p.consume("Tv"):
+		if err := p.callOffset('v'); err != nil {
+			return "", err
+		}
+		enc, err := p.encoding()
+		return "virtual thunk to " + enc, err
+	case p.consume("Tc"):
+		for i := 0; i < 2; i++ {
+			kind := p.peek()
+			p.pos++
+			if err := p.callOffset(kind); err != nil {
+				return "", err
+			}
+		}
+		enc, err := p.encoding()
+		return "covariant return thunk to " + enc, err
+	case p.consume("TW"):
+		name, _, err := p.name()
+		return "TLS wrapper function for " + name, err
+	case p.consume("TH"):
+		name, _, err := p.name()
+		return "TLS init function for " + name, err
+	case p.consume("GV"):
+		name, _, err := p.name()
+		return "guard variable for " + name, err
+	case p.consume("GR"):
+		name, _, err := p.name()
+		if err != nil {
+			return "", err
+		}
+		// Optional sequence id of the temporary
+		for p.peek() != '_' && p.pos < len(p.s) {
+			p.pos++
+		}
+		p.consume("_")
+		return "reference temporary for " + name, nil
+	}
+	return "", errBadMangling
+}
+
+// callOffset skips h <number> _ or v <number> _ <number> _.
+func (p *itanium) callOffset(kind byte) error {
+	n := 1
+	if kind == 'v' {
+		n = 2
+	} else if kind != 'h' {
+		return errBadMangling
+	}
+	for i := 0; i < n; i++ {
+		p.consume("n")
+		if _, err := p.number(); err != nil {
+			return err
+		}
+		if err := p.expect('_'); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nameInfo describes the entity a name refers to, as far as the function
+// encoding around it needs to know.
+type nameInfo struct {
+	template     bool
+	ctorDtorConv bool
+	quals        string
+}
+
+func (p *itanium) name() (string, nameInfo, error) {
+	var info nameInfo
+	switch p.peek() {
+	case 'N':
+		return p.nestedName()
+	case 'Z':
+		return p.localName()
+	}
+
+	var prefix string
+	if p.consume("St") {
+		prefix = "std::"
+	}
+	var n string
+	if p.peek() == 'S' && prefix == "" {
+		sub, err := p.substitution()
+		if err != nil {
+			return "", info, err
+		}
+		if p.peek() != 'I' {
+			return "", info, errBadMangling
+		}
+		n = sub.String()
+	} else {
+		u, un, err := p.unqualifiedName("")
+		if err != nil {
+			return "", info, err
+		}
+		n = prefix + u
+		info.ctorDtorConv = un.ctorDtorConv
+		if p.peek() == 'I' {
+			p.subs = append(p.subs, nameNode(n))
+		}
+	}
+	if p.peek() == 'I' {
+		args, err := p.templateArgs()
+		if err != nil {
+			return "", info, err
+		}
+		n += args
+		info.template = true
+	}
+	return n, info, nil
+}
+
+type unqualifiedInfo struct {
+	ctorDtorConv bool
+}
+
+// unqualifiedName parses one name component. last is the preceding
+// component, which constructors and destructors are named after.
+func (p *itanium) unqualifiedName(last string) (string, unqualifiedInfo, error) {
+	var info unqualifiedInfo
+	var n string
+	var err error
+	c := p.peek()
+	switch {
+	case c >= '0' && c <= '9':
+		n, err = p.sourceName()
+	case (c == 'C' || c == 'D') && p.peekAt(1) >= '0' && p.peekAt(1) <= '5':
+		if last == "" {
+			return "", info, errBadMangling
+		}
+		p.pos += 2
+		n = constructorName(last)
+		if c == 'D' {
+			n = "~" + n
+		}
+		info.ctorDtorConv = true
+	case c == 'U':
+		n, err = p.unnamedType()
+	case c == 'L':
+		// Internal linkage marker on a source name
+		p.pos++
+		n, err = p.sourceName()
+	case c >= 'a' && c <= 'z':
+		var conv bool
+		n, conv, err = p.operatorName()
+		info.ctorDtorConv = conv
+	default:
+		return "", info, errBadMangling
+	}
+	if err != nil {
+		return "", info, err
+	}
+	// ABI tags
+	for p.peek() == 'B' {
+		p.pos++
+		tag, err := p.sourceName()
+		if err != nil {
+			return "", info, err
+		}
+		n += "[abi:" + tag + "]"
+	}
+	return n, info, nil
+}
+
+// constructorName is the class name a constructor of scope is named
+// after: its last component without template arguments.
+func constructorName(scope string) string {
+	if i := strings.IndexByte(scope, '<'); i >= 0 {
+		scope = scope[:i]
+	}
+	if i := strings.LastIndex(scope, "::"); i >= 0 {
+		scope = scope[i+2:]
+	}
+	return scope
+}
+
+func (p *itanium) number() (int, error) {
+	start := p.pos
+	for p.pos < len(p.s) && p.s[p.pos] >= '0' && p.s[p.pos] <= '9' {
+		p.pos++
+	}
+	if start == p.pos {
+		return 0, errBadMangling
+	}
+	return strconv.Atoi(p.s[start:p.pos])
+}
+
+func (p *itanium) sourceName() (string, error) {
+	n, err := p.number()
+	if err != nil {
+		return "", err
+	}
+	if n <= 0 || p.pos+n > len(p.s) {
+		return "", errBadMangling
+	}
+	id := p.s[p.pos : p.pos+n]
+	p.pos += n
+	if strings.HasPrefix(id, "_GLOBAL__N") {
+		return "(anonymous namespace)", nil
+	}
+	return id, nil
+}
+
+// unnamedType parses Ut [<number>] _ and lambda closures Ul ... E [<number>] _.
+func (p *itanium) unnamedType() (string, error) {
+	switch {
+	case p.consume("Ut"):
+		n := 1
+		if p.peek() != '_' {
+			v, err := p.number()
+			if err != nil {
+				return "", err
+			}
+			n = v + 2
+		}
+		if err := p.expect('_'); err != nil {
+			return "", err
+		}
+		return "{unnamed type#" + strconv.Itoa(n) + "}", nil
+	case p.consume("Ul"):
+		tag := p.tagTemplates
+		p.tagTemplates = false
+		params, err := p.bareFunctionType()
+		p.tagTemplates = tag
+		if err != nil {
+			return "", err
+		}
+		if err := p.expect('E'); err != nil {
+			return "", err
+		}
+		n := 1
+		if p.peek() != '_' {
+			v, err := p.number()
+			if err != nil {
+				return "", err
+			}
+			n = v + 2
+		}
+		if err := p.expect('_'); err != nil {
+			return "", err
+		}
+		return "{lambda(" + joinNodes(params) + ")#" + strconv.Itoa(n) + "}", nil
+	}
+	return "", errBadMangling
+}
+
+var operators = map[string]string{
+	"nw": " new", "na": " new[]", "dl": " delete", "da": " delete[]",
+	"ps": "+", "ng": "-", "ad": "&", "de": "*", "co": "~",
+	"pl": "+", "mi": "-", "ml": "*", "dv": "/", "rm": "%",
+	"an": "&", "or": "|", "eo": "^", "aS": "=",
+	"pL": "+=", "mI": "-=", "mL": "*=", "dV": "/=", "rM": "%=",
+	"aN": "&=", "oR": "|=", "eO": "^=",
+	"ls": "<<", "rs": ">>", "lS": "<<=", "rS": ">>=",
+	"eq": "==", "ne": "!=", "lt": "<", "gt": ">", "le": "<=", "ge": ">=", "ss": "<=>",
+	"nt": "!", "aa": "&&", "oo": "||", "pp": "++", "mm": "--",
+	"cm": ",", "pm": "->*", "pt": "->", "cl": "()", "ix": "[]", "qu": "?",
+	"aw": " co_await",
+}
+
+func (p *itanium) operatorName() (string, bool, error) {
+	if p.pos+2 > len(p.s) {
+		return "", false, errBadMangling
+	}
+	code := p.s[p.pos : p.pos+2]
+	if op, ok := operators[code]; ok {
+		p.pos += 2
+		return "operator" + op, false, nil
+	}
+	switch {
+	case code == "cv":
+		p.pos += 2
+		tag := p.tagTemplates
+		p.tagTemplates = false
+		t, err := p.typ()
+		p.tagTemplates = tag
+		if err != nil {
+			return "", false, err
+		}
+		return "operator " + t.String(), true, nil
+	case code == "li":
+		p.pos += 2
+		id, err := p.sourceName()
+		return `operator"" ` + id, false, err
+	case code[0] == 'v' && code[1] >= '0' && code[1] <= '9':
+		p.pos += 2
+		id, err := p.sourceName()
+		return "operator " + id, false, err
+	}
+	return "", false, errBadMangling
+}
+
+// nestedName ::= N [<CV-qualifiers>] [<ref-qualifier>] <prefix> <unqualified-name> E
+func (p *itanium) nestedName() (string, nameInfo, error) {
+	var info nameInfo
+	p.pos++ // N
+	info.quals = p.cvQualifiers()
+	if p.consume("R") {
+		info.quals += " &"
+	} else if p.consume("O") {
+		info.quals += " &&"
+	}
+
+	var soFar, last string
+	pushed := false
+	for !p.consume("E") {
+		if p.pos >= len(p.s) {
+			return "", info, errBadMangling
+		}
+		info.template = false
+		info.ctorDtorConv = false
+		switch c := p.peek(); {
+		case c == 'S' && p.peekAt(1) == 't':
+			if soFar != "" {
+				return "", info, errBadMangling
+			}
+			p.pos += 2
+			soFar = "std"
+			pushed = false
+			continue
+		case c == 'S':
+			sub, err := p.substitution()
+			if err != nil {
+				return "", info, err
+			}
+			soFar = sub.String()
+			last = soFar
+			pushed = false
+			continue
+		case c == 'I':
+			if soFar == "" {
+				return "", info, errBadMangling
+			}
+			args, err := p.templateArgs()
+			if err != nil {
+				return "", info, err
+			}
+			soFar += args
+			info.template = true
+		case c == 'T':
+			t, err := p.templateParam()
+			if err != nil {
+				return "", info, err
+			}
+			soFar = joinScope(soFar, t.String())
+			last = t.String()
+		default:
+			u, un, err := p.unqualifiedName(last)
+			if err != nil {
+				return "", info, err
+			}
+			soFar = joinScope(soFar, u)
+			last = u
+			info.ctorDtorConv = un.ctorDtorConv
+		}
+		p.subs = append(p.subs, nameNode(soFar))
+		pushed = true
+	}
+	if soFar == "" {
+		return "", info, errBadMangling
+	}
+	// The complete name is not a substitution candidate
+	if pushed {
+		p.subs = p.subs[:len(p.subs)-1]
+	}
+	return soFar, info, nil
+}
+
+func joinScope(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "::" + name
+}
+
+// localName ::= Z <encoding> E <entity name> [<discriminator>]
+func (p *itanium) localName() (string, nameInfo, error) {
+	var info nameInfo
+	p.pos++ // Z
+	tag, args := p.tagTemplates, p.tmplArgs
+	fn, err := p.encoding()
+	if err != nil {
+		return "", info, err
+	}
+	p.tagTemplates, p.tmplArgs = tag, args
+	if err := p.expect('E'); err != nil {
+		return "", info, err
+	}
+	var entity string
+	if p.consume("s") {
+		entity = "string literal"
+	} else {
+		var n nameInfo
+		if entity, n, err = p.name(); err != nil {
+			return "", info, err
+		}
+		info = n
+	}
+	// Discriminators only tell identical local names apart
+	if p.consume("_") {
+		if p.consume("_") {
+			if _, err := p.number(); err != nil {
+				return "", info, err
+			}
+			if err := p.expect('_'); err != nil {
+				return "", info, err
+			}
+		} else if _, err := p.number(); err != nil {
+			return "", info, err
+		}
+	}
+	return fn + "::" + entity, info, nil
+}
+
+func (p *itanium) cvQualifiers() string {
+	var q string
+	if p.consume("r") {
+		q += " restrict"
+	}
+	if p.consume("V") {
+		q += " volatile"
+	}
+	if p.consume("K") {
+		q += " const"
+	}
+	return q
+}
+
+// templateArgs parses I <template-arg>+ E and renders them.
+func (p *itanium) templateArgs() (string, error) {
+	p.pos++ // I
+	tag := p.tagTemplates
+	p.tagTemplates = false
+	var args []*node
+	for !p.consume("E") {
+		if p.pos >= len(p.s) {
+			return "", errBadMangling
+		}
+		arg, err := p.templateArg()
+		if err != nil {
+			return "", err
+		}
+		args = append(args, arg)
+	}
+	p.tagTemplates = tag
+	if tag {
+		p.tmplArgs = args
+	}
+	return "<" + joinNodes(args) + ">", nil
+}
+
+func (p *itanium) templateArg() (*node, error) {
+	switch p.peek() {
+	case 'L':
+		return p.exprPrimary()
+	case 'X':
+		p.pos++
+		e, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expect('E')
+	case 'J':
+		p.pos++
+		var pack []*node
+		for !p.consume("E") {
+			if p.pos >= len(p.s) {
+				return nil, errBadMangling
+			}
+			a, err := p.templateArg()
+			if err != nil {
+				return nil, err
+			}
+			pack = append(pack, a)
+		}
+		return &node{kind: kindArgPack, args: pack}, nil
+	}
+	return p.typ()
+}
+
+// expression supports the operands that show up in practice in template
+// arguments of symbols: template parameters and literals.
+func (p *itanium) expression() (*node, error) {
+	switch p.peek() {
+	case 'L':
+		return p.exprPrimary()
+	case 'T':
+		return p.templateParam()
+	}
+	return nil, errBadMangling
+}
+
+var literalSuffixes = map[string]string{
+	"int": "", "unsigned int": "u", "long": "l", "unsigned long": "ul",
+	"long long": "ll", "unsigned long long": "ull",
+}
+
+// exprPrimary ::= L <type> <value> E | L <mangled-name> E
+func (p *itanium) exprPrimary() (*node, error) {
+	p.pos++ // L
+	if p.consume("_Z") {
+		enc, err := p.encoding()
+		if err != nil {
+			return nil, err
+		}
+		return nameNode(enc), p.expect('E')
+	}
+	t, err := p.typ()
+	if err != nil {
+		return nil, err
+	}
+	start := p.pos
+	for p.pos < len(p.s) && p.s[p.pos] != 'E' {
+		p.pos++
+	}
+	value := p.s[start:p.pos]
+	if err := p.expect('E'); err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(value, "n") {
+		value = "-" + value[1:]
+	}
+	ts := t.String()
+	switch {
+	case ts == "bool" && value == "0":
+		return nameNode("false"), nil
+	case ts == "bool" && value == "1":
+		return nameNode("true"), nil
+	}
+	if suffix, ok := literalSuffixes[ts]; ok {
+		return nameNode(value + suffix), nil
+	}
+	return nameNode("(" + ts + ")" + value), nil
+}
+
+func (p *itanium) templateParam() (*node, error) {
+	p.pos++ // T
+	idx := 0
+	if p.peek() != '_' {
+		n, err := p.number()
+		if err != nil {
+			return nil, err
+		}
+		idx = n + 1
+	}
+	if err := p.expect('_'); err != nil {
+		return nil, err
+	}
+	if idx >= len(p.tmplArgs) {
+		return nil, errBadMangling
+	}
+	return p.tmplArgs[idx], nil
+}
+
+// substitution ::= S_ | S <seq-id> _ | St | Sa | Sb | Ss | Si | So | Sd
+func (p *itanium) substitution() (*node, error) {
+	p.pos++ // S
+	std := map[byte]string{
+		'a': "std::allocator",
+		'b': "std::basic_string",
+		's': "std::string",
+		'i': "std::istream",
+		'o': "std::ostream",
+		'd': "std::iostream",
+	}
+	c := p.peek()
+	if name, ok := std[c]; ok {
+		p.pos++
+		return nameNode(name), nil
+	}
+	idx := 0
+	if c != '_' {
+		v := 0
+		for {
+			c = p.peek()
+			switch {
+			case c >= '0' && c <= '9':
+				v = v*36 + int(c-'0')
+			case c >= 'A' && c <= 'Z':
+				v = v*36 + int(c-'A') + 10
+			default:
+				return nil, errBadMangling
+			}
+			if v >= len(p.subs) {
+				return nil, errBadMangling
+			}
+			p.pos++
+			if p.peek() == '_' {
+				break
+			}
+		}
+		idx = v + 1
+	}
+	if err := p.expect('_'); err != nil {
+		return nil, err
+	}
+	if idx >= len(p.subs) {
+		return nil, errBadMangling
+	}
+	return p.subs[idx], nil
+}
+
+var builtinTypes = map[byte]string{
+	'v': "void", 'w': "wchar_t", 'b': "bool", 'c': "char", 'a': "signed char",
+	'h': "unsigned char", 's': "short", 't': "unsigned short", 'i': "int",
+	'j': "unsigned int", 'l': "long", 'm': "unsigned long", 'x': "long long",
+	'y': "unsigned long long", 'n': "__int128", 'o': "unsigned __int128",
+	'f': "float", 'd': "double", 'e': "long double", 'g': "__float128", 'z': "...",
+}
+
+var builtinDTypes = map[byte]string{
+	'd': "decimal64", 'e': "decimal128", 'f': "decimal32", 'h': "half",
+	'i': "char32_t", 's': "char16_t", 'u': "char8_t", 'a': "auto",
+	'c': "decltype(auto)", 'n': "std::nullptr_t",
+}
+
+func (p *itanium) typ() (*node, error) {
+	c := p.peek()
+	if name, ok := builtinTypes[c]; ok {
+		p.pos++
+		return nameNode(name), nil
+	}
+	if c == 'D' {
+		if name, ok := builtinDTypes[p.peekAt(1)]; ok {
+			p.pos += 2
+			return nameNode(name), nil
+		}
+	}
+
+	var t *node
+	var err error
+	switch c {
+	case 'r', 'V', 'K':
+		quals := p.cvQualifiers()
+		inner, err := p.typ()
+		if err != nil {
+			return nil, err
+		}
+		if inner.kind == kindFunction {
+			fn := *inner
+			fn.quals = quals + fn.quals
+			t = &fn
+		} else {
+			t = &node{kind: kindQualified, inner: inner, quals: quals}
+		}
+	case 'P', 'R', 'O':
+		p.pos++
+		inner, err := p.typ()
+		if err != nil {
+			return nil, err
+		}
+		kind := map[byte]nodeKind{'P': kindPointer, 'R': kindLRef, 'O': kindRRef}[c]
+		t = &node{kind: kind, inner: inner}
+	case 'C', 'G':
+		p.pos++
+		inner, err := p.typ()
+		if err != nil {
+			return nil, err
+		}
+		word := map[byte]string{'C': " _Complex", 'G': " _Imaginary"}[c]
+		t = &node{kind: kindQualified, inner: inner, quals: word}
+	case 'F':
+		t, err = p.functionType()
+	case 'A':
+		t, err = p.arrayType()
+	case 'M':
+		p.pos++
+		class, err := p.typ()
+		if err != nil {
+			return nil, err
+		}
+		member, err := p.typ()
+		if err != nil {
+			return nil, err
+		}
+		t = &node{kind: kindMemberPointer, class: class, inner: member}
+	case 'T':
+		t, err = p.templateParam()
+		if err == nil && p.peek() == 'I' {
+			p.subs = append(p.subs, t)
+			var args string
+			if args, err = p.templateArgs(); err == nil {
+				t = nameNode(t.String() + args)
+			}
+		}
+	case 'S':
+		if p.peekAt(1) == 't' {
+			var n string
+			n, _, err = p.name()
+			t = nameNode(n)
+			break
+		}
+		t, err = p.substitution()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != 'I' {
+			return t, nil
+		}
+		args, err := p.templateArgs()
+		if err != nil {
+			return nil, err
+		}
+		t = nameNode(t.String() + args)
+	case 'D':
+		if p.peekAt(1) == 'p' {
+			p.pos += 2
+			inner, err := p.typ()
+			if err != nil {
+				return nil, err
+			}
+			// A pack of the template's arguments prints expanded, like
+			// c++filt; only an unresolved pattern prints as one
+			if expanded, ok := expandPack(inner); ok {
+				t = expanded
+				break
+			}
+			t = &node{kind: kindPack, inner: inner}
+			break
+		}
+		return nil, errBadMangling
+	case 'u':
+		p.pos++
+		var n string
+		n, err = p.sourceName()
+		return nameNode(n), err
+	default:
+		var n string
+		n, _, err = p.name()
+		t = nameNode(n)
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.subs = append(p.subs, t)
+	return t, nil
+}
+
+// functionType ::= F [Y] <bare-function-type> [<ref-qualifier>] E
+func (p *itanium) functionType() (*node, error) {
+	p.pos++ // F
+	p.consume("Y")
+	ret, err := p.typ()
+	if err != nil {
+		return nil, err
+	}
+	var params []*node
+	quals := ""
+	for !p.consume("E") {
+		if p.pos >= len(p.s) {
+			return nil, errBadMangling
+		}
+		if p.peek() == 'R' && p.peekAt(1) == 'E' {
+			p.pos++
+			quals = " &"
+			continue
+		}
+		if p.peek() == 'O' && p.peekAt(1) == 'E' {
+			p.pos++
+			quals = " &&"
+			continue
+		}
+		t, err := p.typ()
+		if err != nil {
+			return nil, err
+		}
+		params = append(params, t)
+	}
+	if len(params) == 1 && params[0].kind == kindName && params[0].name == "void" {
+		params = nil
+	}
+	return &node{kind: kindFunction, ret: ret, args: params, quals: quals}, nil
+}
+
+// arrayType ::= A <number> _ <type> | A _ <type>
+func (p *itanium) arrayType() (*node, error) {
+	p.pos++ // A
+	dim := ""
+	if p.peek() != '_' {
+		start := p.pos
+		if _, err := p.number(); err != nil {
+			return nil, err
+		}
+		dim = p.s[start:p.pos]
+	}
+	if err := p.expect('_'); err != nil {
+		return nil, err
+	}
+	inner, err := p.typ()
+	if err != nil {
+		return nil, err
+	}
+	return &node{kind: kindArray, inner: inner, dim: dim}, nil
+}
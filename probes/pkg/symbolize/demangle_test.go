@@ -0,0 +1,87 @@
+package symbolize
+
+import "testing"
+
+var demangleTests = []struct {
+	mangled, want string
+}{
+	{"_Z3foov", "foo()"},
+	{"_Z3fooi", "foo(int)"},
+	{"_ZN3foo3barEPKc", "foo::bar(char const*)"},
+	{"_ZNK3Foo3getEv", "Foo::get() const"},
+	{"_ZN3FooC2Ev", "Foo::Foo()"},
+	{"_ZN3FooD1Ev", "Foo::~Foo()"},
+	{"_Z1fIiEvT_", "void f<int>(int)"},
+	{"_Z1fIJidEEvDpT_", "void f<int, double>(int, double)"},
+	{"_ZNSt6vectorIiSaIiEE9push_backERKi", "std::vector<int, std::allocator<int>>::push_back(int const&)"},
+	{"_ZN9__gnu_cxx13new_allocatorIcE8allocateEmPKv", "__gnu_cxx::new_allocator<char>::allocate(unsigned long, void const*)"},
+	{"_Z3maxIdET_S0_S0_", "double max<double>(double, double)"},
+	{"_Z5applyPFviE", "apply(void (*)(int))"},
+	{"_ZN2ns5OuterINS_5InnerEE3runEv", "ns::Outer<ns::Inner>::run()"},
+	{"_ZplRK7ComplexS1_", "operator+(Complex const&, Complex const&)"},
+	{"_ZN3FooaSERKS_", "Foo::operator=(Foo const&)"},
+	{"_Z4funcRA10_i", "func(int (&) [10])"},
+	{"_ZNKSt8functionIFvvEEclEv", "std::function<void ()>::operator()() const"},
+	{"_ZN5boost6detail17sp_counted_impl_pIiE7disposeEv", "boost::detail::sp_counted_impl_p<int>::dispose()"},
+
+	// Rust legacy, hash dropped
+	{"_ZN4core3fmt5write17h1e3ef2d8e5d2f5a1E", "core::fmt::write"},
+	{"_ZN3std2rt10lang_start28_$u7b$$u7b$closure$u7d$$u7d$17h9b2b1a4b5c6d7e8fE", "std::rt::lang_start::{{closure}}"},
+	{"_ZN4core3ptr85drop_in_place$LT$std..rt..lang_start$LT$$LP$$RP$$GT$..$u7b$$u7b$closure$u7d$$u7d$$GT$17h0000000000000000E",
+		"core::ptr::drop_in_place<std::rt::lang_start<()>::{{closure}}>"},
+
+	// Rust v0, disambiguators dropped
+	{"_RNvCs15kBYyAo9fc_7mycrate7example", "mycrate::example"},
+	{"_RNvNtCs1234_7mycrate3foo3bar", "mycrate::foo::bar"},
+	{"_RNvMNtCs8ZxSfaqWgvI_5hello3fooNtB2_3Foo3new", "<hello::foo::Foo>::new"},
+	{"_RINvCs1234_7mycrate3fooiE", "mycrate::foo::<isize>"},
+	{"_RNvXCs1234_7mycrateNtB2_3FooNtNtCs5678_4core3fmt7Display3fmt", "<mycrate::Foo as core::fmt::Display>::fmt"},
+	{"_RINvNtCs1234_4core3mem4swapRmE", "core::mem::swap::<&u32>"},
+}
+
+func TestDemangle(t *testing.T) {
+	for _, tt := range demangleTests {
+		if got := Demangle(tt.mangled); got != tt.want {
+			t.Errorf("Demangle(%q) = %q, want %q", tt.mangled, got, tt.want)
+		}
+	}
+}
+
+// TestDemangleMalformed checks names that are not mangled, or are cut
+// short or overflow a length or index, come back unchanged
+func TestDemangleMalformed(t *testing.T) {
+	for _, name := range []string{
+		"main",
+		"foo",
+		"_Z",
+		"_ZN",
+		"_R",
+		"_ZN3foo99999999999999999999999bar17h0123456789abcdefE",
+		"_ZN3foo9223372036854775807bar17h0123456789abcdefE",
+		"_ZS2000000000000_",
+		"_Z1fS2000000000000_",
+		"_Z1fIiES2000000000000_",
+		"_RCu70A000000000000000000000000-00000000000000000000000000000000c00000000000",
+		"_RNvCs1234_7mycrateB99999999999999999999_",
+	} {
+		if got := Demangle(name); got != name {
+			t.Errorf("Demangle(%q) = %q, want it unchanged", name, got)
+		}
+	}
+}
+
+// FuzzDemangle runs the demanglers themselves, as Demangle recovers from
+// their panics and would hide them
+func FuzzDemangle(f *testing.F) {
+	for _, tt := range demangleTests {
+		f.Add(tt.mangled)
+	}
+	f.Fuzz(func(t *testing.T, name string) {
+		demangleItanium("_Z" + name)
+		demangleRustLegacy("_ZN" + name)
+		demangleRustV0("_R" + name)
+		if Demangle(name) == "" && name != "" {
+			t.Errorf("Demangle(%q) is empty", name)
+		}
+	})
+}
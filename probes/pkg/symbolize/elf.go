@@ -0,0 +1,74 @@
+package symbolize
+
+import (
+	"debug/elf"
+	"sort"
+)
+
+// symtab is the function symbols of one ELF file, keyed by file offset so
+// lookups need not know where the file was loaded.
+type symtab struct {
+	syms []symbol
+}
+
+type symbol struct {
+	offset, size uint64
+	name         string
+}
+
+func loadSymtab(path string) (*symtab, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Stripped binaries keep only their dynamic symbols
+	all, _ := f.Symbols()
+	dyn, _ := f.DynamicSymbols()
+	all = append(all, dyn...)
+
+	tab := &symtab{}
+	for _, sym := range all {
+		if elf.ST_TYPE(sym.Info) != elf.STT_FUNC || sym.Value == 0 {
+			continue
+		}
+		off, ok := fileOffset(f, sym.Value)
+		if !ok {
+			continue
+		}
+		tab.syms = append(tab.syms, symbol{offset: off, size: sym.Size, name: sym.Name})
+	}
+	sort.Slice(tab.syms, func(i, j int) bool {
+		return tab.syms[i].offset < tab.syms[j].offset
+	})
+	return tab, nil
+}
+
+// fileOffset maps a virtual address to its offset in the file through the
+// PT_LOAD segment containing it.
+func fileOffset(f *elf.File, vaddr uint64) (uint64, bool) {
+	for _, p := range f.Progs {
+		if p.Type == elf.PT_LOAD && vaddr >= p.Vaddr && vaddr < p.Vaddr+p.Filesz {
+			return vaddr - p.Vaddr + p.Off, true
+		}
+	}
+	return 0, false
+}
+
+// lookup returns the symbol covering the file offset off and off's
+// distance from its start.
+func (t *symtab) lookup(off uint64) (string, uint64, bool) {
+	i := sort.Search(len(t.syms), func(i int) bool {
+		return t.syms[i].offset > off
+	}) - 1
+	if i < 0 {
+		return "", 0, false
+	}
+	sym := t.syms[i]
+	// Symbols without a size are trusted up to the next symbol
+	if sym.size != 0 && off >= sym.offset+sym.size {
+		return "", 0, false
+	}
+	return sym.name, off - sym.offset, true
+}
@@ -0,0 +1,222 @@
+package symbolize
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"probepilot/pkg/procfs"
+)
+
+// ModulePollInterval is how often /proc/modules is compared for changes
+// where module uevents cannot be received.
+const ModulePollInterval = 10 * time.Second
+
+// ErrKernelAddrsHidden is returned when kallsyms lists only zero
+// addresses, as it does without CAP_SYSLOG under kptr_restrict.
+var ErrKernelAddrsHidden = errors.New("kallsyms addresses are hidden (kptr_restrict)")
+
+// Kallsyms resolves kernel addresses against /proc/kallsyms. The table is
+// read once and cached, and reread after a kernel module is loaded or
+// unloaded, so stacks through modules loaded after the agent started
+// resolve and addresses of unloaded modules are not misattributed.
+type Kallsyms struct {
+	mu   sync.RWMutex
+	syms []ksym
+	err  error
+
+	// stale is set by module events and cleared by the next reload
+	stale   atomic.Bool
+	reloads atomic.Uint64
+}
+
+type ksym struct {
+	addr   uint64
+	name   string
+	module string // empty for the core kernel
+}
+
+// NewKallsyms returns a table that is loaded on first use.
+func NewKallsyms() *Kallsyms {
+	k := &Kallsyms{}
+	k.stale.Store(true)
+	return k
+}
+
+// Invalidate marks the table stale so the next lookup rereads it.
+func (k *Kallsyms) Invalidate() {
+	k.stale.Store(true)
+}
+
+// Reloads returns how many times the table has been read.
+func (k *Kallsyms) Reloads() uint64 {
+	return k.reloads.Load()
+}
+
+// Resolve returns the kernel function covering addr. Module symbols are
+// reported with the module name, core kernel symbols as "[kernel]".
+func (k *Kallsyms) Resolve(addr uint64) Frame {
+	frame := Frame{Addr: addr}
+	if k.refresh() != nil {
+		return frame
+	}
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	i := sort.Search(len(k.syms), func(i int) bool {
+		return k.syms[i].addr > addr
+	}) - 1
+	if i < 0 {
+		return frame
+	}
+	sym := k.syms[i]
+	frame.Function, frame.Offset = sym.name, addr-sym.addr
+	frame.Module = "[kernel]"
+	if sym.module != "" {
+		frame.Module = "[" + sym.module + "]"
+	}
+	return frame
+}
+
+// ResolveStack resolves each address of a kernel stack.
+func (k *Kallsyms) ResolveStack(addrs []uint64) []Frame {
+	frames := make([]Frame, len(addrs))
+	for i, addr := range addrs {
+		frames[i] = k.Resolve(addr)
+	}
+	return frames
+}
+
+// refresh rereads kallsyms if the table is stale, returning the error of
+// the last read.
+func (k *Kallsyms) refresh() error {
+	if !k.stale.Load() {
+		k.mu.RLock()
+		defer k.mu.RUnlock()
+		return k.err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	// Another lookup may have reloaded while this one waited
+	if !k.stale.Swap(false) {
+		return k.err
+	}
+	syms, err := loadKallsyms()
+	k.reloads.Add(1)
+	if err != nil {
+		// Keep the previous table; a transient failure should not blank
+		// every kernel frame
+		if k.syms == nil {
+			k.err = err
+		}
+		return k.err
+	}
+	k.syms, k.err = syms, nil
+	return nil
+}
+
+func loadKallsyms() ([]ksym, error) {
+	f, err := os.Open(procfs.Path("kallsyms"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseKallsyms(f)
+}
+
+// parseKallsyms parses "address type name [module]" lines, keeping text
+// symbols sorted by address.
+func parseKallsyms(r io.Reader) ([]ksym, error) {
+	var syms []ksym
+	hidden := true
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		switch fields[1] {
+		case "t", "T", "w", "W":
+		default:
+			continue
+		}
+		addr, err := strconv.ParseUint(fields[0], 16, 64)
+		if err != nil {
+			continue
+		}
+		if addr != 0 {
+			hidden = false
+		}
+		sym := ksym{addr: addr, name: fields[2]}
+		if len(fields) > 3 {
+			sym.module = strings.Trim(fields[3], "[]")
+		}
+		syms = append(syms, sym)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if hidden {
+		return nil, ErrKernelAddrsHidden
+	}
+	sort.Slice(syms, func(i, j int) bool {
+		return syms[i].addr < syms[j].addr
+	})
+	return syms, nil
+}
+
+// Watch invalidates the table whenever a kernel module is loaded or
+// unloaded, until ctx is done. Module uevents are used where the agent may
+// open a kobject uevent socket; elsewhere /proc/modules is polled.
+func (k *Kallsyms) Watch(ctx context.Context) error {
+	err := watchModuleEvents(ctx, k.Invalidate)
+	if err == nil || ctx.Err() != nil {
+		return nil
+	}
+	return k.pollModules(ctx)
+}
+
+func (k *Kallsyms) pollModules(ctx context.Context) error {
+	last, err := os.ReadFile(procfs.Path("modules"))
+	if err != nil {
+		return fmt.Errorf("watch kernel modules: %v", err)
+	}
+	ticker := time.NewTicker(ModulePollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		cur, err := os.ReadFile(procfs.Path("modules"))
+		if err != nil {
+			continue
+		}
+		if !bytes.Equal(moduleNames(cur), moduleNames(last)) {
+			k.Invalidate()
+		}
+		last = cur
+	}
+}
+
+// moduleNames strips /proc/modules down to the loaded module names, since
+// the other columns, such as reference counts, change without a load.
+func moduleNames(modules []byte) []byte {
+	var names []byte
+	for _, line := range bytes.Split(modules, []byte("\n")) {
+		if i := bytes.IndexByte(line, ' '); i > 0 {
+			names = append(append(names, line[:i]...), '\n')
+		}
+	}
+	return names
+}
@@ -0,0 +1,710 @@
+package symbolize
+
+import (
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// demangleRustLegacy decodes the Itanium-shaped scheme rustc used before
+// v0: _ZN <len><ident>... 17h<16 hex digits> E, with $..$ escapes in the
+// identifiers. The trailing hash is dropped.
+func demangleRustLegacy(name string) (string, bool) {
+	if !strings.HasPrefix(name, "_ZN") {
+		return "", false
+	}
+	rest := name[3:]
+
+	// Identifiers may contain dots, so suffixes such as .llvm.<n> are
+	// only recognised after the closing E.
+	var parts []string
+	for rest != "E" && !strings.HasPrefix(rest, "E.") {
+		n := 0
+		i := 0
+		for i < len(rest) && rest[i] >= '0' && rest[i] <= '9' {
+			n = n*10 + int(rest[i]-'0')
+			i++
+			if n > len(rest) {
+				return "", false
+			}
+		}
+		if i == 0 || n == 0 || i+n > len(rest) {
+			return "", false
+		}
+		parts = append(parts, rest[i:i+n])
+		rest = rest[i+n:]
+	}
+	if len(parts) < 2 || !isRustHash(parts[len(parts)-1]) {
+		return "", false
+	}
+	parts = parts[:len(parts)-1]
+
+	for i, part := range parts {
+		decoded, ok := unescapeRustLegacy(part)
+		if !ok {
+			return "", false
+		}
+		parts[i] = decoded
+	}
+	return strings.Join(parts, "::"), true
+}
+
+func isRustHash(s string) bool {
+	if len(s) != 17 || s[0] != 'h' {
+		return false
+	}
+	for _, c := range s[1:] {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+var rustLegacyEscapes = map[string]string{
+	"SP": "@", "BP": "*", "RF": "&", "LT": "<", "GT": ">", "LP": "(", "RP": ")", "C": ",",
+}
+
+func unescapeRustLegacy(s string) (string, bool) {
+	// A leading underscore protects identifiers starting with an escape
+	if strings.HasPrefix(s, "_$") {
+		s = s[1:]
+	}
+	var b strings.Builder
+	for s != "" {
+		switch {
+		case s[0] == '$':
+			end := strings.IndexByte(s[1:], '$')
+			if end < 0 {
+				return "", false
+			}
+			esc := s[1 : end+1]
+			s = s[end+2:]
+			if r, ok := rustLegacyEscapes[esc]; ok {
+				b.WriteString(r)
+				continue
+			}
+			if !strings.HasPrefix(esc, "u") {
+				return "", false
+			}
+			v, err := strconv.ParseUint(esc[1:], 16, 32)
+			if err != nil || !utf8.ValidRune(rune(v)) {
+				return "", false
+			}
+			b.WriteRune(rune(v))
+		case strings.HasPrefix(s, ".."):
+			b.WriteString("::")
+			s = s[2:]
+		default:
+			b.WriteByte(s[0])
+			s = s[1:]
+		}
+	}
+	return b.String(), true
+}
+
+// rustV0 parses the v0 mangling scheme (RFC 2603).
+type rustV0 struct {
+	s     string // symbol without the _R prefix
+	pos   int
+	depth int
+	b     strings.Builder
+}
+
+// maxRustDepth bounds backref recursion on malformed input.
+const maxRustDepth = 100
+
+func demangleRustV0(name string) (string, error) {
+	s := name[2:]
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		s = s[:i]
+	}
+	// Optional encoding version
+	for len(s) > 0 && s[0] >= '0' && s[0] <= '9' {
+		s = s[1:]
+	}
+	if s == "" || s[0] < 'A' || s[0] > 'Z' {
+		return "", errBadMangling
+	}
+	p := &rustV0{s: s}
+	if err := p.path(true); err != nil {
+		return "", err
+	}
+	// The instantiating crate may follow; it is not printed
+	return p.b.String(), nil
+}
+
+func (p *rustV0) next() (byte, error) {
+	if p.pos >= len(p.s) {
+		return 0, errBadMangling
+	}
+	c := p.s[p.pos]
+	p.pos++
+	return c, nil
+}
+
+func (p *rustV0) peek() byte {
+	if p.pos < len(p.s) {
+		return p.s[p.pos]
+	}
+	return 0
+}
+
+func (p *rustV0) eat(c byte) bool {
+	if p.peek() == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// base62 parses {0-9a-zA-Z} _ where "_" alone is 0. Values that overflow
+// are malformed.
+func (p *rustV0) base62() (uint64, error) {
+	if p.eat('_') {
+		return 0, nil
+	}
+	var v uint64
+	for !p.eat('_') {
+		c, err := p.next()
+		if err != nil {
+			return 0, err
+		}
+		var d uint64
+		switch {
+		case c >= '0' && c <= '9':
+			d = uint64(c - '0')
+		case c >= 'a' && c <= 'z':
+			d = uint64(c-'a') + 10
+		case c >= 'A' && c <= 'Z':
+			d = uint64(c-'A') + 36
+		default:
+			return 0, errBadMangling
+		}
+		if v > (math.MaxUint64-1-d)/62 {
+			return 0, errBadMangling
+		}
+		v = v*62 + d
+	}
+	return v + 1, nil
+}
+
+func (p *rustV0) disambiguator() (uint64, error) {
+	if !p.eat('s') {
+		return 0, nil
+	}
+	v, err := p.base62()
+	if v == math.MaxUint64 {
+		return 0, errBadMangling
+	}
+	return v + 1, err
+}
+
+func (p *rustV0) decimal() (int, error) {
+	start := p.pos
+	for p.pos < len(p.s) && p.s[p.pos] >= '0' && p.s[p.pos] <= '9' {
+		p.pos++
+	}
+	if start == p.pos {
+		return 0, errBadMangling
+	}
+	return strconv.Atoi(p.s[start:p.pos])
+}
+
+// ident parses [u] <decimal> [_] <bytes>, decoding punycode for u.
+func (p *rustV0) ident() (string, error) {
+	puny := p.eat('u')
+	n, err := p.decimal()
+	if err != nil {
+		return "", err
+	}
+	p.eat('_')
+	if n > len(p.s)-p.pos {
+		return "", errBadMangling
+	}
+	id := p.s[p.pos : p.pos+n]
+	p.pos += n
+	if puny {
+		return decodePunycode(strings.ReplaceAll(id, "_", "-"))
+	}
+	return id, nil
+}
+
+// backref runs fn at the position a B <base-62> refers to.
+func (p *rustV0) backref(fn func() error) error {
+	start := p.pos - 1
+	v, err := p.base62()
+	if err != nil {
+		return err
+	}
+	// Offsets count from just after the "_R" prefix and must point back
+	if v >= uint64(start) || p.depth >= maxRustDepth {
+		return errBadMangling
+	}
+	saved := p.pos
+	p.pos = int(v)
+	p.depth++
+	err = fn()
+	p.depth--
+	p.pos = saved
+	return err
+}
+
+// path prints one path. inValue selects the value-namespace generic
+// syntax foo::<T> over the type syntax Foo<T>.
+func (p *rustV0) path(inValue bool) error {
+	c, err := p.next()
+	if err != nil {
+		return err
+	}
+	switch c {
+	case 'C':
+		if _, err := p.disambiguator(); err != nil {
+			return err
+		}
+		id, err := p.ident()
+		if err != nil {
+			return err
+		}
+		p.b.WriteString(id)
+	case 'N':
+		ns, err := p.next()
+		if err != nil {
+			return err
+		}
+		if err := p.path(inValue); err != nil {
+			return err
+		}
+		dis, err := p.disambiguator()
+		if err != nil {
+			return err
+		}
+		id, err := p.ident()
+		if err != nil {
+			return err
+		}
+		switch {
+		case ns >= 'a' && ns <= 'z':
+			if id != "" {
+				p.b.WriteString("::" + id)
+			}
+		case ns == 'C':
+			p.b.WriteString("::{closure")
+			p.writeSpecial(id, dis)
+		case ns == 'S':
+			p.b.WriteString("::{shim")
+			p.writeSpecial(id, dis)
+		case ns >= 'A' && ns <= 'Z':
+			p.b.WriteString("::{" + string(ns))
+			p.writeSpecial(id, dis)
+		default:
+			return errBadMangling
+		}
+	case 'M':
+		if _, err := p.disambiguator(); err != nil {
+			return err
+		}
+		if err := p.skipPath(); err != nil {
+			return err
+		}
+		p.b.WriteString("<")
+		if err := p.typ(); err != nil {
+			return err
+		}
+		p.b.WriteString(">")
+	case 'X':
+		if _, err := p.disambiguator(); err != nil {
+			return err
+		}
+		if err := p.skipPath(); err != nil {
+			return err
+		}
+		p.b.WriteString("<")
+		if err := p.typ(); err != nil {
+			return err
+		}
+		p.b.WriteString(" as ")
+		if err := p.path(false); err != nil {
+			return err
+		}
+		p.b.WriteString(">")
+	case 'Y':
+		p.b.WriteString("<")
+		if err := p.typ(); err != nil {
+			return err
+		}
+		p.b.WriteString(" as ")
+		if err := p.path(false); err != nil {
+			return err
+		}
+		p.b.WriteString(">")
+	case 'I':
+		if err := p.path(inValue); err != nil {
+			return err
+		}
+		if inValue {
+			p.b.WriteString("::")
+		}
+		p.b.WriteString("<")
+		if err := p.genericArgs(); err != nil {
+			return err
+		}
+		p.b.WriteString(">")
+	case 'B':
+		return p.backref(func() error { return p.path(inValue) })
+	default:
+		return errBadMangling
+	}
+	return nil
+}
+
+func (p *rustV0) writeSpecial(id string, dis uint64) {
+	if id != "" {
+		p.b.WriteString(":" + id)
+	}
+	p.b.WriteString("#" + strconv.FormatUint(dis, 10) + "}")
+}
+
+// skipPath parses a path without printing it, for impl paths whose
+// printed form is the self type instead.
+func (p *rustV0) skipPath() error {
+	saved := p.b.Len()
+	err := p.path(false)
+	s := p.b.String()[:saved]
+	p.b.Reset()
+	p.b.WriteString(s)
+	return err
+}
+
+func (p *rustV0) genericArgs() error {
+	for i := 0; !p.eat('E'); i++ {
+		if p.pos >= len(p.s) {
+			return errBadMangling
+		}
+		if i > 0 {
+			p.b.WriteString(", ")
+		}
+		switch {
+		case p.eat('L'):
+			if _, err := p.base62(); err != nil {
+				return err
+			}
+			p.b.WriteString("'_")
+		case p.eat('K'):
+			if err := p.constant(); err != nil {
+				return err
+			}
+		default:
+			if err := p.typ(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+var rustBasicTypes = map[byte]string{
+	'a': "i8", 'b': "bool", 'c': "char", 'd': "f64", 'e': "str", 'f': "f32",
+	'h': "u8", 'i': "isize", 'j': "usize", 'l': "i32", 'm': "u32", 'n': "i128",
+	'o': "u128", 's': "i16", 't': "u16", 'u': "()", 'v': "...", 'x': "i64",
+	'y': "u64", 'z': "!", 'p': "_",
+}
+
+func (p *rustV0) typ() error {
+	c := p.peek()
+	if t, ok := rustBasicTypes[c]; ok {
+		p.pos++
+		p.b.WriteString(t)
+		return nil
+	}
+	switch c {
+	case 'R', 'Q':
+		p.pos++
+		p.b.WriteString("&")
+		if p.eat('L') {
+			if _, err := p.base62(); err != nil {
+				return err
+			}
+		}
+		if c == 'Q' {
+			p.b.WriteString("mut ")
+		}
+		return p.typ()
+	case 'P', 'O':
+		p.pos++
+		if c == 'P' {
+			p.b.WriteString("*const ")
+		} else {
+			p.b.WriteString("*mut ")
+		}
+		return p.typ()
+	case 'A':
+		p.pos++
+		p.b.WriteString("[")
+		if err := p.typ(); err != nil {
+			return err
+		}
+		p.b.WriteString("; ")
+		if err := p.constant(); err != nil {
+			return err
+		}
+		p.b.WriteString("]")
+	case 'S':
+		p.pos++
+		p.b.WriteString("[")
+		if err := p.typ(); err != nil {
+			return err
+		}
+		p.b.WriteString("]")
+	case 'T':
+		p.pos++
+		p.b.WriteString("(")
+		n := 0
+		for ; !p.eat('E'); n++ {
+			if p.pos >= len(p.s) {
+				return errBadMangling
+			}
+			if n > 0 {
+				p.b.WriteString(", ")
+			}
+			if err := p.typ(); err != nil {
+				return err
+			}
+		}
+		if n == 1 {
+			p.b.WriteString(",")
+		}
+		p.b.WriteString(")")
+	case 'F':
+		p.pos++
+		return p.fnSig()
+	case 'D':
+		p.pos++
+		return p.dynBounds()
+	case 'B':
+		p.pos++
+		return p.backref(p.typ)
+	default:
+		return p.path(false)
+	}
+	return nil
+}
+
+func (p *rustV0) binder() error {
+	if p.eat('G') {
+		_, err := p.base62()
+		return err
+	}
+	return nil
+}
+
+func (p *rustV0) fnSig() error {
+	if err := p.binder(); err != nil {
+		return err
+	}
+	if p.eat('U') {
+		p.b.WriteString("unsafe ")
+	}
+	if p.eat('K') {
+		abi := "C"
+		if !p.eat('C') {
+			id, err := p.ident()
+			if err != nil {
+				return err
+			}
+			abi = strings.ReplaceAll(id, "_", "-")
+		}
+		p.b.WriteString(`extern "` + abi + `" `)
+	}
+	p.b.WriteString("fn(")
+	for i := 0; !p.eat('E'); i++ {
+		if p.pos >= len(p.s) {
+			return errBadMangling
+		}
+		if i > 0 {
+			p.b.WriteString(", ")
+		}
+		if err := p.typ(); err != nil {
+			return err
+		}
+	}
+	p.b.WriteString(")")
+	if p.peek() == 'u' {
+		p.pos++
+		return nil
+	}
+	p.b.WriteString(" -> ")
+	return p.typ()
+}
+
+func (p *rustV0) dynBounds() error {
+	if err := p.binder(); err != nil {
+		return err
+	}
+	p.b.WriteString("dyn ")
+	for i := 0; !p.eat('E'); i++ {
+		if p.pos >= len(p.s) {
+			return errBadMangling
+		}
+		if i > 0 {
+			p.b.WriteString(" + ")
+		}
+		if err := p.path(false); err != nil {
+			return err
+		}
+		// Associated type bindings, e.g. Iterator<Item = u8>
+		for j := 0; p.eat('p'); j++ {
+			if j == 0 {
+				p.b.WriteString("<")
+			} else {
+				p.b.WriteString(", ")
+			}
+			id, err := p.ident()
+			if err != nil {
+				return err
+			}
+			p.b.WriteString(id + " = ")
+			if err := p.typ(); err != nil {
+				return err
+			}
+			if p.peek() != 'p' {
+				p.b.WriteString(">")
+			}
+		}
+	}
+	// The object lifetime bound is not printed
+	if !p.eat('L') {
+		return errBadMangling
+	}
+	_, err := p.base62()
+	return err
+}
+
+// constant prints <type> <const-data>, a placeholder or a backref.
+func (p *rustV0) constant() error {
+	if p.eat('p') {
+		p.b.WriteString("_")
+		return nil
+	}
+	if p.eat('B') {
+		return p.backref(p.constant)
+	}
+	t, err := p.next()
+	if err != nil {
+		return err
+	}
+	neg := p.eat('n')
+	start := p.pos
+	for p.peek() != '_' {
+		if _, err := p.next(); err != nil {
+			return err
+		}
+	}
+	hex := p.s[start:p.pos]
+	p.pos++
+	v := new(big.Int)
+	if hex != "" {
+		if _, ok := v.SetString(hex, 16); !ok {
+			return errBadMangling
+		}
+	}
+	switch t {
+	case 'b':
+		p.b.WriteString(strconv.FormatBool(v.Sign() != 0))
+	case 'c':
+		if !v.IsInt64() || !utf8.ValidRune(rune(v.Int64())) {
+			return errBadMangling
+		}
+		p.b.WriteString(strconv.QuoteRune(rune(v.Int64())))
+	default:
+		if _, ok := rustBasicTypes[t]; !ok {
+			return errBadMangling
+		}
+		if neg {
+			p.b.WriteString("-")
+		}
+		p.b.WriteString(v.String())
+	}
+	return nil
+}
+
+// decodePunycode decodes RFC 3492 punycode as used in Rust identifiers.
+func decodePunycode(s string) (string, error) {
+	const (
+		base        = 36
+		tMin        = 1
+		tMax        = 26
+		skew        = 38
+		damp        = 700
+		initialBias = 72
+		initialN    = 128
+	)
+	var output []rune
+	if i := strings.LastIndexByte(s, '-'); i >= 0 {
+		output = []rune(s[:i])
+		s = s[i+1:]
+	}
+	n, bias, i := initialN, initialBias, 0
+	adapt := func(delta, numPoints int, first bool) int {
+		if first {
+			delta /= damp
+		} else {
+			delta /= 2
+		}
+		delta += delta / numPoints
+		k := 0
+		for delta > ((base-tMin)*tMax)/2 {
+			delta /= base - tMin
+			k += base
+		}
+		return k + (base-tMin+1)*delta/(delta+skew)
+	}
+	for pos := 0; pos < len(s); {
+		oldi, w := i, 1
+		for k := base; ; k += base {
+			if pos >= len(s) {
+				return "", errBadMangling
+			}
+			c := s[pos]
+			pos++
+			var digit int
+			switch {
+			case c >= 'a' && c <= 'z':
+				digit = int(c - 'a')
+			case c >= '0' && c <= '9':
+				digit = int(c-'0') + 26
+			default:
+				return "", errBadMangling
+			}
+			// Bound the decoder as RFC 3492 does, so no input overflows it
+			if digit > (math.MaxInt32-i)/w {
+				return "", errBadMangling
+			}
+			i += digit * w
+			t := k - bias
+			if t < tMin {
+				t = tMin
+			} else if t > tMax {
+				t = tMax
+			}
+			if digit < t {
+				break
+			}
+			if w > math.MaxInt32/(base-t) {
+				return "", errBadMangling
+			}
+			w *= base - t
+		}
+		bias = adapt(i-oldi, len(output)+1, oldi == 0)
+		n += i / (len(output) + 1)
+		if n > utf8.MaxRune {
+			return "", errBadMangling
+		}
+		i %= len(output) + 1
+		output = append(output[:i], append([]rune{rune(n)}, output[i:]...)...)
+		i++
+	}
+	return string(output), nil
+}
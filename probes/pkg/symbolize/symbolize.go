@@ -0,0 +1,172 @@
+// Package symbolize turns stack addresses captured by the probes into
+// function names. User-space addresses are resolved against the ELF
+// symbol tables of the binaries a process maps, read through the
+// process's own root so containerized processes resolve their own copies;
+// kernel addresses against kallsyms. C++ and Rust names are demangled
+// unless raw names are requested.
+package symbolize
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"probepilot/pkg/procfs"
+)
+
+// Options controls how frames are named.
+type Options struct {
+	// Raw keeps mangled C++ and Rust names as found in the symbol table.
+	Raw bool
+}
+
+// Frame is one resolved stack address.
+type Frame struct {
+	Addr     uint64
+	Function string // empty if no symbol covers Addr
+	Offset   uint64 // Addr's offset into Function
+	Module   string // base name of the mapped file, if any
+}
+
+func (f Frame) String() string {
+	switch {
+	case f.Function != "" && f.Module != "":
+		return fmt.Sprintf("%s+0x%x (%s)", f.Function, f.Offset, f.Module)
+	case f.Function != "":
+		return fmt.Sprintf("%s+0x%x", f.Function, f.Offset)
+	case f.Module != "":
+		return fmt.Sprintf("0x%x (%s)", f.Addr, f.Module)
+	default:
+		return fmt.Sprintf("0x%x", f.Addr)
+	}
+}
+
+// Symbolizer resolves addresses, caching symbol tables by file so a
+// library shared by many processes is read once.
+type Symbolizer struct {
+	opts   Options
+	kernel *Kallsyms
+
+	mu     sync.Mutex
+	tables map[string]*symtab
+}
+
+// New returns a symbolizer with opts.
+func New(opts Options) *Symbolizer {
+	return &Symbolizer{opts: opts, kernel: NewKallsyms(), tables: make(map[string]*symtab)}
+}
+
+// ResolveKernelStack resolves kernel addresses through kallsyms.
+func (s *Symbolizer) ResolveKernelStack(addrs []uint64) []Frame {
+	frames := s.kernel.ResolveStack(addrs)
+	if !s.opts.Raw {
+		// Rust kernel modules export v0 mangled names
+		for i := range frames {
+			frames[i].Function = Demangle(frames[i].Function)
+		}
+	}
+	return frames
+}
+
+// WatchKernelModules keeps the kernel symbol table current as modules
+// load and unload, until ctx is done.
+func (s *Symbolizer) WatchKernelModules(ctx context.Context) error {
+	return s.kernel.Watch(ctx)
+}
+
+// mapping is one executable mapping of /proc/<pid>/maps.
+type mapping struct {
+	start, end, offset uint64
+	path               string
+}
+
+// ResolveStack resolves the user-space addresses of pid. Addresses that
+// cannot be resolved, e.g. because the process has exited, are returned
+// with only Addr set.
+func (s *Symbolizer) ResolveStack(pid uint32, addrs []uint64) []Frame {
+	frames := make([]Frame, len(addrs))
+	for i, addr := range addrs {
+		frames[i].Addr = addr
+	}
+	maps, err := readMaps(pid)
+	if err != nil {
+		return frames
+	}
+	root := procfs.Path(strconv.FormatUint(uint64(pid), 10), "root")
+	for i := range frames {
+		m := findMapping(maps, frames[i].Addr)
+		if m == nil {
+			continue
+		}
+		frames[i].Module = m.path[strings.LastIndexByte(m.path, '/')+1:]
+		tab := s.table(root + m.path)
+		if tab == nil {
+			continue
+		}
+		name, off, ok := tab.lookup(frames[i].Addr - m.start + m.offset)
+		if !ok {
+			continue
+		}
+		if !s.opts.Raw {
+			name = Demangle(name)
+		}
+		frames[i].Function, frames[i].Offset = name, off
+	}
+	return frames
+}
+
+// table returns the cached symbol table of path, loading it on first use.
+// Files without symbols are cached as nil so they are not reread.
+func (s *Symbolizer) table(path string) *symtab {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if tab, ok := s.tables[path]; ok {
+		return tab
+	}
+	tab, _ := loadSymtab(path)
+	s.tables[path] = tab
+	return tab
+}
+
+func readMaps(pid uint32) ([]mapping, error) {
+	f, err := os.Open(procfs.Path(strconv.FormatUint(uint64(pid), 10), "maps"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var maps []mapping
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// start-end perms offset dev inode path
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || !strings.Contains(fields[1], "x") || !strings.HasPrefix(fields[5], "/") {
+			continue
+		}
+		lo, hi, ok := strings.Cut(fields[0], "-")
+		if !ok {
+			continue
+		}
+		start, err1 := strconv.ParseUint(lo, 16, 64)
+		end, err2 := strconv.ParseUint(hi, 16, 64)
+		offset, err3 := strconv.ParseUint(fields[2], 16, 64)
+		if err1 != nil || err2 != nil || err3 != nil {
+			continue
+		}
+		maps = append(maps, mapping{start: start, end: end, offset: offset, path: fields[5]})
+	}
+	return maps, scanner.Err()
+}
+
+func findMapping(maps []mapping, addr uint64) *mapping {
+	for i := range maps {
+		if addr >= maps[i].start && addr < maps[i].end {
+			return &maps[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+//go:build linux
+
+package symbolize
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchModuleEvents calls fn for every module uevent the kernel
+// broadcasts, until ctx is done. It returns an error only if the uevent
+// socket cannot be set up.
+func watchModuleEvents(ctx context.Context, fn func()) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, unix.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	// Group 1 carries the kernel's own broadcasts, not udev's re-sends
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: 1}); err != nil {
+		return err
+	}
+	// Wake up periodically to notice cancellation
+	tv := unix.NsecToTimeval(time.Second.Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 8192)
+	for ctx.Err() == nil {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+				continue
+			}
+			// Overruns lose events; assume a module changed
+			if errors.Is(err, unix.ENOBUFS) {
+				fn()
+				continue
+			}
+			return err
+		}
+		if isModuleEvent(buf[:n]) {
+			fn()
+		}
+	}
+	return nil
+}
+
+// isModuleEvent reports whether a uevent message, a header followed by
+// NUL-separated KEY=value pairs, concerns a kernel module.
+func isModuleEvent(msg []byte) bool {
+	for _, field := range bytes.Split(msg, []byte{0}) {
+		if bytes.Equal(field, []byte("SUBSYSTEM=module")) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package symbolize
+
+import (
+	"context"
+	"errors"
+)
+
+func watchModuleEvents(context.Context, func()) error {
+	return errors.New("module uevents are not supported on this platform")
+}
@@ -0,0 +1,18 @@
+//go:build linux
+
+package target
+
+import (
+	"os"
+	"syscall"
+)
+
+// cgroupID returns the ID the kernel reports for a cgroup v2 directory:
+// its inode number.
+func cgroupID(info os.FileInfo) (uint64, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return st.Ino, true
+}
@@ -0,0 +1,151 @@
+package target
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CgroupPaths resolves cgroup v2 IDs, as bpf_get_current_cgroup_id
+// returns them, to cgroup paths. It is safe for concurrent use.
+type CgroupPaths struct {
+	mu      sync.Mutex
+	paths   map[uint64]string
+	scanned time.Time
+}
+
+// NewCgroupPaths returns an empty resolver.
+func NewCgroupPaths() *CgroupPaths {
+	return &CgroupPaths{paths: make(map[uint64]string)}
+}
+
+// Path returns the path of cgroup id, e.g. /system.slice/nginx.service.
+// An ID not seen yet has the hierarchy walked again, at most once every
+// Rescan, which also forgets the cgroups removed since.
+func (c *CgroupPaths) Path(id uint64) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p, ok := c.paths[id]; ok {
+		return p, true
+	}
+	if time.Since(c.scanned) < Rescan {
+		return "", false
+	}
+	c.scanned = time.Now()
+	paths := make(map[uint64]string, len(c.paths))
+	if err := walkCgroups("/", func(id uint64, path string) { paths[id] = path }); err != nil {
+		return "", false
+	}
+	c.paths = paths
+	p, ok := paths[id]
+	return p, ok
+}
+
+// CgroupMemory is the memory of a cgroup v2 and its limits, in bytes,
+// from its memory.current, memory.high and memory.max. A limit of 0 is
+// none: "max", or the root cgroup, which has no limit files.
+type CgroupMemory struct {
+	Current uint64
+	High    uint64
+	Max     uint64
+}
+
+// ReadCgroupMemory reads the memory of the cgroup at path; it fails for
+// cgroups without the memory controller enabled.
+func ReadCgroupMemory(path string) (CgroupMemory, error) {
+	var m CgroupMemory
+	dir := filepath.Join(CgroupRoot, path)
+	for _, f := range []struct {
+		name  string
+		value *uint64
+	}{
+		{"memory.current", &m.Current},
+		{"memory.high", &m.High},
+		{"memory.max", &m.Max},
+	} {
+		raw, err := os.ReadFile(filepath.Join(dir, f.name))
+		if errors.Is(err, os.ErrNotExist) && f.name != "memory.current" {
+			continue
+		}
+		if err != nil {
+			return CgroupMemory{}, err
+		}
+		s := strings.TrimSpace(string(raw))
+		if s == "max" {
+			continue
+		}
+		if *f.value, err = strconv.ParseUint(s, 10, 64); err != nil {
+			return CgroupMemory{}, err
+		}
+	}
+	return m, nil
+}
+
+// CgroupCPU is the CPU time of a cgroup v2 and its throttling, from its
+// cpu.stat, and its bandwidth limit from cpu.max. The counters only grow;
+// the throttling ones are 0 without the cpu controller enabled. A quota
+// of 0 is none: "max", or the root cgroup.
+type CgroupCPU struct {
+	UsageUsec     uint64
+	NrPeriods     uint64
+	NrThrottled   uint64
+	ThrottledUsec uint64
+	QuotaUsec     uint64
+	PeriodUsec    uint64
+}
+
+// Limit is the CPUs the quota allows per period, 0 without one.
+func (c CgroupCPU) Limit() float64 {
+	if c.QuotaUsec == 0 || c.PeriodUsec == 0 {
+		return 0
+	}
+	return float64(c.QuotaUsec) / float64(c.PeriodUsec)
+}
+
+// ReadCgroupCPU reads the CPU time and throttling of the cgroup at path.
+func ReadCgroupCPU(path string) (CgroupCPU, error) {
+	var c CgroupCPU
+	dir := filepath.Join(CgroupRoot, path)
+	raw, err := os.ReadFile(filepath.Join(dir, "cpu.stat"))
+	if err != nil {
+		return CgroupCPU{}, err
+	}
+	fields := map[string]*uint64{
+		"usage_usec":     &c.UsageUsec,
+		"nr_periods":     &c.NrPeriods,
+		"nr_throttled":   &c.NrThrottled,
+		"throttled_usec": &c.ThrottledUsec,
+	}
+	for _, line := range strings.Split(string(raw), "\n") {
+		key, value, ok := strings.Cut(line, " ")
+		if field := fields[key]; ok && field != nil {
+			if *field, err = strconv.ParseUint(strings.TrimSpace(value), 10, 64); err != nil {
+				return CgroupCPU{}, fmt.Errorf("%s: %v", key, err)
+			}
+		}
+	}
+
+	// cpu.max is "$MAX $PERIOD", MAX being "max" without a quota
+	raw, err = os.ReadFile(filepath.Join(dir, "cpu.max"))
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return CgroupCPU{}, err
+	}
+	quota, period, _ := strings.Cut(strings.TrimSpace(string(raw)), " ")
+	if quota != "max" {
+		if c.QuotaUsec, err = strconv.ParseUint(quota, 10, 64); err != nil {
+			return CgroupCPU{}, fmt.Errorf("cpu.max: %v", err)
+		}
+		if c.PeriodUsec, err = strconv.ParseUint(period, 10, 64); err != nil {
+			return CgroupCPU{}, fmt.Errorf("cpu.max: %v", err)
+		}
+	}
+	return c, nil
+}
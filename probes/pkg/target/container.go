@@ -0,0 +1,154 @@
+package target
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Where container runtimes keep container metadata. Agents running in a
+// container with the host's directories mounted elsewhere override them.
+var (
+	// DockerRoot holds containers/<id>/config.v2.json with the labels.
+	DockerRoot = "/var/lib/docker"
+	// ContainerdState holds the OCI bundles of running containers,
+	// io.containerd.runtime.v2.task/<namespace>/<id>/config.json, whose
+	// annotations carry the pod, e.g. io.kubernetes.cri.sandbox-namespace.
+	ContainerdState = "/run/containerd"
+)
+
+// containerIDPattern finds the 64-hex-digit container ID in cgroup paths
+// such as /system.slice/docker-<id>.scope or
+// /kubepods.slice/.../cri-containerd-<id>.scope.
+var containerIDPattern = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// ContainerID returns the ID of the container a cgroup path belongs to, or
+// "" if it is not a container's.
+func ContainerID(cgroup string) string {
+	ids := containerIDPattern.FindAllString(cgroup, -1)
+	if len(ids) == 0 {
+		return ""
+	}
+	return ids[len(ids)-1]
+}
+
+// criImageName is the annotation containerd's CRI plugin records a
+// container's image under.
+const criImageName = "io.kubernetes.cri.image-name"
+
+// The labels, or annotations, Kubernetes names a container and its pod
+// by: dockershim's and cri-dockerd's labels, then containerd's CRI
+// annotations.
+var podNameKeys = [][3]string{
+	{"io.kubernetes.pod.namespace", "io.kubernetes.pod.name", "io.kubernetes.container.name"},
+	{"io.kubernetes.cri.sandbox-namespace", "io.kubernetes.cri.sandbox-name", "io.kubernetes.cri.container-name"},
+}
+
+// Labels caches container labels and images by ID. It is safe for
+// concurrent use.
+type Labels struct {
+	mu    sync.Mutex
+	cache map[string]*container
+}
+
+type container struct {
+	labels map[string]string
+	image  string
+	name   string
+}
+
+// NewLabels returns an empty cache.
+func NewLabels() *Labels {
+	return &Labels{cache: make(map[string]*container)}
+}
+
+// Get returns the labels of container id: Docker's labels merged with the
+// OCI annotations containerd keeps. Containers whose metadata cannot be
+// read have none; they are read again after Forget.
+func (l *Labels) Get(id string) map[string]string {
+	return l.read(id).labels
+}
+
+// Image returns the image container id was created from as its runtime
+// names it, e.g. "nginx:1.25" or "docker.io/library/nginx:1.25", or "" if
+// its metadata cannot be read.
+func (l *Labels) Image(id string) string {
+	return l.read(id).image
+}
+
+// Name returns the name of container id: namespace/pod/container for a
+// container of a Kubernetes pod, else the name its runtime gave it, or ""
+// if its metadata cannot be read.
+func (l *Labels) Name(id string) string {
+	c := l.read(id)
+	for _, keys := range podNameKeys {
+		ns, pod, name := c.labels[keys[0]], c.labels[keys[1]], c.labels[keys[2]]
+		if pod != "" && name != "" {
+			return ns + "/" + pod + "/" + name
+		}
+	}
+	return c.name
+}
+
+func (l *Labels) read(id string) *container {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if c, ok := l.cache[id]; ok {
+		return c
+	}
+	labels := make(map[string]string)
+	var image, name string
+	var docker struct {
+		Name   string
+		Config struct {
+			Image  string
+			Labels map[string]string
+		}
+	}
+	if readJSON(filepath.Join(DockerRoot, "containers", id, "config.v2.json"), &docker) {
+		for k, v := range docker.Config.Labels {
+			labels[k] = v
+		}
+		image = docker.Config.Image
+		name = strings.TrimPrefix(docker.Name, "/")
+	}
+	bundles, _ := filepath.Glob(filepath.Join(ContainerdState, "io.containerd.runtime.v2.task", "*", id, "config.json"))
+	for _, bundle := range bundles {
+		var spec struct {
+			Annotations map[string]string `json:"annotations"`
+		}
+		if readJSON(bundle, &spec) {
+			for k, v := range spec.Annotations {
+				labels[k] = v
+			}
+			if name := spec.Annotations[criImageName]; name != "" {
+				image = name
+			}
+		}
+	}
+	c := &container{labels: labels, image: image, name: name}
+	l.cache[id] = c
+	return c
+}
+
+// Forget drops the cached labels of containers not in live.
+func (l *Labels) Forget(live map[string]bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for id := range l.cache {
+		if !live[id] {
+			delete(l.cache, id)
+		}
+	}
+}
+
+func readJSON(file string, v interface{}) bool {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(data, v) == nil
+}
@@ -0,0 +1,381 @@
+package target
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cilium/ebpf"
+
+	"probepilot/pkg/procfs"
+)
+
+// Map names and limits shared with target.bpf.h.
+const (
+	configMap  = "target_config"
+	uidMap     = "target_uids"
+	cgroupMap  = "target_cgroups"
+	pidMap     = "target_pids"
+	commMap    = "target_comms"
+	maxCgroups = 4096
+	maxPIDs    = 16384
+	maxComms   = 256
+	commLen    = 16 // TASK_COMM_LEN, with the terminating NUL
+)
+
+// Verdict bits of the uid, cgroup and PID maps.
+const (
+	include uint8 = 1
+	exclude uint8 = 2
+)
+
+// CgroupRoot is where the cgroup v2 hierarchy is mounted.
+var CgroupRoot = "/sys/fs/cgroup"
+
+// Rescan is how often a Filter resolves cgroup and process selectors
+// again.
+const Rescan = 2 * time.Second
+
+// kernelConfig mirrors struct target_config.
+type kernelConfig struct {
+	Enabled uint32
+	Include uint32
+	UIDs    uint32
+	Cgroups uint32
+	Comms   uint32
+}
+
+// commKey mirrors struct target_comm_key.
+type commKey struct {
+	PrefixLen uint32 // in bits
+	Comm      [commLen]byte
+}
+
+// Filter keeps the target maps of one collection in line with a Config.
+// It is safe for concurrent use; a nil Filter scopes nothing.
+type Filter struct {
+	cfg     *Config
+	cgroups *ebpf.Map
+	pids    *ebpf.Map
+	labels  *Labels
+
+	// scan is set when some selector can only be resolved per process
+	scan bool
+	// static holds the verdicts of the PID selectors, kept in the PID
+	// map alongside those a scan resolves
+	static map[uint32]uint8
+
+	mu        sync.Mutex
+	cgroupSet map[uint64]uint8
+	pidSet    map[uint32]uint8
+	procs     map[uint32]*procfs.Process
+}
+
+// NewFilter loads cfg into the target maps of coll and resolves its
+// selectors once. A nil cfg leaves the filter off and returns nil.
+func NewFilter(coll *ebpf.Collection, cfg *Config) (*Filter, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	config, uids := coll.Maps[configMap], coll.Maps[uidMap]
+	cgroups, pids := coll.Maps[cgroupMap], coll.Maps[pidMap]
+	comms := coll.Maps[commMap]
+	if config == nil || uids == nil || cgroups == nil || pids == nil || comms == nil {
+		return nil, fmt.Errorf("no %s maps (include target.bpf.h)", configMap)
+	}
+	f := &Filter{
+		cfg:       cfg,
+		cgroups:   cgroups,
+		pids:      pids,
+		labels:    NewLabels(),
+		static:    make(map[uint32]uint8),
+		cgroupSet: make(map[uint64]uint8),
+		pidSet:    make(map[uint32]uint8),
+		procs:     make(map[uint32]*procfs.Process),
+	}
+
+	kc := kernelConfig{Enabled: 1}
+	if len(cfg.Include) > 0 {
+		kc.Include = 1
+	}
+	uidVerdicts := make(map[uint32]uint8)
+	commVerdicts := make(map[commKey]uint8)
+	cfg.each(func(s *Selector, verdict uint8) {
+		switch {
+		case s.uidOnly():
+			uidVerdicts[*s.UID] |= verdict
+		case s.pidOnly():
+			f.static[*s.PID] |= verdict
+		case s.cgroupOnly():
+			kc.Cgroups = 1
+		case s.prefixOnly():
+			for _, p := range s.prefixes {
+				key := commKey{PrefixLen: uint32(len(p)) * 8}
+				copy(key.Comm[:], p)
+				commVerdicts[key] |= verdict
+			}
+		default:
+			f.scan = true
+		}
+	})
+	for uid, v := range uidVerdicts {
+		if err := uids.Put(uid, v); err != nil {
+			return nil, fmt.Errorf("update %s: %w", uidMap, err)
+		}
+		kc.UIDs = 1
+	}
+	if len(commVerdicts) > maxComms {
+		return nil, fmt.Errorf("%s is full: %d comm prefixes, %d fit", commMap, len(commVerdicts), maxComms)
+	}
+	for key, v := range commVerdicts {
+		if err := comms.Put(key, v); err != nil {
+			return nil, fmt.Errorf("update %s: %w", commMap, err)
+		}
+		kc.Comms = 1
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+	// Turn the filter on once the maps hold the resolved selectors
+	if err := config.Put(uint32(0), kc); err != nil {
+		return nil, fmt.Errorf("update %s: %w", configMap, err)
+	}
+	return f, nil
+}
+
+// each calls fn with every selector and the verdict it hands out.
+func (c *Config) each(fn func(s *Selector, verdict uint8)) {
+	for i := range c.Include {
+		fn(&c.Include[i], include)
+	}
+	for i := range c.Exclude {
+		fn(&c.Exclude[i], exclude)
+	}
+}
+
+// Sync resolves the cgroup and process selectors again.
+func (f *Filter) Sync() error {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var errs []error
+	cgroups := make(map[uint64]uint8)
+	f.cfg.each(func(s *Selector, verdict uint8) {
+		if !s.cgroupOnly() {
+			return
+		}
+		if err := walkCgroups(s.Cgroup, func(id uint64, _ string) { cgroups[id] |= verdict }); err != nil {
+			errs = append(errs, err)
+		}
+	})
+	if err := syncMap(f.cgroups, cgroupMap, f.cgroupSet, cgroups, maxCgroups); err != nil {
+		errs = append(errs, err)
+	}
+
+	if f.scan || len(f.static) > 0 {
+		pids := make(map[uint32]uint8, len(f.static))
+		for pid, v := range f.static {
+			pids[pid] = v
+		}
+		if f.scan {
+			for pid, p := range f.rescan() {
+				var v uint8
+				f.cfg.each(func(s *Selector, verdict uint8) {
+					if !s.scanned() {
+						return
+					}
+					if s.Matches(p, f.labels.Get) {
+						v |= verdict
+					}
+				})
+				if v != 0 {
+					pids[pid] |= v
+				}
+			}
+		}
+		if err := syncMap(f.pids, pidMap, f.pidSet, pids, maxPIDs); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Add resolves the process selectors for p at once, rather than at the
+// next rescan, putting its verdict in the PID map. Agents set it as the
+// OnAdd of their procfs.Cache, so a process they come across is scoped
+// from then on.
+func (f *Filter) Add(p *procfs.Process) {
+	if f == nil || !f.scan {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.procs[p.PID] = p
+	v := f.static[p.PID]
+	f.cfg.each(func(s *Selector, verdict uint8) {
+		if s.scanned() && s.Matches(p, f.labels.Get) {
+			v |= verdict
+		}
+	})
+	have, ok := f.pidSet[p.PID]
+	switch {
+	case ok && have == v, !ok && v == 0:
+		return
+	case v == 0:
+		if err := f.pids.Delete(p.PID); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			log.Printf("Warning: targeting: update %s: %v", pidMap, err)
+			return
+		}
+		delete(f.pidSet, p.PID)
+		return
+	case !ok && len(f.pidSet) >= maxPIDs:
+		// The next rescan warns that the map is full
+		return
+	}
+	if err := f.pids.Put(p.PID, v); err != nil {
+		log.Printf("Warning: targeting: update %s: %v", pidMap, err)
+		return
+	}
+	f.pidSet[p.PID] = v
+}
+
+// rescan refreshes the processes read from procfs. Only new processes, and
+// those whose comm changed since, typically through exec, are read again.
+func (f *Filter) rescan() map[uint32]*procfs.Process {
+	pids, err := procfs.ListPIDs()
+	if err != nil {
+		return f.procs
+	}
+	live := make(map[uint32]bool, len(pids))
+	containers := make(map[string]bool)
+	for _, pid := range pids {
+		live[pid] = true
+		raw, err := os.ReadFile(procfs.Path(strconv.FormatUint(uint64(pid), 10), "comm"))
+		if err != nil {
+			continue
+		}
+		p := f.procs[pid]
+		if p == nil || p.Comm != strings.TrimSuffix(string(raw), "\n") {
+			if p, err = procfs.ReadProcess(pid); err != nil {
+				continue
+			}
+			f.procs[pid] = p
+		}
+		if id := ContainerID(p.Cgroup); id != "" {
+			containers[id] = true
+		}
+	}
+	for pid := range f.procs {
+		if !live[pid] {
+			delete(f.procs, pid)
+		}
+	}
+	f.labels.Forget(containers)
+	return f.procs
+}
+
+// walkCgroups calls fn with the ID and path of the cgroup at path and of
+// every cgroup below it.
+func walkCgroups(path string, fn func(id uint64, path string)) error {
+	root := filepath.Join(CgroupRoot, path)
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == root {
+				return fmt.Errorf("cgroup %s: %w", path, err)
+			}
+			// Cgroups come and go while we walk
+			return nil
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if id, ok := cgroupID(info); ok {
+			rel, _ := filepath.Rel(CgroupRoot, p)
+			fn(id, filepath.Join("/", rel))
+		}
+		return nil
+	})
+}
+
+// syncMap makes m hold want, given that it holds have, and leaves have
+// equal to what m holds.
+func syncMap[K comparable](m *ebpf.Map, name string, have, want map[K]uint8, limit int) error {
+	for k := range have {
+		if _, ok := want[k]; ok {
+			continue
+		}
+		if err := m.Delete(k); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return fmt.Errorf("update %s: %w", name, err)
+		}
+		delete(have, k)
+	}
+	for k, v := range want {
+		if have[k] == v {
+			continue
+		}
+		if _, ok := have[k]; !ok && len(have) >= limit {
+			return fmt.Errorf("%s is full: %d entries match, %d fit", name, len(want), limit)
+		}
+		if err := m.Put(k, v); err != nil {
+			return fmt.Errorf("update %s: %w", name, err)
+		}
+		have[k] = v
+	}
+	return nil
+}
+
+// Run resolves the selectors every Rescan until ctx is done, logging what
+// fails.
+func (f *Filter) Run(ctx context.Context) {
+	if f == nil || (!f.scan && !f.hasCgroups()) {
+		return
+	}
+	ticker := time.NewTicker(Rescan)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := f.Sync(); err != nil {
+				log.Printf("Warning: targeting: %v", err)
+			}
+		}
+	}
+}
+
+// scanned reports selectors that a scan resolves to processes.
+func (s *Selector) scanned() bool {
+	return !s.uidOnly() && !s.pidOnly() && !s.cgroupOnly() && !s.prefixOnly()
+}
+
+func (f *Filter) hasCgroups() bool {
+	found := false
+	f.cfg.each(func(s *Selector, _ uint8) { found = found || s.cgroupOnly() })
+	return found
+}
+
+// String summarises the selectors and what they resolved to.
+func (f *Filter) String() string {
+	if f == nil {
+		return "all processes"
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return fmt.Sprintf("%s (%d cgroups, %d processes resolved)", f.cfg, len(f.cgroupSet), len(f.pidSet))
+}
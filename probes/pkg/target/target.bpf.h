@@ -0,0 +1,121 @@
+/*
+ * In-kernel process targeting shared by every probe
+ *
+ * Programs that include this header drop events of processes outside the
+ * scope of the agent's -targets file before reserving ring buffer space:
+ *
+ *     if (!target_allowed())
+ *         return 0;
+ *
+ * target.Filter fills the maps: uids, PIDs and comm prefixes straight
+ * from the selectors, cgroup IDs of the selected cgroups and their
+ * descendants, and the TGIDs of the processes the other selectors match.
+ * Comm prefixes are matched against the process's name, its thread group
+ * leader's comm, as /proc/<pid>/comm shows it. Each entry holds verdict
+ * bits; a process is dropped if any of its entries excludes it, or if the
+ * file has include selectors and none of its entries includes it. While
+ * the filter is off every process passes.
+ */
+
+#ifndef __PROBEPILOT_TARGET_BPF_H
+#define __PROBEPILOT_TARGET_BPF_H
+
+#define TARGET_INCLUDE 1
+#define TARGET_EXCLUDE 2
+
+#define TARGET_CGROUPS_MAX 4096
+#define TARGET_PIDS_MAX 16384
+#define TARGET_COMMS_MAX 256
+#define TARGET_COMM_LEN 16
+
+struct target_config {
+    __u32 enabled;
+    __u32 include;  // the file has include selectors
+    __u32 uids;     // target_uids has entries
+    __u32 cgroups;  // target_cgroups has entries
+    __u32 comms;    // target_comms has entries
+};
+
+// A comm prefix of prefixlen bits; looking up a whole comm finds the
+// longest prefix it starts with
+struct target_comm_key {
+    __u32 prefixlen;
+    char comm[TARGET_COMM_LEN];
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, 1);
+    __type(key, __u32);
+    __type(value, struct target_config);
+} target_config SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 256);
+    __type(key, __u32);  // real UID
+    __type(value, __u8);
+} target_uids SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, TARGET_CGROUPS_MAX);
+    __type(key, __u64);  // cgroup v2 ID
+    __type(value, __u8);
+} target_cgroups SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, TARGET_PIDS_MAX);
+    __type(key, __u32);  // TGID
+    __type(value, __u8);
+} target_pids SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+    __uint(max_entries, TARGET_COMMS_MAX);
+    __uint(map_flags, BPF_F_NO_PREALLOC);
+    __type(key, struct target_comm_key);
+    __type(value, __u8);
+} target_comms SEC(".maps");
+
+static __always_inline bool target_allowed(void)
+{
+    __u32 key = 0;
+    struct target_config *cfg = bpf_map_lookup_elem(&target_config, &key);
+    __u8 verdict = 0, *v;
+
+    if (!cfg || !cfg->enabled)
+        return true;
+
+    __u32 pid = bpf_get_current_pid_tgid() >> 32;
+    v = bpf_map_lookup_elem(&target_pids, &pid);
+    if (v)
+        verdict |= *v;
+    if (cfg->uids) {
+        __u32 uid = (__u32)bpf_get_current_uid_gid();
+        v = bpf_map_lookup_elem(&target_uids, &uid);
+        if (v)
+            verdict |= *v;
+    }
+    if (cfg->cgroups) {
+        __u64 cgroup = bpf_get_current_cgroup_id();
+        v = bpf_map_lookup_elem(&target_cgroups, &cgroup);
+        if (v)
+            verdict |= *v;
+    }
+    if (cfg->comms) {
+        struct task_struct *task = (struct task_struct *)bpf_get_current_task();
+        struct target_comm_key comm = {.prefixlen = TARGET_COMM_LEN * 8};
+        BPF_CORE_READ_INTO(&comm.comm, task, group_leader, comm);
+        v = bpf_map_lookup_elem(&target_comms, &comm);
+        if (v)
+            verdict |= *v;
+    }
+
+    if (verdict & TARGET_EXCLUDE)
+        return false;
+    return !cfg->include || (verdict & TARGET_INCLUDE);
+}
+
+#endif /* __PROBEPILOT_TARGET_BPF_H */
@@ -0,0 +1,326 @@
+// Package target scopes every probe of an agent to the same processes. A
+// targeting file, shared by all agents, lists which processes to include
+// and exclude:
+//
+//	{
+//	  "schema": "targets/1.0",
+//	  "include": [
+//	    {"cgroup": "/kubepods.slice"},
+//	    {"comm": "^(postgres|pgbouncer)$", "uid": 70},
+//	    {"pid": 4242}
+//	  ],
+//	  "exclude": [
+//	    {"container": "io.kubernetes.pod.namespace=kube-system"},
+//	    {"comm": "^probepilot"}
+//	  ]
+//	}
+//
+// A selector matches the processes that satisfy all of its fields: comm
+// is a regular expression over the kernel's task name, uid the real user
+// ID, pid a process ID, cgroup a cgroup v2 path that also covers the
+// cgroups below it, and container a key=value label or annotation of the
+// process's container. A process is in scope if no exclude selector
+// matches it and, when there are include selectors, one of them does. The
+// -pid, -comm and -cgroup-path flags are shorthands for include
+// selectors, for scoping an agent without writing a file.
+//
+// The decision is made in the kernel, by programs that include
+// target.bpf.h, before they emit an event. Selectors of a uid or pid
+// alone, and the comm prefixes of -comm, are checked there directly.
+// Selectors of a cgroup alone are expanded to the cgroup and its
+// descendants, and all other selectors to the processes they match, by a
+// Filter that rescans every Rescan; a new cgroup or process is scoped
+// within that interval.
+package target
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"probepilot/pkg/procfs"
+	"probepilot/pkg/schema"
+)
+
+// Selector picks processes; empty fields match anything.
+type Selector struct {
+	Comm      string  `json:"comm,omitempty"`
+	UID       *uint32 `json:"uid,omitempty"`
+	PID       *uint32 `json:"pid,omitempty"`
+	Cgroup    string  `json:"cgroup,omitempty"`
+	Container string  `json:"container,omitempty"`
+
+	comm *regexp.Regexp
+	// prefixes are the literal prefixes -comm made Comm of, which the
+	// kernel can match itself
+	prefixes   []string
+	labelKey   string
+	labelValue string
+}
+
+func (s Selector) String() string {
+	var parts []string
+	if s.Comm != "" {
+		parts = append(parts, "comm=~"+strconv.Quote(s.Comm))
+	}
+	if s.UID != nil {
+		parts = append(parts, "uid="+strconv.FormatUint(uint64(*s.UID), 10))
+	}
+	if s.PID != nil {
+		parts = append(parts, "pid="+strconv.FormatUint(uint64(*s.PID), 10))
+	}
+	if s.Cgroup != "" {
+		parts = append(parts, "cgroup="+s.Cgroup)
+	}
+	if s.Container != "" {
+		parts = append(parts, "container="+s.Container)
+	}
+	return strings.Join(parts, " ")
+}
+
+func (s *Selector) compile() error {
+	if s.Comm == "" && s.UID == nil && s.PID == nil && s.Cgroup == "" && s.Container == "" {
+		return fmt.Errorf("empty selector")
+	}
+	if s.PID != nil && *s.PID == 0 {
+		return fmt.Errorf("pid 0: not a process")
+	}
+	if s.Comm != "" {
+		re, err := regexp.Compile(s.Comm)
+		if err != nil {
+			return fmt.Errorf("comm: %v", err)
+		}
+		s.comm = re
+	}
+	if s.Cgroup != "" {
+		if !strings.HasPrefix(s.Cgroup, "/") {
+			return fmt.Errorf("cgroup %q: not an absolute path", s.Cgroup)
+		}
+		s.Cgroup = path.Clean(s.Cgroup)
+	}
+	if s.Container != "" {
+		key, value, ok := strings.Cut(s.Container, "=")
+		if !ok || key == "" {
+			return fmt.Errorf("container %q: want key=value", s.Container)
+		}
+		s.labelKey, s.labelValue = key, value
+	}
+	return nil
+}
+
+// uidOnly, pidOnly, cgroupOnly and prefixOnly report selectors the kernel
+// checks without a process scan.
+func (s *Selector) uidOnly() bool {
+	return s.UID != nil && s.Comm == "" && s.PID == nil && s.Cgroup == "" && s.Container == ""
+}
+
+func (s *Selector) pidOnly() bool {
+	return s.PID != nil && s.Comm == "" && s.UID == nil && s.Cgroup == "" && s.Container == ""
+}
+
+func (s *Selector) cgroupOnly() bool {
+	return s.Cgroup != "" && s.Comm == "" && s.UID == nil && s.PID == nil && s.Container == ""
+}
+
+func (s *Selector) prefixOnly() bool {
+	return len(s.prefixes) > 0 && s.UID == nil && s.PID == nil && s.Cgroup == "" && s.Container == ""
+}
+
+// Matches reports whether p satisfies every field of s; labels looks up
+// the labels of a container by ID.
+func (s *Selector) Matches(p *procfs.Process, labels func(id string) map[string]string) bool {
+	if s.comm != nil && !s.comm.MatchString(p.Comm) {
+		return false
+	}
+	if s.UID != nil && p.UID != *s.UID {
+		return false
+	}
+	if s.PID != nil && p.PID != *s.PID {
+		return false
+	}
+	if s.Cgroup != "" && !underCgroup(p.Cgroup, s.Cgroup) {
+		return false
+	}
+	if s.Container != "" {
+		id := ContainerID(p.Cgroup)
+		if id == "" {
+			return false
+		}
+		v, ok := labels(id)[s.labelKey]
+		if !ok || v != s.labelValue {
+			return false
+		}
+	}
+	return true
+}
+
+func underCgroup(cgroup, root string) bool {
+	return root == "/" || cgroup == root || strings.HasPrefix(cgroup, root+"/")
+}
+
+// Config is the targeting file.
+type Config struct {
+	// Schema is the targets schema the file was written for, e.g.
+	// "targets/1.0"; files without one are read as 1.0.
+	Schema  string     `json:"schema,omitempty"`
+	Include []Selector `json:"include,omitempty"`
+	Exclude []Selector `json:"exclude,omitempty"`
+}
+
+// Load reads a targeting file. An empty path means every process is in
+// scope and returns nil.
+func Load(file string) (*Config, error) {
+	if file == "" {
+		return nil, nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var cfg Config
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return &cfg, nil
+}
+
+// RegisterFlags defines -targets and its shorthands on fs: -pid scopes to
+// a comma-separated list of processes, -comm to processes whose name
+// starts with one of a comma-separated list of prefixes, -cgroup-path to
+// a comma-separated list of cgroups. Given together they narrow each
+// other. The returned function loads the targeting file once fs has been
+// parsed and adds an include selector per PID and cgroup, also matching
+// -comm if given.
+func RegisterFlags(fs *flag.FlagSet) func() (*Config, error) {
+	file := fs.String("targets", "",
+		"JSON file of processes to include and exclude, shared by all agents (all processes if empty)")
+	pidList := fs.String("pid", "",
+		"comma-separated PIDs to scope to, e.g. 1234,5678 (all processes if empty)")
+	comms := fs.String("comm", "",
+		"comma-separated process name prefixes to scope to, e.g. java,postgres (all processes if empty)")
+	cgroups := fs.String("cgroup-path", "",
+		"comma-separated cgroup v2 paths to scope to, e.g. /kubepods.slice (all cgroups if empty)")
+
+	return func() (*Config, error) {
+		cfg, err := Load(*file)
+		if err != nil || (*pidList == "" && *comms == "" && *cgroups == "") {
+			return cfg, err
+		}
+		if cfg == nil {
+			cfg = &Config{}
+		}
+		if len(cfg.Include) > 0 {
+			return nil, fmt.Errorf("-pid, -comm and -cgroup-path cannot be combined with the include selectors of %s", *file)
+		}
+		var comm string
+		var prefixes []string
+		if *comms != "" {
+			var quoted []string
+			for _, p := range strings.Split(*comms, ",") {
+				if p = strings.TrimSpace(p); p == "" {
+					continue
+				}
+				if len(p) >= commLen {
+					return nil, fmt.Errorf("invalid -comm: %q is longer than a process name (%d characters)", p, commLen-1)
+				}
+				prefixes = append(prefixes, p)
+				quoted = append(quoted, regexp.QuoteMeta(p))
+			}
+			comm = "^(" + strings.Join(quoted, "|") + ")"
+		}
+		pids := []*uint32{nil}
+		if *pidList != "" {
+			pids = nil
+			for _, field := range strings.Split(*pidList, ",") {
+				pid, err := strconv.ParseUint(strings.TrimSpace(field), 10, 32)
+				if err != nil {
+					return nil, fmt.Errorf("invalid -pid %q: %v", field, err)
+				}
+				p := uint32(pid)
+				pids = append(pids, &p)
+			}
+		}
+		paths := []string{""}
+		if *cgroups != "" {
+			paths = strings.Split(*cgroups, ",")
+		}
+		for _, pid := range pids {
+			for _, p := range paths {
+				s := Selector{Comm: comm, PID: pid, Cgroup: strings.TrimSpace(p), prefixes: prefixes}
+				if err := s.compile(); err != nil {
+					return nil, fmt.Errorf("invalid -pid, -comm or -cgroup-path: %v", err)
+				}
+				cfg.Include = append(cfg.Include, s)
+			}
+		}
+		return cfg, nil
+	}
+}
+
+func (c *Config) validate() error {
+	if err := schema.Check(schema.Targets, c.Schema); err != nil {
+		return fmt.Errorf("schema: %v", err)
+	}
+	for i := range c.Include {
+		if err := c.Include[i].compile(); err != nil {
+			return fmt.Errorf("include %d: %v", i, err)
+		}
+	}
+	for i := range c.Exclude {
+		if err := c.Exclude[i].compile(); err != nil {
+			return fmt.Errorf("exclude %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// Allowed reports whether p is in scope; labels looks up the labels of a
+// container by ID. A nil Config allows every process.
+func (c *Config) Allowed(p *procfs.Process, labels func(id string) map[string]string) bool {
+	if c == nil {
+		return true
+	}
+	for i := range c.Exclude {
+		if c.Exclude[i].Matches(p, labels) {
+			return false
+		}
+	}
+	if len(c.Include) == 0 {
+		return true
+	}
+	for i := range c.Include {
+		if c.Include[i].Matches(p, labels) {
+			return true
+		}
+	}
+	return false
+}
+
+// String summarises the file, e.g. "include 2, exclude 1 selectors".
+func (c *Config) String() string {
+	if c == nil {
+		return "all processes"
+	}
+	var parts []string
+	if len(c.Include) > 0 {
+		parts = append(parts, fmt.Sprintf("include %d", len(c.Include)))
+	}
+	if len(c.Exclude) > 0 {
+		parts = append(parts, fmt.Sprintf("exclude %d", len(c.Exclude)))
+	}
+	if len(parts) == 0 {
+		return "all processes"
+	}
+	return strings.Join(parts, ", ") + " selectors"
+}
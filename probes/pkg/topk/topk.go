@@ -0,0 +1,177 @@
+// Package topk keeps the heaviest keys of an unbounded stream, such as the
+// busiest processes, flows or stacks on a host churning through hundreds
+// of thousands of short-lived ones, in a fixed number of entries.
+//
+// Sketch implements SpaceSaving (Metwally et al.): once full, an unseen key
+// takes over the lightest entry and inherits its weight as an upper bound
+// on what the new key may have had before it was tracked. Every key whose
+// true weight exceeds total/capacity is guaranteed to be kept, and each
+// reported weight overestimates the truth by at most its Error.
+package topk
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// Item is one tracked key.
+type Item[K comparable, V any] struct {
+	Key K
+	// Weight is the key's estimated total weight, an upper bound.
+	Weight uint64
+	// Error bounds the overestimate: the true weight is at least
+	// Weight-Error.
+	Error uint64
+	// Value is the caller's aggregate for the key, reset when the key
+	// takes over an evicted entry.
+	Value *V
+
+	index int
+}
+
+// Sketch tracks at most a fixed number of keys. It is not safe for
+// concurrent use.
+type Sketch[K comparable, V any] struct {
+	// OnEvict, if set, is called with every key displaced by a heavier
+	// newcomer and its aggregate, before the aggregate is reset.
+	OnEvict func(key K, value *V)
+
+	capacity int
+	items    map[K]*Item[K, V]
+	heap     minHeap[K, V]
+	evicted  uint64
+	total    uint64
+}
+
+// New returns a sketch keeping at most capacity keys (at least one).
+func New[K comparable, V any](capacity int) *Sketch[K, V] {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &Sketch[K, V]{
+		capacity: capacity,
+		items:    make(map[K]*Item[K, V], capacity),
+	}
+}
+
+// Add adds weight to key and returns its aggregate for updating. An
+// unseen key is tracked at the expense of the lightest key if the sketch
+// is full.
+func (s *Sketch[K, V]) Add(key K, weight uint64) *V {
+	s.total += weight
+	if it, ok := s.items[key]; ok {
+		it.Weight += weight
+		heap.Fix(&s.heap, it.index)
+		return it.Value
+	}
+	if len(s.items) < s.capacity {
+		it := &Item[K, V]{Key: key, Weight: weight, Value: new(V)}
+		s.items[key] = it
+		heap.Push(&s.heap, it)
+		return it.Value
+	}
+
+	// Take over the lightest entry in place
+	it := s.heap[0]
+	delete(s.items, it.Key)
+	s.evicted++
+	if s.OnEvict != nil {
+		s.OnEvict(it.Key, it.Value)
+	}
+	it.Key, it.Error, it.Value = key, it.Weight, new(V)
+	it.Weight += weight
+	s.items[key] = it
+	heap.Fix(&s.heap, 0)
+	return it.Value
+}
+
+// Get returns the aggregate of key if it is tracked.
+func (s *Sketch[K, V]) Get(key K) (*V, bool) {
+	it, ok := s.items[key]
+	if !ok {
+		return nil, false
+	}
+	return it.Value, true
+}
+
+// Remove stops tracking key, e.g. when its process exits.
+func (s *Sketch[K, V]) Remove(key K) {
+	it, ok := s.items[key]
+	if !ok {
+		return
+	}
+	delete(s.items, key)
+	heap.Remove(&s.heap, it.index)
+}
+
+// Len returns the number of tracked keys.
+func (s *Sketch[K, V]) Len() int {
+	return len(s.items)
+}
+
+// Capacity returns the most keys the sketch tracks.
+func (s *Sketch[K, V]) Capacity() int {
+	return s.capacity
+}
+
+// Evicted returns how many keys were displaced by heavier newcomers.
+func (s *Sketch[K, V]) Evicted() uint64 {
+	return s.evicted
+}
+
+// Total returns the weight added over the sketch's lifetime, tracked or
+// not.
+func (s *Sketch[K, V]) Total() uint64 {
+	return s.total
+}
+
+// Each calls fn for every tracked key in no particular order, stopping
+// early if fn returns false. fn must not add or remove keys.
+func (s *Sketch[K, V]) Each(fn func(key K, value *V) bool) {
+	for key, it := range s.items {
+		if !fn(key, it.Value) {
+			return
+		}
+	}
+}
+
+// Top returns the n heaviest keys, heaviest first; n <= 0 returns all.
+func (s *Sketch[K, V]) Top(n int) []Item[K, V] {
+	items := make([]Item[K, V], 0, len(s.heap))
+	for _, it := range s.heap {
+		items = append(items, *it)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Weight > items[j].Weight
+	})
+	if n > 0 && len(items) > n {
+		items = items[:n]
+	}
+	return items
+}
+
+// minHeap orders items by weight, lightest first.
+type minHeap[K comparable, V any] []*Item[K, V]
+
+func (h minHeap[K, V]) Len() int           { return len(h) }
+func (h minHeap[K, V]) Less(i, j int) bool { return h[i].Weight < h[j].Weight }
+
+func (h minHeap[K, V]) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *minHeap[K, V]) Push(x any) {
+	it := x.(*Item[K, V])
+	it.index = len(*h)
+	*h = append(*h, it)
+}
+
+func (h *minHeap[K, V]) Pop() any {
+	old := *h
+	it := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return it
+}
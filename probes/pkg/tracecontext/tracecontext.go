@@ -0,0 +1,148 @@
+// Package tracecontext extracts W3C Trace Context (traceparent) headers
+// from captured HTTP/1.x payloads, so kernel-level events can carry the
+// trace and span IDs of the request they belong to and be joined with
+// application traces in Jaeger or Tempo.
+package tracecontext
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// TraceContext is a parsed traceparent header.
+type TraceContext struct {
+	Version  byte
+	TraceID  [16]byte
+	ParentID [8]byte
+	Flags    byte
+	// State is the raw tracestate header, if the payload had one.
+	State string
+}
+
+// Sampled reports whether the caller recorded the trace.
+func (tc TraceContext) Sampled() bool {
+	return tc.Flags&0x01 != 0
+}
+
+// TraceIDString renders the trace ID as 32 lowercase hex digits.
+func (tc TraceContext) TraceIDString() string {
+	return hex.EncodeToString(tc.TraceID[:])
+}
+
+// SpanIDString renders the parent (span) ID as 16 lowercase hex digits.
+func (tc TraceContext) SpanIDString() string {
+	return hex.EncodeToString(tc.ParentID[:])
+}
+
+// String renders tc as a traceparent header value.
+func (tc TraceContext) String() string {
+	return fmt.Sprintf("%02x-%s-%s-%02x", tc.Version, tc.TraceIDString(), tc.SpanIDString(), tc.Flags)
+}
+
+// ErrInvalid reports a malformed traceparent value.
+var ErrInvalid = errors.New("invalid traceparent")
+
+// Parse parses a traceparent value, e.g.
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01". Versions
+// after 00 may append fields, which are ignored as the spec requires.
+func Parse(s string) (TraceContext, error) {
+	var tc TraceContext
+	// version-traceid-parentid-flags
+	if len(s) < 55 || s[2] != '-' || s[35] != '-' || s[52] != '-' {
+		return tc, ErrInvalid
+	}
+	if len(s) > 55 && (s[:2] == "00" || s[55] != '-') {
+		return tc, ErrInvalid
+	}
+	if !lowerHex(s[:55]) {
+		return tc, ErrInvalid
+	}
+	version, _ := hex.DecodeString(s[0:2])
+	if version[0] == 0xff {
+		return tc, ErrInvalid
+	}
+	tc.Version = version[0]
+	hex.Decode(tc.TraceID[:], []byte(s[3:35]))
+	hex.Decode(tc.ParentID[:], []byte(s[36:52]))
+	flags, _ := hex.DecodeString(s[53:55])
+	tc.Flags = flags[0]
+	if tc.TraceID == ([16]byte{}) || tc.ParentID == ([8]byte{}) {
+		return TraceContext{}, ErrInvalid
+	}
+	return tc, nil
+}
+
+// lowerHex reports whether s holds only lowercase hex digits and the
+// dashes between fields.
+func lowerHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '-' && (i == 2 || i == 35 || i == 52) {
+			continue
+		}
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// httpMethods prefix the request lines worth scanning. Responses carry no
+// traceparent.
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("PUT "), []byte("DELETE "),
+	[]byte("HEAD "), []byte("PATCH "), []byte("OPTIONS "),
+}
+
+// IsRequest reports whether payload starts with an HTTP/1.x request line.
+func IsRequest(payload []byte) bool {
+	for _, m := range httpMethods {
+		if bytes.HasPrefix(payload, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// FromHTTP extracts the trace context from the headers of an HTTP/1.x
+// request at the start of payload. Captures are truncated, so headers cut
+// off mid-line are ignored rather than failing the whole request.
+func FromHTTP(payload []byte) (TraceContext, bool) {
+	if !IsRequest(payload) {
+		return TraceContext{}, false
+	}
+	var tc TraceContext
+	var found bool
+	var state string
+	lines := bytes.Split(payload, []byte("\n"))
+	// lines[0] is the request line; the last line may be truncated
+	for i, line := range lines[1:] {
+		if i == len(lines)-2 && !bytes.HasSuffix(payload, []byte("\n")) {
+			break
+		}
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if len(line) == 0 {
+			break // end of headers
+		}
+		name, value, ok := bytes.Cut(line, []byte(":"))
+		if !ok {
+			continue
+		}
+		value = bytes.TrimSpace(value)
+		switch string(bytes.ToLower(bytes.TrimSpace(name))) {
+		case "traceparent":
+			if parsed, err := Parse(string(value)); err == nil {
+				tc, found = parsed, true
+			}
+		case "tracestate":
+			state = string(value)
+		}
+	}
+	if !found {
+		return TraceContext{}, false
+	}
+	tc.State = state
+	return tc, true
+}
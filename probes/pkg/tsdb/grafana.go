@@ -0,0 +1,171 @@
+package tsdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// GrafanaPath is where Mount serves the history to Grafana, the URL of a
+// SimpleJSON or Infinity datasource, e.g. http://host:9464/grafana.
+const GrafanaPath = "/grafana"
+
+// aggregates are how a target reads each point, selected by a suffix such
+// as "tcp.bytes:max"; the mean is the default.
+var aggregates = map[string]func(Point) float64{
+	"mean":  Point.Mean,
+	"min":   func(p Point) float64 { return p.Min },
+	"max":   func(p Point) float64 { return p.Max },
+	"sum":   func(p Point) float64 { return p.Sum },
+	"count": func(p Point) float64 { return float64(p.Count) },
+	"last":  func(p Point) float64 { return p.Last },
+}
+
+// grafanaQuery is the body of POST /query.
+type grafanaQuery struct {
+	Range struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	} `json:"range"`
+	MaxDataPoints int `json:"maxDataPoints"`
+	Targets       []struct {
+		Target string `json:"target"`
+		Type   string `json:"type"`
+	} `json:"targets"`
+}
+
+// grafanaSeries is a time series in a /query response: values with their
+// times in milliseconds since the epoch.
+type grafanaSeries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+// grafanaTable is a table in a /query response, for targets of type
+// "table".
+type grafanaTable struct {
+	Type    string          `json:"type"`
+	Columns []grafanaColumn `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+type grafanaColumn struct {
+	Text string `json:"text"`
+	Type string `json:"type"`
+}
+
+// Mount serves the store under GrafanaPath the way Grafana's SimpleJSON
+// and Infinity datasources expect: GET / to test the connection, POST
+// /search for the series names, POST /query for the points of series
+// over a time range, as time series or tables, and POST /annotations,
+// which has none. Targets are series names, optionally suffixed with
+// ":min", ":max", ":sum", ":count" or ":last" to read buckets by other
+// than their mean. Ranges are served at the finest resolution that both
+// retains them and fits maxDataPoints.
+func (s *Store) Mount(mux *http.ServeMux) {
+	mux.HandleFunc(GrafanaPath+"/", func(w http.ResponseWriter, r *http.Request) {
+		switch strings.TrimPrefix(r.URL.Path, GrafanaPath) {
+		case "/":
+			w.WriteHeader(http.StatusOK)
+		case "/search":
+			s.grafanaSearch(w, r)
+		case "/query":
+			s.grafanaQuery(w, r)
+		case "/annotations":
+			writeGrafana(w, http.StatusOK, []struct{}{})
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+func (s *Store) grafanaSearch(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Target string `json:"target"`
+	}
+	if r.Body != nil {
+		// Older Grafana versions post no body
+		json.NewDecoder(r.Body).Decode(&req)
+	}
+	names := []string{}
+	for _, name := range s.Series() {
+		if strings.Contains(name, req.Target) {
+			names = append(names, name)
+		}
+	}
+	writeGrafana(w, http.StatusOK, names)
+}
+
+func (s *Store) grafanaQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeGrafana(w, http.StatusMethodNotAllowed, map[string]string{"error": "POST a query"})
+		return
+	}
+	var req grafanaQuery
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeGrafana(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	from, to := req.Range.From, req.Range.To
+	if to.IsZero() {
+		to = time.Now()
+	}
+	if from.IsZero() {
+		from = to.Add(-time.Hour)
+	}
+
+	results := []interface{}{}
+	for _, t := range req.Targets {
+		name, agg, ok := strings.Cut(t.Target, ":")
+		if !ok {
+			agg = "mean"
+		}
+		value, known := aggregates[agg]
+		if !known {
+			writeGrafana(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("unknown aggregate %q of %s", agg, t.Target)})
+			return
+		}
+		points := s.grafanaPoints(name, from, to, req.MaxDataPoints)
+		if t.Type == "table" {
+			table := grafanaTable{Type: "table", Columns: []grafanaColumn{{Text: "Time", Type: "time"}, {Text: t.Target, Type: "number"}}, Rows: [][]interface{}{}}
+			for _, p := range points {
+				table.Rows = append(table.Rows, []interface{}{p.Time.UnixMilli(), value(p)})
+			}
+			results = append(results, table)
+			continue
+		}
+		series := grafanaSeries{Target: t.Target, Datapoints: [][2]float64{}}
+		for _, p := range points {
+			series.Datapoints = append(series.Datapoints, [2]float64{value(p), float64(p.Time.UnixMilli())})
+		}
+		results = append(results, series)
+	}
+	writeGrafana(w, http.StatusOK, results)
+}
+
+// grafanaPoints returns the points of name within [from, to] at the finest
+// resolution retaining from, or a coarser one if that has more than
+// maxPoints points.
+func (s *Store) grafanaPoints(name string, from, to time.Time, maxPoints int) []Point {
+	points, res, ok := s.Query(name, from, to)
+	if !ok || maxPoints <= 0 || len(points) <= maxPoints {
+		return points
+	}
+	for _, coarser := range s.resolutions {
+		if coarser.Step <= res.Step {
+			continue
+		}
+		if points, ok = s.QueryAt(name, coarser.Step, from, to); ok && len(points) <= maxPoints {
+			break
+		}
+	}
+	return points
+}
+
+func writeGrafana(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
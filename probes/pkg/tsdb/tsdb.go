@@ -0,0 +1,301 @@
+// Package tsdb keeps the agent's local metric history in memory. Every
+// sample is folded into a set of resolutions (by default 1s, 1m and 1h
+// buckets), each with its own retention, so a long-running agent can
+// answer "last 24h" queries with bounded storage.
+package tsdb
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resolution is a bucket width and how long buckets of that width are kept.
+type Resolution struct {
+	Step      time.Duration
+	Retention time.Duration
+}
+
+func (r Resolution) String() string {
+	return fmt.Sprintf("%s:%s", r.Step, r.Retention)
+}
+
+// capacity is the number of buckets a series holds at this resolution.
+func (r Resolution) capacity() int {
+	return int(r.Retention / r.Step)
+}
+
+// DefaultResolutions keeps 1s points for an hour, 1m points for a day and
+// 1h points for 30 days.
+var DefaultResolutions = []Resolution{
+	{Step: time.Second, Retention: time.Hour},
+	{Step: time.Minute, Retention: 24 * time.Hour},
+	{Step: time.Hour, Retention: 30 * 24 * time.Hour},
+}
+
+// DefaultRetention is DefaultResolutions in the form accepted by
+// ParseResolutions.
+const DefaultRetention = "1s:1h,1m:24h,1h:720h"
+
+// ParseResolutions parses a comma-separated list of step:retention pairs,
+// e.g. "1s:1h,1m:24h,1h:720h".
+func ParseResolutions(s string) ([]Resolution, error) {
+	var res []Resolution
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		stepStr, retStr, ok := strings.Cut(pair, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid resolution %q (want step:retention)", pair)
+		}
+		step, err := time.ParseDuration(stepStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid resolution %q: %w", pair, err)
+		}
+		retention, err := time.ParseDuration(retStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid resolution %q: %w", pair, err)
+		}
+		res = append(res, Resolution{Step: step, Retention: retention})
+	}
+	if err := validate(res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// validate requires strictly coarser steps, each a multiple of the
+// previous one, and retentions that are at least one step long.
+func validate(res []Resolution) error {
+	if len(res) == 0 {
+		return fmt.Errorf("no resolutions configured")
+	}
+	for i, r := range res {
+		if r.Step <= 0 || r.Retention < r.Step {
+			return fmt.Errorf("resolution %s: retention must cover at least one positive step", r)
+		}
+		if i == 0 {
+			continue
+		}
+		prev := res[i-1]
+		if r.Step <= prev.Step || r.Step%prev.Step != 0 {
+			return fmt.Errorf("resolution %s: step must be a multiple of %s", r, prev.Step)
+		}
+	}
+	return nil
+}
+
+// Point is the aggregate of the samples that fell into one bucket.
+type Point struct {
+	Time  time.Time // bucket start
+	Count uint64
+	Sum   float64
+	Min   float64
+	Max   float64
+	Last  float64
+}
+
+// Mean is the average of the samples in the bucket.
+func (p Point) Mean() float64 {
+	if p.Count == 0 {
+		return 0
+	}
+	return p.Sum / float64(p.Count)
+}
+
+func (p *Point) add(v float64) {
+	if p.Count == 0 || v < p.Min {
+		p.Min = v
+	}
+	if p.Count == 0 || v > p.Max {
+		p.Max = v
+	}
+	p.Count++
+	p.Sum += v
+	p.Last = v
+}
+
+// Store holds named series at every configured resolution. It is safe for
+// concurrent use.
+type Store struct {
+	resolutions []Resolution
+
+	mu     sync.RWMutex
+	series map[string][]*tier
+}
+
+// tier is one resolution of a series: buckets sorted by time.
+type tier struct {
+	res    Resolution
+	points []Point
+}
+
+// New creates a store with the given resolutions, or DefaultResolutions if
+// none are given.
+func New(res ...Resolution) (*Store, error) {
+	if len(res) == 0 {
+		res = DefaultResolutions
+	}
+	if err := validate(res); err != nil {
+		return nil, err
+	}
+	return &Store{
+		resolutions: append([]Resolution(nil), res...),
+		series:      make(map[string][]*tier),
+	}, nil
+}
+
+// Resolutions returns the store's resolutions, finest first.
+func (s *Store) Resolutions() []Resolution {
+	return append([]Resolution(nil), s.resolutions...)
+}
+
+// Add records a sample. The sample is rolled up into every resolution
+// directly, so coarser buckets stay exact for count, sum, min and max.
+// Samples older than a resolution's retention are dropped from it.
+func (s *Store) Add(name string, t time.Time, v float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tiers, ok := s.series[name]
+	if !ok {
+		tiers = make([]*tier, len(s.resolutions))
+		for i, r := range s.resolutions {
+			tiers[i] = &tier{res: r}
+		}
+		s.series[name] = tiers
+	}
+	for _, tr := range tiers {
+		tr.add(t, v)
+	}
+}
+
+func (tr *tier) add(t time.Time, v float64) {
+	bucket := t.Truncate(tr.res.Step)
+
+	n := len(tr.points)
+	switch {
+	case n == 0 || bucket.After(tr.points[n-1].Time):
+		tr.points = append(tr.points, Point{Time: bucket})
+		tr.points[n].add(v)
+	case bucket.Equal(tr.points[n-1].Time):
+		tr.points[n-1].add(v)
+	default:
+		// Late sample: merge into its bucket if still retained
+		i := sort.Search(n, func(i int) bool { return !tr.points[i].Time.Before(bucket) })
+		if i == n {
+			return
+		}
+		if !tr.points[i].Time.Equal(bucket) {
+			if i == 0 && n >= tr.res.capacity() {
+				return
+			}
+			tr.points = append(tr.points, Point{})
+			copy(tr.points[i+1:], tr.points[i:])
+			tr.points[i] = Point{Time: bucket}
+		}
+		tr.points[i].add(v)
+	}
+	tr.prune()
+}
+
+// prune drops buckets that fell out of retention relative to the newest.
+func (tr *tier) prune() {
+	newest := tr.points[len(tr.points)-1].Time
+	cutoff := newest.Add(-tr.res.Retention)
+	i := sort.Search(len(tr.points), func(i int) bool { return tr.points[i].Time.After(cutoff) })
+	if i == 0 {
+		return
+	}
+	// Reuse the backing array instead of letting it grow unbounded
+	n := copy(tr.points, tr.points[i:])
+	tr.points = tr.points[:n]
+}
+
+// Query returns the points of name within [from, to] at the finest
+// resolution whose retention still covers from, falling back to the
+// coarsest. The second result is the resolution that was used.
+func (s *Store) Query(name string, from, to time.Time) ([]Point, Resolution, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tiers, ok := s.series[name]
+	if !ok {
+		return nil, Resolution{}, false
+	}
+	tr := tiers[len(tiers)-1]
+	for _, candidate := range tiers {
+		if len(candidate.points) > 0 && !candidate.points[0].Time.After(from.Truncate(candidate.res.Step)) {
+			tr = candidate
+			break
+		}
+	}
+	return tr.rangeOf(from, to), tr.res, true
+}
+
+// QueryAt returns the points of name within [from, to] at a specific step.
+func (s *Store) QueryAt(name string, step time.Duration, from, to time.Time) ([]Point, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, tr := range s.series[name] {
+		if tr.res.Step == step {
+			return tr.rangeOf(from, to), true
+		}
+	}
+	return nil, false
+}
+
+func (tr *tier) rangeOf(from, to time.Time) []Point {
+	from = from.Truncate(tr.res.Step)
+	lo := sort.Search(len(tr.points), func(i int) bool { return !tr.points[i].Time.Before(from) })
+	hi := sort.Search(len(tr.points), func(i int) bool { return tr.points[i].Time.After(to) })
+	if lo >= hi {
+		return nil
+	}
+	return append([]Point(nil), tr.points[lo:hi]...)
+}
+
+// Latest returns the most recent finest-resolution point of name.
+func (s *Store) Latest(name string) (Point, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tiers, ok := s.series[name]
+	if !ok || len(tiers[0].points) == 0 {
+		return Point{}, false
+	}
+	return tiers[0].points[len(tiers[0].points)-1], true
+}
+
+// Series returns the names of all series, sorted.
+func (s *Store) Series() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names := make([]string, 0, len(s.series))
+	for name := range s.series {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Len returns the number of buckets held across all series and
+// resolutions, for reporting the store's footprint.
+func (s *Store) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	total := 0
+	for _, tiers := range s.series {
+		for _, tr := range tiers {
+			total += len(tr.points)
+		}
+	}
+	return total
+}
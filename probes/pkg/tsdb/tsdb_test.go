@@ -0,0 +1,131 @@
+package tsdb
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+var t0 = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func TestParseResolutions(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []Resolution
+		wantErr bool
+	}{
+		{in: DefaultRetention, want: DefaultResolutions},
+		{in: " 10s:1m , 1m:1h ", want: []Resolution{{10 * time.Second, time.Minute}, {time.Minute, time.Hour}}},
+		{in: "", wantErr: true},
+		{in: "1s", wantErr: true},
+		{in: "1x:1h", wantErr: true},
+		{in: "1s:1y", wantErr: true},
+		{in: "1m:30s", wantErr: true},
+		{in: "0s:1h", wantErr: true},
+		{in: "1m:1h,1s:1h", wantErr: true},
+		{in: "2s:1h,3s:1h", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseResolutions(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseResolutions(%q) = %v, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseResolutions(%q): %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseResolutions(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestStoreRollup(t *testing.T) {
+	s, err := New(Resolution{time.Second, time.Minute}, Resolution{time.Minute, time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range []float64{4, 1, 7, 2} {
+		s.Add("cpu", t0.Add(time.Duration(i)*500*time.Millisecond), v)
+	}
+
+	fine, ok := s.QueryAt("cpu", time.Second, t0, t0.Add(time.Minute))
+	if !ok {
+		t.Fatal("no 1s tier")
+	}
+	want := []Point{
+		{Time: t0, Count: 2, Sum: 5, Min: 1, Max: 4, Last: 1},
+		{Time: t0.Add(time.Second), Count: 2, Sum: 9, Min: 2, Max: 7, Last: 2},
+	}
+	if !reflect.DeepEqual(fine, want) {
+		t.Errorf("1s points = %+v, want %+v", fine, want)
+	}
+
+	coarse, _ := s.QueryAt("cpu", time.Minute, t0, t0.Add(time.Hour))
+	if len(coarse) != 1 || coarse[0].Count != 4 || coarse[0].Min != 1 || coarse[0].Max != 7 || coarse[0].Mean() != 3.5 {
+		t.Errorf("1m points = %+v, want one bucket of 4 samples, min 1, max 7, mean 3.5", coarse)
+	}
+
+	if p, ok := s.Latest("cpu"); !ok || p.Last != 2 {
+		t.Errorf("Latest = %+v, %v, want last 2", p, ok)
+	}
+	if _, ok := s.Latest("mem"); ok {
+		t.Error("Latest of an unknown series succeeded")
+	}
+}
+
+func TestStoreRetention(t *testing.T) {
+	s, _ := New(Resolution{time.Second, 10 * time.Second})
+	for i := 0; i < 30; i++ {
+		s.Add("x", t0.Add(time.Duration(i)*time.Second), float64(i))
+	}
+	points, _ := s.QueryAt("x", time.Second, t0, t0.Add(time.Minute))
+	if len(points) != 10 || points[0].Last != 20 || points[9].Last != 29 {
+		t.Errorf("kept %d points from %v, want the 10 newest, 20 to 29", len(points), points)
+	}
+	if s.Len() != 10 {
+		t.Errorf("Len = %d, want 10", s.Len())
+	}
+}
+
+func TestStoreLateSample(t *testing.T) {
+	s, _ := New(Resolution{time.Second, 10 * time.Second})
+	s.Add("x", t0, 1)
+	s.Add("x", t0.Add(2*time.Second), 3)
+	s.Add("x", t0.Add(time.Second), 2)  // late, between retained buckets
+	s.Add("x", t0, 5)                   // late, into an existing bucket
+	s.Add("x", t0.Add(-time.Minute), 9) // older than retention
+
+	points, _ := s.QueryAt("x", time.Second, t0.Add(-time.Hour), t0.Add(time.Minute))
+	var got []float64
+	for _, p := range points {
+		got = append(got, p.Sum)
+	}
+	if want := []float64{6, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("bucket sums = %v, want %v", got, want)
+	}
+}
+
+func TestStoreQueryResolution(t *testing.T) {
+	s, _ := New(Resolution{time.Second, time.Minute}, Resolution{time.Minute, time.Hour})
+	for i := 0; i <= 600; i += 10 {
+		s.Add("x", t0.Add(time.Duration(i)*time.Second), 1)
+	}
+	end := t0.Add(10 * time.Minute)
+
+	if _, res, _ := s.Query("x", end.Add(-30*time.Second), end); res.Step != time.Second {
+		t.Errorf("recent query used %s, want 1s", res)
+	}
+	if _, res, _ := s.Query("x", t0, end); res.Step != time.Minute {
+		t.Errorf("query past the 1s retention used %s, want 1m", res)
+	}
+	if _, _, ok := s.Query("y", t0, end); ok {
+		t.Error("query of an unknown series succeeded")
+	}
+	if got := s.Series(); !reflect.DeepEqual(got, []string{"x"}) {
+		t.Errorf("Series = %v", got)
+	}
+}
@@ -0,0 +1,145 @@
+// Package units renders the quantities agents report for people, and
+// names the units of the metrics they export.
+//
+// Reports print sizes, durations, rates and frequencies through Bytes,
+// Duration, Rate and Hertz, so every agent shows them alike. Exports stay in base units,
+// bytes and seconds, named by the Prometheus convention of a unit suffix,
+// e.g. tcp_flow_rtt_avg_seconds or memory_allocated_bytes_total, which
+// OfMetric reads back for the unit metadata of OpenMetrics and OTLP.
+package units
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Units metric names end in.
+const (
+	BytesUnit   = "bytes"
+	SecondsUnit = "seconds"
+	PercentUnit = "percent"
+	RatioUnit   = "ratio"
+	HertzUnit   = "hertz"
+)
+
+// Bytes renders n bytes in binary multiples, e.g. "512B" or "1.5MB".
+func Bytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// Duration renders d with three significant digits in the unit that
+// suits it, e.g. "850ns", "12.3µs", "4.56ms" or "1.23s"; a minute or
+// more is rounded to the second, e.g. "2m3s".
+func Duration(d time.Duration) string {
+	abs := d
+	if abs < 0 {
+		abs = -abs
+	}
+	switch {
+	case abs < time.Microsecond:
+		return fmt.Sprintf("%dns", d.Nanoseconds())
+	case abs < time.Millisecond:
+		return significant(float64(d)/float64(time.Microsecond), "µs")
+	case abs < time.Second:
+		return significant(float64(d)/float64(time.Millisecond), "ms")
+	case abs < time.Minute:
+		return significant(d.Seconds(), "s")
+	}
+	return d.Round(time.Second).String()
+}
+
+// Seconds renders a duration given in seconds, as exported, like Duration.
+func Seconds(s float64) string {
+	return Duration(time.Duration(s * float64(time.Second)))
+}
+
+// Rate renders a rate of what per second with SI multiples, e.g.
+// "1.23K events/s".
+func Rate(perSecond float64, what string) string {
+	prefix := ""
+	for _, p := range []string{"K", "M", "G", "T"} {
+		if math.Abs(perSecond) < 1000 {
+			break
+		}
+		perSecond /= 1000
+		prefix = p
+	}
+	return significant(perSecond, prefix) + " " + what + "/s"
+}
+
+// Hertz renders a frequency with SI multiples, e.g. "800MHz" or
+// "3.50GHz".
+func Hertz(hz float64) string {
+	prefix := ""
+	for _, p := range []string{"K", "M", "G"} {
+		if math.Abs(hz) < 1000 {
+			break
+		}
+		hz /= 1000
+		prefix = p
+	}
+	return significant(hz, prefix+"Hz")
+}
+
+// ByteRate renders bytes per second in binary multiples, e.g. "1.5MB/s".
+func ByteRate(perSecond float64) string {
+	if perSecond < 0 {
+		perSecond = 0
+	}
+	return Bytes(uint64(perSecond)) + "/s"
+}
+
+// significant formats v with three significant digits.
+func significant(v float64, unit string) string {
+	switch abs := math.Abs(v); {
+	case abs >= 100:
+		return fmt.Sprintf("%.0f%s", v, unit)
+	case abs >= 10:
+		return fmt.Sprintf("%.1f%s", v, unit)
+	}
+	return fmt.Sprintf("%.2f%s", v, unit)
+}
+
+// OfMetric returns the unit a metric's name ends in, before any _total,
+// _bucket, _sum or _count suffix, or "" for counts and other
+// dimensionless metrics.
+func OfMetric(name string) string {
+	for _, suffix := range []string{"_total", "_bucket", "_sum", "_count"} {
+		name = strings.TrimSuffix(name, suffix)
+	}
+	for _, unit := range []string{BytesUnit, SecondsUnit, PercentUnit, RatioUnit, HertzUnit} {
+		if strings.HasSuffix(name, "_"+unit) {
+			return unit
+		}
+	}
+	return ""
+}
+
+// UCUM returns the UCUM code of a unit OfMetric returns, as OTLP wants
+// it, or "" if it has none.
+func UCUM(unit string) string {
+	switch unit {
+	case BytesUnit:
+		return "By"
+	case SecondsUnit:
+		return "s"
+	case PercentUnit:
+		return "%"
+	case RatioUnit:
+		return "1"
+	case HertzUnit:
+		return "Hz"
+	}
+	return ""
+}